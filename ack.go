@@ -0,0 +1,159 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// ackMethod is the reserved method name clients call to acknowledge a
+// message sent with CallWithAck. It cannot clash with a relay method as
+// it is not an exported Go identifier.
+const ackMethod = "__relayrAck"
+
+// ErrDisconnected is returned by CallWithAck when the client disconnects
+// before acknowledging the call.
+var ErrDisconnected = errors.New("relayr: client disconnected")
+
+// errNoAck is returned by CallWithAck for clients that did not say they
+// acknowledge calls as they negotiated.
+var errNoAck = errors.New("relayr: client does not acknowledge calls")
+
+// acks tracks the calls waiting to be acknowledged by each connection.
+type acks struct {
+	lock   sync.Mutex
+	next   uint64
+	byConn map[string]map[string]chan error
+}
+
+func newAcks() *acks {
+	return &acks{byConn: make(map[string]map[string]chan error)}
+}
+
+// add registers a call to the client with the given ConnectionID,
+// returning the ID to send with it and a channel that receives nil when
+// the client acknowledges it.
+func (a *acks) add(cid string) (string, <-chan error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.next++
+	id := strconv.FormatUint(a.next, 10)
+	ch := make(chan error, 1)
+	if a.byConn[cid] == nil {
+		a.byConn[cid] = make(map[string]chan error)
+	}
+	a.byConn[cid][id] = ch
+
+	return id, ch
+}
+
+// ack marks a call as acknowledged by the client that received it.
+func (a *acks) ack(cid, id string) {
+	a.lock.Lock()
+	ch, ok := a.byConn[cid][id]
+	a.lock.Unlock()
+
+	if ok {
+		select {
+		case ch <- nil:
+		default:
+		}
+	}
+}
+
+// remove forgets a call once it is no longer being waited on.
+func (a *acks) remove(cid, id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.byConn[cid], id)
+	if len(a.byConn[cid]) == 0 {
+		delete(a.byConn, cid)
+	}
+}
+
+// cancel fails every call waiting on a connection with ErrDisconnected.
+func (a *acks) cancel(cid string) {
+	a.lock.Lock()
+	calls := a.byConn[cid]
+	delete(a.byConn, cid)
+	a.lock.Unlock()
+
+	for _, ch := range calls {
+		select {
+		case ch <- ErrDisconnected:
+		default:
+		}
+	}
+}
+
+// cancelAll fails every call waiting to be acknowledged.
+func (a *acks) cancelAll() {
+	a.lock.Lock()
+	all := a.byConn
+	a.byConn = make(map[string]map[string]chan error)
+	a.lock.Unlock()
+
+	for _, calls := range all {
+		for _, ch := range calls {
+			select {
+			case ch <- ErrDisconnected:
+			default:
+			}
+		}
+	}
+}
+
+// receiveAck handles an acknowledgement sent by a client, whose only
+// argument is the ID of the call it acknowledges.
+func (e *Exchange) receiveAck(cid string, args []interface{}) {
+	if len(args) != 1 {
+		return
+	}
+	if id, ok := args[0].(string); ok {
+		e.acks.ack(cid, id)
+	}
+}
+
+// callWithAck sends a call to a single client and waits for the client
+// to acknowledge that its handler has run.
+func (e *Exchange) callWithAck(ctx context.Context, relay *Relay, cid, fn string, args []interface{}) error {
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+	s, ok := c.transport().(rawSender)
+	if !ok {
+		return errors.New("relayr: transport does not support acknowledgements")
+	}
+	if !c.caps.has(canAck) {
+		return errNoAck
+	}
+
+	fn, args, ok = e.interceptOutgoing(relay, cid, e.transportName(c.transport()), fn, args)
+	if !ok {
+		return nil
+	}
+
+	c.touch()
+	id, acked := e.acks.add(cid)
+	defer e.acks.remove(cid, id)
+
+	frame, err := encodeFrame(c.codec, c.protocol, &clientInvocation{Relay: relay.Name, Method: fn, Arguments: wireArgs(args), AckID: id, Trace: relay.trace, Sender: relay.sender})
+	if err != nil {
+		return err
+	}
+	if err := s.sendRaw(cid, frame); err != nil {
+		return err
+	}
+	e.emitSent(cid, "", relay.Name, fn)
+
+	select {
+	case err := <-acked:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
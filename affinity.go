@@ -0,0 +1,57 @@
+package relayr
+
+import (
+	"errors"
+	"net/http"
+)
+
+// closeWrongInstance is the websocket close code sent to clients that
+// open a websocket on an instance other than the one they negotiated
+// with, telling them to negotiate again.
+const closeWrongInstance = 4005
+
+// errWrongInstance is the refusal of a request for a connection held by
+// another instance.
+var errWrongInstance = errors.New("relayr: connection is held by another instance, negotiate again")
+
+// foreignInstance reports whether a request is for a connection
+// negotiated with another instance, going by the instance the client
+// script names in every request once it has negotiated. Requests naming
+// none are taken to be for this one.
+func (e *Exchange) foreignInstance(r *http.Request) bool {
+	if e.options.InstanceID == "" {
+		return false
+	}
+	instance := r.URL.Query().Get("instance")
+	return instance != "" && instance != e.options.InstanceID
+}
+
+// setAffinity lets the OnAffinity hook add to the response to a
+// negotiation, with the InstanceID, what the load balancer needs to route
+// the client's later requests to this instance.
+func (e *Exchange) setAffinity(w http.ResponseWriter, r *http.Request) {
+	if e.options.InstanceID != "" && e.options.OnAffinity != nil {
+		e.options.OnAffinity(w, r, e.options.InstanceID)
+	}
+}
+
+// refuseForeign answers a long-poll request for a connection held by
+// another instance with 409, rather than letting it find no connection or
+// one of the same ID that is not its own. Calls are refused with a
+// receipt, so that the client fails them now.
+func (e *Exchange) refuseForeign(w http.ResponseWriter, r *http.Request, op string) {
+	e.logger.Infof("refusing a request for a connection of instance %s", r.URL.Query().Get("instance"))
+	if op != opCallServer {
+		httpError(w, errWrongInstance.Error(), http.StatusConflict)
+		return
+	}
+	b, err := e.json.Marshal(callReceipt{Error: errWrongInstance.Error()})
+	if err != nil {
+		e.logger.Errorf("encoding a call receipt: %v", err)
+		httpError(w, errWrongInstance.Error(), http.StatusConflict)
+		return
+	}
+	jsonResponse(w)
+	w.WriteHeader(http.StatusConflict)
+	w.Write(b)
+}
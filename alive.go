@@ -0,0 +1,49 @@
+package relayr
+
+// closedChan is returned by Done for clients that are gone already.
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// Alive reports whether the client this Relay interacts with is still
+// connected, as it is while it waits out its ReconnectGracePeriod to
+// reconnect with the same ConnectionID; it is not Alive once Done is
+// closed. It reports false for a Relay that interacts with no client,
+// such as one made by Exchange.Relay.
+func (r *Relay) Alive() bool {
+	if r.ConnectionID == "" {
+		return false
+	}
+	e := r.exchange
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+	if e.getClientByConnectionIDLocked(r.ConnectionID) != nil {
+		return true
+	}
+	_, ok := e.detached[r.ConnectionID]
+	return ok
+}
+
+// Done returns a channel that is closed once the client this Relay
+// interacts with is gone for good, so that goroutines that outlive the
+// call being served, such as one streaming updates to the caller, know
+// when to stop. A client waiting out its ReconnectGracePeriod is not gone
+// yet. The channel is closed already if the client is gone, and is nil,
+// never closed, for a Relay that interacts with no client.
+func (r *Relay) Done() <-chan struct{} {
+	if r.ConnectionID == "" {
+		return nil
+	}
+	e := r.exchange
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+	if c := e.getClientByConnectionIDLocked(r.ConnectionID); c != nil {
+		return c.gone
+	}
+	if d, ok := e.detached[r.ConnectionID]; ok {
+		return d.client.gone
+	}
+	return closedChan
+}
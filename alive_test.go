@@ -0,0 +1,117 @@
+package relayr
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// Retainer is a relay handing the *Relay of each call to it to the test,
+// as a method does that retains it for a goroutine outliving the call.
+type Retainer struct{ relays chan *Relay }
+
+func (k Retainer) Retain(r *Relay) { k.relays <- r }
+
+// TestRetainedRelayAcrossReconnects uses a retained Relay from several
+// goroutines while its client drops, reconnects within its grace period,
+// and finally drops for good. Alive and Done must agree throughout.
+func TestRetainedRelayAcrossReconnects(t *testing.T) {
+	k := Retainer{relays: make(chan *Relay, 1)}
+	e, srv := serve(t, ExchangeOptions{ReconnectGracePeriod: 300 * time.Millisecond}, k)
+	ws, cid := openWebSocket(t, srv)
+	ws.WriteJSON(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: "Retainer", Method: "Retain", InvocationID: "1"})
+	var r *Relay
+	select {
+	case r = <-k.relays:
+	case <-time.After(testTimeout):
+		t.Fatal("Retain was not called")
+	}
+	done := r.Done()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				select {
+				case <-r.Done():
+					if r.Alive() {
+						t.Error("a Relay is Alive once Done is closed")
+						return
+					}
+				default:
+				}
+				if !r.Alive() {
+					select {
+					case <-r.Done():
+					default:
+						t.Error("a Relay is not Alive, but Done is not closed")
+						return
+					}
+				}
+				r.Clients.Caller().Call("tick")
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		ws.Close()
+		waitDetached(t, e, cid)
+		if !r.Alive() {
+			t.Fatalf("cycle %d: a client waiting to reconnect is not Alive", i)
+		}
+		select {
+		case <-done:
+			t.Fatalf("cycle %d: Done was closed for a client waiting to reconnect", i)
+		default:
+		}
+
+		body, _ := json.Marshal(protocol.Negotiation{T: "websocket", P: cid, V: protocol.Version})
+		resp, err := http.Post(srv.URL+"/relayr/negotiate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again protocol.NegotiationResponse
+		json.NewDecoder(resp.Body).Decode(&again)
+		resp.Body.Close()
+		if !again.Reconnected {
+			t.Fatalf("cycle %d: the client did not reconnect", i)
+		}
+		if ws, _, err = websocket.DefaultDialer.Dial(wsURL(srv, again), nil); err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+		readFrames(t, ws)
+		if !r.Alive() {
+			t.Fatalf("cycle %d: a reconnected client is not Alive", i)
+		}
+	}
+
+	// the client drops for good as its grace period expires
+	ws.Close()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("Done was not closed once the grace period expired")
+	}
+	if r.Alive() {
+		t.Fatal("a client whose grace period expired is Alive")
+	}
+	if err := r.Clients.Caller().Call("tick"); err != ErrConnectionGone {
+		t.Fatalf("calling a client that is gone failed with %v, want ErrConnectionGone", err)
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,91 @@
+package relayr
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrForbidden is returned to clients that call a relay method they are
+// not allowed to.
+var ErrForbidden = errors.New("relayr: forbidden")
+
+// MethodAuthorizer can be implemented by a relay to decide which clients
+// may call each of its methods. Authorize is called with the method's
+// name, as the relay declares it, before every call to a method that has
+// no rule added with Exchange.Authorize; relay identifies the caller, as
+// it does for the method itself.
+type MethodAuthorizer interface {
+	Authorize(method string, relay *Relay) bool
+}
+
+// AuthorizeFunc decides whether a client authorized as principal, as the
+// Authorizer returned it, may make a call.
+type AuthorizeFunc func(principal interface{}, call *IncomingCall) bool
+
+// Authorize adds a rule deciding which clients may call a relay method,
+// replacing any rule added for it before. The method is named ignoring
+// case, as clients name it. Calls the rule refuses are rejected before the
+// method runs with ErrForbidden, or 403 for long-poll clients.
+func (e *Exchange) Authorize(relay, method string, rule AuthorizeFunc) {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+	if e.methodRules == nil {
+		e.methodRules = make(map[string]AuthorizeFunc)
+	}
+	e.methodRules[methodRuleKey(relay, method)] = rule
+}
+
+func methodRuleKey(relay, method string) string {
+	return relay + "." + strings.ToLower(method)
+}
+
+// authorizeCall checks a client's call to a relay method against the rule
+// added for it, or the relay's MethodAuthorizer, returning ErrForbidden if
+// it must be rejected. A rejected call is still passed through the
+// interceptors, with next returning ErrForbidden without calling the
+// method, so that they see it; it is rejected whatever they return. Calls
+// to relays or methods that do not exist are left for dispatch to report,
+// and those to relays a client did not load, with LazyRelays, are refused
+// with a *CallError.
+func (e *Exchange) authorizeCall(cid, transport, relayName, fn string, args []interface{}) error {
+	relay := e.getRelayByName(relayName, cid)
+	if relay == nil {
+		return nil
+	}
+	if err := e.checkUsed(cid, relayName); err != nil {
+		e.logger.Infof("connection %s: %v", cid, err)
+		return err
+	}
+	name, ok := relay.resolveMethod(fn)
+	if !ok {
+		return nil
+	}
+
+	e.mapLock.RLock()
+	rule := e.methodRules[methodRuleKey(relayName, name)]
+	e.mapLock.RUnlock()
+
+	call := &IncomingCall{
+		RelayName:    relayName,
+		Method:       fn,
+		Args:         args,
+		ConnectionID: cid,
+		Transport:    transport,
+	}
+	var allowed bool
+	if rule != nil {
+		allowed = rule(relay.Principal(), call)
+	} else if a, ok := relay.receiver.Interface().(MethodAuthorizer); ok {
+		allowed = a.Authorize(name, relay)
+	} else {
+		allowed = !e.options.RequireMethodAuthorization
+	}
+	if allowed {
+		return nil
+	}
+
+	e.counters.forbidden.Add(1)
+	e.logger.Infof("connection %s may not call %s.%s", cid, relayName, name)
+	e.intercept(call, func() error { return ErrForbidden })
+	return ErrForbidden
+}
@@ -0,0 +1,106 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+)
+
+// BackplaneMessage is the envelope an Exchange publishes to its Backplane
+// whenever it broadcasts to a group, so that other instances can deliver
+// the call to their own locally connected clients.
+type BackplaneMessage struct {
+	Origin    string        `json:"O"` // the instance ID of the publishing Exchange
+	Relay     string        `json:"R"`
+	Method    string        `json:"M"`
+	Group     string        `json:"G"`
+	Except    []string      `json:"X,omitempty"` // ConnectionIDs to skip, if any
+	Pattern   bool          `json:"P,omitempty"` // Group is a pattern matching group names
+	All       bool          `json:"L,omitempty"` // the call is to every client, Group being Global
+	Stateful  bool          `json:"S,omitempty"` // the call was made with CallStateful, its one argument being the state
+	Groups    []string      `json:"N,omitempty"` // the groups the call is to, in place of Group, for CallerGroups
+	Arguments []interface{} `json:"A"`
+	Sender    *Sender       `json:"W,omitempty"` // the client whose call made the call, with IncludeSenderID
+}
+
+// Backplane connects several Exchange instances so that group broadcasts
+// reach clients regardless of which instance they are connected to.
+// Group membership itself stays local to each instance.
+type Backplane interface {
+	// Publish sends msg to every subscribed instance, including
+	// the publisher itself.
+	Publish(msg BackplaneMessage) error
+	// Subscribe registers fn to be called for every published message.
+	Subscribe(fn func(msg BackplaneMessage)) error
+	// Close disconnects from the backplane.
+	Close() error
+}
+
+// ErrBackplaneInUse is returned by UseBackplane when a backplane has
+// already been configured.
+var ErrBackplaneInUse = errors.New("relayr: a backplane is already in use")
+
+// UseBackplane connects the Exchange to b. Group broadcasts made on this
+// Exchange are published to b, and broadcasts published by other
+// instances are delivered to the members connected here.
+func (e *Exchange) UseBackplane(b Backplane) error {
+	e.mapLock.Lock()
+	if e.backplane != nil {
+		e.mapLock.Unlock()
+		return ErrBackplaneInUse
+	}
+	e.backplane = b
+	e.mapLock.Unlock()
+
+	return b.Subscribe(e.receiveFromBackplane)
+}
+
+// publishToBackplane publishes msg, a broadcast made on this Exchange, to
+// the Backplane if there is one.
+func (e *Exchange) publishToBackplane(msg BackplaneMessage) {
+	e.mapLock.RLock()
+	b := e.backplane
+	e.mapLock.RUnlock()
+
+	if b == nil {
+		return
+	}
+
+	msg.Origin = e.instanceID
+	if err := b.Publish(msg); err != nil {
+		e.logger.Errorf("backplane publish failed: %v", err)
+		e.reportError(TransportError, "", msg.Relay, msg.Method, err)
+	}
+}
+
+func (e *Exchange) receiveFromBackplane(msg BackplaneMessage) {
+	// our own broadcasts have already been delivered locally
+	if msg.Origin == e.instanceID {
+		return
+	}
+
+	relay := e.getRelayByName(msg.Relay, "")
+	if relay == nil {
+		e.logger.Errorf("backplane message for unknown relay '%s'", msg.Relay)
+		e.reportError(DispatchError, "", msg.Relay, msg.Method, &CallError{Relay: msg.Relay, Reason: "does not exist"})
+		return
+	}
+	relay.sender = msg.Sender
+
+	if msg.All {
+		e.deliverToAll(relay, msg.Except, msg.Method, msg.Arguments...)
+		return
+	}
+	if msg.Stateful && len(msg.Arguments) == 1 {
+		e.deliverStateful(relay, msg.Group, msg.Except, msg.Method, msg.Arguments[0])
+		return
+	}
+	if len(msg.Groups) > 0 {
+		e.deliverToGroups(relay, msg.Groups, msg.Except, msg.Method, msg.Arguments...)
+		return
+	}
+	if msg.Pattern {
+		e.deliverToGroupsMatching(relay, msg.Group, msg.Except, msg.Method, msg.Arguments...)
+		return
+	}
+	e.deliverToGroup(context.Background(), relay, msg.Group, msg.Except, msg.Method, msg.Arguments...)
+}
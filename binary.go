@@ -0,0 +1,91 @@
+package relayr
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	errNoBinary   = errors.New("relayr: transport cannot send binary messages")
+	errBinaryArgs = errors.New("relayr: outbound interceptor changed the arguments of a binary message")
+)
+
+// binaryFrameMarker starts every binary frame sent with SendBinary. It is
+// never the first byte of a JSON or MessagePack frame, so clients can tell
+// the two apart.
+const binaryFrameMarker = 0xc1
+
+// binarySender is implemented by transports that can deliver raw binary
+// payloads to a client.
+type binarySender interface {
+	sendBinary(connectionID string, relay, fn string, data []byte)
+}
+
+// encodeBinaryFrame lays out a binary websocket message as the marker
+// byte, the relay and method names each prefixed with their big-endian
+// uint16 length, and then the payload.
+func encodeBinaryFrame(relay, fn string, data []byte) []byte {
+	b := make([]byte, 0, 5+len(relay)+len(fn)+len(data))
+	b = append(b, binaryFrameMarker)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(relay)))
+	b = append(b, relay...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fn)))
+	b = append(b, fn...)
+	return append(b, data...)
+}
+
+// sendBinaryTo sends a binary payload to a single connection.
+func (e *Exchange) sendBinaryTo(relay *Relay, connectionID, fn string, data []byte) {
+	c := e.getClientByConnectionID(connectionID)
+	if c == nil {
+		return
+	}
+	if !c.caps.has(canBinary) {
+		// the client is called with the payload, which is base64-encoded
+		if err := e.callConnectionMethod(relay, connectionID, fn, data); err != nil {
+			e.logger.Debugf("sending %s to %s: %v", fn, connectionID, err)
+		}
+		return
+	}
+	s, ok := c.transport().(binarySender)
+	if !ok {
+		e.logger.Errorf("transport for %s cannot send binary messages", connectionID)
+		e.reportError(TransportError, connectionID, relay.Name, fn, errNoBinary)
+		return
+	}
+
+	fn, args, ok := e.interceptOutgoing(relay, connectionID, e.transportName(c.transport()), fn, []interface{}{data})
+	if !ok {
+		return
+	}
+	if len(args) != 1 {
+		e.logger.Errorf("outbound interceptor changed the arguments of binary message %s", fn)
+		e.reportError(DispatchError, connectionID, relay.Name, fn, errBinaryArgs)
+		return
+	}
+	if data, ok = args[0].([]byte); !ok {
+		e.logger.Errorf("outbound interceptor changed the arguments of binary message %s", fn)
+		e.reportError(DispatchError, connectionID, relay.Name, fn, errBinaryArgs)
+		return
+	}
+	c.touch()
+	s.sendBinary(connectionID, relay.Name, fn, data)
+}
+
+// sendBinaryToGroup sends a binary payload to the members of a group that
+// are connected to this Exchange, skipping those listed in except.
+func (e *Exchange) sendBinaryToGroup(relay *Relay, group string, except []string, fn string, data []byte) {
+	e.sendBinaryToEach(relay, group, e.GroupMembers(group), except, fn, data)
+}
+
+// sendBinaryToEach sends a binary payload to the clients with the given
+// ConnectionIDs, sent to the named group, skipping those listed in except.
+func (e *Exchange) sendBinaryToEach(relay *Relay, group string, ids, except []string, fn string, data []byte) {
+	r := *relay
+	r.group = group
+	for _, id := range ids {
+		if !containsString(except, id) {
+			e.sendBinaryTo(&r, id, fn, data)
+		}
+	}
+}
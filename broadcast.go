@@ -0,0 +1,138 @@
+package relayr
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoRawFrames = errors.New("relayr: transport cannot send encoded frames")
+
+// encodedCall is a call to a client method encoded for one codec and
+// protocol version.
+type encodedCall struct {
+	codec   string
+	version int
+	frame   []byte
+	err     error
+}
+
+// callEncoder encodes a call to a client method made to many clients once
+// for each codec and protocol version they use, rather than once for each
+// client. It is not safe for concurrent use.
+type callEncoder struct {
+	call    clientInvocation
+	encoded []encodedCall
+}
+
+func (c *callEncoder) encode(codec Codec, version int) ([]byte, error) {
+	name := codec.Name()
+	for _, e := range c.encoded {
+		if e.codec == name && e.version == version {
+			return e.frame, e.err
+		}
+	}
+
+	call := c.call
+	frame, err := encodeFrame(codec, version, &call)
+	c.encoded = append(c.encoded, encodedCall{name, version, frame, err})
+	return frame, err
+}
+
+// groupEncoder returns a callEncoder for a call to the members of a group,
+// or nil if the call must be made to each member separately because
+// outbound interceptors may change it, or because it is written
+// uncompressed or with a Priority other than Normal, which frames queued
+// ready encoded cannot say.
+func (e *Exchange) groupEncoder(relay *Relay, fn string, args []interface{}) *callEncoder {
+	e.mapLock.RLock()
+	intercepted := len(e.outboundInterceptors) > 0
+	e.mapLock.RUnlock()
+	if intercepted || relay.plain || relay.priority != Normal {
+		return nil
+	}
+
+	return &callEncoder{call: clientInvocation{Relay: relay.Name, Method: fn, Arguments: wireArgs(args), Trace: relay.trace, Sender: relay.sender}}
+}
+
+// deliverToMember calls a client method on a member of a group. The call
+// is queued ready encoded by enc when there is one and the member's
+// transport can send encoded frames.
+func (e *Exchange) deliverToMember(c *client, enc *callEncoder, relay *Relay, group, fn string, args []interface{}) error {
+	c.touch()
+	if enc != nil {
+		if s, ok := c.transport().(rawSender); ok {
+			codec := c.codec
+			if codec == nil {
+				codec = e.json
+			}
+			frame, err := enc.encode(codec, c.protocol)
+			if err != nil {
+				e.logger.Errorf("encoding %s for %s: %v", fn, c.ConnectionID, err)
+				return err
+			}
+			if err := s.sendCall(c.ConnectionID, frame, relay.coalesce, e.overflowPolicy(group), relay.expires); err != nil {
+				return err
+			}
+			e.emitSent(c.ConnectionID, group, relay.Name, fn)
+			return nil
+		}
+	}
+
+	r := e.getRelayByName(relay.Name, c.ConnectionID)
+	if r == nil {
+		// one of the Exchange's own, such as presence's
+		own := *relay
+		own.ConnectionID = c.ConnectionID
+		r = &own
+	}
+	r.group = group
+	r.sender = relay.sender
+	r.coalesce = relay.coalesce
+	r.overflow = e.overflowPolicy(group)
+	r.expires = relay.expires
+	r.plain = relay.plain
+	r.priority = relay.priority
+	if err := c.transport().CallClientFunction(r, fn, args...); err != nil {
+		return err
+	}
+	e.emitSent(c.ConnectionID, group, relay.Name, fn)
+	return nil
+}
+
+// BroadcastRaw queues frame, exactly as given, for every member of a group
+// connected to this Exchange over the built-in transports. It is meant
+// for frames encoded ahead of time, which must be in the codec and
+// protocol version the members speak. Outbound interceptors are not run
+// and the frame is not relayed through the Backplane. It returns a
+// *GroupCallError if the frame could not be queued for some of the
+// members, including those connected over other transports.
+func (e *Exchange) BroadcastRaw(group string, frame []byte) error {
+	e.mapLock.RLock()
+	g := e.groups[group]
+	e.mapLock.RUnlock()
+	if g == nil {
+		return nil
+	}
+
+	result := &GroupCallError{Group: group}
+	for _, c := range g.clients() {
+		err := errNoRawFrames
+		if s, ok := c.transport().(rawSender); ok {
+			c.touch()
+			err = s.sendCall(c.ConnectionID, frame, "", e.overflowPolicy(group), time.Time{})
+		}
+		if err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[c.ConnectionID] = err
+			continue
+		}
+		result.Delivered++
+	}
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
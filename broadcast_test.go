@@ -0,0 +1,116 @@
+package relayr
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withoutPings drops the pings from frames.
+func withoutPings(frames []json.RawMessage) []json.RawMessage {
+	var kept []json.RawMessage
+	for _, f := range frames {
+		if string(f) != `{"T":"p"}` {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// readCalls reads the frames of ws, skipping pings, until some arrive.
+func readCalls(t *testing.T, ws *websocket.Conn) []json.RawMessage {
+	t.Helper()
+	for {
+		if frames := withoutPings(readFrames(t, ws)); len(frames) > 0 {
+			return frames
+		}
+	}
+}
+
+// checkNothingSent checks that ws is sent nothing but pings for a while.
+func checkNothingSent(t *testing.T, ws *websocket.Conn) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		_, m, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if string(m) != `{"T":"p"}` {
+			t.Fatalf("a client outside the group was sent %s", m)
+		}
+	}
+}
+
+func TestBroadcastRaw(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	var members []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		ws, cid := openWebSocket(t, srv)
+		if err := e.AddToGroup("room", cid); err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, ws)
+	}
+	polling := negotiate(t, srv, "longpoll").ConnectionID
+	if err := e.AddToGroup("room", polling); err != nil {
+		t.Fatal(err)
+	}
+	outsider, _ := openWebSocket(t, srv)
+
+	frame := []byte(`{"T":"c","R":"Ticker","M":"tick","A":["raw <&>"]}`)
+	if err := e.BroadcastRaw("room", frame); err != nil {
+		t.Fatal(err)
+	}
+	for i, ws := range members {
+		if got := readCalls(t, ws); len(got) != 1 || !bytes.Equal(got[0], frame) {
+			t.Fatalf("member %d was sent %s, want %s", i, got, frame)
+		}
+	}
+	if got := withoutPings(poll(t, srv, polling, 0).Messages); len(got) != 1 || !bytes.Equal(got[0], frame) {
+		t.Fatalf("the long-polling member was sent %s, want %s", got, frame)
+	}
+	checkNothingSent(t, outsider)
+
+	if err := e.BroadcastRaw("nobody", frame); err != nil {
+		t.Fatalf("broadcasting to a group with no members: %v", err)
+	}
+}
+
+func TestGroupCallEncodedOnce(t *testing.T) {
+	var encoded atomic.Int32
+	e, srv := serve(t, ExchangeOptions{JSONMarshal: func(v interface{}) ([]byte, error) {
+		if _, ok := v.(*clientInvocation); ok {
+			encoded.Add(1)
+		}
+		return json.Marshal(v)
+	}}, Ticker{})
+	var members []*websocket.Conn
+	for i := 0; i < 5; i++ {
+		ws, cid := openWebSocket(t, srv)
+		if err := e.AddToGroup("room", cid); err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, ws)
+	}
+
+	if err := e.Clients(Ticker{}).Group("room").Call("tick", "once"); err != nil {
+		t.Fatal(err)
+	}
+	var first []byte
+	for i, ws := range members {
+		got := readCalls(t, ws)
+		if len(got) != 1 || (first != nil && !bytes.Equal(got[0], first)) {
+			t.Fatalf("member %d was sent %s, unlike the others", i, got)
+		}
+		first = got[0]
+	}
+	if n := encoded.Load(); n != 1 {
+		t.Fatalf("a call to %d members was encoded %d times", len(members), n)
+	}
+}
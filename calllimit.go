@@ -0,0 +1,248 @@
+package relayr
+
+import (
+	"strings"
+	"time"
+)
+
+// Limit bounds how many calls to a relay, or to one of its methods, run
+// at once, across every client, as for methods that are expensive to run.
+type Limit struct {
+	// MaxConcurrent is the most calls that run at once. Zero or less
+	// removes the limit.
+	MaxConcurrent int
+
+	// MaxQueued is the most calls that wait for one of those running to
+	// finish, in the order they were made. Calls beyond it are refused
+	// with ErrServerBusy, or 503 for long-poll clients. Zero refuses the
+	// calls made while MaxConcurrent are running; negative queues any
+	// number.
+	MaxQueued int
+}
+
+// LimitWaitBuckets are the upper bounds of the buckets of
+// LimitStats.QueueWait. Its last bucket counts the calls that waited
+// longer than all of them.
+var LimitWaitBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// LimitStats describes the calls to a relay or method under a Limit.
+type LimitStats struct {
+	Running  int    // calls running
+	Queued   int    // calls made and waiting to run, whether for the Limit or for the client's calls before them
+	Rejected uint64 // calls refused because MaxQueued were waiting
+
+	// QueueWait counts the calls run by how long they waited to run,
+	// from when they were made, in the buckets of LimitWaitBuckets.
+	QueueWait []uint64
+}
+
+// callLimit is a Limit in force, with the calls under it. It is guarded
+// by the dispatcher's lock.
+type callLimit struct {
+	Limit
+	running  int
+	pending  int          // calls made and yet to finish, running or not
+	parked   []parkedCall // calls waiting for one running to finish, in turn
+	rejected uint64
+	waits    []uint64 // by bucket of LimitWaitBuckets
+}
+
+// parkedCall is a call that was taken to run while its limit was full,
+// and q the queue of the client that made it, which waits behind it. q is
+// nil with ConcurrentCalls, and for calls made through ServeCall, which
+// wait for wake to be closed and run the call themselves.
+type parkedCall struct {
+	q    *callQueue
+	call queuedCall
+	wake chan struct{}
+}
+
+// LimitRelay limits the calls to every method of a relay, replacing any
+// limit set for it before. A method with a limit of its own, set with
+// LimitMethod, follows that instead. Calls waiting for the limit do not
+// hold up the MaxCallWorkers running other calls, and a client's later
+// calls wait behind them, so that its calls still run in order.
+func (e *Exchange) LimitRelay(relay string, l Limit) {
+	e.dispatcher.setLimit(relay, l)
+}
+
+// LimitMethod limits the calls to a relay method, as LimitRelay does for
+// a relay's. The method is named ignoring case, as clients name it.
+func (e *Exchange) LimitMethod(relay, method string, l Limit) {
+	e.dispatcher.setLimit(methodRuleKey(relay, method), l)
+}
+
+// setLimit sets the limit of the calls to a relay or method, keyed by its
+// name or methodRuleKey, or removes it. Calls already made keep to the
+// limit they were made under.
+func (d *dispatcher) setLimit(key string, l Limit) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if l.MaxConcurrent <= 0 {
+		delete(d.limits, key)
+		return
+	}
+	if d.limits == nil {
+		d.limits = make(map[string]*callLimit)
+	}
+	if old := d.limits[key]; old != nil {
+		old.Limit = l
+		return
+	}
+	d.limits[key] = &callLimit{Limit: l, waits: make([]uint64, len(LimitWaitBuckets)+1)}
+}
+
+// limitFor returns the limit of calls to a method, or nil if there is
+// none.
+func (d *dispatcher) limitFor(relay, method string) *callLimit {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.limits) == 0 {
+		return nil
+	}
+	if l := d.limits[relay+"."+strings.ToLower(method)]; l != nil {
+		return l
+	}
+	return d.limits[relay]
+}
+
+// acquire waits for a place under limit for a call made through
+// ServeCall, which must give it up with release. It returns ErrServerBusy
+// if MaxQueued calls are waiting already.
+func (d *dispatcher) acquire(limit *callLimit) error {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return errExchangeClosed
+	}
+	if !limit.admitLocked() {
+		d.lock.Unlock()
+		return ErrServerBusy
+	}
+	if limit.acquireLocked() {
+		limit.waitedLocked(0)
+		d.lock.Unlock()
+		return nil
+	}
+	at, wake := time.Now(), make(chan struct{})
+	limit.parked = append(limit.parked, parkedCall{call: queuedCall{limit: limit, at: at}, wake: wake})
+	d.lock.Unlock()
+
+	<-wake
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return errExchangeClosed
+	}
+	limit.waitedLocked(time.Since(at))
+	return nil
+}
+
+// release gives up a place taken with acquire, running the call parked
+// longest in its place, if any.
+func (d *dispatcher) release(limit *callLimit) {
+	d.lock.Lock()
+	next, ok := limit.releaseLocked()
+	d.lock.Unlock()
+	if ok {
+		d.resume(next)
+	}
+}
+
+// resume runs a parked call that a place has been freed for.
+func (d *dispatcher) resume(p parkedCall) {
+	if p.wake != nil {
+		close(p.wake)
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.run(p.q, p.call)
+	}()
+}
+
+// admitLocked counts a call made under the limit, reporting false if
+// MaxQueued are waiting already. A nil limit admits every call.
+func (l *callLimit) admitLocked() bool {
+	if l == nil {
+		return true
+	}
+	if l.MaxQueued >= 0 && l.pending >= l.MaxConcurrent+l.MaxQueued {
+		l.rejected++
+		return false
+	}
+	l.pending++
+	return true
+}
+
+// acquireLocked takes a place for a call to run, reporting false if
+// MaxConcurrent are running.
+func (l *callLimit) acquireLocked() bool {
+	if l == nil {
+		return true
+	}
+	if l.running >= l.MaxConcurrent {
+		return false
+	}
+	l.running++
+	return true
+}
+
+// releaseLocked gives up a call's place once it has run, returning the
+// call parked longest to run in its place, if any.
+func (l *callLimit) releaseLocked() (parkedCall, bool) {
+	if l == nil {
+		return parkedCall{}, false
+	}
+	l.running--
+	l.pending--
+	if len(l.parked) == 0 || l.running >= l.MaxConcurrent {
+		return parkedCall{}, false
+	}
+	next := l.parked[0]
+	l.parked[0] = parkedCall{}
+	l.parked = l.parked[1:]
+	l.running++
+	return next, true
+}
+
+// waitedLocked records how long a call waited to run.
+func (l *callLimit) waitedLocked(wait time.Duration) {
+	if l == nil {
+		return
+	}
+	i := 0
+	for i < len(LimitWaitBuckets) && wait > LimitWaitBuckets[i] {
+		i++
+	}
+	l.waits[i]++
+}
+
+// limitStats returns the stats of every limit, keyed as they were set: by
+// relay, or "Relay.method".
+func (d *dispatcher) limitStats() map[string]LimitStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.limits) == 0 {
+		return nil
+	}
+	r := make(map[string]LimitStats, len(d.limits))
+	for key, l := range d.limits {
+		r[key] = LimitStats{
+			Running:   l.running,
+			Queued:    l.pending - l.running,
+			Rejected:  l.rejected,
+			QueueWait: append([]uint64(nil), l.waits...),
+		}
+	}
+	return r
+}
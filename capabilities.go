@@ -0,0 +1,97 @@
+package relayr
+
+import "strings"
+
+// The optional features a client says it supports as it negotiates. The
+// Exchange sends a client without one the plain form instead.
+const (
+	CapabilityBatch  = "batch"  // websocket messages holding several frames; sent one frame a message otherwise
+	CapabilityAck    = "ack"    // acknowledging calls made with CallWithAck, which fails otherwise
+	CapabilityBinary = "binary" // binary payloads sent with SendBinary; sent as a call with the payload base64-encoded otherwise
+	CapabilityPatch  = "patch"  // state frames sent by CallStateful; sent as a call with the whole state otherwise
+	CapabilityPing   = "ping"   // ping frames sent over websockets with each keep-alive ping; not sent otherwise
+)
+
+// capabilities is a set of the features a client supports.
+type capabilities uint8
+
+const (
+	canBatch capabilities = 1 << iota
+	canAck
+	canBinary
+	canPatch
+	canPing
+)
+
+var capabilityNames = []struct {
+	name string
+	cap  capabilities
+}{
+	{CapabilityAck, canAck},
+	{CapabilityBatch, canBatch},
+	{CapabilityBinary, canBinary},
+	{CapabilityPatch, canPatch},
+	{CapabilityPing, canPing},
+}
+
+// negotiatedCapabilities returns the features a client supports: those
+// it named as it negotiated that the protocol version it speaks allows,
+// ignoring those the Exchange does not know. Clients that name none, as
+// scripts generated by older releases do not, support all the version
+// allows.
+func negotiatedCapabilities(names []string, version int) capabilities {
+	var allowed capabilities
+	if version >= 1 {
+		allowed |= canAck | canBinary | canPatch | canPing
+	}
+	if version >= batchVersion {
+		allowed |= canBatch
+	}
+	if names == nil {
+		return allowed
+	}
+
+	var caps capabilities
+	for _, name := range names {
+		for _, n := range capabilityNames {
+			if n.name == name {
+				caps |= n.cap
+			}
+		}
+	}
+	return caps & allowed
+}
+
+// capabilitiesFor returns the features the client with the given
+// ConnectionID supports, or none if there is no such client.
+func (e *Exchange) capabilitiesFor(cid string) capabilities {
+	if c := e.getClientByConnectionID(cid); c != nil {
+		return c.caps
+	}
+	return 0
+}
+
+// has reports whether the set holds every feature of caps.
+func (c capabilities) has(caps capabilities) bool {
+	return c&caps == caps
+}
+
+// names returns the names of the features in the set, in the order of
+// capabilityNames, which is sorted.
+func (c capabilities) names() []string {
+	r := []string{}
+	for _, n := range capabilityNames {
+		if c.has(n.cap) {
+			r = append(r, n.name)
+		}
+	}
+	return r
+}
+
+// String names the features in the set, separated by commas, or "none".
+func (c capabilities) String() string {
+	if c == 0 {
+		return "none"
+	}
+	return strings.Join(c.names(), ",")
+}
@@ -1,21 +1,382 @@
 /*
  *
- * This file contains client side Javascript that is rendered
- * when a client hits the RelayR route with a GET request.
+ * This file contains client side Javascript that is served
+ * when a client hits the RelayR route with a GET request,
+ * followed by the Exchange's manifest.
  *
  */
 
 package relayr
 
+// connectionClassScript is the static part of the client script, which
+// is the same for every Exchange. RelayRConnection.configure fills in the
+// rest from an Exchange's manifest.
 const connectionClassScript = `
 
 var RelayRConnection = {};
+var RelayR = {};
 
 RelayRConnection = (function() {
 	var readyCalled = false;
-	var web, transport;
-	var routeWithoutScheme = '%v';
-	var route = '%v';
+	var web, transport, api, emit;
+	var pending = {}, callId = 0;
+	// calls are sent with call IDs starting with this, unique to the page,
+	// so that the server runs a call we send again only once
+	var callKey = Math.random().toString(36).slice(2) + new Date().getTime().toString(36);
+	// the functions taking the credit the server grants our uploads, by
+	// InvocationID
+	var uploads = {};
+	var attempts = 0;
+	// the sequence number of the last long-poll message received
+	var pollSeq = 0;
+	// whether a websocket would not open, so that we long-poll instead
+	// until one does as we try upgrading to it, at first once upgradeDelay
+	// has passed, given when we negotiate
+	var unreachable = false, upgradeDelay = 0;
+	// how long a websocket that opens has to deliver the server's
+	// handshake before we give up on it for long-polling, given when we
+	// negotiate, and the timer that does so
+	var probeTimeout = 0, probe;
+	// the subprotocol our websockets speak, the framing of our codec
+	var subprotocol = 'relayr.v1.json';
+	var stopped = false;
+	// whether the connection is slow, and the round trip past which a
+	// long-poll call makes it so, given by the server when we negotiate
+	var slow = false, slowRoundTrip = 0;
+	// the longest we should go without hearing from the server, given when
+	// we negotiate, and the timer that gives the connection up for lost
+	// once twice that has passed in silence
+	var keepAlive = 0, liveness;
+	// the emit functions of the relays, by name
+	var relays = {};
+	// the names of the relays loaded with use, from an Exchange with
+	// LazyRelays, or null when its manifest lists them all; the loads
+	// still under way; the ready call waiting for them; and whether ready
+	// has been called
+	var used = null, loading = 0, afterUse = null, started = false;
+	// the hubs of the ExchangeGroup serving us, if it is one, by name, each
+	// with its relays, as RelayR holds the Exchange's own, and their emit
+	// functions
+	var hubs = {};
+	// hubOf returns the hub with the given name, adding it if need be, or
+	// the Exchange's own relays given none
+	var hubOf = function(name) {
+		if (!name) {
+			return { relays: RelayR, emits: relays, revives: revives };
+		}
+		return hubs[name] = hubs[name] || { relays: {}, emits: {}, revives: {} };
+	};
+	// the functions reviving the arguments of the client methods the
+	// server described, by relay and method
+	var revives = {};
+	// the states sent by the server's CallStateful, by relay, method and
+	// group, each with its version
+	var states = {};
+	// the emit function of api.presence
+	var presence;
+	// the handlers added with api.onControl, by kind, and their emit
+	// function, and the kinds under which the server's own control frames
+	// are passed to them
+	var controls = {}, control;
+	var builtinControls = { RECONNECT: 'reconnect', UPGRADED: 'upgraded', SLOW: 'slow', RECOVERED: 'recovered', REMOVED: 'removed', RELAYS: 'relaysChanged' };
+	// emitter adds on, once and off to target, and returns a function that
+	// calls the handlers added for an event, reporting how many there were
+	var emitter = function(target) {
+		var handlers = {};
+		var add = function(name, fn, once) {
+			(handlers[name] = handlers[name] || []).push({ fn: fn, once: once });
+			return target;
+		};
+		target.on = function(name, fn) {
+			return add(name, fn, false);
+		};
+		target.once = function(name, fn) {
+			return add(name, fn, true);
+		};
+		// off removes a handler, or every handler for the event when fn is omitted
+		target.off = function(name, fn) {
+			var list = handlers[name] || [];
+			for (var i = list.length - 1; i >= 0; i--) {
+				if (!fn || list[i].fn === fn) {
+					list.splice(i, 1);
+				}
+			}
+			return target;
+		};
+		return function(name, args) {
+			var list = (handlers[name] || []).slice();
+			for (var i = 0; i < list.length; i++) {
+				if (list[i].once) {
+					target.off(name, list[i].fn);
+				}
+				list[i].fn.apply(target, args);
+			}
+			return list.length;
+		};
+	};
+	// fire raises a connection event, calling the on<name> callback if one
+	// is assigned and then the handlers added with on
+	var fire = function(name) {
+		var args = Array.prototype.slice.call(arguments, 1);
+		var f = api['on' + name];
+		f && f.apply(api, args);
+		emit(name, args);
+	};
+	var setState = function(state) {
+		api.state = state;
+	};
+	var connected = function() {
+		setState('connected');
+		if (!readyCalled) {
+			readyCalled = true;
+			api.r();
+		}
+		fire('connected');
+	};
+	// heard restarts the liveness timer whenever the server is heard from,
+	// calling lost if it then stays silent for too long
+	var heard = function(lost) {
+		clearTimeout(liveness);
+		if (!keepAlive || stopped) return;
+		liveness = setTimeout(function() {
+			console.log('%c-> ~relayr: the server stopped responding', 'color:red');
+			fire('error', new Error('relayr: the server stopped responding'));
+			lost();
+		}, 2 * keepAlive);
+	};
+	// failure makes an Error reported by the server, with the code it gave
+	// it, if any, which is one of api.codes or the application's own
+	var failure = function(message, code) {
+		var err = new Error(message);
+		if (code) err.code = code;
+		return err;
+	};
+	var settle = function(res) {
+		var p = pending[res.I];
+		if (!p) return;
+		delete pending[res.I];
+		clearTimeout(p.timer);
+		clearTimeout(p.slow);
+		res.E ? p.fail(failure(res.E, res.C)) : p.ok(res.V);
+	};
+	// streamed passes an item of a streaming result to the call's stream
+	// handler. Each item gives the call another callTimeout to finish
+	var streamed = function(res) {
+		var p = pending[res.I];
+		if (!p) return;
+		p.arm();
+		p.onItem && p.onItem(res.V);
+	};
+	// progressed passes the progress a call's method reported to its
+	// onProgress handler. Each report gives the call another callTimeout
+	// to finish
+	var progressed = function(res) {
+		var p = pending[res.I];
+		if (!p) return;
+		p.arm();
+		p.onProgress && p.onProgress(res.V, res.N || '');
+	};
+	// credited lets an upload send the chunks numbered below the credit
+	// granted. Each grant gives the call another callTimeout to finish
+	var credited = function(res) {
+		var p = pending[res.I];
+		p && p.arm();
+		uploads[res.I] && uploads[res.I](res.N);
+	};
+	// rejectAll fails every call still waiting for a result, as results do
+	// not survive a lost connection
+	var rejectAll = function(reason) {
+		var calls = pending;
+		pending = {};
+		for (var id in calls) {
+			clearTimeout(calls[id].timer);
+			clearTimeout(calls[id].slow);
+			calls[id].fail(new Error(reason));
+		}
+	};
+	// kicked stops the connection for good when the server disconnects us
+	var kicked = function(reason) {
+		stopped = true;
+		clearTimeout(liveness);
+		rejectAll('relayr: disconnected by the server');
+		transport.ConnectionId = transport.Token = null;
+		setState('disconnected');
+		fire('disconnected', reason);
+	};
+	// applyPatch applies the operations of a JSON Patch, as the server
+	// makes them, to doc and returns the result
+	var applyPatch = function(doc, ops) {
+		for (var i = 0; i < ops.length; i++) {
+			var op = ops[i];
+			if (op.path === '') {
+				doc = op.value;
+				continue;
+			}
+			var keys = op.path.split('/');
+			var parent = doc;
+			for (var j = 1; j < keys.length; j++) {
+				keys[j] = keys[j].replace(/~1/g, '/').replace(/~0/g, '~');
+				if (j < keys.length - 1) {
+					parent = parent[keys[j]];
+				}
+			}
+			var key = keys[keys.length - 1];
+			if (parent instanceof Array) {
+				var at = key === '-' ? parent.length : +key;
+				if (op.op === 'add') {
+					parent.splice(at, 0, op.value);
+				} else if (op.op === 'remove') {
+					parent.splice(at, 1);
+				} else {
+					parent[at] = op.value;
+				}
+			} else if (op.op === 'remove') {
+				delete parent[key];
+			} else {
+				parent[key] = op.value;
+			}
+		}
+		return doc;
+	};
+	// stateful keeps a state sent by the server's CallStateful, in full or
+	// as a patch to the version we have, and calls the method with it and
+	// the patch applied, if any. A patch to a version we do not have is
+	// put right by asking for the state in full
+	var stateful = function(cobj) {
+		var key = cobj.R + '\n' + cobj.M + '\n' + cobj.G;
+		var st = states[key];
+		var patch = null;
+		if (!cobj.B) {
+			st = states[key] = { v: cobj.N, s: cobj.S === undefined ? null : cobj.S };
+		} else if (st && cobj.N <= st.v) {
+			return; // overtaken by the state in full
+		} else if (st && st.v === cobj.B) {
+			patch = cobj.D || [];
+			st.s = applyPatch(st.s, patch);
+			st.v = cobj.N;
+		} else {
+			st = states[key] = st || { v: 0, s: null };
+			if (!st.asked) {
+				st.asked = true;
+				transport[web.t()].send(JSON.stringify({ T: 's', R: cobj.R, M: '__relayrState', A: [cobj.G, cobj.R, cobj.M] }));
+			}
+			return;
+		}
+		invoke({ R: cobj.R, M: cobj.M, A: [st.s, patch] });
+	};
+	// invoke calls a client method: the handler assigned to the relay's
+	// client object, if any, and then those added with on. Calls no
+	// handler takes raise unhandled, on the relay and the connection
+	var invoke = function(cobj) {
+		var hub = hubOf(cobj.J);
+		var relay = hub.relays[cobj.R];
+		var args = (cobj.A || []).slice();
+		if (cobj.R === '__relayrPresence') {
+			// users that joined or left together come in one call
+			for (var i = 0; i < args.length; i++) {
+				presence(cobj.M, [args[i]]);
+			}
+			return;
+		}
+		var revive = hub.revives[cobj.R];
+		if (revive && revive[cobj.M]) {
+			args = revive[cobj.M](args);
+		}
+		if (includeSender) {
+			// handlers are passed who made the call, with the server's
+			// IncludeSenderID, and whether it was us, after its arguments
+			var sender = cobj.W ? { connectionId: cobj.W.C, userId: cobj.W.U || null } : null;
+			args.push({ sender: sender, echo: !!sender && sender.connectionId === transport.ConnectionId });
+		}
+		var ack = function() {
+			// the server is waiting for an acknowledgement
+			cobj.K && transport[web.t()].send(JSON.stringify({ T: 's', R: cobj.R, M: '__relayrAck', A: [cobj.K] }));
+		};
+		if (!relay) {
+			fire('unhandled', cobj.R, cobj.M, args);
+			return;
+		}
+		var handler = relay.client[cobj.M];
+		var acked = false;
+		if (handler && cobj.K && handler.length > args.length) {
+			// handlers that take an extra done callback acknowledge by calling it
+			handler.apply(relay.client, args.concat([ack]));
+			acked = true;
+		} else if (handler) {
+			handler.apply(relay.client, args);
+		}
+		var n = hub.emits[cobj.R](cobj.M, args);
+		if (!handler && n === 0) {
+			hub.emits[cobj.R]('unhandled', [cobj.M, args]);
+			fire('unhandled', cobj.R, cobj.M, args);
+			return;
+		}
+		acked || ack();
+	};
+	var text = function(buf, o, n) {
+		var b = new Uint8Array(buf, o, n);
+		return window.TextDecoder ? new TextDecoder().decode(b) : String.fromCharCode.apply(null, b);
+	};
+	// unpack splits a binary frame into its relay, method and payload
+	var unpack = function(buf) {
+		var v = new DataView(buf), o = 1, parts = [];
+		for (var k = 0; k < 2; k++) {
+			var n = v.getUint16(o);
+			parts.push(text(buf, o + 2, n));
+			o += 2 + n;
+		}
+		return { R: parts[0], M: parts[1], B: buf.slice(o) };
+	};
+	var fromBase64 = function(s) {
+		var bin = atob(s), b = new Uint8Array(bin.length);
+		for (var i = 0; i < bin.length; i++) {
+			b[i] = bin.charCodeAt(i);
+		}
+		return b.buffer;
+	};
+	var binary = function(obj) {
+		if (!RelayR[obj.R]) return;
+		var lobj = RelayR[obj.R].binary;
+		lobj[obj.M] && lobj[obj.M].call(lobj, obj.B);
+	};
+	// setSlow raises connectionslow or connectionrecovered when the
+	// connection becomes slow or recovers
+	var setSlow = function(s) {
+		if (s !== slow) {
+			slow = s;
+			fire(s ? 'connectionslow' : 'connectionrecovered');
+		}
+	};
+	// move renegotiates when the server is draining, closing the websocket
+	// it was told on, if any, without its close renegotiating too
+	var move = function(socket) {
+		if (socket) {
+			socket.moved = true;
+			socket.close();
+		}
+		web.b();
+	};
+	// capabilities are the optional features we tell the server we support
+	var capabilities = ['ack', 'batch', 'binary', 'patch', 'ping'];
+	// ident identifies our connection in a URL: by the token the server
+	// gave us when it signs them, or otherwise by its ConnectionID
+	var ident = function() {
+		var id = transport.Token ? 'token=' + encodeURIComponent(transport.Token) : 'connectionId=' + transport.ConnectionId;
+		// and by the instance of the server holding it, if it said
+		return transport.Instance ? id + '&instance=' + encodeURIComponent(transport.Instance) : id;
+	};
+	// set from the manifest by configure
+	var route, wsRoute, callTimeout, preferred, withCredentials, includeSender;
+	// wsURL is where we open websockets: where the server told us as we
+	// negotiated or in the manifest, or else the route, over wss:// unless
+	// it is plain http, one without a scheme being on the page's host
+	var wsURL = function() {
+		if (wsRoute) return wsRoute;
+		if (/^https?:/i.test(route)) return route.replace(/^http/i, 'ws');
+		var page = typeof location !== 'undefined' ? location : { protocol: 'https:', host: '' };
+		var scheme = page.protocol === 'http:' ? 'ws:' : 'wss:';
+		return /^\/\//.test(route) ? scheme + route : scheme + '//' + page.host + route;
+	};
 	transport = {
 		websocket: {
 			waitForConnection: function (callback, interval) {
@@ -23,42 +384,91 @@ RelayRConnection = (function() {
 				if (s.socket.readyState === 1) {
 					callback();
 				} else {
-					console.log('%%c-> websocket: connection is not ready, waiting ' + interval + 'ms', 'color:yellow');
+					console.log('%c-> websocket: connection is not ready, waiting ' + interval + 'ms', 'color:yellow');
 					setTimeout(function () {
 						s.waitForConnection(callback, interval);
 					}, interval);
 				}
 			},
-			connect: function(c) {
+			// connect opens a websocket, or takes over the one given, which
+			// we upgraded to from long-polling and is open already
+			connect: function(c, upgraded) {
 				var s = this;
-				s.socket = new WebSocket("wss://" + routeWithoutScheme + "/ws?connectionId=" + transport.ConnectionId);
+				var socket = s.socket = upgraded || new WebSocket(wsURL() + "/ws?" + ident(), subprotocol);
+				// the server sends a ping frame with each of its pings, which
+				// browsers do not let us see
+				var alive = function() {
+					socket.moved || heard(function() {
+						move(socket);
+					});
+				};
+				s.socket.binaryType = 'arraybuffer';
 				s.socket.onclose = function(evt) {
-					console.log('%%c-> websocket: connection closed', 'color:orange', transport.ConnectionId);
-					setTimeout(function() {
-						web.n(); // renegotiate
-					}, 2000);
+					console.log('%c-> websocket: connection closed', 'color:orange', transport.ConnectionId);
+					clearTimeout(probe);
+					if (socket.moved) {
+						return; // already renegotiating
+					}
+					if (!socket.opened) {
+						// long-poll until a websocket gets through
+						unreachable = true;
+					}
+					if (evt.code === 4000) {
+						kicked(evt.reason);
+						return;
+					}
+					if (evt.code === 1009) {
+						// we sent more than the server accepts
+						fire('error', failure('relayr: message too large', api.codes.tooLarge));
+					}
+					// 4004 and 4005, the websocket went quiet or reached
+					// another instance than ours, are renegotiated as they are
+					if (evt.code === 4007) {
+						// the server does not speak our framing; long-poll instead
+						unreachable = true;
+					}
+					if (evt.code === 4001 || evt.code === 4002 || evt.code === 4003) {
+						// the server does not know our connection, another
+						// socket has it, or our token is no good; start afresh
+						transport.ConnectionId = transport.Token = null;
+					}
+					web.b(); // renegotiate
 				};
 
 				s.socket.onmessage = function(evt) {
+					alive();
 					c(evt.data);
 				};
 
 				s.socket.onerror = function(evt) {
-					console.log('%%c-> websocket: connection error', 'color:red', evt);
-					setTimeout(function() {
-						s.connect(c);
-					});
+					// onclose follows, which reconnects
+					console.log('%c-> websocket: connection error', 'color:red', evt);
 				};
 
 				s.socket.onopen = function(evt) {
-					readyCalled 
-						? console.log('%%c-> websocket: connection opened %%c(readyCalled == true)', 'color:green', 'color:red', evt)
-						: console.log('%%c-> websocket: connection opened', 'color:green', evt);
-					if (!readyCalled) {
-						RelayRConnection.r();
-						readyCalled = true;
+					console.log('%c-> websocket: connection opened', 'color:green', evt);
+					socket.opened = true;
+					alive();
+					if (probeTimeout) {
+						// a proxy may let the upgrade through and then mangle
+						// or hold back the frames, so unless the handshake
+						// the server sends first arrives, we long-poll,
+						// telling the server why we closed the websocket
+						clearTimeout(probe);
+						probe = setTimeout(function() {
+							console.log('%c-> websocket: no handshake within ' + probeTimeout + 'ms, falling back to long-polling', 'color:orange');
+							unreachable = true;
+							socket.moved = true;
+							socket.close(4008, 'relayr: handshake did not arrive');
+							web.b();
+						}, probeTimeout);
 					}
+					connected();
 				};
+				if (upgraded) {
+					socket.opened = true;
+					alive();
+				}
 			},
 			send: function (data) {
 				var s = this;
@@ -69,32 +479,154 @@ RelayRConnection = (function() {
 		},
 		longpoll: {
 			connect: function(c) {
-				if (!readyCalled) {
-					RelayRConnection.r();
-					readyCalled = true;
-				}
-				var retry;
+				// each poll is answered within the keepalive, with an empty
+				// batch if nothing else; one that is not is abandoned
+				var poll, lost = false;
+				var alive = function() {
+					heard(function() {
+						lost = true;
+						poll.abort();
+						web.b();
+					});
+				};
+				alive();
+				connected();
+				// after a websocket would not open, we try upgrading to one,
+				// waiting longer after each try that fails
+				var wait = upgradeDelay, upgradeAt = new Date().getTime() + wait;
+				var retry, upgrade;
 				retry = function() {
-					web.gj(route + '/longpoll?connectionId=' + transport.ConnectionId + '&_=' + new Date().getTime(), function(data) {
+					poll = web.gj(route + '/longpoll?' + ident() + '&seq=' + pollSeq + '&_=' + new Date().getTime(), function(data) {
+						if (lost) return;
 						if (data.responseText) {
-							var reconn = JSON.parse(data.responseText);
-							if (reconn.Z) {
-								web.n();
+							var res = JSON.parse(data.responseText);
+							if (res.Z === 'DISCONNECTED') {
+								kicked(res.D);
+							} else if (res.Z) {
+								web.b();
 							} else {
-								c(data);
-								retry();
+								// queued messages arrive together, oldest first and
+								// numbered up to Seq; ones we have already seen are
+								// being sent again and are skipped. An empty batch is
+								// a heartbeat
+								var first = res.Seq - res.Messages.length + 1;
+								for (var i = 0; i < res.Messages.length; i++) {
+									if (first + i > pollSeq) {
+										c(res.Messages[i]);
+									}
+								}
+								pollSeq = Math.max(pollSeq, res.Seq);
+								alive();
+								if (unreachable && wait && new Date().getTime() >= upgradeAt) {
+									upgrade();
+								} else {
+									retry();
+								}
 							}
 						} else {
-							web.n();
+							web.b();
+						}
+					}, function(xd) {
+						if (lost) return;
+						if (xd.status === 401) {
+							// our token is no good; start afresh
+							transport.ConnectionId = transport.Token = null;
 						}
+						web.b();
 					});
 				};
+				// upgrade opens a websocket naming the last message we polled
+				// for. Once the server has handed our connection over to it,
+				// it tells us so and sends those we have yet to see; until
+				// then we do not poll. If it refuses, we carry on polling
+				upgrade = function() {
+					var s = transport.longpoll, done = false;
+					var socket = new WebSocket(wsURL() + "/ws?" + ident() + '&upgrade=' + pollSeq, subprotocol);
+					var finish = function() {
+						done = true;
+						clearTimeout(timer);
+						s.upgraded = null;
+					};
+					var failed = function() {
+						if (done) return;
+						finish();
+						socket.onclose = socket.onmessage = null;
+						socket.close();
+						wait = Math.min(wait * 2, upgradeDelay * 16);
+						upgradeAt = new Date().getTime() + wait;
+						lost || retry();
+					};
+					// given up on within the keepalive, before the poll we are
+					// not making would be missed
+					var timer = setTimeout(failed, keepAlive || 10000);
+					socket.binaryType = 'arraybuffer';
+					socket.onmessage = function(evt) {
+						c(evt.data);
+					};
+					socket.onclose = failed;
+					s.upgraded = function() {
+						if (done) return;
+						finish();
+						if (lost) {
+							socket.close();
+							return;
+						}
+						console.log('%c-> longpoll: upgraded to a websocket', 'color:green');
+						unreachable = false;
+						// we are pinged as the server said in its handshake
+						keepAlive = api.server && api.server.keepAlive || keepAlive;
+						transport.websocket.connect(c, socket);
+						fire('upgraded');
+					};
+				};
 
 				retry();
 			},
-			send: function(data) {
+			send: function(data, tries) {
 				var s = this;
-				web.p(route + '/call?connectionId=' + transport.ConnectionId + '&_=' + new Date().getTime(), data, null, "json", null); 
+				var start = new Date().getTime();
+				tries = tries || 0;
+				web.p(route + '/call?' + ident() + '&_=' + start, data, function() {
+					// we are not pinged, so how long calls take to be
+					// accepted tells whether the connection is slow
+					if (slowRoundTrip) {
+						setSlow(new Date().getTime() - start > slowRoundTrip);
+					}
+				}, "json", function(xd) {
+					var receipt, id, frame;
+					// a call whose POST failed or timed out unanswered may
+					// have been run nonetheless, so it is sent again under
+					// its call ID, which the server runs only once
+					if (!xd.status) {
+						try {
+							frame = JSON.parse(data);
+						} catch (err) {
+							return;
+						}
+						if (frame.K && pending[frame.I] && tries < 3) {
+							setTimeout(function() {
+								pending[frame.I] && s.send(data, tries + 1);
+							}, 1000 << tries);
+						}
+						return;
+					}
+					// a call the server refused says why, so it fails now
+					// rather than when it times out
+					try {
+						receipt = JSON.parse(xd.responseText);
+					} catch (err) {
+						return;
+					}
+					// a call too large to be read is refused without its id
+					try {
+						id = receipt.InvocationID || JSON.parse(data).I;
+					} catch (err) {}
+					if (id && pending[id]) {
+						settle({ I: id, E: receipt.Error, C: receipt.Code });
+					} else if (receipt.Error) {
+						fire('error', failure(receipt.Error, receipt.Code));
+					}
+				}, callTimeout / 4);
 			}
 		}
 	};
@@ -105,6 +637,7 @@ RelayRConnection = (function() {
 
 				if (window.XMLHttpRequest) {
 					xd = new XMLHttpRequest();
+					xd.withCredentials = withCredentials;
 				}
 				else {
 					xd = new ActiveXObject("Microsoft.XMLHTTP");
@@ -127,7 +660,7 @@ RelayRConnection = (function() {
 
 				xd.send();
 			},
-			gj: function(u, c) {
+			gj: function(u, c, e) {
 				var s = this;
 
 				var xd = s.x();
@@ -139,19 +672,26 @@ RelayRConnection = (function() {
 					if (xd.readyState === 4) {
 						if (xd.status === 200) {
 							c(xd);
-						} 
+						} else if (e) {
+							e(xd);
+						}
 					} 
 				};
 
 				xd.send();
+				return xd;
 			},
-			p: function(u, d, c, t, e) {
+			// p posts d to u, giving up after timeout milliseconds if given
+			p: function(u, d, c, t, e, timeout) {
 				var s = this;
 
 				var xd = s.x();
 
 				xd.open('POST', u, true);
 				xd.setRequestHeader("Content-type", "application/" + t);
+				if (timeout) {
+					xd.timeout = timeout;
+				}
 
 				xd.onreadystatechange = function() {
 					if (xd.readyState === 4) {
@@ -159,6 +699,8 @@ RelayRConnection = (function() {
 							if (c) {
 								c(xd);
 							}
+						} else if (xd.status && e) {
+							e(xd);
 						}
 					} 
 				};
@@ -168,6 +710,7 @@ RelayRConnection = (function() {
 						e(xd);
 					}
 				};
+				xd.ontimeout = xd.onerror;
 
 				xd.send(d);
 
@@ -176,106 +719,656 @@ RelayRConnection = (function() {
 					xd = null;
 				};
 			},
+			// t picks the first preferred transport this browser supports
 			t: function() {
-				if (!!window.WebSocket) {
-					return "websocket";
-				} else {
-					return "longpoll";
+				for (var i = 0; i < preferred.length; i++) {
+					var name = preferred[i];
+					if (name === "websocket" && (!window.WebSocket || unreachable)) {
+						continue;
+					}
+					if (transport[name]) {
+						return name;
+					}
 				}
+				return "longpoll";
 
 				// TODO: Implement SSE Circuit
 				/*if (typeof EventSource !== 'undefined') {
 					return "SSE";
 				}*/
 			},
+			// b renegotiates after an exponential backoff, up to 30 seconds
+			b: function() {
+				var s = this;
+				clearTimeout(liveness);
+				if (stopped) return;
+				rejectAll('relayr: connection lost');
+				if (attempts++ === 0 && transport.ConnectionId) {
+					setState('reconnecting');
+					fire('reconnecting');
+				}
+				setTimeout(function() {
+					s.n();
+				}, Math.min(30000, 500 * Math.pow(2, attempts)));
+			},
 			n: function() {
 				var s = this;
 				var t = s.t();
-				web.p(route + "/negotiate?_=" + new Date().getTime(), JSON.stringify({ t: t }), function(result) {
+				var previous = transport.ConnectionId;
+				web.p(route + "/negotiate?_=" + new Date().getTime(), JSON.stringify({ t: t, p: transport.Token || previous || "", v: 2, g: api.groups, q: api.qs, f: capabilities, u: used }), function(result) {
 					var obj = JSON.parse(result.responseText);
+					if (obj.ConnectionID !== previous) {
+						pollSeq = 0;
+					}
 					transport.ConnectionId = obj.ConnectionID;
+					transport.Token = obj.Token || null;
+					transport.Instance = obj.Instance || null;
+					slowRoundTrip = obj.SlowRoundTrip || 0;
+					keepAlive = obj.KeepAlive || 0;
+					upgradeDelay = obj.Upgrade || 0;
+					probeTimeout = obj.Probe || 0;
+					wsRoute = obj.WebSocketURL || wsRoute;
+					defineHubs(obj.Hubs);
+					attempts = 0;
+					if (previous) {
+						// the server either restored our groups and state, or has forgotten us
+						fire(obj.Reconnected ? 'reconnected' : 'disconnected');
+					}
 					setTimeout(function() {
-						transport[t].connect(function(data) {
-							var cobj;
-							if (data.responseText && data.status && data.responseXML) {
-								cobj = JSON.parse(data.responseText);
-							} else {
-								if (data.responseText == "") return;
-								cobj = JSON.parse(data);
+						transport[t].connect(function dispatch(data) {
+							if (data instanceof ArrayBuffer) {
+								binary(unpack(data));
+								return;
 							}
-							var lobj = RelayR[cobj.R].client;
-							var args = [];
-							for (var i = 0; i < cobj.A.length; i++) {
-								args.push(cobj.A[i]);
+							var cobj = typeof data === 'string' ? JSON.parse(data) : data;
+							if (cobj instanceof Array) {
+								// several frames, batched into one message
+								for (var i = 0; i < cobj.length; i++) {
+									dispatch(cobj[i]);
+								}
+								return;
 							}
-							lobj[cobj.M] && lobj[cobj.M].apply(lobj||window, args);
+							// we negotiate protocol version 2, so every frame names its type
+							switch (cobj.T) {
+							case 'h':
+								// the server describes itself when the websocket opens
+								api.server = { version: cobj.V, keepAlive: cobj.K, maxMessageSize: cobj.X };
+								clearTimeout(probe);
+								return;
+							case 'r':
+								settle(cobj);
+								return;
+							case 'i':
+								streamed(cobj);
+								return;
+							case 'k':
+								credited(cobj);
+								return;
+							case 'g':
+								progressed(cobj);
+								return;
+							case 'e':
+								// the server could not handle something we sent
+								console.log('%c-> ~relayr: ' + cobj.E, 'color:red');
+								fire('error', failure(cobj.E, cobj.C));
+								return;
+							case 'b':
+								binary({ R: cobj.R, M: cobj.M, B: fromBase64(cobj.B) });
+								return;
+							case 'd':
+								// a group's state, in full or as a patch
+								stateful(cobj);
+								return;
+							case 'c':
+								// replayed calls are those made to a group before we joined
+								// it, and missed ones those made to our user while away
+								api.replaying = !!cobj.H;
+								api.missed = !!cobj.O;
+								api.trace = cobj.P || null;
+								try {
+									invoke(cobj);
+								} finally {
+									api.replaying = false;
+									api.missed = false;
+									api.trace = null;
+								}
+								return;
+							case 'z':
+								// the server is draining and wants us elsewhere
+								if (cobj.Z === 'RECONNECT') {
+									move(transport.websocket.socket);
+								}
+								// or that the websocket we opened to upgrade to has
+								// taken over from long-polling
+								if (cobj.Z === 'UPGRADED' && transport.longpoll.upgraded) {
+									transport.longpoll.upgraded();
+								}
+								// or tells us our connection is slow, or has recovered
+								if (cobj.Z === 'SLOW' || cobj.Z === 'RECOVERED') {
+									setSlow(cobj.Z === 'SLOW');
+								}
+								// or that it removed us from a group, which we no
+								// longer ask to join as we negotiate
+								if (cobj.Z === 'REMOVED') {
+									for (var g = api.groups || [], i = g.length - 1; i >= 0; i--) {
+										if (g[i] === cobj.G) g.splice(i, 1);
+									}
+									fire('removed', cobj.G);
+								}
+								// or that its relays have changed
+								if (cobj.Z === 'RELAYS') {
+									redefine(cobj.S || []);
+								}
+								if (builtinControls[cobj.Z]) {
+									control('relayr.' + builtinControls[cobj.Z], [cobj.Z === 'RELAYS' ? cobj.S : cobj.G]);
+								}
+								return;
+							case 'x':
+								// a control frame of the application's own
+								control(cobj.Z, [cobj.V]);
+								return;
+							}
+							// pings, and frames we do not understand, are ignored
 						});
 					}, 0);
 				}, "json",
 				function(result) {
-					console.log('%%c-> ~relayr: negotiate error', 'color:red', result);
+					console.log('%c-> ~relayr: negotiate error', 'color:red', result);
+					fire('error', new Error('relayr: negotiation failed'));
 					// error .. try again
-					setTimeout(function() {
-						s.n();
-					}, 2000);
+					s.b();
 				});
 			}
 		};
 	})();
 
-	return {
-		ready: function(r) {
-			RelayRConnection.r = r;
-
-			web.n();
-		},
-		callServer: function(r, f, a) {
-			transport[web.t()].send(JSON.stringify({ S: true, C: transport.ConnectionId, R: r, M: f, A: a}));
+	// request sends frame, a call to the server or a request of it, under a
+	// new InvocationID, returning a promise of its result as callServer
+	// does. what names it in errors
+	var request = function(frame, what) {
+		var id = String(++callId);
+		var call = {};
+		var result = {};
+		if (window.Promise) {
+			result = new Promise(function(resolve, reject) {
+				call.resolve = resolve;
+				call.reject = reject;
+			});
 		}
+		call.ok = function(v) {
+			call.resolve && call.resolve(v);
+			call.onDone && call.onDone(v);
+		};
+		call.fail = function(err) {
+			call.reject && call.reject(err);
+			call.onError && call.onError(err);
+		};
+		// arm starts the call's timeouts over
+		call.arm = function() {
+			clearTimeout(call.timer);
+			clearTimeout(call.slow);
+			call.timer = setTimeout(function() {
+				delete pending[id];
+				call.fail(new Error('relayr: ' + what + ' timed out'));
+			}, callTimeout);
+			// a call that has taken half its time is slow
+			call.slow = setTimeout(function() {
+				fire('slow', what);
+			}, callTimeout / 2);
+		};
+		result.stream = function(onItem, onDone, onError) {
+			call.onItem = onItem;
+			call.onDone = onDone;
+			call.onError = onError;
+			// failures go to onError rather than going unhandled
+			result.then && result.then(null, function() {});
+			return result;
+		};
+		// onProgress passes the progress the server method reports, if it
+		// takes a Progress, to handler as handler(percent, note)
+		result.onProgress = function(handler) {
+			call.onProgress = handler;
+			return result;
+		};
+		// cancel stops the call, cancelling the context of the server
+		// method, which should stop producing a streaming result
+		result.cancel = function() {
+			if (!pending[id]) return;
+			delete pending[id];
+			clearTimeout(call.timer);
+			clearTimeout(call.slow);
+			transport[web.t()].send(JSON.stringify({ T: 's', R: frame.R, M: '__relayrCancel', A: [id] }));
+			call.fail(new Error('relayr: ' + what + ' cancelled'));
+		};
+		frame.I = id;
+		if (frame.T === 's') {
+			frame.K = callKey + '.' + id;
+		}
+		var data = JSON.stringify(frame);
+		// the server closes the connection of a client that sends more
+		// than it accepts, so such calls fail here instead
+		if (api.server && data.length > api.server.maxMessageSize) {
+			setTimeout(function() {
+				call.fail(failure('relayr: ' + what + ' call is too large', api.codes.tooLarge));
+			}, 0);
+			return result;
+		}
+		call.arm();
+		pending[id] = call;
+		transport[web.t()].send(data);
+		return result;
 	};
-})();
-
-`
-
-const relayClassBegin = `
 
-var RelayR = (function() {
-	return {
-
-`
-
-const relayBegin = `
-
-%v: {
-
-	client: {},
-
-	server: {
-
-`
+	// upload calls a server method that reads an IncomingStream, returning
+	// a writer of the chunks it reads. write queues a chunk, sent once the
+	// server has room for it, and returns a promise that it was sent; end
+	// ends the upload and returns a promise of the method's result; and
+	// abort cancels the call
+	var upload = function(r, f, a) {
+		var queue = [], seq = 0, granted = 0, closed = null;
+		var frame = { T: 's', R: r, M: f, A: a, U: true, P: api.traceParent ? api.traceParent(r, f) : undefined };
+		var result = request(frame, r + '.' + f);
+		var id = frame.I;
+		var flush = function() {
+			while (queue.length && (queue[0].end || seq < granted)) {
+				var w = queue.shift();
+				transport[web.t()].send(JSON.stringify(w.end ? { T: 'u', I: id, N: seq, F: true } : { T: 'u', I: id, N: seq++, A: [w.chunk] }));
+				pending[id] && pending[id].arm();
+				w.sent();
+			}
+		};
+		// finish fails the chunks still queued once the call is over
+		var finish = function(err) {
+			delete uploads[id];
+			closed = closed || err || new Error('relayr: ' + r + '.' + f + ' upload ended');
+			var q = queue;
+			queue = [];
+			for (var i = 0; i < q.length; i++) {
+				q[i].fail(closed);
+			}
+		};
+		var enqueue = function(w) {
+			var p;
+			w.sent = w.fail = function() {};
+			if (window.Promise) {
+				p = new Promise(function(resolve, reject) {
+					w.sent = resolve;
+					w.fail = reject;
+				});
+			}
+			if (closed) {
+				w.fail(closed);
+				return p;
+			}
+			queue.push(w);
+			flush();
+			return p;
+		};
+		uploads[id] = function(n) {
+			if (n > granted) granted = n;
+			flush();
+		};
+		result.stream && result.stream(null, function() { finish(); }, finish);
+		return {
+			write: function(chunk) {
+				return enqueue({ chunk: chunk });
+			},
+			end: function() {
+				enqueue({ end: true });
+				closed = closed || new Error('relayr: ' + r + '.' + f + ' upload ended');
+				return result;
+			},
+			abort: function() {
+				result.cancel();
+			}
+		};
+	};
 
-// {0} == function name
-// {1} == Relay name
-// {2} == function name
-const relayMethod = `
+	// call calls a server method of the Exchange's, or of the named hub's,
+	// as callServer does
+	var call = function(r, f, a, hub) {
+		var frame = { T: 's', R: r, M: f, A: a, P: api.traceParent ? api.traceParent(r, f) : undefined, J: hub };
+		return request(frame, (hub ? hub + '/' : '') + r + '.' + f);
+	};
 
-%v: function() {
-	RelayRConnection.callServer('%v', '%v', Array.prototype.slice.call(arguments));
-},
+	// method makes the stub of a server method, of the named hub's if
+	// given one, which checks it is passed as many arguments as the method
+	// takes. The stubs of the Exchange's methods that read an
+	// IncomingStream also have stream, which calls the method as upload
+	// does. Those of methods the server cannot serve throw, saying why
+	var method = function(r, f, hub) {
+		if (f.unavailable) {
+			return function() {
+				throw new Error('relayr: ' + r + '.' + f.name + ' cannot be called: it ' + f.unavailable);
+			};
+		}
+		var n = f.params.length;
+		var min = f.variadic ? n - 1 : n;
+		var check = function(a) {
+			if (a.length < min || (!f.variadic && a.length > n)) {
+				throw new Error('relayr: ' + r + '.' + f.name + ' takes ' + (f.variadic ? 'at least ' : '') + min +
+					' argument' + (min === 1 ? '' : 's') + ', not ' + a.length);
+			}
+			return a;
+		};
+		var stub = function() {
+			return call(r, f.name, check(Array.prototype.slice.call(arguments)), hub);
+		};
+		if (f.upload && !hub) {
+			stub.stream = function() {
+				return upload(r, f.name, check(Array.prototype.slice.call(arguments)));
+			};
+		}
+		return stub;
+	};
 
-`
+	// reviver makes the function reviving a value as the server described
+	// it: the strings of dates become Dates, and the fields absent or null
+	// take their defaults. Values described as any are left as they are
+	var reviver = function(d) {
+		if (!d) return null;
+		var fields = [], items = reviver(d.items);
+		for (var k in d.fields || {}) {
+			if (d.fields.hasOwnProperty(k)) {
+				fields.push({ name: k, def: d.fields[k]['default'], revive: reviver(d.fields[k]) });
+			}
+		}
+		return function(v) {
+			if (d.type === 'date') {
+				// Date only parses milliseconds everywhere
+				var t = typeof v === 'string' ? new Date(v.replace(/(\.\d{3})\d+/, '$1')) : null;
+				return t && !isNaN(t.getTime()) ? t : v;
+			}
+			if (v === null || typeof v !== 'object') return v;
+			if (items && (d.type === 'array' || d.type === 'map')) {
+				for (var i in v) {
+					if (v.hasOwnProperty(i)) v[i] = items(v[i]);
+				}
+			}
+			for (var j = 0; j < fields.length; j++) {
+				var f = fields[j], x = v[f.name];
+				if ((x === undefined || x === null) && f.def !== undefined) {
+					// each object gets its own copy of the default
+					x = JSON.parse(JSON.stringify(f.def));
+				}
+				if (x !== undefined) v[f.name] = f.revive(x);
+			}
+			return v;
+		};
+	};
+	// revivers makes the functions reviving the arguments of a relay's
+	// client methods, by method, from the server's descriptions
+	var revivers = function(described) {
+		var r = {};
+		for (var m in described || {}) {
+			if (described.hasOwnProperty(m)) {
+				r[m] = (function(fns) {
+					return function(args) {
+						for (var i = 0; i < fns.length && i < args.length; i++) {
+							if (fns[i]) args[i] = fns[i](args[i]);
+						}
+						return args;
+					};
+				})(described[m].map(reviver));
+			}
+		}
+		return r;
+	};
 
-const relayEnd = `
+	// setUp sets up a relay, adding its emit function to emits
+	var setUp = function(emits, name, r) {
+		r.client = {};
+		r.binary = {};
+		emits[name] = emitter(r);
+		return r;
+	};
 
-},
+	// define adds the relays of a schema to RelayR, or to the named hub.
+	// Relays there already have their server stubs replaced, keeping the
+	// handlers added to them
+	var define = function(schema, name) {
+		var hub = hubOf(name);
+		for (var i = 0; i < schema.length; i++) {
+			var relay = schema[i], server = {};
+			for (var j = 0; j < relay.methods.length; j++) {
+				server[relay.methods[j].script] = method(relay.name, relay.methods[j], name);
+			}
+			if (hub.emits[relay.name] && hub.relays[relay.name]) {
+				hub.relays[relay.name].server = server;
+			} else {
+				hub.relays[relay.name] = setUp(hub.emits, relay.name, { server: server });
+			}
+			hub.revives[relay.name] = revivers(relay.clientArgs);
+		}
+	};
 
-},
+	// defineHubs adds the relays of the schemas of an ExchangeGroup's
+	// hubs, by name, to the hubs
+	var defineHubs = function(schemas) {
+		for (var name in schemas || {}) {
+			if (schemas.hasOwnProperty(name)) {
+				define(schemas[name], name);
+			}
+		}
+	};
 
-`
+	// redefine applies the schema the server sends once its relays change,
+	// removing from RelayR the relays it no longer has, and raises relays
+	// with the names of those it has
+	var redefine = function(schema) {
+		var names = [], listed = {}, loaded = [];
+		for (var i = 0; i < schema.length; i++) {
+			names.push(schema[i].name);
+			listed[schema[i].name] = true;
+			// with LazyRelays, only the relays we loaded are added
+			if (!used || used.indexOf(schema[i].name) >= 0) {
+				loaded.push(schema[i]);
+			}
+		}
+		for (var name in relays) {
+			if (relays.hasOwnProperty(name) && !listed[name]) {
+				delete relays[name];
+				delete RelayR[name];
+				delete revives[name];
+			}
+		}
+		define(loaded);
+		fire('relays', names);
+	};
 
-const relayClassEnd = `
+	api = {
+		// one of disconnected, connecting, connected or reconnecting
+		state: 'disconnected',
+		// what the server said of itself in its handshake, over websockets:
+		// version, keepAlive and maxMessageSize
+		server: null,
+		// the codes the server gives the errors it reports, which the
+		// Errors calls fail with and error events are raised with carry
+		// as their code. Those from 5000 up are the application's
+		codes: { unknownRelay: 4100, unknownMethod: 4101, badArguments: 4102, forbidden: 4200, rateLimited: 4300, tooLarge: 4400 },
+		// the groups the server is asked to add us to as we negotiate, so
+		// that we miss nothing sent to them before we connect. It only
+		// adds us to those its AllowInitialGroup allows
+		groups: null,
+		// the values passed as we negotiate, which relay methods read with
+		// ConnectionValues; set with configure({qs: {...}})
+		qs: null,
+		// set while the handlers of a call replayed from the history of a
+		// group we joined run, with the server's RetainGroupMessages
+		replaying: false,
+		// set while the handlers of a call made to our user while none of
+		// its clients were connected run, with the server's OfflineStore
+		missed: false,
+		// set while the handlers of a call run to the traceparent of the
+		// server's trace it was made in, if any
+		trace: null,
+		// traceParent, when set, is called with the relay and method of
+		// each call to the server and returns the traceparent of the span
+		// making it, which the server continues the trace of
+		traceParent: null,
+		ready: function(r) {
+			api.r = r;
+			// relays still loading with use are waited for, so that we
+			// negotiate with them
+			if (loading) {
+				afterUse = function() {
+					api.ready(r);
+				};
+				return;
+			}
+			started = true;
+			if (api.state === 'disconnected') {
+				setState('connecting');
+			}
 
+			web.n();
+		},
+		// relay sets up a relay of the manifest
+		relay: function(name, r) {
+			return setUp(relays, name, r);
+		},
+		// hub returns the relays of the named hub of the ExchangeGroup
+		// serving us, as RelayR holds the Exchange's own, each with server,
+		// client and on as those have. They are there once the manifest, or
+		// failing that our negotiation, has described the hub
+		hub: function(name) {
+			return hubOf(name).relays;
+		},
+		// configure applies an Exchange's manifest: the URLs it is served
+		// at, its options, and the schema of its relays, which are added to
+		// RelayR. Given qs instead, an object of values, it sets those
+		// passed as we negotiate, so it must be called before ready
+		configure: function(m) {
+			if (m.qs) {
+				api.qs = {};
+				for (var k in m.qs) {
+					if (m.qs.hasOwnProperty(k)) {
+						api.qs[k] = String(m.qs[k]);
+					}
+				}
+			}
+			if (!m.relays) return;
+			route = m.route;
+			wsRoute = m.wsURL || null;
+			callTimeout = m.callTimeout;
+			preferred = m.transports;
+			withCredentials = m.withCredentials;
+			includeSender = !!m.includeSender;
+			used = m.lazy ? used || [] : null;
+			define(m.relays);
+			defineHubs(m.hubs);
+		},
+		// load fetches the manifest of the Exchange served at url, such as
+		// "https://example.com/relayr", for a script served apart from it,
+		// then connects as ready does
+		load: function(url, r) {
+			web.gj(url + '/manifest?_=' + new Date().getTime(), function(result) {
+				api.configure(JSON.parse(result.responseText));
+				api.ready(r);
+			}, function(result) {
+				console.log('%c-> ~relayr: manifest error', 'color:red', result);
+				fire('error', new Error('relayr: could not load the manifest'));
+			});
+		},
+		// use loads the relays with the given name, or names, from an
+		// Exchange with LazyRelays, adding them to RelayR, and then calls r,
+		// returning a promise where promises are supported. It is called
+		// before ready, which waits for the relays to load, as the server
+		// refuses calls to relays we did not negotiate with. From an
+		// Exchange without LazyRelays, whose relays are all there, it just
+		// calls r
+		use: function(names, r) {
+			names = [].concat(names);
+			var left = names.length, failed = null, settle = {}, result;
+			if (window.Promise) {
+				result = new Promise(function(resolve, reject) {
+					settle.resolve = resolve;
+					settle.reject = reject;
+				});
+				// failures are raised as errors too
+				result.then(null, function() {});
+			}
+			var done = function() {
+				if (failed) {
+					fire('error', failed);
+					settle.reject && settle.reject(failed);
+					return;
+				}
+				r && r();
+				settle.resolve && settle.resolve();
+			};
+			if (!used || !left || started) {
+				if (used && started) {
+					failed = new Error('relayr: use must be called before ready');
+				}
+				setTimeout(done, 0);
+				return result;
+			}
+			loading++;
+			var loaded = function() {
+				if (--left) return;
+				if (!--loading && afterUse) {
+					var f = afterUse;
+					afterUse = null;
+					f();
+				}
+				done();
+			};
+			for (var i = 0; i < names.length; i++) {
+				(function(name) {
+					web.gj(route + '/manifest?relay=' + encodeURIComponent(name), function(res) {
+						define([JSON.parse(res.responseText)]);
+						if (used.indexOf(name) < 0) {
+							used.push(name);
+						}
+						loaded();
+					}, function() {
+						failed = failed || new Error('relayr: could not load relay ' + name);
+						loaded();
+					});
+				})(names[i]);
+			}
+			return result;
+		},
+		// callServer calls a server method, returning a promise of its result
+		// where promises are supported. The result also has stream, which
+		// takes the items of a method that returns a channel as they arrive,
+		// and cancel, which stops the call
+		callServer: function(r, f, a) {
+			return call(r, f, a);
+		},
+		// join asks the server to add us to a group, of the named hub's if
+		// given one, as its GroupJoinAuthorizer allows, returning a promise
+		// of whether we joined it, being false if we were in it already
+		join: function(group, hub) {
+			return request({ T: 'j', G: group, J: hub }, 'joining ' + group);
+		},
+		// leave asks the server to remove us from a group, of the named
+		// hub's if given one, returning a promise of whether we left it,
+		// being false if we were not in it
+		leave: function(group, hub) {
+			return request({ T: 'l', G: group, J: hub }, 'leaving ' + group);
+		},
+		// onControl adds a handler for the control frames of a kind the
+		// server sends with SendControl, which is passed their payload.
+		// Those of kinds starting "relayr." are the server's own
+		onControl: function(kind, fn) {
+			controls.on(kind, fn);
+			return api;
+		},
+		// offControl removes a handler added with onControl, or every
+		// handler for the kind when fn is omitted
+		offControl: function(kind, fn) {
+			controls.off(kind, fn);
+			return api;
+		}
 	};
+	emit = emitter(api);
+	// presence raises joined and left as users join and leave the groups
+	// we are in, with the server's presence enabled
+	presence = emitter(api.presence = {});
+	control = emitter(controls);
+	return api;
 })();
 
 `
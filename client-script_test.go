@@ -0,0 +1,51 @@
+package relayr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// Rooms is a relay with several methods for the client script to stub.
+type Rooms struct{}
+
+func (Rooms) Join(r *Relay, room string) []string { return nil }
+
+func (Rooms) Leave(r *Relay, room string) {}
+
+func TestClientScriptParses(t *testing.T) {
+	for _, minify := range []bool{false, true} {
+		name := "plain"
+		if minify {
+			name = "minified"
+		}
+		t.Run(name, func(t *testing.T) {
+			e := newExchange(t, "http://localhost/relayr", ExchangeOptions{DisableScriptMinify: !minify})
+			e.RegisterRelay(Chat{})
+			e.RegisterRelay(Rooms{})
+			script := getScript(e, "/relayr/client.js", nil).Body.String()
+
+			if _, err := goja.Compile("client.js", script, false); err != nil {
+				t.Fatalf("the client script does not parse: %v", err)
+			}
+			for _, want := range []string{
+				`"name":"Chat"`, `"script":"say"`, `"name":"Rooms"`, `"script":"join"`, `"script":"leave"`,
+				".once", ".off", "'unhandled'", "'connected'", "'reconnecting'", "'slow'", "'error'", ".state",
+			} {
+				if !strings.Contains(script, want) {
+					t.Errorf("the client script lacks %s", want)
+				}
+			}
+			if minify {
+				// the minified script has no comments, so these can only be
+				// code browsers without ES2015 cannot run
+				for _, es2015 := range []string{"=>", "`", "let ", "const ", "class "} {
+					if strings.Contains(script, es2015) {
+						t.Errorf("the client script uses %q", es2015)
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,41 @@
 package relayr
 
+import "sync/atomic"
+
 type client struct {
 	ConnectionID string
 	exchange     *Exchange
-	transport    Transport
+	transportPtr atomic.Pointer[Transport] // see transport
+	state        *ConnectionState
+	extracted    *ConnectionState // the values the ContextExtractor took from its negotiation and websocket
+	principal    interface{}
+	userID       string // derived from principal by the UserIDProvider
+	codec        Codec
+	protocol     int          // the negotiated protocol version
+	caps         capabilities // the optional features the client supports
+	limiter      *callLimiter
+	bandwidth    *bandwidth        // throttles what the client is sent, and counts it
+	addr         string            // the IP address the client negotiated from
+	values       map[string]string // passed as the client negotiated; never changed
+	lastActive   atomic.Int64      // when the client last sent or was sent something, in unix nanoseconds
+	lastSeen     atomic.Int64      // when the client was last heard from, keep-alives and polls included, in unix nanoseconds
+	gone         chan struct{}     // closed once the client is gone for good
+	goneReason   string            // why it went, set before gone is closed
+	recent       *recentCalls      // its latest calls, by call ID
+	used         map[string]bool   // the relays it loaded, with LazyRelays; nil if its script listed them all
+}
+
+// transport returns the transport the client is connected over, which
+// changes if a long-polling client upgrades to a websocket.
+func (c *client) transport() Transport {
+	if t := c.transportPtr.Load(); t != nil {
+		return *t
+	}
+	return nil
+}
+
+func (c *client) setTransport(t Transport) {
+	c.transportPtr.Store(&t)
 }
 
 type clientMessage struct {
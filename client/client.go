@@ -0,0 +1,906 @@
+// Package client connects Go programs, such as services and command line
+// tools, to a relayr Exchange as the client script connects browsers. It
+// negotiates a connection, opens a websocket or long-polls when one will
+// not open, calls relay methods, runs handlers for the calls the Exchange
+// makes to its client methods, and reconnects as the client script does
+// when the connection is lost. It speaks exactly the frames of the
+// protocol package, in JSON.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// The transports a Client connects over.
+const (
+	WebSocket = "websocket"
+	LongPoll  = "longpoll"
+)
+
+// subprotocol is the framing the Client's websockets speak.
+const subprotocol = "relayr.v1.json"
+
+// capabilities are the optional features the Client supports. Calls the
+// Exchange would make with the others, such as binary payloads and state
+// patches, reach its handlers as plain calls instead.
+var capabilities = []string{"batch", "ping"}
+
+const (
+	defaultMaxBackoff   = 30 * time.Second
+	defaultProbeTimeout = 10 * time.Second
+	callBuffer          = 1024
+	callRetries         = 3
+)
+
+// The websocket close codes the Exchange gives its reasons for closing a
+// Client's websocket with.
+const (
+	closeDisconnected        = 4000
+	closeUnknownConnection   = 4001
+	closeReplaced            = 4002
+	closeInvalidToken        = 4003
+	closeUnknownSubprotocol  = 4007
+	closeHandshakeNotArrived = 4008
+)
+
+var (
+	// ErrClosed is returned for calls made on a Client that was closed.
+	ErrClosed = errors.New("client: closed")
+
+	// ErrConnectionLost fails the calls waiting for their results as the
+	// connection is lost; they may or may not have run.
+	ErrConnectionLost = errors.New("client: connection lost")
+
+	errRenegotiate = errors.New("client: the server asked for the connection to be renegotiated")
+	errForgotten   = errors.New("client: the server does not know the connection")
+)
+
+// Error is the error a relay method, or the Exchange, failed a call with.
+type Error struct {
+	Message string
+	Code    protocol.ErrorCode // the Error's code, if it has one
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// DisconnectedError is the error a Client stops with once the Exchange has
+// disconnected it, as with Exchange.Disconnect.
+type DisconnectedError struct {
+	Reason string
+}
+
+func (e *DisconnectedError) Error() string {
+	return "client: disconnected by the server: " + e.Reason
+}
+
+// Options configures a Client made by Dial.
+type Options struct {
+	// Transport is the transport to connect over, WebSocket or LongPoll.
+	// When empty a websocket is opened, unless one will not, when the
+	// Client long-polls from then on.
+	Transport string
+
+	// Header is sent with every request the Client makes, as for
+	// credentials.
+	Header http.Header
+
+	// HTTPClient makes the requests other than websocket upgrades.
+	// Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Dialer opens websockets. Defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+
+	// Groups are the groups the Client asks to join as it negotiates.
+	Groups []string
+
+	// Values are the connection values relay methods read.
+	Values map[string]string
+
+	// MaxBackoff is the longest the Client waits between attempts to
+	// reconnect, which it makes after an exponential backoff starting at
+	// a second. Defaults to 30 seconds.
+	MaxBackoff time.Duration
+
+	// OnReconnect is called once the Client has reconnected after losing
+	// its connection, reporting whether the Exchange restored it, with its
+	// groups and state, or gave it a new one.
+	OnReconnect func(restored bool)
+
+	// OnError is called with the errors the Exchange reports that belong
+	// to no call, and those with which the Client loses its connection.
+	OnError func(error)
+}
+
+// Client is a connection to an Exchange. Its methods are safe to call from
+// any goroutine. Handlers run one at a time, in the order the Exchange made
+// their calls, on a goroutine of their own, so they may call the Client.
+type Client struct {
+	url  string // of the Exchange, over http or https
+	opts Options
+	http *http.Client
+	key  string // prefixes the call IDs of the Client's calls
+
+	ctx    context.Context // done once the Client is closed or stops
+	cancel context.CancelFunc
+	calls  chan func()   // the handler calls waiting to run
+	done   chan struct{} // closed once the Client has stopped
+	err    error         // why it stopped, once done is closed
+
+	lock        sync.Mutex
+	session     *session      // the current connection; nil while reconnecting
+	ready       chan struct{} // closed once session is set
+	handlers    map[string]func(args []json.RawMessage)
+	pending     map[string]chan outcome // by InvocationID
+	groups      []string                // asked to join as the Client negotiates
+	nextID      uint64
+	id          string // the ConnectionID, once it has one
+	token       string
+	instance    string
+	unreachable bool // websockets would not open; long-poll instead
+
+	seq uint64 // the last long-polled frame; the run goroutine's alone
+}
+
+// session is a connection negotiated with the Exchange.
+type session struct {
+	transport string
+	res       protocol.NegotiationResponse
+	ident     string          // names the connection in the query of requests
+	ws        *websocket.Conn // nil when long-polling
+	write     sync.Mutex      // orders writes to ws
+	early     []json.RawMessage
+}
+
+// outcome is the result of a call.
+type outcome struct {
+	value json.RawMessage
+	err   error
+}
+
+// Dial connects to the Exchange served at rawURL, the http or https URL it
+// is mounted on, returning once the Client is connected. ctx bounds the
+// first connection alone; the Client reconnects until it is closed.
+func Dial(ctx context.Context, rawURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("client: %s is not an http or https URL", rawURL)
+	}
+	if opts.Transport != "" && opts.Transport != WebSocket && opts.Transport != LongPoll {
+		return nil, fmt.Errorf("client: unknown transport %s", opts.Transport)
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	key := make([]byte, 8)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		url:      strings.TrimSuffix(u.String(), "/"),
+		opts:     opts,
+		http:     opts.HTTPClient,
+		key:      hex.EncodeToString(key),
+		calls:    make(chan func(), callBuffer),
+		done:     make(chan struct{}),
+		ready:    make(chan struct{}),
+		handlers: make(map[string]func(args []json.RawMessage)),
+		pending:  make(map[string]chan outcome),
+		groups:   append([]string(nil), opts.Groups...),
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	s, err := c.connect(ctx)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+
+	c.attach(s)
+	go c.run(s)
+	go c.deliver()
+	return c, nil
+}
+
+// ConnectionID returns the Client's ConnectionID, which changes when the
+// Exchange gives it a new connection as it reconnects.
+func (c *Client) ConnectionID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.id
+}
+
+// On sets the handler of the calls the Exchange makes to a client method
+// of a relay, replacing any set before; a nil handler removes it. Calls
+// made by a hub of an ExchangeGroup are handled under "hub/relay". Calls
+// to methods with no handler are dropped.
+func (c *Client) On(relay, method string, handler func(args []json.RawMessage)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if handler == nil {
+		delete(c.handlers, relay+"."+method)
+		return
+	}
+	c.handlers[relay+"."+method] = handler
+}
+
+// Invoke calls a relay method, returning once it has finished with the
+// error it failed with, if any. Calls to the relays of a hub of an
+// ExchangeGroup name them as "hub/relay". A call made while the Client is
+// reconnecting is sent once it has. Calls are sent under a call ID, so
+// that one sent again after its request failed is run once.
+func (c *Client) Invoke(ctx context.Context, relay, method string, args ...interface{}) error {
+	_, err := c.Call(ctx, relay, method, args...)
+	return err
+}
+
+// Call is Invoke returning the method's result, in JSON.
+func (c *Client) Call(ctx context.Context, relay, method string, args ...interface{}) (json.RawMessage, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	frame := protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: relay, Method: method, Arguments: args}
+	if i := strings.IndexByte(relay, '/'); i >= 0 {
+		frame.Hub, frame.Relay = relay[:i], relay[i+1:]
+	}
+	return c.request(ctx, frame)
+}
+
+// Join asks for the Client to be added to a group, which it asks to join
+// again as it reconnects.
+func (c *Client) Join(ctx context.Context, group string) error {
+	if _, err := c.request(ctx, protocol.Inbound{Type: protocol.TypeJoinGroup, Group: group}); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeGroupLocked(group)
+	c.groups = append(c.groups, group)
+	return nil
+}
+
+// Leave asks for the Client to be removed from a group.
+func (c *Client) Leave(ctx context.Context, group string) error {
+	if _, err := c.request(ctx, protocol.Inbound{Type: protocol.TypeLeaveGroup, Group: group}); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeGroupLocked(group)
+	return nil
+}
+
+// Done returns a channel closed once the Client has stopped: it was
+// closed, or the Exchange disconnected it.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the Client stopped, once Done is closed: ErrClosed, or
+// a *DisconnectedError. It returns nil before.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the Client's connection, failing the calls waiting for
+// their results with ErrClosed. No handler runs once it returns.
+func (c *Client) Close() error {
+	c.cancel()
+	c.lock.Lock()
+	if s := c.session; s != nil && s.ws != nil {
+		s.write.Lock()
+		s.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		s.write.Unlock()
+		s.ws.Close()
+	}
+	c.lock.Unlock()
+	<-c.done
+	return nil
+}
+
+// request sends frame under a new InvocationID and waits for its result.
+func (c *Client) request(ctx context.Context, frame protocol.Inbound) (json.RawMessage, error) {
+	s, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan outcome, 1)
+	c.lock.Lock()
+	c.nextID++
+	frame.InvocationID = strconv.FormatUint(c.nextID, 10)
+	if frame.Type == protocol.TypeServerInvocation {
+		frame.CallID = c.key + "." + frame.InvocationID
+	}
+	c.pending[frame.InvocationID] = ch
+	c.lock.Unlock()
+
+	if err := c.send(ctx, s, &frame); err != nil {
+		c.complete(frame.InvocationID, nil, err)
+	}
+	select {
+	case o := <-ch:
+		return o.value, o.err
+	case <-ctx.Done():
+		c.complete(frame.InvocationID, nil, nil)
+		return nil, ctx.Err()
+	}
+}
+
+// connection returns the current connection, waiting for the Client to
+// reconnect if it is.
+func (c *Client) connection(ctx context.Context) (*session, error) {
+	for {
+		c.lock.Lock()
+		s, ready := c.session, c.ready
+		c.lock.Unlock()
+		if s != nil {
+			return s, nil
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, c.err
+		}
+	}
+}
+
+// complete passes the outcome of the call with the given InvocationID to
+// its caller, if it is still waiting.
+func (c *Client) complete(invocationID string, value json.RawMessage, err error) {
+	c.lock.Lock()
+	ch := c.pending[invocationID]
+	delete(c.pending, invocationID)
+	c.lock.Unlock()
+	if ch != nil {
+		ch <- outcome{value: value, err: err}
+	}
+}
+
+// removeGroupLocked forgets a group the Client asked to join. The caller
+// must hold c.lock.
+func (c *Client) removeGroupLocked(group string) {
+	for i := len(c.groups) - 1; i >= 0; i-- {
+		if c.groups[i] == group {
+			c.groups = append(c.groups[:i], c.groups[i+1:]...)
+		}
+	}
+}
+
+// attach makes s the current connection.
+func (c *Client) attach(s *session) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.session = s
+	close(c.ready)
+}
+
+// detach forgets the current connection, which was lost with err, failing
+// the calls waiting for their results.
+func (c *Client) detach(err error) {
+	c.lock.Lock()
+	s := c.session
+	c.session = nil
+	c.ready = make(chan struct{})
+	pending := c.pending
+	c.pending = make(map[string]chan outcome)
+	c.lock.Unlock()
+
+	if s != nil && s.ws != nil {
+		s.ws.Close()
+	}
+	for _, ch := range pending {
+		ch <- outcome{err: err}
+	}
+}
+
+// run receives the frames of the Client's connections, reconnecting as
+// each is lost, until the Client is closed or disconnected.
+func (c *Client) run(s *session) {
+	attempts := 0
+	for {
+		err := c.receive(s)
+		if c.ctx.Err() != nil {
+			c.stop(ErrClosed)
+			return
+		}
+		var kicked *DisconnectedError
+		if errors.As(err, &kicked) {
+			c.stop(err)
+			return
+		}
+		c.detach(ErrConnectionLost)
+		if err != errRenegotiate {
+			c.report(err)
+		}
+		if err == errForgotten {
+			// start afresh
+			c.lock.Lock()
+			c.id, c.token, c.instance = "", "", ""
+			c.lock.Unlock()
+		}
+
+		for s = nil; s == nil; {
+			if err != errRenegotiate || attempts > 0 {
+				attempts++
+				select {
+				case <-time.After(c.backoff(attempts)):
+				case <-c.ctx.Done():
+					c.stop(ErrClosed)
+					return
+				}
+			}
+			if s, err = c.connect(c.ctx); err != nil {
+				if c.ctx.Err() == nil {
+					c.report(err)
+				}
+			}
+		}
+		attempts = 0
+		c.attach(s)
+		restored := s.res.Reconnected
+		if f := c.opts.OnReconnect; f != nil {
+			c.queue(func() { f(restored) })
+		}
+	}
+}
+
+// backoff returns how long to wait before the given attempt to reconnect.
+func (c *Client) backoff(attempts int) time.Duration {
+	if attempts > 16 || 500*time.Millisecond<<attempts > c.opts.MaxBackoff {
+		return c.opts.MaxBackoff
+	}
+	return 500 * time.Millisecond << attempts
+}
+
+// stop stops the Client with err.
+func (c *Client) stop(err error) {
+	c.cancel()
+	c.detach(err)
+	c.err = err
+	close(c.done)
+}
+
+// report passes err to the OnError hook, if there is one.
+func (c *Client) report(err error) {
+	if f := c.opts.OnError; f != nil && err != nil {
+		c.queue(func() { f(err) })
+	}
+}
+
+// queue queues a handler call to run once those queued before have.
+func (c *Client) queue(f func()) {
+	select {
+	case c.calls <- f:
+	case <-c.ctx.Done():
+	}
+}
+
+// deliver runs the handler calls queued, in order, until the Client stops.
+func (c *Client) deliver() {
+	for {
+		select {
+		case f := <-c.calls:
+			f()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// transports returns the transports to try connecting over, in order.
+func (c *Client) transports() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case c.opts.Transport != "":
+		return []string{c.opts.Transport}
+	case c.unreachable:
+		return []string{LongPoll}
+	}
+	return []string{WebSocket, LongPoll}
+}
+
+// connect negotiates a connection and opens it, falling back on
+// long-polling when a websocket will not open, unless the Options name a
+// transport.
+func (c *Client) connect(ctx context.Context) (*session, error) {
+	var err error
+	for _, transport := range c.transports() {
+		var s *session
+		if s, err = c.negotiate(ctx, transport); err != nil {
+			return nil, err
+		}
+		if transport == LongPoll {
+			return s, nil
+		}
+		if err = c.dialWebSocket(ctx, s); err == nil {
+			return s, nil
+		}
+		if c.opts.Transport == "" {
+			c.lock.Lock()
+			c.unreachable = true
+			c.lock.Unlock()
+		}
+	}
+	return nil, err
+}
+
+// negotiate negotiates a connection over transport, resuming the one the
+// Client had, if any.
+func (c *Client) negotiate(ctx context.Context, transport string) (*session, error) {
+	c.lock.Lock()
+	previous := c.token
+	if previous == "" {
+		previous = c.id
+	}
+	neg := protocol.Negotiation{
+		T: transport,
+		P: previous,
+		V: protocol.Version,
+		G: append([]string(nil), c.groups...),
+		Q: c.opts.Values,
+		F: capabilities,
+	}
+	c.lock.Unlock()
+
+	body, err := json.Marshal(neg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", c.url+"/negotiate", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError("negotiation failed", resp)
+	}
+	s := &session{transport: transport}
+	if err := json.NewDecoder(resp.Body).Decode(&s.res); err != nil {
+		return nil, fmt.Errorf("client: reading a negotiation response: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s.res.ConnectionID != c.id {
+		c.seq = 0
+	}
+	c.id, c.token, c.instance = s.res.ConnectionID, s.res.Token, s.res.Instance
+	q := url.Values{}
+	if c.token != "" {
+		q.Set("token", c.token)
+	} else {
+		q.Set("connectionId", c.id)
+	}
+	if c.instance != "" {
+		q.Set("instance", c.instance)
+	}
+	s.ident = q.Encode()
+	return s, nil
+}
+
+// dialWebSocket opens a websocket for s, waiting for the handshake the
+// Exchange sends first over it.
+func (c *Client) dialWebSocket(ctx context.Context, s *session) error {
+	d := websocket.DefaultDialer
+	if c.opts.Dialer != nil {
+		d = c.opts.Dialer
+	}
+	dialer := *d
+	dialer.Subprotocols = []string{subprotocol}
+	wsURL := "ws" + strings.TrimPrefix(c.url, "http") + "/ws?" + s.ident
+	if s.res.WebSocketURL != "" {
+		wsURL = s.res.WebSocketURL + "/ws?" + s.ident
+	}
+	ws, resp, err := dialer.DialContext(ctx, wsURL, c.opts.Header)
+	if err != nil {
+		if resp != nil {
+			return responseError("opening a websocket failed", resp)
+		}
+		return err
+	}
+
+	probe := defaultProbeTimeout
+	if s.res.Probe > 0 {
+		probe = time.Duration(s.res.Probe) * time.Millisecond
+	}
+	ws.SetReadDeadline(time.Now().Add(probe))
+	_, m, err := ws.ReadMessage()
+	if err != nil {
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeHandshakeNotArrived, "relayr: handshake did not arrive"), time.Now().Add(time.Second))
+		ws.Close()
+		return fmt.Errorf("client: no handshake over the websocket: %w", err)
+	}
+	frames := protocol.Split(m)
+	var head struct {
+		Type string `json:"T"`
+	}
+	if len(frames) == 0 || json.Unmarshal(frames[0], &head) != nil || head.Type != protocol.TypeHandshake {
+		ws.Close()
+		return errors.New("client: the websocket did not open with a handshake")
+	}
+	s.ws, s.early = ws, frames[1:]
+	return nil
+}
+
+// receive reads the frames of s until it is lost, returning why.
+func (c *Client) receive(s *session) error {
+	if s.ws == nil {
+		return c.poll(s)
+	}
+	for _, f := range s.early {
+		if err := c.handle(f); err != nil {
+			return err
+		}
+	}
+	for {
+		if s.res.KeepAlive > 0 {
+			s.ws.SetReadDeadline(time.Now().Add(2 * time.Duration(s.res.KeepAlive) * time.Millisecond))
+		} else {
+			s.ws.SetReadDeadline(time.Time{})
+		}
+		_, m, err := s.ws.ReadMessage()
+		if err != nil {
+			var closed *websocket.CloseError
+			if errors.As(err, &closed) {
+				switch closed.Code {
+				case closeDisconnected:
+					return &DisconnectedError{Reason: closed.Text}
+				case closeUnknownConnection, closeReplaced, closeInvalidToken:
+					return errForgotten
+				case closeUnknownSubprotocol:
+					c.lock.Lock()
+					c.unreachable = true
+					c.lock.Unlock()
+				}
+			}
+			return err
+		}
+		for _, f := range protocol.Split(m) {
+			if err := c.handle(f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// poll long-polls for the frames of s until it is lost, returning why.
+func (c *Client) poll(s *session) error {
+	for {
+		ctx, cancel := c.ctx, context.CancelFunc(func() {})
+		if s.res.KeepAlive > 0 {
+			// each poll is answered within the keepalive, with an empty
+			// batch if nothing else
+			ctx, cancel = context.WithTimeout(c.ctx, 2*time.Duration(s.res.KeepAlive)*time.Millisecond)
+		}
+		resp, err := c.do(ctx, "GET", c.url+"/longpoll?"+s.ident+"&seq="+strconv.FormatUint(c.seq, 10), nil)
+		if err != nil {
+			cancel()
+			return err
+		}
+		var res struct {
+			protocol.Control
+			protocol.LongPollBatch
+		}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			// the token is no good, or the connection is unknown
+			err = errForgotten
+		case resp.StatusCode != http.StatusOK:
+			err = responseError("polling failed", resp)
+		default:
+			err = json.NewDecoder(resp.Body).Decode(&res)
+		}
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		switch res.Command {
+		case "":
+		case protocol.CommandDisconnected:
+			return &DisconnectedError{Reason: res.Reason}
+		default:
+			return errRenegotiate
+		}
+		// queued frames arrive together, oldest first and numbered up to
+		// Seq; those seen already are being sent again and are skipped
+		first := res.Seq - uint64(len(res.Messages)) + 1
+		for i, m := range res.Messages {
+			if first+uint64(i) <= c.seq {
+				continue
+			}
+			if err := c.handle(m); err != nil {
+				return err
+			}
+		}
+		if res.Seq > c.seq {
+			c.seq = res.Seq
+		}
+	}
+}
+
+// handle handles a frame the Exchange sent, returning an error if the
+// connection is to be given up.
+func (c *Client) handle(frame json.RawMessage) error {
+	var head struct {
+		Type string `json:"T"`
+	}
+	if err := json.Unmarshal(frame, &head); err != nil {
+		c.report(fmt.Errorf("client: reading a frame: %w", err))
+		return nil
+	}
+
+	switch head.Type {
+	case protocol.TypeClientInvocation:
+		var call struct {
+			protocol.ClientInvocation
+			Arguments []json.RawMessage `json:"A"`
+		}
+		if err := json.Unmarshal(frame, &call); err != nil {
+			c.report(fmt.Errorf("client: reading a call: %w", err))
+			return nil
+		}
+		key := call.Relay + "." + call.Method
+		if call.Hub != "" {
+			key = call.Hub + "/" + key
+		}
+		c.lock.Lock()
+		h := c.handlers[key]
+		c.lock.Unlock()
+		if h != nil {
+			c.queue(func() { h(call.Arguments) })
+		}
+	case protocol.TypeCompletion:
+		var done struct {
+			protocol.Completion
+			Value json.RawMessage `json:"V"`
+		}
+		if err := json.Unmarshal(frame, &done); err != nil {
+			c.report(fmt.Errorf("client: reading a result: %w", err))
+			return nil
+		}
+		var err error
+		if done.Error != "" {
+			err = &Error{Message: done.Error, Code: done.Code}
+		}
+		c.complete(done.InvocationID, done.Value, err)
+	case protocol.TypeError:
+		var e protocol.ErrorFrame
+		if json.Unmarshal(frame, &e) == nil {
+			c.report(&Error{Message: e.Error, Code: e.Code})
+		}
+	case protocol.TypeControl:
+		var z protocol.Control
+		if json.Unmarshal(frame, &z) != nil {
+			return nil
+		}
+		switch z.Command {
+		case protocol.CommandReconnect:
+			return errRenegotiate
+		case protocol.CommandDisconnected:
+			return &DisconnectedError{Reason: z.Reason}
+		case protocol.CommandRemoved:
+			// no longer asked to join as the Client negotiates
+			c.lock.Lock()
+			c.removeGroupLocked(z.Group)
+			c.lock.Unlock()
+		}
+	}
+	// pings, and frames the Client does not understand, are ignored
+	return nil
+}
+
+// send sends frame over s. Over long-polling, a call whose request fails
+// is sent again under its call ID, which the Exchange runs once, while
+// its caller waits.
+func (c *Client) send(ctx context.Context, s *session, frame *protocol.Inbound) error {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if s.ws != nil {
+		s.write.Lock()
+		defer s.write.Unlock()
+		return s.ws.WriteMessage(websocket.TextMessage, body)
+	}
+
+	for tries := 0; ; tries++ {
+		var resp *http.Response
+		resp, err = c.do(ctx, "POST", c.url+"/call?"+s.ident, body)
+		if err == nil {
+			return c.receipt(frame.InvocationID, resp)
+		}
+		if frame.CallID == "" || tries == callRetries {
+			return err
+		}
+		select {
+		case <-time.After(time.Second << tries):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// receipt reads the answer to a call made over long-polling, failing the
+// call with the error the Exchange refused it with, if it did.
+func (c *Client) receipt(invocationID string, resp *http.Response) error {
+	defer resp.Body.Close()
+	var r protocol.CallReceipt
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return &Error{Message: fmt.Sprintf("client: the call was refused: %s", resp.Status)}
+		}
+		return nil
+	}
+	if !r.Accepted && r.Error != "" {
+		c.complete(invocationID, nil, &Error{Message: r.Error, Code: r.Code})
+	}
+	return nil
+}
+
+// do makes a request to the Exchange with the Options' Header.
+func (c *Client) do(ctx context.Context, method, u string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.opts.Header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.http.Do(req)
+}
+
+// responseError returns the error a request was refused with, which the
+// Exchange names in an ErrorResponse where it can.
+func responseError(what string, resp *http.Response) error {
+	var e protocol.ErrorResponse
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if json.Unmarshal(b, &e) == nil && e.Error != "" {
+		return &Error{Message: e.Error, Code: e.Code}
+	}
+	if s := strings.TrimSpace(string(b)); s != "" {
+		return fmt.Errorf("client: %s: %s: %s", what, resp.Status, s)
+	}
+	return fmt.Errorf("client: %s: %s", what, resp.Status)
+}
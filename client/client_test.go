@@ -0,0 +1,300 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr"
+	"github.com/simon-whitehead/relayr/client"
+)
+
+const timeout = 5 * time.Second
+
+// Room is the relay the tests call.
+type Room struct {
+	release chan struct{} // Wait returns once it is closed
+}
+
+func (Room) Add(r *relayr.Relay, a, b int) int { return a + b }
+
+func (Room) Fail(r *relayr.Relay) error { return errors.New("no") }
+
+func (Room) Whisper(r *relayr.Relay, text string) error {
+	return r.Clients.Caller().Call("whispered", text)
+}
+
+func (Room) Shout(r *relayr.Relay, text string) error {
+	return r.Clients.Group("room").Call("heard", text)
+}
+
+func (m Room) Wait(r *relayr.Relay) { <-m.release }
+
+func allowGroups(connectionID, group string, principal interface{}) bool { return true }
+
+// serve starts an Exchange made with opts, with a Room registered, behind
+// an HTTP server at /relayr. Both are closed as the test ends.
+func serve(t *testing.T, opts relayr.ExchangeOptions) (*relayr.Exchange, *httptest.Server, Room) {
+	t.Helper()
+	opts.GroupJoinAuthorizer = allowGroups
+	opts.AllowInitialGroup = func(r *http.Request, principal interface{}, group string) bool { return true }
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	e := relayr.NewExchangeWithOptions(srv.URL+"/relayr", opts)
+	t.Cleanup(func() { e.Close(context.Background()) })
+	mux.Handle("/relayr/", e)
+	room := Room{release: make(chan struct{})}
+	if err := e.RegisterRelay(room); err != nil {
+		t.Fatal(err)
+	}
+	return e, srv, room
+}
+
+// dial connects a Client made with opts to the Exchange srv serves,
+// closing it as the test ends.
+func dial(t *testing.T, srv *httptest.Server, opts client.Options) *client.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := client.Dial(ctx, srv.URL+"/relayr", opts)
+	if err != nil {
+		t.Fatalf("dialing over %s: %v", opts.Transport, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// received returns a channel receiving the first argument, a string, of
+// each call c's handler for method is run for.
+func received(c *client.Client, method string) <-chan string {
+	ch := make(chan string, 100)
+	c.On("Room", method, func(args []json.RawMessage) {
+		var s string
+		json.Unmarshal(args[0], &s)
+		ch <- s
+	})
+	return ch
+}
+
+func receive(t *testing.T, ch <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("%q was not received", want)
+	}
+}
+
+func receiveNothing(t *testing.T, ch <-chan string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		t.Fatalf("received %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCall(t *testing.T) {
+	for _, transport := range []string{client.WebSocket, client.LongPoll} {
+		t.Run(transport, func(t *testing.T) {
+			_, srv, _ := serve(t, relayr.ExchangeOptions{})
+			c := dial(t, srv, client.Options{Transport: transport})
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			v, err := c.Call(ctx, "Room", "Add", 2, 3)
+			if err != nil || string(v) != "5" {
+				t.Fatalf("Add returned %s, %v", v, err)
+			}
+			var cerr *client.Error
+			if err := c.Invoke(ctx, "Room", "Fail"); !errors.As(err, &cerr) || cerr.Message != "no" {
+				t.Fatalf("Fail failed with %v", err)
+			}
+			if err := c.Invoke(ctx, "Room", "Missing"); !errors.As(err, &cerr) || cerr.Code == 0 {
+				t.Fatalf("calling an unknown method failed with %v", err)
+			}
+		})
+	}
+}
+
+func TestOn(t *testing.T) {
+	for _, transport := range []string{client.WebSocket, client.LongPoll} {
+		t.Run(transport, func(t *testing.T) {
+			e, srv, _ := serve(t, relayr.ExchangeOptions{})
+			alice := dial(t, srv, client.Options{Transport: transport})
+			bob := dial(t, srv, client.Options{Transport: transport, Groups: []string{"room"}})
+			whispered, heardByAlice, heardByBob := received(alice, "whispered"), received(alice, "heard"), received(bob, "heard")
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			// a call to the caller alone
+			if err := alice.Invoke(ctx, "Room", "Whisper", "psst"); err != nil {
+				t.Fatal(err)
+			}
+			receive(t, whispered, "psst")
+
+			// a group, joined as bob negotiated and by alice since
+			if err := alice.Invoke(ctx, "Room", "Shout", "before"); err != nil {
+				t.Fatal(err)
+			}
+			receive(t, heardByBob, "before")
+			receiveNothing(t, heardByAlice)
+			if err := alice.Join(ctx, "room"); err != nil {
+				t.Fatal(err)
+			}
+			if err := bob.Invoke(ctx, "Room", "Shout", "joined"); err != nil {
+				t.Fatal(err)
+			}
+			receive(t, heardByAlice, "joined")
+			receive(t, heardByBob, "joined")
+			if err := alice.Leave(ctx, "room"); err != nil {
+				t.Fatal(err)
+			}
+			bob.Invoke(ctx, "Room", "Shout", "left")
+			receive(t, heardByBob, "left")
+			receiveNothing(t, heardByAlice)
+
+			// from outside any relay method, to a handler since removed
+			e.Clients(Room{}).All("heard", "all")
+			receive(t, heardByBob, "all")
+			bob.On("Room", "heard", nil)
+			e.Clients(Room{}).All("heard", "unheard")
+			receiveNothing(t, heardByBob)
+		})
+	}
+}
+
+// droppingDialer opens websockets whose connections drop can cut, as a
+// network failure would.
+type droppingDialer struct {
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func (d *droppingDialer) dialer() *websocket.Dialer {
+	return &websocket.Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil {
+			d.lock.Lock()
+			d.conns = append(d.conns, conn)
+			d.lock.Unlock()
+		}
+		return conn, err
+	}}
+}
+
+func (d *droppingDialer) drop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.conns = nil
+}
+
+func TestReconnect(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		grace    time.Duration
+		restored bool
+	}{
+		{"restored", time.Minute, true},
+		{"forgotten", -1, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, srv, _ := serve(t, relayr.ExchangeOptions{ReconnectGracePeriod: tt.grace})
+			d := &droppingDialer{}
+			reconnected := make(chan bool, 1)
+			c := dial(t, srv, client.Options{
+				Transport:   client.WebSocket,
+				Dialer:      d.dialer(),
+				Groups:      []string{"room"},
+				MaxBackoff:  100 * time.Millisecond,
+				OnReconnect: func(restored bool) { reconnected <- restored },
+			})
+			heard := received(c, "heard")
+			first := c.ConnectionID()
+
+			d.drop()
+			select {
+			case restored := <-reconnected:
+				if restored != tt.restored {
+					t.Fatalf("reconnected with restored %v, want %v", restored, tt.restored)
+				}
+			case <-time.After(timeout):
+				t.Fatal("the client did not reconnect")
+			}
+			if same := c.ConnectionID() == first; same != tt.restored {
+				t.Fatalf("reconnected as %s, having been %s", c.ConnectionID(), first)
+			}
+
+			// still in its group, and calling
+			e.Clients(Room{}).Group("room").Call("heard", "again")
+			receive(t, heard, "again")
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if v, err := c.Call(ctx, "Room", "Add", 1, 1); err != nil || string(v) != "2" {
+				t.Fatalf("Add returned %s, %v after reconnecting", v, err)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	e, srv, room := serve(t, relayr.ExchangeOptions{})
+	defer close(room.release)
+	c := dial(t, srv, client.Options{Transport: client.WebSocket})
+	waiting := make(chan error, 1)
+	go func() { waiting <- c.Invoke(context.Background(), "Room", "Wait") }()
+	time.Sleep(50 * time.Millisecond)
+
+	c.Close()
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("Done is not closed once Close returns")
+	}
+	if err := c.Err(); err != client.ErrClosed {
+		t.Fatalf("a closed client stopped with %v", err)
+	}
+	select {
+	case err := <-waiting:
+		if err != client.ErrClosed {
+			t.Fatalf("a call waiting as the client closed failed with %v", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("a call waiting as the client closed did not return")
+	}
+	if err := c.Invoke(context.Background(), "Room", "Add", 1, 2); err != client.ErrClosed {
+		t.Fatalf("a call on a closed client failed with %v", err)
+	}
+	for deadline := time.Now().Add(timeout); e.Stats().Connections["websocket"] > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the Exchange still has the closed client's connection")
+		}
+	}
+
+	// a client the Exchange disconnects stops, told why
+	c = dial(t, srv, client.Options{Transport: client.WebSocket})
+	e.Disconnect(c.ConnectionID(), "kicked")
+	select {
+	case <-c.Done():
+	case <-time.After(timeout):
+		t.Fatal("a disconnected client did not stop")
+	}
+	var derr *client.DisconnectedError
+	if !errors.As(c.Err(), &derr) || derr.Reason != "kicked" {
+		t.Fatalf("a disconnected client stopped with %v", c.Err())
+	}
+}
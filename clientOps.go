@@ -1,20 +1,312 @@
 package relayr
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
 // ClientOperations provides helper methods for
-// interacting with Clients connected to a Relay.
+// interacting with Clients connected to a Relay. Like the Relay, it is
+// safe to keep and to use from any goroutine once the call that was
+// given it has returned.
 type ClientOperations struct {
 	e     *Exchange
 	relay *Relay
 }
 
 // All invokes a client side method on all clients for the
-// given relay.
-func (c *ClientOperations) All(fn string, args ...interface{}) {
-	c.e.callGroupMethod(c.relay, "Global", fn, args...)
+// given relay, whether or not they are in Global. It returns a
+// *GroupCallError if the call could not be delivered to some of them.
+func (c *ClientOperations) All(fn string, args ...interface{}) error {
+	return c.e.callAllExcept(c.relay, nil, fn, args...)
+}
+
+// CallGroup invokes a client side method on the members of a group. It
+// returns a *GroupCallError summarising the members the call could not
+// be delivered to, if any.
+func (c *ClientOperations) CallGroup(group, fn string, args ...interface{}) error {
+	return c.Group(group).Call(fn, args...)
+}
+
+// Caller targets only the client that invoked the current
+// server method.
+func (c *ClientOperations) Caller() *ClientTarget {
+	return &ClientTarget{ops: c, caller: true}
+}
+
+// Others targets every client except the one that invoked the
+// current server method.
+func (c *ClientOperations) Others() *ClientTarget {
+	return c.AllExcept(c.relay.ConnectionID)
+}
+
+// AllExcept targets every client apart from those with the
+// given ConnectionIDs.
+func (c *ClientOperations) AllExcept(connectionIDs ...string) *ClientTarget {
+	return (&ClientTarget{ops: c, all: true}).Except(connectionIDs...)
+}
+
+// Client targets the single client with the given ConnectionID. Calls
+// fail with ErrConnectionGone if that client is not connected.
+func (c *ClientOperations) Client(connectionID string) *ClientTarget {
+	return &ClientTarget{ops: c, connectionID: connectionID}
+}
+
+// User targets every client connected as the given user, as identified
+// by the ExchangeOptions.UserIDProvider. Calls made to a user with no
+// connections are saved with the ExchangeOptions.OfflineStore, if there
+// is one, for the first client of the user to connect, and are otherwise
+// dropped.
+func (c *ClientOperations) User(userID string) *ClientTarget {
+	return &ClientTarget{ops: c, user: userID}
+}
+
+// Group targets the members of a group, which with NamespaceGroups is in
+// the relay's namespace unless it is marked with GlobalGroup.
+func (c *ClientOperations) Group(name string) *ClientTarget {
+	return &ClientTarget{ops: c, group: c.relay.qualifyGroup(name)}
+}
+
+// CallerGroups targets the members of every group the client that invoked
+// the current server method is in, other than Global, the caller among
+// them. Clients in several of the groups are only called once. The
+// caller's groups are those it is in when the call is made; a group it
+// is leaving meanwhile is either called whole or not at all.
+func (c *ClientOperations) CallerGroups() *ClientTarget {
+	return &ClientTarget{ops: c, callerGroups: true}
+}
+
+// GroupsMatching targets the members of every group whose name matches
+// pattern, in the syntax of path.Match, e.g. "tenant:42:*". Clients in
+// several of the groups are only called once. Calls fail if the pattern is
+// malformed. With NamespaceGroups only the groups in the relay's namespace
+// are matched, unless the pattern is marked with GlobalGroup.
+func (c *ClientOperations) GroupsMatching(pattern string) *ClientTarget {
+	return &ClientTarget{ops: c, pattern: c.relay.qualifyGroup(pattern)}
+}
+
+// WithTag targets the clients tagged with value under key through
+// Exchange.TagConnection. Finding them takes time in proportion to their
+// number rather than to the number of clients connected.
+func (c *ClientOperations) WithTag(key, value string) *ClientTarget {
+	return &ClientTarget{ops: c, tagKey: key, tagValue: value, tagged: true}
+}
+
+// Where targets the clients for which fn returns true, fn being called
+// with every client connected. Prefer WithTag or Group for selections
+// made often.
+func (c *ClientOperations) Where(fn func(ConnectionInfo) bool) *ClientTarget {
+	return &ClientTarget{ops: c, where: fn}
+}
+
+// ClientTarget is a set of clients selected through ClientOperations.
+// Client side methods are invoked on the set with Call.
+type ClientTarget struct {
+	ops          *ClientOperations
+	caller       bool
+	all          bool
+	connectionID string
+	user         string
+	group        string
+	pattern      string
+	callerGroups bool
+	tagKey       string
+	tagValue     string
+	tagged       bool
+	where        func(ConnectionInfo) bool
+	except       []string
+}
+
+// ids returns the ConnectionIDs of the clients a WithTag or Where target
+// selects.
+func (t *ClientTarget) ids() []string {
+	e := t.ops.e
+	if t.tagged {
+		return e.taggedConnections(t.tagKey, t.tagValue)
+	}
+	var r []string
+	for _, info := range e.connections() {
+		if t.where(info) {
+			r = append(r, info.ConnectionID)
+		}
+	}
+	return r
+}
+
+// name describes a WithTag or Where target in a *GroupCallError.
+func (t *ClientTarget) name() string {
+	if t.tagged {
+		return "tag:" + t.tagKey + "=" + t.tagValue
+	}
+	return "where"
+}
+
+// Except returns a copy of the target that skips the clients with
+// the given ConnectionIDs.
+func (t *ClientTarget) Except(connectionIDs ...string) *ClientTarget {
+	n := *t
+	n.except = append(append([]string(nil), t.except...), connectionIDs...)
+	return &n
+}
+
+// Call invokes a client side method on every client in the target,
+// passing args to them. For a single client it returns
+// ErrConnectionGone or ErrBufferFull if the call could not be
+// delivered; for several it returns a *GroupCallError. The clients are
+// those in the target when Call is made, so a ClientTarget may be kept and
+// called again as clients come and go.
+func (t *ClientTarget) Call(fn string, args ...interface{}) error {
+	e, relay := t.ops.e, t.ops.relay
+	if t.caller {
+		if relay.ConnectionID != "" && !containsString(t.except, relay.ConnectionID) {
+			return e.callClientMethod(relay, fn, args...)
+		}
+		return nil
+	}
+	if t.connectionID != "" {
+		if !containsString(t.except, t.connectionID) {
+			return e.callConnectionMethod(relay, t.connectionID, fn, args...)
+		}
+		return nil
+	}
+	if t.all {
+		return e.callAllExcept(relay, t.except, fn, args...)
+	}
+	if t.user != "" {
+		return e.callUserMethod(relay, t.user, t.except, fn, args...)
+	}
+	if t.pattern != "" {
+		return e.callGroupsMatching(relay, t.pattern, t.except, fn, args...)
+	}
+	if t.callerGroups {
+		return e.callCallerGroups(relay, t.except, fn, args...)
+	}
+	if t.tagged || t.where != nil {
+		return e.callEach(relay, t.name(), t.ids(), t.except, fn, args...)
+	}
+
+	return e.callGroupMethodExcept(relay, t.group, t.except, fn, args...)
+}
+
+// CallCoalesced is Call for frequent updates that supersede each other,
+// such as positions. A call replaces any earlier call with the same key
+// that is still waiting to be sent to a client, so clients that fall
+// behind receive only the latest one, in the place of the call it
+// replaced. Calls relayed through a Backplane
+// are not coalesced on other instances.
+func (t *ClientTarget) CallCoalesced(key, fn string, args ...interface{}) error {
+	relay := *t.ops.relay
+	relay.coalesce = key
+	n := *t
+	n.ops = &ClientOperations{e: t.ops.e, relay: &relay}
+	return n.Call(fn, args...)
+}
+
+// CallWithTTL is Call for calls that go stale, such as typing
+// notifications. A call still waiting to be sent to a client once ttl has
+// passed is dropped instead, so clients that fall behind or stop polling
+// for a while are not sent it late. A ttl of zero never expires. Calls
+// relayed through a Backplane do not expire on other instances.
+func (t *ClientTarget) CallWithTTL(ttl time.Duration, fn string, args ...interface{}) error {
+	relay := *t.ops.relay
+	if ttl > 0 {
+		relay.expires = time.Now().Add(ttl)
+	}
+	n := *t
+	n.ops = &ClientOperations{e: t.ops.e, relay: &relay}
+	return n.Call(fn, args...)
+}
+
+// CallUncompressed is Call for calls whose arguments are already
+// compressed, such as images, which are written to websockets without
+// permessage-deflate, with EnableCompression, however large they are.
+// Calls to groups are encoded for each member rather than once for every
+// member speaking the same codec, and calls relayed through a Backplane
+// are compressed as usual on other instances.
+func (t *ClientTarget) CallUncompressed(fn string, args ...interface{}) error {
+	relay := *t.ops.relay
+	relay.plain = true
+	n := *t
+	n.ops = &ClientOperations{e: t.ops.e, relay: &relay}
+	return n.Call(fn, args...)
+}
+
+// CallWithAck invokes a client side method on a single client and waits
+// until the client acknowledges that its handler has run. It returns
+// ErrDisconnected if the client goes away first, or ctx's error if ctx is
+// done first, and fails at once for a client without CapabilityAck. The
+// target must be Caller or Client.
+func (t *ClientTarget) CallWithAck(ctx context.Context, fn string, args ...interface{}) error {
+	e, relay := t.ops.e, t.ops.relay
+	cid := t.connectionID
+	if t.caller {
+		cid = relay.ConnectionID
+	}
+	if cid == "" {
+		return errors.New("relayr: CallWithAck needs a single client")
+	}
+	if containsString(t.except, cid) {
+		return nil
+	}
+
+	return e.callWithAck(ctx, relay, cid, fn, args)
 }
 
-// Others invokes a client side method on all clients except the
-// one who calls it.
-func (c *ClientOperations) Others(fn string, args ...interface{}) {
-	c.e.callGroupMethodExcept(c.relay, "Global", fn, args...)
+// SendBinary sends data to every client in the target, where it is passed
+// as an ArrayBuffer to the binary handler registered for fn. Websocket
+// clients receive a binary message; long-poll clients receive the payload
+// base64-encoded. Clients without CapabilityBinary are called with it
+// as any method would be, base64-encoded. Unlike Call, binary payloads
+// are not relayed through a Backplane.
+func (t *ClientTarget) SendBinary(fn string, data []byte) {
+	e, relay := t.ops.e, t.ops.relay
+	switch {
+	case t.caller:
+		if relay.ConnectionID != "" && !containsString(t.except, relay.ConnectionID) {
+			e.sendBinaryTo(relay, relay.ConnectionID, fn, data)
+		}
+	case t.connectionID != "":
+		if !containsString(t.except, t.connectionID) {
+			e.sendBinaryTo(relay, t.connectionID, fn, data)
+		}
+	case t.all:
+		e.sendBinaryToEach(relay, "Global", e.connectionIDs(), t.except, fn, data)
+	case t.user != "":
+		for _, id := range e.UserConnections(t.user) {
+			if !containsString(t.except, id) {
+				e.sendBinaryTo(relay, id, fn, data)
+			}
+		}
+	case t.tagged || t.where != nil:
+		for _, id := range t.ids() {
+			if !containsString(t.except, id) {
+				e.sendBinaryTo(relay, id, fn, data)
+			}
+		}
+	case t.callerGroups:
+		if relay.ConnectionID == "" {
+			return
+		}
+		members, _ := e.membersOfCallerGroups(relay.ConnectionID)
+		for _, c := range members {
+			if !containsString(t.except, c.ConnectionID) {
+				e.sendBinaryTo(relay, c.ConnectionID, fn, data)
+			}
+		}
+	case t.pattern != "":
+		members, err := e.membersOfGroupsMatching(t.pattern)
+		if err != nil {
+			e.logger.Errorf("sending %s: %v", fn, err)
+			e.reportError(TransportError, "", relay.Name, fn, err)
+			return
+		}
+		for _, c := range members {
+			if !containsString(t.except, c.ConnectionID) {
+				e.sendBinaryTo(relay, c.ConnectionID, fn, data)
+			}
+		}
+	default:
+		e.sendBinaryToGroup(relay, t.group, t.except, fn, data)
+	}
 }
@@ -0,0 +1,168 @@
+package relayr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	rclient "github.com/simon-whitehead/relayr/client"
+)
+
+// Notifications is a relay whose clients are pushed to from outside any
+// relay method.
+type Notifications struct{}
+
+func (Notifications) Ack(r *Relay) {}
+
+// byUser authorizes requests as the user named in their X-User header.
+func byUser(r *http.Request) (interface{}, error) {
+	return r.Header.Get("X-User"), nil
+}
+
+func TestClientsFromBackgroundJob(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{Authorizer: byUser}, Notifications{})
+	alice := dialWith(t, srv, rclient.Options{Transport: "websocket", Header: http.Header{"X-User": {"alice"}}})
+	bob := dialWith(t, srv, rclient.Options{Transport: "longpoll", Header: http.Header{"X-User": {"bob"}}})
+	toAlice, toBob := calls(alice, "Notifications", "notify"), calls(bob, "Notifications", "notify")
+
+	if err := e.AddToGroup("staff", alice.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	// All reaches clients whatever their groups, Global among them
+	if err := e.RemoveFromGroup("Global", bob.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := e.Clients(Notifications{})
+	if err := ops.All("notify", "all"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, toAlice); string(args[0]) != `"all"` {
+		t.Fatalf("alice received %s", args[0])
+	}
+	if args := receive(t, toBob); string(args[0]) != `"all"` {
+		t.Fatalf("bob, in no group, received %s", args[0])
+	}
+
+	// a group without members is called without error, reaching no one;
+	// what each client receives next shows nothing came before it
+	if err := ops.Group("nobody").Call("notify", "nobody"); err != nil {
+		t.Fatalf("calling a group without members failed: %v", err)
+	}
+	if err := ops.Group("staff").Call("notify", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, toAlice); string(args[0]) != `"staff"` {
+		t.Fatalf("alice received %s, want the call to staff", args[0])
+	}
+
+	if err := ops.Client(bob.ConnectionID()).Call("notify", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, toBob); string(args[0]) != `"bob"` {
+		t.Fatalf("bob received %s, want the call to bob alone", args[0])
+	}
+	if err := ops.Client("gone").Call("notify", "gone"); !errors.Is(err, ErrConnectionGone) {
+		t.Fatalf("calling a client that is not connected failed with %v, want ErrConnectionGone", err)
+	}
+
+	if err := ops.User("alice").Call("notify", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, toAlice); string(args[0]) != `"alice"` {
+		t.Fatalf("alice received %s, want the call to alice's user", args[0])
+	}
+	if err := ops.All("notify", "last"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, toBob); string(args[0]) != `"last"` {
+		t.Fatalf("bob received %s, meant for others", args[0])
+	}
+
+	if e.Clients(Chat{}) != nil {
+		t.Error("Clients returned operations for a relay that is not registered")
+	}
+}
+
+// BenchmarkCoalescedUpdates sends a client position updates for 10
+// entities in turn, plainly and coalesced by entity, each iteration being
+// an update, and waits for it to have the latest position of each. The
+// client is throttled to 256KB a second, so it falls behind, and is sent
+// every update plainly, but only the latest of each entity's waiting
+// when coalesced, which the frames it is sent per update show.
+func BenchmarkCoalescedUpdates(b *testing.B) {
+	const entities = 10
+	payload := strings.Repeat("x", 1024)
+	for _, coalesce := range []bool{false, true} {
+		name := "plain"
+		if coalesce {
+			name = "coalesced"
+		}
+		b.Run(name, func(b *testing.B) {
+			e, srv := serve(b, ExchangeOptions{BandwidthLimit: 256 << 10, OutChannelSize: 1 << 14}, Ticker{})
+			ws, cid := openWebSocket(b, srv)
+			client := e.Clients(Ticker{}).Client(cid)
+
+			// use up the second's worth the client may be sent at once, so
+			// that the updates are throttled from the first
+			for i := 0; i < 256; i++ {
+				client.Call("filler", payload)
+			}
+			client.Call("flushed")
+			for flushed := false; !flushed; {
+				for _, f := range readFrames(b, ws) {
+					flushed = flushed || strings.Contains(string(f), `"flushed"`)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			latest := make([]int, entities)
+			for i := 0; i < b.N; i++ {
+				entity := i % entities
+				latest[entity] = i
+				var err error
+				if coalesce {
+					err = client.CallCoalesced("entity-"+strconv.Itoa(entity), "moved", entity, i, payload)
+				} else {
+					err = client.Call("moved", entity, i, payload)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			frames, caughtUp := 0, 0
+			seen := make([]int, entities)
+			for i := range seen {
+				seen[i] = -1
+				if i >= b.N {
+					caughtUp++
+				}
+			}
+			for caughtUp < entities {
+				for _, f := range readFrames(b, ws) {
+					var inv struct {
+						Method string            `json:"M"`
+						Args   []json.RawMessage `json:"A"`
+					}
+					if json.Unmarshal(f, &inv); inv.Method != "moved" {
+						continue
+					}
+					frames++
+					var entity, n int
+					json.Unmarshal(inv.Args[0], &entity)
+					json.Unmarshal(inv.Args[1], &n)
+					if seen[entity] < latest[entity] && n == latest[entity] {
+						caughtUp++
+					}
+					seen[entity] = n
+				}
+			}
+			b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package relayr
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	errGroupRequestsDisabled = errors.New("relayr: clients may not join or leave groups")
+	errGroupJoinDenied       = errors.New("relayr: not allowed to join the group")
+)
+
+// receiveGroupRequest adds a client to, or removes it from, the group
+// named by a join or leave frame it sent. It reports whether the client
+// joined or left the group, which it does not if it was in the group
+// already, or was not in it. Clients may join the groups the
+// GroupJoinAuthorizer allows and leave any group whose name is allowed,
+// and neither without one.
+func (e *Exchange) receiveGroupRequest(cid string, m *inboundFrame) (bool, error) {
+	authorize := e.options.GroupJoinAuthorizer
+	if authorize == nil {
+		return false, errGroupRequestsDisabled
+	}
+	if err := e.validateGroupName(m.Group); err != nil {
+		return false, err
+	}
+	if m.Type == frameLeaveGroup {
+		return e.removeFromGroupByID(m.Group, cid), nil
+	}
+
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return false, ErrConnectionNotFound
+	}
+	if !authorize(cid, m.Group, c.principal) {
+		e.logger.Infof("client %s was not allowed to join '%s'", cid, m.Group)
+		return false, errGroupJoinDenied
+	}
+	return e.addToGroup(m.Group, cid)
+}
+
+// groupRequestStatus returns the status a long-polling client's join or
+// leave request that failed with err is answered with.
+func groupRequestStatus(err error) int {
+	if _, ok := err.(*GroupNameError); ok {
+		return http.StatusBadRequest
+	}
+	if err == ErrConnectionNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusForbidden
+}
@@ -0,0 +1,131 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	rclient "github.com/simon-whitehead/relayr/client"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// openGroups allows clients to join the groups named "open:...", and no
+// others.
+func openGroups(connectionID, group string, principal interface{}) bool {
+	return strings.HasPrefix(group, "open:")
+}
+
+func TestClientGroupRequests(t *testing.T) {
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			e, srv := serve(t, ExchangeOptions{GroupJoinAuthorizer: openGroups}, Ticker{})
+			c := dial(t, srv, transport)
+			ticks := calls(c, "Ticker", "tick")
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+
+			if err := c.Join(ctx, "open:1"); err != nil {
+				t.Fatalf("an approved join failed with %v", err)
+			}
+			if !e.IsInGroup("open:1", c.ConnectionID()) {
+				t.Fatal("the client was not added to the group it joined")
+			}
+			e.Clients(Ticker{}).Group("open:1").Call("tick", "joined")
+			if args := receive(t, ticks); string(args[0]) != `"joined"` {
+				t.Fatalf("the client received %s", args[0])
+			}
+
+			var cerr *rclient.Error
+			if err := c.Join(ctx, "closed"); !errors.As(err, &cerr) || cerr.Message != errGroupJoinDenied.Error() {
+				t.Fatalf("a refused join failed with %v", err)
+			}
+			if e.IsInGroup("closed", c.ConnectionID()) {
+				t.Fatal("the client was added to a group it was refused")
+			}
+
+			if err := c.Leave(ctx, "open:1"); err != nil {
+				t.Fatalf("leaving failed with %v", err)
+			}
+			if e.IsInGroup("open:1", c.ConnectionID()) {
+				t.Fatal("the client is still in the group it left")
+			}
+			if err := c.Leave(ctx, "open:2"); err != nil {
+				t.Fatalf("leaving a group the client is not in failed with %v", err)
+			}
+		})
+	}
+}
+
+// TestClientGroupRequestChanged checks the completions of join and leave
+// requests, which report whether the client joined or left the group.
+func TestClientGroupRequestChanged(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{GroupJoinAuthorizer: openGroups}, Ticker{})
+	ws, _ := openWebSocket(t, srv)
+	for i, tt := range []struct {
+		typ   string
+		group string
+		want  bool
+	}{
+		{protocol.TypeJoinGroup, "open:1", true},
+		{protocol.TypeJoinGroup, "open:1", false}, // joined already
+		{protocol.TypeLeaveGroup, "open:1", true},
+		{protocol.TypeLeaveGroup, "open:1", false}, // left already
+		{protocol.TypeLeaveGroup, "open:2", false}, // never joined
+	} {
+		id := strconv.Itoa(i)
+		if err := ws.WriteJSON(protocol.Inbound{Type: tt.typ, Group: tt.group, InvocationID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if c := readCompletion(t, ws, id); c.Error != "" || c.Value != tt.want {
+			t.Fatalf("%s %s completed with %+v, want %v", tt.typ, tt.group, c, tt.want)
+		}
+	}
+}
+
+func TestClientGroupRequestStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		authorize func(connectionID, group string, principal interface{}) bool
+		frame     string
+		want      int
+	}{
+		{"approved", openGroups, `{"T":"j","G":"open:1","I":"1"}`, http.StatusOK},
+		{"refused", openGroups, `{"T":"j","G":"closed","I":"1"}`, http.StatusForbidden},
+		{"invalid name", openGroups, `{"T":"j","G":"","I":"1"}`, http.StatusBadRequest},
+		{"leave", openGroups, `{"T":"l","G":"open:1","I":"1"}`, http.StatusOK},
+		{"no authorizer", nil, `{"T":"j","G":"open:1","I":"1"}`, http.StatusForbidden},
+		{"no authorizer leave", nil, `{"T":"l","G":"open:1","I":"1"}`, http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := serve(t, ExchangeOptions{GroupJoinAuthorizer: tt.authorize}, Ticker{})
+			cid := negotiate(t, srv, "longpoll").ConnectionID
+			if status := postFrame(t, srv, cid, tt.frame); status != tt.want {
+				t.Fatalf("%s was answered %d, want %d", tt.frame, status, tt.want)
+			}
+		})
+	}
+}
+
+// TestClientGroupRequestsDisabled checks that clients may neither join
+// nor leave groups without a GroupJoinAuthorizer.
+func TestClientGroupRequestsDisabled(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	ws, cid := openWebSocket(t, srv)
+	if err := e.AddToGroup("room", cid); err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []string{protocol.TypeJoinGroup, protocol.TypeLeaveGroup} {
+		if err := ws.WriteJSON(protocol.Inbound{Type: typ, Group: "room", InvocationID: typ}); err != nil {
+			t.Fatal(err)
+		}
+		if c := readCompletion(t, ws, typ); c.Error != errGroupRequestsDisabled.Error() {
+			t.Fatalf("%s completed with %+v", typ, c)
+		}
+	}
+	if !e.IsInGroup("room", cid) {
+		t.Fatal("the client left a group without a GroupJoinAuthorizer")
+	}
+}
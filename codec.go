@@ -0,0 +1,145 @@
+package relayr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Codec encodes and decodes the frames exchanged with clients. Each
+// client negotiates the codec it understands; JSON is always available.
+type Codec interface {
+	// Name identifies the codec during negotiation, e.g. "json".
+	Name() string
+	// Binary reports whether encoded frames are binary rather than text.
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the default codec, understood by the generated client script.
+// It uses encoding/json; ExchangeOptions.JSONMarshal and JSONUnmarshal
+// replace it for an Exchange. Arguments that are json.RawMessage are
+// embedded in frames as they are, without being decoded.
+var JSONCodec Codec = &jsonCodec{}
+
+// jsonCodec encodes frames as JSON, with encoding/json unless marshal and
+// unmarshal are set.
+type jsonCodec struct {
+	marshal      func(v interface{}) ([]byte, error)
+	unmarshal    func(data []byte, v interface{}) error
+	noEscapeHTML bool // leave <, > and & in strings as they are
+}
+
+// newJSONCodec returns the JSON codec configured by opts.
+func newJSONCodec(opts ExchangeOptions) Codec {
+	if opts.JSONMarshal == nil && opts.JSONUnmarshal == nil && !opts.DisableHTMLEscape {
+		return JSONCodec
+	}
+	return &jsonCodec{
+		marshal:      opts.JSONMarshal,
+		unmarshal:    opts.JSONUnmarshal,
+		noEscapeHTML: opts.DisableHTMLEscape,
+	}
+}
+
+func (*jsonCodec) Name() string { return "json" }
+
+func (*jsonCodec) Binary() bool { return false }
+
+func (c *jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if c.marshal != nil {
+		return c.marshal(v)
+	}
+	if !c.noEscapeHTML {
+		return json.Marshal(v)
+	}
+
+	b := encodeBuffers.Get().(*encodeBuffer)
+	defer b.release()
+	if err := b.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	// Encode ends the value with a newline; the frame is copied out of the
+	// buffer, which is reused
+	return append([]byte(nil), bytes.TrimSuffix(b.buf.Bytes(), newline)...), nil
+}
+
+var newline = []byte("\n")
+
+// maxPooledBuffer bounds the encodeBuffers kept for reuse; one grown past
+// it by a large frame is let go.
+const maxPooledBuffer = 64 << 10
+
+// encodeBuffer is a buffer and an encoder writing to it, without escaping
+// HTML, reused across the frames encoded by jsonCodecs with noEscapeHTML.
+type encodeBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encodeBuffers = sync.Pool{New: func() interface{} {
+	b := new(encodeBuffer)
+	b.enc = json.NewEncoder(&b.buf)
+	b.enc.SetEscapeHTML(false)
+	return b
+}}
+
+// release returns the buffer to encodeBuffers, emptied.
+func (b *encodeBuffer) release() {
+	if b.buf.Cap() > maxPooledBuffer {
+		return
+	}
+	b.buf.Reset()
+	encodeBuffers.Put(b)
+}
+
+func (c *jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	if c.unmarshal != nil {
+		return c.unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// unmarshalNumbers decodes data into v as Unmarshal does, but decodes
+// numbers into interface{} values as json.Number rather than float64, so
+// that none loses precision. A JSONUnmarshal decodes them as it does.
+func (c *jsonCodec) unmarshalNumbers(data []byte, v interface{}) error {
+	if c.unmarshal != nil {
+		return c.unmarshal(data, v)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return errors.New("relayr: data after the frame")
+	}
+	return nil
+}
+
+// codecByName returns the codec registered under name, falling back to
+// JSON for unknown or empty names.
+func (e *Exchange) codecByName(name string) Codec {
+	if name == "json" {
+		return e.json
+	}
+	for _, c := range e.options.Codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return e.json
+}
+
+// codecFor returns the codec negotiated by the client with the given
+// ConnectionID.
+func (e *Exchange) codecFor(cid string) Codec {
+	if c := e.getClientByConnectionID(cid); c != nil && c.codec != nil {
+		return c.codec
+	}
+	return e.json
+}
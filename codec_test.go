@@ -0,0 +1,100 @@
+package relayr
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// chatFrame is a typical broadcast: a chat message sent to a room.
+var chatFrame = protocol.ClientInvocation{
+	Type:   protocol.TypeClientInvocation,
+	Relay:  "Chat",
+	Method: "said",
+	Arguments: []interface{}{map[string]interface{}{
+		"room":   "general",
+		"author": "alice",
+		"sentAt": 1700000000000,
+		"text":   strings.Repeat("hello, world ", 10),
+		"tags":   []string{"greeting", "test"},
+	}},
+}
+
+// BenchmarkCodecs encodes and decodes chatFrame with each codec,
+// reporting the size of the encoded frame.
+func BenchmarkCodecs(b *testing.B) {
+	for _, c := range []Codec{JSONCodec, MessagePackCodec} {
+		frame, err := c.Marshal(chatFrame)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.Name()+"/encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Marshal(chatFrame); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(frame)), "bytes/frame")
+		})
+		b.Run(c.Name()+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var inv protocol.ClientInvocation
+				if err := c.Unmarshal(frame, &inv); err != nil || inv.Method != "said" {
+					b.Fatalf("decoded %+v, %v", inv, err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBroadcastPreEncoded broadcasts a JSON document of 5KB to 1000
+// websocket clients, passed as the json.RawMessage it was read as, which
+// is embedded in the frames as it is, and decoded, which is encoded again.
+func BenchmarkBroadcastPreEncoded(b *testing.B) {
+	const clients = 1000
+	var items []map[string]string
+	for i := 0; len(items) < 50; i++ {
+		items = append(items, map[string]string{
+			"id":   strconv.Itoa(i),
+			"text": "a message in the room's history",
+			"link": "https://example.com/rooms/general/messages/" + strconv.Itoa(i),
+		})
+	}
+	raw, _ := json.Marshal(map[string]interface{}{"room": "general", "history": items})
+	var decoded interface{}
+	json.Unmarshal(raw, &decoded)
+
+	e, srv := serve(b, ExchangeOptions{OutChannelSize: 256}, Ticker{})
+	var received sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		ws, _ := openWebSocket(b, srv)
+		go listenTicks(ws, &received)
+	}
+	ops := e.Clients(Ticker{})
+
+	for _, tt := range []struct {
+		name string
+		doc  interface{}
+	}{
+		{"decoded", decoded},
+		{"raw", json.RawMessage(raw)},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				received.Add(clients)
+				if err := ops.All("tick", tt.doc); err != nil {
+					b.Fatal(err)
+				}
+				received.Wait()
+			}
+			b.ReportMetric(float64(len(raw)), "doc-bytes")
+		})
+	}
+}
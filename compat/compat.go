@@ -0,0 +1,670 @@
+// Package compat serves clients that speak the JSON protocol of ASP.NET
+// SignalR 2 hubs, as jquery.signalR does, from a relayr Exchange, so that
+// a frontend built on such a client can move to relayr a page at a time.
+//
+// A Handler answers the legacy negotiate, connect, reconnect, start, send,
+// poll, ping and abort requests, over websockets and long polling, and
+// bridges each legacy connection onto a connection of the Exchange,
+// negotiated over a transport of the Handler's own as a native client's
+// is, with the credentials of the legacy negotiation. Legacy clients thus
+// share groups with native ones and are sent the calls made to them; their
+// hub invocations are calls to relay methods, subject to the Exchange's
+// rate limits, authorization rules and interceptors. Hub names map onto
+// relay names, and method names onto those of the relays' methods,
+// without regard to case.
+//
+// Features of the legacy protocol with no counterpart in relayr are
+// refused with an error rather than ignored: the serverSentEvents and
+// foreverFrame transports, persistent connections without hubs, hub state
+// sent with an invocation, groups tokens, and methods that stream their
+// results or read uploads.
+package compat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// TransportName is the name a Handler's transport is registered with the
+// Exchange under, which legacy clients are listed under by Connections
+// and Stats.
+const TransportName = "signalr"
+
+// protocolVersion is the version of the legacy protocol spoken.
+const protocolVersion = "1.5"
+
+// transportConnectTimeout is how long, in seconds, legacy clients wait for
+// a transport to connect before they try the next.
+const transportConnectTimeout = 5
+
+const (
+	defaultKeepAlive         = 10 * time.Second
+	defaultDisconnectTimeout = 30 * time.Second
+	defaultPollTimeout       = 25 * time.Second
+)
+
+// The legacy transports served.
+const (
+	webSockets  = "webSockets"
+	longPolling = "longPolling"
+)
+
+var (
+	errGroupsToken  = errors.New("compat: groups tokens are not supported")
+	errHubState     = errors.New("compat: hub state is not supported")
+	errNoHubs       = errors.New("compat: persistent connections are not supported; connect to hubs")
+	errUnknownToken = errors.New("compat: unknown connection token")
+	errStream       = errors.New("compat: methods that stream their results or read uploads are not supported")
+)
+
+// Options configures a Handler.
+type Options struct {
+	// Hubs maps the hub names legacy clients connect to, compared without
+	// regard to case, to the names of the relays they stand for. Hubs not
+	// listed stand for the relays of the same name, compared likewise.
+	Hubs map[string]string
+
+	// KeepAlive is how often a legacy websocket is sent a keep-alive
+	// message; clients give up on a connection that goes twice as long
+	// without one. Defaults to 10 seconds.
+	KeepAlive time.Duration
+
+	// DisconnectTimeout is how long a legacy client that lost its
+	// websocket has to reconnect, or a long-polling one to poll again,
+	// before it is disconnected from the Exchange. Defaults to 30 seconds.
+	DisconnectTimeout time.Duration
+
+	// PollTimeout is how long a long poll is held open when there is
+	// nothing to send. Defaults to 25 seconds.
+	PollTimeout time.Duration
+
+	// CheckOrigin validates the Origin header of legacy websocket
+	// upgrades, as ExchangeOptions.CheckOrigin does for the Exchange's.
+	// When nil, only same-origin upgrades are accepted.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Handler serves legacy clients from an Exchange. Mount it under the URL
+// they connect to, such as "/signalr/", the operation being the last
+// segment of the request path.
+type Handler struct {
+	e        *relayr.Exchange
+	opts     Options
+	upgrader websocket.Upgrader
+	t        *transport
+	catalog  atomic.Pointer[catalog] // of the relays registered at the last negotiation
+}
+
+// New returns a Handler serving legacy clients from e, registering its
+// transport with e, which must therefore not be frozen yet.
+func New(e *relayr.Exchange, opts Options) (*Handler, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+	if opts.DisconnectTimeout <= 0 {
+		opts.DisconnectTimeout = defaultDisconnectTimeout
+	}
+	if opts.PollTimeout <= 0 {
+		opts.PollTimeout = defaultPollTimeout
+	}
+	hubs := make(map[string]string, len(opts.Hubs))
+	for legacy, relay := range opts.Hubs {
+		hubs[strings.ToLower(legacy)] = relay
+	}
+	opts.Hubs = hubs
+
+	h := &Handler{e: e, opts: opts, upgrader: websocket.Upgrader{CheckOrigin: opts.CheckOrigin}}
+	h.t = newTransport(h)
+	if err := e.RegisterTransport(TransportName, h.t); err != nil {
+		return nil, err
+	}
+	go h.t.reap()
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	op := path[strings.LastIndex(path, "/")+1:]
+	if op == "negotiate" {
+		h.negotiate(w, r, strings.TrimSuffix(path, "/negotiate"))
+		return
+	}
+	if op == "ping" {
+		writeJSON(w, map[string]string{"Response": "pong"})
+		return
+	}
+
+	c := h.t.byToken(r.URL.Query().Get("connectionToken"))
+	if c == nil {
+		http.Error(w, errUnknownToken.Error(), http.StatusForbidden)
+		return
+	}
+	switch op {
+	case "connect", "reconnect":
+		h.connect(w, r, c, op == "connect")
+	case "start":
+		writeJSON(w, map[string]string{"Response": "started"})
+	case "poll":
+		h.poll(w, r, c)
+	case "send":
+		h.send(w, r, c)
+	case "abort":
+		h.e.Disconnect(c.id, relayr.ReasonClosed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// negotiate answers a legacy negotiation, negotiating a connection with
+// the Exchange on the client's behalf.
+func (h *Handler) negotiate(w http.ResponseWriter, r *http.Request, url string) {
+	cat := newCatalog(h.e.Schema())
+	h.catalog.Store(cat)
+	hubs, err := h.hubs(cat, r.URL.Query().Get("connectionData"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, _ := json.Marshal(protocol.Negotiation{T: TransportName, V: protocol.Version})
+	req := r.Clone(r.Context())
+	req.Method = http.MethodPost
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := &recorder{header: make(http.Header), status: http.StatusOK}
+	h.e.NegotiateHandler().ServeHTTP(rec, req)
+	var res protocol.NegotiationResponse
+	if rec.status != http.StatusOK || json.Unmarshal(rec.body.Bytes(), &res) != nil || res.ConnectionID == "" {
+		// refused, as by the Authorizer or a connection limit
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+		return
+	}
+
+	c := &conn{id: res.ConnectionID, token: newToken(), hubs: hubs, notify: make(chan struct{}, 1), gone: make(chan struct{}), seen: time.Now()}
+	h.t.add(c)
+	writeJSON(w, negotiation{
+		URL:                     url,
+		ConnectionToken:         c.token,
+		ConnectionID:            c.id,
+		KeepAliveTimeout:        2 * h.opts.KeepAlive.Seconds(),
+		DisconnectTimeout:       h.opts.DisconnectTimeout.Seconds(),
+		ConnectionTimeout:       h.opts.PollTimeout.Seconds(),
+		TryWebSockets:           true,
+		ProtocolVersion:         protocolVersion,
+		TransportConnectTimeout: transportConnectTimeout,
+	})
+}
+
+// hubs returns the relays the hubs named by a negotiation's connectionData
+// stand for, by relay name, with the names the client gave them.
+func (h *Handler) hubs(cat *catalog, connectionData string) (map[string]string, error) {
+	var data []struct {
+		Name string `json:"name"`
+	}
+	if connectionData == "" {
+		return nil, errNoHubs
+	}
+	if err := json.Unmarshal([]byte(connectionData), &data); err != nil {
+		return nil, fmt.Errorf("compat: invalid connectionData: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, errNoHubs
+	}
+
+	hubs := make(map[string]string, len(data))
+	for _, hub := range data {
+		name := strings.ToLower(hub.Name)
+		if mapped, ok := h.opts.Hubs[name]; ok {
+			name = strings.ToLower(mapped)
+		}
+		relay, ok := cat.relays[name]
+		if !ok {
+			return nil, fmt.Errorf("compat: unknown hub %s", hub.Name)
+		}
+		hubs[relay.name] = hub.Name
+	}
+	return hubs, nil
+}
+
+// transportOf returns the legacy transport a request is made over,
+// failing for those that are not served, and for groups tokens.
+func transportOf(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	if q.Get("groupsToken") != "" {
+		return "", errGroupsToken
+	}
+	switch t := q.Get("transport"); t {
+	case webSockets, longPolling:
+		return t, nil
+	default:
+		return "", fmt.Errorf("compat: transport %s is not supported", t)
+	}
+}
+
+// connect answers a legacy connect or reconnect request, connecting the
+// client to the Exchange the first time.
+func (h *Handler) connect(w http.ResponseWriter, r *http.Request, c *conn, first bool) {
+	t, err := transportOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.started.Swap(true) {
+		if err := h.e.Connected(c.id); err != nil {
+			h.t.remove(c.id)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if t == longPolling {
+		c.touch()
+		init := persistentResponse{Cursor: c.cursor(), Messages: []json.RawMessage{}}
+		if first {
+			init.Initialized = 1
+		}
+		writeJSON(w, init)
+		return
+	}
+
+	ws, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	if first {
+		b, _ := json.Marshal(persistentResponse{Cursor: c.cursor(), Initialized: 1, Messages: []json.RawMessage{}})
+		c.write(ws, b)
+	}
+	c.attach(ws)
+	done := make(chan struct{})
+	go h.writeLoop(c, ws, done)
+	h.readLoop(c, ws)
+	close(done)
+	c.detach(ws)
+}
+
+// readLoop runs the invocations a legacy client sends over its websocket,
+// each on a goroutine of its own, until the websocket closes.
+func (h *Handler) readLoop(c *conn, ws *websocket.Conn) {
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		go func() {
+			if res := h.invoke(c, data); res != nil {
+				c.write(ws, res)
+			}
+		}()
+	}
+}
+
+// writeLoop writes the calls made to a legacy client to its websocket, and
+// keep-alive messages, until the read loop ends or the client is gone.
+func (h *Handler) writeLoop(c *conn, ws *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(h.opts.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.gone:
+			c.write(ws, disconnectMessage)
+			ws.Close()
+			return
+		case <-ticker.C:
+			c.write(ws, keepAliveMessage)
+		case <-c.notify:
+			cursor, messages := c.take(0, true)
+			if len(messages) == 0 {
+				continue
+			}
+			b, _ := json.Marshal(persistentResponse{Cursor: cursor, Messages: messages})
+			if c.write(ws, b) != nil {
+				ws.Close()
+				return
+			}
+		}
+	}
+}
+
+// poll answers a legacy long poll with the calls made to the client after
+// the messageId it names, waiting up to the PollTimeout for one.
+func (h *Handler) poll(w http.ResponseWriter, r *http.Request, c *conn) {
+	if _, err := transportOf(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var after uint64
+	fmt.Sscan(r.URL.Query().Get("messageId"), &after)
+	c.polling.Add(1)
+	defer func() {
+		c.touch()
+		c.polling.Add(-1)
+	}()
+
+	timer := time.NewTimer(h.opts.PollTimeout)
+	defer timer.Stop()
+	for {
+		cursor, messages := c.take(after, false)
+		if len(messages) > 0 {
+			writeJSON(w, persistentResponse{Cursor: cursor, Messages: messages})
+			return
+		}
+		select {
+		case <-c.notify:
+		case <-c.gone:
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.Write(disconnectMessage)
+			return
+		case <-timer.C:
+			writeJSON(w, persistentResponse{Cursor: cursor, Messages: []json.RawMessage{}})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// send runs an invocation a long-polling legacy client posts, answering
+// with its result.
+func (h *Handler) send(w http.ResponseWriter, r *http.Request, c *conn) {
+	if _, err := transportOf(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.touch()
+	res := h.invoke(c, []byte(r.PostFormValue("data")))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(res)
+}
+
+// invoke runs a hub invocation as a call to the relay method it stands
+// for, returning the legacy response to it, or nil if it asks for none.
+func (h *Handler) invoke(c *conn, data []byte) []byte {
+	var inv invocation
+	if err := json.Unmarshal(data, &inv); err != nil {
+		b, _ := json.Marshal(hubResponse{Error: fmt.Sprintf("compat: invalid invocation: %v", err)})
+		return b
+	}
+
+	result, err := h.call(c, &inv)
+	if inv.ID == "" {
+		return nil
+	}
+	res := hubResponse{ID: inv.ID.String(), Result: result}
+	if err != nil {
+		res.Result, res.Error = nil, err.Error()
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		b, _ = json.Marshal(hubResponse{ID: inv.ID.String(), Error: err.Error()})
+	}
+	return b
+}
+
+// call makes the call to a relay method a hub invocation stands for.
+func (h *Handler) call(c *conn, inv *invocation) (interface{}, error) {
+	if len(inv.State) > 0 {
+		return nil, errHubState
+	}
+	relay, method, err := h.catalog.Load().resolve(c, inv.Hub, inv.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]interface{}, len(inv.Args))
+	for i, raw := range inv.Args {
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		if err := d.Decode(&args[i]); err != nil {
+			return nil, err
+		}
+	}
+	return h.e.ServeCall(c.id, relay, method, args)
+}
+
+// catalog holds the names of the registered relays and their methods,
+// lower-cased, for legacy names to be matched against.
+type catalog struct {
+	relays map[string]catalogRelay
+}
+
+type catalogRelay struct {
+	name    string
+	methods map[string]relayr.MethodSchema
+}
+
+func newCatalog(schema []relayr.RelaySchema) *catalog {
+	cat := &catalog{relays: make(map[string]catalogRelay, len(schema))}
+	for _, r := range schema {
+		methods := make(map[string]relayr.MethodSchema, len(r.Methods))
+		for _, m := range r.Methods {
+			methods[strings.ToLower(m.Name)] = m
+		}
+		cat.relays[strings.ToLower(r.Name)] = catalogRelay{name: r.Name, methods: methods}
+	}
+	return cat
+}
+
+// resolve returns the relay and method a legacy client's invocation of a
+// hub's method stands for.
+func (cat *catalog) resolve(c *conn, hub, method string) (string, string, error) {
+	for relay, legacy := range c.hubs {
+		if !strings.EqualFold(legacy, hub) {
+			continue
+		}
+		m, ok := cat.relays[strings.ToLower(relay)].methods[strings.ToLower(method)]
+		if !ok {
+			return relay, method, nil
+		}
+		if m.Stream || m.Upload {
+			return "", "", errStream
+		}
+		return relay, m.Name, nil
+	}
+	return "", "", fmt.Errorf("compat: the connection is not to hub %s", hub)
+}
+
+// invocation is a hub invocation sent by a legacy client.
+type invocation struct {
+	Hub    string                 `json:"H"`
+	Method string                 `json:"M"`
+	Args   []json.RawMessage      `json:"A"`
+	ID     json.Number            `json:"I"`
+	State  map[string]interface{} `json:"S"`
+}
+
+// hubResponse answers a hub invocation.
+type hubResponse struct {
+	ID     string      `json:"I"`
+	Result interface{} `json:"R,omitempty"`
+	Error  string      `json:"E,omitempty"`
+}
+
+// clientMessage invokes a method of a legacy client's hub proxy.
+type clientMessage struct {
+	Hub    string        `json:"H"`
+	Method string        `json:"M"`
+	Args   []interface{} `json:"A"`
+}
+
+// persistentResponse carries the messages sent to a legacy client, each a
+// clientMessage, up to the cursor it names.
+type persistentResponse struct {
+	Cursor      string            `json:"C"`
+	Initialized int               `json:"S,omitempty"`
+	Messages    []json.RawMessage `json:"M"`
+}
+
+// negotiation answers a legacy negotiation.
+type negotiation struct {
+	URL                     string `json:"Url"`
+	ConnectionToken         string
+	ConnectionID            string `json:"ConnectionId"`
+	KeepAliveTimeout        float64
+	DisconnectTimeout       float64
+	ConnectionTimeout       float64
+	TryWebSockets           bool
+	ProtocolVersion         string
+	TransportConnectTimeout float64
+	LongPollDelay           float64
+}
+
+var (
+	keepAliveMessage  = []byte("{}")
+	disconnectMessage = []byte(`{"D":1}`)
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// newToken returns a connection token, which names a legacy connection in
+// its requests.
+func newToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// recorder keeps the response to a negotiation made with the Exchange on
+// a legacy client's behalf.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header         { return r.header }
+func (r *recorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *recorder) WriteHeader(status int)      { r.status = status }
+
+// conn is a legacy connection, bridged onto the Exchange's connection
+// with the same ConnectionID.
+type conn struct {
+	id      string
+	token   string
+	hubs    map[string]string // the names the client gave the hubs it connected to, by relay name
+	started atomic.Bool       // the client has connected to the Exchange
+	polling atomic.Int32      // long polls waiting
+	notify  chan struct{}     // signalled as calls are queued
+	gone    chan struct{}     // closed once the client is disconnected
+
+	lock     sync.Mutex
+	queue    []queued // calls made to the client and not yet acknowledged, oldest first
+	seq      uint64   // the number of the last call queued
+	ws       *websocket.Conn
+	seen     time.Time // when the client negotiated, last polled or had its websocket close
+	wsLock   sync.Mutex
+	released bool // gone has been closed
+}
+
+type queued struct {
+	seq  uint64
+	data json.RawMessage
+}
+
+// cursor returns the number of the last call queued.
+func (c *conn) cursor() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return fmt.Sprint(c.seq)
+}
+
+// take returns the calls queued after the given number, forgetting those
+// up to it, or all of them with all, along with the number of the last.
+func (c *conn) take(after uint64, all bool) (string, []json.RawMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := 0
+	for i < len(c.queue) && (all || c.queue[i].seq <= after) {
+		i++
+	}
+	var messages []json.RawMessage
+	if all {
+		for _, q := range c.queue {
+			messages = append(messages, q.data)
+		}
+	} else {
+		for _, q := range c.queue[i:] {
+			messages = append(messages, q.data)
+		}
+	}
+	c.queue = c.queue[i:]
+	return fmt.Sprint(c.seq), messages
+}
+
+// write writes a message to a websocket of the client, one at a time.
+func (c *conn) write(ws *websocket.Conn, b []byte) error {
+	c.wsLock.Lock()
+	defer c.wsLock.Unlock()
+	ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// touch records that the client was just heard from.
+func (c *conn) touch() {
+	c.lock.Lock()
+	c.seen = time.Now()
+	c.lock.Unlock()
+}
+
+// attach records the websocket the client connected over, closing the
+// one it had, if any.
+func (c *conn) attach(ws *websocket.Conn) {
+	c.lock.Lock()
+	old := c.ws
+	c.ws = ws
+	c.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// detach records that a websocket of the client closed.
+func (c *conn) detach(ws *websocket.Conn) {
+	ws.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ws == ws {
+		c.ws = nil
+		c.seen = time.Now()
+	}
+}
+
+// idle reports whether the client has had neither a websocket nor a long
+// poll for longer than timeout, or has not connected in that time.
+func (c *conn) idle(now time.Time, timeout time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ws == nil && c.polling.Load() == 0 && now.Sub(c.seen) > timeout
+}
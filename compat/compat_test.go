@@ -0,0 +1,389 @@
+package compat_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr"
+	"github.com/simon-whitehead/relayr/client"
+	"github.com/simon-whitehead/relayr/compat"
+)
+
+const timeout = 5 * time.Second
+
+// Chat is the relay legacy and native clients share.
+type Chat struct{}
+
+func (Chat) Join(r *relayr.Relay, room string) error {
+	return r.Groups(room).Add(r.ConnectionID)
+}
+
+func (Chat) Send(r *relayr.Relay, room, text string) error {
+	return r.Clients.Group(room).Call("said", text)
+}
+
+func (Chat) Shout(r *relayr.Relay, text string) string { return strings.ToUpper(text) }
+
+func (Chat) Count(r *relayr.Relay, n int) <-chan int {
+	ch := make(chan int, n)
+	for i := 0; i < n; i++ {
+		ch <- i
+	}
+	close(ch)
+	return ch
+}
+
+// serve starts an Exchange with a Chat registered at /relayr, and a
+// Handler made with opts serving it to legacy clients at /signalr, closing
+// them as the test ends.
+func serve(t *testing.T, opts compat.Options) (*relayr.Exchange, *httptest.Server) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	e := relayr.NewExchangeWithOptions(srv.URL+"/relayr", relayr.ExchangeOptions{})
+	t.Cleanup(func() { e.Close(context.Background()) })
+	if err := e.RegisterRelay(Chat{}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := compat.New(e, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/relayr/", e)
+	mux.Handle("/signalr/", h)
+	return e, srv
+}
+
+// message is what a legacy client is sent: calls made to it, under M, or
+// the response to one of its invocations, under I.
+type message struct {
+	C string
+	S int
+	D int
+	M []call
+	I string
+	R json.RawMessage
+	E string
+}
+
+// call is a call made to a legacy client's hub proxy.
+type call struct {
+	H, M string
+	A    []json.RawMessage
+}
+
+// legacy is a scripted legacy client.
+type legacy struct {
+	t         *testing.T
+	srv       *httptest.Server
+	transport string
+	hubs      string // the connectionData
+	token     string
+	id        string
+	ws        *websocket.Conn
+	cursor    string
+	calls     []call // received and not yet taken by next
+}
+
+// query returns the query of a request the client makes, with the given
+// parameters besides its own.
+func (l *legacy) query(extra ...string) string {
+	q := url.Values{"clientProtocol": {"1.5"}, "transport": {l.transport}, "connectionToken": {l.token}, "connectionData": {l.hubs}}
+	for i := 0; i < len(extra); i += 2 {
+		q.Set(extra[i], extra[i+1])
+	}
+	return q.Encode()
+}
+
+// negotiateLegacy negotiates for a legacy client of the hubs, returning
+// the status the negotiation was answered with.
+func negotiateLegacy(t *testing.T, srv *httptest.Server, transport string, hubs ...string) (*legacy, int) {
+	t.Helper()
+	l := &legacy{t: t, srv: srv, transport: transport}
+	if hubs != nil {
+		var data []map[string]string
+		for _, h := range hubs {
+			data = append(data, map[string]string{"name": h})
+		}
+		b, _ := json.Marshal(data)
+		l.hubs = string(b)
+	}
+	resp, err := http.Get(srv.URL + "/signalr/negotiate?" + url.Values{"clientProtocol": {"1.5"}, "connectionData": {l.hubs}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		ConnectionToken string
+		ConnectionID    string `json:"ConnectionId"`
+		ProtocolVersion string
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.ConnectionToken == "" || res.ProtocolVersion != "1.5" {
+			t.Fatalf("negotiating: %+v, %v", res, err)
+		}
+	}
+	l.token, l.id = res.ConnectionToken, res.ConnectionID
+	return l, resp.StatusCode
+}
+
+// connectLegacy negotiates and connects a legacy client of the hubs.
+func connectLegacy(t *testing.T, srv *httptest.Server, transport string, hubs ...string) *legacy {
+	t.Helper()
+	l, status := negotiateLegacy(t, srv, transport, hubs...)
+	if status != http.StatusOK {
+		t.Fatalf("negotiating was answered %d", status)
+	}
+	var init message
+	if transport == "webSockets" {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/signalr/connect?"+l.query(), nil)
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		l.ws = ws
+		ws.SetReadDeadline(time.Now().Add(timeout))
+		if err := ws.ReadJSON(&init); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		resp, err := http.Get(srv.URL + "/signalr/connect?" + l.query())
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&init)
+		resp.Body.Close()
+	}
+	if init.S != 1 {
+		t.Fatalf("connecting was answered %+v, not initialized", init)
+	}
+	l.cursor = init.C
+	return l
+}
+
+// read reads the next message sent over the client's websocket, or
+// answering its long poll, skipping keep-alives and empty polls.
+func (l *legacy) read() message {
+	l.t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		var m message
+		if l.ws != nil {
+			l.ws.SetReadDeadline(deadline)
+			if err := l.ws.ReadJSON(&m); err != nil {
+				l.t.Fatalf("reading: %v", err)
+			}
+		} else {
+			resp, err := http.Get(l.srv.URL + "/signalr/poll?" + l.query("messageId", l.cursor))
+			if err != nil {
+				l.t.Fatal(err)
+			}
+			json.NewDecoder(resp.Body).Decode(&m)
+			resp.Body.Close()
+		}
+		if m.C != "" {
+			l.cursor = m.C
+		}
+		if m.I != "" || m.D != 0 || len(m.M) > 0 {
+			return m
+		}
+	}
+	l.t.Fatal("nothing arrived")
+	return message{}
+}
+
+// invoke invokes a method of a hub, returning the response.
+func (l *legacy) invoke(inv map[string]interface{}) message {
+	l.t.Helper()
+	b, _ := json.Marshal(inv)
+	if l.ws == nil {
+		resp, err := http.PostForm(l.srv.URL+"/signalr/send?"+l.query(), url.Values{"data": {string(b)}})
+		if err != nil {
+			l.t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var m message
+		if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+			l.t.Fatalf("sending %s: %d %v", b, resp.StatusCode, err)
+		}
+		return m
+	}
+
+	if err := l.ws.WriteMessage(websocket.TextMessage, b); err != nil {
+		l.t.Fatal(err)
+	}
+	for {
+		m := l.read()
+		l.calls = append(l.calls, m.M...)
+		if m.I == inv["I"] {
+			return m
+		}
+	}
+}
+
+// call invokes a method of a hub, failing the test if it fails, and
+// returns the result.
+func (l *legacy) call(hub, method string, args ...interface{}) json.RawMessage {
+	l.t.Helper()
+	if args == nil {
+		args = []interface{}{}
+	}
+	res := l.invoke(map[string]interface{}{"H": hub, "M": method, "A": args, "I": "1"})
+	if res.E != "" {
+		l.t.Fatalf("%s.%s failed: %s", hub, method, res.E)
+	}
+	return res.R
+}
+
+// next returns the next call made to the client.
+func (l *legacy) next() call {
+	l.t.Helper()
+	for len(l.calls) == 0 {
+		l.calls = append(l.calls, l.read().M...)
+	}
+	c := l.calls[0]
+	l.calls = l.calls[1:]
+	return c
+}
+
+func TestLegacySession(t *testing.T) {
+	for _, transport := range []string{"webSockets", "longPolling"} {
+		t.Run(transport, func(t *testing.T) {
+			e, srv := serve(t, compat.Options{Hubs: map[string]string{"ChatHub": "Chat"}, PollTimeout: 500 * time.Millisecond})
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			native, err := client.Dial(ctx, srv.URL+"/relayr", client.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer native.Close()
+			said := make(chan string, 10)
+			native.On("Chat", "said", func(args []json.RawMessage) {
+				var s string
+				json.Unmarshal(args[0], &s)
+				said <- s
+			})
+			if err := native.Invoke(ctx, "Chat", "Join", "lobby"); err != nil {
+				t.Fatal(err)
+			}
+
+			// the hub and its methods named as the legacy client names them
+			l := connectLegacy(t, srv, transport, "chatHub")
+			if info, ok := e.ConnectionInfo(l.id); !ok || info.Transport != compat.TransportName {
+				t.Fatalf("the Exchange describes the legacy client as %+v", info)
+			}
+			if res := l.call("chatHub", "shout", "hi"); string(res) != `"HI"` {
+				t.Fatalf("shout returned %s", res)
+			}
+			l.call("CHATHUB", "join", "lobby")
+
+			// a legacy call reaches native clients, and the legacy one
+			l.call("chatHub", "send", "lobby", "from legacy")
+			select {
+			case s := <-said:
+				if s != "from legacy" {
+					t.Fatalf("the native client was sent %q", s)
+				}
+			case <-time.After(timeout):
+				t.Fatal("the native client was not sent the legacy client's call")
+			}
+			if c := l.next(); c.H != "chatHub" || c.M != "said" || len(c.A) != 1 || string(c.A[0]) != `"from legacy"` {
+				t.Fatalf("the legacy client was sent %+v", c)
+			}
+
+			// and a native one reaches the legacy client
+			if err := native.Invoke(ctx, "Chat", "Send", "lobby", "from native"); err != nil {
+				t.Fatal(err)
+			}
+			if c := l.next(); c.M != "said" || string(c.A[0]) != `"from native"` {
+				t.Fatalf("the legacy client was sent %+v", c)
+			}
+			e.Clients(Chat{}).All("said", "to all")
+			if c := l.next(); c.M != "said" || string(c.A[0]) != `"to all"` {
+				t.Fatalf("the legacy client was sent %+v", c)
+			}
+
+			// aborting disconnects it from the Exchange
+			resp, err := http.Get(srv.URL + "/signalr/abort?" + l.query())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if _, ok := e.ConnectionInfo(l.id); ok {
+				t.Fatal("an aborted legacy client is still connected")
+			}
+			if members := e.GroupMembers("lobby"); len(members) != 1 || members[0] != native.ConnectionID() {
+				t.Fatalf("lobby has the members %q once the legacy client aborted", members)
+			}
+		})
+	}
+}
+
+func TestLegacyRefusals(t *testing.T) {
+	_, srv := serve(t, compat.Options{})
+
+	for _, tt := range []struct {
+		name string
+		hubs []string
+	}{
+		{"no hubs", nil},
+		{"unknown hub", []string{"Missing"}},
+	} {
+		if _, status := negotiateLegacy(t, srv, "", tt.hubs...); status != http.StatusBadRequest {
+			t.Errorf("a negotiation with %s was answered %d", tt.name, status)
+		}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		query []string
+	}{
+		{"serverSentEvents", []string{"transport", "serverSentEvents"}},
+		{"foreverFrame", []string{"transport", "foreverFrame"}},
+		{"a groups token", []string{"groupsToken", "token"}},
+	} {
+		l, _ := negotiateLegacy(t, srv, "longPolling", "Chat")
+		resp, err := http.Get(srv.URL + "/signalr/connect?" + l.query(tt.query...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("connecting with %s was answered %d", tt.name, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/signalr/poll?" + url.Values{"transport": {"longPolling"}, "connectionToken": {"forged"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("polling with an unknown token was answered %d", resp.StatusCode)
+	}
+
+	l := connectLegacy(t, srv, "webSockets", "Chat")
+	for i, tt := range []struct {
+		name string
+		inv  map[string]interface{}
+		want string
+	}{
+		{"hub state", map[string]interface{}{"H": "Chat", "M": "Shout", "A": []interface{}{"x"}, "S": map[string]interface{}{"k": 1}}, "hub state"},
+		{"a streaming method", map[string]interface{}{"H": "Chat", "M": "Count", "A": []interface{}{3}}, "stream"},
+		{"a hub not connected to", map[string]interface{}{"H": "Other", "M": "Shout", "A": []interface{}{"x"}}, "not to hub"},
+		{"an unknown method", map[string]interface{}{"H": "Chat", "M": "Missing", "A": []interface{}{}}, "Missing"},
+	} {
+		tt.inv["I"] = strconv.Itoa(i)
+		if res := l.invoke(tt.inv); !strings.Contains(res.E, tt.want) {
+			t.Errorf("invoking %s failed with %q, want it to mention %q", tt.name, res.E, tt.want)
+		}
+	}
+}
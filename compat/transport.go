@@ -0,0 +1,152 @@
+package compat
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/simon-whitehead/relayr"
+)
+
+// maxQueued is how many calls a legacy client may have waiting before
+// further calls to it fail with relayr.ErrBufferFull.
+const maxQueued = 1024
+
+// transport delivers the calls the Exchange makes to legacy clients.
+type transport struct {
+	h      *Handler
+	lock   sync.Mutex
+	conns  map[string]*conn // by ConnectionID
+	tokens map[string]*conn // by connection token
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTransport(h *Handler) *transport {
+	return &transport{h: h, conns: make(map[string]*conn), tokens: make(map[string]*conn), closed: make(chan struct{})}
+}
+
+func (t *transport) add(c *conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.conns[c.id] = c
+	t.tokens[c.token] = c
+}
+
+func (t *transport) byToken(token string) *conn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tokens[token]
+}
+
+// remove forgets a legacy client, closing its gone channel, reporting
+// whether it was known.
+func (t *transport) remove(id string) bool {
+	t.lock.Lock()
+	c := t.conns[id]
+	if c != nil {
+		delete(t.conns, id)
+		delete(t.tokens, c.token)
+	}
+	t.lock.Unlock()
+	if c == nil {
+		return false
+	}
+
+	c.lock.Lock()
+	if !c.released {
+		c.released = true
+		close(c.gone)
+	}
+	c.lock.Unlock()
+	return true
+}
+
+// AddConnection does nothing; the legacy connection is added once its
+// negotiation has been answered.
+func (t *transport) AddConnection(connectionID string) {}
+
+func (t *transport) CallClientFunction(relay *relayr.Relay, fn string, args ...interface{}) error {
+	t.lock.Lock()
+	c := t.conns[relay.ConnectionID]
+	t.lock.Unlock()
+	if c == nil {
+		return relayr.ErrConnectionNotFound
+	}
+	hub := c.hubs[relay.Name]
+	if hub == "" {
+		hub = relay.Name
+	}
+	if args == nil {
+		args = []interface{}{}
+	}
+	b, err := json.Marshal(clientMessage{Hub: hub, Method: fn, Args: args})
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if len(c.queue) >= maxQueued {
+		c.lock.Unlock()
+		return relayr.ErrBufferFull
+	}
+	c.seq++
+	c.queue = append(c.queue, queued{seq: c.seq, data: b})
+	c.lock.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RemoveConnection tells the legacy client it is disconnected, over its
+// websocket or in answer to its long poll, and forgets it.
+func (t *transport) RemoveConnection(connectionID, reason string) {
+	t.remove(connectionID)
+}
+
+// Close forgets every legacy client and stops reaping them.
+func (t *transport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	t.lock.Lock()
+	ids := make([]string, 0, len(t.conns))
+	for id := range t.conns {
+		ids = append(ids, id)
+	}
+	t.lock.Unlock()
+
+	for _, id := range ids {
+		t.remove(id)
+	}
+	return nil
+}
+
+// reap disconnects, from the Exchange, the legacy clients that have gone
+// longer than the DisconnectTimeout without a websocket or a long poll,
+// until the transport is closed.
+func (t *transport) reap() {
+	timeout := t.h.opts.DisconnectTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case now := <-ticker.C:
+			t.lock.Lock()
+			var idle []string
+			for id, c := range t.conns {
+				if c.idle(now, timeout) {
+					idle = append(idle, id)
+				}
+			}
+			t.lock.Unlock()
+			for _, id := range idle {
+				if t.h.e.Disconnect(id, relayr.ReasonClosed) != nil {
+					t.remove(id) // the Exchange no longer knows it
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package relayr
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var errNoHijack = errors.New("relayr: response cannot be hijacked")
+
+// offersDeflate reports whether a websocket upgrade request offers
+// permessage-deflate, which the upgrader accepts with EnableCompression.
+func offersDeflate(r *http.Request) bool {
+	for _, h := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(h, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countingResponse is the ResponseWriter a websocket is upgraded through
+// when it compresses, which counts the bytes written to the connection it
+// hijacks, so that how much compression saves can be told.
+type countingResponse struct {
+	http.ResponseWriter
+	written *atomic.Uint64
+}
+
+func (w *countingResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNoHijack
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, written: w.written}, brw, nil
+}
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written *atomic.Uint64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// compress readies the websocket to write a message of size bytes,
+// deflating it if the client negotiated permessage-deflate and it is at
+// least the CompressionThresholdBytes, unless plain is set. It reports
+// whether the message will be deflated, and the bytes written to the
+// socket so far, for deflated to count what it saved once it is written.
+func (c *connection) compress(size int, plain bool) (bool, uint64) {
+	if c.wire == nil {
+		return false, 0
+	}
+	deflate := !plain && size >= c.e.runtime().CompressionThresholdBytes
+	c.ws.EnableWriteCompression(deflate)
+	if !deflate {
+		return false, 0
+	}
+	return true, c.wire.Load()
+}
+
+// deflated counts a message of size bytes written deflated, given the
+// bytes written to the socket before it was. Pings written meanwhile are
+// counted with it.
+func (c *connection) deflated(size int, before uint64) {
+	c.e.counters.compressed.Add(uint64(size))
+	c.e.counters.deflated.Add(c.wire.Load() - before)
+}
@@ -0,0 +1,135 @@
+package relayr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// openDeflateWebSocket opens a websocket as openWebSocket does, but
+// offering permessage-deflate, and returns it with a count of the bytes
+// read off the wire for it.
+func openDeflateWebSocket(b *testing.B, srv *httptest.Server) (*websocket.Conn, *atomic.Uint64) {
+	b.Helper()
+	read := new(atomic.Uint64)
+	d := &websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingReads{Conn: conn, read: read}, nil
+		},
+	}
+	ws, _, err := d.Dial(wsURL(srv, negotiate(b, srv, "websocket")), nil)
+	if err != nil {
+		b.Fatalf("opening a websocket: %v", err)
+	}
+	b.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, _, err := ws.ReadMessage(); err != nil {
+		b.Fatalf("reading the handshake: %v", err)
+	}
+	return ws, read
+}
+
+// countingReads counts the bytes read from a connection.
+type countingReads struct {
+	net.Conn
+	read *atomic.Uint64
+}
+
+func (c *countingReads) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+// readTick reads the messages of ws until one carrying a tick arrives.
+func readTick(b *testing.B, ws *websocket.Conn) {
+	b.Helper()
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		_, m, err := ws.ReadMessage()
+		if err != nil {
+			b.Fatalf("reading: %v", err)
+		}
+		if bytes.Contains(m, []byte(`"tick"`)) {
+			return
+		}
+	}
+}
+
+// BenchmarkCompressedBroadcast broadcasts a roster of the kind chat rooms
+// send, repetitive JSON of 2KB or so, to a client offering
+// permessage-deflate, reporting the bytes each broadcast takes on the
+// wire with compression off and on.
+func BenchmarkCompressedBroadcast(b *testing.B) {
+	roster := make([]map[string]string, 30)
+	for i := range roster {
+		roster[i] = map[string]string{"user": fmt.Sprintf("user-%d", i), "status": "online", "room": "general"}
+	}
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			e, srv := serve(b, ExchangeOptions{EnableCompression: compress}, Ticker{})
+			ws, read := openDeflateWebSocket(b, srv)
+			ops := e.Clients(Ticker{})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := read.Load()
+			for i := 0; i < b.N; i++ {
+				if err := ops.All("tick", roster); err != nil {
+					b.Fatal(err)
+				}
+				readTick(b, ws)
+			}
+			b.ReportMetric(float64(read.Load()-start)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+// BenchmarkCompressionThreshold sends a typing notification, a frame far
+// smaller than CompressionThresholdBytes, to a client offering
+// permessage-deflate, with compression off, on for every message, and on
+// above the default threshold, reporting the bytes each takes on the wire.
+func BenchmarkCompressionThreshold(b *testing.B) {
+	typing := map[string]interface{}{"user": "alice", "room": "general", "typing": true}
+	for _, bb := range []struct {
+		name string
+		opts ExchangeOptions
+	}{
+		{"plain", ExchangeOptions{}},
+		{"deflate-all", ExchangeOptions{EnableCompression: true, CompressionThresholdBytes: -1}},
+		{"deflate-threshold", ExchangeOptions{EnableCompression: true}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			e, srv := serve(b, bb.opts, Ticker{})
+			ws, read := openDeflateWebSocket(b, srv)
+			ops := e.Clients(Ticker{})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := read.Load()
+			for i := 0; i < b.N; i++ {
+				if err := ops.All("tick", typing); err != nil {
+					b.Fatal(err)
+				}
+				readTick(b, ws)
+			}
+			b.ReportMetric(float64(read.Load()-start)/float64(b.N), "wire-B/op")
+		})
+	}
+}
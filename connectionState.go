@@ -0,0 +1,43 @@
+package relayr
+
+import "sync"
+
+// ConnectionState is a key/value store attached to a single client
+// connection. It is shared by every transport the connection uses and
+// is safe for concurrent use.
+type ConnectionState struct {
+	lock   sync.RWMutex
+	values map[string]interface{}
+}
+
+func newConnectionState() *ConnectionState {
+	return &ConnectionState{values: make(map[string]interface{})}
+}
+
+// Get returns the value stored under key, if any.
+func (s *ConnectionState) Get(key string) (interface{}, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set stores v under key.
+func (s *ConnectionState) Set(key string, v interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values[key] = v
+}
+
+// Delete removes the value stored under key.
+func (s *ConnectionState) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.values, key)
+}
+
+func (s *ConnectionState) clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values = make(map[string]interface{})
+}
@@ -0,0 +1,232 @@
+package relayr
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionInfo describes a client connected to the Exchange.
+type ConnectionInfo struct {
+	ConnectionID string
+	Transport    string            // the name of the transport the client is connected over
+	RemoteAddr   string            // the IP address the client negotiated or last opened its websocket from
+	ConnectedAt  time.Time         // when the client negotiated, or reconnected
+	LastActive   time.Time         // when the client last sent or was sent something
+	LastSeen     time.Time         // when the client was last heard from: sent something, answered a keep-alive ping or polled
+	Groups       []string          // the groups the client is in, other than Global, sorted
+	Tags         map[string]string // the client's tags, as set by TagConnection
+	Capabilities []string          // the optional features the client supports, the Capability constants, sorted
+
+	// The client's send queue, over the built-in transports.
+	QueuedFrames     int    // frames waiting to be sent
+	QueuedBytes      int    // their size
+	PeakQueuedFrames int    // the most frames that have been waiting at once
+	ExpiredFrames    uint64 // calls made with a TTL that expired before they were sent
+
+	// RoundTrip is how long the client took to answer its last keep-alive
+	// ping, over websockets; zero until it has answered one.
+	RoundTrip time.Duration
+
+	// LastPingSent and LastPongReceived are when the client was last sent
+	// a keep-alive ping and last answered one, over websockets; zero until
+	// then. A client whose pong is overdue by the KeepAliveTimeout is
+	// disconnected with ReasonPongTimeout.
+	LastPingSent     time.Time
+	LastPongReceived time.Time
+
+	// Bandwidth is the bytes per second the client is throttled to, by
+	// ThrottleConnection, TagBandwidthLimits or the BandwidthLimit; 0 if
+	// it is not. Throughput is how many bytes of frames it was sent in the
+	// last whole second, over the built-in transports.
+	Bandwidth  int
+	Throughput uint64
+
+	// RecentErrors are the latest errors met serving the client, up to
+	// the ConnectionErrorHistory, oldest first: those passed to the
+	// OnError handlers, calls refused by a RateLimit, frames too large to
+	// take and frames dropped because its send queue was full. They are
+	// forgotten once it disconnects.
+	RecentErrors []ConnectionError
+}
+
+// connectionRegistry records what ConnectionInfo reports about each
+// connected client. It has its own lock, so that looking connections up
+// never holds up the mapLock or the groups' locks that broadcasts take. It
+// is updated as clients join and leave groups, with the registry's lock
+// always acquired after those.
+type connectionRegistry struct {
+	lock    sync.RWMutex
+	records map[string]*connectionRecord
+}
+
+type connectionRecord struct {
+	client    *client
+	transport string
+	addr      string
+	connected time.Time
+	groups    map[string]struct{}
+	errors    atomic.Pointer[errorRing] // set with the client's first error
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{records: make(map[string]*connectionRecord)}
+}
+
+// add records a client that connected over the named transport.
+func (r *connectionRegistry) add(c *client, transport string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records[c.ConnectionID] = &connectionRecord{
+		client:    c,
+		transport: transport,
+		addr:      c.addr,
+		connected: time.Now(),
+		groups:    make(map[string]struct{}),
+	}
+}
+
+// remove forgets a client that disconnected.
+func (r *connectionRegistry) remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.records, id)
+}
+
+// joined records that a client joined a group.
+func (r *connectionRegistry) joined(id, group string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rec := r.records[id]; rec != nil {
+		rec.groups[group] = struct{}{}
+	}
+}
+
+// left records that a client left a group.
+func (r *connectionRegistry) left(id, group string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rec := r.records[id]; rec != nil {
+		delete(rec.groups, group)
+	}
+}
+
+// setAddr records the IP address a client connected from.
+func (r *connectionRegistry) setAddr(id, addr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rec := r.records[id]; rec != nil {
+		rec.addr = addr
+	}
+}
+
+// setTransport records the transport a client connects over after it
+// upgrades from long-polling.
+func (r *connectionRegistry) setTransport(id, transport string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rec := r.records[id]; rec != nil {
+		rec.transport = transport
+	}
+}
+
+// info describes a record. The caller must hold r.lock.
+func (rec *connectionRecord) info() ConnectionInfo {
+	groups := make([]string, 0, len(rec.groups))
+	for g := range rec.groups {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	info := ConnectionInfo{
+		ConnectionID: rec.client.ConnectionID,
+		Transport:    rec.transport,
+		RemoteAddr:   rec.addr,
+		ConnectedAt:  rec.connected,
+		LastActive:   time.Unix(0, rec.client.lastActive.Load()),
+		LastSeen:     time.Unix(0, rec.client.lastSeen.Load()),
+		Groups:       groups,
+		Capabilities: rec.client.caps.names(),
+	}
+	if r := rec.errors.Load(); r != nil {
+		info.RecentErrors = r.list()
+	}
+	return info
+}
+
+// connections describes every connected client, in no particular order.
+func (e *Exchange) connections() []ConnectionInfo {
+	e.conns.lock.RLock()
+	r := make([]ConnectionInfo, 0, len(e.conns.records))
+	for _, rec := range e.conns.records {
+		r = append(r, rec.info())
+	}
+	e.conns.lock.RUnlock()
+
+	for i := range r {
+		e.addTags(&r[i])
+		e.addQueueStats(&r[i])
+		e.addBandwidth(&r[i])
+	}
+	return r
+}
+
+// addTags fills in the tags of a connection.
+func (e *Exchange) addTags(info *ConnectionInfo) {
+	e.mapLock.RLock()
+	info.Tags = copyTags(e.tags[info.ConnectionID])
+	e.mapLock.RUnlock()
+}
+
+// addQueueStats fills in the send queue of a connection from its
+// transport. It is called without the registry's lock held.
+func (e *Exchange) addQueueStats(info *ConnectionInfo) {
+	t, ok := e.transports[info.Transport].(queueReporter)
+	if !ok {
+		return
+	}
+	if q, ok := t.queueStats(info.ConnectionID); ok {
+		info.QueuedFrames = q.frames
+		info.QueuedBytes = q.bytes
+		info.PeakQueuedFrames = q.peak
+		info.ExpiredFrames = q.expired
+		info.RoundTrip = q.rtt
+		if q.lastPing > 0 {
+			info.LastPingSent = time.Unix(0, q.lastPing)
+		}
+		if q.lastPong > 0 {
+			info.LastPongReceived = time.Unix(0, q.lastPong)
+		}
+	}
+}
+
+// ConnectionInfo describes the connected client with the given
+// ConnectionID. It returns false if there is no such client, including
+// while a client that dropped is waiting to reconnect.
+func (e *Exchange) ConnectionInfo(connectionID string) (ConnectionInfo, bool) {
+	e.conns.lock.RLock()
+	rec := e.conns.records[connectionID]
+	var info ConnectionInfo
+	if rec != nil {
+		info = rec.info()
+	}
+	e.conns.lock.RUnlock()
+
+	if rec == nil {
+		return ConnectionInfo{}, false
+	}
+	e.addTags(&info)
+	e.addQueueStats(&info)
+	e.addBandwidth(&info)
+	return info, true
+}
+
+// Connections describes every connected client, ordered by ConnectionID.
+func (e *Exchange) Connections() []ConnectionInfo {
+	r := e.connections()
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].ConnectionID < r[j].ConnectionID
+	})
+	return r
+}
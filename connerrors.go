@@ -0,0 +1,80 @@
+package relayr
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionError is an error met serving a client, among the latest
+// listed in its ConnectionInfo's RecentErrors.
+type ConnectionError struct {
+	At       time.Time
+	Category ErrorCategory
+	Relay    string // the relay concerned, if any
+	Method   string // the method concerned, if any
+	Message  string // the error's message, or what RedactError made of it
+}
+
+// errorRing keeps a client's latest errors, overwriting the oldest once
+// it is full. Its entries are allocated in full as it is made, with the
+// client's first error.
+type errorRing struct {
+	lock    sync.Mutex
+	entries []ConnectionError
+	next    int  // where the next error is kept
+	full    bool // every entry holds an error
+}
+
+func (r *errorRing) add(err ConnectionError) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries[r.next] = err
+	r.next++
+	if r.next == len(r.entries) {
+		r.next, r.full = 0, true
+	}
+}
+
+// list returns the errors, oldest first.
+func (r *errorRing) list() []ConnectionError {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]ConnectionError(nil), r.entries[:r.next]...)
+	}
+	l := make([]ConnectionError, 0, len(r.entries))
+	l = append(l, r.entries[r.next:]...)
+	return append(l, r.entries[:r.next]...)
+}
+
+// recordConnectionError keeps err, met serving the client with the given
+// ConnectionID, among its RecentErrors, unless the ConnectionErrorHistory
+// is negative or the client is not connected. Like reportError, it may be
+// called with any of the Exchange's locks held but the registry's.
+func (e *Exchange) recordConnectionError(category ErrorCategory, cid, relay, method string, err error) {
+	n := e.options.ConnectionErrorHistory
+	if n <= 0 || cid == "" || err == nil {
+		return
+	}
+	e.conns.lock.RLock()
+	rec := e.conns.records[cid]
+	e.conns.lock.RUnlock()
+	if rec == nil {
+		return
+	}
+
+	r := rec.errors.Load()
+	if r == nil {
+		r = &errorRing{entries: make([]ConnectionError, n)}
+		if !rec.errors.CompareAndSwap(nil, r) {
+			r = rec.errors.Load()
+		}
+	}
+	var msg string
+	if redact := e.options.RedactError; redact != nil {
+		msg = redact(err)
+	} else {
+		msg = err.Error()
+	}
+	r.add(ConnectionError{At: time.Now(), Category: category, Relay: relay, Method: method, Message: msg})
+}
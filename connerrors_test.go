@@ -0,0 +1,123 @@
+package relayr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postFrame posts body as a call from the long-polling client cid,
+// returning the status it was answered with.
+func postFrame(t *testing.T, srv *httptest.Server, cid, body string) int {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/relayr/call?connectionId="+cid, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// recentErrors returns the RecentErrors of the client cid.
+func recentErrors(t *testing.T, e *Exchange, cid string) []ConnectionError {
+	t.Helper()
+	info, ok := e.ConnectionInfo(cid)
+	if !ok {
+		t.Fatalf("no ConnectionInfo for %s", cid)
+	}
+	return info.RecentErrors
+}
+
+func TestRecentErrors(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{
+		CallRateLimit:        RateLimit{Rate: 0.001, Burst: 1},
+		MaxMessageSize:       1024,
+		LongPollQueueSize:    2,
+		ReconnectGracePeriod: -1,
+		RedactError: func(err error) string {
+			return strings.ReplaceAll(err.Error(), "secret", "[redacted]")
+		},
+	}, Calculator{}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	if errs := recentErrors(t, e, cid); len(errs) != 0 {
+		t.Fatalf("a new client has the RecentErrors %+v", errs)
+	}
+
+	start := time.Now()
+	postFrame(t, srv, cid, `{"T":"secret"}`)
+	callOverHTTP(t, srv, cid, "Calculator", "Add", 1, 2)
+	if status := callOverHTTP(t, srv, cid, "Calculator", "Add", 1, 2); status != http.StatusTooManyRequests {
+		t.Fatalf("a call past the rate limit was answered %d", status)
+	}
+	if status := postFrame(t, srv, cid, `{"T":"s","R":"`+strings.Repeat("x", 2048)+`"}`); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("an oversized call was answered %d", status)
+	}
+	for i := 0; i < 3; i++ {
+		// the client never polls, so its queue fills up
+		e.Clients(Ticker{}).Client(cid).Call("tick", i)
+	}
+
+	errs := recentErrors(t, e, cid)
+	want := []struct {
+		category      ErrorCategory
+		relay, method string
+		message       string
+	}{
+		{DecodeError, "", "", `protocol: unknown frame type "[redacted]"`},
+		{DispatchError, "Calculator", "Add", ErrRateLimited.Error()},
+		{DecodeError, "", "", errMessageTooLarge.Error()},
+		{TransportError, "", "", ErrBufferFull.Error()},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("RecentErrors are %+v, want %d", errs, len(want))
+	}
+	for i, w := range want {
+		got := errs[i]
+		if got.Category != w.category || got.Relay != w.relay || got.Method != w.method || got.Message != w.message {
+			t.Errorf("error %d is %+v, want %+v", i, got, w)
+		}
+		if got.At.Before(start) || (i > 0 && got.At.Before(errs[i-1].At)) {
+			t.Errorf("error %d was met at %v, out of order", i, got.At)
+		}
+	}
+
+	// forgotten with the client
+	if err := e.Disconnect(cid, "done"); err != nil {
+		t.Fatal(err)
+	}
+	cid = negotiate(t, srv, "longpoll").ConnectionID
+	if errs := recentErrors(t, e, cid); len(errs) != 0 {
+		t.Fatalf("a client connecting afresh has the RecentErrors %+v", errs)
+	}
+}
+
+func TestRecentErrorsCapped(t *testing.T) {
+	for _, tt := range []struct {
+		history int
+		want    []string // the unknown frame types reported
+	}{
+		{3, []string{"x3", "x4", "x5"}},
+		{5, []string{"x1", "x2", "x3", "x4", "x5"}},
+		{8, []string{"x1", "x2", "x3", "x4", "x5"}},
+		{-1, nil},
+	} {
+		t.Run(strconv.Itoa(tt.history), func(t *testing.T) {
+			e, srv := serve(t, ExchangeOptions{ConnectionErrorHistory: tt.history})
+			cid := negotiate(t, srv, "longpoll").ConnectionID
+			for i := 1; i <= 5; i++ {
+				postFrame(t, srv, cid, `{"T":"x`+strconv.Itoa(i)+`"}`)
+			}
+
+			var got []string
+			for _, err := range recentErrors(t, e, cid) {
+				got = append(got, strings.TrimSuffix(strings.TrimPrefix(err.Message, `protocol: unknown frame type "`), `"`))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("kept %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
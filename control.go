@@ -0,0 +1,114 @@
+package relayr
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// ErrReservedControl is returned by SendControl and SendControlToGroup
+// for kinds starting "relayr.", which are kept for relayr's own control
+// frames.
+var ErrReservedControl = errors.New("relayr: control kinds starting \"relayr.\" are reserved")
+
+var (
+	errNoControlKind  = errors.New("relayr: control frame has no kind")
+	errControlVersion = errors.New("relayr: client speaks protocol version 0, which has no control frames")
+)
+
+// SendControl sends a control frame of the application's own to the
+// client with the given ConnectionID, such as one telling it to log out
+// or reload its configuration, which invokes no relay method. The client
+// script passes payload to the handlers added for kind with
+// RelayRConnection.onControl, and clients with none ignore it. The frame
+// is queued behind the calls already sent to the client, and passed to
+// the outbound interceptors with an empty RelayName, kind as its Method
+// and payload as its one argument.
+//
+// It returns ErrReservedControl for kinds starting "relayr.", and
+// ErrConnectionNotFound if there is no such client. Clients speaking
+// protocol version 0, and those connected over transports that cannot
+// send encoded frames, cannot be sent one.
+func (e *Exchange) SendControl(connectionID, kind string, payload interface{}) error {
+	if err := checkControlKind(kind); err != nil {
+		return err
+	}
+	c := e.getClientByConnectionID(connectionID)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+	return e.sendControl(c, "", kind, payload)
+}
+
+// SendControlToGroup sends a control frame, as SendControl does, to every
+// member of a group connected to this Exchange. The frame is not relayed
+// through the Backplane. It returns a *GroupCallError if the frame could
+// not be sent to some of the members.
+func (e *Exchange) SendControlToGroup(group, kind string, payload interface{}) error {
+	if err := checkControlKind(kind); err != nil {
+		return err
+	}
+	e.mapLock.RLock()
+	g := e.groups[group]
+	e.mapLock.RUnlock()
+	if g == nil {
+		return nil
+	}
+
+	result := &GroupCallError{Group: group}
+	for _, c := range g.clients() {
+		if err := e.sendControl(c, group, kind, payload); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[c.ConnectionID] = err
+			continue
+		}
+		result.Delivered++
+	}
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// checkControlKind returns an error for the kinds applications cannot
+// send.
+func checkControlKind(kind string) error {
+	if kind == "" {
+		return errNoControlKind
+	}
+	if strings.HasPrefix(kind, protocol.ReservedControlPrefix) {
+		return ErrReservedControl
+	}
+	return nil
+}
+
+// sendControl queues a control frame for a client, sent to the named
+// group, if any, once the outbound interceptors have passed it.
+func (e *Exchange) sendControl(c *client, group, kind string, payload interface{}) error {
+	if c.protocol < 1 {
+		return errControlVersion
+	}
+	s, ok := c.transport().(rawSender)
+	if !ok {
+		return errNoRawFrames
+	}
+
+	kind, args, ok := e.interceptOutgoing(&Relay{group: group}, c.ConnectionID, e.transportName(c.transport()), kind, []interface{}{payload})
+	if !ok {
+		return nil
+	}
+	payload = nil
+	if len(args) > 0 {
+		payload = args[0]
+	}
+	data, err := encodeFrame(c.codec, c.protocol, &appControl{Kind: kind, Payload: payload})
+	if err != nil {
+		return err
+	}
+	c.touch()
+	return urgentSend(s)(c.ConnectionID, data)
+}
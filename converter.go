@@ -0,0 +1,295 @@
+package relayr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// converter translates values of a type to and from the form they take in
+// frames.
+type converter struct {
+	toWire   func(v interface{}) interface{}
+	fromWire func(raw interface{}) (interface{}, error)
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	bytesType      = reflect.TypeOf([]byte(nil))
+	jsonNumberType = reflect.TypeOf(json.Number(""))
+
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+var (
+	convertersLock sync.RWMutex
+	converters     = map[reflect.Type]converter{
+		timeType:     {timeToWire, timeFromWire},
+		durationType: {durationToWire, durationFromWire},
+		bytesType:    {bytesToWire, bytesFromWire},
+	}
+)
+
+// RegisterConverter sets how arguments of type t are sent to and received
+// from clients, replacing any converter registered for t before. toWire
+// is given each argument of type t passed to a client method, and returns
+// the value encoded in its place. fromWire is given each argument a
+// client passes for a relay method parameter of type t, as the codec
+// decoded it, with numbers from JSON clients as json.Number, and returns a value of type t; the error it returns fails
+// the call. Either may be nil to leave that direction as it is.
+//
+// Converters apply to arguments themselves, not to the fields or items
+// of the values passed. time.Time is converted to and from RFC 3339
+// strings, time.Duration to and from milliseconds, and []byte to and from
+// base64 strings unless other converters are registered for them.
+// Converters are shared by every Exchange, and should be registered
+// before any serves requests.
+func RegisterConverter(t reflect.Type, toWire func(v interface{}) interface{}, fromWire func(raw interface{}) (interface{}, error)) {
+	convertersLock.Lock()
+	defer convertersLock.Unlock()
+	converters[t] = converter{toWire, fromWire}
+}
+
+func converterFor(t reflect.Type) (converter, bool) {
+	convertersLock.RLock()
+	defer convertersLock.RUnlock()
+	c, ok := converters[t]
+	return c, ok
+}
+
+// wireArgs returns the arguments of a call to a client method as they are
+// encoded, with those that have a converter replaced by its result. args
+// is returned as it is when none do.
+func wireArgs(args []interface{}) []interface{} {
+	var r []interface{}
+	for i, a := range args {
+		if a == nil {
+			continue
+		}
+		c, ok := converterFor(reflect.TypeOf(a))
+		if !ok || c.toWire == nil {
+			continue
+		}
+		if r == nil {
+			r = append([]interface{}(nil), args...)
+		}
+		r[i] = c.toWire(a)
+	}
+	if r == nil {
+		return args
+	}
+	return r
+}
+
+// convertArg converts an argument, as the codec decoded it, to the type t
+// of the relay method parameter it is passed for: with t's converter if
+// it has one, exactly if it is a json.Number and t a number or a string,
+// as it is if it is assignable to t, or otherwise by encoding it and
+// decoding it again as a t with codec. The json.Numbers passed as they
+// are, on their own or within maps and slices, are made float64s unless
+// numbers is set. A nil argument gives an invalid value, for zeroNilArgs
+// to replace.
+func convertArg(codec Codec, t reflect.Type, a interface{}, numbers bool) (reflect.Value, error) {
+	if a == nil {
+		return reflect.Value{}, nil
+	}
+	v := reflect.ValueOf(a)
+	if v.Type() == t {
+		if !numbers && t != jsonNumberType {
+			v = reflect.ValueOf(floatNumbers(a))
+		}
+		return v, nil
+	}
+
+	if c, ok := converterFor(t); ok && c.fromWire != nil {
+		x, err := c.fromWire(a)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v = reflect.ValueOf(x)
+		switch {
+		case !v.IsValid():
+			return v, nil
+		case v.Type().AssignableTo(t):
+			return v, nil
+		case v.Type().ConvertibleTo(t):
+			return v.Convert(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("converter returned %v, not %v", v.Type(), t)
+	}
+
+	if n, ok := a.(json.Number); ok {
+		if v, ok, err := convertNumber(t, n); ok {
+			return v, err
+		}
+	}
+	if v.Type().AssignableTo(t) {
+		if !numbers && t != jsonNumberType {
+			v = reflect.ValueOf(floatNumbers(a))
+		}
+		return v, nil
+	}
+	data, err := codec.Marshal(a)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	p := reflect.New(t)
+	if err := codec.Unmarshal(data, p.Interface()); err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			return reflect.Value{}, fmt.Errorf("cannot use %s as %v", te.Value, t)
+		}
+		return reflect.Value{}, err
+	}
+	return p.Elem(), nil
+}
+
+// convertNumber converts a number decoded from JSON to t exactly, if t is
+// a number or a string, failing if it does not fit. ok is false for other
+// types.
+func convertNumber(t reflect.Type, n json.Number) (v reflect.Value, ok bool, err error) {
+	v = reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil {
+			// a whole number may be written as a float, e.g. 1e3
+			f, ferr := n.Float64()
+			if ferr != nil || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return v, true, fmt.Errorf("cannot use %s as %v", n, t)
+			}
+			i = int64(f)
+		}
+		if v.OverflowInt(i) {
+			return v, true, fmt.Errorf("cannot use %s as %v", n, t)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(string(n), 10, 64)
+		if err != nil {
+			f, ferr := n.Float64()
+			if ferr != nil || f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return v, true, fmt.Errorf("cannot use %s as %v", n, t)
+			}
+			u = uint64(f)
+		}
+		if v.OverflowUint(u) {
+			return v, true, fmt.Errorf("cannot use %s as %v", n, t)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(string(n), t.Bits())
+		if err != nil {
+			return v, true, fmt.Errorf("cannot use %s as %v", n, t)
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		v.SetString(string(n))
+	default:
+		return v, false, nil
+	}
+	return v, true, nil
+}
+
+// floatNumbers returns a value decoded from JSON with the json.Numbers in
+// it, on its own or within maps and slices, made float64s, as they would
+// have been decoded without json.Number. The maps and slices are copied.
+func floatNumbers(a interface{}) interface{} {
+	switch x := a.(type) {
+	case json.Number:
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		if x == nil {
+			return a
+		}
+		r := make([]interface{}, len(x))
+		for i, item := range x {
+			r[i] = floatNumbers(item)
+		}
+		return r
+	case map[string]interface{}:
+		if x == nil {
+			return a
+		}
+		r := make(map[string]interface{}, len(x))
+		for k, item := range x {
+			r[k] = floatNumbers(item)
+		}
+		return r
+	}
+	return a
+}
+
+// paramType returns the type of the i'th parameter of a method's type t,
+// or of the items of its last one when that is variadic.
+func paramType(t reflect.Type, i int) reflect.Type {
+	if t.IsVariadic() && i >= t.NumIn()-1 {
+		return t.In(t.NumIn() - 1).Elem()
+	}
+	return t.In(i)
+}
+
+func timeToWire(v interface{}) interface{} {
+	return v.(time.Time).Format(time.RFC3339Nano)
+}
+
+func timeFromWire(raw interface{}) (interface{}, error) {
+	s, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot use %T as a time", raw)
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use %q as a time", s)
+	}
+	return t, nil
+}
+
+func durationToWire(v interface{}) interface{} {
+	return float64(v.(time.Duration)) / float64(time.Millisecond)
+}
+
+func durationFromWire(raw interface{}) (interface{}, error) {
+	if n, ok := raw.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return time.Duration(i) * time.Millisecond, nil
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("cannot use %s as a duration in milliseconds", n)
+		}
+		return time.Duration(f * float64(time.Millisecond)), nil
+	}
+	v := reflect.ValueOf(raw)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return time.Duration(v.Float() * float64(time.Millisecond)), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return time.Duration(v.Int()) * time.Millisecond, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return time.Duration(v.Uint()) * time.Millisecond, nil
+	}
+	return nil, fmt.Errorf("cannot use %T as a duration in milliseconds", raw)
+}
+
+func bytesToWire(v interface{}) interface{} {
+	return base64.StdEncoding.EncodeToString(v.([]byte))
+}
+
+func bytesFromWire(raw interface{}) (interface{}, error) {
+	s, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot use %T as base64", raw)
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use %q as base64", s)
+	}
+	return b, nil
+}
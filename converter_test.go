@@ -0,0 +1,102 @@
+package relayr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// snowflake is an ID beyond 2^53, which a float64 cannot hold exactly.
+const snowflake int64 = 1<<62 + 1
+
+// IDs is a relay taking IDs as numbers.
+type IDs struct{}
+
+func (IDs) Share(r *Relay, id int64) int64 {
+	r.Clients.All("shared", id)
+	return id
+}
+
+func (IDs) Describe(r *Relay, v interface{}) string {
+	return fmt.Sprintf("%T %v", v, v)
+}
+
+func (IDs) Nested(r *Relay, v map[string]interface{}) string {
+	return fmt.Sprintf("%T", v["id"])
+}
+
+func (IDs) Small(r *Relay, n int8) int8 { return n }
+
+func (IDs) Unsigned(r *Relay, n uint64) uint64 { return n }
+
+func (IDs) Text(r *Relay, s string) string { return s }
+
+func TestSnowflakeRoundTrip(t *testing.T) {
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			_, srv := serve(t, ExchangeOptions{}, IDs{})
+			sender, other := dial(t, srv, transport), dial(t, srv, transport)
+			shared := calls(other, "IDs", "shared")
+
+			res, err := sender.Call(context.Background(), "IDs", "Share", snowflake)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprint(snowflake)
+			if string(res) != want {
+				t.Errorf("Share returned %s, want %s", res, want)
+			}
+			if args := receive(t, shared); string(args[0]) != want {
+				t.Errorf("the broadcast carried %s, want %s", args[0], want)
+			}
+		})
+	}
+}
+
+func TestNumberConversion(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{}, IDs{})
+	c := dial(t, srv, "websocket")
+	call := func(method string, arg interface{}) (json.RawMessage, error) {
+		return c.Call(context.Background(), "IDs", method, arg)
+	}
+
+	if res, err := call("Small", 127); err != nil || string(res) != "127" {
+		t.Errorf("Small(127) returned %s, %v", res, err)
+	}
+	for _, n := range []interface{}{128, -129, 1.5} {
+		if res, err := call("Small", n); err == nil {
+			t.Errorf("Small(%v) returned %s, want an error rather than a truncated value", n, res)
+		}
+	}
+	if _, err := call("Unsigned", -1); err == nil {
+		t.Error("a negative number was passed as a uint64")
+	}
+	if res, err := call("Unsigned", json.RawMessage("18446744073709551615")); err != nil || string(res) != "18446744073709551615" {
+		t.Errorf("Unsigned(max) returned %s, %v", res, err)
+	}
+	if res, err := call("Text", snowflake); err != nil || string(res) != fmt.Sprintf(`"%d"`, snowflake) {
+		t.Errorf("Text returned %s, %v, want the number exactly", res, err)
+	}
+	if res, err := call("Describe", snowflake); err != nil || !strings.HasPrefix(string(res), `"float64`) {
+		t.Errorf("Describe returned %s, %v, want a float64 without UseJSONNumber", res, err)
+	}
+}
+
+func TestUseJSONNumber(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{UseJSONNumber: true}, IDs{})
+	c := dial(t, srv, "longpoll")
+
+	want := fmt.Sprintf(`"json.Number %d"`, snowflake)
+	if res, err := c.Call(context.Background(), "IDs", "Describe", snowflake); err != nil || string(res) != want {
+		t.Errorf("Describe returned %s, %v, want %s", res, err, want)
+	}
+	if res, err := c.Call(context.Background(), "IDs", "Nested", map[string]int64{"id": snowflake}); err != nil || string(res) != `"json.Number"` {
+		t.Errorf("Nested returned %s, %v, want a json.Number within the map", res, err)
+	}
+	// typed parameters are unaffected
+	if res, err := c.Call(context.Background(), "IDs", "Share", snowflake); err != nil || string(res) != fmt.Sprint(snowflake) {
+		t.Errorf("Share returned %s, %v", res, err)
+	}
+}
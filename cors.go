@@ -0,0 +1,93 @@
+package relayr
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// corsMaxAge is how long, in seconds, browsers may cache the answer to a
+// preflight request.
+const corsMaxAge = 600
+
+// corsAllowedMethods are the methods the client script uses to negotiate,
+// poll and call.
+const corsAllowedMethods = "GET, POST, OPTIONS"
+
+// corsEnabled reports whether cross-origin requests may be allowed.
+func (o ExchangeOptions) corsEnabled() bool {
+	return len(o.AllowedOrigins) > 0 || o.AllowOrigin != nil
+}
+
+// sameOrigin reports whether r came from a page on the host it was sent
+// to, or from something other than a browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// originAllowed reports whether a page from origin may use the Exchange.
+func (e *Exchange) originAllowed(origin string) bool {
+	for _, allowed := range e.options.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return e.options.AllowOrigin != nil && e.options.AllowOrigin(origin)
+}
+
+// checkOrigin is the websocket origin check used when CheckOrigin is nil
+// and cross-origin requests are configured: it accepts the same origins
+// the long-poll operations do.
+func (e *Exchange) checkOrigin(r *http.Request) bool {
+	return sameOrigin(r) || e.originAllowed(r.Header.Get("Origin"))
+}
+
+// allowCrossOrigin checks the origin of a request to negotiate, poll, call
+// or fetch the manifest, setting the CORS headers of the answer to a cross-origin request
+// from an allowed origin. It reports false when it has answered r itself:
+// with 204 to a preflight request, or with 403 to a request from an origin
+// that is not allowed. Without AllowedOrigins or AllowOrigin, requests
+// are not checked.
+func (e *Exchange) allowCrossOrigin(w http.ResponseWriter, r *http.Request) bool {
+	preflight := r.Method == http.MethodOptions
+	if !e.options.corsEnabled() || sameOrigin(r) {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return false
+		}
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if !e.originAllowed(origin) {
+		httpError(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if e.options.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return true
+	}
+
+	h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
@@ -0,0 +1,113 @@
+package relayr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	appOrigin   = "https://app.example.com"
+	otherOrigin = "https://other.example.com"
+	evilOrigin  = "https://evil.example.com"
+)
+
+// request makes a request of e for op from a page of origin.
+func request(e *Exchange, method, op, origin string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/relayr/"+op, strings.NewReader(body))
+	req.Header.Set("Origin", origin)
+	if method == http.MethodOptions {
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{AllowedOrigins: []string{appOrigin}, AllowCredentials: true})
+
+	for _, op := range []string{"negotiate", "longpoll", "call"} {
+		w := request(e, http.MethodOptions, op, appOrigin, "")
+		h := w.Header()
+		if w.Code != http.StatusNoContent {
+			t.Errorf("a preflight for %s was answered with %d", op, w.Code)
+		}
+		if h.Get("Access-Control-Allow-Origin") != appOrigin || h.Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("a preflight for %s was answered with origin %q and credentials %q", op, h.Get("Access-Control-Allow-Origin"), h.Get("Access-Control-Allow-Credentials"))
+		}
+		if !strings.Contains(h.Get("Access-Control-Allow-Methods"), "POST") || h.Get("Access-Control-Allow-Headers") != "Content-Type" || h.Get("Access-Control-Max-Age") == "" {
+			t.Errorf("a preflight for %s was answered with %v", op, h)
+		}
+
+		if w := request(e, http.MethodOptions, op, evilOrigin, ""); w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("a preflight for %s from an origin not allowed was answered with %d and %v", op, w.Code, w.Header())
+		}
+	}
+}
+
+func TestCORSRequests(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{
+		AllowedOrigins: []string{appOrigin},
+		AllowOrigin:    func(origin string) bool { return origin == otherOrigin },
+	})
+
+	for _, origin := range []string{appOrigin, otherOrigin} {
+		w := request(e, http.MethodPost, "negotiate", origin, `{"t":"longpoll"}`)
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != origin {
+			t.Errorf("negotiating from %s was answered with %d and %v", origin, w.Code, w.Header())
+		}
+		if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("credentials were allowed from %s without AllowCredentials", origin)
+		}
+		if !strings.Contains(w.Header().Get("Vary"), "Origin") {
+			t.Errorf("the answer to %s does not vary by Origin", origin)
+		}
+	}
+
+	w := request(e, http.MethodPost, "negotiate", evilOrigin, `{"t":"longpoll"}`)
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("negotiating from an origin not allowed was answered with %d and %v", w.Code, w.Header())
+	}
+	w = request(e, http.MethodGet, "longpoll?connectionId=x", evilOrigin, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("polling from an origin not allowed was answered with %d", w.Code)
+	}
+
+	// the same origin needs no CORS
+	w = request(e, http.MethodPost, "negotiate", "http://example.com", `{"t":"longpoll"}`)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("negotiating from the same origin was answered with %d and %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	w := request(e, http.MethodPost, "negotiate", appOrigin, `{"t":"longpoll"}`)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("CORS headers were sent without AllowedOrigins: %v", w.Header())
+	}
+}
+
+func TestCORSWebSocketOrigins(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{AllowedOrigins: []string{appOrigin}})
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv, negotiate(t, srv, "websocket")), http.Header{"Origin": {appOrigin}})
+	if err != nil {
+		t.Fatalf("an upgrade from an allowed origin failed: %v", err)
+	}
+	ws.Close()
+
+	ws, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, negotiate(t, srv, "websocket")), http.Header{"Origin": {evilOrigin}})
+	if err == nil {
+		ws.Close()
+		t.Fatal("an upgrade from an origin not allowed was accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("an upgrade from an origin not allowed was answered with %v, want 403", resp)
+	}
+}
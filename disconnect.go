@@ -0,0 +1,135 @@
+package relayr
+
+import (
+	"reflect"
+	"time"
+)
+
+// closeDisconnected is the websocket close code sent to clients that are
+// disconnected by the server, telling them not to reconnect.
+const closeDisconnected = 4000
+
+// closeUnknownConnection is the websocket close code sent to clients that
+// open a websocket without having negotiated it, telling them to
+// negotiate afresh.
+const closeUnknownConnection = 4001
+
+// closeDuplicateConnection is the websocket close code sent to clients
+// that open a websocket for a connection that already has one, telling
+// them to negotiate a connection of their own.
+const closeDuplicateConnection = 4002
+
+// closeInvalidToken is the websocket close code sent to clients that open
+// a websocket with a connection token that is tampered with or expired,
+// telling them to negotiate afresh.
+const closeInvalidToken = 4003
+
+// closeNotResponding is the websocket close code sent to clients whose
+// websocket is closed because they stopped answering keep-alive pings or
+// could not be written to. They reconnect as they would if it dropped.
+const closeNotResponding = 4004
+
+// Reasons reported to the OnDisconnectWithReason hook, besides those
+// passed to Disconnect.
+const (
+	ReasonClosed         = "closed"              // the connection went away and the client did not reconnect
+	ReasonNeverConnected = "never connected"     // the client negotiated but did not connect within the ConnectTimeout
+	ReasonIdle           = "idle"                // the client was evicted after the IdleTimeout
+	ReasonBanned         = "banned"              // the client was disconnected by Ban
+	ReasonRateLimited    = "rate limit exceeded" // the client went over the RateLimitDisconnectThreshold
+	ReasonPongTimeout    = "pong timeout"        // the client's websocket stopped answering keep-alive pings and did not reconnect
+	ReasonWriteError     = "write error"         // the client's websocket could not be written to and it did not reconnect
+	ReasonStale          = "stale"               // the client was reaped by ReapStale or after the StaleConnectionTimeout
+	ReasonUnsubscribed   = "unsubscribed"        // the webhook was removed by UnsubscribeWebhook
+	ReasonShutdown       = "shutdown"            // the client's long poll was answered by CancelWaiters or Close
+)
+
+// ban stops a principal from negotiating new connections until it
+// expires.
+type ban struct {
+	principal interface{}
+	until     time.Time
+}
+
+// Disconnect closes a client's connection and forgets it, without giving it
+// the chance to reconnect. The client is removed from all of its groups and
+// reported to the OnDisconnect hook, and its ondisconnected callback is
+// passed the reason. It returns ErrConnectionNotFound if there is no such
+// client.
+func (e *Exchange) Disconnect(connectionID, reason string) error {
+	if e.getClientByConnectionID(connectionID) != nil {
+		e.dropClient(connectionID, reason)
+		return nil
+	}
+
+	// a client waiting to reconnect has no connection to close
+	e.mapLock.RLock()
+	d, ok := e.detached[connectionID]
+	e.mapLock.RUnlock()
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	d.expiry.Stop()
+	e.expireClient(connectionID, d, reason)
+
+	return nil
+}
+
+// Ban disconnects a client and, when an Authorizer is in use, refuses to
+// negotiate new connections for the principal it was authorized as until
+// d has passed. Without an Authorizer clients cannot be told apart, so Ban
+// only disconnects the client.
+func (e *Exchange) Ban(connectionID string, d time.Duration) {
+	var principal interface{}
+	e.mapLock.Lock()
+	if c := e.getClientByConnectionIDLocked(connectionID); c != nil {
+		principal = c.principal
+	} else if dc, ok := e.detached[connectionID]; ok {
+		principal = dc.client.principal
+	}
+	if principal != nil {
+		e.bans = append(e.bans, ban{principal: principal, until: time.Now().Add(d)})
+	}
+	e.mapLock.Unlock()
+
+	e.Disconnect(connectionID, ReasonBanned)
+}
+
+// notifyDisconnect reports a client that has been forgotten to the
+// OnDisconnect hooks.
+func (e *Exchange) notifyDisconnect(id, reason string) {
+	e.disconnectHubs(id, reason)
+	if e.options.OnDisconnect != nil {
+		e.options.OnDisconnect(id)
+	}
+	if e.options.OnDisconnectWithReason != nil {
+		e.options.OnDisconnectWithReason(id, reason)
+	}
+}
+
+// isBanned reports whether a principal is banned, forgetting bans that
+// have expired.
+func (e *Exchange) isBanned(principal interface{}) bool {
+	if principal == nil {
+		return false
+	}
+
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	now := time.Now()
+	banned := false
+	live := e.bans[:0]
+	for _, b := range e.bans {
+		if now.After(b.until) {
+			continue
+		}
+		live = append(live, b)
+		if reflect.DeepEqual(b.principal, principal) {
+			banned = true
+		}
+	}
+	e.bans = live
+
+	return banned
+}
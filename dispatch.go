@@ -0,0 +1,270 @@
+package relayr
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrServerBusy is returned for a call from a client refused because
+// MaxQueuedCalls calls were already waiting to run.
+var ErrServerBusy = errors.New("relayr: server busy")
+
+var errExchangeClosed = errors.New("relayr: exchange closed")
+
+// dispatcher runs the calls clients make to relay methods so that each
+// connection's calls run one at a time, in the order they arrived, while
+// different connections' calls run concurrently. Calls are run by a pool
+// of at most max goroutines, started as calls arrive and stopped once
+// there are none left to run, so idle connections cost nothing. A worker
+// runs a single call for a connection before taking the next connection
+// that has calls waiting, so a busy connection does not hold on to one.
+// At most maxWaiting calls wait across every connection, when it is set.
+// A call to a method under a Limit that is full is parked on the limit,
+// its connection's later calls waiting behind it, and the worker moves
+// on; the worker that runs the last call to free a place runs it next.
+// Once closed it refuses calls and discards those waiting, and wg lets the
+// Exchange wait for the ones running.
+type dispatcher struct {
+	lock       sync.Mutex
+	queues     map[string]*callQueue // by ConnectionID, while the connection has calls waiting or running
+	ready      []*callQueue          // connections with calls waiting and none running, in turn
+	workers    int
+	max        int
+	waiting    int // calls waiting to run
+	maxWaiting int
+	running    int                   // calls running on goroutines of their own, with ConcurrentCalls
+	limits     map[string]*callLimit // by relay name, or methodRuleKey
+	closed     bool
+	wg         sync.WaitGroup // the workers and the calls running on goroutines of their own
+}
+
+type callQueue struct {
+	cid   string
+	calls []queuedCall
+}
+
+// queuedCall is a call made by a client, waiting to run.
+type queuedCall struct {
+	run   func()
+	limit *callLimit // the limit of the method called, if any
+	at    time.Time  // when it was made
+}
+
+func newDispatcher(max, maxWaiting int) *dispatcher {
+	return &dispatcher{queues: make(map[string]*callQueue), max: max, maxWaiting: maxWaiting}
+}
+
+// dispatch queues a call from the client with the given ConnectionID,
+// under limit if it is not nil, starting a worker to run it if the pool
+// is not full. It returns ErrServerBusy if as many calls as allowed are
+// waiting already.
+func (d *dispatcher) dispatch(cid string, limit *callLimit, run func()) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return errExchangeClosed
+	}
+	if d.maxWaiting > 0 && d.waiting >= d.maxWaiting {
+		return ErrServerBusy
+	}
+	if !limit.admitLocked() {
+		return ErrServerBusy
+	}
+	d.waiting++
+	call := queuedCall{run: run, limit: limit, at: time.Now()}
+	if q := d.queues[cid]; q != nil {
+		// already waiting its turn, or running or parking a call and
+		// put back in turn when that is over
+		q.calls = append(q.calls, call)
+		return nil
+	}
+	q := &callQueue{cid: cid, calls: []queuedCall{call}}
+	d.queues[cid] = q
+	d.ready = append(d.ready, q)
+	if d.workers < d.max {
+		d.workers++
+		d.wg.Add(1)
+		go d.work()
+	}
+	return nil
+}
+
+// start runs a call on a goroutine of its own, under limit if it is not
+// nil, once the limit has room for it, returning ErrServerBusy if as
+// many calls as allowed are running or waiting already.
+func (d *dispatcher) start(limit *callLimit, run func()) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return errExchangeClosed
+	}
+	if d.maxWaiting > 0 && d.running >= d.maxWaiting {
+		return ErrServerBusy
+	}
+	if !limit.admitLocked() {
+		return ErrServerBusy
+	}
+	d.running++
+	d.wg.Add(1)
+	call := queuedCall{run: func() {
+		defer d.done()
+		run()
+	}, limit: limit, at: time.Now()}
+	if !limit.acquireLocked() {
+		limit.parked = append(limit.parked, parkedCall{call: call})
+		return nil
+	}
+	go d.run(nil, call)
+	return nil
+}
+
+// done ends a call run by start.
+func (d *dispatcher) done() {
+	d.lock.Lock()
+	d.running--
+	d.lock.Unlock()
+	d.wg.Done()
+}
+
+// close refuses the calls made from now on and discards those waiting.
+// The calls already running are left to finish; wg waits for them.
+func (d *dispatcher) close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.closed = true
+	for _, q := range d.queues {
+		d.waiting -= len(q.calls)
+		q.calls = nil
+	}
+	for _, l := range d.limits {
+		for _, p := range l.parked {
+			l.pending--
+			switch {
+			case p.wake != nil:
+				close(p.wake)
+			case p.q == nil:
+				d.running--
+				d.wg.Done()
+			}
+		}
+		l.parked = nil
+	}
+}
+
+// forget discards the calls waiting for a client that has gone, parked
+// ones included. A call already running is left to finish.
+func (d *dispatcher) forget(cid string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	q := d.queues[cid]
+	if q == nil {
+		return
+	}
+	d.waiting -= len(q.calls)
+	for _, c := range q.calls {
+		if c.limit != nil {
+			c.limit.pending--
+		}
+	}
+	q.calls = nil
+	for _, l := range d.limits {
+		for i := 0; i < len(l.parked); i++ {
+			if l.parked[i].q == q {
+				l.parked = append(l.parked[:i], l.parked[i+1:]...)
+				l.pending--
+				delete(d.queues, cid)
+				i--
+			}
+		}
+	}
+}
+
+func (d *dispatcher) work() {
+	for {
+		d.lock.Lock()
+		if len(d.ready) == 0 {
+			d.workers--
+			d.lock.Unlock()
+			d.wg.Done()
+			return
+		}
+		q := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+		if len(q.calls) == 0 {
+			// forgotten while waiting
+			delete(d.queues, q.cid)
+			d.lock.Unlock()
+			continue
+		}
+		call := q.calls[0]
+		q.calls[0] = queuedCall{}
+		q.calls = q.calls[1:]
+		d.waiting--
+		if !call.limit.acquireLocked() {
+			call.limit.parked = append(call.limit.parked, parkedCall{q: q, call: call})
+			d.lock.Unlock()
+			continue
+		}
+		d.lock.Unlock()
+
+		d.run(q, call)
+	}
+}
+
+// run runs a call made by the client whose queue is q, putting the queue
+// back in turn, and then the calls parked on the call's limit that it
+// frees a place for, in turn.
+func (d *dispatcher) run(q *callQueue, call queuedCall) {
+	for {
+		if call.limit != nil {
+			d.lock.Lock()
+			call.limit.waitedLocked(time.Since(call.at))
+			d.lock.Unlock()
+		}
+		call.run()
+
+		d.lock.Lock()
+		if q != nil {
+			if len(q.calls) > 0 {
+				d.ready = append(d.ready, q)
+			} else {
+				delete(d.queues, q.cid)
+			}
+		}
+		next, ok := call.limit.releaseLocked()
+		d.lock.Unlock()
+		if !ok {
+			return
+		}
+		if next.wake != nil {
+			close(next.wake)
+			return
+		}
+		q, call = next.q, next.call
+	}
+}
+
+// runCall runs a call from a client to a relay method: on a goroutine of
+// its own with ConcurrentCalls, or otherwise after the calls the client
+// made before it, and in either case once the method's Limit, if it has
+// one, has room for it. It returns ErrServerBusy, and counts the call, if
+// MaxQueuedCalls are waiting, or running with ConcurrentCalls, or the
+// Limit's MaxQueued are waiting, and refuses calls once the Exchange is
+// closed.
+func (e *Exchange) runCall(cid, relay, method string, call func()) error {
+	var err error
+	limit := e.dispatcher.limitFor(relay, method)
+	if e.options.ConcurrentCalls {
+		err = e.dispatcher.start(limit, call)
+	} else {
+		err = e.dispatcher.dispatch(cid, limit, call)
+	}
+	if err == ErrServerBusy {
+		e.counters.busy.Add(1)
+	}
+	return err
+}
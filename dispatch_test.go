@@ -0,0 +1,210 @@
+package relayr
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// Gate is a relay whose method Wait blocks until release is closed. It
+// counts the calls running at once, and records the numbers each
+// connection's calls were given in the order they ran.
+type Gate struct {
+	running, most *atomic.Int32
+	entered       chan struct{}
+	release       chan struct{}
+
+	lock *sync.Mutex
+	seen map[string][]int
+}
+
+func newGate() Gate {
+	return Gate{
+		running: new(atomic.Int32),
+		most:    new(atomic.Int32),
+		entered: make(chan struct{}, 64),
+		release: make(chan struct{}),
+		lock:    new(sync.Mutex),
+		seen:    make(map[string][]int),
+	}
+}
+
+func (g Gate) Wait(r *Relay, n int) {
+	running := g.running.Add(1)
+	for most := g.most.Load(); running > most && !g.most.CompareAndSwap(most, running); most = g.most.Load() {
+	}
+	g.lock.Lock()
+	g.seen[r.ConnectionID] = append(g.seen[r.ConnectionID], n)
+	g.lock.Unlock()
+	select {
+	case g.entered <- struct{}{}:
+	default:
+	}
+	<-g.release
+	g.running.Add(-1)
+}
+
+// waitEntered waits for n calls to Wait to start.
+func (g Gate) waitEntered(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-g.entered:
+		case <-time.After(testTimeout):
+			t.Fatalf("%d of %d calls started", i, n)
+		}
+	}
+}
+
+// waitQueued waits for n calls to be waiting for a worker of e.
+func waitQueued(t *testing.T, e *Exchange, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		e.dispatcher.lock.Lock()
+		waiting := e.dispatcher.waiting
+		e.dispatcher.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls are waiting, want %d", waiting, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// callWait calls Gate.Wait over ws with n, under the invocation id.
+func callWait(ws *websocket.Conn, id string, n int) {
+	ws.WriteJSON(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: "Gate", Method: "Wait", Arguments: []interface{}{n}, InvocationID: id})
+}
+
+func TestMaxCallWorkersBoundsConcurrentCalls(t *testing.T) {
+	gate := newGate()
+	_, srv := serve(t, ExchangeOptions{MaxCallWorkers: 2}, gate)
+
+	var sockets []*websocket.Conn
+	for i := 0; i < 5; i++ {
+		ws, _ := openWebSocket(t, srv)
+		sockets = append(sockets, ws)
+		callWait(ws, "w", i)
+	}
+	gate.waitEntered(t, 2)
+	select {
+	case <-gate.entered:
+		t.Fatal("a third call started with MaxCallWorkers 2")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(gate.release)
+	for _, ws := range sockets {
+		if c := readCompletion(t, ws, "w"); c.Error != "" {
+			t.Fatalf("a call waiting for a worker failed: %s", c.Error)
+		}
+	}
+	if most := gate.most.Load(); most != 2 {
+		t.Fatalf("%d calls ran at once, want 2", most)
+	}
+}
+
+func TestMaxQueuedCallsRefusesBusy(t *testing.T) {
+	gate := newGate()
+	e, srv := serve(t, ExchangeOptions{MaxCallWorkers: 1, MaxQueuedCalls: 2}, gate)
+
+	running, _ := openWebSocket(t, srv)
+	callWait(running, "w", 0)
+	gate.waitEntered(t, 1)
+	// these two wait for the only worker, filling the queue
+	var waiting []*websocket.Conn
+	for i := 1; i <= 2; i++ {
+		ws, _ := openWebSocket(t, srv)
+		callWait(ws, "w", i)
+		waiting = append(waiting, ws)
+	}
+	waitQueued(t, e, 2)
+
+	refused, _ := openWebSocket(t, srv)
+	callWait(refused, "busy", 3)
+	if c := readCompletion(t, refused, "busy"); c.Error != ErrServerBusy.Error() {
+		t.Fatalf("a call over the queue's bound failed with %q, want %q", c.Error, ErrServerBusy)
+	}
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	if status := callOverHTTP(t, srv, cid, "Gate", "Wait", 4); status != http.StatusServiceUnavailable {
+		t.Fatalf("a long-poll call over the queue's bound was answered with %d, want 503", status)
+	}
+	if busy := e.Stats().BusyCalls; busy != 2 {
+		t.Fatalf("BusyCalls is %d, want 2", busy)
+	}
+
+	close(gate.release)
+	for _, ws := range append(waiting, running) {
+		if c := readCompletion(t, ws, "w"); c.Error != "" {
+			t.Fatalf("a call that was queued failed: %s", c.Error)
+		}
+	}
+}
+
+// TestQueuedCallsHoldLittleMemory queues 10,000 calls to a slow method
+// behind a small pool, which must not cost a goroutine each, nor much
+// memory, and must still run each connection's calls in order.
+func TestQueuedCallsHoldLittleMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("queues 10,000 calls")
+	}
+	const (
+		workers  = 4
+		sockets  = 10
+		perConn  = 1000
+		maxBytes = 1 << 10 // per queued call, less than a goroutine's stack
+	)
+	gate := newGate()
+	e, srv := serve(t, ExchangeOptions{MaxCallWorkers: workers}, gate)
+
+	var conns []*websocket.Conn
+	for i := 0; i < sockets; i++ {
+		ws, _ := openWebSocket(t, srv)
+		conns = append(conns, ws)
+	}
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	for _, ws := range conns {
+		for n := 0; n < perConn; n++ {
+			callWait(ws, "w"+strconv.Itoa(n), n)
+		}
+	}
+	waitQueued(t, e, sockets*perConn-workers)
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if n := runtime.NumGoroutine() - goroutines; n > workers+sockets {
+		t.Errorf("%d more goroutines with %d calls queued", n, sockets*perConn)
+	}
+	if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > maxBytes*sockets*perConn {
+		t.Errorf("the heap grew by %d bytes with %d calls queued", grown, sockets*perConn)
+	}
+
+	close(gate.release)
+	for _, ws := range conns {
+		readCompletion(t, ws, "w"+strconv.Itoa(perConn-1))
+	}
+	gate.lock.Lock()
+	defer gate.lock.Unlock()
+	for cid, seen := range gate.seen {
+		for i, n := range seen {
+			if n != i {
+				t.Fatalf("%s's call %d ran as its %dth", cid, n, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package relayr
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// reasonDraining is sent with the reconnect control frame that moves
+// clients off a draining Exchange.
+const reasonDraining = "draining"
+
+// drainPollInterval is how often Drain checks whether clients have moved.
+const drainPollInterval = 100 * time.Millisecond
+
+// DrainOptions configures Exchange.Drain.
+type DrainOptions struct {
+	// RedirectURL is where clients are sent to negotiate while the
+	// Exchange is draining: the URL of another Exchange, usually through
+	// the load balancer, e.g. "https://example.com/relayr". Negotiations
+	// are redirected to its "/negotiate" with 307. When empty they are
+	// refused with 503.
+	RedirectURL string
+
+	// Jitter is the window over which connected clients are told to
+	// reconnect, each at a random moment within it, so that they do not
+	// all renegotiate at once. Zero tells them all straight away.
+	Jitter time.Duration
+}
+
+// mover is implemented by the built-in transports, which can tell a
+// client to renegotiate.
+type mover interface {
+	// move tells a client to renegotiate from scratch. When force is set
+	// its connection is also closed, for clients that did not act on it.
+	move(connectionID string, force bool)
+}
+
+// Drain moves clients off the Exchange ahead of it being shut down, e.g.
+// during a rolling deploy. New negotiations are turned away as opts says,
+// and the clients connected are told to renegotiate, which the generated
+// client script does through the RedirectURL or the load balancer while
+// keeping its handlers. Drain returns once they have all gone, or when ctx
+// is done, in which case the connections of those that remain are closed,
+// any long poll still waiting is answered by CancelWaiters, and ctx's
+// error is returned. Clients of transports added with RegisterTransport
+// cannot be told to move, so they are disconnected then.
+// The Exchange keeps turning negotiations away once drained.
+func (e *Exchange) Drain(ctx context.Context, opts DrainOptions) error {
+	e.draining.Store(&opts)
+
+	e.mapLock.RLock()
+	clients := e.clientsLocked()
+	e.mapLock.RUnlock()
+
+	e.logger.Infof("draining %d clients over %v", len(clients), opts.Jitter)
+	timers := make([]*time.Timer, len(clients))
+	for i, c := range clients {
+		c := c
+		var delay time.Duration
+		if opts.Jitter > 0 {
+			delay = time.Duration(rand.Int63n(int64(opts.Jitter)))
+		}
+		timers[i] = time.AfterFunc(delay, func() {
+			e.move(c, false)
+		})
+	}
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		remaining := clients[:0]
+		for _, c := range clients {
+			if e.getClientByConnectionID(c.ConnectionID) == c {
+				remaining = append(remaining, c)
+			}
+		}
+		clients = remaining
+		if len(clients) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, t := range timers {
+				t.Stop()
+			}
+			e.logger.Infof("closing %d clients that did not move", len(clients))
+			for _, c := range clients {
+				e.move(c, true)
+			}
+			e.CancelWaiters()
+			return ctx.Err()
+		}
+	}
+}
+
+// move tells a client to renegotiate, as Drain does.
+func (e *Exchange) move(c *client, force bool) {
+	if m, ok := c.transport().(mover); ok {
+		m.move(c.ConnectionID, force)
+		return
+	}
+	if force {
+		e.dropClient(c.ConnectionID, reasonDraining)
+	}
+}
+
+// turnAway answers a negotiation made while the Exchange is draining.
+func (e *Exchange) turnAway(w http.ResponseWriter, r *http.Request, opts *DrainOptions) {
+	if opts.RedirectURL == "" {
+		httpError(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	u := strings.TrimSuffix(opts.RedirectURL, "/") + "/" + opNegotiate
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,137 @@
+package relayr
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// recentCalls remembers the call IDs of a client's latest calls, so that a
+// call sent again, as by a client retrying a POST that timed out after the
+// call was dispatched, is not run twice.
+type recentCalls struct {
+	lock  sync.Mutex
+	order *list.List               // of *recentCall, oldest first
+	byID  map[string]*list.Element // by call ID
+}
+
+// recentCall is a call remembered by its call ID.
+type recentCall struct {
+	id         string
+	invocation string    // the InvocationID it was made with
+	made       time.Time // when it was made
+	done       bool      // its result is known, with RememberCallResults
+	result     interface{}
+	err        error
+	waiting    []string // the InvocationIDs of its duplicates waiting for its result
+}
+
+func newRecentCalls() *recentCalls {
+	return &recentCalls{order: list.New(), byID: make(map[string]*list.Element)}
+}
+
+// expireLocked forgets the calls made before cutoff. The caller must hold
+// r.lock.
+func (r *recentCalls) expireLocked(cutoff time.Time) {
+	for el := r.order.Front(); el != nil && el.Value.(*recentCall).made.Before(cutoff); el = r.order.Front() {
+		r.removeLocked(el)
+	}
+}
+
+// removeLocked forgets a call. The caller must hold r.lock.
+func (r *recentCalls) removeLocked(el *list.Element) {
+	delete(r.byID, el.Value.(*recentCall).id)
+	r.order.Remove(el)
+}
+
+// duplicateCall reports whether m is a call the client with the given
+// ConnectionID made before under the same call ID, among its last
+// DuplicateCallWindow calls and within the DuplicateCallTTL, counting it
+// in Stats. With RememberCallResults the duplicate is answered with the
+// result of the call at once if it has finished, and otherwise once it
+// does, if it was sent under another InvocationID. A call that is not a
+// duplicate is remembered.
+func (e *Exchange) duplicateCall(cid string, m *inboundFrame) bool {
+	if m.CallID == "" || e.options.DuplicateCallWindow < 0 {
+		return false
+	}
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return false
+	}
+
+	now := time.Now()
+	r := c.recent
+	r.lock.Lock()
+	r.expireLocked(now.Add(-e.options.DuplicateCallTTL))
+	el, ok := r.byID[m.CallID]
+	if !ok {
+		r.byID[m.CallID] = r.order.PushBack(&recentCall{id: m.CallID, invocation: m.InvocationID, made: now})
+		for r.order.Len() > e.options.DuplicateCallWindow {
+			r.removeLocked(r.order.Front())
+		}
+		r.lock.Unlock()
+		return false
+	}
+
+	call := el.Value.(*recentCall)
+	send := e.options.RememberCallResults && call.done
+	if e.options.RememberCallResults && !call.done && m.InvocationID != "" && m.InvocationID != call.invocation {
+		call.waiting = append(call.waiting, m.InvocationID)
+	}
+	result, err := call.result, call.err
+	r.lock.Unlock()
+
+	e.counters.duplicates.Add(1)
+	e.logger.Infof("connection %s sent call %s again; it is not run twice", cid, m.CallID)
+	if send {
+		e.sendResult(cid, m.InvocationID, result, err)
+	}
+	return true
+}
+
+// forgetCall forgets a call that was refused rather than run, so that it
+// may be sent again.
+func (e *Exchange) forgetCall(cid, callID string) {
+	if callID == "" {
+		return
+	}
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return
+	}
+	c.recent.lock.Lock()
+	defer c.recent.lock.Unlock()
+	if el, ok := c.recent.byID[callID]; ok {
+		c.recent.removeLocked(el)
+	}
+}
+
+// rememberResult keeps the result of the call a client made with the given
+// InvocationID, with RememberCallResults, for its duplicates, and sends it
+// to those waiting for it.
+func (e *Exchange) rememberResult(cid, invocationID string, result interface{}, err error) {
+	if !e.options.RememberCallResults || invocationID == "" {
+		return
+	}
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return
+	}
+
+	var waiting []string
+	c.recent.lock.Lock()
+	for el := c.recent.order.Back(); el != nil; el = el.Prev() {
+		call := el.Value.(*recentCall)
+		if call.invocation == invocationID && !call.done {
+			call.done, call.result, call.err = true, result, err
+			waiting, call.waiting = call.waiting, nil
+			break
+		}
+	}
+	c.recent.lock.Unlock()
+
+	for _, id := range waiting {
+		e.sendResult(cid, id, result, err)
+	}
+}
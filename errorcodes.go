@@ -0,0 +1,78 @@
+package relayr
+
+import (
+	"errors"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// ErrorCode classifies the errors the Exchange reports to clients. The
+// client script sets it as the code of the Error a call is rejected with,
+// or that its error event is raised with when the error concerns no call.
+// Like the websocket close codes the Exchange sends, relayr's own codes
+// are in the range 4000 to 4999; applications have the codes from
+// CodeApplication up.
+type ErrorCode = protocol.ErrorCode
+
+// The codes of the errors the Exchange reports to clients.
+const (
+	CodeUnknownRelay  ErrorCode = 4100 // the relay called does not exist
+	CodeUnknownMethod ErrorCode = 4101 // the method called does not exist on the relay
+	CodeBadArguments  ErrorCode = 4102 // the method was called with arguments it does not take
+	CodeForbidden     ErrorCode = 4200 // the client is not allowed to make the call
+	CodeRateLimited   ErrorCode = 4300 // the client went over its rate limit
+	CodeTooLarge      ErrorCode = 4400 // the message was over the MaxMessageSize
+
+	// CodeApplication is the first of the codes left to applications.
+	CodeApplication ErrorCode = 5000
+)
+
+// errMessageTooLarge is reported to long-polling clients that send a call
+// over the MaxMessageSize. Websockets are closed instead.
+var errMessageTooLarge = errors.New("relayr: message too large")
+
+// CodedError is an error reported to clients with a code. Relay methods
+// and interceptors return one to fail a call with a code of their own,
+// from CodeApplication up, or one of relayr's, such as CodeForbidden.
+type CodedError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *CodedError) Error() string {
+	return e.Message
+}
+
+// errorCode returns the code clients are told err has, or 0 if it has
+// none.
+func errorCode(err error) ErrorCode {
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	var call *CallError
+	if errors.As(err, &call) {
+		switch {
+		case call.Method == "":
+			return CodeUnknownRelay
+		case call.Reason == "does not exist":
+			return CodeUnknownMethod
+		}
+		return CodeBadArguments
+	}
+	var name *GroupNameError
+	if errors.As(err, &name) {
+		return CodeBadArguments
+	}
+
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return CodeRateLimited
+	case errors.Is(err, errMessageTooLarge), errors.Is(err, ErrUploadTooLarge):
+		return CodeTooLarge
+	case errors.Is(err, ErrForbidden), errors.Is(err, errForgedConnectionID), errors.Is(err, errClientEcho),
+		errors.Is(err, errGroupJoinDenied), errors.Is(err, errGroupRequestsDisabled):
+		return CodeForbidden
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package relayr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCategory classifies the errors passed to OnError handlers.
+type ErrorCategory int
+
+const (
+	// DecodeError is reported when a client sends a request or message
+	// that cannot be decoded.
+	DecodeError ErrorCategory = iota + 1
+
+	// DispatchError is reported when a relay method called by a client,
+	// or another call into a relay, fails or panics.
+	DispatchError
+
+	// TransportError is reported when a message cannot be encoded or
+	// sent, or a connection cannot be set up.
+	TransportError
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case DecodeError:
+		return "decode"
+	case DispatchError:
+		return "dispatch"
+	case TransportError:
+		return "transport"
+	}
+	return fmt.Sprintf("ErrorCategory(%d)", int(c))
+}
+
+// ExchangeError describes an error the Exchange met while serving clients
+// that it had no caller to return to.
+type ExchangeError struct {
+	Category     ErrorCategory
+	ConnectionID string // the client concerned, if any
+	Relay        string // the relay concerned, if any
+	Method       string // the method concerned, if any
+	Err          error
+}
+
+func (e ExchangeError) Error() string {
+	s := "relayr: " + e.Category.String() + " error"
+	if e.ConnectionID != "" {
+		s += " for " + e.ConnectionID
+	}
+	if e.Relay != "" {
+		s += " in " + e.Relay
+		if e.Method != "" {
+			s += "." + e.Method
+		}
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e ExchangeError) Unwrap() error {
+	return e.Err
+}
+
+// OnError adds a handler called with every error the Exchange meets in
+// the background: requests and messages from clients that cannot be
+// decoded, relay methods that fail, and messages that cannot be sent.
+// Errors are still logged. Handlers are called on the goroutine that met
+// the error, so they must not block.
+func (e *Exchange) OnError(fn func(err ExchangeError)) {
+	e.errorLock.Lock()
+	defer e.errorLock.Unlock()
+	e.errorHandlers = append(e.errorHandlers, fn)
+}
+
+// reportError passes err to the OnError handlers, and keeps it among the
+// RecentErrors of the client concerned. It takes locks of its own, so it
+// may be called with any of the Exchange's held but the registry's.
+func (e *Exchange) reportError(category ErrorCategory, cid, relay, method string, err error) {
+	if !errors.Is(err, ErrBufferFull) {
+		// recorded as the frame was dropped
+		e.recordConnectionError(category, cid, relay, method, err)
+	}
+
+	e.errorLock.Lock()
+	handlers := e.errorHandlers
+	e.errorLock.Unlock()
+
+	for _, fn := range handlers {
+		fn(ExchangeError{Category: category, ConnectionID: cid, Relay: relay, Method: method, Err: err})
+	}
+}
@@ -0,0 +1,182 @@
+package relayr
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultEventBuffer = 256
+
+// EventType is the kind of an ExchangeEvent.
+type EventType int
+
+const (
+	// EventConnected is sent when a client connects, or reconnects.
+	EventConnected EventType = iota + 1
+
+	// EventDisconnected is sent when a client's connection goes away,
+	// after it has left its groups.
+	EventDisconnected
+
+	// EventGroupJoined is sent when a client joins a group, or once for
+	// the clients AddToGroupBulk or MoveGroup adds together.
+	EventGroupJoined
+
+	// EventGroupLeft is sent when a client leaves a group, including when
+	// it disconnects, or once for the clients ClearGroup or MoveGroup
+	// removes together.
+	EventGroupLeft
+
+	// EventMessageSent is sent for each client a client method call is
+	// queued for, once it has been; a call to a group sends one for each
+	// member.
+	EventMessageSent
+
+	// EventCallReceived is sent when a call a client made to a relay
+	// method is about to run.
+	EventCallReceived
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventGroupJoined:
+		return "groupJoined"
+	case EventGroupLeft:
+		return "groupLeft"
+	case EventMessageSent:
+		return "messageSent"
+	case EventCallReceived:
+		return "callReceived"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// MarshalText encodes the type by its name.
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// ExchangeEvent describes something that happened on the Exchange, for
+// consumers outside it such as an analytics pipeline.
+type ExchangeEvent struct {
+	Type         EventType
+	Time         time.Time
+	ConnectionID string
+	Transport    string `json:",omitempty"` // for EventConnected and EventCallReceived
+	Group        string `json:",omitempty"` // for EventGroupJoined and EventGroupLeft, and EventMessageSent for a call to a group
+	Relay        string `json:",omitempty"` // for EventMessageSent and EventCallReceived
+	Method       string `json:",omitempty"` // for EventMessageSent and EventCallReceived
+	Reason       string `json:",omitempty"` // for EventDisconnected, one of the Reason constants or the reason given to Disconnect
+
+	// ConnectionIDs are the clients that joined or left a group together,
+	// for EventGroupJoined and EventGroupLeft sent once for them, in
+	// place of a ConnectionID.
+	ConnectionIDs []string `json:",omitempty"`
+}
+
+// EventSubscription receives the Exchange's events on C, in the order
+// they happened, until Unsubscribe is called.
+type EventSubscription struct {
+	C <-chan ExchangeEvent
+
+	e       *Exchange
+	ch      chan ExchangeEvent
+	lock    sync.Mutex
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// SubscribeEvents returns a subscription to the Exchange's events, with
+// room for buffer events its consumer has not received yet; zero or less
+// gives room for 256. Events that do not fit are dropped rather than
+// holding up the Exchange, and counted by Dropped. Each subscription
+// receives every event.
+func (e *Exchange) SubscribeEvents(buffer int) *EventSubscription {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+	s := &EventSubscription{e: e, ch: make(chan ExchangeEvent, buffer)}
+	s.C = s.ch
+
+	e.eventLock.Lock()
+	defer e.eventLock.Unlock()
+	var subs []*EventSubscription
+	if old := e.eventSubs.Load(); old != nil {
+		subs = append(subs, *old...)
+	}
+	subs = append(subs, s)
+	e.eventSubs.Store(&subs)
+	return s
+}
+
+// Unsubscribe stops the subscription and closes C. Events already
+// buffered in C can still be received.
+func (s *EventSubscription) Unsubscribe() {
+	e := s.e
+	e.eventLock.Lock()
+	if old := e.eventSubs.Load(); old != nil {
+		var subs []*EventSubscription
+		for _, o := range *old {
+			if o != s {
+				subs = append(subs, o)
+			}
+		}
+		if len(subs) == 0 {
+			e.eventSubs.Store(nil)
+		} else {
+			e.eventSubs.Store(&subs)
+		}
+	}
+	e.eventLock.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// Dropped returns how many events have been dropped because the
+// subscription's buffer was full.
+func (s *EventSubscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *EventSubscription) send(ev ExchangeEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// emitSent sends an EventMessageSent for a client method call queued for
+// a client.
+func (e *Exchange) emitSent(cid, group, relay, method string) {
+	e.emit(ExchangeEvent{Type: EventMessageSent, ConnectionID: cid, Group: group, Relay: relay, Method: method})
+}
+
+// emit sends an event to the subscriptions. It costs a single atomic load
+// when there are none, and never blocks.
+func (e *Exchange) emit(ev ExchangeEvent) {
+	subs := e.eventSubs.Load()
+	if subs == nil {
+		return
+	}
+	ev.Time = time.Now()
+	for _, s := range *subs {
+		s.send(ev)
+	}
+}
@@ -0,0 +1,91 @@
+package relayr
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of s other than those of Global, failing
+// the test if none arrives in time.
+func nextEvent(t *testing.T, s *EventSubscription) ExchangeEvent {
+	t.Helper()
+	for {
+		select {
+		case ev := <-s.C:
+			if ev.Group != "Global" {
+				return ev
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("no event arrived")
+		}
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{ReconnectGracePeriod: -1}, Ticker{})
+	sub := e.SubscribeEvents(0)
+	defer sub.Unsubscribe()
+	other := e.SubscribeEvents(0)
+	defer other.Unsubscribe()
+
+	c := dial(t, srv, "websocket")
+	ticks := calls(c, "Ticker", "tick")
+	if err := c.Invoke(context.Background(), "Ticker", "Subscribe", "ticks"); err != nil {
+		t.Fatal(err)
+	}
+	e.Clients(Ticker{}).Group("ticks").Call("tick", 1)
+	receive(t, ticks)
+	if err := e.Disconnect(c.ConnectionID(), "testing"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := c.ConnectionID()
+	want := []ExchangeEvent{
+		{Type: EventConnected, ConnectionID: id, Transport: "websocket"},
+		{Type: EventCallReceived, ConnectionID: id, Transport: "websocket", Relay: "Ticker", Method: "Subscribe"},
+		{Type: EventGroupJoined, ConnectionID: id, Group: "ticks"},
+		{Type: EventMessageSent, ConnectionID: id, Group: "ticks", Relay: "Ticker", Method: "tick"},
+		{Type: EventGroupLeft, ConnectionID: id, Group: "ticks"},
+		{Type: EventDisconnected, ConnectionID: id, Reason: "testing"},
+	}
+	for _, s := range []*EventSubscription{sub, other} {
+		for _, w := range want {
+			ev := nextEvent(t, s)
+			if ev.Time.IsZero() {
+				t.Errorf("%v has no time", ev.Type)
+			}
+			ev.Time = time.Time{}
+			if !reflect.DeepEqual(ev, w) {
+				t.Fatalf("received %+v, want %+v", ev, w)
+			}
+		}
+	}
+}
+
+func TestSlowEventConsumerDropsEvents(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	sub := e.SubscribeEvents(1)
+
+	c := dial(t, srv, "longpoll")
+	ticks := calls(c, "Ticker", "tick")
+	if err := e.AddToGroup("ticks", c.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		e.Clients(Ticker{}).Group("ticks").Call("tick", i)
+	}
+	for i := 0; i < 10; i++ {
+		receive(t, ticks)
+	}
+	if sub.Dropped() == 0 {
+		t.Error("no events were dropped for a consumer that never received")
+	}
+
+	sub.Unsubscribe()
+	<-sub.C // the one buffered
+	if _, ok := <-sub.C; ok {
+		t.Error("C was not closed by Unsubscribe")
+	}
+}
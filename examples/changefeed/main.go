@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/simon-whitehead/relayR"
+)
+
+type ChatRelay struct {
+}
+
+func (cr ChatRelay) Join(relay *relayr.Relay, room string) {
+	relay.Groups(room).Add(relay.ConnectionID)
+}
+
+func (cr ChatRelay) Say(relay *relayr.Relay, room, msg string) {
+	relay.Clients.CallGroup(room, "said", msg)
+}
+
+// writeEvents writes the Exchange's events as JSON lines, one event per
+// line, until the subscription ends.
+func writeEvents(sub *relayr.EventSubscription, enc *json.Encoder) {
+	for ev := range sub.C {
+		if err := enc.Encode(ev); err != nil {
+			log.Printf("writing event: %v", err)
+		}
+	}
+}
+
+func main() {
+	exchange := relayr.NewExchange("http://localhost:8080", 0)
+	exchange.RegisterRelay(ChatRelay{})
+
+	// a slow writer misses events rather than holding up the Exchange
+	sub := exchange.SubscribeEvents(4096)
+	defer sub.Unsubscribe()
+	go writeEvents(sub, json.NewEncoder(os.Stdout))
+
+	http.Handle("/relayr/", exchange)
+	http.ListenAndServe(":8080", nil)
+}
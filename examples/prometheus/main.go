@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/simon-whitehead/relayR"
+)
+
+// relayrCollector exposes an Exchange's Stats as Prometheus metrics.
+type relayrCollector struct {
+	e *relayr.Exchange
+
+	connections *prometheus.Desc
+	groupSize   *prometheus.Desc
+	sent        *prometheus.Desc
+	received    *prometheus.Desc
+	dropped     *prometheus.Desc
+	failed      *prometheus.Desc
+}
+
+func newRelayrCollector(e *relayr.Exchange) *relayrCollector {
+	return &relayrCollector{
+		e:           e,
+		connections: prometheus.NewDesc("relayr_connections", "Active connections.", []string{"transport"}, nil),
+		groupSize:   prometheus.NewDesc("relayr_group_members", "Members per group.", []string{"group"}, nil),
+		sent:        prometheus.NewDesc("relayr_messages_sent_total", "Messages sent to clients.", nil, nil),
+		received:    prometheus.NewDesc("relayr_messages_received_total", "Messages received from clients.", nil, nil),
+		dropped:     prometheus.NewDesc("relayr_messages_dropped_total", "Messages dropped for slow clients.", nil, nil),
+		failed:      prometheus.NewDesc("relayr_failed_calls_total", "Server method calls that failed.", nil, nil),
+	}
+}
+
+func (c *relayrCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+	ch <- c.groupSize
+	ch <- c.sent
+	ch <- c.received
+	ch <- c.dropped
+	ch <- c.failed
+}
+
+func (c *relayrCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.e.Stats()
+	for t, n := range s.Connections {
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(n), t)
+	}
+	for g, n := range s.Groups {
+		ch <- prometheus.MustNewConstMetric(c.groupSize, prometheus.GaugeValue, float64(n), g)
+	}
+	ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(s.MessagesSent))
+	ch <- prometheus.MustNewConstMetric(c.received, prometheus.CounterValue, float64(s.MessagesReceived))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(s.DroppedMessages))
+	ch <- prometheus.MustNewConstMetric(c.failed, prometheus.CounterValue, float64(s.FailedCalls))
+}
+
+type EchoRelay struct {
+}
+
+func (er EchoRelay) Echo(relay *relayr.Relay, msg string) {
+	relay.Clients.All("echo", msg)
+}
+
+func main() {
+	exchange := relayr.NewExchangeWithOptions("http://localhost:8080", relayr.ExchangeOptions{EnableStats: true})
+	exchange.RegisterRelay(EchoRelay{})
+
+	prometheus.MustRegister(newRelayrCollector(exchange))
+
+	http.Handle("/relayr/", exchange)
+	http.Handle("/metrics", promhttp.Handler())
+
+	http.ListenAndServe(":8080", nil)
+}
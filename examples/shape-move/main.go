@@ -10,7 +10,7 @@ type ShapeRelay struct {
 }
 
 func (sr ShapeRelay) UpdateShape(relay *relayr.Relay, s map[string]interface{}) {
-	relay.Clients.Others("shapeUpdated", s) // Only send to other clients
+	relay.Clients.Others().Call("shapeUpdated", s) // Only send to other clients
 }
 
 func main() {
@@ -2,77 +2,219 @@ package relayr
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"reflect"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr/protocol"
 )
 
 // ClientScriptFunc is a callback for altering the client side
 // generated Javascript. This can be used to minify/alter the
 // generated client-side RelayR library before it gets to the browser.
+// It applies to every Exchange without its own transform; prefer
+// Exchange.SetClientScriptTransform.
 var ClientScriptFunc func([]byte) []byte
 
-// A cache for the client script to avoid regenerating it every
-// single page load
-var clientScript []byte
 var cacheEnabled = true
 
-// DisableScriptCache forces the RelayR client-side script to
-// be regenerated on each request, rather than serving it from
-// an internal cache.
+// DisableScriptCache forces the RelayR client-side script of every
+// Exchange to be regenerated on each request, rather than serving it
+// from an internal cache.
+//
+// Deprecated: use Exchange.DisableScriptCache or
+// ExchangeOptions.DisableScriptCache instead.
 func DisableScriptCache() {
 	cacheEnabled = false
 }
 
-var upgrader = &websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// AllowAllOrigins is an origin check that accepts websocket upgrades from
+// any origin. Pass it to SetCheckOrigin to opt out of the default
+// same-origin policy.
+func AllowAllOrigins(r *http.Request) bool {
+	return true
 }
 
-type longPollServerCall struct {
-	Server       bool          `json:"S"`
-	Relay        string        `json:"R"`
-	Method       string        `json:"M"`
-	Arguments    []interface{} `json:"A"`
-	ConnectionID string        `json:"C"`
+// clientScript is a generated client-side script, its gzipped form and
+// their strong ETags.
+type clientScript struct {
+	body      []byte
+	etag      string
+	gzipped   []byte
+	gzipEtag  string
+	sourceMap []byte // from the ScriptTransform, if any
 }
 
+func newClientScript(body []byte) clientScript {
+	sum := sha256.Sum256(body)
+	tag := hex.EncodeToString(sum[:16])
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(body)
+	gz.Close()
+
+	return clientScript{
+		body:     body,
+		etag:     `"` + tag + `"`,
+		gzipped:  buf.Bytes(),
+		gzipEtag: `"` + tag + `-gzip"`,
+	}
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	relayType = reflect.TypeOf(&Relay{})
+)
+
+var (
+	errForgedConnectionID = errors.New("relayr: message sent with another client's ConnectionID")
+	errClientEcho         = errors.New("relayr: calls to client methods are not allowed")
+	errFrozen             = errors.New("relayr: transports must be registered before the Exchange is frozen")
+	errInvalidRelay       = errors.New("relayr: a relay must be a struct or a non-nil pointer to one")
+	errUnsafeID           = errors.New("relayr: IDGenerator returned a ConnectionID that is not URL-safe")
+	errIDsTaken           = errors.New("relayr: IDGenerator returned only ConnectionIDs in use")
+)
+
+// idAttempts is how many ConnectionIDs newClient asks the IDGenerator
+// for, while they are taken by other clients, before giving up.
+const idAttempts = 8
+
 // Exchange represents a hub where clients exchange information
 // via Relays. Relays registered with the Exchange expose methods
 // that can be invoked by clients.
 type Exchange struct {
-	relays               []Relay
-	groups               map[string][]*client
+	relays               atomic.Pointer[[]Relay] // copied on write under relayLock
+	relayLock            sync.Mutex
+	clientArgs           atomic.Pointer[map[string]map[string][]*PayloadSchema] // set by DescribeClientMethod; copied on write under relayLock
+	groups               map[string]*group
+	connected            map[string]*client                        // connected clients by ConnectionID
+	detached             map[string]*detachedClient                // clients waiting to reconnect
+	pending              map[string]*pendingClient                 // clients that have negotiated but not yet connected
+	users                map[string]map[string]struct{}            // ConnectionIDs by user ID
+	addrs                map[string]int                            // connected clients by IP address
+	tags                 map[string]map[string]string              // tags by ConnectionID
+	tagIndex             map[string]map[string]map[string]struct{} // ConnectionIDs by tag key and value
+	negotiating          map[string]struct{}                       // clients given a ConnectionID and not yet added
+	bans                 []ban
+	interceptors         []Interceptor
+	errorHandlers        []func(ExchangeError) // guarded by errorLock
+	errorLock            sync.Mutex
+	methodRules          map[string]AuthorizeFunc // by methodRuleKey
+	outboundInterceptors []OutboundInterceptor
 	transports           map[string]Transport
 	mainURL              string
 	mainURLWithoutScheme string
-	mapLock              sync.Mutex
-	verbosity            int
+	mapLock              sync.RWMutex
+	upgrader             *websocket.Upgrader
+	originCheck          atomic.Pointer[func(r *http.Request) bool] // the upgrader's CheckOrigin, as set by SetCheckOrigin
+	options              ExchangeOptions
+	logger               Logger
+	backplane            Backplane
+	instanceID           string
+	invocations          *invocations
+	acks                 *acks
+	uploads              *uploads
+	schedules            schedules
+	taps                 atomic.Pointer[map[string]*frameTap] // by ConnectionID, copied on write under tapLock; nil when there are none
+	tapLock              sync.Mutex
+	dispatcher           *dispatcher
+	counters             counters
+	conns                *connectionRegistry
+	json                 Codec                      // the JSON codec, as configured by the options
+	offlineLocks         [offlineStripes]sync.Mutex // held while a user's offline calls are saved or sent
+
+	scriptLock      sync.Mutex
+	scriptCache     map[string]clientScript // generated client scripts keyed by baseURL and route
+	scriptGen       uint64                  // bumped whenever cached scripts become stale
+	scriptTransform ScriptTransform
+	scriptSizes     atomic.Pointer[[2]int] // the sizes of the last script generated, before and after it was transformed
+
+	frozen    atomic.Bool // set by Freeze, once transports can no longer be registered
+	draining  atomic.Pointer[DrainOptions]
+	presence  atomic.Pointer[presenceTracker]      // set by EnablePresence
+	retention atomic.Pointer[retention]            // set by RetainGroupMessages
+	states    atomic.Pointer[stateStore]           // set by the first CallStateful
+	expiry    atomic.Pointer[groupExpiry]          // set by SetGroupExpiry
+	webhooks  atomic.Pointer[webhookTransport]     // set by the first SubscribeWebhook
+	locals    atomic.Pointer[localTransport]       // set by the first Connect
+	hubbed    atomic.Pointer[hubTransport]         // set when the Exchange is added to an ExchangeGroup
+	hubs      map[string]*Exchange                 // added with ExchangeGroup.AddHub before the Exchange is frozen
+	tuned     atomic.Pointer[RuntimeOptions]       // the RuntimeOptions in effect, in place of those of options
+	tuneLock  sync.Mutex                           // held while the RuntimeOptions are updated
+	evicting  atomic.Bool                          // set while evictIdle runs
+	eventLock sync.Mutex                           // held while the subscriptions change
+	eventSubs atomic.Pointer[[]*EventSubscription] // nil when there are none
+	done      chan struct{}                        // closed when the Exchange begins shutting down
+	closeOnce sync.Once
+	closeLock sync.Mutex
+	closing   bool
+	wg        sync.WaitGroup // in-flight handlers and transport goroutines
+
+	healthLock   sync.Mutex    // guards healthChecks
+	healthChecks []healthCheck // added with AddHealthCheck
 }
 
-type negotiation struct {
-	T string // the transport that the client is comfortable using (e.g, websockets)
+// NewExchange initializes and returns a new Exchange
+func NewExchange(mainURL string, verbosity int) *Exchange {
+	return NewExchangeWithOptions(mainURL, ExchangeOptions{Verbosity: verbosity})
 }
 
-type negotiationResponse struct {
-	ConnectionID string
-}
+// NewExchangeWithOptions initializes and returns a new Exchange
+// configured by opts.
+func NewExchangeWithOptions(mainURL string, opts ExchangeOptions) *Exchange {
+	opts = opts.withDefaults()
 
-// NewExchange initializes and returns a new Exchange
-func NewExchange(mainURL string, verbosity int) *Exchange {
 	e := &Exchange{}
-	e.groups = make(map[string][]*client)
+	e.options = opts
+	tuned := opts.runtimeOptions()
+	e.tuned.Store(&tuned)
+	e.logger = opts.Logger
+	e.done = make(chan struct{})
+	e.instanceID = opts.InstanceID
+	if e.instanceID == "" {
+		e.instanceID = generateConnectionID()
+	}
+	e.invocations = newInvocations()
+	e.acks = newAcks()
+	e.uploads = newUploads()
+	e.dispatcher = newDispatcher(opts.MaxCallWorkers, opts.MaxQueuedCalls)
+	e.scriptCache = make(map[string]clientScript)
+	e.json = newJSONCodec(opts)
+	e.upgrader = &websocket.Upgrader{
+		ReadBufferSize:    opts.ReadBufferSize,
+		WriteBufferSize:   opts.WriteBufferSize,
+		CheckOrigin:       e.checkUpgradeOrigin,
+		EnableCompression: opts.EnableCompression,
+	}
+	if opts.CheckOrigin == nil && opts.corsEnabled() {
+		e.SetCheckOrigin(e.checkOrigin)
+	} else {
+		e.SetCheckOrigin(opts.CheckOrigin)
+	}
+	e.groups = make(map[string]*group)
+	e.connected = make(map[string]*client)
+	e.detached = make(map[string]*detachedClient)
+	e.pending = make(map[string]*pendingClient)
+	e.users = make(map[string]map[string]struct{})
+	e.addrs = make(map[string]int)
+	e.tags = make(map[string]map[string]string)
+	e.tagIndex = make(map[string]map[string]map[string]struct{})
+	e.negotiating = make(map[string]struct{})
+	e.conns = newConnectionRegistry()
 	e.transports = map[string]Transport{
 		"websocket": newWebSocketTransport(e),
 		"longpoll":  newLongPollTransport(e),
@@ -80,180 +222,1476 @@ func NewExchange(mainURL string, verbosity int) *Exchange {
 	e.mainURL = mainURL
 	e.mainURLWithoutScheme = strings.Replace(e.mainURL, "https://", "", -1)
 	e.mainURLWithoutScheme = strings.Replace(e.mainURLWithoutScheme, "http://", "", -1)
-	e.verbosity = verbosity
+	if opts.IdleTimeout > 0 {
+		e.startEvictingIdle()
+	}
+	if opts.StaleConnectionTimeout > 0 {
+		e.wg.Add(1)
+		go e.reapStale()
+	}
 
 	return e
 }
 
+// Close shuts the Exchange down. New negotiations and calls are refused,
+// open websockets are sent a close frame, pending long polls are answered
+// at once with ReasonShutdown, as CancelWaiters answers them, and the
+// transport goroutines are stopped. Close returns once everything
+// has drained, the calls already running included, or with the context's
+// error if it expires first; no goroutine of the Exchange's is left.
+func (e *Exchange) Close(ctx context.Context) error {
+	e.closeOnce.Do(func() {
+		e.closeLock.Lock()
+		e.closing = true
+		e.closeLock.Unlock()
+		close(e.done)
+		for name, t := range e.transports {
+			if err := t.Close(); err != nil {
+				e.logger.Errorf("closing %s transport: %v", name, err)
+			}
+		}
+		if t := e.locals.Load(); t != nil {
+			t.Close()
+		}
+		if t := e.hubbed.Load(); t != nil {
+			t.Close()
+		}
+		e.dispatcher.close()
+		e.schedules.close()
+		e.untapAll()
+		e.invocations.cancelAll()
+		e.acks.cancelAll()
+		e.uploads.abortAll(errExchangeClosed)
+		e.expireAllClients()
+		e.stopPending()
+
+		e.mapLock.RLock()
+		b := e.backplane
+		e.mapLock.RUnlock()
+		if b != nil {
+			if err := b.Close(); err != nil {
+				e.logger.Errorf("closing backplane: %v", err)
+			}
+		}
+	})
+
+	drained := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		e.dispatcher.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track registers an in-flight handler or goroutine with the Exchange so
+// that Close can wait for it. It returns false once the Exchange is closing,
+// in which case the caller must not proceed.
+func (e *Exchange) track() bool {
+	e.closeLock.Lock()
+	defer e.closeLock.Unlock()
+	if e.closing {
+		return false
+	}
+	e.wg.Add(1)
+	return true
+}
+
+func (e *Exchange) isClosed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetCheckOrigin sets the function used to validate the Origin header of
+// websocket upgrade requests. When fn is nil, upgrades are only accepted
+// from the same origin as the Exchange. Use AllowAllOrigins to accept any.
+// It may be called while the Exchange is serving; upgrades already under
+// way are checked with the function they started with.
+func (e *Exchange) SetCheckOrigin(fn func(r *http.Request) bool) {
+	if fn == nil {
+		fn = sameOrigin
+	}
+	e.originCheck.Store(&fn)
+}
+
+// checkUpgradeOrigin is the upgrader's CheckOrigin, which checks the
+// Origin of an upgrade with the function SetCheckOrigin set.
+func (e *Exchange) checkUpgradeOrigin(r *http.Request) bool {
+	return (*e.originCheck.Load())(r)
+}
+
+// ServeHTTP serves the client script and the requests clients make of
+// the Exchange, each as the handler for its operation, such as
+// NegotiateHandler, would. A request it refuses is answered with a JSON
+// body naming the error, and one that panics with 500.
 func (e *Exchange) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	op := extractOperationFromURL(r)
+	op, ok := e.operation(r)
+	if !ok {
+		defer e.recoverRequest(w, r)
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	e.serveOperation(w, r, op, e.mountFor(r, op), "")
+}
+
+// serveOperation serves r, a request for op of the Exchange served under
+// mount. route, if set, is the URL the client script served connects to,
+// in place of the one built by scriptURLs.
+func (e *Exchange) serveOperation(w http.ResponseWriter, r *http.Request, op, mount, route string) {
+	defer e.recoverRequest(w, r)
+	if !e.frozen.Load() {
+		e.Freeze()
+	}
+	if !allowMethod(w, r, op) {
+		return
+	}
+
+	if op == opStats && e.options.EnableStats {
+		e.serveStats(w, r)
+		return
+	}
+	if op == opHealth && e.options.EnableHealthCheck {
+		e.serveHealth(w, r)
+		return
+	}
+	if op == opServerInvoke {
+		// a POST is no request for the client script
+		if e.options.ServerInvokeSecret == "" {
+			httpError(w, "not found", http.StatusNotFound)
+			return
+		}
+		e.serveServerInvoke(w, r)
+		return
+	}
+
+	if crossOriginOperation(op) && !e.allowCrossOrigin(w, r) {
+		return
+	}
+
+	switch op {
+	case opWebSocket, opNegotiate, opLongPoll:
+		if !e.track() {
+			httpError(w, "exchange is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer e.wg.Done()
+	}
+
+	if (op == opLongPoll || op == opCallServer) && e.foreignInstance(r) {
+		e.refuseForeign(w, r, op)
+		return
+	}
 
 	switch op {
 	case opWebSocket:
 		e.upgradeWebSocket(w, r)
 	case opNegotiate:
-		e.negotiateConnection(w, r)
+		e.negotiateConnection(w, r, mount)
 	case opLongPoll:
 		e.awaitLongPoll(w, r)
 	case opCallServer:
 		e.callServer(w, r)
 	default:
-		u := r.URL
-		lastIndex := strings.LastIndex(u.Path, "/"+op)
-		route := e.mainURL + u.Path[:lastIndex]
-		baseURL := e.mainURLWithoutScheme + u.Path[:lastIndex]
-		e.writeClientScript(w, baseURL, route)
+		baseURL := strings.TrimPrefix(strings.TrimPrefix(route, "https://"), "http://")
+		if route == "" {
+			baseURL, route = e.scriptURLs(r, mount)
+		}
+		switch op {
+		case opSourceMap:
+			e.writeSourceMap(w, r, baseURL, route)
+			return
+		case opManifest:
+			if name := r.URL.Query().Get("relay"); name != "" {
+				e.writeRelayManifest(w, r, name)
+				return
+			}
+			e.writeManifest(w, baseURL, route)
+			return
+		}
+		e.writeClientScript(w, r, baseURL, route)
+	}
+}
+
+// operation returns the operation requested by r. With a MountPath, only
+// its exact sub-paths are recognised, whether or not the router has
+// already stripped the MountPath itself. Without one, the operation is
+// the last segment of the path and anything unrecognised is a request for
+// the client script.
+func (e *Exchange) operation(r *http.Request) (string, bool) {
+	mount := strings.TrimSuffix(e.options.MountPath, "/")
+	if mount == "" {
+		return extractOperationFromURL(r), true
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, mount)
+	if p != "/" {
+		p = strings.TrimSuffix(p, "/")
+	}
+	op, ok := mountedOperations[p]
+	if !ok || !e.serves(op) {
+		return "", false
+	}
+	return op, true
+}
+
+// serves reports whether the Exchange serves op: stats only with
+// EnableStats, its health only with EnableHealthCheck, and server
+// invocations only with a ServerInvokeSecret.
+func (e *Exchange) serves(op string) bool {
+	switch op {
+	case opStats:
+		return e.options.EnableStats
+	case opHealth:
+		return e.options.EnableHealthCheck
+	case opServerInvoke:
+		return e.options.ServerInvokeSecret != ""
+	}
+	return true
+}
+
+// mountFor returns the path the Exchange is served under for r, a request
+// for op: the MountPath, or without one the path of r up to op.
+func (e *Exchange) mountFor(r *http.Request, op string) string {
+	mount := strings.TrimSuffix(e.options.MountPath, "/")
+	if i := strings.LastIndex(r.URL.Path, "/"+op); mount == "" && i >= 0 {
+		mount = r.URL.Path[:i]
+	}
+	return mount
+}
+
+// extractOperationFromURL returns the last segment of the path of r: all
+// of it when it has no slash, as behind http.StripPrefix, and nothing for
+// the root.
+func extractOperationFromURL(r *http.Request) string {
+	return r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+}
+
+func (e *Exchange) upgradeWebSocket(w http.ResponseWriter, r *http.Request) {
+	span := e.startRequestSpan(SpanUpgrade, r)
+	if _, err := e.authorize(r); err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		span.End(err)
+		return
+	}
+
+	cid, err := e.requestConnectionID(r)
+	if err == errMissingConnectionID {
+		httpError(w, "missing connectionId", http.StatusBadRequest)
+		span.End(err)
+		return
+	}
+	tokenErr := err
+	span.SetAttribute("relayr.connection_id", cid)
+
+	codec, protocol := e.protocolFor(cid)
+	var header http.Header
+	sub, known := subprotocol(r, codec)
+	if sub != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {sub}}
+	}
+	// the bytes written to a socket that compresses are counted, to tell
+	// how much compression saves
+	var wire *atomic.Uint64
+	if e.options.EnableCompression && offersDeflate(r) {
+		wire = new(atomic.Uint64)
+		w = &countingResponse{ResponseWriter: w, written: wire}
+	}
+	ws, err := e.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		e.logger.Errorf("websocket upgrade failed: %v", err)
+		e.reportError(TransportError, cid, "", "", err)
+		span.End(err)
+		return
+	}
+	if !known {
+		e.logger.Infof("refusing a websocket for %s asking for subprotocols %q", cid, websocket.Subprotocols(r))
+		refuseWebSocket(ws, closeUnknownSubprotocol, errUnknownSubprotocol.Error())
+		span.End(errUnknownSubprotocol)
+		return
+	}
+
+	if tokenErr != nil {
+		e.logger.Infof("refusing websocket: %v", tokenErr)
+		refuseWebSocket(ws, closeInvalidToken, tokenErr.Error())
+		span.End(tokenErr)
+		return
+	}
+	if e.foreignInstance(r) {
+		e.logger.Infof("refusing a websocket for %s, which is held by instance %s", cid, r.URL.Query().Get("instance"))
+		refuseWebSocket(ws, closeWrongInstance, errWrongInstance.Error())
+		span.End(errWrongInstance)
+		return
+	}
+
+	// a websocket must follow a negotiation for it, and a connection has
+	// one websocket at a time, so that a second cannot take over the
+	// first's registration; browsers cannot see the status of a refused
+	// upgrade, so the refusal is a close frame
+	if e.transports["websocket"].(*webSocketTransport).has(cid) {
+		e.logger.Infof("refusing a second websocket for %s", cid)
+		refuseWebSocket(ws, closeDuplicateConnection, "relayr: connection already has a websocket, negotiate another")
+		span.End(errors.New("relayr: connection already has a websocket"))
+		return
+	}
+	// or, with the sequence number of the last frame it polled for, one
+	// upgrading from long-polling, which has connected already if it has
+	// polled
+	upgrade, upgrading := r.URL.Query()["upgrade"]
+	want := e.transports["websocket"]
+	if upgrading {
+		want = e.transports["longpoll"]
+	}
+	if c := e.getClientByConnectionID(cid); c == nil || c.transport() != want || !e.connectionEstablished(cid) && !upgrading {
+		e.logger.Infof("refusing websocket for %s, which did not negotiate one", cid)
+		refuseWebSocket(ws, closeUnknownConnection, "relayr: unknown connection, negotiate first")
+		span.End(ErrConnectionNotFound)
+		return
+	}
+	var seq uint64
+	if upgrading {
+		if seq, err = strconv.ParseUint(upgrade[0], 10, 64); err != nil {
+			refuseWebSocket(ws, closeUpgradeRefused, errUpgradeRefused.Error())
+			span.End(errUpgradeRefused)
+			return
+		}
+	}
+
+	e.conns.setAddr(cid, remoteIP(r))
+	if c := e.getClientByConnectionID(cid); c != nil {
+		e.extractConnectionValues(c, r)
+	}
+	// the hooks of a client upgrading ran as it started polling
+	welcome := e.hasConnectHooks() && !upgrading
+	if e.options.EnableCompression && e.options.CompressionLevel != 0 {
+		if err := ws.SetCompressionLevel(e.options.CompressionLevel); err != nil {
+			e.logger.Errorf("setting compression level for %s: %v", cid, err)
+			e.reportError(TransportError, cid, "", "", err)
+		}
+	}
+
+	tuned := e.runtime()
+	c := &connection{
+		e:        e,
+		out:      make(chan outFrame, tuned.OutChannelSize),
+		high:     make(chan outFrame, laneSize(tuned.OutChannelSize)),
+		low:      make(chan outFrame, laneSize(tuned.OutChannelSize)),
+		ws:       ws,
+		c:        e.transports["websocket"].(*webSocketTransport),
+		id:       cid,
+		codec:    codec,
+		protocol: protocol,
+		caps:     e.capabilitiesFor(cid),
+		wire:     wire,
+		holding:  welcome,
+		gone:     make(chan struct{}),
+	}
+	if cl := e.getClientByConnectionID(cid); cl != nil {
+		c.bandwidth = cl.bandwidth
+		c.owner = cl
+	}
+	if protocol >= 1 {
+		// the handshake goes first, ahead of anything queued once the
+		// connection is added
+		hs, err := encodeFrame(codec, protocol, &handshake{
+			Version:        protocol,
+			KeepAlive:      (tuned.KeepAliveTimeout / 2).Milliseconds(),
+			MaxMessageSize: tuned.MaxMessageSize,
+		})
+		if err != nil {
+			e.logger.Errorf("encoding handshake for %s: %v", cid, err)
+			e.reportError(TransportError, cid, "", "", err)
+		} else {
+			c.high <- outFrame{data: hs, urgent: true}
+		}
+	}
+	if upgrading {
+		up, err := encodeFrame(codec, protocol, &controlFrame{Command: commandUpgraded})
+		if err == nil {
+			c.high <- outFrame{data: up, urgent: true}
+			err = e.upgradeLongPoll(c, seq)
+		}
+		if err != nil {
+			e.logger.Infof("refusing to upgrade %s: %v", cid, err)
+			refuseWebSocket(ws, closeUpgradeRefused, err.Error())
+			span.End(err)
+			return
+		}
+	}
+
+	select {
+	case c.c.connected <- c:
+		span.End(nil)
+	case <-e.done:
+		ws.Close()
+		span.End(nil)
+		return
+	}
+	if welcome {
+		go e.welcome(cid, func() {
+			c.c.release(c)
+		})
+	}
+	defer func() {
+		select {
+		case c.c.disconnected <- c:
+		case <-e.done:
+		}
+	}()
+
+	if !e.track() {
+		ws.Close()
+		return
+	}
+	go func() {
+		defer e.wg.Done()
+		c.write()
+	}()
+
+	keepAlive(c)
+
+	c.read()
+}
+
+// refuseWebSocket closes a websocket that was upgraded only to be refused,
+// sending the client the code and reason.
+func refuseWebSocket(ws *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	ws.Close()
+}
+
+// keepAlive pings the client every half KeepAliveTimeout, as it is when
+// each ping is sent. Each pong pushes the read deadline back by the
+// KeepAliveTimeout, so a client that stops answering fails
+// its next read and is disconnected with ReasonPongTimeout, as it is with
+// ReasonWriteError if a ping cannot be written. Pings carry the time they
+// were sent, which the pong echoes, giving the connection's round trip.
+// Browsers do not see websocket pings, so clients that speak a typed
+// protocol are sent a ping frame with each, by which they know the server
+// is there. The pinger stops once the connection's read loop has ended.
+func keepAlive(c *connection) {
+	c.ws.SetReadDeadline(time.Now().Add(c.e.runtime().KeepAliveTimeout))
+	c.ws.SetPongHandler(func(msg string) error {
+		atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+		c.e.seenClient(c.id)
+		if sent, err := strconv.ParseInt(msg, 10, 64); err == nil {
+			rtt := time.Since(time.Unix(0, sent))
+			atomic.StoreInt64(&c.rtt, int64(rtt))
+			c.slowChanged(true, rtt > c.e.options.SlowRoundTrip)
+		}
+		return c.ws.SetReadDeadline(time.Now().Add(c.e.runtime().KeepAliveTimeout))
+	})
+
+	var ping []byte
+	if c.caps.has(canPing) {
+		var err error
+		if ping, err = encodeFrame(c.codec, c.protocol, &pingFrame{}); err != nil {
+			c.e.logger.Errorf("encoding ping for %s: %v", c.id, err)
+			ping = nil
+		}
+	}
+
+	if !c.e.track() {
+		return
+	}
+
+	go func() {
+		defer c.e.wg.Done()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		<-timer.C
+		for {
+			timeout := c.e.runtime().KeepAliveTimeout
+			// WriteControl may be called concurrently with the write loop
+			now := time.Now()
+			atomic.StoreInt64(&c.lastPing, now.UnixNano())
+			err := c.ws.WriteControl(websocket.PingMessage, strconv.AppendInt(nil, now.UnixNano(), 10), now.Add(timeout/2))
+			if err != nil {
+				c.notResponding(ReasonWriteError, err)
+				return
+			}
+			if ping != nil {
+				c.c.sendPing(c.id, ping)
+			}
+			timer.Reset(timeout / 2)
+			select {
+			case <-timer.C:
+			case <-c.gone:
+				return
+			case <-c.e.done:
+				return
+			}
+		}
+	}()
+}
+
+// startRequestSpan starts a span for a request, a child of the span its
+// traceparent header identifies.
+func (e *Exchange) startRequestSpan(name string, r *http.Request) Span {
+	span := e.options.Tracer.StartSpan(name, r.Header.Get("traceparent"))
+	span.SetAttribute("relayr.remote_addr", r.RemoteAddr)
+	return span
+}
+
+func (e *Exchange) negotiateConnection(w http.ResponseWriter, r *http.Request, mount string) {
+	span := e.startRequestSpan(SpanNegotiate, r)
+	defer span.End(nil)
+
+	if opts := e.draining.Load(); opts != nil {
+		e.turnAway(w, r, opts)
+		return
+	}
+
+	principal, err := e.authorize(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if e.isBanned(principal) {
+		httpError(w, "banned", http.StatusForbidden)
+		return
+	}
+
+	jsonResponse(w)
+
+	var neg negotiation
+	body, err := readBody(w, r, e.options.MaxRequestBodySize)
+	switch {
+	case r.Context().Err() != nil:
+		// the client gave up
+		return
+	case isMaxBytesError(err):
+		httpError(w, "negotiation too large", http.StatusRequestEntityTooLarge)
+		return
+	case err == nil:
+		err = e.json.Unmarshal(body, &neg)
+	}
+	if err != nil && len(body) > 0 {
+		e.reportError(DecodeError, "", "", "", err)
+		httpError(w, "invalid negotiation", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := e.transports[neg.T]; !ok {
+		httpError(w, "unknown transport", http.StatusBadRequest)
+		return
+	}
+	if valuesSize(neg.Q) > e.options.MaxConnectionValuesSize {
+		e.logger.Infof("refusing to negotiate with %s: connection values too large", remoteIP(r))
+		httpError(w, "connection values too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	addr, userID := remoteIP(r), e.userIDFor(principal)
+	if previous := e.previousConnectionID(neg.P); previous != "" {
+		c := e.connectUser(userID, func() *client {
+			c := e.reattachClient(previous, neg.T, principal)
+			if c != nil {
+				c.transport().AddConnection(c.ConnectionID)
+			}
+			return c
+		})
+		if c != nil {
+			span.SetAttribute("relayr.connection_id", c.ConnectionID)
+			e.connectHubs(c)
+			if e.options.OnReconnect != nil {
+				e.options.OnReconnect(r, c.ConnectionID, c.state)
+			}
+			e.awaitConnection(c.ConnectionID)
+			e.setAffinity(w, r)
+			e.writeJSON(w, negotiationResponse{ConnectionID: c.ConnectionID, Codec: c.codec.Name(), Reconnected: true, Version: c.protocol, SlowRoundTrip: e.slowRoundTrip(), KeepAlive: e.keepAliveFor(neg.T), Token: e.issueToken(c.ConnectionID, userID), Instance: e.options.InstanceID, Capabilities: c.caps.names(), Upgrade: e.upgradeIntervalFor(neg.T), Probe: e.probeTimeoutFor(neg.T), Hubs: e.hubSchemas(), WebSocketURL: e.webSocketURLFor(r, mount)})
+			return
+		}
+	}
+
+	if status, err := e.admit(addr, userID); err != nil {
+		e.counters.rejected.Add(1)
+		e.logger.Infof("refusing to negotiate with %s: %v", addr, err)
+		httpError(w, err.Error(), status)
+		return
+	}
+
+	c, err := e.newClient(neg.T)
+	if err != nil {
+		e.logger.Errorf("negotiating with %s: %v", addr, err)
+		e.reportError(TransportError, "", "", "", err)
+		httpError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	span.SetAttribute("relayr.connection_id", c.ConnectionID)
+	c.principal = principal
+	c.userID = userID
+	c.addr = addr
+	c.codec = e.codecByName(neg.C)
+	c.protocol = negotiatedVersion(neg.V)
+	c.caps = negotiatedCapabilities(neg.F, c.protocol)
+	c.values = neg.Q
+	c.used = usedRelays(neg.U)
+	e.extractConnectionValues(c, r)
+	if e.options.OnNegotiate != nil {
+		e.options.OnNegotiate(r, c.ConnectionID, c.state)
+	}
+	groups := e.initialGroups(r, principal, neg.G)
+	e.connectUser(userID, func() *client {
+		c.transport().AddConnection(c.ConnectionID)
+		e.addClient(c, groups)
+		return c
+	})
+	e.connectHubs(c)
+	e.awaitConnection(c.ConnectionID)
+
+	e.setAffinity(w, r)
+	e.writeJSON(w, negotiationResponse{ConnectionID: c.ConnectionID, Codec: c.codec.Name(), Version: c.protocol, Groups: groups, SlowRoundTrip: e.slowRoundTrip(), KeepAlive: e.keepAliveFor(neg.T), Token: e.issueToken(c.ConnectionID, userID), Instance: e.options.InstanceID, Capabilities: c.caps.names(), Upgrade: e.upgradeIntervalFor(neg.T), Probe: e.probeTimeoutFor(neg.T), Hubs: e.hubSchemas(), WebSocketURL: e.webSocketURLFor(r, mount)})
+}
+
+// keepAliveFor returns the KeepAlive of a negotiation response for a
+// client using the named transport.
+func (e *Exchange) keepAliveFor(transport string) int64 {
+	if transport == "longpoll" {
+		return e.options.LongPollMaxWait.Milliseconds()
+	}
+	return (e.runtime().KeepAliveTimeout / 2).Milliseconds()
+}
+
+// valuesSize returns the size of connection values in bytes, counting
+// keys and values.
+func valuesSize(values map[string]string) int {
+	n := 0
+	for k, v := range values {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// initialGroups returns the groups a negotiating client asked to join that
+// the AllowInitialGroup callback lets it.
+func (e *Exchange) initialGroups(r *http.Request, principal interface{}, asked []string) []string {
+	if e.options.AllowInitialGroup == nil {
+		return nil
+	}
+	var groups []string
+	for _, g := range asked {
+		if containsString(groups, g) {
+			continue
+		}
+		if err := e.validateGroupName(g); err != nil {
+			e.logger.Infof("refusing to add a negotiating client to a group: %v", err)
+			continue
+		}
+		if !e.options.AllowInitialGroup(r, principal, g) {
+			e.logger.Infof("refusing to add a negotiating client to '%s'", g)
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// writeJSON writes v to w, encoded by the Exchange's JSON codec.
+func (e *Exchange) writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := e.json.Marshal(v)
+	if err != nil {
+		e.logger.Errorf("encoding a response: %v", err)
+		httpError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// authorize runs the configured Authorizer, if any, against r.
+func (e *Exchange) authorize(r *http.Request) (interface{}, error) {
+	if e.options.Authorizer == nil {
+		return nil, nil
+	}
+	return e.options.Authorizer(r)
+}
+
+func (e *Exchange) awaitLongPoll(w http.ResponseWriter, r *http.Request) {
+	cid, ok := e.connectionIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if e.codecFor(cid).Binary() {
+		w.Header().Set("Content-type", "application/octet-stream")
+	} else {
+		jsonResponse(w)
+	}
+	// the last sequence number the client has seen; it is sent again
+	// anything after that which it missed
+	seq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	e.seenClient(cid)
+	longPoll := e.transports["longpoll"].(*longPollTransport)
+	if c := e.getClientByConnectionID(cid); c != nil && c.transport() == e.transports["websocket"] {
+		longPoll.upgradedAway(w, cid)
+		return
+	}
+	if e.connectionEstablished(cid) && e.hasConnectHooks() {
+		longPoll.hold(cid)
+		go e.welcome(cid, func() {
+			longPoll.release(cid)
+		})
+	}
+	longPoll.wait(r.Context(), w, cid, seq)
+}
+
+func (e *Exchange) callServer(w http.ResponseWriter, r *http.Request) {
+	cid, ok := e.connectionIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	e.transports["longpoll"].(*longPollTransport).touch(cid)
+	e.touchClient(cid)
+	body, err := readBody(w, r, e.runtime().MaxMessageSize)
+	if r.Context().Err() != nil {
+		// the client gave up
+		return
+	}
+	if err != nil {
+		e.counters.oversized.Add(1)
+		e.recordConnectionError(DecodeError, cid, "", "", errMessageTooLarge)
+		e.logger.Infof("connection %s sent an oversized call", cid)
+		e.refuseCall(w, http.StatusRequestEntityTooLarge, cid, &inboundFrame{}, errMessageTooLarge)
+		return
+	}
+	e.counters.read.Add(1)
+	e.counters.received.Add(1)
+	e.tapFrame(cid, tapInbound, body)
+	codec, version := e.protocolFor(cid)
+	msg, err := decodeFrame(codec, version, body)
+	if err != nil {
+		e.logger.Errorf("connection %s sent an invalid call: %v", cid, err)
+		e.reportError(DecodeError, cid, "", "", err)
+		httpError(w, "invalid call", http.StatusBadRequest)
+		return
+	}
+	if msg.ConnectionID != "" && msg.ConnectionID != cid {
+		e.logger.Errorf("connection %s sent a call as %s", cid, msg.ConnectionID)
+		httpError(w, errForgedConnectionID.Error(), http.StatusForbidden)
+		return
+	}
+	if msg.Type == framePing {
+		e.sendFrame(cid, "ping", &pingFrame{})
+		return
+	}
+	if msg.Hub != "" {
+		e.receiveHubFrame(cid, &msg)
+		jsonResponse(w)
+		e.writeJSON(w, callReceipt{Accepted: true, InvocationID: msg.InvocationID})
+		return
+	}
+	if msg.Type == frameUploadChunk {
+		e.receiveUploadChunk(cid, &msg, len(body))
+		jsonResponse(w)
+		e.writeJSON(w, callReceipt{Accepted: true, InvocationID: msg.InvocationID})
+		return
+	}
+	if msg.Method == ackMethod {
+		e.receiveAck(cid, msg.Arguments)
+		return
+	}
+	if msg.Method == cancelMethod {
+		e.receiveCancel(cid, msg.Arguments)
+		return
+	}
+	if msg.Method == stateMethod {
+		e.receiveStateRequest(cid, msg.Arguments)
+		return
+	}
+	if msg.Type == frameJoinGroup || msg.Type == frameLeaveGroup {
+		changed, err := e.receiveGroupRequest(cid, &msg)
+		if err != nil {
+			e.refuseCall(w, groupRequestStatus(err), cid, &msg, err)
+			return
+		}
+		jsonResponse(w)
+		e.writeJSON(w, callReceipt{Accepted: true, InvocationID: msg.InvocationID})
+		e.sendResult(cid, msg.InvocationID, changed, nil)
+		return
+	}
+	if e.duplicateCall(cid, &msg) {
+		jsonResponse(w)
+		e.writeJSON(w, callReceipt{Accepted: true, InvocationID: msg.InvocationID})
+		return
+	}
+	if err := e.allowCall(cid, msg.Relay, msg.Method); err != nil {
+		e.refuseCall(w, http.StatusTooManyRequests, cid, &msg, err)
+		return
+	}
+	if relay := e.getRelayByName(msg.Relay, cid); relay == nil {
+		err := &CallError{Relay: msg.Relay, Reason: "does not exist"}
+		e.logger.Errorf("connection %s: %v", cid, err)
+		e.reportError(DispatchError, cid, msg.Relay, msg.Method, err)
+		e.refuseCall(w, http.StatusNotFound, cid, &msg, err)
+		return
+	} else if _, err := relay.checkCall(msg.Method, len(msg.Arguments)); err != nil {
+		status := http.StatusBadRequest
+		if _, ok := relay.resolveMethod(msg.Method); !ok {
+			status = http.StatusNotFound
+		}
+		e.logger.Errorf("connection %s: %v", cid, err)
+		e.counters.failedCalls.Add(1)
+		e.reportError(DispatchError, cid, msg.Relay, msg.Method, err)
+		e.refuseCall(w, status, cid, &msg, err)
+		return
+	}
+	if err := e.authorizeCall(cid, "longpoll", msg.Relay, msg.Method, msg.Arguments); err != nil {
+		e.refuseCall(w, http.StatusForbidden, cid, &msg, err)
+		return
+	}
+	if msg.Upload {
+		e.openUpload(cid, msg.InvocationID)
+	}
+	values := e.extractValues(r)
+	err = e.runCall(cid, msg.Relay, msg.Method, func() {
+		e.serveCall(msg.Relay, cid, "longpoll", msg.InvocationID, msg.TraceParent, msg.Method, msg.Arguments, values)
+	})
+	if err != nil {
+		e.uploads.remove(cid, msg.InvocationID)
+		e.logger.Infof("refusing a call from %s: %v", cid, err)
+		e.refuseCall(w, http.StatusServiceUnavailable, cid, &msg, err)
+		return
+	}
+	jsonResponse(w)
+	e.writeJSON(w, callReceipt{Accepted: true, InvocationID: msg.InvocationID})
+}
+
+// refuseCall answers a call made over long polling that will not run with
+// status and a receipt saying why. The call's result is sent through the
+// poll as well, for clients that do not read the receipt.
+func (e *Exchange) refuseCall(w http.ResponseWriter, status int, cid string, msg *inboundFrame, err error) {
+	e.forgetCall(cid, msg.CallID)
+	b, merr := e.json.Marshal(callReceipt{InvocationID: msg.InvocationID, Error: err.Error(), Code: errorCode(err)})
+	if merr != nil {
+		httpError(w, err.Error(), status)
+		return
+	}
+	jsonResponse(w)
+	w.WriteHeader(status)
+	w.Write(b)
+	e.sendResult(cid, msg.InvocationID, nil, err)
+}
+
+// serveCall invokes a relay method for a client and sends the outcome
+// back to it. It runs off the goroutine that received the call, so a
+// panic that escapes the relay method is logged rather than allowed to
+// crash the process. values are those the ContextExtractor took from the
+// request carrying the call, if any.
+func (e *Exchange) serveCall(relayName, cid, transport, invocationID, trace, fn string, args []interface{}, values map[string]interface{}) {
+	defer func() {
+		if p := recover(); p != nil {
+			e.logger.Errorf("panic serving %s.%s for %s: %v\n%s", relayName, fn, cid, p, debug.Stack())
+			e.reportError(DispatchError, cid, relayName, fn, fmt.Errorf("relayr: panic: %v", p))
+		}
+	}()
+
+	e.emit(ExchangeEvent{Type: EventCallReceived, ConnectionID: cid, Transport: transport, Relay: relayName, Method: fn})
+	relay := e.getRelayByName(relayName, cid)
+	if relay == nil {
+		err := &CallError{Relay: relayName, Reason: "does not exist"}
+		e.logger.Errorf("connection %s: %v", cid, err)
+		e.reportError(DispatchError, cid, relayName, fn, err)
+		if invocationID == "" {
+			e.sendError(cid, err)
+			return
+		}
+		e.sendResult(cid, invocationID, nil, err)
+		return
+	}
+
+	relay.values = values
+	result, err := e.invoke(relay, cid, transport, invocationID, trace, fn, args)
+	if err != nil {
+		e.logger.Errorf("connection %s: %v", cid, err)
+	}
+	e.rememberResult(cid, invocationID, result, err)
+	e.sendResult(cid, invocationID, result, err)
+}
+
+// sendResult delivers the outcome of a server method invocation to the
+// client that invoked it. Clients that did not supply an InvocationID
+// are not waiting for a result, so nothing is sent.
+func (e *Exchange) sendResult(cid, invocationID string, result interface{}, err error) {
+	if invocationID == "" {
+		return
+	}
+
+	res := &completion{InvocationID: invocationID, Value: result}
+	if err != nil {
+		res.Error, res.Code = err.Error(), errorCode(err)
+	}
+	e.sendFrame(cid, "result", res)
+}
+
+// sendError tells a client about an error in a message it sent that has
+// no invocation to report it against.
+func (e *Exchange) sendError(cid string, err error) {
+	e.sendFrame(cid, "error", &errorFrame{Error: err.Error(), Code: errorCode(err)})
+}
+
+// sendFrame encodes f for the client and sends it. what describes f in
+// the log.
+func (e *Exchange) sendFrame(cid, what string, f frame) {
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return
+	}
+	s, ok := c.transport().(rawSender)
+	if !ok {
+		return
+	}
+
+	data, err := encodeFrame(c.codec, c.protocol, f)
+	if err != nil {
+		e.logger.Errorf("encoding %s for %s: %v", what, cid, err)
+		e.reportError(TransportError, cid, "", "", err)
+		return
+	}
+	send := s.sendRaw
+	if isUrgent(f) {
+		send = urgentSend(s)
+	}
+	if err := send(cid, data); errors.Is(err, ErrConnectionNotFound) {
+		// the client went as it was sent the frame, which is routine
+		e.logger.Debugf("sending %s to %s: %v", what, cid, err)
+	} else if err != nil {
+		e.logger.Errorf("sending %s to %s: %v", what, cid, err)
+		e.reportError(TransportError, cid, "", "", err)
+	}
+}
+
+// connectionIDFromRequest returns the ConnectionID r was made for when it
+// names a client that negotiated with the Exchange and has not since gone
+// away. Otherwise it answers the request with 400, 401 for a connection
+// token that is tampered with or expired, or 403, and returns false.
+func (e *Exchange) connectionIDFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cid, err := e.requestConnectionID(r)
+	if err == errMissingConnectionID {
+		httpError(w, "missing connectionId", http.StatusBadRequest)
+		return "", false
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	if e.getClientByConnectionID(cid) == nil {
+		httpError(w, "unknown connection", http.StatusForbidden)
+		return "", false
+	}
+
+	return cid, true
+}
+
+// newClient returns a client negotiating over the named transport, with a
+// ConnectionID from the IDGenerator that no other client has. The ID is
+// held as negotiating, so that the client can be tagged before addClient
+// adds it. It returns an error if the IDGenerator gives an ID that is not
+// URL-safe, or only IDs in use.
+func (e *Exchange) newClient(t string) (*client, error) {
+	for i := 0; i < idAttempts; i++ {
+		id := e.options.IDGenerator()
+		if !isURLSafe(id) {
+			return nil, errUnsafeID
+		}
+		e.mapLock.Lock()
+		taken := e.knownLocked(id)
+		if !taken {
+			e.negotiating[id] = struct{}{}
+		}
+		e.mapLock.Unlock()
+		if taken {
+			e.logger.Infof("IDGenerator returned ConnectionID %s, which is in use", id)
+			continue
+		}
+
+		return e.makeClient(id, t), nil
+	}
+	return nil, errIDsTaken
+}
+
+// makeClient returns a client with the given ConnectionID negotiating over
+// the named transport.
+func (e *Exchange) makeClient(id, t string) *client {
+	c := &client{
+		ConnectionID: id,
+		exchange:     e,
+		state:        newConnectionState(),
+		extracted:    newConnectionState(),
+		limiter:      newCallLimiter(),
+		bandwidth:    &bandwidth{},
+		gone:         make(chan struct{}),
+		recent:       newRecentCalls(),
+	}
+	c.setTransport(e.transports[t])
+	c.touch()
+	c.seen()
+	return c
+}
+
+// addClient adds a client that has just negotiated to the Exchange, and to
+// Global unless DisableAutoJoinGlobal is set, and to the given groups at
+// once, so that it is in all of them or none.
+func (e *Exchange) addClient(c *client, groups []string) {
+	e.mapLock.Lock()
+	e.registerLocked(c)
+	if !e.options.DisableAutoJoinGlobal {
+		e.addToGroupLocked("Global", c, true)
+	}
+	for _, g := range groups {
+		e.addToGroupLocked(g, c, true)
+	}
+	e.addUserLocked(c)
+	e.addAddrLocked(c)
+	delete(e.negotiating, c.ConnectionID)
+	e.mapLock.Unlock()
+}
+
+// registerLocked adds a client to the clients connected to the Exchange,
+// which it must be in before it joins any group. The caller must hold
+// mapLock for writing.
+func (e *Exchange) registerLocked(c *client) {
+	e.connected[c.ConnectionID] = c
+	e.counters.added.Add(1)
+	transport := e.transportName(c.transport())
+	e.conns.add(c, transport)
+	e.emit(ExchangeEvent{Type: EventConnected, ConnectionID: c.ConnectionID, Transport: transport})
+}
+
+// unregisterLocked removes a client from the clients connected to the
+// Exchange, once it has left its groups, reporting whether it was
+// connected, and reports the reason it disconnected. The caller must hold
+// mapLock for writing.
+func (e *Exchange) unregisterLocked(id, reason string) bool {
+	if _, ok := e.connected[id]; !ok {
+		return false
+	}
+	delete(e.connected, id)
+	e.counters.removed.Add(1)
+	e.conns.remove(id)
+	e.emit(ExchangeEvent{Type: EventDisconnected, ConnectionID: id, Reason: reason})
+	return true
+}
+
+// clientsLocked returns the clients connected to the Exchange. The caller
+// must hold mapLock.
+func (e *Exchange) clientsLocked() []*client {
+	r := make([]*client, 0, len(e.connected))
+	for _, c := range e.connected {
+		r = append(r, c)
+	}
+	return r
+}
+
+// connectionIDs returns the ConnectionIDs of the clients connected to the
+// Exchange.
+func (e *Exchange) connectionIDs() []string {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	r := make([]string, 0, len(e.connected))
+	for id := range e.connected {
+		r = append(r, id)
+	}
+	return r
+}
+
+// clientScriptFor returns the client script for the given URLs, from the
+// cache if possible.
+func (e *Exchange) clientScriptFor(baseURL, route string) clientScript {
+	key := baseURL + "\x00" + route
+
+	e.scriptLock.Lock()
+	cache := cacheEnabled && !e.options.DisableScriptCache
+	script, ok := e.scriptCache[key]
+	gen, transform := e.scriptGen, e.scriptTransform
+	e.scriptLock.Unlock()
+
+	if ok && cache {
+		return script
+	}
+
+	raw := e.generateClientScript(baseURL, route)
+	size := len(raw)
+	var sourceMap []byte
+	switch {
+	case transform != nil:
+		raw, sourceMap = transform(raw)
+	case ClientScriptFunc != nil:
+		raw = ClientScriptFunc(raw)
+	case !e.options.DisableScriptMinify:
+		raw = minifyScript(raw)
+	}
+	e.scriptSizes.Store(&[2]int{size, len(raw)})
+	if len(sourceMap) > 0 {
+		raw = append(raw, "\n//# sourceMappingURL="+route+"/"+opSourceMap+"\n"...)
+	}
+	script = newClientScript(raw)
+	script.sourceMap = sourceMap
+
+	if cache {
+		e.scriptLock.Lock()
+		// don't cache a script generated from stale relays or transform
+		if e.scriptGen == gen && len(e.scriptCache) < maxCachedScripts {
+			e.scriptCache[key] = script
+		}
+		e.scriptLock.Unlock()
 	}
-}
 
-func extractOperationFromURL(r *http.Request) string {
-	lastSlash := strings.LastIndex(r.URL.Path, "/")
-	return r.URL.Path[lastSlash+1:]
+	return script
 }
 
-func (e *Exchange) upgradeWebSocket(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err.Error())
-		return
+func (e *Exchange) writeClientScript(w http.ResponseWriter, r *http.Request, baseURL, route string) {
+	script := e.clientScriptFor(baseURL, route)
+
+	h := w.Header()
+	h.Set("Content-Type", "application/javascript; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	// so that the browser connects to the Exchange while the script loads,
+	// ready to negotiate; a route without a host is on the page's own
+	if strings.Contains(route, "://") {
+		h.Add("Link", "<"+route+"/"+opNegotiate+">; rel=preconnect")
 	}
+	writeCached(w, r, script)
+}
 
-	c := &connection{
-		e:   e,
-		out: make(chan []byte, 10*1024),
-		ws:  ws,
-		c:   e.transports["websocket"].(*webSocketTransport),
-		id:  r.URL.Query()["connectionId"][0],
+// writeCached writes a generated script, or another body cached as one,
+// gzipped if the client accepts it, or just its ETag if the client has it
+// already.
+func writeCached(w http.ResponseWriter, r *http.Request, script clientScript) {
+	body, etag := script.body, script.etag
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		body, etag = script.gzipped, script.gzipEtag
+		h.Set("Content-Encoding", "gzip")
 	}
+	h.Set("ETag", etag)
 
-	c.c.connected <- c
-	defer func() { c.c.disconnected <- c }()
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		return
+	}
 
-	go c.write()
+	w.Write(body)
+}
 
-	keepAlive(c, 40*time.Second)
+// Freeze closes the Exchange to registration, after which
+// RegisterTransport returns an error, so that every client negotiates the
+// same transports. Relays may still be registered and unregistered, and
+// connected clients are told. The first request served freezes the
+// Exchange if it has not been already. With a MountPath, Freeze also
+// generates the client script served under it, so that the first request
+// for it does not have to.
+func (e *Exchange) Freeze() {
+	if e.frozen.Swap(true) {
+		return
+	}
+	if mount := strings.TrimSuffix(e.options.MountPath, "/"); mount != "" && !e.options.AutoDetectOrigin {
+		e.clientScriptFor(e.mainURLWithoutScheme+mount, e.mainURL+mount)
+	}
+}
 
-	c.read()
+// GenerateClientScript returns the client script the Exchange serves for
+// the given URLs, so that it can be generated ahead of time, served from
+// a CDN or bundled with other assets. route is the URL the Exchange is
+// served at, e.g. "https://example.com/relayr", and baseURL is route
+// without its scheme, e.g. "example.com/relayr". The script is exactly
+// the one served, transformed by any ScriptTransform, and is cached to be
+// served in turn. Relays registered later are not included, though
+// clients connected when they are registered are told of them.
+func (e *Exchange) GenerateClientScript(baseURL, route string) []byte {
+	return e.clientScriptFor(baseURL, route).body
 }
 
-func keepAlive(c *connection, timeout time.Duration) {
-	lastResponse := time.Now()
-	c.ws.SetPongHandler(func(msg string) error {
-		lastResponse = time.Now()
-		return nil
-	})
+func (e *Exchange) generateClientScript(baseURL, route string) []byte {
+	buff := bytes.Buffer{}
 
-	go func() {
-		for {
-			err := c.ws.WriteMessage(websocket.PingMessage, []byte("keepalive"))
-			if err != nil {
-				return
-			}
-			time.Sleep(timeout / 2)
-			if time.Now().Sub(lastResponse) > timeout {
-				c.ws.Close()
-				return
-			}
-		}
-	}()
-}
+	manifest, _ := json.Marshal(e.manifestFor(baseURL, route))
+	buff.WriteString(connectionClassScript)
+	buff.WriteString("RelayRConnection.configure(")
+	buff.Write(manifest)
+	buff.WriteString(");\n")
 
-func (e *Exchange) negotiateConnection(w http.ResponseWriter, r *http.Request) {
-	jsonResponse(w)
-	decoder := json.NewDecoder(r.Body)
+	return buff.Bytes()
+}
 
-	var neg negotiation
+// writeSourceMap serves the source map returned by the ScriptTransform for
+// the client script with the given URLs.
+func (e *Exchange) writeSourceMap(w http.ResponseWriter, r *http.Request, baseURL, route string) {
+	script := e.clientScriptFor(baseURL, route)
+	if len(script.sourceMap) == 0 {
+		httpError(w, "not found", http.StatusNotFound)
+		return
+	}
 
-	decoder.Decode(&neg)
+	jsonResponse(w)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(script.sourceMap)
+}
 
-	encoder := json.NewEncoder(w)
+// ScriptTransform alters the generated client script, for example to
+// minify it. It may also return a source map for the transformed script,
+// which is then linked from the script and served alongside it; otherwise
+// sourceMap should be nil.
+type ScriptTransform func(script []byte) (transformed, sourceMap []byte)
+
+// SetClientScriptTransform sets the transform applied to this Exchange's
+// client script, replacing any cached scripts. It takes precedence over
+// the package-level ClientScriptFunc. A nil transform removes it.
+func (e *Exchange) SetClientScriptTransform(fn ScriptTransform) {
+	e.scriptLock.Lock()
+	defer e.scriptLock.Unlock()
+	e.scriptTransform = fn
+	e.scriptGen++
+	e.scriptCache = make(map[string]clientScript)
+}
 
-	e.mapLock.Lock()
-	encoder.Encode(negotiationResponse{ConnectionID: e.addClient(neg.T)})
-	e.mapLock.Unlock()
+// DisableScriptCache forces the Exchange's client-side script to be
+// regenerated on each request, rather than serving it from a cache.
+func (e *Exchange) DisableScriptCache() {
+	e.scriptLock.Lock()
+	defer e.scriptLock.Unlock()
+	e.options.DisableScriptCache = true
+	e.scriptGen++
+	e.scriptCache = make(map[string]clientScript)
 }
 
-func (e *Exchange) awaitLongPoll(w http.ResponseWriter, r *http.Request) {
-	jsonResponse(w)
-	cid := e.extractConnectionIDFromURL(r)
-	longPoll := e.transports["longpoll"].(*longPollTransport)
-	longPoll.wait(w, cid)
+// invalidateScriptCache discards any generated client scripts so that
+// they are rebuilt on the next request.
+func (e *Exchange) invalidateScriptCache() {
+	e.scriptLock.Lock()
+	defer e.scriptLock.Unlock()
+	e.scriptGen++
+	e.scriptCache = make(map[string]clientScript)
 }
 
-func (e *Exchange) callServer(w http.ResponseWriter, r *http.Request) {
-	var msg longPollServerCall
-	decoder := json.NewDecoder(r.Body)
-	decoder.Decode(&msg)
-	cid := e.extractConnectionIDFromURL(r)
-	relay := e.getRelayByName(msg.Relay, cid)
-	go e.callRelayMethod(relay, msg.Method, msg.Arguments...)
+// RegisterRelay registers a struct, or a pointer to one, as a Relay with
+// the Exchange. This allows clients to invoke server methods on a Relay and
+// allows the Exchange to invoke methods on a Relay on the server side. The
+// Relay is named after the struct's type.
+//
+// Methods are called on x itself, so it may carry dependencies such as a
+// database handle. They are called from many goroutines at once, so any
+// state they change must be guarded. A struct passed by value is copied
+// once, when it is registered. Use RegisterRelayFactory for a fresh
+// instance per call. Relays may be registered while the Exchange serves
+// clients; the client script is regenerated, and connected clients are
+// sent the new relays, which the client script adds to RelayR.
+func (e *Exchange) RegisterRelay(x interface{}) error {
+	if !isRelay(x) {
+		return errInvalidRelay
+	}
+	return e.RegisterRelayWithName(x, relayStructType(x).Name())
 }
 
-func (e *Exchange) extractConnectionIDFromURL(r *http.Request) string {
-	return r.URL.Query()["connectionId"][0]
+// RegisterRelayWithName registers a struct as a Relay under an explicit name,
+// which is how clients refer to it. The name must be a valid Javascript
+// identifier, and neither the name nor the struct's type may already be
+// registered.
+func (e *Exchange) RegisterRelayWithName(x interface{}, name string) error {
+	if !isRelay(x) {
+		return errInvalidRelay
+	}
+	return e.registerRelay(name, relayReceiver(x), nil, reflect.ValueOf(x).Kind() != reflect.Ptr)
 }
 
-func (e *Exchange) addClient(t string) string {
-	cID := generateConnectionID()
-	client := &client{ConnectionID: cID, exchange: e, transport: e.transports[t]}
-	// e.mapLock.Lock()
-	e.groups["Global"] = append(e.groups["Global"], client)
-	// e.mapLock.Unlock()
-	return cID
+// RegisterRelayFactory registers a Relay under name whose methods are each
+// called on a new instance returned by factory, as a struct or a pointer
+// to one. The factory must always return the same type.
+func (e *Exchange) RegisterRelayFactory(name string, factory func() interface{}) error {
+	x := factory()
+	if !isRelay(x) {
+		return errInvalidRelay
+	}
+	return e.registerRelay(name, relayReceiver(x), factory, false)
 }
 
-func (e *Exchange) writeClientScript(w http.ResponseWriter, baseURL, route string) {
-	if len(clientScript) > 0 && cacheEnabled {
-		io.Copy(w, bytes.NewBuffer(clientScript))
-	} else {
-		resultBuff := bytes.Buffer{}
-		buff := bytes.Buffer{}
+func (e *Exchange) registerRelay(name string, receiver reflect.Value, factory func() interface{}, byValue bool) error {
+	if !isJavascriptIdentifier(name) {
+		return fmt.Errorf("relayr: relay name %q is not a valid Javascript identifier", name)
+	}
 
-		buff.WriteString(fmt.Sprintf(connectionClassScript, baseURL, route))
+	e.relayLock.Lock()
+	defer e.relayLock.Unlock()
+	old := e.relayList()
+	t := receiver.Type().Elem()
+	for _, r := range old {
+		if r.Name == name {
+			return fmt.Errorf("relayr: a relay named %q is already registered", name)
+		}
+		if r.t == t {
+			return fmt.Errorf("relayr: %v is already registered as relay %q", t, r.Name)
+		}
+	}
 
-		buff.WriteString(relayClassBegin)
+	methods := e.getMethodsForRelay(receiver)
+	resolved, err := resolveMethods(methods)
+	if err != nil {
+		return fmt.Errorf("relayr: relay %q: %v", name, err)
+	}
+	for _, m := range methods {
+		if err := checkSignature(receiver.MethodByName(m).Type()); err != nil {
+			return fmt.Errorf("relayr: relay %q: method %s %v", name, m, err)
+		}
+	}
+	issues, refused := e.validateRelay(name, receiver, methods, byValue)
+	for _, i := range issues {
+		if i.Severity == SeverityError {
+			e.logger.Errorf("%s", i.describe())
+		} else {
+			e.logger.Infof("%s", i.describe())
+		}
+	}
 
-		for _, relay := range e.relays {
-			buff.WriteString(fmt.Sprintf(relayBegin, relay.Name))
+	relays := make([]Relay, len(old), len(old)+1)
+	copy(relays, old)
+	relays = append(relays, Relay{
+		Name:             name,
+		UnderlyingStruct: receiver.Interface(),
+		t:                t,
+		receiver:         receiver,
+		factory:          factory,
+		methods:          methods,
+		resolved:         resolved,
+		refused:          refused,
+		issues:           issues,
+		exchange:         e,
+	})
+	e.relays.Store(&relays)
+	e.invalidateScriptCache()
+	e.relaysChanged()
 
-			for _, method := range relay.methods {
-				buff.WriteString(fmt.Sprintf(relayMethod, lowerFirst(method), relay.Name, method))
+	return nil
+}
 
-			}
-			buff.WriteString(relayEnd)
+// commandRelays is the command of the control frame that gives clients
+// the schema of the relays once they change.
+const commandRelays = protocol.CommandRelays
+
+// UnregisterRelay removes the relay registered under name. Calls clients
+// make to it from then on fail as calls to an unknown relay, while those
+// already running finish. The client script is regenerated, and connected
+// clients are told, the client script removing the relay from RelayR.
+func (e *Exchange) UnregisterRelay(name string) error {
+	e.relayLock.Lock()
+	defer e.relayLock.Unlock()
+	old := e.relayList()
+	relays := make([]Relay, 0, len(old))
+	for _, r := range old {
+		if r.Name != name {
+			relays = append(relays, r)
 		}
+	}
+	if len(relays) == len(old) {
+		return fmt.Errorf("relayr: no relay named %q is registered", name)
+	}
 
-		buff.WriteString(relayClassEnd)
+	e.relays.Store(&relays)
+	e.invalidateScriptCache()
+	e.relaysChanged()
 
-		if ClientScriptFunc != nil {
-			resultBuff.Write(ClientScriptFunc(buff.Bytes()))
-		} else {
-			resultBuff.Write(buff.Bytes())
-		}
+	return nil
+}
 
-		if cacheEnabled {
-			clientScript = resultBuff.Bytes()
-		}
+// relayList returns the registered relays, which must not be changed.
+func (e *Exchange) relayList() []Relay {
+	if relays := e.relays.Load(); relays != nil {
+		return *relays
+	}
+	return nil
+}
+
+// relaysChanged sends the connected clients the schema of the relays, now
+// that they have changed, so that the client script can add stubs for
+// those it does not have and remove those that have gone. The caller must
+// hold relayLock, so that the schemas are sent in the order the relays
+// changed in.
+func (e *Exchange) relaysChanged() {
+	e.mapLock.RLock()
+	ids := make([]string, 0, len(e.connected))
+	for id := range e.connected {
+		ids = append(ids, id)
+	}
+	e.mapLock.RUnlock()
+	if len(ids) == 0 {
+		return
+	}
 
-		io.Copy(w, &resultBuff)
+	schema := e.Schema()
+	e.logger.Debugf("telling %d clients the relays changed", len(ids))
+	for _, id := range ids {
+		e.sendFrame(id, "relay schema", &controlFrame{Command: commandRelays, Relays: schema})
 	}
 }
 
-// RegisterRelay registers a struct as a Relay with the Exchange. This allows clients
-// to invoke server methods on a Relay and allows the Exchange to invoke
-// methods on a Relay on the server side.
-func (e *Exchange) RegisterRelay(x interface{}) {
-	t := reflect.TypeOf(x)
+// isRelay reports whether x can be registered as a relay: a struct, or a
+// pointer to one that methods can be called through.
+func isRelay(x interface{}) bool {
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Struct
+}
 
-	methods := e.getMethodsForType(t)
+// relayStructType returns the struct type of a relay passed by value or
+// by pointer.
+func relayStructType(x interface{}) reflect.Type {
+	t := reflect.TypeOf(x)
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
 
-	e.relays = append(e.relays, Relay{Name: t.Name(), UnderlyingStruct: x, t: t, methods: methods, exchange: e})
+// relayReceiver returns a pointer to a relay, through which both its value
+// and pointer methods can be called. A relay passed by value is copied.
+func relayReceiver(x interface{}) reflect.Value {
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Ptr {
+		return v
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p
 }
 
-func (e *Exchange) getMethodsForType(t reflect.Type) []string {
+// getMethodsForRelay returns the methods of a relay that clients may call.
+// If the relay implements MethodExposer, only the methods it lists are
+// exposed; otherwise every method taking a *Relay as its first parameter is.
+func (e *Exchange) getMethodsForRelay(receiver reflect.Value) []string {
 	r := []string{}
+	t := receiver.Type()
+	if exposer, ok := receiver.Interface().(MethodExposer); ok {
+		for _, name := range exposer.RelayMethods() {
+			if _, ok := t.MethodByName(name); ok {
+				r = append(r, name)
+			}
+		}
+		return r
+	}
+
 	for i := 0; i < t.NumMethod(); i++ {
-		r = append(r, t.Method(i).Name)
+		m := t.Method(i)
+		if m.Type.NumIn() > 1 && m.Type.In(1) == relayType {
+			r = append(r, m.Name)
+		}
 	}
 
 	return r
@@ -261,12 +1699,17 @@ func (e *Exchange) getMethodsForType(t reflect.Type) []string {
 
 func (e *Exchange) getRelayByName(name string, cID string) *Relay {
 	// Create an instance of Relay
-	for _, r := range e.relays {
+	for _, r := range e.relayList() {
 		if r.Name == name {
 			relay := &Relay{
 				Name:             name,
 				ConnectionID:     cID,
 				t:                r.t,
+				receiver:         r.receiver,
+				factory:          r.factory,
+				methods:          r.methods,
+				resolved:         r.resolved,
+				refused:          r.refused,
 				exchange:         e,
 				UnderlyingStruct: r.UnderlyingStruct,
 			}
@@ -283,166 +1726,625 @@ func (e *Exchange) getRelayByName(name string, cID string) *Relay {
 	return nil
 }
 
-func (e *Exchange) callRelayMethod(relay *Relay, fn string, args ...interface{}) error {
-	newInstance := reflect.New(relay.t)
-	method := newInstance.MethodByName(fn)
-	empty := reflect.Value{}
-	if method == empty {
-		return fmt.Errorf("Method '%v' does not exist on relay '%v'", fn, relay.Name)
+// callRelayMethod invokes a server method on a relay. A method may return
+// nothing, a value, an error, or a value followed by an error.
+func (e *Exchange) callRelayMethod(relay *Relay, fn string, args ...interface{}) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			e.logger.Errorf("panic in %s.%s: %v\n%s", relay.Name, fn, p, debug.Stack())
+			err = fmt.Errorf("relayr: %s.%s panicked: %v", relay.Name, fn, p)
+		}
+	}()
+
+	name, err := relay.checkCall(fn, len(args))
+	if err != nil {
+		return nil, err
+	}
+	receiver := relay.receiver
+	if relay.factory != nil {
+		receiver = relayReceiver(relay.factory())
+		relay.UnderlyingStruct = receiver.Interface()
+	}
+	method := receiver.MethodByName(name)
+
+	t := method.Type()
+
+	in, err := buildArgValues(e.json, relay, t, args...)
+	if err != nil {
+		return nil, &CallError{Relay: relay.Name, Method: name, Reason: err.Error()}
+	}
+	var lead []reflect.Value
+	if takesLead(t, relayType) {
+		lead = append(lead, reflect.ValueOf(relay))
+	}
+	if takesLead(t, contextType) {
+		lead = append(lead, reflect.ValueOf(relay.context()))
+	}
+	if takesUpload(t) {
+		upload := relay.upload
+		if upload == nil {
+			upload = endedStream()
+		}
+		lead = append(lead, reflect.ValueOf(upload))
+	}
+	if takesProgress(t) {
+		progress := relay.progress
+		if progress == nil {
+			progress = noProgress{}
+		}
+		lead = append(lead, reflect.ValueOf(progress))
+	}
+	in = append(lead, in...)
+	zeroNilArgs(t, in)
+
+	return methodResults(method.Call(in))
+}
+
+func methodResults(out []reflect.Value) (interface{}, error) {
+	var result interface{}
+	var err error
+	for _, v := range out {
+		if v.Type() == errorType {
+			if !v.IsNil() {
+				err = v.Interface().(error)
+			}
+			continue
+		}
+		result = v.Interface()
 	}
-	method.Call(buildArgValues(relay, args...))
 
-	return nil
+	return result, err
 }
 
-func buildArgValues(relay *Relay, args ...interface{}) []reflect.Value {
-	r := []reflect.Value{reflect.ValueOf(relay)}
-	for _, a := range args {
-		r = append(r, reflect.ValueOf(a))
+// buildArgValues returns the arguments of a call to a relay method of type
+// t, each converted to the parameter it is passed for, those for a
+// variadic parameter to its items. An argument that cannot be is reported
+// by its position.
+func buildArgValues(codec Codec, relay *Relay, t reflect.Type, args ...interface{}) ([]reflect.Value, error) {
+	r := make([]reflect.Value, 0, len(args))
+	first := firstArg(t)
+	for i, a := range args {
+		v, err := convertArg(codec, paramType(t, first+i), a, relay.exchange.options.UseJSONNumber)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+		r = append(r, v)
 	}
 
-	return r
+	return r, nil
+}
+
+// zeroNilArgs replaces the invalid values that buildArgValues produces for
+// nil arguments with the zero value of the corresponding parameter.
+func zeroNilArgs(t reflect.Type, in []reflect.Value) {
+	for i, v := range in {
+		if v.IsValid() {
+			continue
+		}
+		switch {
+		case t.IsVariadic() && i >= t.NumIn()-1:
+			in[i] = reflect.Zero(t.In(t.NumIn() - 1).Elem())
+		case i < t.NumIn():
+			in[i] = reflect.Zero(t.In(i))
+		}
+	}
 }
 
 // Relay generates an instance of a Relay, allowing calls to be made to
-// it on the server side. It is generated a random ConnectionID for the duration
-// of the call and it does not represent an actual client.
+// it on the server side. It does not represent an actual client: its
+// ConnectionID is empty, so client methods called through it are
+// broadcast to every connected client. It returns nil if x's type has
+// not been registered.
 func (e *Exchange) Relay(x interface{}) *Relay {
-	return e.getRelayByName(reflect.TypeOf(x).Name(), generateConnectionID())
+	name, ok := e.relayName(x)
+	if !ok {
+		return nil
+	}
+	return e.getRelayByName(name, "")
+}
+
+// MustRelay is like Relay, but panics if x's type has not been registered,
+// so that a relay looked up at startup cannot turn out to be missing while
+// serving a request.
+func (e *Exchange) MustRelay(x interface{}) *Relay {
+	r := e.Relay(x)
+	if r == nil {
+		panic(fmt.Sprintf("relayr: %v is not a registered relay", relayStructType(x)))
+	}
+	return r
+}
+
+// relayName returns the name x's type is registered under.
+func (e *Exchange) relayName(x interface{}) (string, bool) {
+	t := relayStructType(x)
+	for _, r := range e.relayList() {
+		if r.t == t {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
+
+// Clients returns the ClientOperations of the relay registered for
+// relayType's type, for pushing to clients from outside a relay method,
+// such as from a background job. All reaches every connected client,
+// whatever its groups, and calls to a group with no members do nothing.
+// Caller and Others have no caller to refer to. It returns nil if the
+// type has not been registered.
+func (e *Exchange) Clients(relayType interface{}) *ClientOperations {
+	if r := e.Relay(relayType); r != nil {
+		return r.Clients
+	}
+	return nil
 }
 
-func (e *Exchange) callClientMethod(r *Relay, fn string, args ...interface{}) {
+func (e *Exchange) callClientMethod(r *Relay, fn string, args ...interface{}) error {
 	if r.ConnectionID == "" {
-		e.callGroupMethod(r, "Global", fn, args...)
-		return
+		return e.callAllExcept(r, nil, fn, args...)
 	}
 
 	c := e.getClientByConnectionID(r.ConnectionID)
-	if c != nil {
-		c.transport.CallClientFunction(r, fn, args...)
+	if c == nil {
+		return ErrConnectionGone
+	}
+	c.touch()
+	if err := c.transport().CallClientFunction(r, fn, args...); err != nil {
+		return err
+	}
+	e.emitSent(r.ConnectionID, "", r.Name, fn)
+	return nil
+}
+
+// callConnectionMethod calls a client method on a single connection,
+// which need not be the one that invoked relay.
+func (e *Exchange) callConnectionMethod(relay *Relay, connectionID, fn string, args ...interface{}) error {
+	c := e.getClientByConnectionID(connectionID)
+	if c == nil {
+		return ErrConnectionGone
+	}
+
+	c.touch()
+	target := *relay
+	target.ConnectionID = connectionID
+	if err := c.transport().CallClientFunction(&target, fn, args...); err != nil {
+		return err
+	}
+	e.emitSent(connectionID, "", relay.Name, fn)
+	return nil
+}
+
+func (e *Exchange) callGroupMethod(relay *Relay, group, fn string, args ...interface{}) error {
+	return e.callGroupMethodExcept(relay, group, nil, fn, args...)
+}
+
+// callGroupMethodExcept calls a client method on every member of a group
+// apart from the clients whose ConnectionIDs are listed in except. Only
+// failures to deliver to clients connected to this Exchange are reported.
+func (e *Exchange) callGroupMethodExcept(relay *Relay, group string, except []string, fn string, args ...interface{}) error {
+	_, err := e.callGroupContext(context.Background(), relay, group, except, fn, args...)
+	return err
+}
+
+// callAllExcept calls a client method on every connected client apart
+// from those whose ConnectionIDs are listed in except, whether or not
+// they are in Global, and relays the call through the Backplane.
+func (e *Exchange) callAllExcept(relay *Relay, except []string, fn string, args ...interface{}) error {
+	err := e.deliverToAll(relay, except, fn, args...)
+	// Group is set for instances that deliver to Global instead
+	e.publishToBackplane(BackplaneMessage{Relay: relay.Name, Method: fn, Group: "Global", Except: except, All: true, Arguments: wireArgs(args), Sender: relay.sender})
+	return err
+}
+
+// deliverToAll calls a client method on every client connected to this
+// Exchange, skipping those listed in except. Calls are retained as calls
+// to Global, if it retains them.
+func (e *Exchange) deliverToAll(relay *Relay, except []string, fn string, args ...interface{}) (err error) {
+	relay, span := e.startFanOut(relay, "Global", fn)
+	defer func() { span.End(err) }()
+
+	e.mapLock.RLock()
+	if r := e.retention.Load(); r != nil && relay.Name != presenceRelay {
+		e.retainGroupCall(r, e.groups["Global"], "Global", relay.Name, fn, args)
+	}
+	clients := e.clientsLocked()
+	e.mapLock.RUnlock()
+
+	return e.deliverToEach(clients, relay, "Global", except, fn, args)
+}
+
+// GroupCallResult summarises a call to the members of a group that are
+// connected to an Exchange.
+type GroupCallResult struct {
+	Targeted  int // the members of the group
+	Delivered int // members the call was queued for
+	Skipped   int // members excluded from the call, or not reached before it was cancelled
+	Dropped   int // members the call could not be queued for
+}
+
+// CallGroup calls a client method on the members of a group through the
+// relay registered with relayType's type, in the relay's namespace with
+// NamespaceGroups. It stops early if ctx is done,
+// returning ctx's error; otherwise it returns a *GroupCallError if the
+// call could not be delivered to some of the members. Unless it was
+// cancelled, the call is also relayed to other instances through the
+// Backplane, whose members the result does not include.
+func (e *Exchange) CallGroup(ctx context.Context, relayType interface{}, group, fn string, args ...interface{}) (GroupCallResult, error) {
+	relay := e.Relay(relayType)
+	if relay == nil {
+		return GroupCallResult{}, fmt.Errorf("relayr: %v is not a registered relay", relayStructType(relayType))
+	}
+	return e.callGroupContext(ctx, relay, relay.qualifyGroup(group), nil, fn, args...)
+}
+
+// callGroupContext delivers a call to the members of a group, and relays
+// it through the Backplane unless ctx is done first.
+func (e *Exchange) callGroupContext(ctx context.Context, relay *Relay, group string, except []string, fn string, args ...interface{}) (GroupCallResult, error) {
+	result, err := e.deliverToGroup(ctx, relay, group, except, fn, args...)
+	if ctx.Err() == nil {
+		e.publishToBackplane(BackplaneMessage{Relay: relay.Name, Method: fn, Group: group, Except: except, Arguments: wireArgs(args), Sender: relay.sender})
+	}
+	return result, err
+}
+
+// callGroupsMatching calls a client method on the members of every group
+// whose name matches pattern, skipping those listed in except. Clients in
+// several of the groups are called once.
+func (e *Exchange) callGroupsMatching(relay *Relay, pattern string, except []string, fn string, args ...interface{}) error {
+	err := e.deliverToGroupsMatching(relay, pattern, except, fn, args...)
+	if _, ok := err.(*GroupCallError); err == nil || ok {
+		e.publishToBackplane(BackplaneMessage{Relay: relay.Name, Method: fn, Group: pattern, Except: except, Pattern: true, Arguments: wireArgs(args), Sender: relay.sender})
+	}
+	return err
+}
+
+// callCallerGroups calls a client method on the members of the groups the
+// relay's caller is in, other than Global, each once, and relays the call
+// through the Backplane with the groups named, for each instance to call
+// its own members of them.
+func (e *Exchange) callCallerGroups(relay *Relay, except []string, fn string, args ...interface{}) (err error) {
+	if relay.ConnectionID == "" {
+		return nil
+	}
+	members, groups := e.membersOfCallerGroups(relay.ConnectionID)
+	if len(groups) == 0 {
+		return nil
+	}
+
+	relay, span := e.startFanOut(relay, callerGroupsName, fn)
+	err = e.deliverToEach(members, relay, callerGroupsName, except, fn, args)
+	span.End(err)
+	if _, ok := err.(*GroupCallError); err == nil || ok {
+		e.publishToBackplane(BackplaneMessage{Relay: relay.Name, Method: fn, Groups: groups, Except: except, Arguments: wireArgs(args), Sender: relay.sender})
+	}
+	return err
+}
+
+// deliverToGroups is deliverToGroup for several groups, whose members are
+// called once each.
+func (e *Exchange) deliverToGroups(relay *Relay, groups []string, except []string, fn string, args ...interface{}) (err error) {
+	relay, span := e.startFanOut(relay, callerGroupsName, fn)
+	defer func() { span.End(err) }()
+
+	return e.deliverToEach(e.membersOfGroups(groups), relay, callerGroupsName, except, fn, args)
+}
+
+// deliverToGroupsMatching is deliverToGroup for the groups whose names
+// match pattern.
+func (e *Exchange) deliverToGroupsMatching(relay *Relay, pattern string, except []string, fn string, args ...interface{}) (err error) {
+	relay, span := e.startFanOut(relay, pattern, fn)
+	defer func() { span.End(err) }()
+
+	members, err := e.membersOfGroupsMatching(pattern)
+	if err != nil {
+		return err
 	}
+
+	return e.deliverToEach(members, relay, pattern, except, fn, args)
 }
 
-func (e *Exchange) callGroupMethod(relay *Relay, group, fn string, args ...interface{}) {
-	// e.mapLock.Lock()
-	// defer e.mapLock.Unlock()
-	if _, ok := e.groups[group]; ok {
-		if e.verbosity > 0 {
-			log.Println("group found")
-			log.Printf("list of clients for group when calling %s:\n", group)
+// deliverToEach calls a client method on each of clients apart from those
+// listed in except, reporting those it could not be queued for in a
+// *GroupCallError named name.
+func (e *Exchange) deliverToEach(clients []*client, relay *Relay, name string, except []string, fn string, args []interface{}) error {
+	enc := e.groupEncoder(relay, fn, args)
+	result := &GroupCallError{Group: name}
+	for _, c := range clients {
+		if containsString(except, c.ConnectionID) {
+			continue
 		}
-		for _, c := range e.groups[group] {
-			if c == nil {
-				if e.verbosity > 0 {
-					log.Printf("c.ConnectionID will fail since c is nil, group key %s", group)
-				}
-				continue
-			}
-			if e.verbosity > 0 {
-				log.Printf("ConnectionID: %s\n", c.ConnectionID)
+		if err := e.deliverToMember(c, enc, relay, name, fn, args); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
 			}
-			r := e.getRelayByName(relay.Name, c.ConnectionID)
-			if e.verbosity > 0 {
-				log.Printf("sending to %s", c.ConnectionID)
-			}
-			c.transport.CallClientFunction(r, fn, args...)
-		}
-	} else {
-		if e.verbosity > 0 {
-			log.Printf("group '%s' not found. All groups: %v", group, e.groups)
+			result.Failed[c.ConnectionID] = err
+			continue
 		}
+		result.Delivered++
 	}
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
 }
 
-func (e *Exchange) callGroupMethodExcept(relay *Relay, group, fn string, args ...interface{}) {
-	// e.mapLock.Lock()
-	// defer e.mapLock.Unlock()
-	for _, c := range e.groups[group] {
-		if c.ConnectionID == relay.ConnectionID {
+// deliverToGroup calls a client method on the members of a group that
+// are connected to this Exchange, skipping those listed in except. It
+// checks ctx before each member, and returns its error if it is done. It
+// returns a *GroupCallError if the call could not be queued for some of
+// them.
+func (e *Exchange) deliverToGroup(ctx context.Context, relay *Relay, group string, except []string, fn string, args ...interface{}) (summary GroupCallResult, err error) {
+	relay, span := e.startFanOut(relay, group, fn)
+	defer func() { span.End(err) }()
+
+	e.mapLock.RLock()
+	g := e.groups[group]
+	var members []*client
+	if r := e.retention.Load(); r != nil && relay.Name != presenceRelay {
+		members = e.retainGroupCall(r, g, group, relay.Name, fn, args)
+	} else if g != nil {
+		members = g.clients()
+	}
+	e.mapLock.RUnlock()
+
+	if g == nil {
+		e.logger.Debugf("group '%s' not found. All groups: %v", group, e.Groups())
+		return GroupCallResult{}, nil
+	}
+
+	e.logger.Debugf("calling %s on %d clients in group '%s'", fn, len(members), group)
+	summary = GroupCallResult{Targeted: len(members)}
+	result := &GroupCallError{Group: group}
+	enc := e.groupEncoder(relay, fn, args)
+	for i, c := range members {
+		if err := ctx.Err(); err != nil {
+			summary.Skipped += len(members) - i
+			return summary, err
+		}
+		if containsString(except, c.ConnectionID) {
+			summary.Skipped++
 			continue
 		}
-		r := e.getRelayByName(relay.Name, c.ConnectionID)
-		c.transport.CallClientFunction(r, fn, args...)
+		if err := e.deliverToMember(c, enc, relay, group, fn, args); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[c.ConnectionID] = err
+			summary.Dropped++
+			continue
+		}
+		result.Delivered++
+		summary.Delivered++
+	}
+
+	if len(result.Failed) > 0 {
+		return summary, result
+	}
+	return summary, nil
+}
+
+// startFanOut starts the span of a call to a client method made to the
+// members of a group, or of the groups matching a pattern, returning the
+// relay to make it through so that it carries the span's trace.
+func (e *Exchange) startFanOut(relay *Relay, group, fn string) (*Relay, Span) {
+	span := e.options.Tracer.StartSpan(SpanFanOut, relay.trace)
+	span.SetAttribute("relayr.relay", relay.Name)
+	span.SetAttribute("relayr.method", fn)
+	span.SetAttribute("relayr.group", group)
+	if trace := spanParent(span, relay.trace); trace != relay.trace {
+		traced := *relay
+		traced.trace = trace
+		relay = &traced
 	}
+	return relay, span
 }
 
 func (e *Exchange) getClientByConnectionID(cID string) *client {
-	// e.mapLock.Lock()
-	// defer e.mapLock.Unlock()
-	for _, c := range e.groups["Global"] {
-		if c.ConnectionID == cID {
-			return c
-		}
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+	return e.getClientByConnectionIDLocked(cID)
+}
+
+// getClientByConnectionIDLocked is getClientByConnectionID for callers
+// already holding mapLock.
+func (e *Exchange) getClientByConnectionIDLocked(cID string) *client {
+	return e.connected[cID]
+}
+
+// disconnectClient handles a client whose transport connection has gone
+// away for the given reason, ReasonClosed unless the server closed it.
+// The client is detached so that it can reconnect, or forgotten and
+// reported to the OnDisconnect hook when reconnection is disabled.
+func (e *Exchange) disconnectClient(id, reason string) {
+	e.invocations.cancel(id)
+	e.acks.cancel(id)
+	e.uploads.abort(id, "", ErrDisconnected)
+	if e.detachClient(id, reason) {
+		return
 	}
-	return nil
+	e.forgetClient(id, reason)
 }
 
-func (e *Exchange) removeFromAllGroups(id string) {
-	if e.verbosity > 0 {
-		log.Printf("removing client %s from all groups\n", id)
+// forgetClient removes a client from all of its groups and notifies the
+// OnDisconnect hooks, if the client was still known.
+func (e *Exchange) forgetClient(id, reason string) {
+	e.dispatcher.forget(id)
+	if e.options.CancelSchedulesOnDisconnect {
+		e.schedules.cancelConnection(id)
 	}
-	for group := range e.groups {
-		e.removeFromGroupByID(group, id)
+	if t := e.tapped(id); t != nil {
+		e.untap(id, t)
+	}
+	if !e.removeFromAllGroups(id, reason) {
+		return
+	}
+	e.notifyDisconnect(id, reason)
+}
+
+// dropClient disconnects a client for good, without giving it the
+// chance to reconnect. The reason is passed on to the client.
+func (e *Exchange) dropClient(id, reason string) {
+	c := e.getClientByConnectionID(id)
+	e.invocations.cancel(id)
+	e.acks.cancel(id)
+	e.uploads.abort(id, "", ErrDisconnected)
+	e.forgetClient(id, reason)
+	if c == nil {
+		return
 	}
+	c.transport().RemoveConnection(id, reason)
 }
 
-func (e *Exchange) removeFromGroupByID(g, id string) {
-	if e.verbosity > 0 {
-		log.Printf("removing client %s from '%s'\n", id, g)
+// removeFromAllGroups removes a client that disconnected for the given
+// reason from every group, reporting whether it was connected.
+func (e *Exchange) removeFromAllGroups(id, reason string) bool {
+	e.logger.Debugf("removing client %s from all groups", id)
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+	c := e.getClientByConnectionIDLocked(id)
+	if c != nil {
+		c.state.clear()
+		e.removeUserLocked(c)
+		e.removeAddrLocked(c)
+	}
+	e.forgetTagsLocked(id)
+	for group := range e.groups {
+		e.removeFromGroupByIDLocked(group, id)
+	}
+	// last, so that the client is reported leaving its groups before it
+	// is reported disconnected
+	if !e.unregisterLocked(id, reason) {
+		return false
 	}
-	// e.mapLock.Lock()
-	// defer e.mapLock.Unlock()
+	c.goneReason = reason
+	close(c.gone)
+	return true
+}
 
-	if i := e.getClientIndexInGroup(g, id); i > -1 {
-		group := e.groups[g]
-		group[i] = nil
-		e.groups[g] = append(group[:i], group[i+1:]...)
+func (e *Exchange) removeFromGroupByID(name, id string) bool {
+	e.mapLock.RLock()
+	g := e.groups[name]
+	removed, empty := false, false
+	if g != nil {
+		removed, empty = g.remove(id)
+	}
+	e.mapLock.RUnlock()
 
-		// clean up the group if it is empty
-		if len(e.groups[g]) == 0 {
-			delete(e.groups, g)
+	if !removed {
+		e.logger.Debugf("client %s not in the group '%s'", id, name)
+		return false
+	}
+	e.left(id, name)
+	e.logger.Debugf("client %s removed from '%s'", id, name)
+
+	// clean up the group if it is empty
+	if empty {
+		e.groupEmptied(name)
+		if !e.options.KeepEmptyGroups {
+			e.pruneGroup(name, g)
 		}
-		if e.verbosity > 0 {
-			log.Println("client removed")
+	}
+	return true
+}
+
+// addToGroup adds the client with the given ConnectionID to a group,
+// reporting false if it was a member already. It returns a
+// *GroupNameError if the group's name is not allowed, and
+// ErrConnectionNotFound if the client is unknown.
+func (e *Exchange) addToGroup(name, connectionID string) (bool, error) {
+	if err := e.validateGroupName(name); err != nil {
+		e.logger.Infof("cannot add client %s to a group: %v", connectionID, err)
+		return false, err
+	}
+	for {
+		e.mapLock.RLock()
+		c := e.getClientByConnectionIDLocked(connectionID)
+		g := e.groups[name]
+		if c == nil || g != nil {
+			added := false
+			var err error
+			switch {
+			case c == nil:
+				e.logger.Debugf("cannot add unknown client %s to '%s'", connectionID, name)
+				err = ErrConnectionNotFound
+			case e.joinGroup(g, name, c, true):
+				e.joined(c, name)
+				e.logger.Debugf("client %s added to '%s'", connectionID, name)
+				added = true
+			default:
+				e.logger.Debugf("client %s already in '%s'", connectionID, name)
+			}
+			e.mapLock.RUnlock()
+			return added, err
 		}
-	} else {
-		if e.verbosity > 0 {
-			log.Printf("client %s not in the group '%s'", id, g)
+		e.mapLock.RUnlock()
+
+		// create the group, then add the client to it as above
+		e.mapLock.Lock()
+		if e.groups[name] == nil {
+			e.groups[name] = newGroup()
 		}
+		e.mapLock.Unlock()
 	}
 }
 
-func (e *Exchange) getClientIndexInGroup(g, id string) int {
-	// e.mapLock.Lock()
-	// defer e.mapLock.Unlock()
-	for i, c := range e.groups[g] {
-		if c != nil && c.ConnectionID == id {
-			return i
-		}
+// DroppedMessages returns, for every connected client that has had
+// messages dropped because it could not keep up, the number dropped.
+func (e *Exchange) DroppedMessages() map[string]uint64 {
+	r := make(map[string]uint64)
+	e.transports["websocket"].(*webSocketTransport).droppedMessages(r)
+	e.transports["longpoll"].(*longPollTransport).droppedMessages(r)
+	return r
+}
+
+// Groups returns the names of all groups that currently have members.
+// With KeepEmptyGroups it also returns those that have had members
+// since. With NamespaceGroups, the name of a group in a relay's
+// namespace includes the namespace, e.g. "Chat/admins".
+func (e *Exchange) Groups() []string {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	r := make([]string, 0, len(e.groups))
+	for g := range e.groups {
+		r = append(r, g)
 	}
 
-	return -1
+	return r
 }
 
-func (e *Exchange) addToGroup(group, connectionID string) {
-	// only add them if they aren't currently in the group
-	// e.mapLock.Lock()
-	// defer e.mapLock.Unlock()
-	if e.getClientIndexInGroup(group, connectionID) == -1 {
-		e.groups[group] = append(e.groups[group], e.getClientByConnectionID(connectionID))
-		if e.verbosity > 0 {
-			log.Printf("list of clients for group %s:\n", group)
-			for _, c := range e.groups[group] {
-				log.Printf("ConnectionID: %s\n", c.ConnectionID)
-			}
-		}
-	} else {
-		if e.verbosity > 0 {
-			log.Printf("client %s NOT added to '%s'\n", connectionID, group)
-			log.Printf("list of clients for group %s:\n", group)
-			for _, c := range e.groups[group] {
-				log.Printf("ConnectionID: %s\n", c.ConnectionID)
-			}
+// GroupMembers returns the ConnectionIDs of the clients in a group.
+// The returned slice is a copy and may be modified freely.
+func (e *Exchange) GroupMembers(group string) []string {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	r := []string{}
+	if g := e.groups[group]; g != nil {
+		for _, c := range g.clients() {
+			r = append(r, c.ConnectionID)
 		}
 	}
+
+	return r
+}
+
+// IsInGroup reports whether the client with the given ConnectionID
+// is a member of group.
+func (e *Exchange) IsInGroup(group, connectionID string) bool {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	g := e.groups[group]
+	return g != nil && g.has(connectionID)
+}
+
+// AddToGroup adds the client with the given ConnectionID to a group, as
+// Relay.Groups(group).Add does from within a relay method. The group is
+// named in full, as Groups reports it, whatever NamespaceGroups says. It
+// returns a *GroupNameError if the name is not allowed, and
+// ErrConnectionNotFound if there is no such client.
+func (e *Exchange) AddToGroup(group, connectionID string) error {
+	_, err := e.addToGroup(group, connectionID)
+	return err
 }
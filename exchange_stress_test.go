@@ -0,0 +1,199 @@
+package relayr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// stressGroups are the groups the clients of TestExchangeStress join and
+// leave.
+var stressGroups = []string{"red", "green", "blue", "amber"}
+
+// stressNegotiate negotiates a connection over transport, as negotiate
+// does, from a goroutine other than the test's.
+func stressNegotiate(srv *httptest.Server, transport string) (protocol.NegotiationResponse, error) {
+	body, _ := json.Marshal(protocol.Negotiation{T: transport, V: protocol.Version})
+	var res protocol.NegotiationResponse
+	resp, err := http.Post(srv.URL+"/relayr/negotiate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.ConnectionID == "" {
+		return res, fmt.Errorf("negotiating: %d %v", resp.StatusCode, err)
+	}
+	return res, nil
+}
+
+// stressClient connects a client over transport, has it join and leave
+// groups while the broadcasts run, and disconnects it: from its end when
+// n is even, closing its websocket or no longer polling, and from the
+// Exchange's when it is odd.
+func stressClient(e *Exchange, srv *httptest.Server, transport string, n int) error {
+	res, err := stressNegotiate(srv, transport)
+	if err != nil {
+		return err
+	}
+	cid := res.ConnectionID
+
+	var closeClient func()
+	read := make(chan struct{})
+	if transport == "websocket" {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv, res), nil)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer close(read)
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		closeClient = func() { ws.Close() }
+	} else {
+		stopped := make(chan struct{})
+		go func() {
+			defer close(read)
+			seq := "0"
+			for {
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+				resp, err := http.Get(srv.URL + "/relayr/longpoll?connectionId=" + cid + "&seq=" + seq)
+				if err != nil {
+					return
+				}
+				var res pollResult
+				b, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || json.Unmarshal(b, &res) != nil || res.Command != "" {
+					return
+				}
+				seq = strconv.FormatUint(res.Seq, 10)
+			}
+		}()
+		closeClient = func() { close(stopped) }
+	}
+
+	for i := 0; i < 10; i++ {
+		g := stressGroups[(n+i)%len(stressGroups)]
+		if i%3 == 2 {
+			e.RemoveFromGroup(g, cid)
+		} else if err := e.AddToGroup(g, cid); err != nil {
+			return fmt.Errorf("adding %s client %s to %s: %v", transport, cid, g, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if n%2 == 0 {
+		closeClient()
+	} else {
+		e.Disconnect(cid, "stress")
+		closeClient()
+	}
+	select {
+	case <-read:
+	case <-time.After(testTimeout):
+		return fmt.Errorf("%s client %s was not disconnected", transport, cid)
+	}
+	return nil
+}
+
+// TestExchangeStress connects 500 clients, half over websockets and half
+// long-polling, which join and leave groups and disconnect while tight
+// loops broadcast to those groups and to every client. It passes if
+// nothing panics, the race detector finds nothing, and every client is
+// forgotten at the end, so it is meant to be run with the race detector:
+//
+//	go test -race -run TestExchangeStress .
+//
+// It is skipped with -short.
+func TestExchangeStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	const clients, concurrent = 500, 100
+	e, srv := serve(t, ExchangeOptions{
+		ReconnectGracePeriod: -1,
+		LongPollMaxWait:      50 * time.Millisecond,
+		LongPollIdleTimeout:  2 * time.Second, // for the long-polling clients that stop polling
+		OutChannelSize:       64,
+	}, Ticker{})
+
+	stop := make(chan struct{})
+	var broadcasts sync.WaitGroup
+	for b := 0; b < 4; b++ {
+		broadcasts.Add(1)
+		go func(b int) {
+			defer broadcasts.Done()
+			ops := e.Clients(Ticker{})
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if b == 0 {
+					ops.All("tick", i)
+				} else {
+					ops.Group(stressGroups[(b+i)%len(stressGroups)]).Call("tick", i)
+				}
+			}
+		}(b)
+	}
+
+	slots := make(chan struct{}, concurrent)
+	var wg sync.WaitGroup
+	for n := 0; n < clients; n++ {
+		transport := "websocket"
+		if n%2 == 1 {
+			transport = "longpoll"
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := stressClient(e, srv, transport, n/2); err != nil {
+				t.Error(err)
+			}
+		}(n)
+	}
+	wg.Wait()
+	close(stop)
+	broadcasts.Wait()
+
+	for deadline := time.Now().Add(testTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if len(e.connections()) == 0 && len(e.Groups()) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients and the groups %q are left", len(e.connections()), e.Groups())
+		}
+	}
+
+	// the Exchange still serves
+	ws, cid := openWebSocket(t, srv)
+	e.AddToGroup("red", cid)
+	e.Clients(Ticker{}).Group("red").Call("tick", "after")
+	for ticked := false; !ticked; {
+		for _, inv := range clientCalls(t, readFrames(t, ws)) {
+			ticked = inv.Method == "tick"
+		}
+	}
+}
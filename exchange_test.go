@@ -0,0 +1,503 @@
+package relayr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	rclient "github.com/simon-whitehead/relayr/client"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+func TestCrossOriginUpgradeRefused(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{})
+
+	header := http.Header{"Origin": {"http://evil.example"}}
+	ws, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, negotiate(t, srv, "websocket")), header)
+	if err == nil {
+		ws.Close()
+		t.Fatal("a cross-origin upgrade was accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("a cross-origin upgrade was answered with %v, want 403", resp)
+	}
+
+	header = http.Header{"Origin": {srv.URL}}
+	ws, _, err = websocket.DefaultDialer.Dial(wsURL(srv, negotiate(t, srv, "websocket")), header)
+	if err != nil {
+		t.Fatalf("a same-origin upgrade failed: %v", err)
+	}
+	ws.Close()
+}
+
+func TestSetCheckOrigin(t *testing.T) {
+	open, openSrv := serve(t, ExchangeOptions{})
+	_, strictSrv := serve(t, ExchangeOptions{})
+	open.SetCheckOrigin(AllowAllOrigins)
+
+	header := http.Header{"Origin": {"http://elsewhere.example"}}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL(openSrv, negotiate(t, openSrv, "websocket")), header)
+	if err != nil {
+		t.Fatalf("an upgrade from any origin was refused with AllowAllOrigins: %v", err)
+	}
+	ws.Close()
+
+	// the other Exchange keeps its own policy
+	if ws, _, err := websocket.DefaultDialer.Dial(wsURL(strictSrv, negotiate(t, strictSrv, "websocket")), header); err == nil {
+		ws.Close()
+		t.Fatal("SetCheckOrigin on one Exchange changed another's")
+	}
+
+	open.SetCheckOrigin(nil)
+	if ws, _, err := websocket.DefaultDialer.Dial(wsURL(openSrv, negotiate(t, openSrv, "websocket")), header); err == nil {
+		ws.Close()
+		t.Fatal("a cross-origin upgrade was accepted once the check was reset")
+	}
+}
+
+func TestSetCheckOriginWhileServing(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if i%2 == 0 {
+				e.SetCheckOrigin(AllowAllOrigins)
+			} else {
+				e.SetCheckOrigin(nil)
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv, negotiate(t, srv, "websocket")), nil)
+		if err != nil {
+			t.Fatalf("an upgrade with no Origin failed: %v", err)
+		}
+		ws.Close()
+	}
+	wg.Wait()
+}
+
+// Chat and Admin are relays served by different Exchanges.
+type Chat struct{}
+
+func (Chat) Say(r *Relay, msg string) {}
+
+type Admin struct{}
+
+func (Admin) Kick(r *Relay, id string) {}
+
+// Audit is registered once the script has been served.
+type Audit struct{}
+
+func (Audit) Record(r *Relay, what string) {}
+
+// getScript fetches the client script h serves at path.
+func getScript(h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestScriptCachedPerExchange(t *testing.T) {
+	chat := newExchange(t, "http://localhost/chat", ExchangeOptions{})
+	admin := newExchange(t, "http://localhost/admin", ExchangeOptions{})
+	chat.RegisterRelay(Chat{})
+	admin.RegisterRelay(Admin{})
+	mux := http.NewServeMux()
+	mux.Handle("/chat/", chat)
+	mux.Handle("/admin/", admin)
+
+	for i := 0; i < 2; i++ {
+		chatScript := getScript(mux, "/chat/client.js", nil).Body.String()
+		adminScript := getScript(mux, "/admin/client.js", nil).Body.String()
+		if !strings.Contains(chatScript, "localhost/chat") || !strings.Contains(chatScript, "Chat") || strings.Contains(chatScript, "Admin") {
+			t.Fatalf("the chat Exchange served a script for the wrong Exchange:\n%s", chatScript)
+		}
+		if !strings.Contains(adminScript, "localhost/admin") || !strings.Contains(adminScript, "Admin") || strings.Contains(adminScript, "Chat") {
+			t.Fatalf("the admin Exchange served a script for the wrong Exchange:\n%s", adminScript)
+		}
+	}
+
+	if err := chat.RegisterRelay(Audit{}); err != nil {
+		t.Fatal(err)
+	}
+	if script := getScript(mux, "/chat/client.js", nil).Body.String(); !strings.Contains(script, "Audit") {
+		t.Error("the cached script was served after a relay was registered")
+	}
+	if script := getScript(mux, "/admin/client.js", nil).Body.String(); strings.Contains(script, "Audit") {
+		t.Error("registering a relay with one Exchange changed another's script")
+	}
+}
+
+func TestScriptETag(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Chat{})
+
+	first := getScript(e, "/relayr/client.js", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("the script was served with %d and ETag %q", first.Code, etag)
+	}
+	if ct := first.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/javascript") {
+		t.Errorf("the script was served as %q", ct)
+	}
+	if cc := first.Header().Get("Cache-Control"); cc == "" {
+		t.Error("the script was served without a Cache-Control")
+	}
+
+	again := getScript(e, "/relayr/client.js", http.Header{"If-None-Match": {etag}})
+	if again.Code != http.StatusNotModified || again.Body.Len() != 0 {
+		t.Fatalf("a request with the script's ETag was answered with %d and %d bytes, want 304 and none", again.Code, again.Body.Len())
+	}
+	stale := getScript(e, "/relayr/client.js", http.Header{"If-None-Match": {`"stale"`}})
+	if stale.Code != http.StatusOK || stale.Body.String() != first.Body.String() {
+		t.Fatalf("a request with another ETag was answered with %d", stale.Code)
+	}
+
+	head := httptest.NewRequest("HEAD", "/relayr/client.js", nil)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, head)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+		t.Errorf("HEAD was answered with %d, %d bytes and ETag %q", w.Code, w.Body.Len(), w.Header().Get("ETag"))
+	}
+
+	e.RegisterRelay(Audit{})
+	changed := getScript(e, "/relayr/client.js", http.Header{"If-None-Match": {etag}})
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Fatalf("once a relay was registered the old ETag was answered with %d and ETag %q", changed.Code, changed.Header().Get("ETag"))
+	}
+}
+
+func TestScriptGzip(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Chat{})
+
+	plain := getScript(e, "/relayr/client.js", nil)
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatal("the script was compressed for a client that does not accept gzip")
+	}
+	zipped := getScript(e, "/relayr/client.js", http.Header{"Accept-Encoding": {"br, gzip"}})
+	if zipped.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("the script was not gzipped for a client that accepts it")
+	}
+	if !strings.Contains(zipped.Header().Get("Vary"), "Accept-Encoding") {
+		t.Error("the script does not vary by Accept-Encoding")
+	}
+	if zipped.Header().Get("ETag") == plain.Header().Get("ETag") {
+		t.Error("the gzipped script has the plain one's ETag")
+	}
+
+	r, err := gzip.NewReader(zipped.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Error("the gzipped script differs from the plain one")
+	}
+
+	again := getScript(e, "/relayr/client.js", http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {zipped.Header().Get("ETag")}})
+	if again.Code != http.StatusNotModified {
+		t.Errorf("a request with the gzipped script's ETag was answered with %d", again.Code)
+	}
+}
+
+// Fragile is a relay whose methods panic.
+type Fragile struct{}
+
+func (Fragile) Panic(r *Relay) {
+	var m map[string]int
+	m["boom"]++
+}
+
+type point struct{ X, Y int }
+
+func (Fragile) Norm(r *Relay, p *point) int {
+	return p.X*p.X + p.Y*p.Y
+}
+
+func TestPanickingMethodKeepsConnection(t *testing.T) {
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			e, srv := serve(t, ExchangeOptions{}, Fragile{})
+			c := dial(t, srv, transport)
+			after := calls(c, "Fragile", "after")
+
+			if err := c.Invoke(context.Background(), "Fragile", "Panic"); err == nil || !strings.Contains(err.Error(), "panicked") {
+				t.Fatalf("a method that panicked failed with %v", err)
+			}
+			// a nil argument for a pointer parameter reaches the method as
+			// nil, which it dereferences
+			if err := c.Invoke(context.Background(), "Fragile", "Norm", nil); err == nil {
+				t.Fatal("a method that panicked on a nil argument did not fail")
+			}
+			if res, err := c.Call(context.Background(), "Fragile", "Norm", point{3, 4}); err != nil || string(res) != "25" {
+				t.Fatalf("calling after the panics returned %s, %v", res, err)
+			}
+
+			e.Clients(Fragile{}).All("after", "still here")
+			if args := receive(t, after); string(args[0]) != `"still here"` {
+				t.Fatalf("received %s", args[0])
+			}
+		})
+	}
+}
+
+// Calculator is a relay whose methods return results.
+type Calculator struct{}
+
+func (Calculator) Add(r *Relay, a, b int) int {
+	return a + b
+}
+
+func (Calculator) Divide(r *Relay, a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func TestCallCompletions(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{}, Calculator{})
+
+	t.Run("websocket", func(t *testing.T) {
+		ws, _ := openWebSocket(t, srv)
+		ws.WriteJSON(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: "Calculator", Method: "Add", Arguments: []interface{}{2, 3}, InvocationID: "a1"})
+		ws.WriteJSON(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: "Calculator", Method: "Divide", Arguments: []interface{}{1, 0}, InvocationID: "a2"})
+
+		if c := readCompletion(t, ws, "a1"); c.Value != 5.0 || c.Error != "" {
+			t.Errorf("Add completed with %+v", c)
+		}
+		if c := readCompletion(t, ws, "a2"); !strings.Contains(c.Error, "division by zero") {
+			t.Errorf("Divide completed with %+v, want its error", c)
+		}
+	})
+
+	t.Run("longpoll", func(t *testing.T) {
+		cid := negotiate(t, srv, "longpoll").ConnectionID
+		body, _ := json.Marshal(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: "Calculator", Method: "Add", Arguments: []interface{}{2, 3}, InvocationID: "b1"})
+		resp, err := http.Post(srv.URL+"/relayr/call?connectionId="+cid, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var receipt protocol.CallReceipt
+		json.NewDecoder(resp.Body).Decode(&receipt)
+		resp.Body.Close()
+		if !receipt.Accepted || receipt.InvocationID != "b1" {
+			t.Fatalf("the call was answered with %+v", receipt)
+		}
+
+		var seq uint64
+		for deadline := time.Now().Add(testTimeout); time.Now().Before(deadline); {
+			res := poll(t, srv, cid, seq)
+			for _, f := range res.Messages {
+				var c protocol.Completion
+				if json.Unmarshal(f, &c) == nil && c.Type == protocol.TypeCompletion {
+					if c.InvocationID != "b1" || c.Value != 5.0 {
+						t.Fatalf("polled the completion %+v", c)
+					}
+					return
+				}
+			}
+			seq = res.Seq
+		}
+		t.Fatal("the completion was not polled")
+	})
+
+	t.Run("client", func(t *testing.T) {
+		c := dial(t, srv, "websocket")
+		if res, err := c.Call(context.Background(), "Calculator", "Divide", 9, 3); err != nil || string(res) != "3" {
+			t.Errorf("Divide returned %s, %v", res, err)
+		}
+		var callErr *rclient.Error
+		if _, err := c.Call(context.Background(), "Calculator", "Divide", 9, 0); !errors.As(err, &callErr) {
+			t.Errorf("Divide by zero failed with %v, want the method's error", err)
+		}
+	})
+}
+
+// Counter is a relay registered by pointer, with a dependency and state
+// its pointer methods share.
+type Counter struct {
+	prefix string
+
+	lock sync.Mutex
+	n    int
+}
+
+func (c *Counter) Increment(r *Relay) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.n++
+	return c.prefix + strconv.Itoa(c.n)
+}
+
+// Greeter is a relay registered by value, with a dependency.
+type Greeter struct{ greeting string }
+
+func (g Greeter) Greet(r *Relay, name string) string {
+	return g.greeting + ", " + name
+}
+
+func TestMethodsCalledOnRegisteredInstance(t *testing.T) {
+	const clients, callsEach = 4, 25
+	counter := &Counter{prefix: "#"}
+	_, srv := serve(t, ExchangeOptions{}, counter, Greeter{greeting: "hello"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := dial(t, srv, "websocket")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < callsEach; j++ {
+				if res, err := c.Call(context.Background(), "Counter", "Increment"); err != nil || !strings.HasPrefix(string(res), `"#`) {
+					t.Errorf("Increment returned %s, %v", res, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	if counter.n != clients*callsEach {
+		t.Errorf("the registered Counter was incremented %d times, want %d", counter.n, clients*callsEach)
+	}
+
+	c := dial(t, srv, "longpoll")
+	if res, err := c.Call(context.Background(), "Greeter", "Greet", "you"); err != nil || string(res) != `"hello, you"` {
+		t.Errorf("Greet returned %s, %v, want the registered greeting", res, err)
+	}
+}
+
+func TestRelayFactoryInstancePerCall(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{})
+	var made atomic.Int64
+	err := e.RegisterRelayFactory("Counter", func() interface{} {
+		made.Add(1)
+		return &Counter{prefix: "#"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, srv, "websocket")
+	for i := 0; i < 3; i++ {
+		if res, err := c.Call(context.Background(), "Counter", "Increment"); err != nil || string(res) != `"#1"` {
+			t.Fatalf("Increment on a new instance returned %s, %v", res, err)
+		}
+	}
+	if made.Load() < 3 {
+		t.Errorf("the factory made %d instances for 3 calls", made.Load())
+	}
+}
+
+func TestOrderedDeliveryPerConnection(t *testing.T) {
+	const senders, each = 8, 1250
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			e, srv := serve(t, ExchangeOptions{OutChannelSize: senders * each, LongPollQueueSize: senders * each}, Ticker{})
+			c := dial(t, srv, transport)
+			type send struct{ sender, n int }
+			received := make(chan send, senders*each)
+			c.On("Ticker", "seq", func(args []json.RawMessage) {
+				var s send
+				json.Unmarshal(args[0], &s.sender)
+				json.Unmarshal(args[1], &s.n)
+				received <- s
+			})
+
+			target := e.Clients(Ticker{}).Client(c.ConnectionID())
+			var wg sync.WaitGroup
+			for i := 0; i < senders; i++ {
+				wg.Add(1)
+				go func(sender int) {
+					defer wg.Done()
+					for n := 0; n < each; n++ {
+						if err := target.Call("seq", sender, n); err != nil {
+							t.Errorf("sender %d call %d: %v", sender, n, err)
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			next := make([]int, senders)
+			for i := 0; i < senders*each; i++ {
+				select {
+				case s := <-received:
+					if s.n != next[s.sender] {
+						t.Fatalf("received call %d of sender %d, want %d", s.n, s.sender, next[s.sender])
+					}
+					next[s.sender]++
+				case <-time.After(testTimeout):
+					t.Fatalf("received %d of %d calls", i, senders*each)
+				}
+			}
+		})
+	}
+}
+
+// Store is a dependency relays are given as an interface.
+type Store interface {
+	Get(key string) string
+}
+
+type mapStore map[string]string
+
+func (s mapStore) Get(key string) string { return s[key] }
+
+// Lookup is a relay holding its dependency in an unexported field, with
+// a pointer receiver.
+type Lookup struct {
+	store Store
+}
+
+func (l *Lookup) Find(r *Relay, key string) string {
+	return l.store.Get(key)
+}
+
+func TestPointerRelayKeepsDependencies(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, &Lookup{store: mapStore{"answer": "42"}})
+	if schema := e.Schema(); len(schema) != 1 || schema[0].Name != "Lookup" {
+		t.Fatalf("a relay registered by pointer is described as %+v", schema)
+	}
+
+	for _, transport := range []string{"websocket", "longpoll"} {
+		c := dial(t, srv, transport)
+		if res, err := c.Call(context.Background(), "Lookup", "Find", "answer"); err != nil || string(res) != `"42"` {
+			t.Errorf("over %s Find returned %s, %v, want the injected store's value", transport, res, err)
+		}
+	}
+
+	if err := e.RegisterRelay(Lookup{}); err == nil {
+		t.Error("a relay registered by pointer was registered again by value")
+	}
+	if err := e.RegisterRelay(&Lookup{}); err == nil {
+		t.Error("a relay was registered twice")
+	}
+}
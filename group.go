@@ -0,0 +1,285 @@
+package relayr
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// callerGroupsName names a call made to CallerGroups, which is to no one
+// group, in a *GroupCallError and its span.
+const callerGroupsName = "callerGroups"
+
+// group is a set of clients keyed by ConnectionID. Each group has its own
+// lock so that broadcasts to a group only briefly hold up clients joining
+// and leaving it, and never those of other groups. The map of groups is
+// guarded by the Exchange's mapLock, which is always acquired before a
+// group's lock.
+type group struct {
+	lock    sync.RWMutex
+	members map[string]*client // never holds nil; an unknown ConnectionID is refused before it gets here
+}
+
+func newGroup() *group {
+	return &group{members: make(map[string]*client)}
+}
+
+// add adds c to the group, reporting false if it was already a member.
+func (g *group) add(c *client) bool {
+	return g.addThen(c, nil)
+}
+
+// addThen adds c to the group as add does, then calls then, if it is not
+// nil, before releasing the group's lock. A nil c is not added.
+func (g *group) addThen(c *client, then func()) bool {
+	if c == nil {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, ok := g.members[c.ConnectionID]; ok {
+		return false
+	}
+	g.members[c.ConnectionID] = c
+	if then != nil {
+		then()
+	}
+	return true
+}
+
+// remove removes a client from the group, reporting whether it was a
+// member and whether the group is now empty.
+func (g *group) remove(id string) (removed, empty bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	_, removed = g.members[id]
+	delete(g.members, id)
+	return removed, len(g.members) == 0
+}
+
+func (g *group) get(id string) *client {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.members[id]
+}
+
+func (g *group) has(id string) bool {
+	return g.get(id) != nil
+}
+
+func (g *group) len() int {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return len(g.members)
+}
+
+// clients returns a copy of the group's members.
+func (g *group) clients() []*client {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.clientsLocked()
+}
+
+// clientsLocked is clients for callers already holding the group's lock.
+func (g *group) clientsLocked() []*client {
+	r := make([]*client, 0, len(g.members))
+	for _, c := range g.members {
+		r = append(r, c)
+	}
+	return r
+}
+
+// groupMatcher compiles a pattern matching group names, in the syntax of
+// path.Match. Patterns whose only wildcard is a trailing "*" are matched
+// as a prefix.
+func groupMatcher(pattern string) (func(name string) bool, error) {
+	if i := strings.IndexAny(pattern, `*?[\`); i == len(pattern)-1 && pattern[i] == '*' {
+		prefix := pattern[:i]
+		return func(name string) bool {
+			return strings.HasPrefix(name, prefix)
+		}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("relayr: group pattern %q: %v", pattern, err)
+	}
+
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}, nil
+}
+
+// groupsOf returns the names of the groups the client with the given
+// ConnectionID is in, sorted, Global among them only if withGlobal is set.
+func (e *Exchange) groupsOf(id string, withGlobal bool) []string {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	r := []string{}
+	for name, g := range e.groups {
+		if (withGlobal || name != "Global") && g.has(id) {
+			r = append(r, name)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+// membersOfCallerGroups returns the clients in the groups, other than
+// Global, that the client with the given ConnectionID is in, each only
+// once however many of them it is in, and the names of the groups. Each
+// group's members are taken as its membership is checked, under its
+// lock, so a group the client is leaving is either reached whole or not
+// at all.
+func (e *Exchange) membersOfCallerGroups(id string) ([]*client, []string) {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	seen := make(map[string]struct{})
+	r := []*client{}
+	var names []string
+	for name, g := range e.groups {
+		if name == "Global" {
+			continue
+		}
+		g.lock.RLock()
+		if g.members[id] != nil {
+			names = append(names, name)
+			for _, c := range g.members {
+				if _, ok := seen[c.ConnectionID]; !ok {
+					seen[c.ConnectionID] = struct{}{}
+					r = append(r, c)
+				}
+			}
+		}
+		g.lock.RUnlock()
+	}
+	sort.Strings(names)
+	return r, names
+}
+
+// membersOfGroups returns the clients in the named groups, each only once
+// however many of the groups it is in.
+func (e *Exchange) membersOfGroups(names []string) []*client {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	seen := make(map[string]struct{})
+	r := []*client{}
+	for _, name := range names {
+		g := e.groups[name]
+		if g == nil {
+			continue
+		}
+		for _, c := range g.clients() {
+			if _, ok := seen[c.ConnectionID]; !ok {
+				seen[c.ConnectionID] = struct{}{}
+				r = append(r, c)
+			}
+		}
+	}
+	return r
+}
+
+// membersOfGroupsMatching returns the clients in the groups whose names
+// match pattern, each only once however many of the groups it is in.
+func (e *Exchange) membersOfGroupsMatching(pattern string) ([]*client, error) {
+	match, err := groupMatcher(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	seen := make(map[string]struct{})
+	r := []*client{}
+	for name, g := range e.groups {
+		if !match(name) {
+			continue
+		}
+		for _, c := range g.clients() {
+			if _, ok := seen[c.ConnectionID]; ok {
+				continue
+			}
+			seen[c.ConnectionID] = struct{}{}
+			r = append(r, c)
+		}
+	}
+
+	return r, nil
+}
+
+// addToGroupLocked adds c to a group, creating the group if necessary,
+// and replays the calls retained for it unless replay is false. The
+// caller must hold mapLock for writing.
+func (e *Exchange) addToGroupLocked(name string, c *client, replay bool) bool {
+	g := e.groups[name]
+	if g == nil {
+		g = newGroup()
+		e.groups[name] = g
+	}
+	if !e.joinGroup(g, name, c, replay) {
+		return false
+	}
+	e.joined(c, name)
+	return true
+}
+
+// joined records in the connection registry, and for presence and event
+// subscribers, that a client joined a group other than Global.
+func (e *Exchange) joined(c *client, name string) {
+	if name == "Global" {
+		return
+	}
+	e.conns.joined(c.ConnectionID, name)
+	e.groupJoined(name)
+	e.presenceJoined(c, name)
+	e.emit(ExchangeEvent{Type: EventGroupJoined, ConnectionID: c.ConnectionID, Group: name})
+}
+
+// left records in the connection registry, and for presence and event
+// subscribers, that a client left a group other than Global.
+func (e *Exchange) left(id, name string) {
+	if name == "Global" {
+		return
+	}
+	e.conns.left(id, name)
+	e.presenceLeft(id, name)
+	e.emit(ExchangeEvent{Type: EventGroupLeft, ConnectionID: id, Group: name})
+}
+
+// removeFromGroupByIDLocked removes a client from a group, deleting the
+// group once it is empty unless KeepEmptyGroups is set. The caller must
+// hold mapLock for writing.
+func (e *Exchange) removeFromGroupByIDLocked(name, id string) bool {
+	g := e.groups[name]
+	if g == nil {
+		return false
+	}
+	removed, empty := g.remove(id)
+	if empty && !e.options.KeepEmptyGroups {
+		delete(e.groups, name)
+	}
+	if removed {
+		e.left(id, name)
+		if empty {
+			e.groupEmptied(name)
+		}
+	}
+	return removed
+}
+
+// pruneGroup deletes a group if it is still empty.
+func (e *Exchange) pruneGroup(name string, g *group) {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	if e.groups[name] == g && g.len() == 0 {
+		delete(e.groups, name)
+	}
+}
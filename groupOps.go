@@ -13,8 +13,11 @@ type GroupOperations struct {
 // is a member of the group for the remainder of its
 // connection. At that point, the client must re-negotiate
 // its place within the group to be considered a member of it.
-func (g *GroupOperations) Add(connectionID string) {
-	g.e.addToGroup(g.group, connectionID)
+// It returns a *GroupNameError if the group's name is not
+// allowed, and ErrConnectionNotFound if there is no such client.
+func (g *GroupOperations) Add(connectionID string) error {
+	_, err := g.e.addToGroup(g.group, connectionID)
+	return err
 }
 
 // Remove removes a client from a group via its ConnectionID.
@@ -23,7 +26,8 @@ func (g *GroupOperations) Remove(connectionID string) {
 }
 
 // Call invokes a client-side method across a Group of clients,
-// passing args to them.
-func (g *GroupOperations) Call(fn string, args ...interface{}) {
-	g.e.callGroupMethod(g.relay, g.group, fn, args...)
+// passing args to them. It returns a *GroupCallError if the call could
+// not be delivered to some of them.
+func (g *GroupOperations) Call(fn string, args ...interface{}) error {
+	return g.e.callGroupMethod(g.relay, g.group, fn, args...)
 }
@@ -0,0 +1,376 @@
+package relayr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// TestAddUnknownConnectionToGroup adds ConnectionIDs no client has to a
+// group alongside its members, which once left nil members in it that
+// broadcasts and the debug logging tripped over.
+func TestAddUnknownConnectionToGroup(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{Verbosity: 3, ReconnectGracePeriod: -1}, Notifications{})
+	alice, bob := dial(t, srv, "websocket"), dial(t, srv, "longpoll")
+	toAlice, toBob := calls(alice, "Notifications", "notify"), calls(bob, "Notifications", "notify")
+
+	if err := e.AddToGroup("staff", "unknown"); err != ErrConnectionNotFound {
+		t.Fatalf("adding an unknown connection failed with %v, want ErrConnectionNotFound", err)
+	}
+	if err := e.AddToGroup("staff", alice.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := e.AddToGroupBulk("staff", []string{"unknown", bob.ConnectionID(), ""}); n != 1 || err != nil {
+		t.Fatalf("adding in bulk added %d with %v, want bob alone", n, err)
+	}
+	members := e.GroupMembers("staff")
+	sort.Strings(members)
+	want := []string{alice.ConnectionID(), bob.ConnectionID()}
+	sort.Strings(want)
+	if len(members) != 2 || members[0] != want[0] || members[1] != want[1] {
+		t.Fatalf("staff has the members %q, want %q", members, want)
+	}
+
+	// broadcasts reach every member, while members come and go
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			e.AddToGroup("staff", "unknown")
+			e.RemoveFromGroup("staff", "unknown")
+		}()
+		go func() {
+			defer wg.Done()
+			if err := e.Clients(Notifications{}).Group("staff").Call("notify", "staff"); err != nil {
+				t.Errorf("calling staff: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		receive(t, toAlice)
+		receive(t, toBob)
+	}
+
+	if err := e.Disconnect(bob.ConnectionID(), "left"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Clients(Notifications{}).Group("staff").Call("notify", "alone"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, toAlice); string(args[0]) != `"alone"` {
+		t.Fatalf("alice received %s", args[0])
+	}
+	if members := e.GroupMembers("staff"); len(members) != 1 || members[0] != alice.ConnectionID() {
+		t.Fatalf("staff has the members %q once bob left", members)
+	}
+}
+
+func TestGroupRefusesNil(t *testing.T) {
+	g := newGroup()
+	if g.addThen(nil, func() { t.Fatal("then was called for a nil client") }) {
+		t.Fatal("a nil client was added")
+	}
+	if len(g.members) != 0 {
+		t.Fatalf("the group holds %d members", len(g.members))
+	}
+}
+
+// checkGroupEvent checks that the next event of s of clients joining or
+// leaving a group is of typ for group, naming the clients with the
+// ConnectionIDs want: the one client of an event sent for each, or those
+// of an event sent once for them together.
+func checkGroupEvent(t *testing.T, s *EventSubscription, typ EventType, group string, want ...string) {
+	t.Helper()
+	ev := nextEvent(t, s)
+	for ev.Type != EventGroupJoined && ev.Type != EventGroupLeft {
+		ev = nextEvent(t, s)
+	}
+	got := append([]string(nil), ev.ConnectionIDs...)
+	if ev.ConnectionID != "" {
+		got = append(got, ev.ConnectionID)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if ev.Type != typ || ev.Group != group || !reflect.DeepEqual(got, want) {
+		t.Fatalf("the event was %v of '%s' for %q, want %v of '%s' for %q", ev.Type, ev.Group, got, typ, group, want)
+	}
+}
+
+func TestMoveGroup(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Notifications{})
+	alice, bob, carol := dial(t, srv, "websocket"), dial(t, srv, "longpoll"), dial(t, srv, "websocket")
+	toAlice, toBob, toCarol := calls(alice, "Notifications", "notify"), calls(bob, "Notifications", "notify"), calls(carol, "Notifications", "notify")
+	for _, join := range []struct{ group, cid string }{
+		{"lobby", alice.ConnectionID()},
+		{"lobby", bob.ConnectionID()},
+		{"game", bob.ConnectionID()},
+		{"game", carol.ConnectionID()},
+	} {
+		if err := e.AddToGroup(join.group, join.cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := e.SubscribeEvents(0)
+	defer events.Unsubscribe()
+
+	if n, err := e.MoveGroup("lobby", "game"); n != 2 || err != nil {
+		t.Fatalf("moving lobby moved %d with %v, want 2", n, err)
+	}
+	// bob, in both groups, is left in game, and so not said to join it
+	checkGroupEvent(t, events, EventGroupLeft, "lobby", alice.ConnectionID(), bob.ConnectionID())
+	checkGroupEvent(t, events, EventGroupJoined, "game", alice.ConnectionID())
+	if members := e.GroupMembers("lobby"); len(members) != 0 {
+		t.Fatalf("lobby still has the members %q", members)
+	}
+	members := e.GroupMembers("game")
+	sort.Strings(members)
+	want := []string{alice.ConnectionID(), bob.ConnectionID(), carol.ConnectionID()}
+	sort.Strings(want)
+	if !reflect.DeepEqual(members, want) {
+		t.Fatalf("game has the members %q, want %q", members, want)
+	}
+	if info, _ := e.ConnectionInfo(alice.ConnectionID()); !reflect.DeepEqual(info.Groups, []string{"game"}) {
+		t.Fatalf("alice is in %q, want game alone", info.Groups)
+	}
+
+	// each member of game is called once, bob too
+	ops := e.Clients(Notifications{})
+	if err := ops.Group("game").Call("notify", "game"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.Group("lobby").Call("notify", "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.All("notify", "all"); err != nil {
+		t.Fatal(err)
+	}
+	for name, ch := range map[string]<-chan []json.RawMessage{"alice": toAlice, "bob": toBob, "carol": toCarol} {
+		if args := receive(t, ch); string(args[0]) != `"game"` {
+			t.Fatalf("%s received %s, want the call to game", name, args[0])
+		}
+		if args := receive(t, ch); string(args[0]) != `"all"` {
+			t.Fatalf("%s received %s, want nothing between the calls to game and all", name, args[0])
+		}
+	}
+
+	if n, err := e.MoveGroup("nobody", "game"); n != 0 || err != nil {
+		t.Fatalf("moving a group without members moved %d with %v", n, err)
+	}
+	if n, err := e.MoveGroup("game", "game"); n != 0 || err != nil {
+		t.Fatalf("moving a group to itself moved %d with %v", n, err)
+	}
+	var nerr *GroupNameError
+	if n, err := e.MoveGroup("game", "Global"); n != 0 || !errors.As(err, &nerr) {
+		t.Fatalf("moving a group to Global moved %d with %v", n, err)
+	}
+	if members := e.GroupMembers("game"); len(members) != 3 {
+		t.Fatalf("game has the members %q after a refused move", members)
+	}
+}
+
+func TestClearGroup(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Notifications{})
+	ws, cid := openWebSocket(t, srv)
+	bob := dial(t, srv, "longpoll")
+	toBob := calls(bob, "Notifications", "notify")
+	for _, id := range []string{cid, bob.ConnectionID()} {
+		if err := e.AddToGroup("room", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := e.SubscribeEvents(0)
+	defer events.Unsubscribe()
+
+	if n := e.ClearGroup("room", true); n != 2 {
+		t.Fatalf("clearing room removed %d, want 2", n)
+	}
+	checkGroupEvent(t, events, EventGroupLeft, "room", cid, bob.ConnectionID())
+	var removed protocol.Control
+	if err := json.Unmarshal(readCalls(t, ws)[0], &removed); err != nil || removed.Command != protocol.CommandRemoved || removed.Group != "room" {
+		t.Fatalf("a removed member was sent %+v, %v", removed, err)
+	}
+	if members := e.GroupMembers("room"); len(members) != 0 {
+		t.Fatalf("room still has the members %q", members)
+	}
+	if info, _ := e.ConnectionInfo(cid); len(info.Groups) != 0 {
+		t.Fatalf("a removed member is in %q", info.Groups)
+	}
+
+	// calls to the group reach none of those removed
+	ops := e.Clients(Notifications{})
+	if err := ops.Group("room").Call("notify", "room"); err != nil {
+		t.Fatal(err)
+	}
+	checkNothingSent(t, ws)
+	if err := ops.Client(bob.ConnectionID()).Call("notify", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, toBob); string(args[0]) != `"bob"` {
+		t.Fatalf("bob received %s, want nothing before the call to bob", args[0])
+	}
+
+	// without notify, members are removed without being told
+	if err := e.AddToGroup("room", cid); err != nil {
+		t.Fatal(err)
+	}
+	checkGroupEvent(t, events, EventGroupJoined, "room", cid)
+	if n := e.ClearGroup("room", false); n != 1 {
+		t.Fatalf("clearing room again removed %d, want 1", n)
+	}
+	checkGroupEvent(t, events, EventGroupLeft, "room", cid)
+	checkNothingSent(t, ws)
+	if n := e.ClearGroup("room", true); n != 0 {
+		t.Fatalf("clearing an empty group removed %d", n)
+	}
+}
+
+// TestBulkGroupOpsRace moves and clears groups while clients join and
+// leave them one at a time and calls are made to them, leaving the
+// groups and the connection registry agreeing on who is in what.
+func TestBulkGroupOpsRace(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Notifications{})
+	var ids []string
+	for i := 0; i < 8; i++ {
+		ws, cid := openWebSocket(t, srv)
+		go func() {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		ids = append(ids, cid)
+	}
+	ops := e.Clients(Notifications{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				cid := ids[(w+i)%len(ids)]
+				switch i % 5 {
+				case 0:
+					e.AddToGroup("a", cid)
+				case 1:
+					e.AddToGroupBulk("b", ids[w:w+3])
+				case 2:
+					e.MoveGroup("a", "b")
+				case 3:
+					e.RemoveFromGroup("b", cid)
+				case 4:
+					e.ClearGroup("a", w%2 == 0)
+				}
+				if err := ops.Group("b").Call("notify", i); err != nil {
+					t.Errorf("calling b: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, cid := range ids {
+		info, _ := e.ConnectionInfo(cid)
+		for _, group := range []string{"a", "b"} {
+			registered := false
+			for _, g := range info.Groups {
+				registered = registered || g == group
+			}
+			if member := e.IsInGroup(group, cid); member != registered {
+				t.Errorf("%s is a member of %s: %v, but registered in %q", cid, group, member, info.Groups)
+			}
+		}
+	}
+}
+
+// BenchmarkGroupBroadcastChurn broadcasts to a group of 1000 websocket
+// clients, quietly and while those clients join and leave other groups,
+// as they do in a busy deployment, reporting how many joins and leaves
+// go through alongside the broadcasts. With a lock per group neither
+// holds up the other. The allocations counted under churn include those
+// of the joins and leaves.
+func BenchmarkGroupBroadcastChurn(b *testing.B) {
+	const clients = 1000
+	e, srv := serve(b, ExchangeOptions{OutChannelSize: 256}, Ticker{})
+	var received sync.WaitGroup
+	ids := make([]string, clients)
+	for i := range ids {
+		ws, cid := openWebSocket(b, srv)
+		ids[i] = cid
+		if err := e.AddToGroup("room", cid); err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			for {
+				_, m, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				if bytes.Contains(m, []byte(`"tick"`)) {
+					received.Done()
+				}
+			}
+		}()
+	}
+	room := e.Clients(Ticker{}).Group("room")
+
+	for _, churn := range []bool{false, true} {
+		name := "quiet"
+		if churn {
+			name = "churn"
+		}
+		b.Run(name, func(b *testing.B) {
+			var changes atomic.Uint64
+			stop := make(chan struct{})
+			var churning sync.WaitGroup
+			if churn {
+				for w := 0; w < 4; w++ {
+					churning.Add(1)
+					go func(w int) {
+						defer churning.Done()
+						for i := w; ; i += 4 {
+							select {
+							case <-stop:
+								return
+							default:
+							}
+							cid, group := ids[i%clients], "side-"+strconv.Itoa(i%64)
+							e.AddToGroup(group, cid)
+							e.RemoveFromGroup(group, cid)
+							changes.Add(2)
+						}
+					}(w)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				received.Add(clients)
+				if err := room.Call("tick", i); err != nil {
+					b.Fatal(err)
+				}
+				received.Wait()
+			}
+			b.StopTimer()
+			close(stop)
+			churning.Wait()
+			if churn {
+				b.ReportMetric(float64(changes.Load())/time.Since(start).Seconds(), "changes/s")
+			}
+		})
+	}
+}
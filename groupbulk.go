@@ -0,0 +1,131 @@
+package relayr
+
+import "github.com/simon-whitehead/relayr/protocol"
+
+// commandRemoved is the command of the control frame that tells a client,
+// with ClearGroup, the group it was removed from.
+const commandRemoved = protocol.CommandRemoved
+
+// AddToGroupBulk adds the clients with the given ConnectionIDs to a group
+// at once, returning how many were added. Unknown clients, and members of
+// the group already, are skipped. The group's members are told of those
+// added in one presence notification, and event subscribers in one
+// EventGroupJoined. It returns a *GroupNameError if the group's name is
+// not allowed.
+func (e *Exchange) AddToGroupBulk(group string, connectionIDs []string) (int, error) {
+	if err := e.validateGroupName(group); err != nil {
+		return 0, err
+	}
+
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+	var cs []*client
+	for _, id := range connectionIDs {
+		if c := e.connected[id]; c != nil {
+			cs = append(cs, c)
+		}
+	}
+	added := e.addAllToGroupLocked(group, cs)
+	e.logger.Debugf("%d clients added to '%s'", len(added), group)
+	return len(added), nil
+}
+
+// MoveGroup moves every member of one group to another at once, as from
+// a lobby to a game, returning how many were moved. The first group is
+// no more; members of both are left in the second. Presence and event
+// subscribers are told as they are by ClearGroup and AddToGroupBulk. It
+// returns a *GroupNameError if the second group's name is not allowed.
+func (e *Exchange) MoveGroup(from, to string) (int, error) {
+	if err := e.validateGroupName(to); err != nil {
+		return 0, err
+	}
+	if from == to {
+		return 0, nil
+	}
+
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+	members := e.clearGroupLocked(from)
+	e.addAllToGroupLocked(to, members)
+	e.logger.Debugf("%d clients moved from '%s' to '%s'", len(members), from, to)
+	return len(members), nil
+}
+
+// ClearGroup removes every member from a group at once, returning how
+// many were removed, and with notify tells each of them, through the
+// client script's removed event. The group's members are told of those
+// removed in one presence notification, without the PresenceGracePeriod,
+// and event subscribers in one EventGroupLeft.
+func (e *Exchange) ClearGroup(group string, notify bool) int {
+	e.mapLock.Lock()
+	members := e.clearGroupLocked(group)
+	e.mapLock.Unlock()
+
+	e.logger.Debugf("%d clients removed from '%s'", len(members), group)
+	if notify {
+		for _, c := range members {
+			e.sendFrame(c.ConnectionID, "group removal", &controlFrame{Command: commandRemoved, Group: group})
+		}
+	}
+	return len(members)
+}
+
+// addAllToGroupLocked adds clients to a group, creating it if necessary,
+// and records that those not in it already joined it together, whom it
+// returns. The caller must hold mapLock for writing.
+func (e *Exchange) addAllToGroupLocked(name string, cs []*client) []*client {
+	if len(cs) == 0 {
+		return nil
+	}
+	g := e.groups[name]
+	if g == nil {
+		g = newGroup()
+		e.groups[name] = g
+	}
+	var added []*client
+	for _, c := range cs {
+		if e.joinGroup(g, name, c, true) {
+			added = append(added, c)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(added))
+	for i, c := range added {
+		ids[i] = c.ConnectionID
+		e.conns.joined(c.ConnectionID, name)
+	}
+	e.groupJoined(name)
+	e.presenceJoinedMany(added, name)
+	e.emit(ExchangeEvent{Type: EventGroupJoined, Group: name, ConnectionIDs: ids})
+	return added
+}
+
+// clearGroupLocked deletes a group, recording that its members left it
+// together, and returns them. The caller must hold mapLock for writing.
+func (e *Exchange) clearGroupLocked(name string) []*client {
+	g := e.groups[name]
+	if g == nil {
+		return nil
+	}
+	delete(e.groups, name)
+	g.lock.Lock()
+	members := g.clientsLocked()
+	g.members = make(map[string]*client)
+	g.lock.Unlock()
+	if len(members) == 0 || name == "Global" {
+		return members
+	}
+
+	ids := make([]string, len(members))
+	for i, c := range members {
+		ids[i] = c.ConnectionID
+		e.conns.left(c.ConnectionID, name)
+	}
+	e.groupEmptied(name)
+	e.presenceLeftMany(ids, name)
+	e.emit(ExchangeEvent{Type: EventGroupLeft, Group: name, ConnectionIDs: ids})
+	return members
+}
@@ -0,0 +1,252 @@
+package relayr
+
+import (
+	"sync"
+	"time"
+)
+
+// groupExpiry follows the groups left empty whose names match a pattern
+// given to SetGroupExpiry, so that they can be expired once they have
+// stayed empty long enough. Its lock is always acquired after the mapLock
+// and the groups' locks.
+type groupExpiry struct {
+	lock  sync.Mutex
+	rules []*expiryRule
+	empty map[string]emptyGroup // by group name
+	kick  chan struct{}         // signalled when a group is left empty
+}
+
+type expiryRule struct {
+	pattern  string
+	match    func(name string) bool
+	after    time.Duration
+	onExpire func(group string)
+}
+
+// emptyGroup is a group left empty, which expires at the given time
+// unless a client joins it first.
+type emptyGroup struct {
+	rule *expiryRule
+	at   time.Time
+}
+
+// SetGroupExpiry expires each group whose name matches pattern, in the
+// syntax of path.Match, once it has had no members for after: the calls
+// retained for it by RetainGroupMessages, the states kept for it by
+// CallStateful and its presence are forgotten, a group kept with
+// KeepEmptyGroups is deleted, and then onExpire, if not nil, is called
+// with its name, so that the application can tidy up after it. A client
+// joining the group before then stops it expiring. Each group left empty
+// expires at most once, from a goroutine of the Exchange's that stops
+// when it is closed.
+//
+// Calling it again with the same pattern replaces its after and onExpire;
+// an after of zero or less stops expiring the groups matching pattern. A
+// group matching several patterns follows the first given. Groups that
+// were left empty before it was called do not expire.
+func (e *Exchange) SetGroupExpiry(pattern string, after time.Duration, onExpire func(group string)) error {
+	match, err := groupMatcher(pattern)
+	if err != nil {
+		return err
+	}
+
+	x := e.expiry.Load()
+	if x == nil {
+		if !e.track() {
+			return errExchangeClosed
+		}
+		if e.expiry.CompareAndSwap(nil, &groupExpiry{empty: make(map[string]emptyGroup), kick: make(chan struct{}, 1)}) {
+			go e.sweepGroups(e.expiry.Load())
+		} else {
+			e.wg.Done()
+		}
+		x = e.expiry.Load()
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for i, rule := range x.rules {
+		if rule.pattern != pattern {
+			continue
+		}
+		if after <= 0 {
+			x.rules = append(x.rules[:i], x.rules[i+1:]...)
+			for name, g := range x.empty {
+				if g.rule == rule {
+					delete(x.empty, name)
+				}
+			}
+			return nil
+		}
+		rule.after, rule.onExpire = after, onExpire
+		return nil
+	}
+	if after > 0 {
+		x.rules = append(x.rules, &expiryRule{pattern: pattern, match: match, after: after, onExpire: onExpire})
+	}
+	return nil
+}
+
+// groupEmptied starts a group that was left empty expiring, if it matches
+// a pattern given to SetGroupExpiry.
+func (e *Exchange) groupEmptied(name string) {
+	x := e.expiry.Load()
+	if x == nil || name == "Global" {
+		return
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, rule := range x.rules {
+		if rule.match(name) {
+			x.empty[name] = emptyGroup{rule: rule, at: time.Now().Add(rule.after)}
+			select {
+			case x.kick <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// groupJoined stops a group a client joined from expiring.
+func (e *Exchange) groupJoined(name string) {
+	x := e.expiry.Load()
+	if x == nil {
+		return
+	}
+
+	x.lock.Lock()
+	delete(x.empty, name)
+	x.lock.Unlock()
+}
+
+// sweepGroups expires the groups left empty as they come due, until the
+// Exchange is closed.
+func (e *Exchange) sweepGroups(x *groupExpiry) {
+	defer e.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		wait := time.Hour
+		if next := e.expireGroups(x, time.Now()); !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-x.kick:
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// expireGroups expires the groups that are due by now, returning when the
+// next is due, or the zero time if none is.
+func (e *Exchange) expireGroups(x *groupExpiry, now time.Time) time.Time {
+	x.lock.Lock()
+	var due []string
+	var next time.Time
+	for name, g := range x.empty {
+		switch {
+		case !g.at.After(now):
+			due = append(due, name)
+		case next.IsZero() || g.at.Before(next):
+			next = g.at
+		}
+	}
+	x.lock.Unlock()
+
+	for _, name := range due {
+		e.expireGroup(x, name, now)
+	}
+	return next
+}
+
+// expireGroup expires a group if it is still due by now and has stayed
+// empty.
+func (e *Exchange) expireGroup(x *groupExpiry, name string, now time.Time) {
+	e.mapLock.Lock()
+	x.lock.Lock()
+	g, ok := x.empty[name]
+	if !ok || g.at.After(now) {
+		x.lock.Unlock()
+		e.mapLock.Unlock()
+		return
+	}
+	delete(x.empty, name)
+	x.lock.Unlock()
+
+	if members := e.groups[name]; members != nil {
+		if members.len() > 0 {
+			// a client joined as the group was left empty
+			e.mapLock.Unlock()
+			return
+		}
+		delete(e.groups, name)
+	}
+	if r := e.retention.Load(); r != nil {
+		r.forget(name)
+	}
+	if s := e.states.Load(); s != nil {
+		s.forget(name)
+	}
+	if p := e.presence.Load(); p != nil {
+		p.forget(name)
+	}
+	e.mapLock.Unlock()
+
+	e.logger.Debugf("group '%s' expired after %v empty", name, g.rule.after)
+	if g.rule.onExpire != nil {
+		g.rule.onExpire(name)
+	}
+}
+
+// forget drops the calls retained for a group.
+func (r *retention) forget(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if h := r.histories[name]; h != nil {
+		for len(h.calls) > 0 {
+			r.dropLocked(h.calls[0])
+		}
+	}
+}
+
+// forget drops the states kept for a group.
+func (s *stateStore) forget(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, st := range s.byGroup[name] {
+		s.dropLocked(st)
+	}
+}
+
+// forget drops a group's presence, which only users yet to be reported
+// leaving it are left in once it is empty.
+func (p *presenceTracker) forget(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	g := p.groups[name]
+	if g == nil || len(g.byConn) > 0 {
+		return
+	}
+	for _, u := range g.byKey {
+		if u.leaving != nil {
+			u.leaving.Stop()
+		}
+	}
+	delete(p.groups, name)
+}
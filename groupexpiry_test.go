@@ -0,0 +1,154 @@
+package relayr
+
+import (
+	"testing"
+	"time"
+)
+
+// expiries returns an onExpire that sends the groups it is called with on
+// the channel returned.
+func expiries() (func(group string), chan string) {
+	ch := make(chan string, 10)
+	return func(group string) { ch <- group }, ch
+}
+
+// checkNotExpired fails t if a group expires within wait.
+func checkNotExpired(t *testing.T, ch chan string, wait time.Duration) {
+	t.Helper()
+	select {
+	case name := <-ch:
+		t.Fatalf("%q expired", name)
+	case <-time.After(wait):
+	}
+}
+
+func TestGroupExpiry(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	onExpire, ch := expiries()
+	if err := e.SetGroupExpiry("room:*", 100*time.Millisecond, onExpire); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RetainGroupMessages("room:*", 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, srv, "websocket")
+	for _, g := range []string{"room:1", "lobby"} {
+		if err := e.AddToGroup(g, c.ConnectionID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Clients(Ticker{}).Group("room:1").Call("tick", "retained"); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"room:1", "lobby"} {
+		if err := e.RemoveFromGroup(g, c.ConnectionID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	select {
+	case name := <-ch:
+		if name != "room:1" {
+			t.Fatalf("%q expired, want room:1", name)
+		}
+		if waited := time.Since(start); waited < 100*time.Millisecond {
+			t.Fatalf("a group expiring after 100ms expired after %v", waited)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the empty group did not expire")
+	}
+	// it expires once, and lobby, which matches no pattern, not at all
+	checkNotExpired(t, ch, 300*time.Millisecond)
+
+	// the calls retained for it were forgotten: a client joining is sent
+	// only the call made after
+	other := dial(t, srv, "websocket")
+	ticks := calls(other, "Ticker", "tick")
+	if err := e.AddToGroup("room:1", other.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Clients(Ticker{}).Group("room:1").Call("tick", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, ticks); string(args[0]) != `"after"` {
+		t.Fatalf("a client joining the expired group received %s", args[0])
+	}
+}
+
+// TestGroupExpiryRejoin checks that a client joining an empty group
+// before it expires stops it expiring, and that it expires once left
+// empty again.
+func TestGroupExpiryRejoin(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	onExpire, ch := expiries()
+	if err := e.SetGroupExpiry("room:?", 200*time.Millisecond, onExpire); err != nil {
+		t.Fatal(err)
+	}
+	cid := dial(t, srv, "websocket").ConnectionID()
+	if err := e.AddToGroup("room:1", cid); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RemoveFromGroup("room:1", cid); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := e.AddToGroup("room:1", cid); err != nil {
+		t.Fatal(err)
+	}
+	checkNotExpired(t, ch, 400*time.Millisecond)
+
+	if err := e.RemoveFromGroup("room:1", cid); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-ch:
+		if name != "room:1" {
+			t.Fatalf("%q expired, want room:1", name)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the group left empty again did not expire")
+	}
+	checkNotExpired(t, ch, 300*time.Millisecond)
+}
+
+func TestGroupExpiryPatterns(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	if err := e.SetGroupExpiry("[", time.Second, nil); err == nil {
+		t.Fatal("a malformed pattern was accepted")
+	}
+	onExpire, ch := expiries()
+	if err := e.SetGroupExpiry("game-?/*", 50*time.Millisecond, onExpire); err != nil {
+		t.Fatal(err)
+	}
+	// a group matching several patterns follows the first given
+	if err := e.SetGroupExpiry("game-1/*", time.Hour, onExpire); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetGroupExpiry("stopped", 50*time.Millisecond, onExpire); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetGroupExpiry("stopped", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cid := dial(t, srv, "websocket").ConnectionID()
+	groups := []string{"game-1/red", "game-12/red", "game-1", "stopped"}
+	for _, g := range groups {
+		if err := e.AddToGroup(g, cid); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.RemoveFromGroup(g, cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case name := <-ch:
+		if name != "game-1/red" {
+			t.Fatalf("%q expired, want game-1/red", name)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the group matching the pattern did not expire")
+	}
+	checkNotExpired(t, ch, 300*time.Millisecond)
+}
@@ -0,0 +1,60 @@
+package relayr
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// reservedGroupPrefix starts the names the Exchange keeps for itself, as
+// it does the presence relay's. Clients cannot be added to such groups.
+const reservedGroupPrefix = "__relayr"
+
+// GroupNameError is returned when a client is added to a group whose
+// name is not allowed: empty, longer than the MaxGroupNameLength, holding
+// control characters or invalid UTF-8, reserved, as Global and names
+// starting with "__relayr" are, or refused by the ValidateGroupName
+// option.
+type GroupNameError struct {
+	Group  string
+	Reason string
+}
+
+func (e *GroupNameError) Error() string {
+	name := e.Group
+	if len(name) > 32 {
+		name = name[:32] + "..."
+	}
+	return fmt.Sprintf("relayr: group name %q %s", name, e.Reason)
+}
+
+// validateGroupName returns a *GroupNameError if clients may not be added
+// to the group with the given name, named in full.
+func (e *Exchange) validateGroupName(name string) error {
+	reason := ""
+	switch {
+	case name == "":
+		reason = "is empty"
+	case len(name) > e.options.MaxGroupNameLength:
+		reason = fmt.Sprintf("is longer than %d bytes", e.options.MaxGroupNameLength)
+	case name == "Global" || strings.HasPrefix(name, reservedGroupPrefix):
+		reason = "is reserved"
+	case !utf8.ValidString(name):
+		reason = "is not valid UTF-8"
+	case strings.IndexFunc(name, isControl) >= 0:
+		reason = "holds control characters"
+	}
+	if reason == "" && e.options.ValidateGroupName != nil {
+		if err := e.options.ValidateGroupName(name); err != nil {
+			reason = err.Error()
+		}
+	}
+	if reason != "" {
+		return &GroupNameError{Group: name, Reason: reason}
+	}
+	return nil
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r >= 0x7f && r < 0xa0
+}
@@ -0,0 +1,106 @@
+package relayr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// groupNames are names of groups clients may or may not be added to,
+// with the reason a name is refused for.
+var groupNames = []struct {
+	name   string
+	group  string
+	reason string
+}{
+	{"plain", "room", ""},
+	{"punctuated", "room:7/general", ""},
+	{"unicode", "café☕", ""},
+	{"longest", strings.Repeat("a", defaultMaxGroupName), ""},
+	{"empty", "", "is empty"},
+	{"too long", strings.Repeat("a", defaultMaxGroupName+1), "is longer than 128 bytes"},
+	{"NUL", "room\x00", "holds control characters"},
+	{"newline", "room\n7", "holds control characters"},
+	{"DEL", "room\x7f", "holds control characters"},
+	{"C1", "room\u0085", "holds control characters"},
+	{"invalid UTF-8", "room\xff", "is not valid UTF-8"},
+	{"Global", "Global", "is reserved"},
+	{"reserved prefix", "__relayr", "is reserved"},
+	{"presence relay", presenceRelay, "is reserved"},
+	{"refused by ValidateGroupName", "private room", "may not hold spaces"},
+}
+
+// noSpaces is a ValidateGroupName that refuses names holding spaces.
+func noSpaces(name string) error {
+	if strings.Contains(name, " ") {
+		return errors.New("may not hold spaces")
+	}
+	return nil
+}
+
+func TestAddToGroupValidatesName(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{ValidateGroupName: noSpaces}, Ticker{})
+	_, cid := openWebSocket(t, srv)
+	for _, tt := range groupNames {
+		t.Run(tt.name, func(t *testing.T) {
+			err := e.AddToGroup(tt.group, cid)
+			if tt.reason == "" {
+				if err != nil || !e.IsInGroup(tt.group, cid) {
+					t.Fatalf("adding to %q failed with %v", tt.group, err)
+				}
+				return
+			}
+			var nerr *GroupNameError
+			if !errors.As(err, &nerr) || nerr.Group != tt.group || nerr.Reason != tt.reason {
+				t.Fatalf("adding to %q failed with %v, want it refused as it %s", tt.group, err, tt.reason)
+			}
+			if tt.group != "Global" && e.IsInGroup(tt.group, cid) {
+				t.Fatalf("the client was added to %q", tt.group)
+			}
+		})
+	}
+}
+
+func TestClientJoinValidatesName(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{
+		ValidateGroupName:   noSpaces,
+		GroupJoinAuthorizer: func(connectionID, group string, principal interface{}) bool { return true },
+	}, Ticker{})
+	ws, cid := openWebSocket(t, srv)
+	longpoll := negotiate(t, srv, "longpoll").ConnectionID
+	for i, tt := range groupNames {
+		t.Run(tt.name, func(t *testing.T) {
+			if !utf8.ValidString(tt.group) {
+				t.Skip("JSON cannot carry invalid UTF-8")
+			}
+			id := strconv.Itoa(i)
+			if err := ws.WriteJSON(protocol.Inbound{Type: protocol.TypeJoinGroup, Group: tt.group, InvocationID: id}); err != nil {
+				t.Fatal(err)
+			}
+			c := readCompletion(t, ws, id)
+			if tt.reason == "" {
+				if c.Error != "" || !e.IsInGroup(tt.group, cid) {
+					t.Fatalf("joining %q completed with %+v", tt.group, c)
+				}
+			} else if want := (&GroupNameError{Group: tt.group, Reason: tt.reason}).Error(); c.Error != want {
+				t.Fatalf("joining %q completed with %+v, want the error %q", tt.group, c, want)
+			}
+
+			// long-polling clients are refused with 400
+			frame, _ := json.Marshal(protocol.Inbound{Type: protocol.TypeJoinGroup, Group: tt.group, InvocationID: id})
+			want := http.StatusOK
+			if tt.reason != "" {
+				want = http.StatusBadRequest
+			}
+			if status := postFrame(t, srv, longpoll, string(frame)); status != want {
+				t.Fatalf("a long-polling client joining %q was answered %d, want %d", tt.group, status, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package relayr
+
+import "fmt"
+
+// NotInGroupError is returned by RemoveFromGroup for a client that was
+// not in the group, so that removing a client twice can be told apart
+// from removing the wrong one.
+type NotInGroupError struct {
+	Group        string
+	ConnectionID string
+}
+
+func (e *NotInGroupError) Error() string {
+	return fmt.Sprintf("relayr: client %s is not in the group %q", e.ConnectionID, e.Group)
+}
+
+// RemoveFromGroup removes the client with the given ConnectionID from a
+// group, as Relay.Groups(group).Remove does from within a relay method.
+// The group is named in full, as Groups reports it. The group's members
+// are told the client left through presence, and event subscribers
+// through EventGroupLeft. The group is deleted once its last member is
+// removed, unless KeepEmptyGroups is set. It returns a *NotInGroupError
+// if the client was not in the group, and ErrConnectionNotFound if there
+// is no such client.
+func (e *Exchange) RemoveFromGroup(group, connectionID string) error {
+	if e.removeFromGroupByID(group, connectionID) {
+		return nil
+	}
+	if e.getClientByConnectionID(connectionID) == nil {
+		return ErrConnectionNotFound
+	}
+	return &NotInGroupError{Group: group, ConnectionID: connectionID}
+}
+
+// RemoveFromGroup removes the client that invoked the current server
+// method from a group, which with NamespaceGroups is in the relay's
+// namespace unless it is marked with GlobalGroup. It returns errors as
+// Exchange.RemoveFromGroup does.
+func (c *ClientOperations) RemoveFromGroup(group string) error {
+	if c.relay.ConnectionID == "" {
+		return ErrConnectionNotFound
+	}
+	return c.e.RemoveFromGroup(c.relay.qualifyGroup(group), c.relay.ConnectionID)
+}
@@ -0,0 +1,80 @@
+package relayr
+
+import (
+	"net/http"
+	"strings"
+)
+
+// operationHandler serves a single operation of an Exchange, for routers
+// that route each to a handler of its own. The Exchange is taken to be
+// served under mount when mounted is set, as by Mount, and otherwise
+// under the path the operation is requested at, less the operation.
+// route, if set, is the URL the client script it serves connects to.
+type operationHandler struct {
+	e       *Exchange
+	op      string
+	mount   string
+	mounted bool
+	route   string
+}
+
+func (h operationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mount := h.mount
+	if !h.mounted {
+		mount = h.e.mountFor(r, h.op)
+	}
+	h.e.serveOperation(w, r, h.op, mount, h.route)
+}
+
+// NegotiateHandler returns the handler for the requests clients negotiate
+// their connections with. Like the handlers of the Exchange's other
+// operations, it serves what ServeHTTP does for the same request, and
+// must be served at the path the client script asks for, here the URL
+// the Exchange is served at followed by "/negotiate", so that middleware
+// may be put in front of some operations and not others.
+func (e *Exchange) NegotiateHandler() http.Handler {
+	return operationHandler{e: e, op: opNegotiate}
+}
+
+// WebSocketHandler returns the handler for the requests that upgrade
+// clients to websockets, served at "/ws".
+func (e *Exchange) WebSocketHandler() http.Handler {
+	return operationHandler{e: e, op: opWebSocket}
+}
+
+// LongPollHandler returns the handler for the long polls of clients that
+// are not using websockets, served at "/longpoll".
+func (e *Exchange) LongPollHandler() http.Handler {
+	return operationHandler{e: e, op: opLongPoll}
+}
+
+// CallHandler returns the handler for the calls clients that are not
+// using websockets post, served at "/call".
+func (e *Exchange) CallHandler() http.Handler {
+	return operationHandler{e: e, op: opCallServer}
+}
+
+// ScriptHandler returns the handler serving the client script, which may
+// be served at any path, connecting to the Exchange served at baseURL,
+// such as "https://example.com/relayr", or if it is empty at the mainURL,
+// or with AutoDetectOrigin the origin the script is requested from,
+// followed by the MountPath.
+func (e *Exchange) ScriptHandler(baseURL string) http.Handler {
+	mount := strings.TrimSuffix(e.options.MountPath, "/")
+	return operationHandler{e: e, op: opScript, mount: mount, mounted: true, route: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Mount registers the handlers of each of the Exchange's operations with
+// mux under prefix, such as "/relayr", at the paths it serves them at
+// with prefix as its MountPath: the client script at prefix+"/client.js",
+// negotiation at prefix+"/negotiate", and so on. The Exchange is taken to
+// be served under prefix in the URLs it gives clients, whatever its
+// MountPath.
+func (e *Exchange) Mount(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	for path, op := range mountedOperations {
+		if e.serves(op) {
+			mux.Handle(prefix+path, operationHandler{e: e, op: op, mount: prefix, mounted: true})
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package relayr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// healthCheckTimeout bounds how long the "healthz" operation waits for the
+// health checks.
+const healthCheckTimeout = 5 * time.Second
+
+// healthOK is the status of a health check that passed.
+const healthOK = "ok"
+
+var (
+	errHealthClosed   = errors.New("relayr: exchange is shutting down")
+	errHealthDraining = errors.New("relayr: exchange is draining")
+)
+
+// BackplanePinger is implemented by Backplanes that can check that they
+// are connected, as RedisBackplane does. The health check's "backplane"
+// check pings a Backplane that implements it, and passes for one that
+// does not.
+type BackplanePinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthReport is the health of an Exchange, as returned by Health.
+type HealthReport struct {
+	Healthy bool              // every check passed
+	Checks  map[string]string // "ok", or why the check failed, by name
+}
+
+// healthCheck is a check Health runs, built in or added with
+// AddHealthCheck.
+type healthCheck struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// AddHealthCheck adds a check to those Health runs, under name, failing
+// the Exchange's health whenever fn returns an error. fn is given a
+// context that is done when the health check gives up waiting for it. A
+// check added under the name of another, built-in ones included, replaces
+// it.
+func (e *Exchange) AddHealthCheck(name string, fn func(ctx context.Context) error) {
+	e.healthLock.Lock()
+	defer e.healthLock.Unlock()
+	for i, c := range e.healthChecks {
+		if c.name == name {
+			e.healthChecks[i].fn = fn
+			return
+		}
+	}
+	e.healthChecks = append(e.healthChecks, healthCheck{name: name, fn: fn})
+}
+
+// Health runs the Exchange's health checks, at once, and reports whether
+// they pass, giving up on those still running when ctx is done. The
+// built-in checks are "transports", failing once the Exchange is closing,
+// "drain", failing once it is draining, "dispatcher", failing while calls
+// waiting to run fill the HealthQueueThreshold of the MaxQueuedCalls,
+// "backplane", with a Backplane, failing when a BackplanePinger cannot
+// be pinged, and "goroutines", with HealthMaxGoroutines, failing while
+// the process runs more; those added with AddHealthCheck follow.
+func (e *Exchange) Health(ctx context.Context) HealthReport {
+	checks := e.builtinHealthChecks()
+	e.healthLock.Lock()
+	for _, c := range e.healthChecks {
+		checks = replaceHealthCheck(checks, c)
+	}
+	e.healthLock.Unlock()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for _, c := range checks {
+		go func(c healthCheck) {
+			results <- result{c.name, runHealthCheck(ctx, c.fn)}
+		}(c)
+	}
+
+	report := HealthReport{Healthy: true, Checks: make(map[string]string, len(checks))}
+	for range checks {
+		select {
+		case r := <-results:
+			report.Checks[r.name] = healthOK
+			if r.err != nil {
+				report.Checks[r.name] = r.err.Error()
+			}
+		case <-ctx.Done():
+		}
+	}
+	for _, c := range checks {
+		if _, ok := report.Checks[c.name]; !ok {
+			report.Checks[c.name] = ctx.Err().Error()
+		}
+		if report.Checks[c.name] != healthOK {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// runHealthCheck runs a health check, failing it if it panics.
+func runHealthCheck(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("relayr: panic: %v", p)
+		}
+	}()
+	return fn(ctx)
+}
+
+// replaceHealthCheck returns checks with c in place of the check of the
+// same name, or after them if there is none.
+func replaceHealthCheck(checks []healthCheck, c healthCheck) []healthCheck {
+	for i := range checks {
+		if checks[i].name == c.name {
+			checks[i] = c
+			return checks
+		}
+	}
+	return append(checks, c)
+}
+
+// builtinHealthChecks returns the checks Health runs before those added
+// with AddHealthCheck.
+func (e *Exchange) builtinHealthChecks() []healthCheck {
+	checks := []healthCheck{
+		{"transports", func(ctx context.Context) error {
+			if e.isClosed() {
+				return errHealthClosed
+			}
+			return nil
+		}},
+		{"drain", func(ctx context.Context) error {
+			if e.draining.Load() != nil {
+				return errHealthDraining
+			}
+			return nil
+		}},
+		{"dispatcher", func(ctx context.Context) error {
+			max := e.options.MaxQueuedCalls
+			if n := e.dispatcher.pending(); max > 0 && float64(n) >= e.options.HealthQueueThreshold*float64(max) {
+				return fmt.Errorf("relayr: %d of %d calls queued", n, max)
+			}
+			return nil
+		}},
+	}
+
+	e.mapLock.RLock()
+	b := e.backplane
+	e.mapLock.RUnlock()
+	if b != nil {
+		checks = append(checks, healthCheck{"backplane", func(ctx context.Context) error {
+			if p, ok := b.(BackplanePinger); ok {
+				return p.Ping(ctx)
+			}
+			return nil
+		}})
+	}
+	if max := e.options.HealthMaxGoroutines; max > 0 {
+		checks = append(checks, healthCheck{"goroutines", func(ctx context.Context) error {
+			if n := runtime.NumGoroutine(); n > max {
+				return fmt.Errorf("relayr: %d goroutines running", n)
+			}
+			return nil
+		}})
+	}
+	return checks
+}
+
+// pending returns the number of calls waiting to run, or with
+// ConcurrentCalls running, as MaxQueuedCalls bounds them.
+func (d *dispatcher) pending() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.running > d.waiting {
+		return d.running
+	}
+	return d.waiting
+}
+
+// serveHealth answers a request for the "healthz" operation with the
+// Exchange's Health, 200 when it is healthy and 503 when it is not.
+func (e *Exchange) serveHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	report := e.Health(ctx)
+
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w)
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+		e.logger.Debugf("health check failing: %v", report.Checks)
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		json.NewEncoder(w).Encode(report)
+	}
+}
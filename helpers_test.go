@@ -0,0 +1,227 @@
+package relayr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	rclient "github.com/simon-whitehead/relayr/client"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// testTimeout bounds how long a test waits for anything to arrive.
+const testTimeout = 5 * time.Second
+
+// newExchange makes an Exchange served at mainURL, closing it as the
+// test ends.
+func newExchange(t testing.TB, mainURL string, opts ExchangeOptions) *Exchange {
+	e := NewExchangeWithOptions(mainURL, opts)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		if err := e.Close(ctx); err != nil {
+			t.Errorf("closing the Exchange: %v", err)
+		}
+	})
+	return e
+}
+
+// serve starts an Exchange made with opts, with the relays registered,
+// behind an HTTP server at /relayr. Both are closed as the test ends.
+func serve(t testing.TB, opts ExchangeOptions, relays ...interface{}) (*Exchange, *httptest.Server) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	// registered after the server, so closed before it
+	e := newExchange(t, srv.URL+"/relayr", opts)
+	mux.Handle("/relayr/", e)
+	for _, r := range relays {
+		if err := e.RegisterRelay(r); err != nil {
+			t.Fatalf("registering %T: %v", r, err)
+		}
+	}
+	return e, srv
+}
+
+// dial connects a Go client to the Exchange srv serves over transport,
+// closing it as the test ends.
+func dial(t *testing.T, srv *httptest.Server, transport string) *rclient.Client {
+	t.Helper()
+	return dialWith(t, srv, rclient.Options{Transport: transport})
+}
+
+// dialWith connects a Go client made with opts to the Exchange srv
+// serves, closing it as the test ends.
+func dialWith(t *testing.T, srv *httptest.Server, opts rclient.Options) *rclient.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	c, err := rclient.Dial(ctx, srv.URL+"/relayr", opts)
+	if err != nil {
+		t.Fatalf("dialing over %s: %v", opts.Transport, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// calls returns a channel receiving the arguments of the calls c's
+// handler for a client method is given.
+func calls(c *rclient.Client, relay, method string) <-chan []json.RawMessage {
+	ch := make(chan []json.RawMessage, 1024)
+	c.On(relay, method, func(args []json.RawMessage) {
+		ch <- args
+	})
+	return ch
+}
+
+// receive returns the next call ch receives, failing the test if none
+// arrives in time.
+func receive(t *testing.T, ch <-chan []json.RawMessage) []json.RawMessage {
+	t.Helper()
+	select {
+	case args := <-ch:
+		return args
+	case <-time.After(testTimeout):
+		t.Fatal("no call arrived")
+		return nil
+	}
+}
+
+// negotiate negotiates a connection over transport with the Exchange
+// srv serves, as a client speaking the newest protocol.
+func negotiate(t testing.TB, srv *httptest.Server, transport string) protocol.NegotiationResponse {
+	t.Helper()
+	body, _ := json.Marshal(protocol.Negotiation{T: transport, V: protocol.Version})
+	resp, err := http.Post(srv.URL+"/relayr/negotiate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("negotiating: %v", err)
+	}
+	defer resp.Body.Close()
+	var res protocol.NegotiationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.ConnectionID == "" {
+		t.Fatalf("negotiating: %d %v", resp.StatusCode, err)
+	}
+	return res
+}
+
+// wsURL returns the URL of the websocket of the connection res
+// negotiated with the Exchange srv serves.
+func wsURL(srv *httptest.Server, res protocol.NegotiationResponse) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/relayr/ws?connectionId=" + res.ConnectionID
+}
+
+// openWebSocket negotiates a connection with the Exchange srv serves and
+// opens its websocket, reading the handshake, closing it as the test
+// ends.
+func openWebSocket(t testing.TB, srv *httptest.Server) (*websocket.Conn, string) {
+	t.Helper()
+	res := negotiate(t, srv, "websocket")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv, res), nil)
+	if err != nil {
+		t.Fatalf("opening a websocket: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatalf("reading the handshake: %v", err)
+	}
+	ws.SetReadDeadline(time.Time{})
+	return ws, res.ConnectionID
+}
+
+// pollResult is the answer to a long poll: a batch of frames, or a
+// control frame.
+type pollResult struct {
+	protocol.Control
+	protocol.LongPollBatch
+}
+
+// poll long-polls the Exchange srv serves for the frames queued for cid
+// after seq.
+func poll(t *testing.T, srv *httptest.Server, cid string, seq uint64) pollResult {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/relayr/longpoll?connectionId=" + cid + "&seq=" + strconv.FormatUint(seq, 10))
+	if err != nil {
+		t.Fatalf("polling: %v", err)
+	}
+	defer resp.Body.Close()
+	var res pollResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("polling: %d %v", resp.StatusCode, err)
+	}
+	return res
+}
+
+// clientCalls decodes the client invocations among frames.
+func clientCalls(t *testing.T, frames []json.RawMessage) []protocol.ClientInvocation {
+	t.Helper()
+	var r []protocol.ClientInvocation
+	for _, f := range frames {
+		var inv protocol.ClientInvocation
+		if err := json.Unmarshal(f, &inv); err != nil {
+			t.Fatalf("decoding %s: %v", f, err)
+		}
+		if inv.Type == protocol.TypeClientInvocation {
+			r = append(r, inv)
+		}
+	}
+	return r
+}
+
+// callOverHTTP calls a relay method as the long-polling client cid,
+// returning the status the call was answered with.
+func callOverHTTP(t *testing.T, srv *httptest.Server, cid, relay, method string, args ...interface{}) int {
+	t.Helper()
+	if args == nil {
+		args = []interface{}{}
+	}
+	body, _ := json.Marshal(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: relay, Method: method, Arguments: args})
+	resp, err := http.Post(srv.URL+"/relayr/call?connectionId="+cid, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("calling %s.%s: %v", relay, method, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// readFrames reads the next message of ws, returning the frames it
+// carries, of which there are several when the Exchange batched them.
+func readFrames(t testing.TB, ws *websocket.Conn) []json.RawMessage {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+	_, m, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if len(m) > 0 && m[0] == '[' {
+		var frames []json.RawMessage
+		if err := json.Unmarshal(m, &frames); err != nil {
+			t.Fatalf("decoding %s: %v", m, err)
+		}
+		return frames
+	}
+	return []json.RawMessage{m}
+}
+
+// readCompletion reads the frames of ws until the completion of the
+// invocation id arrives.
+func readCompletion(t testing.TB, ws *websocket.Conn, id string) protocol.Completion {
+	t.Helper()
+	for {
+		for _, f := range readFrames(t, ws) {
+			var c protocol.Completion
+			if json.Unmarshal(f, &c) == nil && c.Type == protocol.TypeCompletion && c.InvocationID == id {
+				return c
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package relayr
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// retention keeps the calls made to groups whose names match a pattern
+// given to RetainGroupMessages, so that they can be replayed to clients
+// that join later. Its lock is always acquired after the mapLock and the
+// groups' locks.
+type retention struct {
+	lock      sync.Mutex
+	rules     []*retentionRule
+	histories map[string]*history // by group name, for groups with calls retained
+	order     *list.List          // the retained calls of every group, oldest first
+	bytes     int64
+	max       int64
+	evicted   uint64
+}
+
+type retentionRule struct {
+	pattern string
+	match   func(name string) bool
+	n       int
+	ttl     time.Duration
+}
+
+// history is the calls retained for a group, oldest first.
+type history struct {
+	rule  *retentionRule
+	calls []*retainedCall
+}
+
+type retainedCall struct {
+	group  string
+	relay  string
+	method string
+	args   []interface{} // as they are encoded
+	size   int64
+	at     time.Time
+	elem   *list.Element // in retention.order
+}
+
+// RetainGroupMessages keeps the last n calls made to each group whose
+// name matches pattern, in the syntax of path.Match, for up to ttl, or
+// for as long as there is room when ttl is zero. A client joining such a
+// group is sent them, in the order they were made and before any call
+// made after it joined, with RelayRConnection.replaying set while their
+// handlers run. Calling it again with the same pattern replaces its n
+// and ttl; a group matching several patterns follows the first given.
+//
+// Calls are retained as they were made, without running the outbound
+// interceptors, and replayed to clients connected over the built-in
+// transports. Clients restored to their groups when they reconnect are
+// not sent them again. Retained calls take at most MaxRetainedBytes
+// between them, the oldest being dropped to make room.
+func (e *Exchange) RetainGroupMessages(pattern string, n int, ttl time.Duration) error {
+	match, err := groupMatcher(pattern)
+	if err != nil {
+		return err
+	}
+
+	r := e.retention.Load()
+	if r == nil {
+		e.retention.CompareAndSwap(nil, &retention{
+			histories: make(map[string]*history),
+			order:     list.New(),
+			max:       e.options.MaxRetainedBytes,
+		})
+		r = e.retention.Load()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, rule := range r.rules {
+		if rule.pattern == pattern {
+			rule.n, rule.ttl = n, ttl
+			return nil
+		}
+	}
+	r.rules = append(r.rules, &retentionRule{pattern: pattern, match: match, n: n, ttl: ttl})
+	return nil
+}
+
+// retainGroupCall retains a call made to a group if it is retained, and
+// returns the group's members, g being the group or nil if it has none.
+// The caller must hold the mapLock, so that the call is retained and the
+// members taken together with respect to clients joining, which are then
+// either replayed the call or sent it, never both or neither.
+func (e *Exchange) retainGroupCall(r *retention, g *group, name, relay, fn string, args []interface{}) []*client {
+	if g != nil {
+		g.lock.RLock()
+		defer g.lock.RUnlock()
+	}
+
+	args = wireArgs(args)
+	size := int64(len(name) + len(relay) + len(fn))
+	if b, err := e.json.Marshal(args); err == nil {
+		size += int64(len(b))
+	}
+	r.add(&retainedCall{group: name, relay: relay, method: fn, args: args, size: size, at: time.Now()})
+
+	if g == nil {
+		return nil
+	}
+	return g.clientsLocked()
+}
+
+// joinGroup adds c to g, the group with the given name, replaying the
+// calls retained for it and sending it the states kept for it by
+// CallStateful, unless replay is false. The caller must hold the mapLock.
+func (e *Exchange) joinGroup(g *group, name string, c *client, replay bool) bool {
+	r, s := e.retention.Load(), e.states.Load()
+	if (r == nil && s == nil) || !replay {
+		return g.add(c)
+	}
+	return g.addThen(c, func() {
+		if r != nil {
+			e.replayGroupCalls(r, c, name)
+		}
+		if s != nil {
+			e.sendGroupStates(s, c, name)
+		}
+	})
+}
+
+// replayGroupCalls sends a client that has just joined a group the calls
+// retained for it. The caller must hold the group's lock, so that no call
+// made to the group after the client joined is sent before them.
+func (e *Exchange) replayGroupCalls(r *retention, c *client, name string) {
+	calls := r.history(name)
+	if len(calls) == 0 {
+		return
+	}
+	s, ok := c.transport().(rawSender)
+	if !ok {
+		return
+	}
+	codec := c.codec
+	if codec == nil {
+		codec = e.json
+	}
+
+	policy := e.overflowPolicy(name)
+	for _, call := range calls {
+		frame, err := encodeFrame(codec, c.protocol, &clientInvocation{Relay: call.relay, Method: call.method, Arguments: call.args, Replay: true})
+		if err != nil {
+			e.logger.Errorf("encoding %s for %s: %v", call.method, c.ConnectionID, err)
+			e.reportError(TransportError, c.ConnectionID, call.relay, call.method, err)
+			continue
+		}
+		if err := s.sendCall(c.ConnectionID, frame, "", policy, time.Time{}); err != nil {
+			e.logger.Debugf("replaying %s to %s: %v", call.method, c.ConnectionID, err)
+			return
+		}
+	}
+}
+
+// ruleForLocked returns the rule retaining calls to a group, if any. The
+// caller must hold r.lock.
+func (r *retention) ruleForLocked(name string) *retentionRule {
+	for _, rule := range r.rules {
+		if rule.match(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// add retains a call, dropping the group's oldest beyond its rule's n and
+// the oldest of any group beyond the Exchange's MaxRetainedBytes.
+func (r *retention) add(call *retainedCall) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if h := r.histories[call.group]; h != nil {
+		r.expireLocked(h, call.at)
+	}
+	h := r.histories[call.group]
+	if h == nil {
+		rule := r.ruleForLocked(call.group)
+		if rule == nil || rule.n <= 0 {
+			return
+		}
+		h = &history{rule: rule}
+		r.histories[call.group] = h
+	}
+
+	call.elem = r.order.PushBack(call)
+	h.calls = append(h.calls, call)
+	r.bytes += call.size
+	for len(h.calls) > h.rule.n {
+		r.dropLocked(h.calls[0])
+	}
+	for r.bytes > r.max && r.order.Len() > 0 {
+		r.dropLocked(r.order.Front().Value.(*retainedCall))
+		r.evicted++
+	}
+}
+
+// history returns the calls retained for a group that have not expired.
+func (r *retention) history(name string) []*retainedCall {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	h := r.histories[name]
+	if h == nil {
+		return nil
+	}
+	r.expireLocked(h, time.Now())
+	return append([]*retainedCall(nil), h.calls...)
+}
+
+// expire drops the calls of every group that have expired.
+func (r *retention) expire() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	for _, h := range r.histories {
+		r.expireLocked(h, now)
+	}
+}
+
+// expireLocked drops the calls of a group that have expired by now. The
+// caller must hold r.lock.
+func (r *retention) expireLocked(h *history, now time.Time) {
+	if h.rule.ttl <= 0 {
+		return
+	}
+	for len(h.calls) > 0 && now.Sub(h.calls[0].at) > h.rule.ttl {
+		r.dropLocked(h.calls[0])
+	}
+}
+
+// dropLocked forgets a retained call, which is always the oldest of its
+// group, forgetting the group's history once it is empty. The caller
+// must hold r.lock.
+func (r *retention) dropLocked(call *retainedCall) {
+	h := r.histories[call.group]
+	h.calls[0] = nil
+	h.calls = h.calls[1:]
+	if len(h.calls) == 0 {
+		delete(r.histories, call.group)
+	}
+	r.order.Remove(call.elem)
+	r.bytes -= call.size
+}
+
+// stats returns the number of calls retained, their size and how many
+// have been dropped to stay under MaxRetainedBytes.
+func (r *retention) stats() (calls int, bytes int64, evicted uint64) {
+	r.expire()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.order.Len(), r.bytes, r.evicted
+}
@@ -0,0 +1,36 @@
+package relayr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// httpError answers a request with status and an errorResponse carrying
+// msg. It is http.Error, with a JSON body in place of plain text.
+func httpError(w http.ResponseWriter, msg string, status int) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
+
+// recoverRequest turns a panic serving r into a 500, reported to the
+// OnError handlers as a TransportError, rather than letting net/http log
+// it and drop the connection. It must be deferred. http.ErrAbortHandler,
+// with which a handler means to abort the response, is panicked again.
+func (e *Exchange) recoverRequest(w http.ResponseWriter, r *http.Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if p == http.ErrAbortHandler {
+		panic(p)
+	}
+	e.logger.Errorf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+	e.reportError(TransportError, "", "", "", fmt.Errorf("relayr: panic serving %s %s: %v", r.Method, r.URL.Path, p))
+	httpError(w, "internal error", http.StatusInternalServerError)
+}
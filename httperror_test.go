@@ -0,0 +1,171 @@
+package relayr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkErrorBody fails the test unless w was answered with a JSON body
+// naming an error.
+func checkErrorBody(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	var res errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Error == "" {
+		t.Errorf("answered %d with %q, not a JSON error", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("answered %d with Content-Type %q", w.Code, ct)
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Calculator{})
+	cid := requestNegotiation(t, e)
+
+	for _, tt := range []struct {
+		method, target, body string
+		status               int
+	}{
+		{"POST", "/", "", http.StatusMethodNotAllowed},
+		{"POST", "/relayr/nothing", "", http.StatusMethodNotAllowed},
+		{"POST", "/relayr/negotiate", "", http.StatusBadRequest},
+		{"POST", "/relayr/negotiate", "null", http.StatusBadRequest},
+		{"POST", "/relayr/negotiate", "{", http.StatusBadRequest},
+		{"POST", "/relayr/negotiate", `{"T":"carrier-pigeon"}`, http.StatusBadRequest},
+		{"GET", "/relayr/longpoll", "", http.StatusBadRequest},
+		{"GET", "/relayr/longpoll?connectionId=", "", http.StatusBadRequest},
+		{"GET", "/relayr/longpoll?connectionId=unknown", "", http.StatusForbidden},
+		{"POST", "/relayr/call", `{"T":"s","R":"Calculator","M":"Add","A":[1,2]}`, http.StatusBadRequest},
+		{"POST", "/relayr/call?connectionId=" + cid, "null", http.StatusNotFound},
+		{"POST", "/relayr/call?connectionId=" + cid, "[", http.StatusBadRequest},
+		{"GET", "/relayr/ws", "", http.StatusBadRequest},
+		{"POST", "/relayr/serverinvoke", "null", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %s %q was answered with %d, want %d: %.200s", tt.method, tt.target, tt.body, w.Code, tt.status, w.Body)
+			continue
+		}
+		checkErrorBody(t, w)
+	}
+}
+
+// requestNegotiation negotiates a long-polling connection with e,
+// returning its ConnectionID.
+func requestNegotiation(t *testing.T, e *Exchange) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("POST", "/relayr/negotiate", strings.NewReader(`{"T":"longpoll"}`)))
+	var res struct{ ConnectionID string }
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.ConnectionID == "" {
+		t.Fatalf("negotiating: %d %s", w.Code, w.Body)
+	}
+	return res.ConnectionID
+}
+
+func TestPanicServingRequest(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{
+		OnNegotiate: func(r *http.Request, id string, state *ConnectionState) {
+			panic("hook failed")
+		},
+	})
+	reported := make(chan ExchangeError, 1)
+	e.OnError(func(err ExchangeError) { reported <- err })
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("POST", "/relayr/negotiate", strings.NewReader(`{"T":"longpoll"}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("a request that panicked was answered with %d", w.Code)
+	}
+	checkErrorBody(t, w)
+	select {
+	case err := <-reported:
+		if err.Category != TransportError || !strings.Contains(err.Error(), "hook failed") {
+			t.Fatalf("reported %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the panic was not reported")
+	}
+
+	// http.ErrAbortHandler still aborts the response
+	e = newExchange(t, "http://localhost/relayr", ExchangeOptions{
+		OnNegotiate: func(r *http.Request, id string, state *ConnectionState) {
+			panic(http.ErrAbortHandler)
+		},
+	})
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/relayr/negotiate", strings.NewReader(`{"T":"longpoll"}`)))
+}
+
+func FuzzServeHTTP(f *testing.F) {
+	for _, seed := range []struct{ method, path, query, body string }{
+		{"GET", "", "", ""},
+		{"GET", "/", "", ""},
+		{"GET", "noslash", "", ""},
+		{"POST", "/relayr/negotiate", "", "null"},
+		{"POST", "/relayr/negotiate", "", `{"T":"longpoll","G":[null],"Q":{"":""}}`},
+		{"POST", "/relayr/call", "connectionId=", `{"T":"s","A":null}`},
+		{"GET", "/relayr/longpoll", "connectionId=x&seq=-1", ""},
+		{"GET", "/relayr/longpoll", "connectionId&connectionId=&seq", ""},
+		{"POST", "/relayr/serverinvoke", "", `{"Relay":null}`},
+		{"OPTIONS", "/relayr/ws", "upgrade=%zz", ""},
+		{"DELETE", "/relayr/client.js.map", "", ""},
+	} {
+		f.Add(seed.method, seed.path, seed.query, []byte(seed.body))
+	}
+
+	e := newExchange(f, "http://localhost/relayr", ExchangeOptions{LongPollMaxWait: 10 * time.Millisecond})
+	e.RegisterRelay(Calculator{})
+	var lock sync.Mutex
+	var panicked []string
+	e.OnError(func(err ExchangeError) {
+		if strings.Contains(err.Error(), "panic") {
+			lock.Lock()
+			panicked = append(panicked, err.Error())
+			lock.Unlock()
+		}
+	})
+
+	f.Fuzz(func(t *testing.T, method, path, query string, body []byte) {
+		req, err := http.NewRequest(method, "http://localhost", strings.NewReader(string(body)))
+		if err != nil {
+			return // not a method net/http would serve
+		}
+		req.URL.Path, req.URL.RawQuery = path, query
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		lock.Lock()
+		defer lock.Unlock()
+		if len(panicked) > 0 {
+			t.Fatalf("%s %q %q %q panicked: %s", method, path, query, body, panicked[0])
+		}
+		if w.Code >= 400 && w.Code != http.StatusMethodNotAllowed {
+			checkErrorBody(t, w)
+		}
+		if w.Code < 400 && !knownOperation(req.Method, path) {
+			t.Fatalf("%s %q was answered with %d", method, path, w.Code)
+		}
+	})
+}
+
+// knownOperation reports whether a request with method for path may be
+// answered successfully: one for an operation of the Exchange, or any
+// other the client script is served for.
+func knownOperation(method, path string) bool {
+	op := path[strings.LastIndex(path, "/")+1:]
+	if _, ok := operationMethods[op]; ok || method == http.MethodOptions {
+		return true
+	}
+	return method == http.MethodGet || method == http.MethodHead
+}
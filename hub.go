@@ -0,0 +1,278 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// hubTransportName is the transport the clients of a hub are listed under,
+// by Connections and Stats.
+const hubTransportName = "hub"
+
+var (
+	errHubName  = errors.New("relayr: hub names must be non-empty and URL-safe")
+	errHubFrame = errors.New("relayr: hubs take calls and group requests only")
+)
+
+// ExchangeGroup serves several Exchanges, its hubs, to clients over a
+// single connection each, so that a page using, say, a chat Exchange and a
+// telemetry one pays for one websocket, one set of keep-alives and one
+// negotiation rather than one of each per Exchange. The group's own
+// Exchange owns the connections: its options, such as the Authorizer,
+// transports and timeouts, apply to them, and it serves the client script,
+// in which RelayRConnection.hub(name) holds the relays of a hub as RelayR
+// holds the Exchange's. Each hub keeps its own relays, groups, hooks,
+// interceptors and limits, and has a client of its own, with the same
+// ConnectionID, for each client of the group, which is connected as the
+// client negotiates and disconnected, its hub's OnDisconnect hooks called,
+// once the client is gone for good. Hubs send their clients calls to
+// client methods alone; CallWithAck, binary calls, states, streamed
+// results and control frames are not carried, nor are uploads to their
+// methods.
+type ExchangeGroup struct {
+	e *Exchange
+}
+
+// NewExchangeGroup returns an ExchangeGroup whose own Exchange is made with
+// NewExchangeWithOptions, and has no hubs.
+func NewExchangeGroup(mainURL string, opts ExchangeOptions) *ExchangeGroup {
+	return &ExchangeGroup{e: NewExchangeWithOptions(mainURL, opts)}
+}
+
+// Exchange returns the group's own Exchange, which owns the connections.
+// Relays registered with it are served as an Exchange's are, outside any
+// hub.
+func (g *ExchangeGroup) Exchange() *Exchange {
+	return g.e
+}
+
+// AddHub adds an Exchange to the group as the hub with the given name.
+// The hub must not be served on its own, nor added to another group. Hubs
+// must be added before the group's Exchange is frozen, which it is once
+// it serves a request.
+func (g *ExchangeGroup) AddHub(name string, hub *Exchange) error {
+	if g.e.frozen.Load() {
+		return errFrozen
+	}
+	if !isURLSafe(name) {
+		return errHubName
+	}
+	if _, ok := g.e.hubs[name]; ok {
+		return fmt.Errorf("relayr: a hub named %s is already added", name)
+	}
+	if !hub.hubbed.CompareAndSwap(nil, &hubTransport{parent: g.e, hub: hub, name: name}) {
+		return errors.New("relayr: the Exchange is a hub of a group already")
+	}
+
+	if g.e.hubs == nil {
+		g.e.hubs = make(map[string]*Exchange)
+	}
+	g.e.hubs[name] = hub
+	return nil
+}
+
+// Hub returns the hub with the given name, or nil if there is none.
+func (g *ExchangeGroup) Hub(name string) *Exchange {
+	return g.e.hubs[name]
+}
+
+// ServeHTTP serves the group's Exchange.
+func (g *ExchangeGroup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.e.ServeHTTP(w, r)
+}
+
+// Close closes the hubs, disconnecting their clients, and then the group's
+// Exchange, as Exchange.Close does, returning the first error.
+func (g *ExchangeGroup) Close(ctx context.Context) error {
+	var first error
+	for _, name := range g.e.hubNames() {
+		if err := g.e.hubs[name].Close(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := g.e.Close(ctx); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
+
+// hubNames returns the names of the Exchange's hubs, sorted.
+func (e *Exchange) hubNames() []string {
+	names := make([]string, 0, len(e.hubs))
+	for name := range e.hubs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hubSchemas returns the schema of each of the Exchange's hubs, by name,
+// or nil if it has none.
+func (e *Exchange) hubSchemas() map[string][]RelaySchema {
+	if len(e.hubs) == 0 {
+		return nil
+	}
+	schemas := make(map[string][]RelaySchema, len(e.hubs))
+	for name, hub := range e.hubs {
+		schemas[name] = hub.Schema()
+	}
+	return schemas
+}
+
+// connectHubs connects a client that has just negotiated to each of the
+// Exchange's hubs.
+func (e *Exchange) connectHubs(c *client) {
+	for _, name := range e.hubNames() {
+		e.hubs[name].connectHubClient(c)
+	}
+}
+
+// disconnectHubs disconnects a client that is gone for good from each of
+// the Exchange's hubs.
+func (e *Exchange) disconnectHubs(id, reason string) {
+	for _, name := range e.hubNames() {
+		e.hubs[name].dropClient(id, reason)
+	}
+}
+
+// connectHubClient connects the hub's client standing for p, a client of
+// its group, unless it is connected already, as it stays while p is
+// detached, and runs its OnClientConnected hooks.
+func (e *Exchange) connectHubClient(p *client) {
+	id := p.ConnectionID
+	e.mapLock.Lock()
+	known := e.knownLocked(id)
+	if !known {
+		e.negotiating[id] = struct{}{}
+	}
+	e.mapLock.Unlock()
+	if known {
+		return
+	}
+
+	c := e.makeClient(id, "")
+	c.setTransport(e.hubbed.Load())
+	c.principal = p.principal
+	c.userID = e.userIDFor(p.principal)
+	c.codec = e.codecByName("")
+	c.protocol = p.protocol
+	c.values = p.values
+	e.connectUser(c.userID, func() *client {
+		e.addClient(c, nil)
+		return c
+	})
+	e.logger.Infof("hub client %s connected", id)
+	go e.welcome(id, func() {})
+}
+
+// receiveHubFrame passes a frame a client sent to one of the Exchange's
+// hubs to it: calls to its relay methods, whose results are sent back to
+// the client, and requests to join and leave its groups.
+func (e *Exchange) receiveHubFrame(cid string, m *inboundFrame) {
+	hub := e.hubs[m.Hub]
+	if hub == nil {
+		err := &CallError{Relay: m.Hub + "/" + m.Relay, Reason: "does not exist"}
+		e.logger.Errorf("connection %s: %v", cid, err)
+		e.reportError(DispatchError, cid, m.Relay, m.Method, err)
+		e.sendResult(cid, m.InvocationID, nil, err)
+		return
+	}
+
+	switch {
+	case m.Type == frameJoinGroup || m.Type == frameLeaveGroup:
+		changed, err := hub.receiveGroupRequest(cid, m)
+		e.sendResult(cid, m.InvocationID, changed, err)
+	case m.Type == frameServerInvocation && !m.Upload && m.Method != ackMethod && m.Method != cancelMethod && m.Method != stateMethod:
+		if e.duplicateCall(cid, m) {
+			return
+		}
+		err := e.runCall(cid, m.Relay, m.Method, func() {
+			result, err := hub.ServeCall(cid, m.Relay, m.Method, m.Arguments)
+			if err != nil {
+				e.logger.Errorf("connection %s: hub %s: %v", cid, m.Hub, err)
+			}
+			e.rememberResult(cid, m.InvocationID, result, err)
+			e.sendResult(cid, m.InvocationID, result, err)
+		})
+		if err != nil {
+			e.forgetCall(cid, m.CallID)
+			e.logger.Infof("refusing a call from %s: %v", cid, err)
+			e.sendResult(cid, m.InvocationID, nil, err)
+		}
+	default:
+		e.sendResult(cid, m.InvocationID, nil, errHubFrame)
+	}
+}
+
+// isHubbed reports whether a client is the client of a hub standing for
+// a client of its group.
+func (c *client) isHubbed() bool {
+	_, ok := c.transport().(*hubTransport)
+	return ok
+}
+
+// hubTransport delivers the calls a hub makes to its clients over the
+// connections of the clients of its group they stand for, marked with the
+// hub's name. It is not registered with the hub, so that clients cannot
+// negotiate it.
+type hubTransport struct {
+	parent *Exchange
+	hub    *Exchange
+	name   string
+}
+
+func (t *hubTransport) AddConnection(connectionID string) {}
+
+func (t *hubTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) error {
+	fn, args, ok := t.hub.interceptOutgoing(relay, relay.ConnectionID, hubTransportName, fn, args)
+	if !ok {
+		return nil
+	}
+
+	c := t.parent.getClientByConnectionID(relay.ConnectionID)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+	s, ok := c.transport().(rawSender)
+	if !ok {
+		return errors.New("relayr: transport cannot carry the calls of hubs")
+	}
+	frame, err := t.parent.encodeFrameFor(relay.ConnectionID, &clientInvocation{Relay: relay.Name, Method: fn, Arguments: wireArgs(args), Trace: relay.trace, Sender: relay.sender, Hub: t.name})
+	if err != nil {
+		t.hub.logger.Errorf("encoding %s for %s: %v", fn, relay.ConnectionID, err)
+		return err
+	}
+	c.touch()
+	return s.sendCall(relay.ConnectionID, frame, relay.coalesce, relay.overflow, relay.expires)
+}
+
+// RemoveConnection does nothing, as the connection is its group's; a
+// client disconnected from a hub stays connected to the others.
+func (t *hubTransport) RemoveConnection(connectionID, reason string) {
+	t.hub.logger.Infof("hub client %s disconnected: %s", connectionID, reason)
+}
+
+// Close disconnects every client of the hub, as the hub closes.
+func (t *hubTransport) Close() error {
+	t.hub.mapLock.RLock()
+	ids := make([]string, 0, len(t.hub.connected))
+	for id := range t.hub.connected {
+		ids = append(ids, id)
+	}
+	t.hub.mapLock.RUnlock()
+
+	for _, id := range ids {
+		t.hub.dropClient(id, ReasonClosed)
+	}
+	return nil
+}
+
+// count returns the number of clients connected to the hub.
+func (t *hubTransport) count() int {
+	t.hub.mapLock.RLock()
+	defer t.hub.mapLock.RUnlock()
+	return len(t.hub.connected)
+}
@@ -0,0 +1,110 @@
+package relayr_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/simon-whitehead/relayr"
+	"github.com/simon-whitehead/relayr/relayrtest"
+)
+
+// exchangeWithIDs makes an Exchange giving the IDs gen returns, closing
+// it as the test ends.
+func exchangeWithIDs(t *testing.T, gen func() string) *relayr.Exchange {
+	e := relayr.NewExchangeWithOptions("http://localhost/relayr", relayr.ExchangeOptions{IDGenerator: gen})
+	t.Cleanup(func() { e.Close(context.Background()) })
+	return e
+}
+
+// negotiateWith negotiates a long-polling connection with e, returning
+// the status it answered with and the ConnectionID it gave, if any.
+func negotiateWith(e *relayr.Exchange) (int, string) {
+	req := httptest.NewRequest("POST", "/relayr/negotiate", strings.NewReader(`{"T":"longpoll"}`))
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	var res struct{ ConnectionID string }
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res.ConnectionID
+}
+
+// idList returns an IDGenerator giving ids in turn, and the last of them
+// once they run out.
+func idList(ids ...string) func() string {
+	var lock sync.Mutex
+	return func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		id := ids[0]
+		if len(ids) > 1 {
+			ids = ids[1:]
+		}
+		return id
+	}
+}
+
+func TestSequentialIDs(t *testing.T) {
+	e := exchangeWithIDs(t, relayrtest.SequentialIDs())
+	for _, want := range []string{"conn-1", "conn-2", "conn-3"} {
+		if got := relayrtest.NewTestClient(e).ConnectionID(); got != want {
+			t.Fatalf("a test client was given %q, want %q", got, want)
+		}
+	}
+
+	// each generator counts on its own, safely across goroutines
+	gen := relayrtest.SequentialIDs()
+	if id := gen(); id != "conn-1" {
+		t.Fatalf("a new generator started at %q", id)
+	}
+	var lock sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := gen()
+			lock.Lock()
+			defer lock.Unlock()
+			if seen[id] {
+				t.Errorf("%s was given twice", id)
+			}
+			seen[id] = true
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIDGeneratorCollisions(t *testing.T) {
+	e := exchangeWithIDs(t, idList("a", "a", "b", "a"))
+	if _, id := negotiateWith(e); id != "a" {
+		t.Fatalf("the first client was given %q, want a", id)
+	}
+	// "a" is in use, so the generator is asked again
+	if _, id := negotiateWith(e); id != "b" {
+		t.Fatalf("the second client was given %q, want b", id)
+	}
+	// and it only gives IDs in use from now on
+	if status, id := negotiateWith(e); status != http.StatusInternalServerError || id != "" {
+		t.Fatalf("negotiating with only IDs in use was answered with %d and %q, want 500", status, id)
+	}
+}
+
+func TestIDGeneratorUnsafeIDs(t *testing.T) {
+	for _, id := range []string{"", "a b", "a/b", "a?b", "a&b", "a%20b", "é"} {
+		e := exchangeWithIDs(t, idList(id))
+		if status, got := negotiateWith(e); status != http.StatusInternalServerError || got != "" {
+			t.Errorf("negotiating with the ID %q was answered with %d and %q, want 500", id, status, got)
+		}
+	}
+
+	const safe = "AZaz09-._~"
+	e := exchangeWithIDs(t, idList(safe))
+	if _, id := negotiateWith(e); id != safe {
+		t.Fatalf("the client was given %q, want %q", id, safe)
+	}
+}
@@ -0,0 +1,61 @@
+package relayr
+
+import (
+	"fmt"
+)
+
+// IncomingCall describes a relay method call made by a client, as seen
+// by an Interceptor.
+type IncomingCall struct {
+	RelayName    string
+	Method       string
+	Args         []interface{} // as decoded, with the numbers sent by JSON clients as json.Number
+	ConnectionID string
+	Transport    string // the caller's transport, "websocket" or "longpoll"
+}
+
+// An Interceptor wraps every relay method call made by a client. It must
+// call next to continue with the call, or return an error without doing
+// so to abort it. Errors are sent back to the caller like those returned
+// from the relay method itself.
+type Interceptor func(call *IncomingCall, next func() error) error
+
+// UseInterceptor adds an Interceptor to the Exchange. Interceptors run in
+// the order they were added, the first outermost.
+func (e *Exchange) UseInterceptor(i Interceptor) {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+	e.interceptors = append(e.interceptors, i)
+}
+
+// RecoveryInterceptor turns a panic in a relay method, or in the
+// interceptors that follow it, into an error returned to the caller.
+func RecoveryInterceptor(call *IncomingCall, next func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("relayr: panic in %s.%s: %v", call.RelayName, call.Method, p)
+		}
+	}()
+
+	return next()
+}
+
+// intercept runs call through the Exchange's interceptors, with final
+// making the call itself.
+func (e *Exchange) intercept(call *IncomingCall, final func() error) error {
+	e.mapLock.RLock()
+	chain := e.interceptors
+	e.mapLock.RUnlock()
+
+	var run func(i int) error
+	run = func(i int) error {
+		if i == len(chain) {
+			return final()
+		}
+		return chain[i](call, func() error {
+			return run(i + 1)
+		})
+	}
+
+	return run(0)
+}
@@ -0,0 +1,171 @@
+package relayr
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+type contextKey int
+
+const (
+	connectionIDKey contextKey = iota
+	invocationIDKey
+	traceParentKey
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// ConnectionIDFromContext returns the ConnectionID of the client whose
+// call is being served by the relay method that received ctx.
+func ConnectionIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(connectionIDKey).(string)
+	return id, ok
+}
+
+// InvocationIDFromContext returns the InvocationID the client attached to
+// the call being served by the relay method that received ctx.
+func InvocationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(invocationIDKey).(string)
+	return id, ok
+}
+
+// invocations tracks the server method calls in flight for each
+// connection so they can be cancelled when the connection goes away, or
+// when the client cancels them.
+type invocations struct {
+	lock   sync.Mutex
+	next   int64
+	byConn map[string]map[int64]invocation
+}
+
+// invocation is a server method call in flight.
+type invocation struct {
+	id     string // the InvocationID the client sent with the call, if any
+	cancel context.CancelFunc
+}
+
+func newInvocations() *invocations {
+	return &invocations{byConn: make(map[string]map[int64]invocation)}
+}
+
+// start returns a context for a call from the client with the given
+// ConnectionID, and a function to call once the call has returned.
+func (i *invocations) start(parent context.Context, cid, invocationID, trace string) (context.Context, func()) {
+	ctx := context.WithValue(parent, connectionIDKey, cid)
+	ctx = context.WithValue(ctx, invocationIDKey, invocationID)
+	if trace != "" {
+		ctx = context.WithValue(ctx, traceParentKey, trace)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	i.lock.Lock()
+	i.next++
+	n := i.next
+	if i.byConn[cid] == nil {
+		i.byConn[cid] = make(map[int64]invocation)
+	}
+	i.byConn[cid][n] = invocation{invocationID, cancel}
+	i.lock.Unlock()
+
+	return ctx, func() {
+		i.lock.Lock()
+		delete(i.byConn[cid], n)
+		if len(i.byConn[cid]) == 0 {
+			delete(i.byConn, cid)
+		}
+		i.lock.Unlock()
+		cancel()
+	}
+}
+
+// cancel cancels every call in flight for a connection.
+func (i *invocations) cancel(cid string) {
+	i.lock.Lock()
+	calls := i.byConn[cid]
+	delete(i.byConn, cid)
+	i.lock.Unlock()
+
+	for _, call := range calls {
+		call.cancel()
+	}
+}
+
+// cancelOne cancels a connection's call with the given InvocationID.
+func (i *invocations) cancelOne(cid, invocationID string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for _, call := range i.byConn[cid] {
+		if call.id == invocationID {
+			call.cancel()
+		}
+	}
+}
+
+// cancelAll cancels every call in flight.
+func (i *invocations) cancelAll() {
+	i.lock.Lock()
+	all := i.byConn
+	i.byConn = make(map[string]map[int64]invocation)
+	i.lock.Unlock()
+
+	for _, calls := range all {
+		for _, call := range calls {
+			call.cancel()
+		}
+	}
+}
+
+// invoke calls a relay method on behalf of the client that sent it over
+// the named transport, passing the call through the Exchange's
+// interceptors. The method may accept a context.Context after its *Relay
+// parameter; the context is cancelled if the client disconnects or
+// cancels the call before it returns. It may accept an IncomingStream
+// after those, reading the client's upload to the call, and a Progress
+// after those, reporting its progress to the client. A method that returns a channel
+// streams its result, as stream describes, for as long as the channel is
+// open. The call is traced as a child of trace, the traceparent the
+// client sent with it, and the calls the method makes to clients carry
+// the trace on.
+func (e *Exchange) invoke(relay *Relay, cid, transport, invocationID, trace, fn string, args []interface{}) (interface{}, error) {
+	span := e.options.Tracer.StartSpan(SpanDispatch, trace)
+	span.SetAttribute("relayr.relay", relay.Name)
+	span.SetAttribute("relayr.method", fn)
+	span.SetAttribute("relayr.connection_id", cid)
+	trace = spanParent(span, trace)
+
+	ctx, done := e.invocations.start(span.Context(context.Background()), cid, invocationID, trace)
+	defer done()
+
+	relay.ctx = ctx
+	relay.trace = trace
+	relay.sender = e.senderOf(cid)
+	if relay.upload = e.uploads.get(cid, invocationID); relay.upload != nil {
+		defer e.uploads.remove(cid, invocationID)
+	}
+	relay.progress = e.progressFor(ctx, cid, invocationID)
+	call := &IncomingCall{
+		RelayName:    relay.Name,
+		Method:       fn,
+		Args:         args,
+		ConnectionID: cid,
+		Transport:    transport,
+	}
+
+	var result interface{}
+	err := e.intercept(call, func() error {
+		var err error
+		result, err = e.callRelayMethod(relay, call.Method, call.Args...)
+		return err
+	})
+	if err == nil && isStream(result) {
+		result, err = e.stream(ctx, cid, invocationID, result)
+	}
+	if err != nil {
+		e.counters.failedCalls.Add(1)
+		e.reportError(DispatchError, cid, relay.Name, fn, err)
+	}
+	span.End(err)
+
+	return result, err
+}
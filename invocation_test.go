@@ -0,0 +1,62 @@
+package relayr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Worker is a relay whose methods take a context.
+type Worker struct {
+	started  chan string
+	observed chan string
+}
+
+// Wait blocks until its context ends, reporting the context's values.
+func (w *Worker) Wait(r *Relay, ctx context.Context) {
+	cid, _ := ConnectionIDFromContext(ctx)
+	invocationID, _ := InvocationIDFromContext(ctx)
+	w.started <- cid + " " + invocationID
+	select {
+	case <-ctx.Done():
+		w.observed <- cid
+	case <-time.After(testTimeout):
+	}
+}
+
+// Plain takes no context.
+func (w *Worker) Plain(r *Relay, n int) int {
+	return n * 2
+}
+
+func TestContextCancelledOnDisconnect(t *testing.T) {
+	w := &Worker{started: make(chan string, 1), observed: make(chan string, 1)}
+	_, srv := serve(t, ExchangeOptions{}, w)
+	c := dial(t, srv, "websocket")
+
+	if res, err := c.Call(context.Background(), "Worker", "Plain", 21); err != nil || string(res) != "42" {
+		t.Fatalf("a method without a context returned %s, %v", res, err)
+	}
+
+	go c.Invoke(context.Background(), "Worker", "Wait")
+	var started string
+	select {
+	case started = <-w.started:
+	case <-time.After(testTimeout):
+		t.Fatal("the method was not called")
+	}
+	// the client numbers its calls from 1, and Plain was the first
+	if want := c.ConnectionID() + " 2"; started != want {
+		t.Errorf("the context carried %q, want the ConnectionID and InvocationID %q", started, want)
+	}
+
+	c.Close()
+	select {
+	case cid := <-w.observed:
+		if cid == "" {
+			t.Error("the context lost its ConnectionID")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the method's context was not cancelled when the socket closed mid-call")
+	}
+}
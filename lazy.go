@@ -0,0 +1,88 @@
+package relayr
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// relayManifestKey is the prefix of the keys the manifests of single
+// relays are cached under, among the client scripts.
+const relayManifestKey = "relay\x00"
+
+// relayManifest returns the schema of the named relay, served by the
+// "manifest" operation to clients that load it with
+// RelayRConnection.use, from the cache if possible. It reports false if
+// there is no such relay.
+func (e *Exchange) relayManifest(name string) (clientScript, bool) {
+	key := relayManifestKey + name
+
+	e.scriptLock.Lock()
+	cache := cacheEnabled && !e.options.DisableScriptCache
+	m, ok := e.scriptCache[key]
+	gen := e.scriptGen
+	e.scriptLock.Unlock()
+
+	if ok && cache {
+		return m, true
+	}
+
+	relay := e.getRelayByName(name, "")
+	if relay == nil {
+		return clientScript{}, false
+	}
+	s := relaySchema(*relay)
+	s.ClientArgs = e.describedClientArgs(name)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return clientScript{}, false
+	}
+	m = newClientScript(b)
+
+	if cache {
+		e.scriptLock.Lock()
+		// don't cache a manifest made from stale relays
+		if e.scriptGen == gen && len(e.scriptCache) < maxCachedScripts {
+			e.scriptCache[key] = m
+		}
+		e.scriptLock.Unlock()
+	}
+
+	return m, true
+}
+
+// writeRelayManifest serves the schema of the named relay.
+func (e *Exchange) writeRelayManifest(w http.ResponseWriter, r *http.Request, name string) {
+	m, ok := e.relayManifest(name)
+	if !ok {
+		httpError(w, (&CallError{Relay: name, Reason: "does not exist"}).Error(), http.StatusNotFound)
+		return
+	}
+
+	jsonResponse(w)
+	w.Header().Set("Cache-Control", "no-cache")
+	writeCached(w, r, m)
+}
+
+// usedRelays returns the set of the relays a client negotiating with an
+// Exchange whose script leaves them out says it loaded, or nil if its
+// script listed them all.
+func usedRelays(names []string) map[string]bool {
+	if names == nil {
+		return nil
+	}
+	used := make(map[string]bool, len(names))
+	for _, name := range names {
+		used[name] = true
+	}
+	return used
+}
+
+// checkUsed returns an error if a client of an Exchange with LazyRelays
+// calls a relay it did not load.
+func (e *Exchange) checkUsed(cid, relayName string) error {
+	c := e.getClientByConnectionID(cid)
+	if c == nil || c.used == nil || c.used[relayName] {
+		return nil
+	}
+	return &CallError{Relay: relayName, Reason: "was not loaded with use"}
+}
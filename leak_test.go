@@ -0,0 +1,131 @@
+package relayr
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// checkNoLeaks fails the test if, once it has ended and its Exchanges
+// and servers are closed, goroutines started during it are still
+// running. It must be called before anything the test closes as it ends
+// is made, so that it checks after they are closed.
+func checkNoLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		// idle keep-alive connections of the test's own HTTP client
+		http.DefaultClient.CloseIdleConnections()
+		deadline := time.Now().Add(testTimeout)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Fatalf("%d goroutines, %d before the test:\n%s", runtime.NumGoroutine(), before, buf)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestCloseLeavesNoGoroutines(t *testing.T) {
+	t.Run("idle", func(t *testing.T) {
+		checkNoLeaks(t)
+		e := NewExchange("http://localhost/relayr", 0)
+		if err := e.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("websocket clients", func(t *testing.T) {
+		checkNoLeaks(t)
+		_, srv := serve(t, ExchangeOptions{KeepAliveTimeout: 100 * time.Millisecond}, Calculator{})
+		for i := 0; i < 3; i++ {
+			ws, _ := openWebSocket(t, srv)
+			ws.WriteJSON(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: "Calculator", Method: "Add", Arguments: []interface{}{2, 3}, InvocationID: "a"})
+			readCompletion(t, ws, "a")
+		}
+	})
+
+	t.Run("long-poll clients", func(t *testing.T) {
+		checkNoLeaks(t)
+		e, srv := serve(t, ExchangeOptions{LongPollMaxWait: time.Minute}, Calculator{})
+		cid := negotiate(t, srv, "longpoll").ConnectionID
+		if status := callOverHTTP(t, srv, cid, "Calculator", "Add", 1, 2); status != http.StatusOK {
+			t.Fatalf("calling: %d", status)
+		}
+		// left waiting as the Exchange closes
+		polled := make(chan struct{})
+		go func() {
+			defer close(polled)
+			resp, err := http.Get(srv.URL + "/relayr/longpoll?connectionId=" + cid + "&seq=0")
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		e.Close(context.Background())
+		select {
+		case <-polled:
+		case <-time.After(testTimeout):
+			t.Fatal("a waiting poll was not answered as the Exchange closed")
+		}
+	})
+
+	t.Run("calls running", func(t *testing.T) {
+		checkNoLeaks(t)
+		gate := newGate()
+		e, srv := serve(t, ExchangeOptions{}, gate)
+		ws, cid := openWebSocket(t, srv)
+		callWait(ws, "w", 0)
+		callWait(ws, "w", 1)
+		gate.waitEntered(t, 1)
+		closed := make(chan error, 1)
+		go func() { closed <- e.Close(context.Background()) }()
+		select {
+		case <-closed:
+			t.Fatal("Close returned with a call running")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(gate.release)
+		if err := <-closed; err != nil {
+			t.Fatal(err)
+		}
+		gate.lock.Lock()
+		defer gate.lock.Unlock()
+		if n := len(gate.seen[cid]); n > 1 {
+			t.Fatalf("%d calls ran, but the one queued should have been discarded", n)
+		}
+	})
+}
+
+// TestConnectionsRetiredOnce closes websockets from both ends at once,
+// and the Exchange with them, which must close each connection's
+// outgoing channel exactly once.
+func TestConnectionsRetiredOnce(t *testing.T) {
+	checkNoLeaks(t)
+	e, srv := serve(t, ExchangeOptions{ReconnectGracePeriod: -1})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		ws, cid := openWebSocket(t, srv)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ws.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			if err := e.Disconnect(cid, "kicked"); err != nil && err != ErrConnectionNotFound {
+				t.Errorf("disconnecting: %v", err)
+			}
+		}()
+	}
+	ws, _ := openWebSocket(t, srv)
+	go ws.Close()
+	e.Close(context.Background())
+	wg.Wait()
+}
@@ -0,0 +1,145 @@
+package relayr
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	errTooManyConnections     = errors.New("relayr: too many connections")
+	errTooManyAddrConnections = errors.New("relayr: too many connections from this address")
+	errTooManyUserConnections = errors.New("relayr: too many connections for this user")
+)
+
+// remoteIP returns the IP address a request came from. Headers set by
+// proxies are not trusted.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admit checks that a new client from addr, connecting as userID, would
+// not go over the connection limits. Otherwise it returns the status to
+// refuse the negotiation with and why. Concurrent negotiations are each
+// checked against the clients added before them, so a burst of them may
+// briefly go over a limit.
+func (e *Exchange) admit(addr, userID string) (int, error) {
+	o := e.options
+
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	if o.MaxConnections > 0 && e.connectionCountLocked() >= o.MaxConnections {
+		return http.StatusServiceUnavailable, errTooManyConnections
+	}
+	if o.MaxConnectionsPerIP > 0 && e.addrs[addr] >= o.MaxConnectionsPerIP {
+		return http.StatusTooManyRequests, errTooManyAddrConnections
+	}
+	if o.MaxConnectionsPerUser > 0 && userID != "" && len(e.users[userID]) >= o.MaxConnectionsPerUser {
+		return http.StatusTooManyRequests, errTooManyUserConnections
+	}
+	return 0, nil
+}
+
+// connectionCountLocked returns the number of clients the Exchange holds,
+// including those waiting to connect or reconnect. The caller must hold
+// mapLock.
+func (e *Exchange) connectionCountLocked() int {
+	return len(e.detached) + len(e.connected)
+}
+
+// addAddrLocked counts a client against its IP address. The caller must
+// hold mapLock.
+func (e *Exchange) addAddrLocked(c *client) {
+	if c.addr != "" {
+		e.addrs[c.addr]++
+	}
+}
+
+// removeAddrLocked stops counting a client against its IP address. The
+// caller must hold mapLock.
+func (e *Exchange) removeAddrLocked(c *client) {
+	if c.addr == "" {
+		return
+	}
+	if e.addrs[c.addr]--; e.addrs[c.addr] <= 0 {
+		delete(e.addrs, c.addr)
+	}
+}
+
+// touch records that a client sent or was sent something.
+func (c *client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// touchClient records that the client with the given ConnectionID sent
+// something.
+func (e *Exchange) touchClient(cid string) {
+	if c := e.getClientByConnectionID(cid); c != nil {
+		c.touch()
+		c.seen()
+	}
+}
+
+// startEvictingIdle starts evictIdle, unless it is running.
+func (e *Exchange) startEvictingIdle() {
+	if !e.evicting.CompareAndSwap(false, true) {
+		return
+	}
+	if !e.track() {
+		e.evicting.Store(false)
+		return
+	}
+	go e.evictIdle()
+}
+
+// evictIdle disconnects clients that have neither sent nor been sent
+// anything for the IdleTimeout, checking every quarter of it until the
+// Exchange is closed, or the IdleTimeout is set to zero.
+func (e *Exchange) evictIdle() {
+	defer e.wg.Done()
+
+	timer := time.NewTimer(e.runtime().IdleTimeout / 4)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-e.done:
+			e.evicting.Store(false)
+			return
+		}
+
+		timeout := e.runtime().IdleTimeout
+		if timeout <= 0 {
+			e.evicting.Store(false)
+			// an update may have set it again as this one stopped
+			if e.runtime().IdleTimeout <= 0 || !e.evicting.CompareAndSwap(false, true) {
+				return
+			}
+			timeout = e.runtime().IdleTimeout
+		}
+		timer.Reset(timeout / 4)
+
+		cutoff := time.Now().Add(-timeout).UnixNano()
+		var idle []string
+		e.mapLock.RLock()
+		for _, c := range e.connected {
+			if c.lastActive.Load() < cutoff && !c.isWebhook() && !c.isLocal() && !c.isHubbed() {
+				idle = append(idle, c.ConnectionID)
+			}
+		}
+		e.mapLock.RUnlock()
+
+		for _, id := range idle {
+			e.logger.Infof("evicting client %s after %v idle", id, timeout)
+			e.counters.evicted.Add(1)
+			e.dropClient(id, ReasonIdle)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package relayr
+
+import (
+	"sync"
+)
+
+// localTransportName is the transport LocalClients are listed under, by
+// Connections and Stats.
+const localTransportName = "local"
+
+const defaultLocalBuffer = 1024
+
+// ClientCall is a call to a client method received by a LocalClient.
+type ClientCall struct {
+	Relay  string
+	Method string
+	Group  string        // the group the call was made to; empty if it was made to the client
+	Args   []interface{} // decoded from JSON, as the client script sees them
+}
+
+// ClientOption configures a LocalClient made by Connect.
+type ClientOption func(*localClientOptions)
+
+type localClientOptions struct {
+	principal interface{}
+	groups    []string
+	values    map[string]string
+	buffer    int
+}
+
+// WithPrincipal connects a LocalClient as principal, as though the
+// Authorizer had returned it, for the authorization rules, Relay.Principal
+// and the user ID the UserIDProvider derives from it.
+func WithPrincipal(principal interface{}) ClientOption {
+	return func(o *localClientOptions) {
+		o.principal = principal
+	}
+}
+
+// WithGroups adds a LocalClient to groups as it connects, along with
+// Global unless DisableAutoJoinGlobal is set.
+func WithGroups(groups ...string) ClientOption {
+	return func(o *localClientOptions) {
+		o.groups = append(o.groups, groups...)
+	}
+}
+
+// WithConnectionValues gives a LocalClient the connection values a client
+// passes as it negotiates, for Relay.ConnectionValue.
+func WithConnectionValues(values map[string]string) ClientOption {
+	return func(o *localClientOptions) {
+		o.values = values
+	}
+}
+
+// WithCallBuffer sets how many calls a LocalClient holds before further
+// calls to it fail with ErrBufferFull. Defaults to 1024.
+func WithCallBuffer(n int) ClientOption {
+	return func(o *localClientOptions) {
+		o.buffer = n
+	}
+}
+
+// LocalClient is a client running in the same process as the Exchange,
+// such as a bot or a monitoring probe, which takes part as a browser's
+// client does: it is in groups, is sent the calls made to them and to it,
+// and calls relay methods. Its methods are safe to call from any
+// goroutine.
+type LocalClient struct {
+	e     *Exchange
+	id    string
+	calls chan ClientCall
+}
+
+// Connect connects a LocalClient to the Exchange. Nothing is negotiated,
+// so neither the Authorizer, OnNegotiate nor the connection limits apply
+// to it, but the OnClientConnected hooks have run for it by the time
+// Connect returns. It is listed by Connections and counted by Stats over
+// the "local" transport, and is neither evicted for being idle nor reaped
+// as stale. It stays connected until it is closed, disconnected with
+// Disconnect, or the Exchange is closed.
+func (e *Exchange) Connect(opts ...ClientOption) (*LocalClient, error) {
+	o := localClientOptions{buffer: defaultLocalBuffer}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for _, g := range o.groups {
+		if err := e.validateGroupName(g); err != nil {
+			return nil, err
+		}
+	}
+	if !e.track() {
+		return nil, errExchangeClosed
+	}
+	defer e.wg.Done()
+
+	c, err := e.newClient("")
+	if err != nil {
+		return nil, err
+	}
+	t := e.localTransport()
+	c.setTransport(t)
+	c.principal = o.principal
+	c.userID = e.userIDFor(o.principal)
+	c.codec = e.codecByName("")
+	c.protocol = protocolVersion
+	c.values = o.values
+
+	l := &LocalClient{e: e, id: c.ConnectionID, calls: make(chan ClientCall, o.buffer)}
+	t.lock.Lock()
+	t.clients[l.id] = l
+	t.lock.Unlock()
+
+	e.connectUser(c.userID, func() *client {
+		e.addClient(c, o.groups)
+		return c
+	})
+	e.logger.Infof("local client %s connected", l.id)
+	e.welcome(l.id, func() {})
+	return l, nil
+}
+
+// ConnectionID returns the client's ConnectionID.
+func (l *LocalClient) ConnectionID() string {
+	return l.id
+}
+
+// Calls returns the calls made to the client's methods, in the order they
+// were made. It is closed once the client is disconnected.
+func (l *LocalClient) Calls() <-chan ClientCall {
+	return l.calls
+}
+
+// Invoke calls a relay method as the client, returning its result once it
+// has finished. The call goes through the rate limits, authorization
+// rules, Limits and interceptors as a browser's would, and the arguments
+// through JSON first, so that the method receives them as it would from
+// the client script.
+func (l *LocalClient) Invoke(relay, method string, args ...interface{}) (interface{}, error) {
+	decoded, err := l.e.roundTrip(args)
+	if err != nil {
+		return nil, err
+	}
+	return l.e.ServeCall(l.id, relay, method, decoded)
+}
+
+// Join adds the client to a group, returning the error AddToGroup does.
+func (l *LocalClient) Join(group string) error {
+	return l.e.AddToGroup(group, l.id)
+}
+
+// Leave removes the client from a group, returning the error
+// RemoveFromGroup does.
+func (l *LocalClient) Leave(group string) error {
+	return l.e.RemoveFromGroup(group, l.id)
+}
+
+// Close disconnects the client, which leaves its groups as a client that
+// goes away does, and closes Calls.
+func (l *LocalClient) Close() error {
+	if l.e.getClientByConnectionID(l.id) == nil {
+		return ErrConnectionNotFound
+	}
+	l.e.dropClient(l.id, ReasonClosed)
+	return nil
+}
+
+// roundTrip encodes args with the Exchange's JSON codec and decodes them
+// again.
+func (e *Exchange) roundTrip(args []interface{}) ([]interface{}, error) {
+	b, err := e.json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []interface{}
+	err = e.json.Unmarshal(b, &decoded)
+	return decoded, err
+}
+
+// isLocal reports whether a client is a LocalClient.
+func (c *client) isLocal() bool {
+	_, ok := c.transport().(*localTransport)
+	return ok
+}
+
+// localTransport delivers the calls made to LocalClients. It is not
+// registered with the Exchange, so that clients cannot negotiate it.
+type localTransport struct {
+	e       *Exchange
+	lock    sync.Mutex // guards clients and closing their calls
+	clients map[string]*LocalClient
+}
+
+// localTransport returns the Exchange's localTransport, creating it on
+// first use.
+func (e *Exchange) localTransport() *localTransport {
+	if t := e.locals.Load(); t != nil {
+		return t
+	}
+	e.locals.CompareAndSwap(nil, &localTransport{e: e, clients: make(map[string]*LocalClient)})
+	return e.locals.Load()
+}
+
+func (t *localTransport) AddConnection(connectionID string) {}
+
+func (t *localTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) error {
+	fn, args, ok := t.e.interceptOutgoing(relay, relay.ConnectionID, localTransportName, fn, args)
+	if !ok {
+		return nil
+	}
+	decoded, err := t.e.roundTrip(args)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l := t.clients[relay.ConnectionID]
+	if l == nil {
+		return ErrConnectionNotFound
+	}
+	select {
+	case l.calls <- ClientCall{Relay: relay.Name, Method: fn, Group: relay.group, Args: decoded}:
+		return nil
+	default:
+		t.e.counters.dropped.Add(1)
+		t.e.recordConnectionError(TransportError, relay.ConnectionID, "", "", ErrBufferFull)
+		return ErrBufferFull
+	}
+}
+
+func (t *localTransport) RemoveConnection(connectionID, reason string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if l := t.clients[connectionID]; l != nil {
+		delete(t.clients, connectionID)
+		close(l.calls)
+		t.e.logger.Infof("local client %s disconnected: %s", connectionID, reason)
+	}
+}
+
+// Close disconnects every LocalClient, as the Exchange closes.
+func (t *localTransport) Close() error {
+	t.lock.Lock()
+	ids := make([]string, 0, len(t.clients))
+	for id := range t.clients {
+		ids = append(ids, id)
+	}
+	t.lock.Unlock()
+
+	for _, id := range ids {
+		t.e.dropClient(id, ReasonClosed)
+	}
+	return nil
+}
+
+// count returns the number of LocalClients connected.
+func (t *localTransport) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.clients)
+}
@@ -0,0 +1,58 @@
+package relayr
+
+import (
+	"log"
+	"os"
+)
+
+// Logger receives diagnostic output from an Exchange. Implementations
+// must be safe for concurrent use. Adapters for zap, slog and friends
+// only need to forward the three levels.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LogLevel is the minimum level written by a logger created with NewStdLogger.
+type LogLevel int
+
+// Log levels, from most to least verbose.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelError
+	LevelNone
+)
+
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+// NewStdLogger returns a Logger that writes messages at or above level
+// to l. When l is nil, output goes to stderr.
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &stdLogger{l: l, level: level}
+}
+
+func (s *stdLogger) Debugf(format string, args ...interface{}) {
+	if s.level <= LevelDebug {
+		s.l.Printf("DEBUG: "+format, args...)
+	}
+}
+
+func (s *stdLogger) Infof(format string, args ...interface{}) {
+	if s.level <= LevelInfo {
+		s.l.Printf("INFO: "+format, args...)
+	}
+}
+
+func (s *stdLogger) Errorf(format string, args ...interface{}) {
+	if s.level <= LevelError {
+		s.l.Printf("ERROR: "+format, args...)
+	}
+}
@@ -0,0 +1,87 @@
+package relayr
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer is a bytes.Buffer that a log.Logger writes to from many
+// goroutines.
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// TestQuietByDefault connects a client over each transport, has it call
+// a relay method and disconnects it, and checks that nothing is logged
+// at the level the default Logger writes, while Stats still counts it.
+func TestQuietByDefault(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		level LogLevel
+		quiet bool
+	}{
+		{"default", LevelError, true},
+		{"debug", LevelDebug, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out logBuffer
+			e, srv := serve(t, ExchangeOptions{
+				Logger:               NewStdLogger(log.New(&out, "", 0), tt.level),
+				ReconnectGracePeriod: -1,
+				LongPollIdleTimeout:  500 * time.Millisecond, // for the long-polling client, which stops polling
+			}, Calculator{})
+
+			for _, transport := range []string{"websocket", "longpoll"} {
+				c := dial(t, srv, transport)
+				ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+				v, err := c.Call(ctx, "Calculator", "Add", 1, 2)
+				cancel()
+				if err != nil || string(v) != "3" {
+					t.Fatalf("calling over %s returned %s, %v", transport, v, err)
+				}
+				c.Close()
+			}
+			for deadline := time.Now().Add(testTimeout); e.Stats().ClientsRemoved < 2; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the clients were not disconnected")
+				}
+			}
+
+			stats := e.Stats()
+			if stats.ClientsAdded != 2 || stats.FramesRead < 2 {
+				t.Fatalf("counted %d clients added and %d frames read, want 2 and at least 2", stats.ClientsAdded, stats.FramesRead)
+			}
+			if logged := out.String(); tt.quiet && logged != "" {
+				t.Fatalf("logged at the default level:\n%s", logged)
+			} else if !tt.quiet && logged == "" {
+				t.Fatal("nothing was logged at LevelDebug")
+			}
+		})
+	}
+}
+
+func TestDefaultLoggerLevel(t *testing.T) {
+	for verbosity, want := range map[int]LogLevel{0: LevelError, 1: LevelDebug} {
+		l, ok := ExchangeOptions{Verbosity: verbosity}.withDefaults().Logger.(*stdLogger)
+		if !ok || l.level != want {
+			t.Errorf("the default Logger at Verbosity %d is %#v, want one at level %d", verbosity, l, want)
+		}
+	}
+}
@@ -1,112 +1,798 @@
 package relayr
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"io"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// longPollConnection buffers the frames destined for a long-poll client
+// between its poll requests. Frames are numbered in the order they are
+// queued, and those the client has been sent are kept until it
+// acknowledges them by polling with a later sequence number, so that
+// they can be sent again if the response carrying them was lost.
 type longPollConnection struct {
-	e            *Exchange
-	result       chan []byte
-	timeoutChan  chan struct{}
-	t            *time.Timer
+	lock         sync.Mutex
+	queue        [][]byte      // frames the client has not acknowledged, oldest first
+	keys         []string      // the coalescing key of each queued frame, if any
+	expires      []time.Time   // when each queued frame is dropped if it has not been sent; never when zero
+	lanes        []queuedFrame // the Priority of each queued frame, and how often it has been passed over
+	first        uint64        // the sequence number of queue[0]
+	delivered    uint64        // the sequence number of the last frame sent to the client
+	overflowed   bool          // frames were dropped; the client must reconnect
+	closed       bool          // the server disconnected the client
+	moving       bool          // the client is to renegotiate once it has its queued frames
+	upgraded     bool          // the client upgraded to a websocket, over which its frames are sent now
+	holding      bool          // OnClientConnected hooks are running
+	held         []heldFrame   // frames sent meanwhile, other than by the hooks
+	reason       string        // why the server disconnected the client
+	notify       chan struct{} // signalled when frames are queued
+	polling      int           // number of poll requests in flight
+	dropped      uint64        // frames dropped because the queue was full
+	expired      uint64        // frames dropped because they expired before they were sent
+	watch        queueWatch
+	idle         *time.Timer // reaps the client when it stops polling
 	ConnectionID string
 }
 
+// heldFrame is a frame held back while a client's OnClientConnected hooks
+// run.
+type heldFrame struct {
+	data     []byte
+	key      string
+	policy   OverflowPolicy
+	expires  time.Time
+	priority Priority
+}
+
 type longPollTransport struct {
 	e           *Exchange
-	connections map[string]longPollConnection
+	connections map[string]*longPollConnection
 	clock       *sync.RWMutex
+	waiters     pollWaiters
 }
 
-func (t *longPollTransport) clientInConnections(cid string) bool {
-	_, exists := t.connections[cid]
-
-	return exists
-}
-
-func (t *longPollTransport) addConnection(cid string) longPollConnection {
-	lp := longPollConnection{
-		e:            t.e,
-		result:       make(chan []byte, 100),
-		timeoutChan:  make(chan struct{}, 10),
-		ConnectionID: cid,
+// connection returns the queue for cid, creating it if necessary so that
+// frames sent before the client's first poll are not lost.
+func (t *longPollTransport) connection(cid string) *longPollConnection {
+	t.clock.RLock()
+	lp, ok := t.connections[cid]
+	t.clock.RUnlock()
+	if ok {
+		return lp
 	}
 
-	t.connections[cid] = lp
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	if lp, ok = t.connections[cid]; !ok {
+		lp = &longPollConnection{
+			notify:       make(chan struct{}, 1),
+			first:        1,
+			ConnectionID: cid,
+		}
+		lp.idle = time.AfterFunc(t.e.runtime().LongPollIdleTimeout, func() {
+			t.reap(lp)
+		})
+		t.connections[cid] = lp
+	}
 
 	return lp
 }
 
-func (t *longPollTransport) withClient(cid string, fn func(c longPollConnection)) {
-	if t.clientInConnections(cid) {
-		fn(t.connections[cid])
-	}
-}
-
 func newLongPollTransport(e *Exchange) *longPollTransport {
 	lp := &longPollTransport{
 		e:           e,
-		connections: make(map[string]longPollConnection),
+		connections: make(map[string]*longPollConnection),
 		clock:       &sync.RWMutex{},
 	}
 
 	return lp
 }
 
-func (t *longPollTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) {
-	buff := &bytes.Buffer{}
-	encoder := json.NewEncoder(buff)
+// websocket returns the transport that clients which upgrade from
+// long-polling go on to use.
+func (t *longPollTransport) websocket() *webSocketTransport {
+	return t.e.transports["websocket"].(*webSocketTransport)
+}
+
+func (t *longPollTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) error {
+	fn, args, ok := t.e.interceptOutgoing(relay, relay.ConnectionID, "longpoll", fn, args)
+	if !ok {
+		return nil
+	}
+
+	frame, err := t.e.encodeFrameFor(relay.ConnectionID, &clientInvocation{Relay: relay.Name, Method: fn, Arguments: wireArgs(args), Trace: relay.trace, Sender: relay.sender})
+	if err != nil {
+		t.e.logger.Errorf("encoding %s for %s: %v", fn, relay.ConnectionID, err)
+		return err
+	}
+
+	if relay.welcome {
+		return t.sendWelcome(relay.ConnectionID, frame, relay.coalesce, relay.expires, relay.priority)
+	}
+	return t.send(relay.ConnectionID, frame, relay.coalesce, relay.overflow, relay.expires, relay.priority)
+}
+
+// sendBinary queues a binary payload for the client. Long-poll responses
+// are text, so the payload is carried base64-encoded by the codec.
+func (t *longPollTransport) sendBinary(cid string, relay, fn string, data []byte) {
+	frame, err := t.e.encodeFrameFor(cid, &binaryCall{Relay: relay, Method: fn, Data: data})
+	if err != nil {
+		t.e.logger.Errorf("encoding %s for %s: %v", fn, cid, err)
+		t.e.reportError(TransportError, cid, relay, fn, err)
+		return
+	}
+
+	t.sendRaw(cid, frame)
+}
+
+func (t *longPollTransport) sendRaw(cid string, frame []byte) error {
+	return t.send(cid, frame, "", 0, time.Time{}, Normal)
+}
+
+// sendUrgent queues a ping or control frame High, ahead of the calls
+// waiting to be sent.
+func (t *longPollTransport) sendUrgent(cid string, frame []byte) error {
+	return t.send(cid, frame, "", 0, time.Time{}, High)
+}
+
+func (t *longPollTransport) sendProgress(cid string, frame []byte, key string) error {
+	return t.send(cid, frame, key, 0, time.Time{}, Low)
+}
+
+func (t *longPollTransport) sendCall(cid string, frame []byte, key string, policy OverflowPolicy, expires time.Time) error {
+	return t.send(cid, frame, key, policy, expires, Normal)
+}
+
+// send queues a frame for the client. A frame with a coalescing key
+// replaces a queued frame with the same key that has not been sent yet
+// instead. When LongPollQueueSize frames are waiting to be sent the
+// policy, or the Exchange's OverflowPolicy when unset, applies. A frame
+// with an expiry is dropped if the client has not polled for it by then.
+// A frame goes ahead of those of a lower Priority that have not been sent.
+func (t *longPollTransport) send(cid string, frame []byte, key string, policy OverflowPolicy, expires time.Time, priority Priority) error {
+	c := t.connection(cid)
+
+	c.lock.Lock()
+	if c.upgraded {
+		c.lock.Unlock()
+		return t.websocket().send(cid, outFrame{data: frame, key: key, policy: policy, expires: expires, priority: priority})
+	}
+	if c.holding {
+		c.held = append(c.held, heldFrame{frame, key, policy, expires, priority})
+		c.lock.Unlock()
+		return nil
+	}
+	err := t.enqueueLocked(c, frame, key, policy, expires, priority)
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	return err
+}
+
+// sendWelcome queues a frame sent by an OnClientConnected hook, which is
+// never held back.
+func (t *longPollTransport) sendWelcome(cid string, frame []byte, key string, expires time.Time, priority Priority) error {
+	c := t.connection(cid)
 
-	encoder.Encode(struct {
-		R string
-		M string
-		A []interface{}
-	}{
-		relay.Name,
-		fn,
-		args,
-	})
+	c.lock.Lock()
+	if c.upgraded {
+		c.lock.Unlock()
+		return t.websocket().send(cid, outFrame{data: frame, key: key, welcome: true, expires: expires, priority: priority})
+	}
+	err := t.enqueueLocked(c, frame, key, 0, expires, priority)
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	return err
+}
+
+// hasRoom reports whether a client's queue has room for another frame.
+func (t *longPollTransport) hasRoom(cid string) bool {
+	c := t.connection(cid)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.queue)-c.sentLocked() < t.e.runtime().LongPollQueueSize
+}
+
+// hold holds back the frames sent to a client, other than by its
+// OnClientConnected hooks, until release is called.
+func (t *longPollTransport) hold(cid string) {
+	c := t.connection(cid)
+	c.lock.Lock()
+	c.holding = true
+	c.lock.Unlock()
+}
+
+// release queues the frames held back while a client's OnClientConnected
+// hooks ran, and stops holding them.
+func (t *longPollTransport) release(cid string) {
+	c := t.connection(cid)
+
+	c.lock.Lock()
+	c.holding = false
+	for _, f := range c.held {
+		t.enqueueLocked(c, f.data, f.key, f.policy, f.expires, f.priority)
+	}
+	c.held = nil
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueLocked adds a frame to a client's queue, behind the frames of the
+// same or a higher Priority, applying the overflow policy if it is full.
+// DropOldest drops the oldest frame waiting of no higher a Priority, or
+// the new frame if there is none. The caller must hold c.lock.
+func (t *longPollTransport) enqueueLocked(c *longPollConnection, frame []byte, key string, policy OverflowPolicy, expires time.Time, priority Priority) error {
+	sent := c.sentLocked()
+	if key != "" {
+		for i := sent; i < len(c.keys); i++ {
+			if c.keys[i] == key && c.lanes[i].priority == priority {
+				c.queue[i], c.expires[i] = frame, expires
+				t.e.counters.coalesced.Add(1)
+				t.e.tapFrame(c.ConnectionID, tapOutbound, frame)
+				return nil
+			}
+		}
+	}
+
+	size := t.e.runtime().LongPollQueueSize
+	if len(c.queue)-sent >= size {
+		c.dropped++
+		t.e.counters.dropped.Add(1)
+		t.e.recordConnectionError(TransportError, c.ConnectionID, "", "", ErrBufferFull)
+		switch policy.resolve(t.e) {
+		case DropOldest:
+			oldest := sent
+			for oldest < len(c.queue) && c.lanes[oldest].priority > priority {
+				oldest++
+			}
+			if oldest == len(c.queue) {
+				return ErrBufferFull
+			}
+			// frames after the dropped one are renumbered, which is safe
+			// as none of them has been sent
+			c.queue = append(c.queue[:oldest], c.queue[oldest+1:]...)
+			c.keys = append(c.keys[:oldest], c.keys[oldest+1:]...)
+			c.expires = append(c.expires[:oldest], c.expires[oldest+1:]...)
+			c.lanes = append(c.lanes[:oldest], c.lanes[oldest+1:]...)
+		case Disconnect:
+			c.overflowed = true
+			t.e.logger.Infof("long-poll queue for %s overflowed", c.ConnectionID)
+			return ErrBufferFull
+		default:
+			return ErrBufferFull
+		}
+	}
+
+	i := c.placeLocked(priority, t.e.options.PriorityBurst)
+	c.queue = append(c.queue, nil)
+	copy(c.queue[i+1:], c.queue[i:])
+	c.queue[i] = frame
+	c.keys = append(c.keys, "")
+	copy(c.keys[i+1:], c.keys[i:])
+	c.keys[i] = key
+	c.expires = append(c.expires, time.Time{})
+	copy(c.expires[i+1:], c.expires[i:])
+	c.expires[i] = expires
+	c.lanes = append(c.lanes, queuedFrame{})
+	copy(c.lanes[i+1:], c.lanes[i:])
+	c.lanes[i] = queuedFrame{priority: priority}
+	t.e.counters.sent.Add(1)
+	t.e.tapFrame(c.ConnectionID, tapOutbound, frame)
+	if slow, _ := c.watch.observe(&t.e.options, len(c.queue)-sent, size); slow {
+		t.e.connectionSlow(c.ConnectionID, c.queuedBytesLocked())
+	}
+	return nil
+}
+
+// sentLocked returns the number of queued frames that have been sent but
+// not yet acknowledged, which are the first in the queue. The caller must
+// hold c.lock.
+func (c *longPollConnection) sentLocked() int {
+	return int(c.delivered + 1 - c.first)
+}
+
+// queuedBytesLocked returns the size of the frames waiting to be sent. The
+// caller must hold c.lock.
+func (c *longPollConnection) queuedBytesLocked() int {
+	n := 0
+	for _, f := range c.queue[c.sentLocked():] {
+		n += len(f)
+	}
+	return n
+}
+
+// queueStats describes a client's queue.
+func (t *longPollTransport) queueStats(cid string) (queueStats, bool) {
+	t.clock.RLock()
+	c, ok := t.connections[cid]
+	t.clock.RUnlock()
+	if !ok {
+		return queueStats{}, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return queueStats{
+		frames:  len(c.queue) - c.sentLocked(),
+		bytes:   c.queuedBytesLocked(),
+		peak:    c.watch.peak,
+		expired: c.expired,
+	}, true
+}
 
-	go t.withClient(relay.ConnectionID, func(c longPollConnection) {
-		// force a timeout if we block on sending too long..
-		go func() {
-			<-time.After(time.Second * 30)
-			c.timeoutChan <- struct{}{}
-		}()
-		c.result <- buff.Bytes()
-	})
+// expire drops the frames that have not been sent and whose expiry has
+// passed by now, returning how many it dropped. The frames after them
+// are renumbered, which is safe as none of them has been sent either.
+func (c *longPollConnection) expire(now time.Time) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	sent := c.sentLocked()
+	kept := sent
+	for i := sent; i < len(c.queue); i++ {
+		if expired(c.expires[i], now) {
+			continue
+		}
+		c.queue[kept], c.keys[kept], c.expires[kept], c.lanes[kept] = c.queue[i], c.keys[i], c.expires[i], c.lanes[i]
+		kept++
+	}
+	n := uint64(len(c.queue) - kept)
+	c.queue, c.keys, c.expires, c.lanes = c.queue[:kept], c.keys[:kept], c.expires[:kept], c.lanes[:kept]
+	c.expired += n
+	return n
+}
+
+// drain returns the frames queued after seq, the last sequence number the
+// client has seen, and the sequence number of the last of them. Frames up
+// to seq are acknowledged and forgotten, and at most retain of the frames
+// returned are kept to be sent again. When budget is positive the frames
+// returned come to at most that many bytes, though there is always at
+// least one, and the rest wait for the next poll. It returns false if the
+// client must reconnect, because frames were dropped or are no longer
+// retained.
+func (c *longPollConnection) drain(seq uint64, retain, budget int) ([][]byte, uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.overflowed {
+		c.overflowed = false
+		return nil, 0, false
+	}
+	if seq > c.delivered {
+		// the client has seen more than this queue has sent, so the queue
+		// was recreated while the client was away; carry on numbering
+		// from where the client is
+		c.first += seq - c.delivered
+		c.delivered = seq
+	}
+	if seq+1 < c.first {
+		return nil, 0, false
+	}
+
+	n := seq + 1 - c.first
+	c.queue, c.keys, c.expires, c.lanes = c.queue[n:], c.keys[n:], c.expires[n:], c.lanes[n:]
+	c.first = seq + 1
+	if len(c.queue) == 0 {
+		return nil, seq, true
+	}
+
+	count := len(c.queue)
+	if budget > 0 {
+		size := len(c.queue[0])
+		count = 1
+		for count < len(c.queue) && size+len(c.queue[count]) <= budget {
+			size += len(c.queue[count])
+			count++
+		}
+	}
+	frames := c.queue[:count:count]
+	c.delivered = c.first + uint64(count) - 1
+	if retain < 0 {
+		retain = 0
+	}
+	if drop := count - retain; drop > 0 {
+		c.queue, c.keys, c.expires, c.lanes = c.queue[drop:], c.keys[drop:], c.expires[drop:], c.lanes[drop:]
+		c.first += uint64(drop)
+	}
+
+	return frames, c.delivered, true
 }
 
 func (t *longPollTransport) removeConnection(cid string) {
-	delete(t.connections, cid)
+	t.clock.Lock()
+	if lp, ok := t.connections[cid]; ok {
+		lp.idle.Stop()
+		delete(t.connections, cid)
+	}
+	t.clock.Unlock()
+}
+
+// AddConnection forgets the queue of a client that upgraded to a
+// websocket and is long-polling again; otherwise it does nothing, as a
+// client's queue is created when something is first sent to it or it
+// first polls.
+func (t *longPollTransport) AddConnection(cid string) {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	if c, ok := t.connections[cid]; ok && c.isUpgraded() {
+		c.idle.Stop()
+		delete(t.connections, cid)
+	}
 }
 
-func (t *longPollTransport) wait(w http.ResponseWriter, cid string) {
-	var conn longPollConnection
-	if !t.clientInConnections(cid) {
-		conn = t.addConnection(cid)
-	} else {
-		conn = t.connections[cid]
+// RemoveConnection discards a client's queue and marks it disconnected,
+// so that its current or next poll tells it so.
+func (t *longPollTransport) RemoveConnection(cid, reason string) {
+	c := t.connection(cid)
+
+	c.lock.Lock()
+	c.queue = nil
+	c.keys = nil
+	c.expires = nil
+	c.lanes = nil
+	c.first = c.delivered + 1
+	c.closed = true
+	c.reason = reason
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
 	}
+}
+
+// move tells a client to renegotiate once it has polled for the frames
+// already queued for it. When forced the client is disconnected straight
+// away, and told to renegotiate if it is waiting for a poll.
+func (t *longPollTransport) move(cid string, force bool) {
+	c := t.connection(cid)
+	c.lock.Lock()
+	c.moving = true
+	c.lock.Unlock()
 
 	select {
-	case m := <-conn.result:
-		io.Copy(w, bytes.NewBuffer(m))
-	case <-conn.timeoutChan:
-		buff := &bytes.Buffer{}
-		encoder := json.NewEncoder(buff)
-		encoder.Encode(struct {
-			Z string
-		}{
-			"RECONNECT",
-		})
-		io.WriteString(w, buff.String())
-		t.removeConnection(cid)
-		t.e.removeFromAllGroups(cid)
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	if force {
+		t.e.disconnectClient(cid, ReasonClosed)
 	}
 }
+
+// handOver hands a client that has seen the frames up to seq over to a
+// websocket it opened to upgrade. commit is called, under the queue's lock
+// so that nothing is queued meanwhile, with the frames queued after seq,
+// and must see them sent over the websocket ahead of anything sent later;
+// from then on frames are sent to the websocket, and polls are answered
+// as upgraded. It returns false, without calling commit, if the client
+// cannot upgrade now: its OnClientConnected hooks are running, it is to
+// reconnect or renegotiate, it missed frames or has seen frames this
+// queue did not send, or more than max frames are queued after seq.
+func (t *longPollTransport) handOver(cid string, seq uint64, max int, commit func([]outFrame)) bool {
+	c := t.connection(cid)
+
+	c.lock.Lock()
+	if c.closed || c.overflowed || c.moving || c.holding || c.upgraded {
+		c.lock.Unlock()
+		return false
+	}
+	if seq+1 < c.first || seq > c.delivered {
+		c.lock.Unlock()
+		return false
+	}
+	n := seq + 1 - c.first
+	if len(c.queue)-int(n) > max {
+		c.lock.Unlock()
+		return false
+	}
+	pending := make([]outFrame, 0, len(c.queue)-int(n))
+	for i := n; i < uint64(len(c.queue)); i++ {
+		pending = append(pending, outFrame{data: c.queue[i], expires: c.expires[i], priority: c.lanes[i].priority})
+	}
+	commit(pending)
+	c.upgraded = true
+	c.queue, c.keys, c.expires, c.lanes = nil, nil, nil, nil
+	c.first = c.delivered + 1
+	c.lock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// disconnected reports whether the server disconnected the client, and why.
+func (c *longPollConnection) disconnected() (bool, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed, c.reason
+}
+
+// isUpgraded reports whether the client upgraded to a websocket.
+func (c *longPollConnection) isUpgraded() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.upgraded
+}
+
+// isMoving reports whether the client is to renegotiate.
+func (c *longPollConnection) isMoving() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.moving
+}
+
+// touch records activity from a client outside of a poll request, such
+// as a server call, postponing its idle timeout.
+func (t *longPollTransport) touch(cid string) {
+	t.clock.RLock()
+	c, ok := t.connections[cid]
+	t.clock.RUnlock()
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	if c.polling == 0 {
+		c.idle.Reset(t.e.runtime().LongPollIdleTimeout)
+	}
+	c.lock.Unlock()
+}
+
+// reap disconnects a client that has not polled within the idle timeout,
+// or forgets the queue of one that upgraded to a websocket.
+func (t *longPollTransport) reap(c *longPollConnection) {
+	c.lock.Lock()
+	polling, upgraded := c.polling, c.upgraded
+	c.lock.Unlock()
+	if polling > 0 {
+		return
+	}
+
+	t.clock.Lock()
+	current, ok := t.connections[c.ConnectionID]
+	if !ok || current != c {
+		t.clock.Unlock()
+		return
+	}
+	delete(t.connections, c.ConnectionID)
+	t.clock.Unlock()
+	if upgraded {
+		return
+	}
+
+	t.e.logger.Debugf("reaping idle long-poll client %s", c.ConnectionID)
+	t.e.disconnectClient(c.ConnectionID, ReasonClosed)
+}
+
+// count returns the number of clients long-polling, leaving out those
+// that upgraded to a websocket.
+func (t *longPollTransport) count() int {
+	t.clock.RLock()
+	defer t.clock.RUnlock()
+	n := 0
+	for _, c := range t.connections {
+		if !c.isUpgraded() {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *longPollTransport) droppedMessages(r map[string]uint64) {
+	t.clock.RLock()
+	defer t.clock.RUnlock()
+	for id, c := range t.connections {
+		c.lock.Lock()
+		if c.dropped > 0 {
+			r[id] = c.dropped
+		}
+		c.lock.Unlock()
+	}
+}
+
+// Close answers every poll waiting, and any that starts waiting later,
+// with ReasonShutdown, and cancels every idle timer. It is called when the
+// Exchange closes.
+func (t *longPollTransport) Close() error {
+	t.waiters.cancelAll(true)
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for _, c := range t.connections {
+		c.idle.Stop()
+	}
+	return nil
+}
+
+// wait answers a poll request from a client that has seen the frames up
+// to seq. Frames queued after those are returned immediately; otherwise it
+// blocks until something is sent to the client, or answers with an empty
+// batch once LongPollMaxWait has passed so the client polls again. It
+// gives up if the client goes away, and tells the client to stop polling
+// if it is cancelled by CancelWaiters or Close.
+func (t *longPollTransport) wait(ctx context.Context, w http.ResponseWriter, cid string, seq uint64) {
+	conn := t.connection(cid)
+	codec := t.e.codecFor(cid)
+
+	conn.lock.Lock()
+	conn.polling++
+	conn.idle.Stop()
+	conn.lock.Unlock()
+	defer func() {
+		conn.lock.Lock()
+		conn.polling--
+		if conn.polling == 0 {
+			conn.idle.Reset(t.e.runtime().LongPollIdleTimeout)
+		}
+		conn.lock.Unlock()
+	}()
+
+	waiter := t.waiters.add()
+	defer t.waiters.remove(waiter)
+	timeout := time.NewTimer(t.e.options.LongPollMaxWait)
+	defer timeout.Stop()
+
+	var bw *bandwidth
+	if c := t.e.getClientByConnectionID(cid); c != nil {
+		bw = c.bandwidth
+	}
+	for {
+		if closed, reason := conn.disconnected(); closed {
+			t.disconnect(w, cid, reason)
+			return
+		}
+		if conn.isUpgraded() {
+			t.upgradedAway(w, cid)
+			return
+		}
+		if n := conn.expire(time.Now()); n > 0 {
+			t.e.counters.expired.Add(n)
+		}
+		var throttled *time.Timer
+		var resume <-chan time.Time
+		limit, budget := 0, 0
+		if bw != nil {
+			limit = t.e.bandwidthLimit(cid, bw)
+			var pause time.Duration
+			if budget, pause = bw.allowance(limit, time.Now()); pause > 0 {
+				// hold what is queued until the client's bandwidth allows
+				// it, answering empty by the LongPollMaxWait meanwhile
+				throttled = time.NewTimer(pause)
+				resume = throttled.C
+			}
+		}
+		if throttled == nil {
+			frames, last, ok := conn.drain(seq, t.e.options.LongPollRetention, budget)
+			if !ok {
+				t.e.logger.Infof("long-poll client %s missed messages", cid)
+				t.reconnect(w, cid, "")
+				return
+			}
+			if len(frames) > 0 {
+				batch, err := encodeBatch(codec, frames, last)
+				if err != nil {
+					t.e.logger.Errorf("encoding long-poll batch for %s: %v", cid, err)
+					t.e.reportError(TransportError, cid, "", "", err)
+					return
+				}
+				w.Write(batch)
+				if bw != nil {
+					bw.wrote(len(batch), limit, time.Now())
+				}
+				return
+			}
+		}
+		if conn.isMoving() {
+			t.reconnect(w, cid, reasonDraining)
+			return
+		}
+
+		select {
+		case <-conn.notify:
+		case <-resume:
+		case <-timeout.C:
+			batch, _ := encodeBatch(codec, nil, seq)
+			w.Write(batch)
+			return
+		case <-ctx.Done():
+			return
+		case <-waiter.cancel:
+			t.shutDown(w, cid)
+			return
+		}
+		if throttled != nil {
+			throttled.Stop()
+		}
+	}
+}
+
+// encodeBatch combines already encoded frames into a longPollBatch.
+func encodeBatch(codec Codec, frames [][]byte, seq uint64) ([]byte, error) {
+	switch codec.(type) {
+	case *jsonCodec:
+		b := []byte(`{"Messages":[`)
+		for i, f := range frames {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, f...)
+		}
+		b = append(b, `],"Seq":`...)
+		b = strconv.AppendUint(b, seq, 10)
+		return append(b, '}'), nil
+	case msgpackCodec:
+		b := msgpackAppendHeader(nil, 2, 0x80, 0xde, 0xdf)
+		b = msgpackAppendString(b, "Messages")
+		b = msgpackAppendHeader(b, len(frames), 0x90, 0xdc, 0xdd)
+		for _, f := range frames {
+			b = append(b, f...)
+		}
+		b = msgpackAppendString(b, "Seq")
+		return msgpackAppendUint(b, seq), nil
+	}
+
+	values := make([]json.RawMessage, len(frames))
+	for i, f := range frames {
+		var v interface{}
+		if err := codec.Unmarshal(f, &v); err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = raw
+	}
+
+	return codec.Marshal(longPollBatch{Messages: values, Seq: seq})
+}
+
+// disconnect tells a waiting client that the server disconnected it, and
+// forgets about its connection.
+func (t *longPollTransport) disconnect(w http.ResponseWriter, cid, reason string) {
+	frame, _ := t.e.encodeFrameFor(cid, &controlFrame{Command: "DISCONNECTED", Reason: reason})
+	w.Write(frame)
+	t.removeConnection(cid)
+}
+
+// shutDown tells a waiting client to stop polling, as the Exchange is
+// shutting down, and disconnects it.
+func (t *longPollTransport) shutDown(w http.ResponseWriter, cid string) {
+	t.disconnect(w, cid, ReasonShutdown)
+	t.e.disconnectClient(cid, ReasonShutdown)
+}
+
+// upgradedAway tells a waiting client that its connection upgraded to a
+// websocket, over which it is sent frames now.
+func (t *longPollTransport) upgradedAway(w http.ResponseWriter, cid string) {
+	frame, _ := t.e.encodeFrameFor(cid, &controlFrame{Command: commandUpgraded})
+	w.Write(frame)
+}
+
+// reconnect tells a waiting client to renegotiate and forgets about
+// its connection. The reason, if any, is passed on to the client.
+func (t *longPollTransport) reconnect(w http.ResponseWriter, cid, reason string) {
+	frame, _ := t.e.encodeFrameFor(cid, &controlFrame{Command: "RECONNECT", Reason: reason})
+	w.Write(frame)
+	t.removeConnection(cid)
+	t.e.disconnectClient(cid, ReasonClosed)
+}
@@ -0,0 +1,241 @@
+package relayr
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Ticker is a relay whose client method calls the tests count.
+type Ticker struct{}
+
+func (Ticker) Subscribe(r *Relay, group string) error {
+	return r.Groups(group).Add(r.ConnectionID)
+}
+
+func TestLongPollNoLossBetweenPolls(t *testing.T) {
+	const sends = 500
+	e, srv := serve(t, ExchangeOptions{LongPollMaxWait: 50 * time.Millisecond}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	poll(t, srv, cid, 0)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < sends; i++ {
+			if err := e.Clients(Ticker{}).Client(cid).Call("tick", i); err != nil {
+				t.Errorf("sending %d: %v", i, err)
+				return
+			}
+		}
+	}()
+
+	var seq uint64
+	var got []int
+	for len(got) < sends {
+		res := poll(t, srv, cid, seq)
+		if res.Command != "" {
+			t.Fatalf("poll answered with %s %s", res.Command, res.Reason)
+		}
+		if len(res.Messages) > 0 && res.Seq-uint64(len(res.Messages)) != seq {
+			t.Fatalf("polled after %d and got frames %d to %d", seq, res.Seq-uint64(len(res.Messages))+1, res.Seq)
+		}
+		for _, inv := range clientCalls(t, res.Messages) {
+			got = append(got, int(inv.Arguments[0].(float64)))
+		}
+		seq = res.Seq
+	}
+	wg.Wait()
+
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("call %d carried %d; calls were lost, duplicated or reordered", i, n)
+		}
+	}
+}
+
+func TestLongPollResendsUnacknowledged(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	for i := 0; i < 3; i++ {
+		e.Clients(Ticker{}).Client(cid).Call("tick", i)
+	}
+
+	first := poll(t, srv, cid, 0)
+	if len(first.Messages) != 3 {
+		t.Fatalf("polled %d frames, want 3", len(first.Messages))
+	}
+	// the response was lost, so the client polls after the same frame
+	again := poll(t, srv, cid, 0)
+	if len(again.Messages) != 3 || again.Seq != first.Seq {
+		t.Fatalf("polling again after 0 got %d frames up to %d, want the same 3 up to %d", len(again.Messages), again.Seq, first.Seq)
+	}
+
+	e.Clients(Ticker{}).Client(cid).Call("tick", 3)
+	next := poll(t, srv, cid, again.Seq)
+	if inv := clientCalls(t, next.Messages); len(inv) != 1 || inv[0].Arguments[0] != 3.0 {
+		t.Fatalf("polling after %d got %v, want only the new call", again.Seq, inv)
+	}
+}
+
+func TestLongPollOverflow(t *testing.T) {
+	t.Run("DropOldest", func(t *testing.T) {
+		e, srv := serve(t, ExchangeOptions{LongPollQueueSize: 4, OverflowPolicy: DropOldest}, Ticker{})
+		cid := negotiate(t, srv, "longpoll").ConnectionID
+		for i := 0; i < 10; i++ {
+			e.Clients(Ticker{}).Client(cid).Call("tick", i)
+		}
+
+		inv := clientCalls(t, poll(t, srv, cid, 0).Messages)
+		if len(inv) != 4 {
+			t.Fatalf("polled %d calls, want the 4 the queue holds", len(inv))
+		}
+		for i, c := range inv {
+			if c.Arguments[0] != float64(6+i) {
+				t.Fatalf("call %d carried %v; the newest were not kept", i, c.Arguments[0])
+			}
+		}
+		if dropped := e.DroppedMessages()[cid]; dropped != 6 {
+			t.Errorf("DroppedMessages reports %d, want 6", dropped)
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		e, srv := serve(t, ExchangeOptions{LongPollQueueSize: 4, OverflowPolicy: Disconnect}, Ticker{})
+		cid := negotiate(t, srv, "longpoll").ConnectionID
+		for i := 0; i < 5; i++ {
+			e.Clients(Ticker{}).Client(cid).Call("tick", i)
+		}
+
+		if res := poll(t, srv, cid, 0); res.Command != "RECONNECT" {
+			t.Fatalf("a client whose queue overflowed polled %+v, want to be told to reconnect", res)
+		}
+	})
+}
+
+func TestLongPollIdleClientsReaped(t *testing.T) {
+	gone := make(chan string, 3)
+	e, srv := serve(t, ExchangeOptions{
+		LongPollIdleTimeout:  300 * time.Millisecond,
+		LongPollMaxWait:      50 * time.Millisecond,
+		ReconnectGracePeriod: -1,
+		OnDisconnectWithReason: func(id, reason string) {
+			gone <- id
+		},
+	}, Ticker{})
+
+	idle := negotiate(t, srv, "longpoll").ConnectionID
+	polling := negotiate(t, srv, "longpoll").ConnectionID
+	calling := negotiate(t, srv, "longpoll").ConnectionID
+	for _, id := range []string{idle, polling, calling} {
+		poll(t, srv, id, 0)
+		if err := e.AddToGroup("ticks", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one client polls and another calls the server, each more often than
+	// the timeout, while the third does nothing
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		poll(t, srv, polling, 0)
+		if status := callOverHTTP(t, srv, calling, "Ticker", "Subscribe", "ticks"); status != 200 {
+			t.Fatalf("calling the server was answered with %d", status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case id := <-gone:
+		if id != idle {
+			t.Fatalf("reaped %s, which was active", id)
+		}
+	default:
+		t.Fatal("the idle client was not reaped")
+	}
+	select {
+	case id := <-gone:
+		t.Fatalf("reaped %s, which was active", id)
+	default:
+	}
+	if e.IsInGroup("ticks", idle) {
+		t.Error("the reaped client is still in its group")
+	}
+	if !e.IsInGroup("ticks", polling) || !e.IsInGroup("ticks", calling) {
+		t.Error("an active client was removed from its group")
+	}
+}
+
+func TestLongPollMaxWait(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{LongPollMaxWait: 200 * time.Millisecond}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+
+	start := time.Now()
+	res := poll(t, srv, cid, 0)
+	elapsed := time.Since(start)
+	if res.Command != "" || len(res.Messages) != 0 || res.Seq != 0 {
+		t.Fatalf("a poll with no traffic was answered with %+v, want an empty batch", res)
+	}
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("a poll with no traffic was answered after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestLongPollClientGoesAway(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	conn := e.transports["longpoll"].(*longPollTransport).connection(cid)
+	polling := func() int {
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		return conn.polling
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/relayr/longpoll?connectionId="+cid+"&seq=0", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	for deadline := time.Now().Add(testTimeout); polling() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the poll did not start waiting")
+		}
+	}
+
+	cancel()
+	<-done
+	for deadline := time.Now().Add(time.Second); polling() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the poll went on waiting once its client went away")
+		}
+	}
+}
+
+func TestLongPollForgedConnectionID(t *testing.T) {
+	teller := Teller{callers: make(chan string, 1)}
+	_, srv := serve(t, ExchangeOptions{}, teller)
+	victim := negotiate(t, srv, "websocket").ConnectionID
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+
+	for _, tt := range []struct {
+		as     string
+		status int
+		caller string
+	}{
+		{victim, http.StatusForbidden, ""},
+		{cid, http.StatusOK, cid},
+		{"", http.StatusOK, cid},
+	} {
+		if status := postFrame(t, srv, cid, `{"T":"s","R":"Teller","M":"Withdraw","A":[],"C":"`+tt.as+`"}`); status != tt.status {
+			t.Fatalf("a call sent as %q was answered %d, want %d", tt.as, status, tt.status)
+		}
+		teller.checkCaller(t, tt.caller)
+	}
+}
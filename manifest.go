@@ -0,0 +1,64 @@
+package relayr
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// clientManifest describes an Exchange to the client script: the URLs it
+// is served at, the options the script needs and the schema of the relays
+// clients may call.
+type clientManifest struct {
+	BaseURL         string        `json:"baseURL"` // route without its scheme, for scripts that predate wsURL
+	Route           string        `json:"route"`
+	WebSocketURL    string        `json:"wsURL,omitempty"` // as webSocketURL returns it
+	CallTimeout     int64         `json:"callTimeout"`     // in milliseconds
+	Transports      []string      `json:"transports"`
+	WithCredentials bool          `json:"withCredentials"`
+	IncludeSender   bool          `json:"includeSender,omitempty"`
+	Relays          []RelaySchema `json:"relays"`
+	Lazy            bool          `json:"lazy,omitempty"` // relays are loaded with use, with LazyRelays
+
+	// Hubs are the schemas of the relays of each hub of an ExchangeGroup,
+	// by name.
+	Hubs map[string][]RelaySchema `json:"hubs,omitempty"`
+}
+
+// StaticClientScript returns the part of the client script that is the
+// same for every Exchange, so that it can be bundled with other assets,
+// cached for good and pinned with a subresource integrity hash. A page
+// using it calls RelayRConnection.load with the URL the Exchange is served
+// at, in place of RelayRConnection.ready, which fetches the Exchange's
+// relays and options from its "manifest" operation before connecting.
+func StaticClientScript() []byte {
+	return []byte(connectionClassScript)
+}
+
+// manifestFor returns the manifest of the Exchange for the given URLs,
+// which lists no relays with LazyRelays or over MaxScriptRelays of them.
+func (e *Exchange) manifestFor(baseURL, route string) clientManifest {
+	m := clientManifest{
+		BaseURL:         baseURL,
+		Route:           route,
+		WebSocketURL:    e.webSocketURL(route),
+		CallTimeout:     e.options.ClientCallTimeout.Milliseconds(),
+		Transports:      e.options.ClientTransports,
+		WithCredentials: e.options.AllowCredentials,
+		IncludeSender:   e.options.IncludeSenderID,
+		Relays:          e.Schema(),
+		Hubs:            e.hubSchemas(),
+	}
+	if e.options.LazyRelays || (e.options.MaxScriptRelays > 0 && len(m.Relays) > e.options.MaxScriptRelays) {
+		m.Relays, m.Lazy = []RelaySchema{}, true
+	}
+	return m
+}
+
+// writeManifest serves the manifest a client script served apart from the
+// Exchange configures itself from. The schema of a single relay, loaded
+// with RelayRConnection.use, is served by writeRelayManifest.
+func (e *Exchange) writeManifest(w http.ResponseWriter, baseURL, route string) {
+	jsonResponse(w)
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(e.manifestFor(baseURL, route))
+}
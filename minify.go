@@ -0,0 +1,164 @@
+package relayr
+
+import "bytes"
+
+// minifyScript shrinks the generated client script by removing comments
+// and the whitespace the script does not need, leaving strings and
+// regular expressions as they are. A line break is kept wherever
+// automatic semicolon insertion might depend on it, so the script parses
+// exactly as before. It is not a general purpose minifier: it relies on
+// the script being written without template literals.
+func minifyScript(src []byte) []byte {
+	out := make([]byte, 0, len(src))
+	// the last character written, and whether whitespace or a comment
+	// came after it, with a line break
+	var prev byte
+	space, newline := false, false
+
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			space = true
+			i++
+			continue
+		case ch == '\n':
+			space, newline = true, true
+			i++
+			continue
+		case ch == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			space = true
+			continue
+		case ch == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				end = len(src) - i - 2
+			}
+			if bytes.IndexByte(src[i+2:i+2+end], '\n') >= 0 {
+				newline = true
+			}
+			i += end + 4
+			space = true
+			continue
+		}
+
+		if space && len(out) > 0 {
+			if sep := separator(prev, ch, newline); sep != 0 {
+				out = append(out, sep)
+			}
+		}
+		space, newline = false, false
+
+		switch {
+		case ch == '\'' || ch == '"':
+			n := quotedLen(src[i:], ch)
+			out = append(out, src[i:i+n]...)
+			i += n
+		case ch == '/' && regexAllowed(out):
+			n := regexLen(src[i:])
+			out = append(out, src[i:i+n]...)
+			i += n
+		default:
+			out = append(out, ch)
+			i++
+		}
+		prev = out[len(out)-1]
+	}
+
+	return out
+}
+
+// separator returns what must be kept of the whitespace between prev and
+// next, if anything, newline reporting whether it held a line break.
+func separator(prev, next byte, newline bool) byte {
+	if newline {
+		// a line break after an operator or opening bracket, or before
+		// one that cannot start a statement, never ends a statement
+		if bytes.IndexByte([]byte("{([,;:=?&|!<>*%~^"), prev) >= 0 ||
+			bytes.IndexByte([]byte(")]},;:.?&|*%^=<>"), next) >= 0 {
+			return 0
+		}
+		return '\n'
+	}
+	switch {
+	case isIdentByte(prev) && isIdentByte(next):
+		return ' '
+	case (prev == '+' || prev == '-') && (next == '+' || next == '-'):
+		// a + ++b is not a++ + b
+		return ' '
+	case prev == '/' && (next == '/' || next == '*'):
+		return ' '
+	}
+	return 0
+}
+
+func isIdentByte(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+		ch == '_' || ch == '$' || ch == '\\' || ch >= 0x80
+}
+
+// regexAllowed reports whether a slash following out starts a regular
+// expression rather than being a division.
+func regexAllowed(out []byte) bool {
+	if len(out) == 0 {
+		return true
+	}
+	last := out[len(out)-1]
+	if bytes.IndexByte([]byte("(,=:[!&|?{};+-*%~^<>"), last) >= 0 {
+		return true
+	}
+	for _, kw := range []string{"return", "typeof", "case", "in", "do", "else", "void", "delete"} {
+		if bytes.HasSuffix(out, []byte(kw)) {
+			n := len(out) - len(kw)
+			if n == 0 || !isIdentByte(out[n-1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// quotedLen returns the length of the string literal at the start of s,
+// quoted with q.
+func quotedLen(s []byte, q byte) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case q, '\n':
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// regexLen returns the length of the regular expression literal at the
+// start of s, flags included.
+func regexLen(s []byte) int {
+	class := false
+	i := 1
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			class = true
+		case ']':
+			class = false
+		case '/':
+			if !class {
+				i++
+				for i < len(s) && isIdentByte(s[i]) {
+					i++
+				}
+				return i
+			}
+		case '\n':
+			return i
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,224 @@
+package relayr
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+func TestMinifyScript(t *testing.T) {
+	for _, tt := range []struct {
+		name, src, want string
+	}{
+		{"line comment", "var a = 1; // one\nvar b = 2;", "var a=1;var b=2;"},
+		{"block comment", "/* header\n */\nvar a = 1;", "var a=1;"},
+		{"strings", `var s = "// not a comment", t = '/* nor this */';`, `var s="// not a comment",t='/* nor this */';`},
+		{"regular expressions", `var re = /\/\/+/g, n = a / b / c;`, `var re=/\/\/+/g,n=a/b/c;`},
+		{"slash in a class", "if (ok) { x = y.match(/[/]*/); }", "if(ok){x=y.match(/[/]*/);}"},
+		{"prefix operator on a new line", "a\n++b", "a\n++b"},
+		{"return on its own line", "return\nx", "return\nx"},
+		{"unary operators", "var c = a - -b + +d;", "var c=a- -b+ +d;"},
+		{"function", "var f = function (x) {\n\treturn x;\n};", "var f=function(x){return x;};"},
+	} {
+		if got := string(minifyScript([]byte(tt.src))); got != tt.want {
+			t.Errorf("%s: minified %q to %q, want %q", tt.name, tt.src, got, tt.want)
+		}
+	}
+}
+
+// browser is the little of a browser the client script needs to
+// long-poll: XMLHttpRequest, whose requests the test serves with sent and
+// answer, and timers the test runs with tick.
+const browser = `
+var window = this;
+var console = { log: function() {} };
+var requests = [], timers = [], timerID = 0;
+function XMLHttpRequest() {
+	this.readyState = 0;
+	this.status = 0;
+	this.responseText = '';
+}
+XMLHttpRequest.prototype.open = function(method, url) {
+	this.method = method;
+	this.url = url;
+};
+XMLHttpRequest.prototype.setRequestHeader = function() {};
+XMLHttpRequest.prototype.send = function(body) {
+	requests.push({ xhr: this, method: this.method, url: this.url, body: body || '' });
+};
+XMLHttpRequest.prototype.abort = function() {};
+function setTimeout(fn, ms) {
+	timers.push({ id: ++timerID, fn: fn, ms: ms || 0 });
+	return timerID;
+}
+function clearTimeout(id) {
+	for (var i = 0; i < timers.length; i++) {
+		if (timers[i].id === id) {
+			timers.splice(i, 1);
+			return;
+		}
+	}
+}
+// sent returns the requests not yet answered, as JSON
+function sent() {
+	var r = [];
+	for (var i = 0; i < requests.length; i++) {
+		if (!requests[i].answered) {
+			r.push({ ID: i, Method: requests[i].method, URL: requests[i].url, Body: requests[i].body });
+		}
+	}
+	return JSON.stringify(r);
+}
+function answer(id, status, text) {
+	var xhr = requests[id].xhr;
+	requests[id].answered = true;
+	xhr.readyState = 4;
+	xhr.status = status;
+	xhr.responseText = text;
+	xhr.onreadystatechange();
+}
+// tick runs the timers set to run at once, as those they run set
+function tick() {
+	for (var i = 0; i < timers.length; i++) {
+		if (timers[i].ms === 0) {
+			timers.splice(i, 1)[0].fn();
+			i = -1;
+		}
+	}
+}
+`
+
+// sentRequest is a request the client script sent.
+type sentRequest struct {
+	ID                int
+	Method, URL, Body string
+}
+
+// run runs src in vm, failing the test if it throws.
+func run(t *testing.T, vm *goja.Runtime, src string) goja.Value {
+	t.Helper()
+	v, err := vm.RunString(src)
+	if err != nil {
+		t.Fatalf("running %.40q: %v", src, err)
+	}
+	return v
+}
+
+// answerRequest serves the first request for op the script in vm has
+// sent and not had answered with e, and answers it.
+func answerRequest(t *testing.T, vm *goja.Runtime, e *Exchange, op string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reqs []sentRequest
+	if err := json.Unmarshal([]byte(run(t, vm, "sent()").String()), &reqs); err != nil {
+		t.Fatalf("decoding the requests sent: %v", err)
+	}
+	for _, req := range reqs {
+		if strings.Contains(req.URL, "/"+op+"?") {
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(req.Method, req.URL, strings.NewReader(req.Body)))
+			text, _ := json.Marshal(w.Body.String())
+			run(t, vm, "answer("+jsonString(req.ID)+", "+jsonString(w.Code)+", "+string(text)+")")
+			return w
+		}
+	}
+	t.Fatalf("the script sent %+v, want a request to %s", reqs, op)
+	return nil
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestMinifiedScriptConnects(t *testing.T) {
+	for _, minify := range []bool{false, true} {
+		name := "plain"
+		if minify {
+			name = "minified"
+		}
+		t.Run(name, func(t *testing.T) {
+			e := newExchange(t, "http://localhost/relayr", ExchangeOptions{
+				DisableScriptMinify: !minify,
+				LongPollMaxWait:     testTimeout,
+			})
+			e.RegisterRelay(Chat{})
+			script := getScript(e, "/relayr/client.js", nil).Body.String()
+
+			vm := goja.New()
+			run(t, vm, browser)
+			run(t, vm, script)
+			run(t, vm, `
+				var said = [], ready = false, replied = false;
+				RelayR.Chat.on('said', function(msg) { said.push(msg); });
+				RelayRConnection.ready(function() { ready = true; });
+			`)
+
+			var res struct{ ConnectionID string }
+			json.Unmarshal(answerRequest(t, vm, e, opNegotiate).Body.Bytes(), &res)
+			if res.ConnectionID == "" {
+				t.Fatal("the script did not negotiate a connection")
+			}
+			run(t, vm, "tick()")
+			if run(t, vm, "ready").Export() != true {
+				t.Fatal("the script is not ready once it has negotiated")
+			}
+
+			// queued before the poll is served, so that it is answered at once
+			e.Clients(Chat{}).All("said", "hello")
+			answerRequest(t, vm, e, opLongPoll)
+			if e.getClientByConnectionID(res.ConnectionID) == nil {
+				t.Fatal("the script's connection is not connected")
+			}
+			if got := run(t, vm, "JSON.stringify(said)").String(); got != `["hello"]` {
+				t.Fatalf("the script was sent %s, want [\"hello\"]", got)
+			}
+
+			// a call, whose result comes with the poll under way
+			run(t, vm, "RelayR.Chat.server.say('hi').then(function() { replied = true; })")
+			if w := answerRequest(t, vm, e, opCallServer); w.Code != 200 {
+				t.Fatalf("the script's call was answered with %d: %s", w.Code, w.Body)
+			}
+			deadline := time.Now().Add(testTimeout)
+			for run(t, vm, "replied").Export() != true {
+				if time.Now().After(deadline) {
+					t.Fatal("the script's call was not answered")
+				}
+				answerRequest(t, vm, e, opLongPoll)
+				run(t, vm, "tick()")
+			}
+		})
+	}
+}
+
+func TestScriptPreconnectAndSizes(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Chat{})
+	w := getScript(e, "/relayr/client.js", nil)
+
+	if link := w.Header().Get("Link"); !strings.HasPrefix(link, "<http://localhost/relayr/") || !strings.HasSuffix(link, "/"+opNegotiate+">; rel=preconnect") {
+		t.Errorf("Link is %q, want a preconnect to the negotiate URL", link)
+	}
+	s := e.Stats()
+	if s.ScriptBytes != w.Body.Len() {
+		t.Errorf("ScriptBytes is %d, but the script served is %d bytes", s.ScriptBytes, w.Body.Len())
+	}
+	if s.ScriptRawBytes <= s.ScriptBytes {
+		t.Errorf("ScriptRawBytes is %d, no more than the %d bytes minified", s.ScriptRawBytes, s.ScriptBytes)
+	}
+
+	// ClientScriptFunc alters the script in place of the minifier
+	ClientScriptFunc = func(b []byte) []byte { return append(b, "\n// altered\n"...) }
+	defer func() { ClientScriptFunc = nil }()
+	e = newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Chat{})
+	if body := getScript(e, "/relayr/client.js", nil).Body.String(); !strings.HasSuffix(body, "// altered\n") {
+		t.Error("ClientScriptFunc did not alter the script")
+	}
+	if s := e.Stats(); s.ScriptRawBytes+len("\n// altered\n") != s.ScriptBytes {
+		t.Errorf("with ClientScriptFunc the script is %d bytes, and %d before", s.ScriptBytes, s.ScriptRawBytes)
+	}
+}
@@ -0,0 +1,51 @@
+package relayr
+
+import (
+	"strings"
+)
+
+// globalGroupPrefix marks a group name returned by GlobalGroup. It cannot
+// appear in a group name otherwise, as nothing a client sends names one.
+const globalGroupPrefix = "\x00"
+
+// GlobalGroup marks a group as shared by every relay, for use with the
+// group operations of a Relay or ClientOperations when NamespaceGroups is
+// set: GlobalGroup("admins") is the group "admins" whichever relay it is
+// used through. Without NamespaceGroups it makes no difference.
+func GlobalGroup(name string) string {
+	return globalGroupPrefix + name
+}
+
+// qualifyGroup returns the name the Exchange knows a group by when it is
+// used through the relay: the name itself, or with NamespaceGroups the
+// name prefixed by the relay's, e.g. "Chat/admins". Global and groups
+// marked with GlobalGroup are never prefixed. Patterns are qualified the
+// same way.
+func (r *Relay) qualifyGroup(name string) string {
+	if strings.HasPrefix(name, globalGroupPrefix) {
+		return name[len(globalGroupPrefix):]
+	}
+	if name == "Global" || r.exchange == nil || !r.exchange.options.NamespaceGroups {
+		return name
+	}
+	return r.Name + "/" + name
+}
+
+// SplitGroupName splits a group name, as reported by Groups, into the name
+// of the relay whose namespace it is in and the name the relay uses for
+// it. Groups that are not in a registered relay's namespace, such as
+// those created before NamespaceGroups was set, are returned whole with
+// an empty relay name.
+func (e *Exchange) SplitGroupName(group string) (relay, name string) {
+	i := strings.Index(group, "/")
+	if i < 0 {
+		return "", group
+	}
+
+	for _, r := range e.relayList() {
+		if r.Name == group[:i] {
+			return group[:i], group[i+1:]
+		}
+	}
+	return "", group
+}
@@ -0,0 +1,88 @@
+// Package natsbackplane provides a relayr Backplane built on NATS, for
+// deployments that already run NATS and would rather not add Redis.
+package natsbackplane
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simon-whitehead/relayr"
+)
+
+// Backplane is a relayr.Backplane that publishes broadcasts to a NATS
+// subject. Every Exchange subscribes to the subject without a queue group
+// so that each instance receives every broadcast.
+type Backplane struct {
+	conn    *nats.Conn
+	subject string
+
+	lock sync.Mutex
+	sub  *nats.Subscription
+}
+
+// New returns a Backplane that publishes on conn to the subject
+// subjectPrefix + ".broadcast". An empty prefix defaults to "relayr".
+// The connection remains owned by the caller; Close does not close it.
+func New(conn *nats.Conn, subjectPrefix string) *Backplane {
+	if subjectPrefix == "" {
+		subjectPrefix = "relayr"
+	}
+
+	return &Backplane{
+		conn:    conn,
+		subject: subjectPrefix + ".broadcast",
+	}
+}
+
+// Publish implements relayr.Backplane.
+func (b *Backplane) Publish(msg relayr.BackplaneMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return b.conn.Publish(b.subject, payload)
+}
+
+// Subscribe implements relayr.Backplane. The message envelopes carry the
+// instance ID of their publisher, which the Exchange uses to skip its
+// own broadcasts.
+func (b *Backplane) Subscribe(fn func(msg relayr.BackplaneMessage)) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.sub != nil {
+		return errors.New("natsbackplane: already subscribed")
+	}
+
+	sub, err := b.conn.Subscribe(b.subject, func(m *nats.Msg) {
+		var msg relayr.BackplaneMessage
+		if err := json.Unmarshal(m.Data, &msg); err != nil {
+			return
+		}
+		fn(msg)
+	})
+	if err != nil {
+		return err
+	}
+	b.sub = sub
+
+	return nil
+}
+
+// Close implements relayr.Backplane by unsubscribing. It does not close
+// the NATS connection.
+func (b *Backplane) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.sub == nil {
+		return nil
+	}
+	err := b.sub.Unsubscribe()
+	b.sub = nil
+
+	return err
+}
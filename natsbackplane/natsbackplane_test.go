@@ -0,0 +1,111 @@
+//go:build nats
+
+// The tests here need a NATS server, at NATS_URL or the default URL, and
+// run with the nats build tag:
+//
+//	go test -tags nats ./natsbackplane
+package natsbackplane_test
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/simon-whitehead/relayr"
+	"github.com/simon-whitehead/relayr/natsbackplane"
+	"github.com/simon-whitehead/relayr/relayrtest"
+)
+
+type Notifier struct{}
+
+func (Notifier) Ping(r *relayr.Relay) {}
+
+// connect connects to the NATS server the tests run against.
+func connect(t *testing.T) *nats.Conn {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("connecting to NATS at %s: %v", url, err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+// instance makes an Exchange using a Backplane on subject prefix, with a
+// test client in group.
+func instance(t *testing.T, conn *nats.Conn, prefix, group string) (*relayr.Exchange, *relayrtest.TestClient) {
+	e := relayr.NewExchange("http://localhost/relayr", 0)
+	t.Cleanup(func() { e.Close(context.Background()) })
+	b := natsbackplane.New(conn, prefix)
+	if err := e.UseBackplane(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterRelay(Notifier{}); err != nil {
+		t.Fatal(err)
+	}
+	c := relayrtest.NewTestClient(e)
+	if err := c.JoinGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	return e, c
+}
+
+// expect waits for c to be called with arg, failing the test if another
+// call, or none, arrives.
+func expect(t *testing.T, c *relayrtest.TestClient, arg string) {
+	t.Helper()
+	select {
+	case call := <-c.Received():
+		if call.Method != "notify" || call.Args[0] != arg {
+			t.Fatalf("received %s(%v), want notify(%s)", call.Method, call.Args, arg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notify(%s) did not arrive", arg)
+	}
+}
+
+func TestBroadcastAcrossInstances(t *testing.T) {
+	conn := connect(t)
+	prefix := "relayrtest." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	a, onA := instance(t, conn, prefix, "news")
+	_, onB := instance(t, conn, prefix, "news")
+
+	if err := a.Clients(Notifier{}).Group("news").Call("notify", "first"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, onA, "first")
+	expect(t, onB, "first")
+
+	// the publisher skips its own envelope, so its client is not called
+	// twice
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case call := <-onA.Received():
+		t.Fatalf("the publisher's client was called again: %s(%v)", call.Method, call.Args)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSubjectPrefixesSeparateInstances(t *testing.T) {
+	conn := connect(t)
+	prefix := "relayrtest." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	a, _ := instance(t, conn, prefix+".a", "news")
+	_, onB := instance(t, conn, prefix+".b", "news")
+
+	if err := a.Clients(Notifier{}).Group("news").Call("notify", "private"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case call := <-onB.Received():
+		t.Fatalf("an instance on another subject was called: %s(%v)", call.Method, call.Args)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,190 @@
+package relayr
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// OfflineEnvelope is a call to a client method made to a user who had no
+// clients connected, kept by an OfflineStore until one connects.
+type OfflineEnvelope struct {
+	Relay     string        `json:"R"`
+	Method    string        `json:"M"`
+	Arguments []interface{} `json:"A"` // as they are encoded
+	Time      time.Time     `json:"T"` // when the call was made
+}
+
+// OfflineStore keeps the calls made through Clients.User to users with no
+// clients connected to the Exchange, so that they can be sent to the
+// first of the user's clients to connect. Calls are kept as they were
+// made, without running the outbound interceptors. Implementations backed
+// by a database or Redis can share the calls between instances.
+type OfflineStore interface {
+	// Save keeps a call made to a user, after those saved before it.
+	Save(userID string, env OfflineEnvelope) error
+	// LoadAndDelete returns the calls kept for a user, oldest first,
+	// and forgets them.
+	LoadAndDelete(userID string) ([]OfflineEnvelope, error)
+}
+
+// offlineStripes is the number of offline locks users are spread over.
+const offlineStripes = 64
+
+// saveOfflineLocked saves a call made to a user with the OfflineStore, if there
+// is one, when the user has no clients connected, reporting whether it
+// did. The caller must hold the user's offline lock.
+func (e *Exchange) saveOfflineLocked(relay *Relay, userID, fn string, args []interface{}) (bool, error) {
+	store := e.options.OfflineStore
+	if store == nil {
+		return false, nil
+	}
+
+	e.mapLock.RLock()
+	online := len(e.users[userID]) > 0
+	e.mapLock.RUnlock()
+	if online {
+		return false, nil
+	}
+
+	err := store.Save(userID, OfflineEnvelope{Relay: relay.Name, Method: fn, Arguments: wireArgs(args), Time: time.Now()})
+	if err != nil {
+		e.logger.Errorf("saving %s for user %s: %v", fn, userID, err)
+		e.reportError(TransportError, "", relay.Name, fn, err)
+	}
+	return true, err
+}
+
+// connectUser runs connect, which adds a client of the given user to the
+// Exchange and returns it, or nil if it did not, and sends the client the
+// calls kept for the user while it had none connected. The user's offline
+// lock is held meanwhile, so that they are queued ahead of any call made
+// to the user after the client was added, and none saved in the meantime
+// is left behind.
+func (e *Exchange) connectUser(userID string, connect func() *client) *client {
+	store := e.options.OfflineStore
+	if store == nil || userID == "" {
+		return connect()
+	}
+
+	l := e.offlineLock(userID)
+	l.Lock()
+	defer l.Unlock()
+
+	c := connect()
+	if c == nil {
+		return nil
+	}
+	envs, err := store.LoadAndDelete(userID)
+	if err != nil {
+		e.logger.Errorf("loading the calls kept for user %s: %v", userID, err)
+		e.reportError(TransportError, c.ConnectionID, "", "", err)
+		return c
+	}
+	if len(envs) == 0 {
+		return c
+	}
+	s, ok := c.transport().(rawSender)
+	if !ok {
+		return c
+	}
+
+	codec, version := e.protocolFor(c.ConnectionID)
+	for _, env := range envs {
+		frame, err := encodeFrame(codec, version, &clientInvocation{Relay: env.Relay, Method: env.Method, Arguments: env.Arguments, Missed: true})
+		if err != nil {
+			e.logger.Errorf("encoding %s for %s: %v", env.Method, c.ConnectionID, err)
+			e.reportError(TransportError, c.ConnectionID, env.Relay, env.Method, err)
+			continue
+		}
+		if err := s.sendCall(c.ConnectionID, frame, "", 0, time.Time{}); err != nil {
+			e.logger.Debugf("sending %s kept for %s: %v", env.Method, c.ConnectionID, err)
+			break
+		}
+	}
+	return c
+}
+
+// offlineLock returns the lock of the stripe a user's offline calls fall
+// in.
+func (e *Exchange) offlineLock(userID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return &e.offlineLocks[h.Sum32()%offlineStripes]
+}
+
+// MemoryOfflineStore is an OfflineStore that keeps calls in memory, for
+// an Exchange running on its own.
+type MemoryOfflineStore struct {
+	lock  sync.Mutex
+	ttl   time.Duration
+	max   int
+	users map[string][]OfflineEnvelope
+	swept time.Time
+}
+
+// NewMemoryOfflineStore returns a MemoryOfflineStore keeping calls for up
+// to ttl, and at most maxPerUser calls for each user, the oldest being
+// dropped to make room. Zero for either means no limit.
+func NewMemoryOfflineStore(ttl time.Duration, maxPerUser int) *MemoryOfflineStore {
+	return &MemoryOfflineStore{
+		ttl:   ttl,
+		max:   maxPerUser,
+		users: make(map[string][]OfflineEnvelope),
+		swept: time.Now(),
+	}
+}
+
+// Save keeps a call made to a user.
+func (s *MemoryOfflineStore) Save(userID string, env OfflineEnvelope) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if s.ttl > 0 && now.Sub(s.swept) > s.ttl {
+		// forget the users that have not come back for their calls
+		for id := range s.users {
+			s.expireLocked(id, now)
+		}
+		s.swept = now
+	}
+
+	envs := append(s.expireLocked(userID, now), env)
+	if s.max > 0 && len(envs) > s.max {
+		envs = append([]OfflineEnvelope(nil), envs[len(envs)-s.max:]...)
+	}
+	s.users[userID] = envs
+	return nil
+}
+
+// LoadAndDelete returns the calls kept for a user that have not expired.
+func (s *MemoryOfflineStore) LoadAndDelete(userID string) ([]OfflineEnvelope, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	envs := s.expireLocked(userID, time.Now())
+	delete(s.users, userID)
+	return envs, nil
+}
+
+// expireLocked drops the calls kept for a user that have expired by now,
+// returning the rest. The caller must hold s.lock.
+func (s *MemoryOfflineStore) expireLocked(userID string, now time.Time) []OfflineEnvelope {
+	envs := s.users[userID]
+	if s.ttl <= 0 {
+		return envs
+	}
+	i := 0
+	for i < len(envs) && now.Sub(envs[i].Time) > s.ttl {
+		i++
+	}
+	if i == len(envs) {
+		delete(s.users, userID)
+		return nil
+	}
+	if i > 0 {
+		envs = envs[i:]
+		s.users[userID] = envs
+	}
+	return envs
+}
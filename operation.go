@@ -1,9 +1,91 @@
 package relayr
 
+import (
+	"net/http"
+	"strings"
+)
+
 const (
-	opNegotiate  = "negotiate"
-	opConnect    = "connect"
-	opWebSocket  = "ws"
-	opLongPoll   = "longpoll"
-	opCallServer = "call"
+	opNegotiate    = "negotiate"
+	opConnect      = "connect"
+	opWebSocket    = "ws"
+	opLongPoll     = "longpoll"
+	opCallServer   = "call"
+	opStats        = "stats"
+	opServerInvoke = "serverinvoke"
+	opScript       = "client.js"
+	opManifest     = "manifest"
+	opSourceMap    = "client.js.map"
+	opHealth       = "healthz"
 )
+
+// mountedOperations maps the sub-paths of an Exchange with a MountPath to
+// the operations they serve.
+var mountedOperations = map[string]string{
+	"/" + opNegotiate:    opNegotiate,
+	"/" + opWebSocket:    opWebSocket,
+	"/" + opLongPoll:     opLongPoll,
+	"/poll":              opLongPoll,
+	"/" + opCallServer:   opCallServer,
+	"/" + opStats:        opStats,
+	"/" + opServerInvoke: opServerInvoke,
+	"/" + opScript:       opScript,
+	"/" + opManifest:     opManifest,
+	"/" + opSourceMap:    opSourceMap,
+	"/" + opHealth:       opHealth,
+}
+
+// operationMethods are the HTTP methods each operation is served with,
+// besides OPTIONS. Operations not listed are requests for the client
+// script.
+var operationMethods = map[string][]string{
+	opNegotiate:    {http.MethodPost},
+	opCallServer:   {http.MethodPost},
+	opServerInvoke: {http.MethodPost},
+	opWebSocket:    {http.MethodGet},
+	opLongPoll:     {http.MethodGet},
+	opStats:        {http.MethodGet},
+	opManifest:     {http.MethodGet, http.MethodHead},
+	opSourceMap:    {http.MethodGet, http.MethodHead},
+	opHealth:       {http.MethodGet, http.MethodHead},
+}
+
+var scriptMethods = []string{http.MethodGet, http.MethodHead}
+
+// crossOriginOperation reports whether the client script may request op
+// from another origin, subject to the CORS options.
+func crossOriginOperation(op string) bool {
+	switch op {
+	case opNegotiate, opLongPoll, opCallServer, opManifest:
+		return true
+	}
+	return false
+}
+
+// allowMethod reports whether r's method is one op is served with. When
+// it is not, r is answered with 405 and an Allow header naming those that
+// are. OPTIONS requests are answered with the Allow header and 204, but
+// left for allowCrossOrigin to answer for operations that may be
+// requested across origins.
+func allowMethod(w http.ResponseWriter, r *http.Request, op string) bool {
+	methods, ok := operationMethods[op]
+	if !ok {
+		methods = scriptMethods
+	}
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", ")+", "+http.MethodOptions)
+	if r.Method != http.MethodOptions {
+		httpError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if crossOriginOperation(op) {
+		return true
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
@@ -0,0 +1,94 @@
+package relayr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOperationMethods(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{EnableStats: true, EnableHealthCheck: true, ServerInvokeSecret: "secret"})
+	e.RegisterRelay(Chat{})
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+	ops := []string{opNegotiate, opWebSocket, opLongPoll, opCallServer, opStats, opServerInvoke, opScript, opManifest, opSourceMap, opHealth}
+
+	for _, op := range ops {
+		allowed, ok := operationMethods[op]
+		if !ok {
+			allowed = scriptMethods
+		}
+		for _, method := range methods {
+			t.Run(op+" "+method, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				e.ServeHTTP(w, httptest.NewRequest(method, "/relayr/"+op, strings.NewReader("{}")))
+
+				switch {
+				case method == http.MethodOptions:
+					if w.Code != http.StatusNoContent {
+						t.Errorf("answered with %d, want 204", w.Code)
+					}
+				case contains(allowed, method):
+					if w.Code == http.StatusMethodNotAllowed {
+						t.Errorf("answered with 405, though %s is served with %v", op, allowed)
+					}
+				default:
+					if w.Code != http.StatusMethodNotAllowed {
+						t.Errorf("answered with %d, want 405", w.Code)
+					}
+				}
+				if method == http.MethodOptions || !contains(allowed, method) {
+					if allow := w.Header().Get("Allow"); allow != strings.Join(allowed, ", ")+", OPTIONS" {
+						t.Errorf("answered with Allow %q, want %v and OPTIONS", allow, allowed)
+					}
+				}
+				if op == opScript && method == http.MethodHead && w.Body.Len() != 0 {
+					t.Errorf("HEAD was answered with a body of %d bytes", w.Body.Len())
+				}
+			})
+		}
+	}
+}
+
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	// calls are limited as messages are, by MaxMessageSize
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{MaxRequestBodySize: 1024, MaxMessageSize: 1024})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/relayr/negotiate", strings.NewReader(`{"t":"longpoll"}`)))
+	var res negotiationResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{opNegotiate, opCallServer} {
+		body := `{"t":"longpoll","q":{"pad":"` + strings.Repeat("x", 2048) + `"}}`
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/relayr/"+op+"?connectionId="+res.ConnectionID, strings.NewReader(body)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("a body over the limit to %s was answered with %d, want 413", op, w.Code)
+		}
+	}
+
+	// a client that has gone away is not read from
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/relayr/negotiate", strings.NewReader(`{"t":"longpoll"}`)).WithContext(ctx)
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	if w.Body.Len() != 0 {
+		t.Errorf("a negotiation whose client had gone away was answered with %s", w.Body)
+	}
+}
@@ -0,0 +1,831 @@
+package relayr
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	defaultKeepAliveTimeout  = 40 * time.Second
+	defaultWriteTimeout      = 10 * time.Second
+	defaultBufferSize        = 1024
+	defaultMaxMessageSize    = 64 * 1024
+	defaultMaxRequestBody    = 1024 * 1024
+	defaultMaxRetainedBytes  = 8 * 1024 * 1024
+	defaultOutChannelSize    = 10 * 1024
+	defaultLongPollQueue     = 1024
+	defaultHighWaterMark     = 0.5
+	defaultSlowConnection    = 5 * time.Second
+	defaultSlowRoundTrip     = 2 * time.Second
+	defaultLongPollIdle      = 60 * time.Second
+	defaultLongPollMaxWait   = 25 * time.Second
+	defaultLongPollRetention = 256
+	defaultClientCallTimeout = 30 * time.Second
+	defaultReconnectGrace    = 30 * time.Second
+	defaultConnectTimeout    = 30 * time.Second
+	defaultPresenceGrace     = 5 * time.Second
+	defaultMaxCallWorkers    = 1024
+	defaultConnectionValues  = 4 * 1024
+	defaultTokenTTL          = 24 * time.Hour
+	defaultMaxGroupName      = 128
+	defaultLongPollUpgrade   = 30 * time.Second
+	defaultUploadBuffer      = 16
+	defaultMaxUploadBytes    = 16 * 1024 * 1024
+	defaultMaxUploadDuration = 10 * time.Minute
+	defaultWebSocketProbe    = 5 * time.Second
+	defaultWebhookWorkers    = 16
+	defaultCompressThreshold = 512
+	defaultPriorityBurst     = 16
+	defaultDuplicateWindow   = 64
+	defaultDuplicateTTL      = 5 * time.Minute
+	defaultHealthQueue       = 0.9
+	defaultErrorHistory      = 10
+)
+
+// ExchangeOptions configures an Exchange. Zero values are replaced
+// with sensible defaults by NewExchangeWithOptions. Those RuntimeOptions
+// holds can be changed while the Exchange runs, with UpdateOptions.
+type ExchangeOptions struct {
+	// MountPath is the path the Exchange is served under, e.g. "/relayr".
+	// When set, requests are routed on its exact sub-paths ("/negotiate",
+	// "/ws", "/longpoll" or "/poll", "/call", "/client.js", "/client.js.map",
+	// "/stats", "/healthz" and "/serverinvoke"), with or without the
+	// MountPath itself, and anything else is answered with 404. The client
+	// script's URLs are built from it. When empty the operation is taken
+	// from the last segment of the request path.
+	MountPath string
+
+	// KeepAliveTimeout is how long a websocket may go without answering
+	// a ping before it is disconnected. It is enforced as a read deadline
+	// that each pong extends. Defaults to 40 seconds.
+	KeepAliveTimeout time.Duration
+
+	// WriteTimeout is how long writing a message to a websocket may take
+	// before the connection is closed and the client disconnected, so a
+	// client that stops reading cannot hold up its connection's writes
+	// for good. Defaults to 10 seconds.
+	WriteTimeout time.Duration
+
+	// MaxMessageSize is the largest message, in bytes, a client may send
+	// over a websocket or in a long-poll call. Websockets that exceed it
+	// are closed and long-poll calls are answered with 413. Defaults to
+	// 64KB.
+	MaxMessageSize int64
+
+	// MaxRequestBodySize is the largest body, in bytes, of a negotiate or
+	// server invoke request. Larger ones are answered with 413. Defaults
+	// to 1MB.
+	MaxRequestBodySize int64
+
+	// ReadBufferSize and WriteBufferSize are the websocket I/O buffer
+	// sizes in bytes. Both default to 1024.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// EnableCompression negotiates permessage-deflate with websocket
+	// clients that support it.
+	EnableCompression bool
+
+	// CompressionLevel is the flate level used for compressed websocket
+	// messages, from -2 (Huffman only) to 9 (best compression). Zero keeps
+	// gorilla/websocket's default.
+	CompressionLevel int
+
+	// CompressionThresholdBytes is the smallest websocket message that is
+	// compressed, with EnableCompression; smaller ones, such as typing
+	// notifications, are written uncompressed, as deflating them costs
+	// more than it saves. ExchangeStats.CompressedBytes and DeflatedBytes
+	// tell how much compression saves, to tune it by. Defaults to 512
+	// bytes; negative compresses every message.
+	CompressionThresholdBytes int
+
+	// OutChannelSize is the number of outgoing messages buffered per
+	// websocket connection. Defaults to 10240. Calls made with High or
+	// Low Priority wait in lanes of their own, an eighth as long.
+	OutChannelSize int
+
+	// PriorityBurst is the most frames of a higher Priority sent to a
+	// client in a row while frames of a lower one wait, after which one
+	// of those is sent, so that High calls cannot hold up the others
+	// for good. Defaults to 16.
+	PriorityBurst int
+
+	// WriteBatchSize batches the frames waiting to be sent to a websocket
+	// client into messages of up to this many frames, each an array of
+	// them, so that bursts take fewer writes. Only clients using a text
+	// codec, such as JSON, with a script that understands batches are
+	// sent them. Batching is off when it is below 2.
+	WriteBatchSize int
+
+	// WriteBatchBytes stops adding frames to a batch once it holds this
+	// many bytes. Zero means no limit beyond WriteBatchSize.
+	WriteBatchBytes int
+
+	// WriteBatchDelay is how long a batch waits for more frames before it
+	// is sent, trading latency for fewer writes. Zero sends the frames
+	// already waiting without waiting for more.
+	WriteBatchDelay time.Duration
+
+	// SlowClientGracePeriod is how long a websocket's outgoing buffer may
+	// stay full before the connection is closed. Messages that do not fit
+	// in the buffer are never allowed to block a broadcast; the
+	// OverflowPolicy decides what is dropped instead. Zero never closes
+	// slow connections.
+	SlowClientGracePeriod time.Duration
+
+	// OverflowPolicy says what happens to a call made to a client whose
+	// send queue, OutChannelSize or LongPollQueueSize long, is full.
+	// Defaults to DropNewest.
+	OverflowPolicy OverflowPolicy
+
+	// GroupOverflowPolicies overrides the OverflowPolicy for calls made to
+	// the groups it names, e.g. DropOldest for a group of price ticks
+	// while chat keeps the default. Calls to the groups matching a
+	// pattern use the policy named by the pattern itself.
+	GroupOverflowPolicies map[string]OverflowPolicy
+
+	// OnConnectionSlow is called when a connection's send queue has stayed
+	// at least HighWaterMark full for the SlowConnectionDelay, so that the
+	// application can send it less before anything is dropped. It is
+	// called once each time the queue stays high, with the size of the
+	// frames queued, on its own goroutine.
+	OnConnectionSlow func(connectionID string, queuedBytes int)
+
+	// HighWaterMark is the fraction of a send queue that, filled for the
+	// SlowConnectionDelay, makes a connection slow. The queue is checked
+	// as frames are queued. Defaults to 0.5.
+	HighWaterMark float64
+
+	// SlowConnectionDelay is how long a send queue must stay over the
+	// HighWaterMark for OnConnectionSlow to be called. Defaults to 5s.
+	SlowConnectionDelay time.Duration
+
+	// SlowRoundTrip is how long a websocket client may take to answer a
+	// keep-alive ping before its connection is considered slow, as it is
+	// while its send queue stays over the HighWaterMark. Defaults to 2s.
+	SlowRoundTrip time.Duration
+
+	// NotifySlowClients tells clients when their connection becomes slow
+	// and when it recovers, raising connectionslow and
+	// connectionrecovered on RelayRConnection, e.g. to warn the user
+	// before it drops. Long-poll clients, which are not pinged, judge for
+	// themselves from how long their calls take to be accepted, against
+	// the SlowRoundTrip.
+	NotifySlowClients bool
+
+	// LongPollQueueSize is the number of messages buffered for a long-poll
+	// client between polls. When it is exceeded the OverflowPolicy applies.
+	// Defaults to 1024.
+	LongPollQueueSize int
+
+	// LongPollRetention is the number of messages already sent to a
+	// long-poll client that are kept so they can be sent again if the
+	// client reports it did not receive them. A client that has missed
+	// more is told to reconnect. Defaults to 256; negative keeps none.
+	LongPollRetention int
+
+	// LongPollMaxWait is how long a poll request is held open when there
+	// is nothing to send before it is answered with an empty batch and
+	// the client polls again. Defaults to 25 seconds.
+	LongPollMaxWait time.Duration
+
+	// LongPollIdleTimeout is how long a long-poll client may go without
+	// polling or calling the server before it is considered gone and
+	// disconnected. Defaults to 60 seconds.
+	LongPollIdleTimeout time.Duration
+
+	// ConnectTimeout is how long a client may take to open its websocket
+	// or make its first long poll after negotiating. Clients that take
+	// longer are forgotten and must negotiate again. Defaults to 30 seconds.
+	ConnectTimeout time.Duration
+
+	// ReconnectGracePeriod is how long a disconnected client's
+	// ConnectionID, groups and state are kept so that it can reconnect
+	// and carry on where it left off. Defaults to 30 seconds; a negative
+	// value forgets clients as soon as they disconnect.
+	ReconnectGracePeriod time.Duration
+
+	// PresenceGracePeriod is how long, with EnablePresence, a user whose
+	// last connection leaves a group stays present in it, so that a
+	// client reconnecting within it is not reported leaving and joining
+	// again. Defaults to 5 seconds; a negative value reports it leaving
+	// straight away.
+	PresenceGracePeriod time.Duration
+
+	// Logger receives diagnostic output. Defaults to a standard logger
+	// writing to stderr that only reports errors, or everything when
+	// Verbosity is greater than zero.
+	Logger Logger
+
+	// Verbosity selects the level of the default Logger. It is ignored
+	// when Logger is set.
+	Verbosity int
+
+	// MaxRetainedBytes bounds the size of the calls kept for replay by
+	// RetainGroupMessages, counting their encoded arguments, across every
+	// group. The oldest are dropped to make room. Defaults to 8MB.
+	MaxRetainedBytes int64
+
+	// MaxStateBytes bounds the size of the states kept by CallStateful,
+	// encoded as JSON, across every group. Those updated least recently
+	// are dropped to make room, their groups being sent the next in full.
+	// Defaults to 8MB.
+	MaxStateBytes int64
+
+	// ConcurrentCalls runs each call a client makes to a relay method on
+	// a goroutine of its own as soon as it arrives. By default a client's
+	// calls run one at a time, in the order it made them, so that a call
+	// sees the effects of those before it; calls from different clients
+	// still run concurrently. A call holds up the client's later ones
+	// until it returns, or until its stream ends for a method that streams
+	// its result, so relay methods that wait for a later call from the
+	// same client need ConcurrentCalls.
+	ConcurrentCalls bool
+
+	// MaxCallWorkers bounds how many calls, from different clients, run
+	// at once without ConcurrentCalls; others wait for one to finish. It
+	// is the Exchange's bound on concurrent calls, so there is no separate
+	// MaxConcurrentCalls. Defaults to 1024, though calls were not bounded
+	// at all before worker pools: raise it, or set ConcurrentCalls, to run
+	// more at once.
+	MaxCallWorkers int
+
+	// MaxQueuedCalls bounds how many calls may wait for a worker, across
+	// every client, or with ConcurrentCalls how many may run at once.
+	// Further calls are refused with ErrServerBusy, long-polling clients
+	// being answered with 503, and counted in Stats as BusyCalls. Zero
+	// imposes no limit.
+	MaxQueuedCalls int
+
+	// ClientCallTimeout is how long the generated client script waits for
+	// the result of a server call before rejecting its promise. Defaults
+	// to 30 seconds.
+	ClientCallTimeout time.Duration
+
+	// DuplicateCallWindow is how many of each client's latest calls are
+	// remembered by the call ID the client script gives them, so that a
+	// call sent again, as the script does when the POST carrying it over
+	// long polling fails, is not run twice: the duplicate is accepted, but
+	// not passed to the relay method, and counted in Stats as a
+	// DuplicateCall. Defaults to 64; negative to run every call.
+	DuplicateCallWindow int
+
+	// DuplicateCallTTL is how long a call is remembered for the
+	// DuplicateCallWindow. Defaults to 5 minutes.
+	DuplicateCallTTL time.Duration
+
+	// RememberCallResults keeps the result each call in the
+	// DuplicateCallWindow returns, so that its duplicates are answered
+	// with it, as clients that send a call again under another
+	// InvocationID need. Without it duplicates are answered with nothing,
+	// the client script sending a call again under its InvocationID.
+	RememberCallResults bool
+
+	// DisableScriptCache regenerates the client-side script on every
+	// request instead of serving it from a cache.
+	DisableScriptCache bool
+
+	// DisableScriptMinify serves the client-side script as it is
+	// generated, with its comments and indentation. Otherwise it is
+	// minified, unless a ScriptTransform or ClientScriptFunc is set,
+	// which is applied instead.
+	DisableScriptMinify bool
+
+	// LazyRelays leaves the relays out of the client script and the
+	// manifest, for Exchanges with many relays of which a page uses few.
+	// A page loads those it uses with RelayRConnection.use, before ready,
+	// each from the "manifest" operation with ?relay=Name, which is served
+	// with an ETag so that browsers cache it. Calls to relays a client did
+	// not load are refused. The relays of hubs are not left out.
+	LazyRelays bool
+
+	// MaxScriptRelays is the most relays the client script and the
+	// manifest list; an Exchange with more leaves them out, as with
+	// LazyRelays. Zero imposes no limit.
+	MaxScriptRelays int
+
+	// CallRateLimit limits how often each client may call relay methods.
+	// Calls over the limit are rejected with ErrRateLimited, or 429 for
+	// long-poll clients. The zero value imposes no limit.
+	CallRateLimit RateLimit
+
+	// MethodRateLimits overrides CallRateLimit for a relay, keyed by its
+	// name, or for a single method, keyed by "Relay.Method". Each entry
+	// is tracked separately.
+	MethodRateLimits map[string]RateLimit
+
+	// RateLimitDisconnectThreshold disconnects a client once this many of
+	// its calls in a row have been rejected by a rate limit. Zero never
+	// disconnects.
+	RateLimitDisconnectThreshold int
+
+	// Authorizer authenticates negotiate and websocket upgrade requests.
+	// When it returns an error the request is refused with 401. The
+	// principal it returns is available to relay methods through
+	// Relay.Principal.
+	Authorizer func(r *http.Request) (principal interface{}, err error)
+
+	// UserIDProvider derives a user ID from the principal returned by the
+	// Authorizer, so that all of a user's connections can be reached with
+	// Clients.User. When nil, principals that are strings are used as the
+	// user ID. An empty ID leaves the connection out of the user index.
+	UserIDProvider func(principal interface{}) string
+
+	// OfflineStore keeps the calls made through Clients.User to users with
+	// no clients connected, e.g. a MemoryOfflineStore. The first of the
+	// user's clients to negotiate, or reconnect, is sent them ahead of the
+	// calls made to the user since, with RelayRConnection.missed set while
+	// their handlers run. When nil such calls are dropped.
+	OfflineStore OfflineStore
+
+	// RequireMethodAuthorization rejects calls to relay methods that have
+	// no rule added with Exchange.Authorize, on relays that do not
+	// implement MethodAuthorizer, with ErrForbidden. By default they are
+	// allowed.
+	RequireMethodAuthorization bool
+
+	// OnNegotiate is called when a client negotiates a new connection,
+	// before its ConnectionID is returned. It can be used to populate the
+	// connection's state from the request's cookies or headers.
+	OnNegotiate func(r *http.Request, connectionID string, state *ConnectionState)
+
+	// ContextExtractor takes values, such as those middleware attached to
+	// its context, from the requests a client negotiates, opens its
+	// websocket and makes calls over long polling with, for Relay.Value.
+	// Those taken as it negotiates and opens its websocket are kept for
+	// the connection, later ones replacing earlier ones of the same key;
+	// those taken from a call's own request apply to that call alone,
+	// over the connection's.
+	ContextExtractor func(r *http.Request) map[string]interface{}
+
+	// AllowInitialGroup decides whether a client may join a group it asks
+	// to be added to when it negotiates, so that it is a member before it
+	// connects and misses nothing sent to the group meanwhile. principal
+	// is what the Authorizer returned. Groups are named in full, as Groups
+	// names them. When nil, clients are not added to the groups they ask
+	// for.
+	AllowInitialGroup func(r *http.Request, principal interface{}, group string) bool
+
+	// GroupJoinAuthorizer decides whether a client may join a group it
+	// asks to join with RelayRConnection.join. principal is what the
+	// Authorizer returned. Groups are named in full, as Groups names
+	// them. Clients may leave any group with RelayRConnection.leave. When
+	// nil, clients can neither join nor leave groups themselves.
+	GroupJoinAuthorizer func(connectionID, group string, principal interface{}) bool
+
+	// MaxGroupNameLength is the longest name, in bytes, of a group clients
+	// may be added to, as Groups names it. Defaults to 128.
+	MaxGroupNameLength int
+
+	// ValidateGroupName, when set, decides whether clients may be added to
+	// a group, named in full, returning why not if they may not. It is
+	// only asked about names that are not empty, too long, reserved, or
+	// holding control characters, which are always refused. Adding a
+	// client to a group it refuses fails with a *GroupNameError, as do
+	// the joins of clients and the groups they ask for as they negotiate.
+	ValidateGroupName func(name string) error
+
+	// MaxConnectionValuesSize is the most bytes, counting keys and values,
+	// of the values a client may pass as it negotiates for relay methods
+	// to read with Relay.ConnectionValues. Negotiations passing more are
+	// refused with 413. Defaults to 4KB.
+	MaxConnectionValuesSize int
+
+	// JSONMarshal and JSONUnmarshal replace encoding/json for the frames
+	// exchanged with clients using the JSON codec and for negotiation, e.g.
+	// with jsoniter's or go-json's. Either may be left nil to keep
+	// encoding/json's. A replacement JSONUnmarshal must match field names
+	// ignoring case, as encoding/json does.
+	JSONMarshal   func(v interface{}) ([]byte, error)
+	JSONUnmarshal func(data []byte, v interface{}) error
+
+	// UseJSONNumber passes the numbers sent by JSON clients to relay
+	// method parameters of type interface{}, and within the maps and
+	// slices passed to them, as json.Number rather than float64, so that
+	// integers beyond 2^53 keep their precision. Parameters that are
+	// numbers or strings are passed them exactly either way, and numbers
+	// that do not fit them fail the call.
+	UseJSONNumber bool
+
+	// DisableHTMLEscape stops encoding/json escaping <, > and & in the
+	// strings sent to JSON clients, so that URLs arrive as they were
+	// sent rather than with \u0026 in place of &. It has no effect on a
+	// JSONMarshal.
+	DisableHTMLEscape bool
+
+	// Codecs lists the wire formats clients may negotiate in addition
+	// to JSON, which is always available (e.g. MessagePackCodec).
+	Codecs []Codec
+
+	// OnReconnect is called when a client that dropped its connection
+	// reconnects within the ReconnectGracePeriod and has its groups and
+	// state restored. OnNegotiate is not called for it again.
+	OnReconnect func(r *http.Request, connectionID string, state *ConnectionState)
+
+	// OnDisconnect is called after a client has disconnected and been
+	// removed from all of its groups. When reconnection is enabled this
+	// happens once the ReconnectGracePeriod has passed without the client
+	// coming back.
+	OnDisconnect func(connectionID string)
+
+	// OnDisconnectWithReason is called alongside OnDisconnect with the
+	// reason the client was forgotten: one of the Reason constants, such
+	// as ReasonIdle for evicted clients, or the reason given to
+	// Disconnect.
+	OnDisconnectWithReason func(connectionID, reason string)
+
+	// MaxConnections is the most clients the Exchange holds at once,
+	// counting those yet to connect and those waiting to reconnect.
+	// Further negotiations are refused with 503. Zero imposes no limit.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the most clients that may be connected from
+	// a single IP address, as seen in the request's RemoteAddr. Further
+	// negotiations from it are refused with 429. Zero imposes no limit.
+	MaxConnectionsPerIP int
+
+	// MaxConnectionsPerUser is the most clients that may be connected as
+	// a single user, identified as by UserIDProvider. Further
+	// negotiations as the user are refused with 429. Zero imposes no
+	// limit.
+	MaxConnectionsPerUser int
+
+	// IdleTimeout disconnects clients that have neither called the server
+	// nor been sent anything for this long. Keepalives and polls do not
+	// count. They are reported to OnDisconnectWithReason with ReasonIdle.
+	// Zero never evicts idle clients.
+	IdleTimeout time.Duration
+
+	// StaleConnectionTimeout disconnects clients that have not been heard
+	// from for this long, as ReapStale does, checking every quarter of
+	// it. Unlike the IdleTimeout, keep-alives and polls count, so only
+	// clients whose connection has gone quiet without closing are
+	// disconnected. Zero never reaps them.
+	StaleConnectionTimeout time.Duration
+
+	// DisableAutoJoinGlobal stops clients joining the Global group when
+	// they connect, so that a call to Global reaches only those added to
+	// it. Clients.All, AllExcept and Others reach every client either
+	// way, and clients in no group remain reachable by ConnectionID.
+	DisableAutoJoinGlobal bool
+
+	// NamespaceGroups puts the groups a relay uses in a namespace of its
+	// own, so that relays using the same group name do not share the
+	// group: through a relay named Chat, Groups("admins") is the group
+	// "Chat/admins". Groups marked with GlobalGroup, and Global, are
+	// shared. The Exchange's own group methods, such as Groups and
+	// GroupMembers, use the full names, which SplitGroupName takes apart.
+	NamespaceGroups bool
+
+	// EnableStats serves the Exchange's Stats as JSON from the "stats"
+	// operation, e.g. /relayr/stats.
+	EnableStats bool
+
+	// EnableHealthCheck serves the Exchange's Health as JSON from the
+	// "healthz" operation, e.g. /relayr/healthz, for load balancers to
+	// tell whether the instance should be given new connections: with 200
+	// when every check passes, and 503 otherwise.
+	EnableHealthCheck bool
+
+	// HealthQueueThreshold is the fraction of the MaxQueuedCalls that,
+	// waiting to run, fails the health check's "dispatcher" check.
+	// Defaults to 0.9; the check always passes without MaxQueuedCalls.
+	HealthQueueThreshold float64
+
+	// HealthMaxGoroutines, when set, fails the health check's
+	// "goroutines" check once the process runs more goroutines than it.
+	HealthMaxGoroutines int
+
+	// ServerInvokeSecret enables the "serverinvoke" operation, e.g.
+	// /relayr/serverinvoke, through which other services call client
+	// methods with a RemoteExchange. Its requests must carry the secret
+	// in the X-Relayr-Secret header.
+	ServerInvokeSecret string
+
+	// ConnectionTokenKeys, when set, has clients identified by signed
+	// connection tokens instead of bare ConnectionIDs, so that one cannot
+	// be forged. A negotiating client is given a token stating its
+	// ConnectionID, its user and when the token was issued and expires,
+	// signed with HMAC-SHA256, which it presents in place of its
+	// ConnectionID when it opens its websocket, polls and calls. Requests
+	// with a token that is tampered with or expired are refused with 401,
+	// and websockets closed, and the client negotiates afresh. Tokens are
+	// signed with the first key and verified against each, so a key is
+	// rotated by putting its replacement first and dropping it once the
+	// tokens it signed have expired.
+	ConnectionTokenKeys [][]byte
+
+	// ConnectionTokenTTL is how long a connection token is good for, 24
+	// hours by default. A client is issued another each time it
+	// negotiates; one that long-polls past its token's expiry has to
+	// negotiate a new connection.
+	ConnectionTokenTTL time.Duration
+
+	// DebugStats adds the Exchange's Connections to the stats served with
+	// EnableStats, as a ConnectionTable. It lists every client and its
+	// address, so it is meant for debugging rather than production.
+	DebugStats bool
+
+	// ConnectionErrorHistory is how many of each client's latest errors
+	// are kept, for its ConnectionInfo's RecentErrors. Defaults to 10; a
+	// negative value keeps none.
+	ConnectionErrorHistory int
+
+	// RedactError, when set, makes the message kept among a client's
+	// RecentErrors for an error, in place of the error's own, so that
+	// fragments of the frames it quotes are not kept.
+	RedactError func(err error) string
+
+	// AllowClientEcho lets websocket clients send calls to client methods
+	// of their own, which the Exchange echoes straight back to them. Such
+	// calls are rejected when false.
+	AllowClientEcho bool
+
+	// ClientTransports lists the transports the client script may use, in
+	// order of preference. It skips those the browser does not support.
+	// Defaults to "websocket" then "longpoll".
+	ClientTransports []string
+
+	// CheckOrigin validates the Origin header of websocket upgrades.
+	// When nil, only same-origin upgrades are accepted, and those from
+	// the origins allowed by AllowedOrigins and AllowOrigin.
+	CheckOrigin func(r *http.Request) bool
+
+	// AllowedOrigins lists the origins, e.g. "https://app.example.com",
+	// whose pages may use the Exchange from another origin: negotiate,
+	// poll and call with CORS, and open websockets when CheckOrigin is
+	// nil. "*" allows any origin. When it and AllowOrigin are both unset,
+	// no CORS headers are sent.
+	AllowedOrigins []string
+
+	// AllowOrigin decides whether an origin not in AllowedOrigins is
+	// allowed.
+	AllowOrigin func(origin string) bool
+
+	// AllowCredentials lets cross-origin requests carry cookies and HTTP
+	// authentication, and has the client script send them.
+	AllowCredentials bool
+
+	// Tracer traces negotiations, websocket upgrades, the calls clients
+	// make to relay methods and calls made to groups, continuing the
+	// traces of clients that send a traceparent with them. Calls a relay
+	// method makes to clients carry its trace to them. When nil, spans
+	// are not recorded, but traces are still carried through. Calls
+	// relayed through a Backplane do not carry traces.
+	Tracer Tracer
+
+	// IDGenerator returns the ConnectionIDs given to negotiating clients.
+	// By default they are 256 random bits, which cannot be guessed;
+	// relayrtest.SequentialIDs gives predictable ones for tests. IDs
+	// travel in query strings, so they must be URL-safe: letters, digits,
+	// '-', '.', '_' and '~' only. An ID that is in use is asked for again,
+	// a few times before the negotiation fails, as it does for one that
+	// is not URL-safe.
+	IDGenerator func() string
+
+	// CancelSchedulesOnDisconnect cancels the calls made with Schedule to
+	// a single client, through Client or Caller, when the client is
+	// forgotten: once the ReconnectGracePeriod has passed without it
+	// reconnecting. Otherwise they are made, and fail with
+	// ErrConnectionNotFound.
+	CancelSchedulesOnDisconnect bool
+
+	// InstanceID identifies this instance among those behind a load
+	// balancer, and is given to clients as they negotiate. The client
+	// script names it in every later request for the connection, and
+	// requests naming another instance are refused: long polls and calls
+	// with 409, and websockets with a close frame, upon which the client
+	// negotiates again. Each instance needs its own. It also identifies
+	// the instance to a Backplane. When empty, requests are not checked.
+	InstanceID string
+
+	// OnAffinity is called with the InstanceID as each negotiation is
+	// answered, to add what the load balancer routes by to the response,
+	// such as a cookie, so that the client's requests reach this instance.
+	OnAffinity func(w http.ResponseWriter, r *http.Request, instanceID string)
+
+	// IncludeSenderID names the client whose call to a relay method made
+	// a call to client methods in the call, with its user's ID, as a
+	// Sender, so that its group's members can tell their own messages
+	// from others'. Calls made other than from a relay method serving a
+	// client, such as through Exchange.Clients, carry none. The client
+	// script passes handlers a context of the sender, and of whether the
+	// call is an echo of the client's own, after the call's arguments.
+	IncludeSenderID bool
+
+	// LongPollUpgradeInterval is how long the client script, having fallen
+	// back on long-polling because its websocket would not open, waits
+	// before trying one again, doubling the wait after each try that fails
+	// up to 16 times as long. A websocket that opens takes the connection
+	// over from long-polling, with the messages the client had yet to poll
+	// for sent over it first, none lost or sent twice. Defaults to 30
+	// seconds; negative refuses upgrades.
+	LongPollUpgradeInterval time.Duration
+
+	// UploadBufferSize is how many chunks of an upload to an
+	// IncomingStream a client may send ahead of those the server method
+	// has read. The client waits for the method to read some before
+	// sending more. Defaults to 16.
+	UploadBufferSize int
+
+	// MaxUploadBytes is the most a client may upload to an IncomingStream,
+	// counted as the size of the messages carrying its chunks. An upload
+	// over it is cut short with ErrUploadTooLarge. Defaults to 16MB;
+	// negative for no limit.
+	MaxUploadBytes int64
+
+	// MaxUploadDuration is how long an upload to an IncomingStream may
+	// take, from the call that starts it. An upload that takes longer is
+	// cut short with ErrUploadTimedOut. Defaults to 10 minutes; negative
+	// for no limit.
+	MaxUploadDuration time.Duration
+
+	// KeepEmptyGroups keeps a group once its last member leaves, is
+	// removed or disconnects, rather than deleting it, so that Groups
+	// still lists it, as for rooms that outlive their occupants. Kept
+	// groups are deleted with ClearGroup.
+	KeepEmptyGroups bool
+
+	// AutoDetectOrigin builds the URLs in the client script from the
+	// scheme and host the script was requested at, rather than from the
+	// mainURL, so that the same Exchange can be served under several
+	// hostnames, such as in development and production. The script
+	// connects to its websocket over wss:// when served over https, and
+	// ws:// otherwise.
+	AutoDetectOrigin bool
+
+	// TrustForwardedHeaders has AutoDetectOrigin take the scheme and host
+	// from the X-Forwarded-Proto and X-Forwarded-Host headers, for an
+	// Exchange served behind a proxy that sets them. Set it only then, as
+	// clients can send them too.
+	TrustForwardedHeaders bool
+
+	// WebSocketURLOverride is the URL clients open websockets to the
+	// Exchange at, such as "wss://ws.example.com/relayr", in place of the
+	// one built from the mainURL or, with AutoDetectOrigin, the origin,
+	// for deployments that serve websockets from another host than the
+	// rest. An http:// or https:// URL is taken as ws:// or wss://.
+	WebSocketURLOverride string
+
+	// WebSocketProbeTimeout is how long the client script waits, once its
+	// websocket opens, for the handshake the server sends first over it.
+	// A websocket that opens but does not deliver it in time, as behind a
+	// proxy that lets the upgrade through and then corrupts or holds back
+	// the frames, is closed, and the client falls back on long-polling,
+	// trying a websocket again after the LongPollUpgradeInterval. Defaults
+	// to 5 seconds; negative for no probe.
+	WebSocketProbeTimeout time.Duration
+
+	// MaxWebhookWorkers is the most POSTs the webhooks added with
+	// SubscribeWebhook make at once, across every webhook. Defaults to
+	// 16.
+	MaxWebhookWorkers int
+
+	// BandwidthLimit throttles the frames sent to each client to this
+	// many bytes per second, measured before compression, over the
+	// built-in transports, so that one client on a fast link cannot use
+	// up the bandwidth others share. A client may be sent up to a second's
+	// worth at once. Frames sent faster wait in its queue, where the
+	// OverflowPolicy and coalescing deal with those that do not fit.
+	// Keep-alive pings and control frames are not throttled. Zero imposes
+	// no limit.
+	BandwidthLimit int
+
+	// TagBandwidthLimits overrides BandwidthLimit for clients with a tag,
+	// keyed by "key=value", as set by TagConnection. A client with several
+	// such tags is throttled to the lowest of their limits.
+	// Exchange.ThrottleConnection overrides both for a single client.
+	TagBandwidthLimits map[string]int
+}
+
+func (o ExchangeOptions) withDefaults() ExchangeOptions {
+	if o.KeepAliveTimeout <= 0 {
+		o.KeepAliveTimeout = defaultKeepAliveTimeout
+	}
+	if o.ConnectionTokenTTL <= 0 {
+		o.ConnectionTokenTTL = defaultTokenTTL
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = defaultWriteTimeout
+	}
+	if o.MaxMessageSize <= 0 {
+		o.MaxMessageSize = defaultMaxMessageSize
+	}
+	if o.MaxRequestBodySize <= 0 {
+		o.MaxRequestBodySize = defaultMaxRequestBody
+	}
+	if o.ReadBufferSize <= 0 {
+		o.ReadBufferSize = defaultBufferSize
+	}
+	if o.WriteBufferSize <= 0 {
+		o.WriteBufferSize = defaultBufferSize
+	}
+	if o.OutChannelSize <= 0 {
+		o.OutChannelSize = defaultOutChannelSize
+	}
+	if o.LongPollQueueSize <= 0 {
+		o.LongPollQueueSize = defaultLongPollQueue
+	}
+	if o.PriorityBurst <= 0 {
+		o.PriorityBurst = defaultPriorityBurst
+	}
+	if o.OverflowPolicy == 0 {
+		o.OverflowPolicy = DropNewest
+	}
+	if o.HighWaterMark <= 0 {
+		o.HighWaterMark = defaultHighWaterMark
+	}
+	if o.SlowConnectionDelay <= 0 {
+		o.SlowConnectionDelay = defaultSlowConnection
+	}
+	if o.SlowRoundTrip <= 0 {
+		o.SlowRoundTrip = defaultSlowRoundTrip
+	}
+	if o.LongPollRetention == 0 {
+		o.LongPollRetention = defaultLongPollRetention
+	}
+	if o.LongPollMaxWait <= 0 {
+		o.LongPollMaxWait = defaultLongPollMaxWait
+	}
+	if o.LongPollIdleTimeout <= 0 {
+		o.LongPollIdleTimeout = defaultLongPollIdle
+	}
+	if o.LongPollUpgradeInterval == 0 {
+		o.LongPollUpgradeInterval = defaultLongPollUpgrade
+	}
+	if o.UploadBufferSize <= 0 {
+		o.UploadBufferSize = defaultUploadBuffer
+	}
+	if o.MaxUploadBytes == 0 {
+		o.MaxUploadBytes = defaultMaxUploadBytes
+	}
+	if o.MaxUploadDuration == 0 {
+		o.MaxUploadDuration = defaultMaxUploadDuration
+	}
+	if o.CompressionThresholdBytes == 0 {
+		o.CompressionThresholdBytes = defaultCompressThreshold
+	}
+	if o.WebSocketProbeTimeout == 0 {
+		o.WebSocketProbeTimeout = defaultWebSocketProbe
+	}
+	if o.MaxWebhookWorkers <= 0 {
+		o.MaxWebhookWorkers = defaultWebhookWorkers
+	}
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = defaultConnectTimeout
+	}
+	if o.ReconnectGracePeriod == 0 {
+		o.ReconnectGracePeriod = defaultReconnectGrace
+	}
+	if o.PresenceGracePeriod == 0 {
+		o.PresenceGracePeriod = defaultPresenceGrace
+	}
+	if o.MaxConnectionValuesSize <= 0 {
+		o.MaxConnectionValuesSize = defaultConnectionValues
+	}
+	if o.MaxRetainedBytes <= 0 {
+		o.MaxRetainedBytes = defaultMaxRetainedBytes
+	}
+	if o.MaxStateBytes <= 0 {
+		o.MaxStateBytes = defaultMaxRetainedBytes
+	}
+	if o.MaxCallWorkers <= 0 {
+		o.MaxCallWorkers = defaultMaxCallWorkers
+	}
+	if o.ClientCallTimeout <= 0 {
+		o.ClientCallTimeout = defaultClientCallTimeout
+	}
+	if o.DuplicateCallWindow == 0 {
+		o.DuplicateCallWindow = defaultDuplicateWindow
+	}
+	if o.DuplicateCallTTL <= 0 {
+		o.DuplicateCallTTL = defaultDuplicateTTL
+	}
+	if o.ConnectionErrorHistory == 0 {
+		o.ConnectionErrorHistory = defaultErrorHistory
+	}
+	if o.HealthQueueThreshold <= 0 {
+		o.HealthQueueThreshold = defaultHealthQueue
+	}
+	if len(o.ClientTransports) == 0 {
+		o.ClientTransports = []string{"websocket", "longpoll"}
+	}
+	if o.Logger == nil {
+		level := LevelError
+		if o.Verbosity > 0 {
+			level = LevelDebug
+		}
+		o.Logger = NewStdLogger(nil, level)
+	}
+	if o.Tracer == nil {
+		o.Tracer = noopTracer{}
+	}
+	if o.MaxGroupNameLength <= 0 {
+		o.MaxGroupNameLength = defaultMaxGroupName
+	}
+	if o.IDGenerator == nil {
+		o.IDGenerator = generateConnectionID
+	}
+
+	return o
+}
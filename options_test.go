@@ -0,0 +1,49 @@
+package relayr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepAliveTimeoutDropsUnresponsiveClient(t *testing.T) {
+	gone := make(chan string, 2)
+	e, srv := serve(t, ExchangeOptions{
+		KeepAliveTimeout:     200 * time.Millisecond,
+		ReconnectGracePeriod: -1,
+		OnDisconnectWithReason: func(id, reason string) {
+			gone <- id + " " + reason
+		},
+	})
+
+	// the socket is never read, so its pings are never answered
+	_, silentID := openWebSocket(t, srv)
+
+	// this one reads, answering its pings as it does
+	answering, answeringID := openWebSocket(t, srv)
+	go func() {
+		for {
+			if _, _, err := answering.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case got := <-gone:
+		if want := silentID + " " + ReasonPongTimeout; got != want {
+			t.Fatalf("forgot %q, want %q", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("a client that never answered pings was not dropped")
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	select {
+	case got := <-gone:
+		t.Fatalf("forgot %q, which answered its pings", got)
+	default:
+	}
+	if e.getClientByConnectionID(answeringID) == nil {
+		t.Fatal("a client that answered its pings is not connected")
+	}
+}
@@ -0,0 +1,76 @@
+package relayr
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxCachedScripts bounds the client scripts cached with AutoDetectOrigin,
+// one for each origin they are served at, as any Host may be asked for.
+// Scripts for origins beyond it are generated for each request.
+const maxCachedScripts = 64
+
+// scriptURLs returns the URLs the client script served for r connects to:
+// route, at which the Exchange is served, and baseURL, route without its
+// scheme. mount is the path the Exchange is served under, as mountFor
+// returns it. They are built
+// from the mainURL, or with AutoDetectOrigin from the origin r was made
+// to, so that the script served under each hostname connects back to it.
+func (e *Exchange) scriptURLs(r *http.Request, mount string) (baseURL, route string) {
+	if !e.options.AutoDetectOrigin {
+		return e.mainURLWithoutScheme + mount, e.mainURL + mount
+	}
+	host := r.Host
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if e.options.TrustForwardedHeaders {
+		if h := forwardedValue(r, "X-Forwarded-Host"); h != "" {
+			host = h
+		}
+		if p := strings.ToLower(forwardedValue(r, "X-Forwarded-Proto")); p == "http" || p == "https" {
+			scheme = p
+		}
+	}
+	return host + mount, scheme + "://" + host + mount
+}
+
+// webSocketURL returns the URL clients of the Exchange served at route
+// open websockets at, less the "/ws" operation: the WebSocketURLOverride
+// if set, and otherwise route over wss:// if it is https, or ws:// if
+// http. It is empty for a route without a scheme, which the client script
+// resolves against the page it is on.
+func (e *Exchange) webSocketURL(route string) string {
+	if o := strings.TrimSuffix(e.options.WebSocketURLOverride, "/"); o != "" {
+		route = o
+	}
+	switch {
+	case strings.HasPrefix(route, "ws://"), strings.HasPrefix(route, "wss://"):
+		return route
+	case strings.HasPrefix(route, "https://"):
+		return "wss://" + strings.TrimPrefix(route, "https://")
+	case strings.HasPrefix(route, "http://"):
+		return "ws://" + strings.TrimPrefix(route, "http://")
+	}
+	return ""
+}
+
+// webSocketURLFor returns the URL the client negotiating with r, with the
+// Exchange served under mount, opens websockets at, from the origin r was
+// made to with AutoDetectOrigin, so that it holds behind a proxy that
+// rewrites the Host.
+func (e *Exchange) webSocketURLFor(r *http.Request, mount string) string {
+	_, route := e.scriptURLs(r, mount)
+	return e.webSocketURL(route)
+}
+
+// forwardedValue returns the first value of a header a proxy set, which
+// names what the client asked for of the first proxy on its way.
+func forwardedValue(r *http.Request, name string) string {
+	v := r.Header.Get(name)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
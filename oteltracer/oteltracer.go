@@ -0,0 +1,74 @@
+// Package oteltracer adapts an OpenTelemetry tracer to the relayr Tracer
+// interface, so that an Exchange's spans join the traces of the rest of
+// an application.
+package oteltracer
+
+import (
+	"context"
+
+	"github.com/simon-whitehead/relayr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceParentHeader = "traceparent"
+
+// Tracer is a relayr.Tracer starting its spans with an OpenTelemetry
+// tracer.
+type Tracer struct {
+	tracer trace.Tracer
+	prop   propagation.TraceContext
+}
+
+// New returns a Tracer starting its spans with tracer, e.g.
+// otel.Tracer("relayr").
+func New(tracer trace.Tracer) *Tracer {
+	return &Tracer{tracer: tracer}
+}
+
+// StartSpan starts a span as a child of the span the W3C traceparent
+// parent identifies.
+func (t *Tracer) StartSpan(name, parent string) relayr.Span {
+	ctx := context.Background()
+	if parent != "" {
+		ctx = t.prop.Extract(ctx, propagation.MapCarrier{traceParentHeader: parent})
+	}
+	ctx, span := t.tracer.Start(ctx, name)
+	return &Span{ctx: ctx, span: span, prop: t.prop}
+}
+
+// Span is a relayr.Span wrapping an OpenTelemetry span.
+type Span struct {
+	ctx  context.Context
+	span trace.Span
+	prop propagation.TraceContext
+}
+
+// SetAttribute records a string attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// TraceParent returns the span's W3C traceparent.
+func (s *Span) TraceParent() string {
+	carrier := propagation.MapCarrier{}
+	s.prop.Inject(s.ctx, carrier)
+	return carrier[traceParentHeader]
+}
+
+// Context returns parent carrying the span.
+func (s *Span) Context(parent context.Context) context.Context {
+	return trace.ContextWithSpan(parent, s.span)
+}
+
+// End ends the span, recording err and setting its status to Error if err
+// is not nil.
+func (s *Span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
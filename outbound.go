@@ -0,0 +1,89 @@
+package relayr
+
+// OutgoingMessage describes a call to a client method that is about to be
+// sent to a client, as seen by an OutboundInterceptor.
+type OutgoingMessage struct {
+	RelayName    string
+	Method       string
+	Args         []interface{}
+	ConnectionID string // the client the message is sent to
+	Group        string // the group it was sent to, if any
+	Transport    string // the client's transport, "websocket" or "longpoll"
+}
+
+// An OutboundInterceptor sees every call to a client method before it is
+// sent, once for each client it is sent to. It may alter the message's
+// Method and Args, and must call next for the message to be sent; the
+// message is dropped if it does not. Binary payloads sent with SendBinary
+// are passed as a single []byte argument, and control frames sent with
+// SendControl with an empty RelayName, their kind as the Method and their
+// payload as the one argument.
+type OutboundInterceptor func(msg *OutgoingMessage, next func())
+
+// UseOutboundInterceptor adds an OutboundInterceptor to the Exchange.
+// Outbound interceptors run in the order they were added, the first
+// outermost.
+func (e *Exchange) UseOutboundInterceptor(i OutboundInterceptor) {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+	e.outboundInterceptors = append(e.outboundInterceptors, i)
+}
+
+// interceptOutgoing runs a message for the client with the given
+// ConnectionID through the Exchange's outbound interceptors. It returns
+// the method and arguments to send, and false if the message was dropped.
+// Messages are passed straight through, without allocating, when there
+// are no interceptors.
+func (e *Exchange) interceptOutgoing(relay *Relay, cid, transport, fn string, args []interface{}) (string, []interface{}, bool) {
+	e.mapLock.RLock()
+	chain := e.outboundInterceptors
+	e.mapLock.RUnlock()
+
+	if len(chain) == 0 {
+		return fn, args, true
+	}
+
+	msg := &OutgoingMessage{
+		RelayName:    relay.Name,
+		Method:       fn,
+		Args:         args,
+		ConnectionID: cid,
+		Group:        relay.group,
+		Transport:    transport,
+	}
+
+	sent := false
+	var run func(i int)
+	run = func(i int) {
+		if i == len(chain) {
+			sent = true
+			return
+		}
+		chain[i](msg, func() {
+			run(i + 1)
+		})
+	}
+	run(0)
+
+	return msg.Method, msg.Args, sent
+}
+
+// transportName returns the name a built-in transport is registered
+// under.
+func (e *Exchange) transportName(t Transport) string {
+	if _, ok := t.(*webhookTransport); ok {
+		return "webhook"
+	}
+	if _, ok := t.(*localTransport); ok {
+		return localTransportName
+	}
+	if _, ok := t.(*hubTransport); ok {
+		return hubTransportName
+	}
+	for name, registered := range e.transports {
+		if registered == t {
+			return name
+		}
+	}
+	return ""
+}
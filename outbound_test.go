@@ -0,0 +1,34 @@
+package relayr
+
+import "testing"
+
+// BenchmarkInterceptOutgoing runs a call to a client through no outbound
+// interceptors, which must cost next to nothing, and through one and
+// three that pass it on.
+func BenchmarkInterceptOutgoing(b *testing.B) {
+	relay := &Relay{Name: "Chat", group: "room"}
+	args := []interface{}{"alice", "hello"}
+	for _, tt := range []struct {
+		name         string
+		interceptors int
+	}{
+		{"none", 0},
+		{"one", 1},
+		{"three", 3},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			e := newExchange(b, "http://localhost/relayr", ExchangeOptions{})
+			for i := 0; i < tt.interceptors; i++ {
+				e.UseOutboundInterceptor(func(msg *OutgoingMessage, next func()) { next() })
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, ok := e.interceptOutgoing(relay, "cid", "websocket", "said", args); !ok {
+					b.Fatal("the call was dropped")
+				}
+			}
+		})
+	}
+}
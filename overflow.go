@@ -0,0 +1,118 @@
+package relayr
+
+import (
+	"time"
+)
+
+// OverflowPolicy says what happens to a call made to a client whose send
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the call. It is the default.
+	DropNewest OverflowPolicy = iota + 1
+
+	// DropOldest drops the oldest frame still waiting to be sent to make
+	// room for the call, for updates that supersede each other.
+	DropOldest
+
+	// Disconnect drops the call and closes the client's connection. The
+	// client reconnects as it would after any dropped connection, within
+	// the ReconnectGracePeriod, having missed what was dropped.
+	Disconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop newest"
+	case DropOldest:
+		return "drop oldest"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "default"
+}
+
+// overflowPolicy returns the policy for calls made to a group, or to a
+// single client when group is empty.
+func (e *Exchange) overflowPolicy(group string) OverflowPolicy {
+	o := e.runtime()
+	if p, ok := o.GroupOverflowPolicies[group]; ok && group != "" {
+		return p
+	}
+	return o.OverflowPolicy
+}
+
+// resolve returns p, or the Exchange's OverflowPolicy when p is unset.
+func (p OverflowPolicy) resolve(e *Exchange) OverflowPolicy {
+	if p == 0 {
+		return e.runtime().OverflowPolicy
+	}
+	return p
+}
+
+// queueStats describes a connection's send queue, and its round trip.
+type queueStats struct {
+	frames  int           // frames waiting to be sent
+	bytes   int           // their size
+	peak    int           // the most frames that have been waiting at once
+	expired uint64        // frames that expired before they were sent
+	rtt     time.Duration // the round trip of the last ping, over websockets
+	// when the last ping was sent and pong received, in unix nanoseconds,
+	// over websockets; 0 until then
+	lastPing, lastPong int64
+}
+
+// queueReporter is implemented by the built-in transports, which can
+// describe a connection's send queue.
+type queueReporter interface {
+	queueStats(connectionID string) (queueStats, bool)
+}
+
+// queueWatch follows the depth of a connection's send queue, for
+// OnConnectionSlow and the peak reported by ConnectionInfo. It is guarded
+// by the lock of the queue it watches.
+type queueWatch struct {
+	peak     int
+	above    time.Time // when the queue went over the high-water mark; zero if it is not
+	reported bool      // OnConnectionSlow has been called since
+}
+
+// observe records the depth of a queue of the given capacity once a frame
+// has been queued on it. It reports whether OnConnectionSlow is due: the
+// queue has now been over the HighWaterMark for the SlowConnectionDelay;
+// and whether the queue has recovered, falling back under the mark after
+// it was.
+func (w *queueWatch) observe(o *ExchangeOptions, depth, capacity int) (slow, recovered bool) {
+	if depth > w.peak {
+		w.peak = depth
+	}
+	if float64(depth) < o.HighWaterMark*float64(capacity) {
+		recovered = w.reported
+		w.above = time.Time{}
+		w.reported = false
+		return false, recovered
+	}
+
+	now := time.Now()
+	if w.above.IsZero() {
+		w.above = now
+	}
+	if w.reported || now.Sub(w.above) < o.SlowConnectionDelay {
+		return false, false
+	}
+	w.reported = true
+	return true, false
+}
+
+// connectionSlow reports a connection whose queue has stayed over the
+// high-water mark to the OnConnectionSlow hook, on its own goroutine so
+// that the hook can call the Exchange.
+func (e *Exchange) connectionSlow(cid string, queuedBytes int) {
+	e.counters.slow.Add(1)
+	e.logger.Infof("connection %s has had %d bytes queued for over %v", cid, queuedBytes, e.options.SlowConnectionDelay)
+	if e.options.OnConnectionSlow != nil {
+		go e.options.OnConnectionSlow(cid, queuedBytes)
+	}
+}
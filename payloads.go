@@ -0,0 +1,202 @@
+package relayr
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// PayloadSchema describes how the client script revives a value a client
+// method is passed, as DescribeClientMethod describes it.
+type PayloadSchema = protocol.PayloadSchema
+
+// The types of PayloadSchemas.
+const (
+	payloadDate   = "date"
+	payloadObject = "object"
+	payloadArray  = "array"
+	payloadMap    = "map"
+	payloadAny    = "any"
+)
+
+// DescribeClientMethod describes the arguments the client method fn of
+// the named relay is called with, given a value of each in turn, so that
+// the client script revives them before the method's handlers see them:
+// the strings time.Time values are sent as become Dates, and the fields
+// set in a struct value are defaults, given to the objects received that
+// lack them or have them null. Structs are described through their fields
+// as encoding/json names them, nested structs, pointers, slices, arrays
+// and maps of them included; the items of slices and arrays and the values
+// of maps are described by their type alone, with no defaults, and a type
+// nested in itself is described down to where it recurs. Types that
+// marshal themselves, and arguments given as nil, are passed as they are
+// received, as are the arguments of the methods not described.
+//
+// Describing a method again replaces its description, and describing it
+// with no arguments removes it. The client script is regenerated, and
+// connected clients are sent the new descriptions, as they are when relays
+// are registered.
+func (e *Exchange) DescribeClientMethod(relay, fn string, args ...interface{}) {
+	var described []*PayloadSchema
+	for _, a := range args {
+		var d *PayloadSchema
+		if a != nil {
+			d = describePayload(reflect.TypeOf(a), reflect.ValueOf(a), map[reflect.Type]bool{})
+		}
+		described = append(described, d)
+	}
+
+	e.relayLock.Lock()
+	defer e.relayLock.Unlock()
+	old := e.clientArgs.Load()
+	all := make(map[string]map[string][]*PayloadSchema)
+	if old != nil {
+		for r, methods := range *old {
+			all[r] = methods
+		}
+	}
+	methods := make(map[string][]*PayloadSchema, len(all[relay])+1)
+	for m, d := range all[relay] {
+		methods[m] = d
+	}
+	if len(args) > 0 {
+		methods[fn] = described
+	} else {
+		delete(methods, fn)
+	}
+	all[relay] = methods
+	e.clientArgs.Store(&all)
+	e.invalidateScriptCache()
+	e.relaysChanged()
+}
+
+// describedClientArgs returns the descriptions of the named relay's client
+// methods, by method name, or nil if there are none.
+func (e *Exchange) describedClientArgs(relay string) map[string][]*PayloadSchema {
+	all := e.clientArgs.Load()
+	if all == nil || len((*all)[relay]) == 0 {
+		return nil
+	}
+	return (*all)[relay]
+}
+
+// describePayload describes a value of type t, with v, when valid, the
+// value whose set fields are defaults, or returns nil if the client script
+// has nothing to do to revive it. seen holds the struct types being
+// described, so that recursive types end.
+func describePayload(t reflect.Type, v reflect.Value, seen map[reflect.Type]bool) *PayloadSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		if v.IsValid() && !v.IsNil() {
+			v = v.Elem()
+		} else {
+			v = reflect.Value{}
+		}
+	}
+	if t == timeType {
+		return &PayloadSchema{Type: payloadDate}
+	}
+	if p := reflect.PtrTo(t); t.Implements(jsonMarshalerType) || p.Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || p.Implements(textMarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if items := describePayload(t.Elem(), reflect.Value{}, seen); items != nil {
+			return &PayloadSchema{Type: payloadArray, Items: items}
+		}
+	case reflect.Map:
+		if items := describePayload(t.Elem(), reflect.Value{}, seen); items != nil && t.Key().Kind() == reflect.String {
+			return &PayloadSchema{Type: payloadMap, Items: items}
+		}
+	case reflect.Struct:
+		if seen[t] {
+			return nil
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		if !v.IsValid() {
+			v = reflect.Zero(t)
+		}
+		if fields := describeFields(v, seen); len(fields) > 0 {
+			return &PayloadSchema{Type: payloadObject, Fields: fields}
+		}
+	}
+	return nil
+}
+
+// describeFields describes the fields of the struct value v that need
+// reviving, by the names encoding/json gives them, the fields of embedded
+// structs among them, with those v sets as their defaults.
+func describeFields(v reflect.Value, seen map[reflect.Type]bool) map[string]*PayloadSchema {
+	fields := make(map[string]*PayloadSchema)
+	promoted := make(map[string]*PayloadSchema)
+	named := make(map[string]bool)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(","+opts+",", ",string,") {
+			continue
+		}
+
+		fv := v.Field(i)
+		if f.Anonymous && name == "" {
+			if !f.IsExported() && f.Type.Kind() == reflect.Ptr {
+				continue
+			}
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+				if fv.IsNil() {
+					fv = reflect.Zero(ft)
+				} else {
+					fv = fv.Elem()
+				}
+			}
+			if ft.Kind() == reflect.Struct && !seen[ft] {
+				seen[ft] = true
+				for n, d := range describeFields(fv, seen) {
+					promoted[n] = d
+				}
+				delete(seen, ft)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		named[name] = true
+
+		d := describePayload(f.Type, fv, seen)
+		if fv.CanInterface() && !fv.IsZero() {
+			if b, err := json.Marshal(fv.Interface()); err == nil {
+				if d == nil {
+					d = &PayloadSchema{Type: payloadAny}
+				}
+				d.Default = b
+			}
+		}
+		if d != nil {
+			fields[name] = d
+		}
+	}
+	// the fields of embedded structs are promoted, unless the struct names
+	// them itself
+	for n, d := range promoted {
+		if !named[n] {
+			fields[n] = d
+		}
+	}
+	return fields
+}
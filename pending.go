@@ -0,0 +1,69 @@
+package relayr
+
+import (
+	"time"
+)
+
+// pendingClient is a client that has negotiated but not yet connected.
+type pendingClient struct {
+	expiry *time.Timer
+}
+
+// awaitConnection gives a client that has just negotiated the
+// ConnectTimeout to open its websocket or make its first long poll,
+// after which it is forgotten.
+func (e *Exchange) awaitConnection(cid string) {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	if p, ok := e.pending[cid]; ok {
+		p.expiry.Stop()
+	}
+	p := &pendingClient{}
+	p.expiry = time.AfterFunc(e.options.ConnectTimeout, func() {
+		e.expirePending(cid, p)
+	})
+	e.pending[cid] = p
+}
+
+// connectionEstablished records that a negotiated client has connected,
+// reporting false if it had already done so since it last negotiated.
+func (e *Exchange) connectionEstablished(cid string) bool {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	p, ok := e.pending[cid]
+	if ok {
+		p.expiry.Stop()
+		delete(e.pending, cid)
+	}
+	return ok
+}
+
+// expirePending forgets a client that negotiated but never connected.
+func (e *Exchange) expirePending(cid string, p *pendingClient) {
+	e.mapLock.Lock()
+	if e.pending[cid] != p {
+		e.mapLock.Unlock()
+		return
+	}
+	delete(e.pending, cid)
+	e.mapLock.Unlock()
+
+	e.logger.Debugf("client %s negotiated but never connected", cid)
+	e.transports["longpoll"].(*longPollTransport).removeConnection(cid)
+	e.transports["websocket"].(*webSocketTransport).forgetEarly(cid)
+	e.forgetClient(cid, ReasonNeverConnected)
+}
+
+// stopPending cancels the timers of clients that have yet to connect. It
+// is called when the Exchange closes.
+func (e *Exchange) stopPending() {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	for cid, p := range e.pending {
+		p.expiry.Stop()
+		delete(e.pending, cid)
+	}
+}
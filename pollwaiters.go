@@ -0,0 +1,72 @@
+package relayr
+
+import "sync"
+
+// pollWaiter is a poll request waiting in longPollTransport.wait for
+// something to send.
+type pollWaiter struct {
+	cancel chan struct{} // closed to answer the poll with ReasonShutdown
+	done   chan struct{} // closed once the poll has been answered
+}
+
+// pollWaiters keeps the polls waiting on a long-poll transport, so that
+// they can be answered at once when the Exchange shuts down.
+type pollWaiters struct {
+	lock    sync.Mutex
+	waiting map[*pollWaiter]struct{}
+	closed  bool // the Exchange closed; polls are answered as they start waiting
+}
+
+// add registers a poll that is about to wait. Once the Exchange has closed
+// its cancel channel is closed already.
+func (p *pollWaiters) add() *pollWaiter {
+	w := &pollWaiter{cancel: make(chan struct{}), done: make(chan struct{})}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		close(w.cancel)
+		return w
+	}
+	if p.waiting == nil {
+		p.waiting = make(map[*pollWaiter]struct{})
+	}
+	p.waiting[w] = struct{}{}
+	return w
+}
+
+// remove forgets a poll once it has been answered.
+func (p *pollWaiters) remove(w *pollWaiter) {
+	p.lock.Lock()
+	delete(p.waiting, w)
+	p.lock.Unlock()
+	close(w.done)
+}
+
+// cancelAll answers the polls waiting with ReasonShutdown, and those that
+// wait later too when closing, returning once they have been answered.
+func (p *pollWaiters) cancelAll(closing bool) {
+	p.lock.Lock()
+	p.closed = p.closed || closing
+	waiters := make([]*pollWaiter, 0, len(p.waiting))
+	for w := range p.waiting {
+		waiters = append(waiters, w)
+		close(w.cancel)
+	}
+	p.waiting = nil
+	p.lock.Unlock()
+
+	for _, w := range waiters {
+		<-w.done
+	}
+}
+
+// CancelWaiters answers every long poll waiting on the Exchange at once
+// with a DISCONNECTED control frame giving ReasonShutdown, rather than
+// leaving it blocked until the LongPollMaxWait, and disconnects the
+// clients that made them. It returns once the polls have been answered.
+// Drain calls it for the clients that did not move in time, and Close for
+// every poll; polls made afterwards wait as usual until the Exchange
+// closes.
+func (e *Exchange) CancelWaiters() {
+	e.transports["longpoll"].(*longPollTransport).waiters.cancelAll(false)
+}
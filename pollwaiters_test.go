@@ -0,0 +1,116 @@
+package relayr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// startPolls negotiates n long-polling clients and has each poll, in the
+// background, waiting for something to be sent. It returns the clients
+// and a channel receiving the answer to each poll, once every poll waits.
+func startPolls(t *testing.T, e *Exchange, srv *httptest.Server, n int) ([]string, <-chan pollResult) {
+	t.Helper()
+	answers := make(chan pollResult, n)
+	cids := make([]string, n)
+	for i := range cids {
+		cid := negotiate(t, srv, "longpoll").ConnectionID
+		cids[i] = cid
+		go func() {
+			var res pollResult
+			resp, err := http.Get(srv.URL + "/relayr/longpoll?connectionId=" + cid + "&seq=0")
+			if err == nil {
+				json.NewDecoder(resp.Body).Decode(&res)
+				resp.Body.Close()
+			}
+			answers <- res
+		}()
+	}
+	waitWaiting(t, e, n)
+	return cids, answers
+}
+
+// waitWaiting waits until n polls are waiting on the Exchange.
+func waitWaiting(t *testing.T, e *Exchange, n int) {
+	t.Helper()
+	waiters := &e.transports["longpoll"].(*longPollTransport).waiters
+	for deadline := time.Now().Add(testTimeout); ; time.Sleep(time.Millisecond) {
+		waiters.lock.Lock()
+		waiting := len(waiters.waiting)
+		waiters.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d polls are waiting, want %d", waiting, n)
+		}
+	}
+}
+
+// checkShutDown checks that n polls are answered straight away with a
+// DISCONNECTED frame giving ReasonShutdown.
+func checkShutDown(t *testing.T, answers <-chan pollResult, n int) {
+	t.Helper()
+	deadline := time.After(500 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		select {
+		case res := <-answers:
+			if res.Type != protocol.TypeControl || res.Command != protocol.CommandDisconnected || res.Reason != ReasonShutdown {
+				t.Fatalf("a waiting poll was answered %+v", res)
+			}
+		case <-deadline:
+			t.Fatalf("%d of %d waiting polls were not answered at once", n-i, n)
+		}
+	}
+}
+
+func TestCloseAnswersWaitingPolls(t *testing.T) {
+	const polls = 5
+	e, srv := serve(t, ExchangeOptions{LongPollMaxWait: time.Minute})
+	_, answers := startPolls(t, e, srv, polls)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := e.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkShutDown(t, answers, polls)
+
+	// with no poll left waiting, the server shuts down promptly
+	start := time.Now()
+	if err := srv.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("shutting the server down: %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("shutting the server down took %v", took)
+	}
+}
+
+func TestCancelWaiters(t *testing.T) {
+	const polls = 3
+	e, srv := serve(t, ExchangeOptions{LongPollMaxWait: time.Minute})
+	cids, answers := startPolls(t, e, srv, polls)
+
+	e.CancelWaiters()
+	checkShutDown(t, answers, polls)
+	for _, cid := range cids {
+		if _, ok := e.ConnectionInfo(cid); ok {
+			t.Fatalf("client %s is still connected once its poll was cancelled", cid)
+		}
+	}
+
+	// polls made afterwards wait as usual
+	_, answers = startPolls(t, e, srv, 1)
+	select {
+	case res := <-answers:
+		t.Fatalf("a poll made after CancelWaiters was answered %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+	e.CancelWaiters()
+	checkShutDown(t, answers, 1)
+}
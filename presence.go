@@ -0,0 +1,313 @@
+package relayr
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// presenceRelay is the relay presence notifications are sent to clients
+// under, as calls to its joined and left methods.
+const presenceRelay = "__relayrPresence"
+
+const (
+	presenceJoined = "joined"
+	presenceLeft   = "left"
+)
+
+// PresenceEntry describes a user, or a connection without a user ID,
+// present in a group.
+type PresenceEntry struct {
+	Group        string
+	UserID       string `json:",omitempty"` // set when the client's principal has a user ID
+	ConnectionID string // the connection that joined or left; in Presence, the user's first one in the group
+}
+
+// presenceTracker follows who is present in each group, and queues the
+// notifications sent when that changes. A user with several connections
+// in a group is present while any of them is, and one whose last
+// connection leaves stays present for the PresenceGracePeriod, so that a
+// client that reconnects straight away is neither reported leaving nor
+// joining. It has its own lock, which is always acquired after the
+// mapLock and the groups' locks.
+type presenceTracker struct {
+	lock   sync.Mutex
+	groups map[string]*presentGroup
+	queue  []presenceEvent
+	signal chan struct{} // signalled when events are queued
+}
+
+type presentGroup struct {
+	byKey  map[string]*present // by presenceKey
+	byConn map[string]*present // by ConnectionID
+}
+
+// present is a user, or a connection without a user ID, in a group.
+type present struct {
+	key     string
+	userID  string
+	since   time.Time
+	conns   []string    // the connections in the group, in the order they joined
+	last    string      // the last connection to leave
+	leaving *time.Timer // set once the last connection has left, until the grace period is over
+}
+
+// presenceEvent is a notification queued for the members of a group. Users
+// that joined or left together are sent in one notification, each entry
+// an argument of the call.
+type presenceEvent struct {
+	method  string
+	group   string
+	entries []PresenceEntry
+	except  []string // the connections that joined, which are not told of themselves
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		groups: make(map[string]*presentGroup),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// presenceKey identifies the user of a connection, or the connection
+// itself when it has no user ID.
+func presenceKey(cid, userID string) string {
+	if userID != "" {
+		return "u:" + userID
+	}
+	return "c:" + cid
+}
+
+// EnablePresence has the Exchange track who is present in each group
+// other than Global, which Presence reports. Members of a group are sent
+// a "joined" notification when a user's first connection joins it and a
+// "left" one when its last connection leaves, once the
+// PresenceGracePeriod is over, through RelayRConnection.presence in the
+// client script. Clients already in groups when it is called are not
+// tracked, so it should be called before the Exchange serves requests.
+// Presence covers the clients connected to this Exchange only.
+func (e *Exchange) EnablePresence() {
+	if !e.track() {
+		return
+	}
+	p := newPresenceTracker()
+	if !e.presence.CompareAndSwap(nil, p) {
+		e.wg.Done()
+		return
+	}
+	go e.notifyPresence(p)
+}
+
+// Presence returns who is present in a group, in the order they joined,
+// or nil when presence is not enabled. With NamespaceGroups the group is
+// named in full, as Groups names it.
+func (e *Exchange) Presence(group string) []PresenceEntry {
+	p := e.presence.Load()
+	if p == nil {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	g := p.groups[group]
+	if g == nil {
+		return []PresenceEntry{}
+	}
+	users := make([]*present, 0, len(g.byKey))
+	for _, u := range g.byKey {
+		if u.leaving == nil {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].since.Before(users[j].since) })
+
+	r := make([]PresenceEntry, len(users))
+	for i, u := range users {
+		r[i] = PresenceEntry{Group: group, UserID: u.userID, ConnectionID: u.conns[0]}
+	}
+	return r
+}
+
+// presenceJoined records that a client joined a group.
+func (e *Exchange) presenceJoined(c *client, group string) {
+	if p := e.presence.Load(); p != nil {
+		p.joined(c.ConnectionID, c.userID, group)
+	}
+}
+
+// presenceLeft records that a client left a group.
+func (e *Exchange) presenceLeft(id, group string) {
+	if p := e.presence.Load(); p != nil {
+		p.left(id, group, e.options.PresenceGracePeriod)
+	}
+}
+
+// presenceJoinedMany records that clients joined a group together, of
+// whom the members are told in one notification.
+func (e *Exchange) presenceJoinedMany(cs []*client, group string) {
+	p := e.presence.Load()
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ev := presenceEvent{method: presenceJoined, group: group}
+	for _, c := range cs {
+		if entry, ok := p.joinedLocked(c.ConnectionID, c.userID, group); ok {
+			ev.entries = append(ev.entries, entry)
+		}
+		ev.except = append(ev.except, c.ConnectionID)
+	}
+	if len(ev.entries) > 0 {
+		p.queueLocked(ev)
+	}
+}
+
+// presenceLeftMany records that clients were removed from a group
+// together, of whom the members are told in one notification. Having been
+// removed rather than lost their connections, those leaving are not given
+// the PresenceGracePeriod.
+func (e *Exchange) presenceLeftMany(ids []string, group string) {
+	p := e.presence.Load()
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ev := presenceEvent{method: presenceLeft, group: group}
+	for _, id := range ids {
+		if entry, ok := p.leftLocked(id, group, -1); ok {
+			ev.entries = append(ev.entries, entry)
+		}
+	}
+	if len(ev.entries) > 0 {
+		p.queueLocked(ev)
+	}
+}
+
+func (p *presenceTracker) joined(cid, userID, group string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if entry, ok := p.joinedLocked(cid, userID, group); ok {
+		p.queueLocked(presenceEvent{method: presenceJoined, group: group, entries: []PresenceEntry{entry}, except: []string{cid}})
+	}
+}
+
+// joinedLocked records that a client joined a group, returning the entry
+// to tell the group's members of if its user was not present before. The
+// caller must hold p.lock.
+func (p *presenceTracker) joinedLocked(cid, userID, group string) (PresenceEntry, bool) {
+	g := p.groups[group]
+	if g == nil {
+		g = &presentGroup{byKey: make(map[string]*present), byConn: make(map[string]*present)}
+		p.groups[group] = g
+	}
+	key := presenceKey(cid, userID)
+	u := g.byKey[key]
+	joined := false
+	switch {
+	case u == nil:
+		u = &present{key: key, userID: userID, since: time.Now()}
+		g.byKey[key] = u
+		joined = true
+	case u.leaving != nil:
+		// back within the grace period; nobody was told it left
+		u.leaving.Stop()
+		u.leaving = nil
+	}
+	u.conns = append(u.conns, cid)
+	g.byConn[cid] = u
+	return PresenceEntry{group, userID, cid}, joined
+}
+
+func (p *presenceTracker) left(cid, group string, grace time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if entry, ok := p.leftLocked(cid, group, grace); ok {
+		p.queueLocked(presenceEvent{method: presenceLeft, group: group, entries: []PresenceEntry{entry}})
+	}
+}
+
+// leftLocked records that a client left a group, returning the entry to
+// tell the group's members of if its user is no longer present. A user
+// whose last connection left is told of once the grace period is over,
+// unless it is negative. The caller must hold p.lock.
+func (p *presenceTracker) leftLocked(cid, group string, grace time.Duration) (PresenceEntry, bool) {
+	g := p.groups[group]
+	if g == nil || g.byConn[cid] == nil {
+		return PresenceEntry{}, false
+	}
+	u := g.byConn[cid]
+	delete(g.byConn, cid)
+	u.conns = removeString(u.conns, cid)
+	if len(u.conns) > 0 {
+		return PresenceEntry{}, false
+	}
+
+	u.last = cid
+	if grace < 0 {
+		return p.goneLocked(group, g, u), true
+	}
+	u.leaving = time.AfterFunc(grace, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if p.groups[group] == g && g.byKey[u.key] == u && u.leaving != nil {
+			entry := p.goneLocked(group, g, u)
+			p.queueLocked(presenceEvent{method: presenceLeft, group: group, entries: []PresenceEntry{entry}})
+		}
+	})
+	return PresenceEntry{}, false
+}
+
+// goneLocked forgets a user that has left a group, returning the entry to
+// tell the group's members of. The caller must hold p.lock.
+func (p *presenceTracker) goneLocked(group string, g *presentGroup, u *present) PresenceEntry {
+	delete(g.byKey, u.key)
+	if len(g.byKey) == 0 {
+		delete(p.groups, group)
+	}
+	return PresenceEntry{group, u.userID, u.last}
+}
+
+// queueLocked queues a notification. The caller must hold p.lock.
+func (p *presenceTracker) queueLocked(ev presenceEvent) {
+	p.queue = append(p.queue, ev)
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// notifyPresence sends the queued presence notifications in order until
+// the Exchange is closed. They are sent from their own goroutine, as
+// membership changes while the mapLock is held.
+func (e *Exchange) notifyPresence(p *presenceTracker) {
+	defer e.wg.Done()
+
+	relay := &Relay{Name: presenceRelay, exchange: e}
+	for {
+		select {
+		case <-p.signal:
+		case <-e.done:
+			return
+		}
+
+		p.lock.Lock()
+		queue := p.queue
+		p.queue = nil
+		p.lock.Unlock()
+
+		for _, ev := range queue {
+			args := make([]interface{}, len(ev.entries))
+			for i, entry := range ev.entries {
+				args[i] = entry
+			}
+			if _, err := e.deliverToGroup(context.Background(), relay, ev.group, ev.except, ev.method, args...); err != nil {
+				e.logger.Debugf("sending presence to '%s': %v", ev.group, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package relayr
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	rclient "github.com/simon-whitehead/relayr/client"
+)
+
+// presenceNote is a presence notification as a client receives it.
+type presenceNote struct {
+	method  string
+	entries []PresenceEntry
+}
+
+// presenceNotes returns a channel receiving the presence notifications
+// sent to c, joins and leaves alike, in the order they arrive.
+func presenceNotes(t *testing.T, c *rclient.Client) <-chan presenceNote {
+	ch := make(chan presenceNote, 64)
+	for _, method := range []string{presenceJoined, presenceLeft} {
+		method := method
+		c.On(presenceRelay, method, func(args []json.RawMessage) {
+			n := presenceNote{method: method}
+			for _, a := range args {
+				var entry PresenceEntry
+				if err := json.Unmarshal(a, &entry); err != nil {
+					t.Errorf("decoding %s: %v", a, err)
+				}
+				n.entries = append(n.entries, entry)
+			}
+			ch <- n
+		})
+	}
+	return ch
+}
+
+// checkNote checks that the next notification ch receives is of method,
+// for the entries given.
+func checkNote(t *testing.T, ch <-chan presenceNote, method string, entries ...PresenceEntry) {
+	t.Helper()
+	select {
+	case n := <-ch:
+		if n.method != method || !reflect.DeepEqual(n.entries, entries) {
+			t.Fatalf("notified %s %+v, want %s %+v", n.method, n.entries, method, entries)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no %s notification arrived", method)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{Authorizer: byUser, PresenceGracePeriod: 100 * time.Millisecond}, Notifications{})
+	e.EnablePresence()
+	as := func(transport, user string) *rclient.Client {
+		return dialWith(t, srv, rclient.Options{Transport: transport, Header: http.Header{"X-User": {user}}})
+	}
+	bob := as("websocket", "bob")
+	notes := presenceNotes(t, bob)
+	if err := e.AddToGroup("room", bob.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice joins twice, in two tabs, and is announced once
+	alice := as("longpoll", "alice")
+	if err := e.AddToGroup("room", alice.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	joined := PresenceEntry{Group: "room", UserID: "alice", ConnectionID: alice.ConnectionID()}
+	checkNote(t, notes, presenceJoined, joined)
+	tab := as("websocket", "alice")
+	if err := e.AddToGroup("room", tab.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	want := []PresenceEntry{
+		{Group: "room", UserID: "bob", ConnectionID: bob.ConnectionID()},
+		joined,
+	}
+	if got := e.Presence("room"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Presence is %+v, want %+v", got, want)
+	}
+
+	// the first tab leaving leaves alice present through the other
+	if err := e.RemoveFromGroup("room", alice.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	want[1].ConnectionID = tab.ConnectionID()
+	if got := e.Presence("room"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("with one tab left Presence is %+v, want %+v", got, want)
+	}
+
+	// the last tab leaving announces alice leaving once the grace is over
+	start := time.Now()
+	if err := e.RemoveFromGroup("room", tab.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	checkNote(t, notes, presenceLeft, PresenceEntry{Group: "room", UserID: "alice", ConnectionID: tab.ConnectionID()})
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("alice was announced leaving after %v, within the grace period", waited)
+	}
+	if got := e.Presence("room"); !reflect.DeepEqual(got, want[:1]) {
+		t.Fatalf("once alice left Presence is %+v, want %+v", got, want[:1])
+	}
+
+	if got := e.Presence("nobody"); got == nil || len(got) != 0 {
+		t.Fatalf("Presence of a group without members is %#v, want it empty", got)
+	}
+}
+
+func TestPresenceReconnect(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{Authorizer: byUser, ReconnectGracePeriod: -1, PresenceGracePeriod: 500 * time.Millisecond}, Notifications{})
+	e.EnablePresence()
+	events := e.SubscribeEvents(0)
+	defer events.Unsubscribe()
+	as := func(user string) *rclient.Client {
+		return dialWith(t, srv, rclient.Options{Transport: "websocket", Header: http.Header{"X-User": {user}}})
+	}
+	bob := as("bob")
+	notes := presenceNotes(t, bob)
+	alice := as("alice")
+	for _, c := range []*rclient.Client{bob, alice} {
+		if err := e.AddToGroup("room", c.ConnectionID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkNote(t, notes, presenceJoined, PresenceEntry{Group: "room", UserID: "alice", ConnectionID: alice.ConnectionID()})
+
+	// alice's connection drops and alice is back in the room at once
+	if err := e.Disconnect(alice.ConnectionID(), "testing"); err != nil {
+		t.Fatal(err)
+	}
+	for ev := nextEvent(t, events); ev.Type != EventGroupLeft || ev.ConnectionID != alice.ConnectionID(); ev = nextEvent(t, events) {
+	}
+	again := as("alice")
+	if err := e.AddToGroup("room", again.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// past the grace period, the next notification bob receives is carol
+	// joining: alice was not reported leaving or joining again
+	time.Sleep(600 * time.Millisecond)
+	carol := as("carol")
+	if err := e.AddToGroup("room", carol.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	checkNote(t, notes, presenceJoined, PresenceEntry{Group: "room", UserID: "carol", ConnectionID: carol.ConnectionID()})
+	want := []PresenceEntry{
+		{Group: "room", UserID: "bob", ConnectionID: bob.ConnectionID()},
+		{Group: "room", UserID: "alice", ConnectionID: again.ConnectionID()},
+		{Group: "room", UserID: "carol", ConnectionID: carol.ConnectionID()},
+	}
+	if got := e.Presence("room"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Presence is %+v, want %+v", got, want)
+	}
+}
+
+func TestPresenceDisabled(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Notifications{})
+	c := dial(t, srv, "websocket")
+	if err := e.AddToGroup("room", c.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Presence("room"); got != nil {
+		t.Fatalf("without EnablePresence Presence is %+v, want nil", got)
+	}
+}
@@ -0,0 +1,167 @@
+package relayr
+
+import (
+	"errors"
+	"sort"
+)
+
+// maxPreviewIDs bounds the ConnectionIDs a TargetPreview lists; the rest
+// are only counted.
+const maxPreviewIDs = 1000
+
+// ErrGroupNotFound is returned by ClientTarget.Validate for a group that
+// does not exist.
+var ErrGroupNotFound = errors.New("relayr: group not found")
+
+var errEmptyTagKey = errors.New("relayr: WithTag needs a key")
+
+// TargetPreview describes the clients connected to an Exchange that a
+// call to a target would be made to, as returned by ResolveTarget.
+type TargetPreview struct {
+	// ConnectionIDs are those of the clients, sorted, up to the first
+	// thousand.
+	ConnectionIDs []string
+
+	// Count is the number of clients, which may be more than are listed.
+	Count int
+
+	// Transports are the number of the clients connected over each
+	// transport, by name.
+	Transports map[string]int
+
+	// Bytes is the size of the frames the call would be sent to the
+	// clients in, before any compression, summed over them.
+	Bytes int
+
+	// Offline reports that the target is a user with no clients
+	// connected, for whom the call would be saved with the OfflineStore.
+	Offline bool
+}
+
+// ResolveTarget returns the clients connected to the Exchange that a call
+// to fn with args made to target, a *ClientTarget or a *GroupOperations,
+// would be made to, without making it, so that the reach of a call can be
+// checked first. The clients are selected as Call selects them, so the
+// preview holds as long as clients do not come, go, or join and leave
+// groups in the meantime, but the OutboundInterceptors, which may drop a
+// call or change it, are not run, and clients connected to other
+// instances through a Backplane are not included. Targets of other types
+// select no clients.
+func (e *Exchange) ResolveTarget(target CallTarget, fn string, args ...interface{}) TargetPreview {
+	var t *ClientTarget
+	switch x := target.(type) {
+	case *ClientTarget:
+		t = x
+	case *GroupOperations:
+		t = &ClientTarget{ops: x.relay.Clients, group: x.group}
+	default:
+		return TargetPreview{Transports: map[string]int{}}
+	}
+
+	p := TargetPreview{ConnectionIDs: []string{}, Transports: map[string]int{}}
+	clients, _ := t.clients()
+	if len(clients) == 0 && t.user != "" && e.options.OfflineStore != nil {
+		p.Offline = true
+	}
+	relay := t.ops.relay
+	enc := &callEncoder{call: clientInvocation{Relay: relay.Name, Method: fn, Arguments: wireArgs(args), Sender: relay.sender}}
+	for _, c := range clients {
+		if containsString(t.except, c.ConnectionID) {
+			continue
+		}
+		p.Count++
+		p.ConnectionIDs = append(p.ConnectionIDs, c.ConnectionID)
+		p.Transports[e.transportName(c.transport())]++
+		codec := c.codec
+		if codec == nil {
+			codec = e.json
+		}
+		if frame, err := enc.encode(codec, c.protocol); err == nil {
+			p.Bytes += len(frame)
+		}
+	}
+	sort.Strings(p.ConnectionIDs)
+	if len(p.ConnectionIDs) > maxPreviewIDs {
+		p.ConnectionIDs = p.ConnectionIDs[:maxPreviewIDs]
+	}
+	return p
+}
+
+// clients returns the clients connected to the Exchange that the target
+// selects, those it skips with Except among them, as Call selects them.
+func (t *ClientTarget) clients() ([]*client, error) {
+	e, relay := t.ops.e, t.ops.relay
+	var ids []string
+	switch {
+	case t.caller:
+		if relay.ConnectionID != "" {
+			ids = []string{relay.ConnectionID}
+		}
+	case t.connectionID != "":
+		ids = []string{t.connectionID}
+	case t.all:
+		e.mapLock.RLock()
+		defer e.mapLock.RUnlock()
+		return e.clientsLocked(), nil
+	case t.user != "":
+		ids = e.UserConnections(t.user)
+	case t.pattern != "":
+		return e.membersOfGroupsMatching(t.pattern)
+	case t.callerGroups:
+		if relay.ConnectionID == "" {
+			return nil, nil
+		}
+		members, _ := e.membersOfCallerGroups(relay.ConnectionID)
+		return members, nil
+	case t.tagged || t.where != nil:
+		ids = t.ids()
+	default:
+		e.mapLock.RLock()
+		g := e.groups[t.group]
+		e.mapLock.RUnlock()
+		if g == nil {
+			return nil, nil
+		}
+		return g.clients(), nil
+	}
+
+	r := make([]*client, 0, len(ids))
+	for _, id := range ids {
+		if c := e.getClientByConnectionID(id); c != nil {
+			r = append(r, c)
+		}
+	}
+	return r, nil
+}
+
+// Validate returns an error if calls to the target would go astray for a
+// reason known before they are made: ErrGroupNotFound for a Group that
+// does not exist on this Exchange, the error Call returns for a malformed
+// GroupsMatching pattern, or one for a WithTag with no key. It does not
+// check that the target selects any clients; ResolveTarget tells which it
+// does.
+func (t *ClientTarget) Validate() error {
+	switch {
+	case t.caller, t.connectionID != "", t.all, t.user != "", t.callerGroups:
+		return nil
+	case t.pattern != "":
+		_, err := groupMatcher(t.pattern)
+		return err
+	case t.tagged:
+		if t.tagKey == "" {
+			return errEmptyTagKey
+		}
+		return nil
+	case t.where != nil:
+		return nil
+	}
+
+	e := t.ops.e
+	e.mapLock.RLock()
+	_, ok := e.groups[t.group]
+	e.mapLock.RUnlock()
+	if !ok {
+		return ErrGroupNotFound
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package relayr
+
+import "time"
+
+// Priority orders the calls waiting to be sent to a client, so that
+// critical ones, such as a payment confirmation, are not held up behind a
+// storm of routine ones. Calls of each Priority wait in a lane of their
+// own, and are sent from the highest lane with calls waiting, except that
+// a lane passed over PriorityBurst times in a row goes next. Calls of the
+// same Priority reach a client in the order they were made, but a call
+// may overtake calls of a lower Priority made before it. The control and
+// ping frames the Exchange sends its clients are High.
+type Priority int
+
+// The Priorities a call may be made with.
+const (
+	Low    Priority = -1
+	Normal Priority = 0
+	High   Priority = 1
+)
+
+// CallOptions are the options of a call made with CallWithOptions.
+type CallOptions struct {
+	// Priority is the lane the call waits in to be sent to each client.
+	Priority Priority
+}
+
+// CallWithOptions is Call with the given options. Calls to groups with a
+// Priority other than Normal are encoded for each member rather than once
+// for every member speaking the same codec, and calls relayed through a
+// Backplane are Normal on other instances.
+func (t *ClientTarget) CallWithOptions(opts CallOptions, fn string, args ...interface{}) error {
+	relay := *t.ops.relay
+	relay.priority = opts.Priority
+	n := *t
+	n.ops = &ClientOperations{e: t.ops.e, relay: &relay}
+	return n.Call(fn, args...)
+}
+
+// laneSize returns the length of the High and Low lanes of a websocket
+// whose Normal lane, out, is n long.
+func laneSize(n int) int {
+	if n < 16 {
+		return n
+	}
+	if n/8 < 16 {
+		return 16
+	}
+	return n / 8
+}
+
+// lane returns the lane a frame waits in.
+func (c *connection) lane(frame outFrame) chan outFrame {
+	switch {
+	case frame.urgent || frame.priority > Normal:
+		return c.high
+	case frame.priority < Normal:
+		return c.low
+	}
+	return c.out
+}
+
+// pending returns the number of frames waiting in the connection's lanes.
+func (c *connection) pending() int {
+	return len(c.high) + len(c.out) + len(c.low)
+}
+
+// next takes the frame to write next off the connection's lanes: the
+// oldest High one, else the oldest Normal one, else the oldest Low one,
+// except that a lane passed over PriorityBurst times in a row while it had
+// frames waiting goes first. If none is waiting it waits for one when
+// block is set, until wait fires, reporting whether it got one. closed
+// reports that out was closed. It is only called from the write loop.
+func (c *connection) next(block bool, wait <-chan time.Time) (message outFrame, got, closed bool) {
+	lanes := [...]chan outFrame{c.high, c.out, c.low}
+	for i := len(lanes) - 1; i > 0; i-- {
+		if c.passed[i] >= c.e.options.PriorityBurst && len(lanes[i]) > 0 {
+			message, ok := <-lanes[i]
+			return c.took(i, message, ok)
+		}
+	}
+	for i := range lanes {
+		select {
+		case message, ok := <-lanes[i]:
+			return c.took(i, message, ok)
+		default:
+		}
+	}
+	if !block {
+		return outFrame{}, false, false
+	}
+
+	select {
+	case message := <-c.high:
+		return c.took(0, message, true)
+	case message, ok := <-c.out:
+		return c.took(1, message, ok)
+	case message := <-c.low:
+		return c.took(2, message, true)
+	case <-wait:
+		return outFrame{}, false, false
+	}
+}
+
+// took records that a frame was taken off a lane, passing over the lower
+// lanes with frames waiting.
+func (c *connection) took(lane int, message outFrame, ok bool) (outFrame, bool, bool) {
+	if !ok {
+		return message, false, true
+	}
+	lanes := [...]chan outFrame{c.high, c.out, c.low}
+	c.passed[lane] = 0
+	for i := lane + 1; i < len(lanes); i++ {
+		if len(lanes[i]) > 0 {
+			c.passed[i]++
+		}
+	}
+	return message, true, false
+}
+
+// queuedFrame is where a frame waits in a long-polling client's queue.
+type queuedFrame struct {
+	priority Priority
+	passed   int // the frames of a higher Priority placed ahead of it since it was queued
+}
+
+// placeLocked returns where in a long-polling client's queue a frame of
+// the given Priority goes: after the frames of the same or a higher one
+// that have not been sent, and after any it may not pass, as they have
+// been passed over PriorityBurst times. The frames it passes are counted
+// as passed over once more. The caller must hold c.lock.
+func (c *longPollConnection) placeLocked(priority Priority, burst int) int {
+	i := len(c.queue)
+	for sent := c.sentLocked(); i > sent; i-- {
+		q := c.lanes[i-1]
+		if q.priority >= priority || q.passed >= burst {
+			break
+		}
+	}
+	for j := i; j < len(c.lanes); j++ {
+		c.lanes[j].passed++
+	}
+	return i
+}
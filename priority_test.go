@@ -0,0 +1,127 @@
+package relayr
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// callWith calls tick on the client with the given ConnectionID with the
+// Priority, passing label.
+func callWith(t *testing.T, e *Exchange, cid string, p Priority, label string) {
+	t.Helper()
+	if err := e.Clients(Ticker{}).Client(cid).CallWithOptions(CallOptions{Priority: p}, "tick", label); err != nil {
+		t.Fatalf("calling with %s: %v", label, err)
+	}
+}
+
+// labels returns what each of the ticks in frames was passed.
+func labels(t *testing.T, frames []json.RawMessage) []string {
+	t.Helper()
+	var got []string
+	for _, f := range frames {
+		var c clientInvocation
+		if err := json.Unmarshal(f, &c); err != nil {
+			t.Fatalf("decoding %s: %v", f, err)
+		}
+		got = append(got, c.Arguments[0].(string))
+	}
+	return got
+}
+
+func TestLongPollPriority(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		burst int
+		calls []string // each a Priority, h, n or l, and a number
+		want  []string
+	}{
+		{"High first", 0,
+			[]string{"n1", "n2", "l1", "h1", "n3", "h2"},
+			[]string{"h1", "h2", "n1", "n2", "n3", "l1"}},
+		{"starvation", 2,
+			[]string{"n1", "n2", "n3", "h1", "h2", "h3", "h4"},
+			[]string{"h1", "h2", "n1", "n2", "n3", "h3", "h4"}},
+		{"Low waits", 2,
+			[]string{"l1", "n1", "n2", "n3", "l2"},
+			[]string{"n1", "n2", "l1", "n3", "l2"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, srv := serve(t, ExchangeOptions{LongPollMaxWait: 10 * time.Millisecond, PriorityBurst: tt.burst}, Ticker{})
+			cid := negotiate(t, srv, "longpoll").ConnectionID
+			seq := poll(t, srv, cid, 0).Seq
+			for _, call := range tt.calls {
+				p := map[byte]Priority{'h': High, 'n': Normal, 'l': Low}[call[0]]
+				callWith(t, e, cid, p, call)
+			}
+			got := labels(t, poll(t, srv, cid, seq).Messages)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("polled %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketLanes(t *testing.T) {
+	c := &connection{
+		e:    &Exchange{options: ExchangeOptions{PriorityBurst: 2}},
+		high: make(chan outFrame, 8),
+		out:  make(chan outFrame, 8),
+		low:  make(chan outFrame, 8),
+	}
+	for _, f := range []struct {
+		lane  chan outFrame
+		label string
+	}{
+		{c.out, "n1"}, {c.out, "n2"}, {c.out, "n3"},
+		{c.low, "l1"},
+		{c.high, "h1"}, {c.high, "h2"}, {c.high, "h3"}, {c.high, "h4"}, {c.high, "h5"},
+	} {
+		f.lane <- outFrame{data: []byte(f.label)}
+	}
+
+	var got []string
+	for {
+		message, ok, _ := c.next(false, nil)
+		if !ok {
+			break
+		}
+		got = append(got, string(message.data))
+	}
+	// each lower lane goes once it has been passed over twice, the lowest
+	// first when both have
+	want := "h1 h2 l1 n1 h3 h4 n2 h5 n3"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("wrote %q, want %q", got, want)
+	}
+}
+
+// TestHighPriorityLatency floods a throttled websocket client with Normal
+// calls, so that many seconds' worth wait in its queue, and checks that a
+// High call made behind them arrives within a frame or two.
+func TestHighPriorityLatency(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	ws, cid := openWebSocket(t, srv)
+	e.ThrottleConnection(cid, 10000)
+	filler := strings.Repeat("x", 500)
+	for i := 0; i < 500; i++ {
+		callWith(t, e, cid, Normal, filler)
+	}
+
+	start := time.Now()
+	callWith(t, e, cid, High, "urgent")
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		_, m, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("the High call did not arrive")
+		}
+		if strings.Contains(string(m), "urgent") {
+			break
+		}
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Fatalf("a High call took %v behind 25 seconds' worth of Normal ones", took)
+	}
+}
@@ -0,0 +1,85 @@
+package relayr
+
+import (
+	"context"
+	"reflect"
+)
+
+// progressKeyPrefix begins the coalescing keys of progress frames, which
+// the keys of client calls cannot clash with.
+const progressKeyPrefix = "\x00progress."
+
+var progressType = reflect.TypeOf((*Progress)(nil)).Elem()
+
+// Progress reports how far a long-running relay method has got to the
+// client that called it, which the client script passes to the handler
+// given to the onProgress of the call's promise, so that its user sees
+// the call moving rather than retrying it. A method reports its progress
+// by taking one after its *Relay and any context.Context and
+// IncomingStream, as
+//
+//	func (r Reports) Build(relay *relayr.Relay, progress relayr.Progress, year int) (Report, error)
+//
+// Progress is sent Low, and only the latest of the reports made before
+// the client could be sent the first is sent, so reporting often costs
+// little. Reports made once the method has returned, or its client has
+// gone or cancelled the call, are dropped, as are those of calls made
+// without an InvocationID, such as those ServeCall and hubs make. The
+// call's result or error still comes with its completion.
+type Progress interface {
+	// Report reports that the method is percent done, from 0 to 100,
+	// with a note saying what it is doing, which may be empty.
+	Report(percent float64, note string)
+}
+
+// progress reports the progress of a client's call to the client.
+type progress struct {
+	e            *Exchange
+	ctx          context.Context // the call's, done once it has returned
+	cid          string
+	invocationID string
+}
+
+// noProgress is the Progress of calls whose progress goes nowhere.
+type noProgress struct{}
+
+func (noProgress) Report(percent float64, note string) {}
+
+// progressFor returns the Progress of a client's call made with the given
+// InvocationID, or nil if its progress cannot be reported: the client
+// speaks protocol version 0, or its transport cannot carry progress.
+func (e *Exchange) progressFor(ctx context.Context, cid, invocationID string) Progress {
+	if invocationID == "" {
+		return nil
+	}
+	c := e.getClientByConnectionID(cid)
+	if c == nil || c.protocol < 1 {
+		return nil
+	}
+	if _, ok := c.transport().(progressSender); !ok {
+		return nil
+	}
+	return &progress{e: e, ctx: ctx, cid: cid, invocationID: invocationID}
+}
+
+func (p *progress) Report(percent float64, note string) {
+	if p.ctx.Err() != nil {
+		return
+	}
+	c := p.e.getClientByConnectionID(p.cid)
+	if c == nil {
+		return
+	}
+	s, ok := c.transport().(progressSender)
+	if !ok {
+		return
+	}
+	frame, err := p.e.encodeFrameFor(p.cid, &progressFrame{InvocationID: p.invocationID, Percent: percent, Note: note})
+	if err != nil {
+		p.e.logger.Errorf("encoding progress for %s: %v", p.cid, err)
+		return
+	}
+	if err := s.sendProgress(p.cid, frame, progressKeyPrefix+p.invocationID); err != nil {
+		p.e.logger.Debugf("sending progress to %s: %v", p.cid, err)
+	}
+}
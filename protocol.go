@@ -0,0 +1,151 @@
+package relayr
+
+import "github.com/simon-whitehead/relayr/protocol"
+
+// protocolVersion is the newest version of the wire protocol, whose
+// frames are defined by the protocol package.
+const protocolVersion = protocol.Version
+
+// batchVersion is the first protocol version whose clients accept
+// batched frames.
+const batchVersion = protocol.BatchVersion
+
+// Frame types, sent in T.
+const (
+	frameClientInvocation = protocol.TypeClientInvocation
+	frameServerInvocation = protocol.TypeServerInvocation
+	frameCompletion       = protocol.TypeCompletion
+	frameError            = protocol.TypeError
+	framePing             = protocol.TypePing
+	frameBinary           = protocol.TypeBinary
+	frameStreamItem       = protocol.TypeStreamItem
+	frameControl          = protocol.TypeControl
+	frameHandshake        = protocol.TypeHandshake
+	frameJoinGroup        = protocol.TypeJoinGroup
+	frameLeaveGroup       = protocol.TypeLeaveGroup
+	frameState            = protocol.TypeState
+	frameUploadChunk      = protocol.TypeUploadChunk
+	frameUploadCredit     = protocol.TypeUploadCredit
+	frameAppControl       = protocol.TypeAppControl
+	frameProgress         = protocol.TypeProgress
+)
+
+// frame is implemented by the frames sent to clients.
+type frame interface {
+	// setType sets T for a client speaking the given protocol version.
+	setType(version int)
+}
+
+// frameType returns t for clients speaking version 1 or later. Version 0
+// clients are sent no T.
+func frameType(version int, t string) string {
+	if version < 1 {
+		return ""
+	}
+	return t
+}
+
+// negotiatedVersion returns the protocol version used with a client that
+// asked for v.
+func negotiatedVersion(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > protocolVersion {
+		return protocolVersion
+	}
+	return v
+}
+
+// The frames and bodies sent to and read from clients. Each is defined
+// by its counterpart in the protocol package, so that the wire format has
+// the one definition, shared with the transports and clients written
+// against that package.
+type (
+	clientInvocation    protocol.ClientInvocation
+	completion          protocol.Completion
+	errorFrame          protocol.ErrorFrame
+	pingFrame           protocol.Ping
+	binaryCall          protocol.BinaryCall
+	streamItem          protocol.StreamItem
+	controlFrame        protocol.Control
+	handshake           protocol.Handshake
+	stateFrame          protocol.State
+	uploadCredit        protocol.UploadCredit
+	inboundFrame        protocol.Inbound
+	negotiation         protocol.Negotiation
+	negotiationResponse protocol.NegotiationResponse
+	longPollBatch       protocol.LongPollBatch
+	callReceipt         protocol.CallReceipt
+	errorResponse       protocol.ErrorResponse
+	appControl          protocol.AppControl
+	progressFrame       protocol.Progress
+)
+
+// patchOp is an operation of an RFC 6902 JSON Patch, sent in a
+// stateFrame.
+type patchOp = protocol.PatchOp
+
+func (f *handshake) setType(v int)        { f.Type = frameType(v, frameHandshake) }
+func (f *clientInvocation) setType(v int) { f.Type = frameType(v, frameClientInvocation) }
+func (f *completion) setType(v int)       { f.Type = frameType(v, frameCompletion) }
+func (f *errorFrame) setType(v int)       { f.Type = frameType(v, frameError) }
+func (f *pingFrame) setType(v int)        { f.Type = frameType(v, framePing) }
+func (f *binaryCall) setType(v int)       { f.Type = frameType(v, frameBinary) }
+func (f *controlFrame) setType(v int)     { f.Type = frameType(v, frameControl) }
+func (f *streamItem) setType(v int)       { f.Type = frameType(v, frameStreamItem) }
+func (f *stateFrame) setType(v int)       { f.Type = frameType(v, frameState) }
+func (f *uploadCredit) setType(v int)     { f.Type = frameType(v, frameUploadCredit) }
+func (f *appControl) setType(v int)       { f.Type = frameType(v, frameAppControl) }
+func (f *progressFrame) setType(v int)    { f.Type = frameType(v, frameProgress) }
+
+// encodeFrame encodes f with codec for a client speaking the given
+// protocol version.
+func encodeFrame(codec Codec, version int, f frame) ([]byte, error) {
+	f.setType(version)
+	return codec.Marshal(f)
+}
+
+// encodeFrameFor encodes f in the codec and protocol version negotiated by
+// the client with the given ConnectionID.
+func (e *Exchange) encodeFrameFor(cid string, f frame) ([]byte, error) {
+	codec, version := e.protocolFor(cid)
+	return encodeFrame(codec, version, f)
+}
+
+// protocolFor returns the codec and protocol version negotiated by the
+// client with the given ConnectionID.
+func (e *Exchange) protocolFor(cid string) (Codec, int) {
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return e.json, 0
+	}
+	codec := c.codec
+	if codec == nil {
+		codec = e.json
+	}
+	return codec, c.protocol
+}
+
+// numberUnmarshaler is implemented by the codecs that can decode numbers
+// into interface{} values as json.Number, as frames are decoded so that
+// no argument loses precision.
+type numberUnmarshaler interface {
+	unmarshalNumbers(data []byte, v interface{}) error
+}
+
+// decodeFrame decodes a frame sent by a client speaking the given protocol
+// version, resolving its Type as protocol.Inbound.Resolve does.
+func decodeFrame(codec Codec, version int, data []byte) (inboundFrame, error) {
+	var f inboundFrame
+	var err error
+	if nc, ok := codec.(numberUnmarshaler); ok {
+		err = nc.unmarshalNumbers(data, &f)
+	} else {
+		err = codec.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return f, err
+	}
+	return f, (*protocol.Inbound)(&f).Resolve(version)
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrUntyped is returned by Inbound.Resolve for a frame of version 1 or
+// later that has no T.
+var ErrUntyped = errors.New("protocol: frame has no type")
+
+// Resolve sets the Type of a frame sent by a client speaking the given
+// version, as the server reads it. Version 0 frames, which are untyped,
+// are server invocations when S is set and client invocations otherwise,
+// whatever T they carry. Later frames must carry one of the types clients
+// send.
+func (f *Inbound) Resolve(version int) error {
+	if version < 1 {
+		f.Type = TypeClientInvocation
+		if f.Server {
+			f.Type = TypeServerInvocation
+		}
+		return nil
+	}
+
+	switch f.Type {
+	case TypeClientInvocation, TypeServerInvocation, TypePing, TypeJoinGroup, TypeLeaveGroup, TypeUploadChunk:
+		return nil
+	case "":
+		return ErrUntyped
+	}
+	return fmt.Errorf("protocol: unknown frame type %q", f.Type)
+}
+
+// Split returns the frames of a websocket message in a text codec, which
+// holds several as an array when the server batches its writes to a
+// client of BatchVersion or later, and one on its own otherwise.
+func Split(message []byte) []json.RawMessage {
+	message = bytes.TrimSpace(message)
+	if len(message) > 0 && message[0] == '[' {
+		var frames []json.RawMessage
+		if json.Unmarshal(message, &frames) == nil {
+			return frames
+		}
+	}
+	return []json.RawMessage{message}
+}
@@ -0,0 +1,358 @@
+// Package protocol defines the messages relayr's clients and servers
+// exchange: the frames sent over websockets and long polls, and the
+// bodies of the HTTP requests and responses around them. The relayr
+// package sends and reads exactly these types, so that transports and
+// native clients written elsewhere can depend on the same definitions
+// rather than copies of them.
+//
+// The field names in the json tags, and the order of the fields, which
+// is the order they are encoded in, are part of the wire format; neither
+// is changed without a new Version.
+package protocol
+
+import "encoding/json"
+
+// Version is the newest version of the wire protocol. Clients send the
+// version they speak when they negotiate and are answered with the older
+// of theirs and this one, which both sides then use.
+//
+// From version 1 every frame names its type in T. Version 0 frames are
+// untyped: a frame sent by a client invokes a server method when S is set
+// and a client method otherwise, and clients tell the server's frames
+// apart by the fields they carry. Clients that negotiate without a
+// version, as scripts generated by older releases do, speak version 0.
+//
+// From version 2 a websocket message in a text codec may carry several
+// frames as an array, when the server batches its writes.
+const Version = 2
+
+// BatchVersion is the first protocol version whose clients accept
+// batched frames.
+const BatchVersion = 2
+
+// Frame types, sent in T.
+const (
+	TypeClientInvocation = "c" // invokes a client method
+	TypeServerInvocation = "s" // invokes a server method
+	TypeCompletion       = "r" // the outcome of a server method invoked with an InvocationID
+	TypeError            = "e" // an error in a frame with no invocation to report it against
+	TypePing             = "p" // a keepalive, sent over websockets along with their pings; the server answers a client's ping with one of its own
+	TypeBinary           = "b" // a binary payload, over transports that cannot send binary messages
+	TypeStreamItem       = "i" // an item of a server method's streaming result, ahead of its completion
+	TypeControl          = "z" // tells a long-polling client to renegotiate, or that it was disconnected
+	TypeHandshake        = "h" // the first frame over a websocket, describing the server
+	TypeJoinGroup        = "j" // asks for the client to be added to a group
+	TypeLeaveGroup       = "l" // asks for the client to be removed from a group
+	TypeState            = "d" // a group's state, in full or as a patch
+	TypeUploadChunk      = "u" // a chunk of a client's upload to a server method, or its end
+	TypeUploadCredit     = "k" // lets a client send more chunks of an upload
+	TypeAppControl       = "x" // an application's own control frame, of a kind clients that do not know it ignore
+	TypeProgress         = "g" // how far a server method invoked with an InvocationID has got, ahead of its completion
+)
+
+// ErrorCode classifies the errors the server reports to clients. Like the
+// websocket close codes the server sends, relayr's own codes are in the
+// range 4000 to 4999; applications have the codes from 5000 up.
+type ErrorCode int
+
+// Sender identifies the client whose call to a server method made a call
+// to client methods. It is sent with the call when the server is
+// configured to include it.
+type Sender struct {
+	ConnectionID string `json:"C"`
+	UserID       string `json:"U,omitempty"` // the client's user, if it has one
+}
+
+// RelaySchema describes a relay's methods as clients call them, so that
+// client code such as TypeScript definitions can be generated from it.
+type RelaySchema struct {
+	Name    string         `json:"name"`
+	Methods []MethodSchema `json:"methods"`
+
+	// ClientArgs describes the arguments of the client methods the server
+	// described, by method name, one entry per argument; a nil entry is
+	// passed to the client's handlers as it is received.
+	ClientArgs map[string][]*PayloadSchema `json:"clientArgs,omitempty"`
+}
+
+// PayloadSchema describes how the client script revives a value a client
+// method is passed before its handlers see it. Type is "date" for a
+// string to become a Date, "object" for an object whose Fields are
+// described, by name, "array" for an array whose Items are, "map" for an
+// object whose values are Items, or "any" for a value left as it is.
+// Default, if set, replaces the value when it is absent or null.
+type PayloadSchema struct {
+	Type    string                    `json:"type"`
+	Fields  map[string]*PayloadSchema `json:"fields,omitempty"`
+	Items   *PayloadSchema            `json:"items,omitempty"`
+	Default json.RawMessage           `json:"default,omitempty"`
+}
+
+// MethodSchema describes a relay method.
+type MethodSchema struct {
+	Name     string        `json:"name"`               // as the relay declares it
+	Script   string        `json:"script"`             // as the client script names it
+	Params   []ParamSchema `json:"params"`             // the arguments clients pass, after the *Relay and any context.Context and IncomingStream
+	Variadic bool          `json:"variadic,omitempty"` // the last parameter takes any number of arguments
+	Returns  string        `json:"returns,omitempty"`  // the type of the result, or of its items when Stream is set; empty when there is none
+	Stream   bool          `json:"stream,omitempty"`   // the result is streamed from a channel
+	Upload   bool          `json:"upload,omitempty"`   // the method reads an IncomingStream the client uploads
+	Progress bool          `json:"progress,omitempty"` // the method reports its progress
+
+	// Unavailable, when set, says why clients cannot call the method, as
+	// Exchange.Validate reports it; the client script's stub fails with it.
+	Unavailable string `json:"unavailable,omitempty"`
+}
+
+// ParamSchema describes a parameter of a relay method. Type is one of
+// "string", "integer", "number", "boolean", "array", "object" or "any",
+// the JSON type its arguments take.
+type ParamSchema struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ClientInvocation is the frame sent to a client to invoke one of its
+// methods.
+type ClientInvocation struct {
+	Type      string        `json:"T,omitempty"`
+	Relay     string        `json:"R"`
+	Method    string        `json:"M"`
+	Arguments []interface{} `json:"A"`
+	AckID     string        `json:"K,omitempty"` // set when the server waits for the client to acknowledge the call
+	Replay    bool          `json:"H,omitempty"` // set when the call is replayed from a group's history to a client that joined it
+	Missed    bool          `json:"O,omitempty"` // set when the call was kept for the client's user while it was away
+	Trace     string        `json:"P,omitempty"` // the traceparent of the server call that made the call, if any
+	Sender    *Sender       `json:"W,omitempty"` // the client whose call made the call, if the server includes it
+	Hub       string        `json:"J,omitempty"` // the hub of an ExchangeGroup that made the call, if any
+}
+
+// Completion is sent to a client when a server method it invoked with an
+// InvocationID has finished.
+type Completion struct {
+	Type         string      `json:"T,omitempty"`
+	InvocationID string      `json:"I"`
+	Value        interface{} `json:"V"`
+	Error        string      `json:"E,omitempty"`
+	Code         ErrorCode   `json:"C,omitempty"` // the Error's, if it has one
+}
+
+// ErrorFrame is sent to a client when a message it sent could not be
+// handled and there is no invocation to report the error against.
+type ErrorFrame struct {
+	Type  string    `json:"T,omitempty"`
+	Error string    `json:"E"`
+	Code  ErrorCode `json:"C,omitempty"` // the Error's, if it has one
+}
+
+// Ping answers a client's ping.
+type Ping struct {
+	Type string `json:"T,omitempty"`
+}
+
+// BinaryCall is the frame used to carry a binary payload over transports
+// that cannot send binary messages. Codecs such as JSON encode Data as
+// base64.
+type BinaryCall struct {
+	Type   string `json:"T,omitempty"`
+	Relay  string `json:"R"`
+	Method string `json:"M"`
+	Data   []byte `json:"B"`
+}
+
+// StreamItem carries one item of the streaming result of a server method
+// invoked with an InvocationID. The items are followed by a Completion.
+type StreamItem struct {
+	Type         string      `json:"T,omitempty"`
+	InvocationID string      `json:"I"`
+	Value        interface{} `json:"V"`
+}
+
+// Control ends a long poll, telling the client to renegotiate or that the
+// server disconnected it, or tells it of a change to its connection.
+type Control struct {
+	Type    string        `json:"T,omitempty"`
+	Command string        `json:"Z"`
+	Reason  string        `json:"D,omitempty"`
+	Group   string        `json:"G,omitempty"` // the group the client was removed from, for CommandRemoved
+	Relays  []RelaySchema `json:"S,omitempty"` // the relays registered, for CommandRelays
+}
+
+// The commands of Control frames.
+const (
+	CommandReconnect    = "RECONNECT"    // the client is to negotiate again, as when the server is shutting down
+	CommandDisconnected = "DISCONNECTED" // the server disconnected the client, for the Reason given
+	CommandRemoved      = "REMOVED"      // the client was removed from Group
+	CommandRelays       = "RELAYS"       // the relays registered have changed to Relays
+	CommandSlow         = "SLOW"         // the client's connection has become slow
+	CommandRecovered    = "RECOVERED"    // the client's connection is no longer slow
+	CommandUpgraded     = "UPGRADED"     // the client's connection has upgraded to a websocket
+)
+
+// Handshake is sent as the first frame over a websocket, so that the
+// client can configure itself for the server.
+type Handshake struct {
+	Type           string `json:"T,omitempty"`
+	Version        int    `json:"V"` // the protocol version in use
+	KeepAlive      int64  `json:"K"` // how often the server pings the client, in milliseconds
+	MaxMessageSize int64  `json:"X"` // the largest message the server accepts, in bytes
+}
+
+// ReservedControlPrefix starts the kinds of AppControl frames kept for
+// relayr's own features, which applications cannot send.
+const ReservedControlPrefix = "relayr."
+
+// AppControl carries a control frame of the application's own, such as
+// one telling a client to log out, which invokes no relay method. Clients
+// ignore the kinds they have no handler for.
+type AppControl struct {
+	Type    string      `json:"T,omitempty"`
+	Kind    string      `json:"Z"`
+	Payload interface{} `json:"V,omitempty"`
+}
+
+// PatchOp is an operation of an RFC 6902 JSON Patch.
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// State carries a group's state to a client: in full, or as a JSON Patch
+// against the version the client was sent before.
+type State struct {
+	Type    string      `json:"T,omitempty"`
+	Relay   string      `json:"R"`
+	Method  string      `json:"M"`
+	Group   string      `json:"G"`
+	Version uint64      `json:"N"`
+	Base    uint64      `json:"B,omitempty"` // the version Patch applies to; unset when State is sent in full
+	State   interface{} `json:"S,omitempty"`
+	Patch   []PatchOp   `json:"D,omitempty"`
+}
+
+// Progress tells a client how far a server method it invoked with an
+// InvocationID has got. Only the latest is sent of those reported before
+// the client could be sent the first, and none once the method has
+// returned, though one may arrive after its Completion, which clients
+// ignore.
+type Progress struct {
+	Type         string  `json:"T,omitempty"`
+	InvocationID string  `json:"I"`
+	Percent      float64 `json:"V"`
+	Note         string  `json:"N,omitempty"`
+}
+
+// UploadCredit lets a client send the chunks of an upload numbered below
+// Granted. Grants only grow, so one that arrives late changes nothing.
+type UploadCredit struct {
+	Type         string `json:"T,omitempty"`
+	InvocationID string `json:"I"`
+	Granted      uint64 `json:"N"`
+}
+
+// Inbound is a frame sent by a client: an invocation of a server or
+// client method, a ping, a request to join or leave a group, or a chunk
+// of an upload.
+type Inbound struct {
+	Type         string        `json:"T"`
+	Server       bool          `json:"S"` // version 0 only: set when invoking a server method
+	Relay        string        `json:"R"`
+	Method       string        `json:"M"`
+	Arguments    []interface{} `json:"A"`
+	ConnectionID string        `json:"C"`
+	InvocationID string        `json:"I"`
+	TraceParent  string        `json:"P,omitempty"` // the W3C traceparent of the client's span making the call
+	Group        string        `json:"G,omitempty"` // the group of a join or leave frame
+	Upload       bool          `json:"U,omitempty"` // set on a call to a server method the client uploads to
+	Sequence     uint64        `json:"N,omitempty"` // the number of an upload chunk, or of the chunks in all with Final
+	Final        bool          `json:"F,omitempty"` // set on the frame ending an upload
+	Hub          string        `json:"J,omitempty"` // the hub of an ExchangeGroup the frame is for, if any
+	CallID       string        `json:"K,omitempty"` // unique to a call, and the same each time the client sends it, so that it is run once
+}
+
+// Negotiation is the body a client posts to negotiate a connection.
+type Negotiation struct {
+	T string            `json:"t"` // the transport that the client is comfortable using (e.g, websockets)
+	C string            `json:"c"` // the codec the client would like to use; JSON when empty
+	P string            `json:"p"` // the ConnectionID the client had before it lost its connection, if any
+	V int               `json:"v"` // the newest protocol version the client speaks; 0 when absent
+	G []string          `json:"g"` // the groups the client asks to join
+	Q map[string]string `json:"q"` // values for relay methods to read
+	F []string          `json:"f"` // the optional features the client supports; nil from older scripts
+	U []string          `json:"u"` // the relays the client loaded, from an Exchange with LazyRelays; nil when it loaded them all
+}
+
+// NegotiationResponse answers a Negotiation.
+type NegotiationResponse struct {
+	ConnectionID string
+	Codec        string
+	Reconnected  bool     // the previous connection was restored
+	Version      int      // the protocol version to speak
+	Groups       []string `json:",omitempty"` // the groups asked for that the client was added to
+
+	// SlowRoundTrip is the round trip in milliseconds against which
+	// long-poll clients judge whether their connection is slow, when the
+	// server tells clients they are.
+	SlowRoundTrip int64 `json:",omitempty"`
+
+	// KeepAlive is the longest the client should go without a frame from
+	// the server, in milliseconds, when all is well: how often it is
+	// pinged over a websocket, or a long poll is answered.
+	KeepAlive int64
+
+	// Token is the connection token the client presents in place of its
+	// ConnectionID, if the server issues them.
+	Token string `json:",omitempty"`
+
+	// Instance is the ID of the server, which the client names in every
+	// request it makes for the connection.
+	Instance string `json:",omitempty"`
+
+	// Capabilities are the optional features the server uses with the
+	// client: those it asked for that the server supports.
+	Capabilities []string
+
+	// Upgrade is how long in milliseconds clients that long-poll wait
+	// before they may try upgrading to a websocket.
+	Upgrade int64 `json:",omitempty"`
+
+	// Probe is how long in milliseconds clients using websockets wait
+	// for the handshake to arrive over one before falling back on long
+	// polling.
+	Probe int64 `json:",omitempty"`
+
+	// Hubs are the schemas of the relays of each hub of an ExchangeGroup,
+	// by name, when the server is one.
+	Hubs map[string][]RelaySchema `json:",omitempty"`
+
+	// WebSocketURL is the ws:// or wss:// URL the client opens its
+	// websocket at, to which it adds "/ws" and its query, when the server
+	// knows it. Without it the client opens it at the URL it negotiated
+	// at, over ws:// for http and wss:// for https.
+	WebSocketURL string `json:",omitempty"`
+}
+
+// LongPollBatch is the response to a poll: the frames sent since the
+// client's last poll, the last of which has sequence number Seq.
+type LongPollBatch struct {
+	Messages []json.RawMessage
+	Seq      uint64
+}
+
+// CallReceipt answers a call made over long polling, once the call has
+// been checked and before it runs; its result, if it was accepted, comes
+// through the poll.
+type CallReceipt struct {
+	Accepted     bool
+	InvocationID string    `json:",omitempty"`
+	Error        string    `json:",omitempty"`
+	Code         ErrorCode `json:",omitempty"` // the Error's, if it has one
+}
+
+// ErrorResponse is the body of the answer to a request the server
+// refuses, naming the error as a CallReceipt does.
+type ErrorResponse struct {
+	Error string
+	Code  ErrorCode `json:",omitempty"`
+}
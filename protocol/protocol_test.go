@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the frames servers send")
+
+// golden returns the contents of testdata/name.golden, without the
+// newline ending it.
+func golden(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name+".golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSuffix(b, []byte("\n"))
+}
+
+// TestGoldenFrames encodes a frame of every type servers send, and the
+// bodies of the HTTP requests and responses around them, checking each
+// against its golden file, so that a change to a field's name, type or
+// order fails here before it reaches clients. Run with -update to rewrite
+// the files after a deliberate change to the wire format.
+func TestGoldenFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"client-invocation", &ClientInvocation{Type: TypeClientInvocation, Relay: "Chat", Method: "said", Arguments: []interface{}{"hi", 2.5}, AckID: "a1", Trace: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", Sender: &Sender{ConnectionID: "c1", UserID: "u1"}}},
+		{"client-invocation-replayed", &ClientInvocation{Type: TypeClientInvocation, Relay: "Chat", Method: "said", Arguments: []interface{}{}, Replay: true, Missed: true, Hub: "support"}},
+		{"client-invocation-v0", &ClientInvocation{Relay: "Chat", Method: "said", Arguments: []interface{}{"hi"}}},
+		{"completion", &Completion{Type: TypeCompletion, InvocationID: "1", Value: map[string]interface{}{"sum": 5.0}}},
+		{"completion-failed", &Completion{Type: TypeCompletion, InvocationID: "2", Error: "division by zero", Code: 5000}},
+		{"error", &ErrorFrame{Type: TypeError, Error: "unknown relay 'Nope'", Code: 4100}},
+		{"ping", &Ping{Type: TypePing}},
+		{"binary", &BinaryCall{Type: TypeBinary, Relay: "Files", Method: "chunk", Data: []byte{0, 1, 2, 255}}},
+		{"stream-item", &StreamItem{Type: TypeStreamItem, InvocationID: "3", Value: "x"}},
+		{"control", &Control{Type: TypeControl, Command: CommandDisconnected, Reason: "kicked"}},
+		{"control-removed", &Control{Type: TypeControl, Command: CommandRemoved, Group: "admins"}},
+		{"control-relays", &Control{Type: TypeControl, Command: CommandRelays, Relays: []RelaySchema{{
+			Name: "Chat",
+			Methods: []MethodSchema{
+				{Name: "Say", Script: "say", Params: []ParamSchema{{Name: "text", Type: "string"}}, Returns: "string"},
+				{Name: "Upload", Script: "upload", Params: []ParamSchema{}, Upload: true, Progress: true, Unavailable: "it takes a channel"},
+				{Name: "Feed", Script: "feed", Params: []ParamSchema{{Name: "tags", Type: "array"}}, Variadic: true, Returns: "object", Stream: true},
+			},
+			ClientArgs: map[string][]*PayloadSchema{"said": {
+				{Type: "object", Fields: map[string]*PayloadSchema{"at": {Type: "date"}}},
+				{Type: "array", Items: &PayloadSchema{Type: "any"}, Default: json.RawMessage(`[]`)},
+				nil,
+			}},
+		}}}},
+		{"handshake", &Handshake{Type: TypeHandshake, Version: Version, KeepAlive: 15000, MaxMessageSize: 65536}},
+		{"app-control", &AppControl{Type: TypeAppControl, Kind: "logout", Payload: map[string]interface{}{"why": "expired"}}},
+		{"state", &State{Type: TypeState, Relay: "Board", Method: "state", Group: "g", Version: 1, State: map[string]interface{}{"n": 1.0}}},
+		{"state-patch", &State{Type: TypeState, Relay: "Board", Method: "state", Group: "g", Version: 2, Base: 1, Patch: []PatchOp{{Op: "replace", Path: "/n", Value: 2.0}}}},
+		{"progress", &Progress{Type: TypeProgress, InvocationID: "5", Percent: 50, Note: "half"}},
+		{"upload-credit", &UploadCredit{Type: TypeUploadCredit, InvocationID: "4", Granted: 8}},
+		{"negotiation", &Negotiation{T: "websocket", C: "msgpack", P: "c0", V: Version, G: []string{"lobby"}, Q: map[string]string{"room": "1"}, F: []string{"ack", "batch"}, U: []string{"Chat"}}},
+		{"negotiation-response", &NegotiationResponse{ConnectionID: "c1", Codec: "json", Reconnected: true, Version: Version, Groups: []string{"lobby"}, SlowRoundTrip: 2000, KeepAlive: 15000, Token: "t", Instance: "i1", Capabilities: []string{"ack"}, Upgrade: 30000, Probe: 5000, Hubs: map[string][]RelaySchema{"support": {{Name: "Chat", Methods: []MethodSchema{}}}}, WebSocketURL: "wss://example.com/relayr"}},
+		{"negotiation-response-minimal", &NegotiationResponse{ConnectionID: "c1", Codec: "json"}},
+		{"longpoll-batch", &LongPollBatch{Messages: []json.RawMessage{json.RawMessage(`{"T":"p"}`), json.RawMessage(`{"T":"r","I":"1","V":null}`)}, Seq: 7}},
+		{"call-receipt", &CallReceipt{Accepted: true, InvocationID: "1"}},
+		{"call-receipt-refused", &CallReceipt{Error: "server busy", Code: 4300}},
+		{"error-response", &ErrorResponse{Error: "unknown connection", Code: 4000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := os.WriteFile(filepath.Join("testdata", tt.name+".golden"), append(b, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := golden(t, tt.name)
+			if !bytes.Equal(b, want) {
+				t.Fatalf("encoded\n%s\nwant\n%s", b, want)
+			}
+
+			// and decodes to the same frame
+			decoded := reflect.New(reflect.TypeOf(tt.v).Elem()).Interface()
+			if err := json.Unmarshal(want, decoded); err != nil {
+				t.Fatal(err)
+			}
+			again, _ := json.Marshal(decoded)
+			if !bytes.Equal(again, want) {
+				t.Fatalf("decoded and encoded again as\n%s\nwant\n%s", again, want)
+			}
+		})
+	}
+}
+
+// TestDecodeInbound decodes the frames clients of each version send, as
+// found in their golden files, at every version a server may speak with
+// them. Frames sent by version 0 clients decode to the frames of the same
+// meaning a version 1 client sends, and neither is read as the other by a
+// server speaking the other's version.
+func TestDecodeInbound(t *testing.T) {
+	tests := []struct {
+		name  string
+		since int // the first version whose clients send the frame
+		until int // the last
+		want  Inbound
+	}{
+		{"inbound-v0-server-invocation", 0, 0,
+			Inbound{Type: TypeServerInvocation, Server: true, Relay: "Chat", Method: "Say", Arguments: []interface{}{"hi"}, ConnectionID: "c1", InvocationID: "1"}},
+		{"inbound-v0-client-invocation", 0, 0,
+			Inbound{Type: TypeClientInvocation, Relay: "Chat", Method: "said", Arguments: []interface{}{"hi"}, ConnectionID: "c1"}},
+		{"inbound-v1-server-invocation", 1, Version,
+			Inbound{Type: TypeServerInvocation, Relay: "Chat", Method: "Say", Arguments: []interface{}{"hi"}, InvocationID: "1", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", Hub: "support", CallID: "k1"}},
+		// which a version 0 server, ignoring T, reads the same
+		{"inbound-v1-client-invocation", 0, Version,
+			Inbound{Type: TypeClientInvocation, Relay: "Chat", Method: "said", Arguments: []interface{}{"hi"}}},
+		{"inbound-v1-ping", 1, Version, Inbound{Type: TypePing}},
+		{"inbound-v1-join", 1, Version, Inbound{Type: TypeJoinGroup, Group: "room"}},
+		{"inbound-v1-leave", 1, Version, Inbound{Type: TypeLeaveGroup, Group: "room"}},
+		{"inbound-v1-upload", 1, Version,
+			Inbound{Type: TypeServerInvocation, Relay: "Files", Method: "Store", Arguments: []interface{}{"a.txt"}, InvocationID: "2", Upload: true}},
+		{"inbound-v1-upload-chunk", 1, Version, Inbound{Type: TypeUploadChunk, InvocationID: "2", Sequence: 3, Arguments: []interface{}{"AQI="}}},
+		{"inbound-v1-upload-end", 1, Version, Inbound{Type: TypeUploadChunk, InvocationID: "2", Sequence: 4, Final: true}},
+	}
+	for _, tt := range tests {
+		data := golden(t, tt.name)
+		for version := 0; version <= Version; version++ {
+			var f Inbound
+			if err := json.Unmarshal(data, &f); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			err := f.Resolve(version)
+			if version < tt.since || version > tt.until {
+				if err == nil && reflect.DeepEqual(f, tt.want) {
+					t.Errorf("%s decoded at version %d, which does not send it, as %+v", tt.name, version, f)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s at version %d: %v", tt.name, version, err)
+			} else if !reflect.DeepEqual(f, tt.want) {
+				t.Errorf("%s decoded at version %d as %+v, want %+v", tt.name, version, f, tt.want)
+			}
+		}
+	}
+}
+
+func TestResolveRefuses(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want error
+	}{
+		{`{"S":true,"R":"Chat","M":"Say"}`, ErrUntyped},
+		{`{"T":"?"}`, nil},
+		{`{"T":"r","I":"1"}`, nil}, // sent only by servers
+	} {
+		var f Inbound
+		json.Unmarshal([]byte(tt.data), &f)
+		err := f.Resolve(1)
+		if err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s resolved with %v", tt.data, err)
+		}
+	}
+}
+
+// TestSplitBatch splits the batched message a server sends clients of
+// BatchVersion into the frames in it, each as its own golden file has it,
+// and leaves the messages sent to older clients whole.
+func TestSplitBatch(t *testing.T) {
+	frames := Split(golden(t, "batch-v2"))
+	want := []string{"client-invocation", "completion", "ping"}
+	if len(frames) != len(want) {
+		t.Fatalf("split the batch into %d frames, want %d", len(frames), len(want))
+	}
+	for i, name := range want {
+		var got, expected bytes.Buffer
+		json.Compact(&got, frames[i])
+		json.Compact(&expected, golden(t, name))
+		if got.String() != expected.String() {
+			t.Errorf("frame %d is %s, want %s", i, &got, &expected)
+		}
+	}
+
+	for _, name := range []string{"client-invocation-v0", "completion"} {
+		if frames := Split(golden(t, name)); len(frames) != 1 || !bytes.Equal(frames[0], golden(t, name)) {
+			t.Errorf("split a single frame %s into %q", name, frames)
+		}
+	}
+	if frames := Split([]byte(` [not json `)); len(frames) != 1 {
+		t.Errorf("split a malformed message into %d frames", len(frames))
+	}
+}
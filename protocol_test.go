@@ -0,0 +1,130 @@
+package relayr
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		f    frame
+		v0   string // as sent to clients of version 0, which are sent no T
+		v1   string
+	}{
+		{"client invocation", &clientInvocation{Relay: "Chat", Method: "say", Arguments: []interface{}{"hi"}},
+			`{"R":"Chat","M":"say","A":["hi"]}`, `{"T":"c","R":"Chat","M":"say","A":["hi"]}`},
+		{"completion", &completion{InvocationID: "1", Value: 5},
+			`{"I":"1","V":5}`, `{"T":"r","I":"1","V":5}`},
+		{"failed completion", &completion{InvocationID: "2", Error: "no", Code: 4101},
+			`{"I":"2","V":null,"E":"no","C":4101}`, `{"T":"r","I":"2","V":null,"E":"no","C":4101}`},
+		{"error", &errorFrame{Error: "bad frame"},
+			`{"E":"bad frame"}`, `{"T":"e","E":"bad frame"}`},
+		{"ping", &pingFrame{},
+			`{}`, `{"T":"p"}`},
+		{"binary", &binaryCall{Relay: "Files", Method: "chunk", Data: []byte{1, 2}},
+			`{"R":"Files","M":"chunk","B":"AQI="}`, `{"T":"b","R":"Files","M":"chunk","B":"AQI="}`},
+		{"stream item", &streamItem{InvocationID: "3", Value: "x"},
+			`{"I":"3","V":"x"}`, `{"T":"i","I":"3","V":"x"}`},
+		{"control", &controlFrame{Command: "DISCONNECTED", Reason: "kicked"},
+			`{"Z":"DISCONNECTED","D":"kicked"}`, `{"T":"z","Z":"DISCONNECTED","D":"kicked"}`},
+		{"handshake", &handshake{Version: 2, KeepAlive: 15000, MaxMessageSize: 65536},
+			`{"V":2,"K":15000,"X":65536}`, `{"T":"h","V":2,"K":15000,"X":65536}`},
+		{"state", &stateFrame{Relay: "Board", Method: "state", Group: "g", Version: 2, Base: 1, Patch: []patchOp{{Op: "replace", Path: "/n", Value: 2}}},
+			`{"R":"Board","M":"state","G":"g","N":2,"B":1,"D":[{"op":"replace","path":"/n","value":2}]}`,
+			`{"T":"d","R":"Board","M":"state","G":"g","N":2,"B":1,"D":[{"op":"replace","path":"/n","value":2}]}`},
+		{"upload credit", &uploadCredit{InvocationID: "4", Granted: 8},
+			`{"I":"4","N":8}`, `{"T":"k","I":"4","N":8}`},
+		{"app control", &appControl{Kind: "logout"},
+			`{"Z":"logout"}`, `{"T":"x","Z":"logout"}`},
+		{"progress", &progressFrame{InvocationID: "5", Percent: 50, Note: "half"},
+			`{"I":"5","V":50,"N":"half"}`, `{"T":"g","I":"5","V":50,"N":"half"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range []struct {
+				version int
+				want    string
+			}{{0, tt.v0}, {1, tt.v1}, {protocolVersion, tt.v1}} {
+				b, err := encodeFrame(JSONCodec, c.version, tt.f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(b); !jsonEqual(t, got, c.want) {
+					t.Errorf("version %d: encoded %s, want %s", c.version, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+// jsonEqual reports whether a and b encode the same JSON value.
+func jsonEqual(t *testing.T, a, b string) bool {
+	t.Helper()
+	var x, y interface{}
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatalf("decoding %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatalf("decoding %s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestDecodeFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		data    string
+		want    inboundFrame
+		wantErr bool
+	}{
+		{"v0 server invocation", 0, `{"S":true,"R":"Chat","M":"Say","A":["hi"],"C":"c1","I":"1"}`,
+			inboundFrame{Type: frameServerInvocation, Server: true, Relay: "Chat", Method: "Say", Arguments: []interface{}{"hi"}, ConnectionID: "c1", InvocationID: "1"}, false},
+		{"v0 client invocation", 0, `{"R":"Chat","M":"said","A":[]}`,
+			inboundFrame{Type: frameClientInvocation, Relay: "Chat", Method: "said", Arguments: []interface{}{}}, false},
+		{"v0 ignores T", 0, `{"T":"p","S":true,"R":"Chat","M":"Say"}`,
+			inboundFrame{Type: frameServerInvocation, Server: true, Relay: "Chat", Method: "Say"}, false},
+		{"server invocation", 1, `{"T":"s","R":"Chat","M":"Say","A":["hi"],"I":"1","P":"00-trace"}`,
+			inboundFrame{Type: frameServerInvocation, Relay: "Chat", Method: "Say", Arguments: []interface{}{"hi"}, InvocationID: "1", TraceParent: "00-trace"}, false},
+		{"client invocation", 1, `{"T":"c","R":"Chat","M":"said","A":[]}`,
+			inboundFrame{Type: frameClientInvocation, Relay: "Chat", Method: "said", Arguments: []interface{}{}}, false},
+		{"ping", 1, `{"T":"p"}`, inboundFrame{Type: framePing}, false},
+		{"join", 1, `{"T":"j","G":"room"}`, inboundFrame{Type: frameJoinGroup, Group: "room"}, false},
+		{"leave", 1, `{"T":"l","G":"room"}`, inboundFrame{Type: frameLeaveGroup, Group: "room"}, false},
+		{"upload chunk", protocolVersion, `{"T":"u","I":"1","N":3,"A":["AQI="]}`,
+			inboundFrame{Type: frameUploadChunk, InvocationID: "1", Sequence: 3, Arguments: []interface{}{"AQI="}}, false},
+		{"upload end", protocolVersion, `{"T":"u","I":"1","N":4,"F":true}`,
+			inboundFrame{Type: frameUploadChunk, InvocationID: "1", Sequence: 4, Final: true}, false},
+		{"untyped", 1, `{"S":true,"R":"Chat","M":"Say"}`, inboundFrame{}, true},
+		{"unknown type", 1, `{"T":"?"}`, inboundFrame{}, true},
+		{"sent only by servers", 1, `{"T":"r","I":"1"}`, inboundFrame{}, true},
+		{"malformed", 1, `{"T":`, inboundFrame{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeFrame(JSONCodec, tt.version, []byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decoded %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiatedVersion(t *testing.T) {
+	for asked, want := range map[int]int{-1: 0, 0: 0, 1: 1, protocolVersion: protocolVersion, protocolVersion + 1: protocolVersion} {
+		if got := negotiatedVersion(asked); got != want {
+			t.Errorf("a client asking for version %d was given %d, want %d", asked, got, want)
+		}
+	}
+}
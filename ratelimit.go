@@ -0,0 +1,125 @@
+package relayr
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned to clients whose calls to relay methods
+// exceed their rate limit.
+var ErrRateLimited = errors.New("relayr: rate limit exceeded")
+
+// RateLimit limits how often a client may call relay methods. Calls are
+// allowed at Rate per second on average, with bursts of up to Burst calls.
+// A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// tokenBucket tracks the calls a client has made against one RateLimit.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(l RateLimit, now time.Time) bool {
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// callLimiter holds a client's token buckets, one per distinct limit.
+type callLimiter struct {
+	lock     sync.Mutex
+	buckets  map[string]*tokenBucket
+	rejected int // calls rejected since the last allowed one
+}
+
+func newCallLimiter() *callLimiter {
+	return &callLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow reports whether a call may go ahead, and how many calls in a row
+// have now been rejected.
+func (c *callLimiter) allow(key string, l RateLimit, now time.Time) (bool, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b := c.buckets[key]
+	if b == nil {
+		b = &tokenBucket{}
+		c.buckets[key] = b
+	}
+	if b.allow(l, now) {
+		c.rejected = 0
+		return true, 0
+	}
+	c.rejected++
+	return false, c.rejected
+}
+
+// rateLimitFor returns the limit that applies to calls to a relay method,
+// and the key of the bucket that tracks it. MethodRateLimits entries for
+// "Relay.Method" take precedence over those for "Relay", which take
+// precedence over CallRateLimit.
+func (e *Exchange) rateLimitFor(relay, method string) (RateLimit, string, bool) {
+	o := e.runtime()
+	key := relay + "." + method
+	l, ok := o.MethodRateLimits[key]
+	if !ok {
+		key = relay
+		l, ok = o.MethodRateLimits[key]
+	}
+	if !ok {
+		key, l = "", o.CallRateLimit
+	}
+
+	return l, key, l.Rate > 0
+}
+
+// allowCall checks a client's call against its rate limit, returning
+// ErrRateLimited if it must be rejected. Clients that keep exceeding their
+// limit are disconnected once RateLimitDisconnectThreshold is reached.
+func (e *Exchange) allowCall(cid, relay, method string) error {
+	l, key, ok := e.rateLimitFor(relay, method)
+	if !ok {
+		return nil
+	}
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return nil
+	}
+
+	allowed, rejected := c.limiter.allow(key, l, time.Now())
+	if allowed {
+		return nil
+	}
+
+	e.counters.rateLimited.Add(1)
+	e.recordConnectionError(DispatchError, cid, relay, method, ErrRateLimited)
+	e.logger.Infof("connection %s exceeded the rate limit calling %s.%s", cid, relay, method)
+	if threshold := e.runtime().RateLimitDisconnectThreshold; threshold > 0 && rejected >= threshold {
+		e.logger.Infof("disconnecting %s for exceeding its rate limit", cid)
+		e.dropClient(cid, ReasonRateLimited)
+	}
+
+	return ErrRateLimited
+}
@@ -0,0 +1,71 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	rclient "github.com/simon-whitehead/relayr/client"
+)
+
+// addOnce has c call Calculator.Add, returning the error the call failed
+// with, if any.
+func addOnce(t *testing.T, c *rclient.Client) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	_, err := c.Call(ctx, "Calculator", "Add", 1, 2)
+	return err
+}
+
+// checkRateLimited checks that err is the refusal of a call over the
+// client's rate limit.
+func checkRateLimited(t *testing.T, err error) {
+	t.Helper()
+	var cerr *rclient.Error
+	if !errors.As(err, &cerr) || cerr.Code != CodeRateLimited || cerr.Message != ErrRateLimited.Error() {
+		t.Fatalf("a call over the rate limit failed with %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const burst = 3
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			// a token every 100ms, more slowly than the calls are made
+			e, srv := serve(t, ExchangeOptions{CallRateLimit: RateLimit{Rate: 10, Burst: burst}}, Calculator{})
+			c := dial(t, srv, transport)
+
+			for i := 0; i < burst; i++ {
+				if err := addOnce(t, c); err != nil {
+					t.Fatalf("call %d of the burst failed with %v", i+1, err)
+				}
+			}
+			checkRateLimited(t, addOnce(t, c))
+
+			// one token has come back since, and one alone
+			time.Sleep(150 * time.Millisecond)
+			if err := addOnce(t, c); err != nil {
+				t.Fatalf("a call once a token came back failed with %v", err)
+			}
+			checkRateLimited(t, addOnce(t, c))
+
+			if n := e.Stats().RateLimitedCalls; n != 2 {
+				t.Fatalf("counted %d calls rate limited, want 2", n)
+			}
+		})
+	}
+}
+
+func TestRateLimitStatus(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{CallRateLimit: RateLimit{Rate: 10, Burst: 1}}, Calculator{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	if status := callOverHTTP(t, srv, cid, "Calculator", "Add", 1, 2); status != http.StatusOK {
+		t.Fatalf("a call within the rate limit was answered %d", status)
+	}
+	if status := callOverHTTP(t, srv, cid, "Calculator", "Add", 1, 2); status != http.StatusTooManyRequests {
+		t.Fatalf("a call over the rate limit was answered %d", status)
+	}
+}
@@ -0,0 +1,124 @@
+package relayr
+
+import (
+	"reflect"
+	"time"
+)
+
+// detachedClient is a client whose transport connection dropped and which
+// may still reconnect within the ReconnectGracePeriod.
+type detachedClient struct {
+	client *client
+	groups []string // the groups the client was in when it dropped
+	reason string   // why it dropped, reported if it does not reconnect
+	expiry *time.Timer
+}
+
+// detachClient takes a disconnected client out of its groups but keeps it
+// for the ReconnectGracePeriod so that it can be restored by
+// reattachClient. It returns false when the client is unknown or
+// reconnection is disabled, in which case the caller should forget it.
+func (e *Exchange) detachClient(id, reason string) bool {
+	grace := e.options.ReconnectGracePeriod
+	if grace < 0 || e.isClosed() {
+		return false
+	}
+
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	if _, ok := e.detached[id]; ok {
+		return true
+	}
+	c := e.getClientByConnectionIDLocked(id)
+	if c == nil {
+		return false
+	}
+
+	d := &detachedClient{client: c, reason: reason}
+	e.removeUserLocked(c)
+	e.removeAddrLocked(c)
+	for name, g := range e.groups {
+		if g.has(id) {
+			d.groups = append(d.groups, name)
+			e.removeFromGroupByIDLocked(name, id)
+		}
+	}
+	e.unregisterLocked(id, reason)
+	d.expiry = time.AfterFunc(grace, func() {
+		e.expireClient(id, d, reason)
+	})
+	e.detached[id] = d
+
+	e.logger.Debugf("client %s detached, waiting %v for it to reconnect", id, grace)
+	return true
+}
+
+// reattachClient restores a detached client onto transport t and back
+// into its groups. It returns nil if there is no such client, or if it was
+// authorized as a different principal.
+func (e *Exchange) reattachClient(id, t string, principal interface{}) *client {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	d, ok := e.detached[id]
+	if !ok || !reflect.DeepEqual(d.client.principal, principal) {
+		return nil
+	}
+	// if the timer has already fired, expireClient will find the client
+	// gone from detached once it gets the lock and leave it alone
+	d.expiry.Stop()
+	delete(e.detached, id)
+
+	c := d.client
+	c.setTransport(e.transports[t])
+	e.registerLocked(c)
+	for _, group := range d.groups {
+		e.addToGroupLocked(group, c, false)
+	}
+	e.addUserLocked(c)
+	e.addAddrLocked(c)
+	c.touch()
+	c.seen()
+
+	e.logger.Debugf("client %s reattached to %d groups", id, len(d.groups))
+	return c
+}
+
+// expireClient forgets a detached client once its grace period is over,
+// or when it is disconnected for the given reason before then.
+func (e *Exchange) expireClient(id string, d *detachedClient, reason string) {
+	e.mapLock.Lock()
+	if e.detached[id] != d {
+		e.mapLock.Unlock()
+		return
+	}
+	delete(e.detached, id)
+	e.forgetTagsLocked(id)
+	d.client.goneReason = reason
+	close(d.client.gone)
+	e.mapLock.Unlock()
+
+	e.logger.Debugf("client %s did not reconnect", id)
+	d.client.state.clear()
+	if t := e.tapped(id); t != nil {
+		e.untap(id, t)
+	}
+	e.notifyDisconnect(id, reason)
+}
+
+// expireAllClients forgets every detached client. It is called when the
+// Exchange closes.
+func (e *Exchange) expireAllClients() {
+	e.mapLock.RLock()
+	detached := make(map[string]*detachedClient, len(e.detached))
+	for id, d := range e.detached {
+		detached[id] = d
+	}
+	e.mapLock.RUnlock()
+
+	for id, d := range detached {
+		d.expiry.Stop()
+		e.expireClient(id, d, ReasonClosed)
+	}
+}
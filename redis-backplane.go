@@ -0,0 +1,302 @@
+package relayr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errBackplaneClosed = errors.New("relayr: backplane closed")
+
+// RedisBackplane is a Backplane built on Redis pub/sub. It speaks the
+// Redis protocol directly, so it has no dependencies beyond a reachable
+// Redis server.
+type RedisBackplane struct {
+	// Channel is the pub/sub channel used for broadcasts. It defaults
+	// to "relayr" and must be set before the backplane is used.
+	Channel string
+
+	addr     string
+	password string
+
+	pubLock sync.Mutex
+	pub     *redisConn
+
+	subLock sync.Mutex
+	sub     *redisConn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewRedisBackplane returns a Backplane using the Redis server at addr.
+// An empty password skips authentication.
+func NewRedisBackplane(addr, password string) *RedisBackplane {
+	return &RedisBackplane{
+		Channel:  "relayr",
+		addr:     addr,
+		password: password,
+		closed:   make(chan struct{}),
+	}
+}
+
+// Publish implements Backplane.
+func (b *RedisBackplane) Publish(msg BackplaneMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+
+	// retry once on a fresh connection if the old one has gone stale
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			b.pub, err = dialRedis(b.addr, b.password)
+			if err != nil {
+				return err
+			}
+		}
+		if err = b.pub.do("PUBLISH", b.Channel, string(payload)); err == nil {
+			_, err = b.pub.readReply()
+		}
+		if err == nil {
+			return nil
+		}
+		b.pub.Close()
+		b.pub = nil
+	}
+
+	return err
+}
+
+// Ping implements BackplanePinger, sending PING over the connection
+// messages are published on, which it dials if need be.
+func (b *RedisBackplane) Ping(ctx context.Context) error {
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+	select {
+	case <-b.closed:
+		return errBackplaneClosed
+	default:
+	}
+
+	var err error
+	if b.pub == nil {
+		if b.pub, err = dialRedis(b.addr, b.password); err != nil {
+			return err
+		}
+	}
+	conn := b.pub
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err = conn.do("PING"); err == nil {
+		_, err = conn.readReply()
+	}
+	if err != nil {
+		conn.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+// Subscribe implements Backplane. Messages are delivered from a single
+// goroutine which reconnects automatically until Close is called.
+func (b *RedisBackplane) Subscribe(fn func(msg BackplaneMessage)) error {
+	conn, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			b.receive(conn, fn)
+
+			// the connection dropped; keep trying until we are closed
+			for {
+				select {
+				case <-b.closed:
+					return
+				case <-time.After(time.Second):
+				}
+				if conn, err = b.subscribe(); err == nil {
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *RedisBackplane) subscribe() (*redisConn, error) {
+	conn, err := dialRedis(b.addr, b.password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.do("SUBSCRIBE", b.Channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.readReply(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+	select {
+	case <-b.closed:
+		conn.Close()
+		return nil, errBackplaneClosed
+	default:
+	}
+	b.sub = conn
+
+	return conn, nil
+}
+
+func (b *RedisBackplane) receive(conn *redisConn, fn func(msg BackplaneMessage)) {
+	defer conn.Close()
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return
+		}
+
+		// pushed messages arrive as ["message", channel, payload]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		payload, ok := parts[2].(string)
+		if !ok {
+			continue
+		}
+
+		var msg BackplaneMessage
+		if json.Unmarshal([]byte(payload), &msg) == nil {
+			fn(msg)
+		}
+	}
+}
+
+// Close implements Backplane.
+func (b *RedisBackplane) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+
+		b.subLock.Lock()
+		if b.sub != nil {
+			b.sub.Close()
+		}
+		b.subLock.Unlock()
+
+		b.pubLock.Lock()
+		if b.pub != nil {
+			b.pub.Close()
+			b.pub = nil
+		}
+		b.pubLock.Unlock()
+	})
+
+	return nil
+}
+
+// redisConn is a minimal client for the Redis serialization protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialRedis(addr, password string) (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if password != "" {
+		if err := c.do("AUTH", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if _, err := c.readReply(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *redisConn) do(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := c.Write(buf)
+	return err
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("relayr: malformed redis reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("relayr: redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		r := make([]interface{}, n)
+		for i := range r {
+			if r[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("relayr: unexpected redis reply %q", line)
+}
@@ -1,10 +1,20 @@
 package relayr
 
-import "reflect"
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
 
 // Relay encapsulates a connection with a client
 // during an interaction with the server. It provides methods
-// for interacting with clients and groups.
+// for interacting with clients and groups. A Relay is safe for concurrent
+// use and may be kept once the call it was passed to returns, such as by a
+// goroutine that goes on calling the client: Done tells it when the client
+// is gone, after which calls to the client fail with ErrConnectionGone.
+// Its context ends with the call.
 type Relay struct {
 	Name             string            // The name of the relay it is associated with
 	ConnectionID     string            // The connectionID of the client that this Relay interacts with
@@ -12,8 +22,101 @@ type Relay struct {
 	UnderlyingStruct interface{}
 
 	methods  []string
-	t        reflect.Type
+	resolved map[string]string  // the exposed methods, keyed by their lower-cased names
+	t        reflect.Type       // the relay's struct type
+	receiver reflect.Value      // a pointer to the registered relay, which methods are called on
+	factory  func() interface{} // creates the relay for each call, if registered with a factory
 	exchange *Exchange
+	ctx      context.Context        // the context of the client call being served, if any
+	trace    string                 // the traceparent of the client call being served, if any
+	group    string                 // the group a client call is being delivered to, if any
+	coalesce string                 // the coalescing key of a client call, if any
+	overflow OverflowPolicy         // the overflow policy of a client call; the Exchange's when unset
+	expires  time.Time              // when a client call still queued is dropped; never when zero
+	plain    bool                   // a client call is written to websockets uncompressed, whatever its size
+	priority Priority               // the lane a client call waits in to be sent; Normal when unset
+	welcome  bool                   // calls are made by an OnClientConnected hook
+	sender   *Sender                // the client whose call is being served, with IncludeSenderID
+	upload   *incomingStream        // the client's upload to the call being served, if any
+	progress Progress               // reports the progress of the call being served to its client, if it can be
+	values   map[string]interface{} // taken by the ContextExtractor from the request carrying the call being served, if any
+
+	// the issues Validate reports with the relay, and why clients cannot
+	// call the exposed methods with errors, by name
+	issues  []RelayValidationIssue
+	refused map[string]string
+}
+
+func (r *Relay) context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// MethodExposer can be implemented by a relay to list exactly which of
+// its methods clients may call, which need not take a *Relay. Relays that
+// do not implement it expose every method whose first parameter is a
+// *Relay.
+type MethodExposer interface {
+	RelayMethods() []string
+}
+
+// CallError is returned when a client calls a relay or method that does
+// not exist or is not exposed to clients.
+type CallError struct {
+	Relay  string
+	Method string // empty when the relay itself does not exist
+	Reason string
+}
+
+func (e *CallError) Error() string {
+	if e.Method == "" {
+		return fmt.Sprintf("relayr: relay '%v' %v", e.Relay, e.Reason)
+	}
+	return fmt.Sprintf("relayr: method '%v' on relay '%v' %v", e.Method, e.Relay, e.Reason)
+}
+
+// resolveMethods indexes a relay's exposed methods by their lower-cased
+// names, so that the names used by the generated script and by clients
+// resolve to the same method regardless of case. Methods whose names
+// differ only in case are rejected as ambiguous.
+func resolveMethods(methods []string) (map[string]string, error) {
+	r := make(map[string]string, len(methods))
+	for _, m := range methods {
+		key := strings.ToLower(m)
+		if other, ok := r[key]; ok {
+			return nil, fmt.Errorf("methods %s and %s differ only in case", other, m)
+		}
+		r[key] = m
+	}
+	return r, nil
+}
+
+// resolveMethod returns the exposed method that fn names, ignoring case.
+func (r *Relay) resolveMethod(fn string) (string, bool) {
+	m, ok := r.resolved[strings.ToLower(fn)]
+	return m, ok
+}
+
+// checkCall returns the exposed method that fn names, failing if there is
+// none or if it cannot be passed nargs arguments.
+func (r *Relay) checkCall(fn string, nargs int) (string, error) {
+	name, ok := r.resolveMethod(fn)
+	if !ok {
+		return "", &CallError{Relay: r.Name, Method: fn, Reason: "does not exist"}
+	}
+	if why, ok := r.refused[name]; ok {
+		return "", &CallError{Relay: r.Name, Method: name, Reason: "cannot be called: it " + why}
+	}
+	t := r.receiver.MethodByName(name).Type()
+	switch n := t.NumIn() - firstArg(t); {
+	case t.IsVariadic() && nargs < n-1:
+		return "", &CallError{Relay: r.Name, Method: name, Reason: fmt.Sprintf("takes at least %d arguments, not %d", n-1, nargs)}
+	case !t.IsVariadic() && nargs != n:
+		return "", &CallError{Relay: r.Name, Method: name, Reason: fmt.Sprintf("takes %d arguments, not %d", n, nargs)}
+	}
+	return name, nil
 }
 
 // Call will execute a function on another server-side Relay,
@@ -22,12 +125,89 @@ func (r *Relay) Call(fn string, args ...interface{}) {
 	r.exchange.callRelayMethod(r, fn, args...)
 }
 
+// CallErr is like Call, but returns the error the method returns, or a
+// *CallError if the method cannot be called with args.
+func (r *Relay) CallErr(fn string, args ...interface{}) error {
+	_, err := r.exchange.callRelayMethod(r, fn, args...)
+	return err
+}
+
+// Other returns the relay registered for x's type, as a struct or a
+// pointer to one, bound to the same client as r: its Caller and Others
+// refer to the client r does, and the client methods called through it
+// are those of the other relay. Calls made through it from an
+// OnClientConnected hook are sent as r's are. It returns nil if x's type
+// has not been registered.
+func (r *Relay) Other(x interface{}) *Relay {
+	name, ok := r.exchange.relayName(x)
+	if !ok {
+		return nil
+	}
+	o := r.exchange.getRelayByName(name, r.ConnectionID)
+	if o == nil {
+		// unregistered since relayName found it
+		return nil
+	}
+	o.ctx, o.trace, o.welcome, o.sender, o.upload, o.values = r.ctx, r.trace, r.welcome, r.sender, r.upload, r.values
+	return o
+}
+
 // Groups returns a GroupOperations object, which offers helper
-// methods for communicating with and grouping clients.
+// methods for communicating with and grouping clients. With
+// NamespaceGroups the group is in the relay's namespace unless it is
+// marked with GlobalGroup.
 func (r *Relay) Groups(group string) *GroupOperations {
 	return &GroupOperations{
-		group: group,
+		group: r.qualifyGroup(group),
 		e:     r.exchange,
 		relay: r,
 	}
 }
+
+// Connection returns the state store of the client this Relay interacts
+// with. If the client is no longer connected, an empty store that is not
+// attached to any connection is returned.
+func (r *Relay) Connection() *ConnectionState {
+	if c := r.exchange.getClientByConnectionID(r.ConnectionID); c != nil {
+		return c.state
+	}
+	return newConnectionState()
+}
+
+// ConnectionValues returns the values the client this Relay interacts
+// with passed as it negotiated its connection, such as with
+// RelayRConnection.configure({qs: {...}}) in the client script. They are
+// kept when the client reconnects with the same ConnectionID. It returns
+// nil if the client passed none or is no longer connected.
+func (r *Relay) ConnectionValues() map[string]string {
+	c := r.exchange.getClientByConnectionID(r.ConnectionID)
+	if c == nil || len(c.values) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+// Memberships returns the groups the client this Relay interacts with is
+// in, sorted, with Global only if withGlobal is set. They are named in
+// full, as Exchange.Groups names them, so with NamespaceGroups they are
+// used through Groups marked with GlobalGroup. It returns an empty slice
+// if the client is no longer connected.
+func (r *Relay) Memberships(withGlobal bool) []string {
+	if r.ConnectionID == "" {
+		return []string{}
+	}
+	return r.exchange.groupsOf(r.ConnectionID, withGlobal)
+}
+
+// Principal returns the principal the Authorizer returned when the
+// client this Relay interacts with negotiated its connection.
+func (r *Relay) Principal() interface{} {
+	if c := r.exchange.getClientByConnectionID(r.ConnectionID); c != nil {
+		return c.principal
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Orders pushes to its callers through Notifications.
+type Orders struct{}
+
+func (Orders) Place(r *Relay, item string) error {
+	n := r.Other(Notifications{})
+	if n == nil {
+		return errInvalidRelay
+	}
+	return n.Clients.Caller().Call("notify", "placed "+item)
+}
+
+func (Orders) Missing(r *Relay) bool {
+	return r.Other(Chat{}) == nil
+}
+
+// Toolbox exposes methods that do not all take a *Relay, some of them
+// variadic.
+type Toolbox struct{}
+
+func (Toolbox) RelayMethods() []string { return []string{"Version", "Ping", "Sum", "Join"} }
+
+func (Toolbox) Version() string { return "1.0" }
+
+func (Toolbox) Ping(r *Relay) bool { return r != nil }
+
+func (Toolbox) Sum(r *Relay, base int, ns ...int) int {
+	for _, n := range ns {
+		base += n
+	}
+	return base
+}
+
+func (Toolbox) Join(sep string, parts ...string) string { return strings.Join(parts, sep) }
+
+// Plumbing exposes methods clients could not call.
+type Plumbing struct{ methods []string }
+
+func (p Plumbing) RelayMethods() []string { return p.methods }
+
+func (Plumbing) Pipe(r *Relay, ch chan int) {}
+
+func (Plumbing) Each(r *Relay, fn func(int)) {}
+
+func (Plumbing) Twice(r *Relay, inner *Relay) {}
+
+func TestMethodSignatures(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{}, Toolbox{})
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			c := dial(t, srv, transport)
+			for _, tt := range []struct {
+				method string
+				args   []interface{}
+				want   string
+			}{
+				{"Version", nil, `"1.0"`},
+				{"Ping", nil, "true"},
+				{"Sum", []interface{}{1}, "1"},
+				{"Sum", []interface{}{1, 2, 3.0, 4}, "10"},
+				{"Join", []interface{}{"-", "a", "b"}, `"a-b"`},
+				{"Join", []interface{}{"-"}, `""`},
+			} {
+				ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+				res, err := c.Call(ctx, "Toolbox", tt.method, tt.args...)
+				cancel()
+				if err != nil || string(res) != tt.want {
+					t.Errorf("%s%v returned %s, %v, want %s", tt.method, tt.args, res, err, tt.want)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			if _, err := c.Call(ctx, "Toolbox", "Sum", 1, "two"); err == nil {
+				t.Error("Sum was called with an item that is not a number")
+			}
+		})
+	}
+
+	for _, method := range []string{"Pipe", "Each", "Twice"} {
+		e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+		err := e.RegisterRelay(Plumbing{methods: []string{method}})
+		if err == nil || !strings.Contains(err.Error(), method) {
+			t.Errorf("registering a relay exposing %s returned %v", method, err)
+		}
+		if len(e.Schema()) != 0 {
+			t.Errorf("a relay refused for exposing %s is in the schema", method)
+		}
+	}
+}
+
+func TestOtherPushesAsOtherRelay(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Orders{}, Notifications{})
+
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			caller, bystander := dial(t, srv, transport), dial(t, srv, transport)
+			asOrders := calls(caller, "Orders", "notify")
+			toCaller, toBystander := calls(caller, "Notifications", "notify"), calls(bystander, "Notifications", "notify")
+
+			if err := caller.Invoke(context.Background(), "Orders", "Place", "book"); err != nil {
+				t.Fatal(err)
+			}
+			if args := receive(t, toCaller); string(args[0]) != `"placed book"` {
+				t.Fatalf("the caller received %s", args[0])
+			}
+
+			// what each client receives next shows the push reached no one
+			// else, nor came as Orders'
+			e.Clients(Notifications{}).All("notify", "next")
+			if args := receive(t, toBystander); string(args[0]) != `"next"` {
+				t.Fatalf("another client received %s", args[0])
+			}
+			receive(t, toCaller)
+			select {
+			case args := <-asOrders:
+				t.Fatalf("the push came as Orders' notify(%s)", args[0])
+			default:
+			}
+		})
+	}
+
+	c := dial(t, srv, "websocket")
+	if res, err := c.Call(context.Background(), "Orders", "Missing"); err != nil || string(res) != "true" {
+		t.Errorf("Other of a relay that is not registered was not nil: %s, %v", res, err)
+	}
+}
+
+func TestMustRelay(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Orders{})
+	if r := e.MustRelay(Orders{}); r == nil || r.Name != "Orders" {
+		t.Fatalf("MustRelay returned %+v", r)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustRelay did not panic for a relay that is not registered")
+		}
+	}()
+	e.MustRelay(Chat{})
+}
+
+func TestRelayCallErr(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Calculator{})
+	r := e.MustRelay(Calculator{})
+
+	if err := r.CallErr("Add", 1, 2); err != nil {
+		t.Fatalf("calling Add: %v", err)
+	}
+	if err := r.CallErr("Divide", 1, 0); err == nil || err.Error() != "division by zero" {
+		t.Fatalf("calling Divide by zero returned %v", err)
+	}
+	var ce *CallError
+	if err := r.CallErr("Multiply", 1, 2); !errors.As(err, &ce) {
+		t.Fatalf("calling a method that does not exist returned %v, want a *CallError", err)
+	}
+	if err := r.CallErr("Add", 1); !errors.As(err, &ce) {
+		t.Fatalf("calling Add with too few arguments returned %v, want a *CallError", err)
+	}
+}
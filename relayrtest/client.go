@@ -0,0 +1,189 @@
+package relayrtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/simon-whitehead/relayr"
+)
+
+// memoryTransportName is the name the in-memory transport is registered
+// under.
+const memoryTransportName = "memory"
+
+// receivedBuffer is the number of calls a TestClient buffers before
+// further calls to it fail with relayr.ErrBufferFull.
+const receivedBuffer = 1024
+
+// ClientCall is a call to a client method received by a TestClient.
+type ClientCall struct {
+	Relay  string
+	Method string
+	Args   []interface{} // decoded from JSON, as the client script sees them
+}
+
+// TestClient is a client connected to an Exchange in memory, without a
+// network. Its calls go through the Exchange's real dispatch, rate limits
+// and interceptors, and it receives the calls made to it through groups,
+// Clients and outbound interceptors as a browser would.
+type TestClient struct {
+	e        *relayr.Exchange
+	t        *memoryTransport
+	id       string
+	received chan ClientCall
+}
+
+// transports holds the in-memory transport registered with each Exchange
+// that has had a TestClient.
+var transports sync.Map // *relayr.Exchange -> *memoryTransport
+
+// NewTestClient negotiates a connection with e over an in-memory transport
+// and connects to it. The transport is registered with e the first time,
+// which must be before e serves any HTTP requests. Negotiating freezes e,
+// so its other transports must be registered before the first TestClient
+// is made.
+// The negotiation is made with a request that carries no credentials, so
+// it is refused by most Authorizers. NewTestClient panics if it fails.
+func NewTestClient(e *relayr.Exchange) *TestClient {
+	t := &memoryTransport{clients: make(map[string]*TestClient)}
+	if registered, ok := transports.LoadOrStore(e, t); ok {
+		t = registered.(*memoryTransport)
+	} else if err := e.RegisterTransport(memoryTransportName, t); err != nil {
+		transports.Delete(e)
+		panic(fmt.Sprintf("relayrtest: %v", err))
+	}
+
+	body, _ := json.Marshal(map[string]string{"t": memoryTransportName})
+	req := httptest.NewRequest("POST", "/negotiate", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+
+	var res struct{ ConnectionID string }
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.ConnectionID == "" {
+		panic(fmt.Sprintf("relayrtest: negotiating a test client: %d %s", w.Code, w.Body))
+	}
+
+	c := &TestClient{
+		e:        e,
+		t:        t,
+		id:       res.ConnectionID,
+		received: make(chan ClientCall, receivedBuffer),
+	}
+	t.lock.Lock()
+	t.clients[c.id] = c
+	t.lock.Unlock()
+
+	if err := e.Connected(c.id); err != nil {
+		panic(fmt.Sprintf("relayrtest: connecting a test client: %v", err))
+	}
+
+	return c
+}
+
+// ConnectionID returns the client's ConnectionID.
+func (c *TestClient) ConnectionID() string {
+	return c.id
+}
+
+// CallServer calls a relay method as the client, returning its result
+// once it has finished. The arguments are passed through JSON first, so
+// the method receives them as it would from the client script.
+func (c *TestClient) CallServer(relay, method string, args ...interface{}) (interface{}, error) {
+	decoded, err := roundTrip(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.e.ServeCall(c.id, relay, method, decoded)
+}
+
+// Received returns the calls made to the client's methods, in the order
+// they were made. It is closed once the client is disconnected.
+func (c *TestClient) Received() <-chan ClientCall {
+	return c.received
+}
+
+// JoinGroup adds the client to a group, returning the error
+// Exchange.AddToGroup does.
+func (c *TestClient) JoinGroup(name string) error {
+	return c.e.AddToGroup(name, c.id)
+}
+
+// Disconnect closes the client's connection as though it went away. The
+// Exchange may keep it for the ReconnectGracePeriod before forgetting it.
+func (c *TestClient) Disconnect() {
+	if c.t.remove(c.id) {
+		c.e.Disconnected(c.id)
+	}
+}
+
+// roundTrip encodes args to JSON and decodes them again.
+func roundTrip(args []interface{}) ([]interface{}, error) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []interface{}
+	err = json.Unmarshal(b, &decoded)
+	return decoded, err
+}
+
+// memoryTransport delivers calls to TestClients.
+type memoryTransport struct {
+	lock    sync.Mutex
+	clients map[string]*TestClient
+}
+
+// AddConnection does nothing; the client is added once it has negotiated.
+func (t *memoryTransport) AddConnection(connectionID string) {}
+
+func (t *memoryTransport) CallClientFunction(relay *relayr.Relay, fn string, args ...interface{}) error {
+	decoded, err := roundTrip(args)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c := t.clients[relay.ConnectionID]
+	if c == nil {
+		return relayr.ErrConnectionNotFound
+	}
+	select {
+	case c.received <- ClientCall{Relay: relay.Name, Method: fn, Args: decoded}:
+		return nil
+	default:
+		return relayr.ErrBufferFull
+	}
+}
+
+func (t *memoryTransport) RemoveConnection(connectionID, reason string) {
+	t.remove(connectionID)
+}
+
+func (t *memoryTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for id, c := range t.clients {
+		delete(t.clients, id)
+		close(c.received)
+	}
+	return nil
+}
+
+// remove forgets a client and closes its Received channel, reporting
+// whether it was connected.
+func (t *memoryTransport) remove(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c := t.clients[id]
+	if c == nil {
+		return false
+	}
+	delete(t.clients, id)
+	close(c.received)
+	return true
+}
@@ -0,0 +1,17 @@
+package relayrtest
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// SequentialIDs returns an ExchangeOptions.IDGenerator that numbers
+// ConnectionIDs "conn-1", "conn-2" and so on, so that tests which record
+// broadcasts or logs see the same IDs on every run. Each generator counts
+// on its own, and may be called concurrently.
+func SequentialIDs() func() string {
+	var n uint64
+	return func() string {
+		return "conn-" + strconv.FormatUint(atomic.AddUint64(&n, 1), 10)
+	}
+}
@@ -0,0 +1,199 @@
+// Package relayrtest helps test code built on relayr. TestClient connects
+// clients to an Exchange in memory for testing relays, TestTransport
+// checks that a custom transport behaves as the Exchange expects, and
+// SequentialIDs makes the ConnectionIDs clients are given predictable.
+package relayrtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simon-whitehead/relayr"
+)
+
+// Timeout is how long the suite waits for a transport to deliver a
+// message or notice a closed connection.
+var Timeout = 5 * time.Second
+
+// Harness describes the transport under test.
+type Harness struct {
+	// Name is the name the transport is registered under.
+	Name string
+
+	// New creates the transport for an Exchange. It is nil for the
+	// transports built into the Exchange, which the suite uses as they
+	// are registered under Name.
+	New func(e *relayr.Exchange) relayr.Transport
+
+	// Connect connects a client to the transport with a ConnectionID that
+	// has just been negotiated with the Exchange, as a real client would.
+	// The transport is expected to call Exchange.Connected. t is nil for
+	// a built-in transport.
+	Connect func(e *relayr.Exchange, t relayr.Transport, connectionID string) (Conn, error)
+
+	// Options are those the Exchanges the suite makes start from, such as
+	// for a transport that only notices a client has gone after a timeout
+	// to make that shorter than Timeout. ReconnectGracePeriod and
+	// OnDisconnect are set by the suite.
+	Options relayr.ExchangeOptions
+}
+
+// Conn is the client's end of a connection to the transport under test.
+type Conn interface {
+	// Receive returns the next message sent to the client. It returns an
+	// error once the connection has been closed, or if nothing arrives
+	// within timeout.
+	Receive(timeout time.Duration) ([]byte, error)
+
+	// Close closes the connection from the client's end.
+	Close() error
+}
+
+// TestRelay is the relay the suite calls client methods through.
+type TestRelay struct{}
+
+// Ping is a server method clients may call.
+func (TestRelay) Ping(r *relayr.Relay) string {
+	return "pong"
+}
+
+// TestTransport runs the conformance suite against the transport h
+// describes.
+func TestTransport(t *testing.T, h Harness) {
+	t.Run("CallClientFunction", func(t *testing.T) {
+		e, tr, disconnected := setup(t, h)
+		id, conn := connect(t, e, tr, h)
+		defer conn.Close()
+
+		if err := e.Clients(TestRelay{}).Client(id).Call("hello", "world"); err != nil {
+			t.Fatalf("calling a client method: %v", err)
+		}
+		msg, err := conn.Receive(Timeout)
+		if err != nil {
+			t.Fatalf("receiving a client method call: %v", err)
+		}
+		if !bytes.Contains(msg, []byte("hello")) {
+			t.Errorf("received %q, which does not name the method called", msg)
+		}
+		select {
+		case id := <-disconnected:
+			t.Errorf("client %s was disconnected", id)
+		default:
+		}
+	})
+
+	t.Run("UnknownConnection", func(t *testing.T) {
+		e, tr, _ := setup(t, h)
+		call := func() error { return e.Clients(TestRelay{}).Client("unknown").Call("hello") }
+		if tr != nil {
+			relay := &relayr.Relay{Name: "TestRelay", ConnectionID: "unknown"}
+			call = func() error { return tr.CallClientFunction(relay, "hello") }
+		}
+		if err := call(); err == nil {
+			t.Error("calling a client method on an unknown connection did not fail")
+		}
+	})
+
+	t.Run("ClientDisconnects", func(t *testing.T) {
+		e, tr, disconnected := setup(t, h)
+		id, conn := connect(t, e, tr, h)
+		conn.Close()
+
+		select {
+		case got := <-disconnected:
+			if got != id {
+				t.Errorf("disconnected %s, want %s", got, id)
+			}
+		case <-time.After(Timeout):
+			t.Fatal("the transport did not call Exchange.Disconnected when the client went away")
+		}
+	})
+
+	t.Run("RemoveConnection", func(t *testing.T) {
+		e, tr, _ := setup(t, h)
+		id, conn := connect(t, e, tr, h)
+		defer conn.Close()
+
+		if err := e.Disconnect(id, "testing"); err != nil {
+			t.Fatalf("disconnecting: %v", err)
+		}
+		deadline := time.Now().Add(Timeout)
+		for time.Now().Before(deadline) {
+			if _, err := conn.Receive(time.Until(deadline)); err != nil {
+				return
+			}
+		}
+		t.Fatal("the connection stayed open after RemoveConnection")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		e, tr, _ := setup(t, h)
+		_, conn := connect(t, e, tr, h)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		defer cancel()
+		if err := e.Close(ctx); err != nil {
+			t.Errorf("closing the Exchange: %v", err)
+		}
+	})
+}
+
+// setup creates an Exchange with the transport registered, unless it is
+// built in, and a channel that receives the ConnectionIDs of the clients
+// it forgets.
+func setup(t *testing.T, h Harness) (*relayr.Exchange, relayr.Transport, chan string) {
+	disconnected := make(chan string, 1)
+	opts := h.Options
+	opts.ReconnectGracePeriod = -1
+	opts.OnDisconnect = func(id string) {
+		select {
+		case disconnected <- id:
+		default:
+		}
+	}
+	e := relayr.NewExchangeWithOptions("http://localhost/relayr", opts)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		defer cancel()
+		e.Close(ctx)
+	})
+
+	var tr relayr.Transport
+	if h.New != nil {
+		tr = h.New(e)
+		if err := e.RegisterTransport(h.Name, tr); err != nil {
+			t.Fatalf("registering the transport: %v", err)
+		}
+	}
+	if err := e.RegisterRelay(TestRelay{}); err != nil {
+		t.Fatalf("registering the relay: %v", err)
+	}
+
+	return e, tr, disconnected
+}
+
+// connect negotiates a connection over the transport and connects a
+// client to it.
+func connect(t *testing.T, e *relayr.Exchange, tr relayr.Transport, h Harness) (string, Conn) {
+	body, _ := json.Marshal(map[string]string{"t": h.Name})
+	req := httptest.NewRequest("POST", "/relayr/negotiate", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+
+	var res struct{ ConnectionID string }
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.ConnectionID == "" {
+		t.Fatalf("negotiating over %s: %d %v", h.Name, w.Code, err)
+	}
+
+	conn, err := h.Connect(e, tr, res.ConnectionID)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+
+	return res.ConnectionID, conn
+}
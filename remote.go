@@ -0,0 +1,223 @@
+package relayr
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ServerInvokeHeader carries the ServerInvokeSecret on requests to the
+// "serverinvoke" operation.
+const ServerInvokeHeader = "X-Relayr-Secret"
+
+// defaultRemoteRetryDelay is how long a RemoteExchange waits before its
+// first retry.
+const defaultRemoteRetryDelay = 100 * time.Millisecond
+
+// serverInvocation is the body of a request to the "serverinvoke"
+// operation: a call to a client method on the members of Group, or on the
+// client with the given ConnectionID.
+type serverInvocation struct {
+	Relay        string
+	Method       string
+	Group        string        `json:",omitempty"`
+	ConnectionID string        `json:",omitempty"`
+	Args         []interface{} `json:",omitempty"`
+}
+
+// serveServerInvoke calls a client method on behalf of another service, as
+// CallGroup does or as a relay's Clients do for a single connection, and
+// answers with the GroupCallResult.
+func (e *Exchange) serveServerInvoke(w http.ResponseWriter, r *http.Request) {
+	secret := r.Header.Get(ServerInvokeHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(e.options.ServerInvokeSecret)) != 1 {
+		httpError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var call serverInvocation
+	body, err := readBody(w, r, e.options.MaxRequestBodySize)
+	if err == nil {
+		err = json.Unmarshal(body, &call)
+	}
+	if err != nil {
+		httpError(w, "invalid invocation", http.StatusBadRequest)
+		return
+	}
+	if call.Method == "" || (call.Group == "") == (call.ConnectionID == "") {
+		httpError(w, "an invocation needs a method and either a group or a ConnectionID", http.StatusBadRequest)
+		return
+	}
+
+	relay := e.getRelayByName(call.Relay, call.ConnectionID)
+	if relay == nil {
+		httpError(w, (&CallError{Relay: call.Relay, Reason: "does not exist"}).Error(), http.StatusNotFound)
+		return
+	}
+
+	var result GroupCallResult
+	if call.ConnectionID != "" {
+		result.Targeted = 1
+		switch err := e.callClientMethod(relay, call.Method, call.Args...); err {
+		case nil:
+			result.Delivered = 1
+		case ErrConnectionGone:
+			httpError(w, ErrConnectionNotFound.Error(), http.StatusNotFound)
+			return
+		default:
+			result.Dropped = 1
+		}
+	} else {
+		var err error
+		result, err = e.callGroupContext(r.Context(), relay, relay.qualifyGroup(call.Group), nil, call.Method, call.Args...)
+		if _, ok := err.(*GroupCallError); err != nil && !ok {
+			httpError(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	jsonResponse(w)
+	json.NewEncoder(w).Encode(result)
+}
+
+// RemoteError is returned by a RemoteExchange when the Exchange refuses a
+// call.
+type RemoteError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("relayr: remote exchange answered %d: %s", e.StatusCode, e.Message)
+}
+
+// RemoteExchange calls client methods through an Exchange served by
+// another process, over its "serverinvoke" operation, so that services
+// other than the one hosting the Exchange can reach its clients.
+type RemoteExchange struct {
+	// Client sends the requests. It defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Retries is how many more times a call is tried when the Exchange
+	// cannot be reached or answers 502, 503 or 504. A call that reached
+	// the Exchange before failing may be delivered twice. Defaults to 2.
+	Retries int
+
+	// RetryDelay is how long to wait before the first retry, doubling
+	// with each one after it. Defaults to 100 milliseconds.
+	RetryDelay time.Duration
+
+	url    string
+	secret string
+}
+
+// NewRemoteExchange returns a RemoteExchange for the Exchange served at
+// url, e.g. "https://rt.example.com/relayr", whose ServerInvokeSecret is
+// secret.
+func NewRemoteExchange(url, secret string) *RemoteExchange {
+	return &RemoteExchange{
+		Retries:    2,
+		RetryDelay: defaultRemoteRetryDelay,
+		url:        strings.TrimSuffix(url, "/") + "/" + opServerInvoke,
+		secret:     secret,
+	}
+}
+
+// CallGroup calls a client method on the members of a group through the
+// named relay, as Exchange.CallGroup does. Only the members connected to
+// the remote Exchange are counted in the result. Calls that could not be
+// delivered to some members are counted as Dropped rather than returned
+// as an error.
+func (x *RemoteExchange) CallGroup(ctx context.Context, relay, group, fn string, args ...interface{}) (GroupCallResult, error) {
+	return x.invoke(ctx, serverInvocation{Relay: relay, Method: fn, Group: group, Args: args})
+}
+
+// CallClient calls a client method on the client with the given
+// ConnectionID through the named relay. It returns ErrConnectionNotFound
+// if the client is not connected to the remote Exchange, and
+// ErrBufferFull if the call could not be queued for it.
+func (x *RemoteExchange) CallClient(ctx context.Context, relay, connectionID, fn string, args ...interface{}) error {
+	result, err := x.invoke(ctx, serverInvocation{Relay: relay, Method: fn, ConnectionID: connectionID, Args: args})
+	if err != nil {
+		return err
+	}
+	if result.Dropped > 0 {
+		return ErrBufferFull
+	}
+	return nil
+}
+
+// invoke sends call to the Exchange, retrying as configured.
+func (x *RemoteExchange) invoke(ctx context.Context, call serverInvocation) (GroupCallResult, error) {
+	body, err := json.Marshal(call)
+	if err != nil {
+		return GroupCallResult{}, err
+	}
+
+	delay := x.RetryDelay
+	for attempt := 0; ; attempt++ {
+		result, retry, err := x.post(ctx, body)
+		if !retry || attempt >= x.Retries {
+			return result, err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return GroupCallResult{}, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// post makes a single request to the Exchange, reporting whether it is
+// worth retrying if it failed.
+func (x *RemoteExchange) post(ctx context.Context, body []byte) (GroupCallResult, bool, error) {
+	var result GroupCallResult
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, x.url, bytes.NewReader(body))
+	if err != nil {
+		return result, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ServerInvokeHeader, x.secret)
+
+	client := x.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return result, ctx.Err() == nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		text := strings.TrimSpace(string(msg))
+		var refusal errorResponse
+		if json.Unmarshal(msg, &refusal) == nil && refusal.Error != "" {
+			text = refusal.Error
+		}
+		if res.StatusCode == http.StatusNotFound && text == ErrConnectionNotFound.Error() {
+			return result, false, ErrConnectionNotFound
+		}
+		switch res.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return result, true, &RemoteError{res.StatusCode, text}
+		}
+		return result, false, &RemoteError{res.StatusCode, text}
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return result, false, errors.New("relayr: invalid answer from remote exchange: " + err.Error())
+	}
+	return result, false, nil
+}
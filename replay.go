@@ -0,0 +1,153 @@
+package relayr
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// replayTransport is the transport of the clients Replay makes. Nothing
+// is sent to them.
+type replayTransport struct{}
+
+func (replayTransport) AddConnection(connectionID string) {}
+
+func (replayTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) error {
+	return nil
+}
+
+func (replayTransport) RemoveConnection(connectionID, reason string) {}
+
+func (replayTransport) Close() error { return nil }
+
+// Replay plays a session recorded with TapConnection back into e: a new
+// client, speaking the codec and protocol version the recorded one did,
+// makes the calls the recorded client made, in order and as far apart as
+// they were made, divided by speed. A speed of 0 or less makes them
+// without waiting. The calls are subject to the Exchange's rate limits,
+// authorization rules and interceptors, and go through the transport
+// named "replay" for those that tell transports apart; their results,
+// and the frames sent to the client, are discarded. Replay returns once
+// the calls have been made and the client has disconnected, or with an
+// error if the recording cannot be read or the Exchange closes.
+func Replay(e *Exchange, r io.Reader, speed float64) error {
+	first, err := readTapRecord(r)
+	if err != nil {
+		return err
+	}
+	if first.dir != tapHeader {
+		return errTapHeader
+	}
+	var desc tapDescription
+	if err := e.json.Unmarshal(first.data, &desc); err != nil {
+		return err
+	}
+
+	c, err := e.newClient("")
+	if err != nil {
+		return err
+	}
+	c.setTransport(replayTransport{})
+	c.codec = e.codecByName(desc.Codec)
+	c.protocol = negotiatedVersion(desc.Version)
+	c.caps = negotiatedCapabilities(nil, c.protocol)
+	cid := c.ConnectionID
+	e.addClient(c, nil)
+	e.logger.Debugf("replaying the session of %s as %s", desc.ConnectionID, cid)
+
+	var calls sync.WaitGroup
+	err = e.replayFrames(r, cid, c, speed, &calls)
+
+	// wait for the calls queued to run before the client goes, which
+	// would discard them
+	finished := make(chan struct{})
+	go func() {
+		calls.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-e.done:
+		if err == nil {
+			err = errExchangeClosed
+		}
+	}
+	e.forgetClient(cid, ReasonClosed)
+	return err
+}
+
+// replayFrames makes the calls recorded in r as the client c, adding those
+// queued to run to calls.
+func (e *Exchange) replayFrames(r io.Reader, cid string, c *client, speed float64, calls *sync.WaitGroup) error {
+	var last time.Time
+	for {
+		rec, err := readTapRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.dir != tapInbound {
+			continue
+		}
+
+		if !last.IsZero() && speed > 0 {
+			wait := time.NewTimer(time.Duration(float64(rec.at.Sub(last)) / speed))
+			select {
+			case <-wait.C:
+			case <-e.done:
+				wait.Stop()
+				return errExchangeClosed
+			}
+		}
+		last = rec.at
+
+		m, err := decodeFrame(c.codec, c.protocol, rec.data)
+		if err != nil {
+			e.logger.Errorf("replaying an invalid frame as %s: %v", cid, err)
+			continue
+		}
+		e.replayFrame(cid, &m, calls)
+	}
+}
+
+// replayFrame makes a recorded call as the client with the given
+// ConnectionID, as the transports do for the frames clients send. Pings
+// and calls to client methods are skipped.
+func (e *Exchange) replayFrame(cid string, m *inboundFrame, calls *sync.WaitGroup) {
+	switch {
+	case m.Type == frameJoinGroup || m.Type == frameLeaveGroup:
+		e.receiveGroupRequest(cid, m)
+		return
+	case m.Type != frameServerInvocation:
+		return
+	case m.Method == ackMethod:
+		e.receiveAck(cid, m.Arguments)
+		return
+	case m.Method == cancelMethod:
+		e.receiveCancel(cid, m.Arguments)
+		return
+	case m.Method == stateMethod:
+		e.receiveStateRequest(cid, m.Arguments)
+		return
+	}
+
+	if err := e.allowCall(cid, m.Relay, m.Method); err != nil {
+		e.logger.Infof("replayed call %s.%s refused: %v", m.Relay, m.Method, err)
+		return
+	}
+	if err := e.authorizeCall(cid, "replay", m.Relay, m.Method, m.Arguments); err != nil {
+		e.logger.Infof("replayed call %s.%s refused: %v", m.Relay, m.Method, err)
+		return
+	}
+	calls.Add(1)
+	err := e.runCall(cid, m.Relay, m.Method, func() {
+		defer calls.Done()
+		e.serveCall(m.Relay, cid, "replay", m.InvocationID, m.TraceParent, m.Method, m.Arguments, nil)
+	})
+	if err != nil {
+		calls.Done()
+		e.logger.Infof("replayed call %s.%s refused: %v", m.Relay, m.Method, err)
+	}
+}
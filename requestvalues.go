@@ -0,0 +1,36 @@
+package relayr
+
+import "net/http"
+
+// Value returns the value the ContextExtractor took under key from the
+// requests of the client this Relay interacts with: from the request
+// carrying the call being served, if it took one there, else from those
+// the client negotiated and opened its websocket with. It returns nil if
+// there is none or the client is no longer connected.
+func (r *Relay) Value(key string) interface{} {
+	if v, ok := r.values[key]; ok {
+		return v
+	}
+	if c := r.exchange.getClientByConnectionID(r.ConnectionID); c != nil {
+		v, _ := c.extracted.Get(key)
+		return v
+	}
+	return nil
+}
+
+// extractValues returns the values the ContextExtractor takes from a
+// request, or nil if there is no ContextExtractor.
+func (e *Exchange) extractValues(r *http.Request) map[string]interface{} {
+	if e.options.ContextExtractor == nil {
+		return nil
+	}
+	return e.options.ContextExtractor(r)
+}
+
+// extractConnectionValues merges the values the ContextExtractor takes
+// from a request into those kept for a client.
+func (e *Exchange) extractConnectionValues(c *client, r *http.Request) {
+	for k, v := range e.extractValues(r) {
+		c.extracted.Set(k, v)
+	}
+}
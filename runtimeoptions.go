@@ -0,0 +1,138 @@
+package relayr
+
+import "time"
+
+// RuntimeOptions are the ExchangeOptions that can be changed while the
+// Exchange runs, with UpdateOptions, such as to tune rate limits and
+// queues in production without a restart. Each is as the ExchangeOptions
+// field of the same name describes, with the same defaults. New
+// connections take up a change at once. Existing ones take it up as they
+// next use the value: the next call or frame queued for rate limits,
+// queue sizes and overflow policies; the next keep-alive ping, poll or
+// idle check for the timeouts; the next message read or written for
+// MaxMessageSize and CompressionThresholdBytes; and the next frame sent
+// for the bandwidth limits. OutChannelSize only
+// applies to websockets opened after it changes.
+type RuntimeOptions struct {
+	CallRateLimit                RateLimit
+	MethodRateLimits             map[string]RateLimit
+	RateLimitDisconnectThreshold int
+
+	OverflowPolicy        OverflowPolicy
+	GroupOverflowPolicies map[string]OverflowPolicy
+	SlowClientGracePeriod time.Duration
+	OutChannelSize        int
+	LongPollQueueSize     int
+
+	KeepAliveTimeout    time.Duration
+	IdleTimeout         time.Duration
+	LongPollIdleTimeout time.Duration
+
+	MaxMessageSize            int64
+	CompressionThresholdBytes int
+
+	BandwidthLimit     int
+	TagBandwidthLimits map[string]int
+}
+
+// runtimeOptions returns the RuntimeOptions of o.
+func (o *ExchangeOptions) runtimeOptions() RuntimeOptions {
+	return RuntimeOptions{
+		CallRateLimit:                o.CallRateLimit,
+		MethodRateLimits:             o.MethodRateLimits,
+		RateLimitDisconnectThreshold: o.RateLimitDisconnectThreshold,
+		OverflowPolicy:               o.OverflowPolicy,
+		GroupOverflowPolicies:        o.GroupOverflowPolicies,
+		SlowClientGracePeriod:        o.SlowClientGracePeriod,
+		OutChannelSize:               o.OutChannelSize,
+		LongPollQueueSize:            o.LongPollQueueSize,
+		KeepAliveTimeout:             o.KeepAliveTimeout,
+		IdleTimeout:                  o.IdleTimeout,
+		LongPollIdleTimeout:          o.LongPollIdleTimeout,
+		MaxMessageSize:               o.MaxMessageSize,
+		CompressionThresholdBytes:    o.CompressionThresholdBytes,
+		BandwidthLimit:               o.BandwidthLimit,
+		TagBandwidthLimits:           o.TagBandwidthLimits,
+	}
+}
+
+// setRuntimeOptions sets the fields of o that r holds.
+func (o *ExchangeOptions) setRuntimeOptions(r RuntimeOptions) {
+	o.CallRateLimit = r.CallRateLimit
+	o.MethodRateLimits = r.MethodRateLimits
+	o.RateLimitDisconnectThreshold = r.RateLimitDisconnectThreshold
+	o.OverflowPolicy = r.OverflowPolicy
+	o.GroupOverflowPolicies = r.GroupOverflowPolicies
+	o.SlowClientGracePeriod = r.SlowClientGracePeriod
+	o.OutChannelSize = r.OutChannelSize
+	o.LongPollQueueSize = r.LongPollQueueSize
+	o.KeepAliveTimeout = r.KeepAliveTimeout
+	o.IdleTimeout = r.IdleTimeout
+	o.LongPollIdleTimeout = r.LongPollIdleTimeout
+	o.MaxMessageSize = r.MaxMessageSize
+	o.CompressionThresholdBytes = r.CompressionThresholdBytes
+	o.BandwidthLimit = r.BandwidthLimit
+	o.TagBandwidthLimits = r.TagBandwidthLimits
+}
+
+// clone returns a copy of r whose maps can be changed without changing
+// r's.
+func (r RuntimeOptions) clone() RuntimeOptions {
+	if r.MethodRateLimits != nil {
+		limits := make(map[string]RateLimit, len(r.MethodRateLimits))
+		for k, v := range r.MethodRateLimits {
+			limits[k] = v
+		}
+		r.MethodRateLimits = limits
+	}
+	if r.GroupOverflowPolicies != nil {
+		policies := make(map[string]OverflowPolicy, len(r.GroupOverflowPolicies))
+		for k, v := range r.GroupOverflowPolicies {
+			policies[k] = v
+		}
+		r.GroupOverflowPolicies = policies
+	}
+	if r.TagBandwidthLimits != nil {
+		limits := make(map[string]int, len(r.TagBandwidthLimits))
+		for k, v := range r.TagBandwidthLimits {
+			limits[k] = v
+		}
+		r.TagBandwidthLimits = limits
+	}
+	return r
+}
+
+// runtime returns the RuntimeOptions in effect, which must not be
+// changed.
+func (e *Exchange) runtime() *RuntimeOptions {
+	return e.tuned.Load()
+}
+
+// Options returns the RuntimeOptions in effect, defaults filled in.
+func (e *Exchange) Options() RuntimeOptions {
+	return e.runtime().clone()
+}
+
+// UpdateOptions changes the RuntimeOptions while the Exchange runs. update
+// is passed a copy of those in effect to change, and the changed copy
+// replaces them at once, zero values taking their defaults, so that no
+// call or connection sees some of the changes without the others.
+// Updates made concurrently are applied one after the other. update must
+// not keep o, or its maps, once it returns.
+func (e *Exchange) UpdateOptions(update func(o *RuntimeOptions)) {
+	e.tuneLock.Lock()
+	defer e.tuneLock.Unlock()
+
+	r := e.runtime().clone()
+	update(&r)
+	o := e.options
+	o.setRuntimeOptions(r)
+	o = o.withDefaults()
+	r = o.runtimeOptions()
+	e.tuned.Store(&r)
+
+	e.logger.Infof("options updated")
+	if r.IdleTimeout > 0 {
+		e.startEvictingIdle()
+	}
+}
@@ -0,0 +1,133 @@
+package relayr
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ScheduleID identifies a call made with Schedule, for CancelSchedule.
+type ScheduleID uint64
+
+// CallTarget is what a scheduled call is made to: a *ClientTarget, such as
+// Clients(relayType).Group("room"), User(id) or Client(id), or a
+// *GroupOperations.
+type CallTarget interface {
+	Call(fn string, args ...interface{}) error
+}
+
+var errNoTarget = errors.New("relayr: Schedule needs a target")
+
+// schedules holds the calls waiting in Schedule.
+type schedules struct {
+	lock   sync.Mutex
+	next   ScheduleID
+	calls  map[ScheduleID]*scheduledCall
+	closed bool
+}
+
+type scheduledCall struct {
+	timer        *time.Timer
+	connectionID string // the single client the call is made to, if it is
+}
+
+// Schedule makes a call to target after d. The clients called are those
+// the target selects when the call is made, so clients that have left a
+// group or disconnected in the meantime are not called, and the call goes
+// through the OutboundInterceptors as any other does. Failures to deliver
+// it are reported to the OnError handlers. Calls still waiting when the
+// Exchange is closed are cancelled, as are those made to a single client
+// that disconnects, with CancelSchedulesOnDisconnect.
+func (e *Exchange) Schedule(d time.Duration, target CallTarget, fn string, args ...interface{}) (ScheduleID, error) {
+	if target == nil {
+		return 0, errNoTarget
+	}
+	call := &scheduledCall{}
+	if t, ok := target.(*ClientTarget); ok {
+		call.connectionID = t.connectionID
+		if t.caller {
+			call.connectionID = t.ops.relay.ConnectionID
+		}
+	}
+
+	s := &e.schedules
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, errExchangeClosed
+	}
+	if s.calls == nil {
+		s.calls = make(map[ScheduleID]*scheduledCall)
+	}
+	s.next++
+	id := s.next
+	s.calls[id] = call
+	call.timer = time.AfterFunc(d, func() { e.runScheduled(id, target, fn, args) })
+	return id, nil
+}
+
+// CancelSchedule cancels a call made with Schedule, reporting whether it
+// was still waiting to be made.
+func (e *Exchange) CancelSchedule(id ScheduleID) bool {
+	s := &e.schedules
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	call, ok := s.calls[id]
+	if !ok {
+		return false
+	}
+	delete(s.calls, id)
+	call.timer.Stop()
+	return true
+}
+
+// runScheduled makes a scheduled call that has not been cancelled. Close
+// waits for it.
+func (e *Exchange) runScheduled(id ScheduleID, target CallTarget, fn string, args []interface{}) {
+	s := &e.schedules
+	s.lock.Lock()
+	if _, ok := s.calls[id]; !ok || s.closed {
+		s.lock.Unlock()
+		return
+	}
+	delete(s.calls, id)
+	e.wg.Add(1)
+	s.lock.Unlock()
+	defer e.wg.Done()
+
+	if err := target.Call(fn, args...); err != nil {
+		e.logger.Errorf("making scheduled call %s: %v", fn, err)
+		e.reportError(TransportError, "", "", fn, err)
+	}
+}
+
+// cancelConnection cancels the scheduled calls made to the single client
+// with the given ConnectionID.
+func (s *schedules) cancelConnection(cid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, call := range s.calls {
+		if call.connectionID == cid {
+			delete(s.calls, id)
+			call.timer.Stop()
+		}
+	}
+}
+
+// close cancels every scheduled call, and any made later.
+func (s *schedules) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for id, call := range s.calls {
+		delete(s.calls, id)
+		call.timer.Stop()
+	}
+}
+
+// len returns the number of calls waiting to be made.
+func (s *schedules) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.calls)
+}
@@ -0,0 +1,147 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	c := dial(t, srv, "websocket")
+	ticks := calls(c, "Ticker", "tick")
+	if err := e.AddToGroup("room", c.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	room := e.Clients(Ticker{}).Group("room")
+
+	start := time.Now()
+	fired, err := e.Schedule(100*time.Millisecond, room, "tick", "later")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := e.Stats().ScheduledCalls; n != 1 {
+		t.Fatalf("Stats counts %d scheduled calls, want 1", n)
+	}
+	if args := receive(t, ticks); string(args[0]) != `"later"` {
+		t.Fatalf("received %s", args[0])
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("a call scheduled for 100ms was made after %v", waited)
+	}
+	if n := e.Stats().ScheduledCalls; n != 0 {
+		t.Fatalf("once made, Stats counts %d scheduled calls", n)
+	}
+	if e.CancelSchedule(fired) {
+		t.Fatal("cancelled a call already made")
+	}
+
+	// a cancelled call is not made; what arrives next shows nothing came
+	// before it
+	cancelled, err := e.Schedule(50*time.Millisecond, room, "tick", "cancelled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.CancelSchedule(cancelled) {
+		t.Fatal("could not cancel a call waiting to be made")
+	}
+	if e.CancelSchedule(cancelled) {
+		t.Fatal("cancelled a call twice")
+	}
+	if _, err := e.Schedule(100*time.Millisecond, room, "tick", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, ticks); string(args[0]) != `"after"` {
+		t.Fatalf("received %s, want the call after the cancelled one", args[0])
+	}
+
+	if _, err := e.Schedule(time.Millisecond, nil, "tick"); err != errNoTarget {
+		t.Fatalf("scheduling a call without a target failed with %v", err)
+	}
+}
+
+// TestScheduleChurn checks that a scheduled call reaches the clients its
+// target selects when it is made, not when it was scheduled.
+func TestScheduleChurn(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	leaving, joining := dial(t, srv, "websocket"), dial(t, srv, "longpoll")
+	left, joined := calls(leaving, "Ticker", "tick"), calls(joining, "Ticker", "tick")
+	if err := e.AddToGroup("room", leaving.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Schedule(100*time.Millisecond, e.Clients(Ticker{}).Group("room"), "tick", "room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RemoveFromGroup("room", leaving.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddToGroup("room", joining.ConnectionID()); err != nil {
+		t.Fatal(err)
+	}
+
+	if args := receive(t, joined); string(args[0]) != `"room"` {
+		t.Fatalf("the client that joined received %s", args[0])
+	}
+	if err := e.Clients(Ticker{}).Client(leaving.ConnectionID()).Call("tick", "direct"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, left); string(args[0]) != `"direct"` {
+		t.Fatalf("the client that left received %s, want nothing before the direct call", args[0])
+	}
+}
+
+func TestScheduleCancelledOnDisconnect(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{ReconnectGracePeriod: -1, CancelSchedulesOnDisconnect: true}, Ticker{})
+	c := dial(t, srv, "websocket")
+	other := dial(t, srv, "websocket")
+	ticks := calls(other, "Ticker", "tick")
+	ops := e.Clients(Ticker{})
+	if _, err := e.Schedule(time.Hour, ops.Client(c.ConnectionID()), "tick"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Schedule(50*time.Millisecond, ops.Client(other.ConnectionID()), "tick", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Disconnect(c.ConnectionID(), "testing"); err != nil {
+		t.Fatal(err)
+	}
+	if args := receive(t, ticks); string(args[0]) != `"other"` {
+		t.Fatalf("received %s", args[0])
+	}
+	if n := e.Stats().ScheduledCalls; n != 0 {
+		t.Fatalf("Stats counts %d scheduled calls once the client called disconnected", n)
+	}
+}
+
+func TestScheduleDroppedOnClose(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	var sent atomic.Int32
+	e.UseOutboundInterceptor(func(msg *OutgoingMessage, next func()) {
+		sent.Add(1)
+		next()
+	})
+	c := dial(t, srv, "websocket")
+	for i := 0; i < 3; i++ {
+		if _, err := e.Schedule(50*time.Millisecond, e.Clients(Ticker{}).Client(c.ConnectionID()), "tick"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := e.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.Stats().ScheduledCalls; n != 0 {
+		t.Fatalf("Stats counts %d scheduled calls once closed", n)
+	}
+	if _, err := e.Schedule(time.Millisecond, e.Clients(Ticker{}).Client(c.ConnectionID()), "tick"); !errors.Is(err, errExchangeClosed) {
+		t.Fatalf("scheduling a call once closed failed with %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := sent.Load(); n != 0 {
+		t.Fatalf("%d scheduled calls were made after Close", n)
+	}
+}
@@ -0,0 +1,203 @@
+package relayr
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// RelaySchema describes a relay's methods as clients call them, so that
+// client code such as TypeScript definitions can be generated from it.
+type RelaySchema = protocol.RelaySchema
+
+// MethodSchema describes a relay method.
+type MethodSchema = protocol.MethodSchema
+
+// ParamSchema describes a parameter of a relay method. Type is one of
+// "string", "integer", "number", "boolean", "array", "object" or "any",
+// the JSON type its arguments take.
+type ParamSchema = protocol.ParamSchema
+
+// ParamNamer can be implemented by a relay to name the parameters of its
+// methods in its schema, keyed by method name. Parameters it does not
+// name are called arg1, arg2 and so on.
+type ParamNamer interface {
+	RelayParams() map[string][]string
+}
+
+// Schema describes the relays registered with the Exchange, ordered by
+// name and with their methods ordered by name, so that it is the same for
+// the same relays however they were registered, along with the client
+// methods described with DescribeClientMethod.
+func (e *Exchange) Schema() []RelaySchema {
+	relays := e.relayList()
+	schema := make([]RelaySchema, 0, len(relays))
+	for _, r := range relays {
+		s := relaySchema(r)
+		s.ClientArgs = e.describedClientArgs(r.Name)
+		schema = append(schema, s)
+	}
+	sort.Slice(schema, func(i, j int) bool { return schema[i].Name < schema[j].Name })
+	return schema
+}
+
+func relaySchema(r Relay) RelaySchema {
+	var names map[string][]string
+	if n, ok := r.receiver.Interface().(ParamNamer); ok {
+		names = n.RelayParams()
+	}
+
+	s := RelaySchema{Name: r.Name, Methods: make([]MethodSchema, 0, len(r.methods))}
+	for _, name := range r.methods {
+		t := r.receiver.MethodByName(name).Type()
+		m := MethodSchema{Name: name, Script: lowerFirst(name), Params: []ParamSchema{}, Variadic: t.IsVariadic(), Upload: takesUpload(t), Progress: takesProgress(t), Unavailable: r.refused[name]}
+		for i := firstArg(t); i < t.NumIn(); i++ {
+			p := t.In(i)
+			if m.Variadic && i == t.NumIn()-1 {
+				p = p.Elem()
+			}
+			n := len(m.Params)
+			param := fmt.Sprintf("arg%d", n+1)
+			if n < len(names[name]) {
+				param = names[name][n]
+			}
+			m.Params = append(m.Params, ParamSchema{Name: param, Type: jsonType(p)})
+		}
+		for i := 0; i < t.NumOut(); i++ {
+			if out := t.Out(i); out != errorType {
+				if out.Kind() == reflect.Chan {
+					m.Stream = true
+					out = out.Elem()
+				}
+				m.Returns = jsonType(out)
+			}
+		}
+		s.Methods = append(s.Methods, m)
+	}
+	sort.Slice(s.Methods, func(i, j int) bool { return s.Methods[i].Name < s.Methods[j].Name })
+	return s
+}
+
+// firstArg returns the index of the first parameter of a relay method's
+// type that clients pass an argument for, after those the Exchange passes:
+// the *Relay, if it takes one, and then any context, IncomingStream and
+// Progress, in that order.
+func firstArg(t reflect.Type) int {
+	i := 0
+	if t.NumIn() > i && t.In(i) == relayType {
+		i++
+	}
+	if t.NumIn() > i && t.In(i) == contextType {
+		i++
+	}
+	if t.NumIn() > i && t.In(i) == incomingStreamType {
+		i++
+	}
+	if t.NumIn() > i && t.In(i) == progressType {
+		i++
+	}
+	return i
+}
+
+// takesUpload reports whether a relay method's type reads an
+// IncomingStream.
+func takesUpload(t reflect.Type) bool {
+	return takesLead(t, incomingStreamType)
+}
+
+// takesProgress reports whether a relay method's type reports its
+// progress.
+func takesProgress(t reflect.Type) bool {
+	return takesLead(t, progressType)
+}
+
+// takesLead reports whether a relay method's type has a parameter of type
+// lead among those before the arguments clients pass.
+func takesLead(t reflect.Type, lead reflect.Type) bool {
+	for i := 0; i < firstArg(t); i++ {
+		if t.In(i) == lead {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignature returns an error if clients cannot call a relay method of
+// type t, as it takes a parameter that arguments cannot be decoded into,
+// such as a channel or a func, or one of those the Exchange passes out of
+// place.
+func checkSignature(t reflect.Type) error {
+	for i := firstArg(t); i < t.NumIn(); i++ {
+		if !decodable(paramType(t, i)) {
+			return fmt.Errorf("takes a %v, which arguments cannot be decoded into", t.In(i))
+		}
+	}
+	return nil
+}
+
+// decodable reports whether arguments can be decoded into values of type
+// t: those of a type with a converter registered, or one that decodes
+// itself, can be, while channels, funcs, complex numbers and interfaces
+// with methods, such as a context, cannot.
+func decodable(t reflect.Type) bool {
+	if _, ok := converterFor(t); ok {
+		return true
+	}
+	if t == relayType {
+		return false
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Interface:
+		return t.NumMethod() == 0
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return decodable(t.Elem())
+	case reflect.Map:
+		return decodable(t.Key()) && decodable(t.Elem())
+	}
+	return true
+}
+
+// jsonType names the JSON type values of t are encoded as.
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch p := reflect.PtrTo(t); {
+	case t == timeType:
+		return "string"
+	case t == durationType:
+		return "number" // milliseconds
+	case t.Implements(jsonMarshalerType) || p.Implements(jsonMarshalerType):
+		return "any"
+	case t.Implements(textMarshalerType) || p.Implements(textMarshalerType):
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string" // base64-encoded
+		}
+		return "array"
+	case reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "any"
+}
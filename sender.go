@@ -0,0 +1,23 @@
+package relayr
+
+import "github.com/simon-whitehead/relayr/protocol"
+
+// Sender identifies the client whose call to a relay method made a call
+// to client methods, with IncludeSenderID. It is sent with the call, and
+// relayed with it through the Backplane. UserID is given by the
+// UserIDProvider.
+type Sender = protocol.Sender
+
+// senderOf returns the Sender the calls made while serving a call from
+// the client with the given ConnectionID carry, or nil without
+// IncludeSenderID.
+func (e *Exchange) senderOf(cid string) *Sender {
+	if !e.options.IncludeSenderID || cid == "" {
+		return nil
+	}
+	s := &Sender{ConnectionID: cid}
+	if c := e.getClientByConnectionID(cid); c != nil {
+		s.UserID = c.userID
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package relayr
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// The commands of the control frames that tell a client, with
+// NotifySlowClients, that its connection has become slow and that it has
+// recovered.
+const (
+	commandSlow      = protocol.CommandSlow
+	commandRecovered = protocol.CommandRecovered
+)
+
+// slowness follows why a websocket connection is slow: its last ping took
+// longer than the SlowRoundTrip to answer, or its send queue has stayed
+// over the HighWaterMark, or both.
+type slowness struct {
+	lock  sync.Mutex
+	rtt   bool
+	queue bool
+	told  bool // the client has been told it is slow, and not since that it recovered
+}
+
+// set records whether the connection is slow for one of the reasons,
+// returning the command to send the client if that changed whether it is
+// slow at all.
+func (s *slowness) set(byRTT, slow bool) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if byRTT {
+		s.rtt = slow
+	} else {
+		s.queue = slow
+	}
+	switch slow = s.rtt || s.queue; {
+	case slow && !s.told:
+		s.told = true
+		return commandSlow
+	case !slow && s.told:
+		s.told = false
+		return commandRecovered
+	}
+	return ""
+}
+
+// slowChanged records whether a connection is slow by its round trip or by
+// its queue, and tells the client if that changed whether it is slow. The
+// frame is sent from its own goroutine, as this may be called with the
+// connection's queueLock held.
+func (c *connection) slowChanged(byRTT, slow bool) {
+	cmd := c.slow.set(byRTT, slow)
+	if cmd == "" || !c.e.options.NotifySlowClients {
+		return
+	}
+	c.e.logger.Debugf("telling connection %s it is %s", c.id, cmd)
+	go c.e.sendFrame(c.id, "slow notice", &controlFrame{Command: cmd})
+}
+
+// slowRoundTrip returns the SlowRoundTrip given to negotiating clients, in
+// milliseconds: none without NotifySlowClients.
+func (e *Exchange) slowRoundTrip() int64 {
+	if !e.options.NotifySlowClients {
+		return 0
+	}
+	return e.options.SlowRoundTrip.Milliseconds()
+}
+
+// roundTripPercentiles returns the 50th, 90th and 99th percentiles of the
+// round trips of the connections that have answered a ping.
+func roundTripPercentiles(infos []ConnectionInfo) (p50, p90, p99 time.Duration) {
+	var rtts []time.Duration
+	for _, info := range infos {
+		if info.RoundTrip > 0 {
+			rtts = append(rtts, info.RoundTrip)
+		}
+	}
+	if len(rtts) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	at := func(p int) time.Duration {
+		return rtts[(len(rtts)-1)*p/100]
+	}
+	return at(50), at(90), at(99)
+}
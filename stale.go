@@ -0,0 +1,136 @@
+package relayr
+
+import (
+	"sort"
+	"time"
+)
+
+// seen records that a client was heard from.
+func (c *client) seen() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// seenClient records that the client with the given ConnectionID was
+// heard from, without it counting as activity for the IdleTimeout, as for
+// keep-alives and polls.
+func (e *Exchange) seenClient(cid string) {
+	if c := e.getClientByConnectionID(cid); c != nil {
+		c.seen()
+	}
+}
+
+// isPolling reports whether the client with the given ConnectionID has a
+// poll request waiting.
+func (t *longPollTransport) isPolling(cid string) bool {
+	t.clock.RLock()
+	c, ok := t.connections[cid]
+	t.clock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.polling > 0
+}
+
+// StaleConnections describes the connected clients that have not been
+// heard from for olderThan, oldest first, by their LastSeen: a websocket
+// that neither sent anything nor answered a keep-alive ping, or a
+// long-poll client that neither polled nor called the server. A long-poll
+// client with a poll waiting is never stale, and one between polls only
+// once it has gone the LongPollMaxWait and the LongPollIdleTimeout
+// without polling, the longest it may. Clients waiting to reconnect are
+// left out.
+func (e *Exchange) StaleConnections(olderThan time.Duration) []ConnectionInfo {
+	ids := e.staleConnectionIDs(olderThan)
+	r := make([]ConnectionInfo, 0, len(ids))
+	for _, id := range ids {
+		if info, ok := e.ConnectionInfo(id); ok {
+			r = append(r, info)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].LastSeen.Before(r[j].LastSeen)
+	})
+	return r
+}
+
+// ReapStale disconnects the clients StaleConnections reports for
+// olderThan for good, as Disconnect does, reporting them to
+// OnDisconnectWithReason with ReasonStale, and returns how many it
+// disconnected. It may be called at any time, such as while calls are
+// being made to the clients.
+func (e *Exchange) ReapStale(olderThan time.Duration) int {
+	start := time.Now().UnixNano()
+	n := 0
+	for _, id := range e.staleConnectionIDs(olderThan) {
+		// heard from since it was found stale
+		if c := e.getClientByConnectionID(id); c == nil || c.lastSeen.Load() >= start {
+			continue
+		}
+		e.logger.Infof("reaping client %s, not heard from for %v", id, olderThan)
+		e.counters.reaped.Add(1)
+		e.dropClient(id, ReasonStale)
+		n++
+	}
+	return n
+}
+
+// staleConnectionIDs returns the ConnectionIDs of the clients that have
+// not been heard from for olderThan, as StaleConnections describes.
+func (e *Exchange) staleConnectionIDs(olderThan time.Duration) []string {
+	now := time.Now()
+	cutoff := now.Add(-olderThan).UnixNano()
+	pollCutoff := cutoff
+	if window := e.options.LongPollMaxWait + e.runtime().LongPollIdleTimeout; window > olderThan {
+		pollCutoff = now.Add(-window).UnixNano()
+	}
+	longPoll := e.transports["longpoll"]
+
+	var stale []string
+	e.mapLock.RLock()
+	for id, c := range e.connected {
+		if c.isWebhook() || c.isLocal() || c.isHubbed() {
+			continue
+		}
+		limit := cutoff
+		if c.transport() == longPoll {
+			limit = pollCutoff
+		}
+		if c.lastSeen.Load() < limit {
+			stale = append(stale, id)
+		}
+	}
+	e.mapLock.RUnlock()
+
+	// a poll is heard from as it starts, and may wait as long as the
+	// LongPollMaxWait to be answered
+	r := stale[:0]
+	for _, id := range stale {
+		if !longPoll.(*longPollTransport).isPolling(id) {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+// reapStale disconnects the clients not heard from for the
+// StaleConnectionTimeout, checking every quarter of it until the Exchange
+// is closed.
+func (e *Exchange) reapStale() {
+	defer e.wg.Done()
+
+	timeout := e.options.StaleConnectionTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.done:
+			return
+		}
+		e.ReapStale(timeout)
+	}
+}
@@ -0,0 +1,429 @@
+package relayr
+
+import (
+	"container/list"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateMethod is the reserved method name clients call to ask for a
+// group's state in full, when a patch to it does not apply to the version
+// they have. Like ackMethod, it cannot clash with a relay method.
+const stateMethod = "__relayrState"
+
+// stateStore keeps the last state passed to CallStateful for each group,
+// relay and method, so that the next can be sent as a patch against it.
+// Its lock is always acquired after the mapLock and the groups' locks.
+type stateStore struct {
+	lock    sync.Mutex
+	states  map[stateKey]*groupState
+	byGroup map[string]map[stateKey]*groupState
+	order   *list.List // the states, least recently updated first
+	bytes   int64
+	max     int64
+	evicted uint64
+}
+
+type stateKey struct {
+	group, relay, method string
+}
+
+// groupState is the state last sent to a group by a client method.
+type groupState struct {
+	key     stateKey
+	send    sync.Mutex // held while the state is updated and sent, so that versions are sent in turn
+	version uint64
+	doc     interface{}       // the state as it is encoded, decoded into plain values
+	size    int64             // the size of the state encoded as JSON
+	synced  map[string]uint64 // by ConnectionID, the version each member was last sent
+	elem    *list.Element     // in stateStore.order
+}
+
+// CallStateful invokes a client-side method across a Group of clients,
+// passing it state, as Call does, but sends each member only what has
+// changed since the state it was last sent: a JSON Patch (RFC 6902)
+// against that version. Members that have not been sent it yet, those
+// that join the group, and those whose version the patch does not apply
+// to, which ask for it, are sent the state in full. The client script
+// keeps each state and passes it to the method's handlers whole, with the
+// patch that was applied to it, if any; handlers must not change it.
+//
+// The state is compared as it is encoded as JSON. The last state sent to
+// each group by each method is kept, up to MaxStateBytes between them,
+// those updated least recently being dropped to make room. Outbound
+// interceptors are not run, except for members that are sent the state
+// as an ordinary call: those connected over other transports or with
+// clients without CapabilityPatch. The target must be Group.
+func (t *ClientTarget) CallStateful(fn string, state interface{}) error {
+	if t.group == "" || t.caller || t.all || t.connectionID != "" || t.user != "" || t.pattern != "" || t.tagged || t.where != nil {
+		return errors.New("relayr: CallStateful needs a group")
+	}
+	return t.ops.e.callStateful(t.ops.relay, t.group, t.except, fn, state)
+}
+
+// CallStateful invokes a client-side method across a Group of clients,
+// passing it state, as ClientTarget.CallStateful does.
+func (g *GroupOperations) CallStateful(fn string, state interface{}) error {
+	return g.e.callStateful(g.relay, g.group, nil, fn, state)
+}
+
+// callStateful sends state to the members of a group and relays it
+// through the Backplane, for each instance to send to its own.
+func (e *Exchange) callStateful(relay *Relay, group string, except []string, fn string, state interface{}) error {
+	err := e.deliverStateful(relay, group, except, fn, state)
+	if _, ok := err.(*GroupCallError); err == nil || ok {
+		e.publishToBackplane(BackplaneMessage{Relay: relay.Name, Method: fn, Group: group, Except: except, Stateful: true, Arguments: wireArgs([]interface{}{state})})
+	}
+	return err
+}
+
+// deliverStateful sends state to the members of a group connected to this
+// Exchange, skipping those listed in except, each as a patch against the
+// version it was last sent or in full. Those skipped are sent the next in
+// full. It returns a *GroupCallError if it could not be queued for some
+// of them.
+func (e *Exchange) deliverStateful(relay *Relay, group string, except []string, fn string, state interface{}) (err error) {
+	relay, span := e.startFanOut(relay, group, fn)
+	defer func() { span.End(err) }()
+
+	b, err := e.json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := e.json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+
+	s := e.states.Load()
+	if s == nil {
+		e.states.CompareAndSwap(nil, &stateStore{
+			states:  make(map[stateKey]*groupState),
+			byGroup: make(map[string]map[stateKey]*groupState),
+			order:   list.New(),
+			max:     e.options.MaxStateBytes,
+		})
+		s = e.states.Load()
+	}
+	st := s.state(stateKey{group, relay.Name, fn})
+	st.send.Lock()
+	defer st.send.Unlock()
+
+	// the patch is sent only if it is smaller than the state itself
+	var patch []patchOp
+	patched := false
+	if st.version > 0 {
+		patch = diffJSON(nil, "", st.doc, doc)
+		p, err := e.json.Marshal(patch)
+		patched = err == nil && len(p) < len(b)
+	}
+
+	e.mapLock.RLock()
+	var members []*client
+	if g := e.groups[group]; g != nil {
+		g.lock.RLock()
+		for _, c := range g.members {
+			if !containsString(except, c.ConnectionID) {
+				members = append(members, c)
+			}
+		}
+		g.lock.RUnlock()
+	}
+	base, version, full := s.update(st, doc, int64(len(b)), patched, members)
+	e.mapLock.RUnlock()
+
+	e.logger.Debugf("sending state %s to %d clients in group '%s'", fn, len(members), group)
+	result := &GroupCallError{Group: group}
+	frames := make(map[string]encodedCall) // by codec, protocol version and whether it is a patch
+	policy := e.overflowPolicy(group)
+	for _, c := range members {
+		sender, ok := c.transport().(rawSender)
+		if !ok || !c.caps.has(canPatch) {
+			// the client cannot be sent a patch, so it is called with the
+			// state as any method would be
+			err = e.deliverToMember(c, nil, relay, group, fn, []interface{}{state})
+		} else {
+			f := &stateFrame{Relay: relay.Name, Method: fn, Group: group, Version: version, State: doc}
+			if !full[c.ConnectionID] {
+				f.Base, f.State, f.Patch = base, nil, patch
+			}
+			codec := c.codec
+			if codec == nil {
+				codec = e.json
+			}
+			key := codec.Name() + "/" + strconv.Itoa(c.protocol) + "/" + strconv.FormatBool(f.Base > 0)
+			enc, ok := frames[key]
+			if !ok {
+				enc.frame, enc.err = encodeFrame(codec, c.protocol, f)
+				if enc.err != nil {
+					e.logger.Errorf("encoding %s for %s: %v", fn, c.ConnectionID, enc.err)
+				}
+				frames[key] = enc
+			}
+			err = enc.err
+			if err == nil {
+				c.touch()
+				if err = sender.sendCall(c.ConnectionID, enc.frame, "", policy, time.Time{}); err == nil {
+					e.emitSent(c.ConnectionID, group, relay.Name, fn)
+				}
+			}
+		}
+		if err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[c.ConnectionID] = err
+			continue
+		}
+		result.Delivered++
+	}
+
+	if len(result.Failed) > 0 {
+		s.unsync(st, result.Failed)
+		return result
+	}
+	return nil
+}
+
+// state returns the state kept for key, creating it if necessary.
+func (s *stateStore) state(key stateKey) *groupState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := s.states[key]
+	if st == nil {
+		st = &groupState{key: key, synced: make(map[string]uint64)}
+		s.keepLocked(st)
+	}
+	return st
+}
+
+// keepLocked adds a state to those kept. The caller must hold s.lock.
+func (s *stateStore) keepLocked(st *groupState) {
+	s.states[st.key] = st
+	if s.byGroup[st.key.group] == nil {
+		s.byGroup[st.key.group] = make(map[stateKey]*groupState)
+	}
+	s.byGroup[st.key.group][st.key] = st
+	st.elem = s.order.PushBack(st)
+}
+
+// update makes doc the state's next version, returning the version a
+// patch to it applies to, the new version, and the members that are to be
+// sent it in full: all of them unless patched is set, or otherwise those
+// that were not sent the last. It forgets states beyond MaxStateBytes,
+// least recently updated first, this one included if it is too large to
+// keep on its own.
+func (s *stateStore) update(st *groupState, doc interface{}, size int64, patched bool, members []*client) (base, version uint64, full map[string]bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if cur := s.states[st.key]; cur != st {
+		// dropped to make room since; it is kept again, in place of any
+		// state made for the key meanwhile
+		if cur != nil {
+			s.dropLocked(cur)
+		}
+		st.size = 0
+		s.keepLocked(st)
+	} else {
+		s.order.MoveToBack(st.elem)
+	}
+
+	base = st.version
+	st.version++
+	st.doc = doc
+	s.bytes += size - st.size
+	st.size = size
+
+	full = make(map[string]bool)
+	synced := make(map[string]uint64, len(members))
+	for _, c := range members {
+		if !patched || st.synced[c.ConnectionID] != base {
+			full[c.ConnectionID] = true
+		}
+		synced[c.ConnectionID] = st.version
+	}
+	st.synced = synced
+
+	for s.bytes > s.max && s.order.Len() > 0 {
+		s.dropLocked(s.order.Front().Value.(*groupState))
+		s.evicted++
+	}
+	return base, st.version, full
+}
+
+// unsync forgets the version sent to the clients a state could not be
+// queued for, so that they are sent the next in full.
+func (s *stateStore) unsync(st *groupState, failed map[string]error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for cid := range failed {
+		delete(st.synced, cid)
+	}
+}
+
+// dropLocked forgets a state. The caller must hold s.lock.
+func (s *stateStore) dropLocked(st *groupState) {
+	delete(s.states, st.key)
+	if states := s.byGroup[st.key.group]; states != nil {
+		delete(states, st.key)
+		if len(states) == 0 {
+			delete(s.byGroup, st.key.group)
+		}
+	}
+	s.order.Remove(st.elem)
+	s.bytes -= st.size
+}
+
+// sendStateLocked sends a client the state in full, as the version it
+// now has. The caller must hold s.lock.
+func (e *Exchange) sendStateLocked(st *groupState, c *client) {
+	s, ok := c.transport().(rawSender)
+	if !ok || !c.caps.has(canPatch) || st.version == 0 {
+		return
+	}
+	codec := c.codec
+	if codec == nil {
+		codec = e.json
+	}
+	frame, err := encodeFrame(codec, c.protocol, &stateFrame{Relay: st.key.relay, Method: st.key.method, Group: st.key.group, Version: st.version, State: st.doc})
+	if err != nil {
+		e.logger.Errorf("encoding %s for %s: %v", st.key.method, c.ConnectionID, err)
+		e.reportError(TransportError, c.ConnectionID, st.key.relay, st.key.method, err)
+		return
+	}
+	if err := s.sendCall(c.ConnectionID, frame, "", e.overflowPolicy(st.key.group), time.Time{}); err != nil {
+		e.logger.Debugf("sending state %s to %s: %v", st.key.method, c.ConnectionID, err)
+		delete(st.synced, c.ConnectionID)
+		return
+	}
+	st.synced[c.ConnectionID] = st.version
+}
+
+// sendGroupStates sends a client that has just joined a group the states
+// kept for it. The caller must hold the group's lock, so that no patch
+// sent to the group after the client joined is sent before them.
+func (e *Exchange) sendGroupStates(s *stateStore, c *client, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, st := range s.byGroup[name] {
+		e.sendStateLocked(st, c)
+	}
+}
+
+// receiveStateRequest sends a client that asked for it, by calling
+// stateMethod with the group, relay and method, a state in full.
+func (e *Exchange) receiveStateRequest(cid string, args []interface{}) {
+	if len(args) != 3 {
+		return
+	}
+	var key stateKey
+	var ok [3]bool
+	key.group, ok[0] = args[0].(string)
+	key.relay, ok[1] = args[1].(string)
+	key.method, ok[2] = args[2].(string)
+	s := e.states.Load()
+	if s == nil || ok != [3]bool{true, true, true} {
+		return
+	}
+
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+	g := e.groups[key.group]
+	if g == nil {
+		return
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	c := g.members[cid]
+	if c == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if st := s.states[key]; st != nil {
+		e.sendStateLocked(st, c)
+	}
+}
+
+// stats returns the number of states kept, their size and how many have
+// been dropped to stay under MaxStateBytes.
+func (s *stateStore) stats() (states int, bytes int64, evicted uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.order.Len(), s.bytes, s.evicted
+}
+
+// diffJSON appends to ops the operations of a JSON Patch turning a into b,
+// values decoded from JSON, at the given JSON Pointer path.
+func diffJSON(ops []patchOp, path string, a, b interface{}) []patchOp {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			av, inA := a[k]
+			bv, inB := b[k]
+			p := path + "/" + escapePointer(k)
+			switch {
+			case !inB:
+				ops = append(ops, patchOp{Op: "remove", Path: p})
+			case !inA:
+				ops = append(ops, patchOp{Op: "add", Path: p, Value: bv})
+			default:
+				ops = diffJSON(ops, p, av, bv)
+			}
+		}
+		return ops
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		n := len(a)
+		if len(b) < n {
+			n = len(b)
+		}
+		for i := 0; i < n; i++ {
+			ops = diffJSON(ops, path+"/"+strconv.Itoa(i), a[i], b[i])
+		}
+		for i := len(a) - 1; i >= n; i-- {
+			ops = append(ops, patchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := n; i < len(b); i++ {
+			ops = append(ops, patchOp{Op: "add", Path: path + "/-", Value: b[i]})
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, patchOp{Op: "replace", Path: path, Value: b})
+	}
+	return ops
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// escapePointer escapes a key for use in a JSON Pointer.
+func escapePointer(key string) string {
+	return pointerEscaper.Replace(key)
+}
@@ -0,0 +1,191 @@
+package relayr
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ExchangeStats is a snapshot of an Exchange's activity.
+type ExchangeStats struct {
+	Connections      map[string]int // active connections per transport
+	Groups           map[string]int // members per group
+	MessagesSent     uint64         // messages queued for delivery to clients
+	MessagesReceived uint64         // messages received from clients
+	DroppedMessages  uint64         // messages dropped because a client could not keep up
+	FailedCalls      uint64         // server method calls that returned or caused an error
+	RateLimitedCalls uint64         // server method calls rejected by a RateLimit
+	ForbiddenCalls   uint64         // server method calls rejected by an authorization rule
+	OversizedFrames  uint64         // messages rejected for exceeding MaxMessageSize
+	CoalescedCalls   uint64         // coalesced calls that replaced one still waiting to be sent
+	RejectedClients  uint64         // negotiations refused by a connection limit
+	BusyCalls        uint64         // server method calls refused because MaxQueuedCalls were waiting
+	EvictedClients   uint64         // clients disconnected after the IdleTimeout
+	QueuedFrames     int            // frames waiting to be sent, across every connection
+	PeakQueuedFrames int            // the most frames waiting to be sent to any one connection at once
+	SlowConnections  uint64         // times a connection's queue stayed over the HighWaterMark
+	ExpiredMessages  uint64         // calls made with a TTL that expired before they were sent
+	RetainedMessages int            // calls to groups kept for replay by RetainGroupMessages
+	RetainedBytes    int64          // the size of those calls
+	EvictedRetained  uint64         // retained calls dropped to stay under MaxRetainedBytes
+	States           int            // states kept by CallStateful
+	StateBytes       int64          // the size of those states
+	EvictedStates    uint64         // states dropped to stay under MaxStateBytes
+	ScheduledCalls   int            // calls made with Schedule still waiting to be made
+	DroppedTapFrames uint64         // frames left out of recordings made with TapConnection because the writer fell behind
+	UpgradedClients  uint64         // long-polling clients that upgraded to a websocket
+	FailedProbes     uint64         // websockets closed by clients the handshake did not reach within the WebSocketProbeTimeout
+	ReapedClients    uint64         // clients disconnected by ReapStale or after the StaleConnectionTimeout
+	DeadLetters      uint64         // webhook deliveries given up on
+	CompressedBytes  uint64         // the size of the websocket messages written compressed, before compression
+	DeflatedBytes    uint64         // their size as written, frame headers included; CompressedBytes less this is what compression saved
+	DuplicateCalls   uint64         // calls a client sent again under the same call ID, which were not run twice
+	ClientsAdded     uint64         // clients connected, counting each reconnection
+	ClientsRemoved   uint64         // clients disconnected, counting each detached to wait for it to reconnect
+	FramesRead       uint64         // websocket messages and long-polled calls read from clients, before they are decoded
+	ScriptRawBytes   int            // the size of the client script last generated, before it was minified or transformed
+	ScriptBytes      int            // the size of the client script served, as last generated
+
+	// CallLimits describes the calls under each Limit, keyed by the relay
+	// it was set for, or "Relay.method" for one set for a method.
+	CallLimits map[string]LimitStats
+
+	// Capabilities counts the connected clients by the optional features
+	// they support, named as "ack,batch,binary,patch,ping", or "none", so
+	// that it can be seen when clients without one have gone.
+	Capabilities map[string]int
+
+	// The percentiles of the round trips of the websocket connections'
+	// last keep-alive pings.
+	RoundTripP50 time.Duration
+	RoundTripP90 time.Duration
+	RoundTripP99 time.Duration
+
+	// Options are the RuntimeOptions in effect, as UpdateOptions last
+	// left them.
+	Options RuntimeOptions
+}
+
+// counters are the running totals reported by Stats.
+type counters struct {
+	sent        atomic.Uint64
+	received    atomic.Uint64
+	dropped     atomic.Uint64
+	failedCalls atomic.Uint64
+	rateLimited atomic.Uint64
+	forbidden   atomic.Uint64
+	oversized   atomic.Uint64
+	coalesced   atomic.Uint64
+	rejected    atomic.Uint64
+	busy        atomic.Uint64
+	evicted     atomic.Uint64
+	slow        atomic.Uint64
+	expired     atomic.Uint64
+	tapDropped  atomic.Uint64
+	upgraded    atomic.Uint64
+	probeFailed atomic.Uint64
+	reaped      atomic.Uint64
+	deadLetters atomic.Uint64
+	compressed  atomic.Uint64
+	deflated    atomic.Uint64
+	duplicates  atomic.Uint64
+	added       atomic.Uint64
+	removed     atomic.Uint64
+	read        atomic.Uint64
+}
+
+// Stats returns a snapshot of the Exchange's connections, groups and
+// message counters. It is safe to call at any time.
+func (e *Exchange) Stats() ExchangeStats {
+	s := ExchangeStats{
+		Connections: map[string]int{
+			"websocket": e.transports["websocket"].(*webSocketTransport).count(),
+			"longpoll":  e.transports["longpoll"].(*longPollTransport).count(),
+		},
+		Groups:           make(map[string]int),
+		Capabilities:     make(map[string]int),
+		MessagesSent:     e.counters.sent.Load(),
+		MessagesReceived: e.counters.received.Load(),
+		DroppedMessages:  e.counters.dropped.Load(),
+		FailedCalls:      e.counters.failedCalls.Load(),
+		RateLimitedCalls: e.counters.rateLimited.Load(),
+		ForbiddenCalls:   e.counters.forbidden.Load(),
+		OversizedFrames:  e.counters.oversized.Load(),
+		CoalescedCalls:   e.counters.coalesced.Load(),
+		RejectedClients:  e.counters.rejected.Load(),
+		BusyCalls:        e.counters.busy.Load(),
+		EvictedClients:   e.counters.evicted.Load(),
+		SlowConnections:  e.counters.slow.Load(),
+		ExpiredMessages:  e.counters.expired.Load(),
+		ScheduledCalls:   e.schedules.len(),
+		DroppedTapFrames: e.counters.tapDropped.Load(),
+		UpgradedClients:  e.counters.upgraded.Load(),
+		FailedProbes:     e.counters.probeFailed.Load(),
+		ReapedClients:    e.counters.reaped.Load(),
+		DeadLetters:      e.counters.deadLetters.Load(),
+		CompressedBytes:  e.counters.compressed.Load(),
+		DeflatedBytes:    e.counters.deflated.Load(),
+		DuplicateCalls:   e.counters.duplicates.Load(),
+		ClientsAdded:     e.counters.added.Load(),
+		ClientsRemoved:   e.counters.removed.Load(),
+		FramesRead:       e.counters.read.Load(),
+	}
+
+	infos := e.connections()
+	for _, info := range infos {
+		s.QueuedFrames += info.QueuedFrames
+		if info.PeakQueuedFrames > s.PeakQueuedFrames {
+			s.PeakQueuedFrames = info.PeakQueuedFrames
+		}
+	}
+	s.RoundTripP50, s.RoundTripP90, s.RoundTripP99 = roundTripPercentiles(infos)
+	if r := e.retention.Load(); r != nil {
+		s.RetainedMessages, s.RetainedBytes, s.EvictedRetained = r.stats()
+	}
+	if st := e.states.Load(); st != nil {
+		s.States, s.StateBytes, s.EvictedStates = st.stats()
+	}
+
+	s.CallLimits = e.dispatcher.limitStats()
+	s.Options = e.Options()
+	if t := e.webhooks.Load(); t != nil {
+		s.Connections["webhook"] = t.count()
+	}
+	if t := e.locals.Load(); t != nil {
+		s.Connections[localTransportName] = t.count()
+	}
+	if t := e.hubbed.Load(); t != nil {
+		s.Connections[hubTransportName] = t.count()
+	}
+
+	if sizes := e.scriptSizes.Load(); sizes != nil {
+		s.ScriptRawBytes, s.ScriptBytes = sizes[0], sizes[1]
+	}
+
+	e.mapLock.RLock()
+	for name, g := range e.groups {
+		s.Groups[name] = g.len()
+	}
+	for _, c := range e.connected {
+		s.Capabilities[c.caps.String()]++
+	}
+	e.mapLock.RUnlock()
+
+	return s
+}
+
+// debugStats is served instead of ExchangeStats with DebugStats.
+type debugStats struct {
+	ExchangeStats
+	ConnectionTable []ConnectionInfo
+}
+
+func (e *Exchange) serveStats(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w)
+	if e.options.DebugStats {
+		json.NewEncoder(w).Encode(debugStats{e.Stats(), e.Connections()})
+		return
+	}
+	json.NewEncoder(w).Encode(e.Stats())
+}
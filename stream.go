@@ -0,0 +1,121 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// cancelMethod is the reserved method name clients call to cancel a call
+// they made, usually one streaming its result. Like ackMethod, it cannot
+// clash with a relay method.
+const cancelMethod = "__relayrCancel"
+
+// streamPollInterval is how often a stream checks for room in a client's
+// send buffer once it has filled up.
+const streamPollInterval = 10 * time.Millisecond
+
+var errStreamItemDropped = errors.New("relayr: stream item could not be queued")
+
+// bufferedSender is implemented by the built-in transports, which can tell
+// whether a connection's send buffer has room for another frame.
+type bufferedSender interface {
+	hasRoom(connectionID string) bool
+}
+
+// isStream reports whether a relay method's result is a channel to stream
+// to the client.
+func isStream(result interface{}) bool {
+	if result == nil {
+		return false
+	}
+	t := reflect.TypeOf(result)
+	return t.Kind() == reflect.Chan && t.ChanDir()&reflect.RecvDir != 0
+}
+
+// stream reads the items of a streaming result until the channel is
+// closed. Clients that invoked the method with an InvocationID over a
+// built-in transport are sent each item as it arrives, waiting for room
+// in their send buffer, and stream returns nil. Otherwise the items are
+// collected and returned together. An item that is an error ends the
+// stream with that error.
+//
+// Reading stops when ctx is done, as it is when the client cancels the
+// call or disconnects; the method must stop sending on the channel then.
+func (e *Exchange) stream(ctx context.Context, cid, invocationID string, ch interface{}) (interface{}, error) {
+	var s rawSender
+	if c := e.getClientByConnectionID(cid); c != nil && c.protocol >= 1 && invocationID != "" {
+		s, _ = c.transport().(rawSender)
+	}
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	items := []interface{}{}
+	for {
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return nil, ctx.Err()
+		}
+		if !ok {
+			break
+		}
+
+		item := v.Interface()
+		if err, ok := item.(error); ok {
+			return nil, err
+		}
+		if s == nil {
+			items = append(items, item)
+			continue
+		}
+		if err := e.sendStreamItem(ctx, s, cid, invocationID, item); err != nil {
+			return nil, err
+		}
+	}
+
+	if s != nil {
+		return nil, nil
+	}
+	return items, nil
+}
+
+// sendStreamItem sends an item of a streaming result once the client's
+// send buffer has room for it.
+func (e *Exchange) sendStreamItem(ctx context.Context, s rawSender, cid, invocationID string, item interface{}) error {
+	if b, ok := s.(bufferedSender); ok && !b.hasRoom(cid) {
+		ticker := time.NewTicker(streamPollInterval)
+		defer ticker.Stop()
+		for !b.hasRoom(cid) {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	frame, err := e.encodeFrameFor(cid, &streamItem{InvocationID: invocationID, Value: item})
+	if err != nil {
+		return err
+	}
+	if err := s.sendRaw(cid, frame); err != nil {
+		e.logger.Errorf("sending stream item to %s: %v", cid, err)
+		e.reportError(TransportError, cid, "", "", err)
+		return errStreamItemDropped
+	}
+	return nil
+}
+
+// receiveCancel cancels the call named by a client's cancelMethod call.
+func (e *Exchange) receiveCancel(cid string, args []interface{}) {
+	if len(args) != 1 {
+		return
+	}
+	if id, ok := args[0].(string); ok && id != "" {
+		e.uploads.abort(cid, id, ErrUploadAborted)
+		e.invocations.cancelOne(cid, id)
+	}
+}
@@ -0,0 +1,55 @@
+package relayr
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// subprotocolPrefix begins the Sec-WebSocket-Protocol naming the framing
+// a websocket speaks, which it ends with the name of the connection's
+// codec, as "relayr.v1.json" or "relayr.v1.msgpack".
+const subprotocolPrefix = "relayr.v1."
+
+// closeUnknownSubprotocol is the websocket close code sent to clients
+// that ask for none of the subprotocols their connection speaks.
+const closeUnknownSubprotocol = 4007
+
+// closeProbeFailed is the websocket close code a client closes its
+// websocket with when the handshake did not arrive within the
+// WebSocketProbeTimeout, as when a proxy lets the upgrade through and
+// then mangles the frames, before it falls back on long-polling.
+const closeProbeFailed = 4008
+
+var errUnknownSubprotocol = errors.New("relayr: unknown websocket subprotocol")
+
+// subprotocol returns the subprotocol to echo to a websocket upgrade for
+// a connection speaking codec, reporting false if the client asked for
+// subprotocols that do not include it. A client asking for none, as
+// scripts from before subprotocols did, frames as it negotiated. One
+// refused is echoed the first it asked for all the same, as browsers fail
+// a websocket whose upgrade echoes none of theirs without showing the
+// close frame that says why.
+func subprotocol(r *http.Request, codec Codec) (string, bool) {
+	asked := websocket.Subprotocols(r)
+	if len(asked) == 0 {
+		return "", true
+	}
+	want := subprotocolPrefix + codec.Name()
+	for _, p := range asked {
+		if p == want {
+			return p, true
+		}
+	}
+	return asked[0], false
+}
+
+// probeTimeoutFor returns the Probe of a negotiation response for a
+// client using the named transport.
+func (e *Exchange) probeTimeoutFor(transport string) int64 {
+	if transport != "websocket" || e.options.WebSocketProbeTimeout < 0 {
+		return 0
+	}
+	return e.options.WebSocketProbeTimeout.Milliseconds()
+}
@@ -0,0 +1,128 @@
+package relayr
+
+// TagConnection tags the client with the given ConnectionID with value
+// under key, replacing the value it had, so that it can be called with
+// Clients.WithTag. Tags suit selecting clients by a property, such as the
+// version of the app they run, where groups suit clients joining and
+// leaving. It can be called from the OnNegotiate hook. Tags last until
+// the client disconnects, surviving reconnections. It returns
+// ErrConnectionNotFound if there is no such client.
+func (e *Exchange) TagConnection(connectionID, key, value string) error {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	if !e.knownLocked(connectionID) {
+		return ErrConnectionNotFound
+	}
+	tags := e.tags[connectionID]
+	if tags == nil {
+		tags = make(map[string]string)
+		e.tags[connectionID] = tags
+	} else if old, ok := tags[key]; ok {
+		e.unindexTagLocked(connectionID, key, old)
+	}
+	tags[key] = value
+
+	values := e.tagIndex[key]
+	if values == nil {
+		values = make(map[string]map[string]struct{})
+		e.tagIndex[key] = values
+	}
+	ids := values[value]
+	if ids == nil {
+		ids = make(map[string]struct{})
+		values[value] = ids
+	}
+	ids[connectionID] = struct{}{}
+	return nil
+}
+
+// UntagConnection removes the tag under key from the client with the
+// given ConnectionID, if it has one.
+func (e *Exchange) UntagConnection(connectionID, key string) {
+	e.mapLock.Lock()
+	defer e.mapLock.Unlock()
+
+	tags := e.tags[connectionID]
+	old, ok := tags[key]
+	if !ok {
+		return
+	}
+	delete(tags, key)
+	if len(tags) == 0 {
+		delete(e.tags, connectionID)
+	}
+	e.unindexTagLocked(connectionID, key, old)
+}
+
+// ConnectionTags returns the tags of the client with the given
+// ConnectionID.
+func (e *Exchange) ConnectionTags(connectionID string) map[string]string {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+	return copyTags(e.tags[connectionID])
+}
+
+// knownLocked reports whether there is a client with the given
+// ConnectionID: connected, waiting to reconnect or negotiating. The caller
+// must hold mapLock.
+func (e *Exchange) knownLocked(id string) bool {
+	if e.getClientByConnectionIDLocked(id) != nil {
+		return true
+	}
+	if _, ok := e.detached[id]; ok {
+		return true
+	}
+	_, ok := e.negotiating[id]
+	return ok
+}
+
+// unindexTagLocked removes a client from the index of a tag it no longer
+// has. The caller must hold mapLock.
+func (e *Exchange) unindexTagLocked(id, key, value string) {
+	values := e.tagIndex[key]
+	ids := values[value]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(values, value)
+		if len(values) == 0 {
+			delete(e.tagIndex, key)
+		}
+	}
+}
+
+// forgetTagsLocked removes the tags of a client that has disconnected.
+// The caller must hold mapLock.
+func (e *Exchange) forgetTagsLocked(id string) {
+	for key, value := range e.tags[id] {
+		e.unindexTagLocked(id, key, value)
+	}
+	delete(e.tags, id)
+}
+
+// taggedConnections returns the ConnectionIDs of the connected clients
+// tagged with value under key.
+func (e *Exchange) taggedConnections(key, value string) []string {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	ids := e.tagIndex[key][value]
+	r := make([]string, 0, len(ids))
+	for id := range ids {
+		if e.getClientByConnectionIDLocked(id) != nil {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	r := make(map[string]string, len(tags))
+	for k, v := range tags {
+		r[k] = v
+	}
+	return r
+}
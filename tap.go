@@ -0,0 +1,249 @@
+package relayr
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// The directions of the records a tap writes.
+const (
+	tapHeader   = 'h' // the first record, describing the connection
+	tapInbound  = 'i' // a frame the client sent
+	tapOutbound = 'o' // a frame sent to the client
+)
+
+// tapBuffer is the number of frames a tap holds while its writer catches
+// up. Frames are dropped, and counted, while it is full.
+const tapBuffer = 1024
+
+// tapRecordHeader is the size of the direction, timestamp and length that
+// come before each record's frame.
+const tapRecordHeader = 1 + 8 + 4
+
+var (
+	errTapped    = errors.New("relayr: connection is tapped already")
+	errTapHeader = errors.New("relayr: recording does not start with a header")
+)
+
+// tapDescription is the header of a recording: what Replay needs to decode
+// the frames that follow.
+type tapDescription struct {
+	ConnectionID string
+	Codec        string
+	Version      int
+}
+
+type tapRecord struct {
+	dir  byte
+	at   time.Time
+	data []byte
+}
+
+// frameTap copies a connection's frames to a writer, on a goroutine of its
+// own so that a slow writer never holds up the connection.
+type frameTap struct {
+	records chan tapRecord
+	done    chan struct{} // closed to stop the tap
+	stopped chan struct{} // closed once the frames taken have been written
+	once    sync.Once
+}
+
+// TapConnection copies every frame the client with the given ConnectionID
+// sends and is sent, as they cross its transport, to w until stop is
+// called or the client disconnects for good, for recording sessions to
+// debug or to play back with Replay. Each frame is written as a record of
+// its direction, 'i' for inbound or 'o' for outbound, when it crossed as
+// big-endian unix nanoseconds, and its length as a big-endian uint32,
+// followed by the frame as the client's codec encoded it; the first
+// record, 'h', describes the connection. Writes happen off the
+// connection's goroutines, and frames are dropped, and counted in
+// DroppedTapFrames, rather than wait for a writer that falls behind. A
+// write error stops the recording. stop returns once the frames taken
+// have been written. It returns ErrConnectionNotFound if there is no such
+// client, and an error if it is tapped already.
+func (e *Exchange) TapConnection(connectionID string, w io.Writer) (stop func(), err error) {
+	c := e.getClientByConnectionID(connectionID)
+	if c == nil {
+		return nil, ErrConnectionNotFound
+	}
+	codec, version := e.protocolFor(connectionID)
+	header, err := e.json.Marshal(tapDescription{ConnectionID: connectionID, Codec: codec.Name(), Version: version})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &frameTap{
+		records: make(chan tapRecord, tapBuffer),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	t.records <- tapRecord{dir: tapHeader, at: time.Now(), data: header}
+
+	e.tapLock.Lock()
+	if old := e.taps.Load(); old != nil && (*old)[connectionID] != nil {
+		e.tapLock.Unlock()
+		return nil, errTapped
+	}
+	if !e.track() {
+		e.tapLock.Unlock()
+		return nil, errExchangeClosed
+	}
+	e.setTapLocked(connectionID, t)
+	e.tapLock.Unlock()
+
+	go func() {
+		defer e.wg.Done()
+		t.write(w)
+	}()
+	e.logger.Debugf("tapping connection %s", connectionID)
+
+	return func() {
+		e.untap(connectionID, t)
+		<-t.stopped
+	}, nil
+}
+
+// setTapLocked replaces the taps with a copy in which the connection's is
+// t, or none when t is nil. The caller must hold tapLock.
+func (e *Exchange) setTapLocked(cid string, t *frameTap) {
+	taps := make(map[string]*frameTap)
+	if old := e.taps.Load(); old != nil {
+		for id, tap := range *old {
+			taps[id] = tap
+		}
+	}
+	if t == nil {
+		delete(taps, cid)
+	} else {
+		taps[cid] = t
+	}
+	if len(taps) == 0 {
+		e.taps.Store(nil)
+		return
+	}
+	e.taps.Store(&taps)
+}
+
+// untap removes a connection's tap, if it is still t, and stops it. The
+// frames it has taken are still written.
+func (e *Exchange) untap(cid string, t *frameTap) {
+	e.tapLock.Lock()
+	if old := e.taps.Load(); old != nil && (*old)[cid] == t {
+		e.setTapLocked(cid, nil)
+	}
+	e.tapLock.Unlock()
+	t.once.Do(func() { close(t.done) })
+}
+
+// untapAll stops every tap, as the Exchange closes.
+func (e *Exchange) untapAll() {
+	if taps := e.taps.Load(); taps != nil {
+		for cid, t := range *taps {
+			e.untap(cid, t)
+		}
+	}
+}
+
+// tapped returns the tap of the connection with the given ConnectionID,
+// or nil if it is not tapped.
+func (e *Exchange) tapped(cid string) *frameTap {
+	if taps := e.taps.Load(); taps != nil {
+		return (*taps)[cid]
+	}
+	return nil
+}
+
+// tapFrame gives a frame that crossed a connection in the given direction
+// to its tap, if it has one. It never blocks.
+func (e *Exchange) tapFrame(cid string, dir byte, data []byte) {
+	t := e.tapped(cid)
+	if t == nil {
+		return
+	}
+	if dir == tapInbound {
+		// the read loop reuses the memory of the frames it reads
+		data = append([]byte(nil), data...)
+	}
+	select {
+	case t.records <- tapRecord{dir: dir, at: time.Now(), data: data}:
+	default:
+		e.counters.tapDropped.Add(1)
+	}
+}
+
+// tapEncoded gives a frame to the connection's tap as the client's codec
+// and protocol version encode it, for the transports added with
+// RegisterTransport, whose frames are not encoded otherwise.
+func (e *Exchange) tapEncoded(cid string, dir byte, v interface{}) {
+	codec, version := e.protocolFor(cid)
+	var data []byte
+	var err error
+	if f, ok := v.(frame); ok {
+		data, err = encodeFrame(codec, version, f)
+	} else {
+		data, err = codec.Marshal(v)
+	}
+	if err != nil {
+		e.logger.Debugf("encoding a tapped frame of %s: %v", cid, err)
+		return
+	}
+	e.tapFrame(cid, dir, data)
+}
+
+// write writes the records taken to w until the tap is stopped, and then
+// those left. After a write fails the records are discarded.
+func (t *frameTap) write(w io.Writer) {
+	defer close(t.stopped)
+	var err error
+	put := func(r tapRecord) {
+		if err == nil {
+			err = writeTapRecord(w, r)
+		}
+	}
+	for {
+		select {
+		case r := <-t.records:
+			put(r)
+		case <-t.done:
+			for {
+				select {
+				case r := <-t.records:
+					put(r)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeTapRecord(w io.Writer, r tapRecord) error {
+	var head [tapRecordHeader]byte
+	head[0] = r.dir
+	binary.BigEndian.PutUint64(head[1:], uint64(r.at.UnixNano()))
+	binary.BigEndian.PutUint32(head[9:], uint32(len(r.data)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(r.data)
+	return err
+}
+
+func readTapRecord(r io.Reader) (tapRecord, error) {
+	var head [tapRecordHeader]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return tapRecord{}, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(head[9:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return tapRecord{}, io.ErrUnexpectedEOF
+	}
+	return tapRecord{
+		dir:  head[0],
+		at:   time.Unix(0, int64(binary.BigEndian.Uint64(head[1:]))),
+		data: data,
+	}, nil
+}
@@ -0,0 +1,37 @@
+package relayr
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestTapStopsOnDisconnect checks that a tap outlives a client that may
+// reconnect, and stops once it is forgotten.
+func TestTapStopsOnDisconnect(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{ReconnectGracePeriod: 200 * time.Millisecond}, Calculator{})
+	ws, cid := openWebSocket(t, srv)
+	var buf bytes.Buffer
+	if _, err := e.TapConnection(cid, &buf); err != nil {
+		t.Fatal(err)
+	}
+	tap := e.tapped(cid)
+	checkAlive(t, ws, "")
+
+	ws.Close()
+	waitDetached(t, e, cid)
+	if e.tapped(cid) != tap {
+		t.Fatal("the tap stopped while the client could still reconnect")
+	}
+	select {
+	case <-tap.stopped:
+	case <-time.After(testTimeout):
+		t.Fatal("the tap did not stop once the client was forgotten")
+	}
+	if e.tapped(cid) != nil {
+		t.Fatal("the tap is still registered once the client was forgotten")
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"Add"`)) {
+		t.Fatalf("the recording lacks the call made: %q", buf.Bytes())
+	}
+}
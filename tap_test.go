@@ -0,0 +1,223 @@
+package relayr_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simon-whitehead/relayr"
+	"github.com/simon-whitehead/relayr/relayrtest"
+)
+
+// Ledger is a relay recording the calls made to it, and confirming each
+// to its caller.
+type Ledger struct {
+	lock  *sync.Mutex
+	calls *[]string
+}
+
+func newLedger() Ledger {
+	return Ledger{lock: new(sync.Mutex), calls: new([]string)}
+}
+
+func (l Ledger) record(call string) {
+	l.lock.Lock()
+	*l.calls = append(*l.calls, call)
+	l.lock.Unlock()
+}
+
+func (l Ledger) recorded() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), *l.calls...)
+}
+
+func (l Ledger) Deposit(r *relayr.Relay, account string, amount int) error {
+	l.record(fmt.Sprintf("deposit %s %d", account, amount))
+	return r.Clients.Caller().Call("confirmed", account)
+}
+
+func (l Ledger) Withdraw(r *relayr.Relay, account string, amount int) error {
+	l.record(fmt.Sprintf("withdraw %s %d", account, amount))
+	return r.Clients.Caller().Call("confirmed", account)
+}
+
+// ledgerExchange makes an Exchange with l registered, closing it as the
+// test ends.
+func ledgerExchange(t *testing.T, l Ledger) *relayr.Exchange {
+	e := relayr.NewExchangeWithOptions("http://localhost/relayr", relayr.ExchangeOptions{ReconnectGracePeriod: -1})
+	t.Cleanup(func() { e.Close(context.Background()) })
+	if err := e.RegisterRelay(l); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// tapRecord is a record of a recording, as TapConnection documents it.
+type tapRecord struct {
+	Dir  byte
+	At   time.Time
+	Data []byte
+}
+
+func readRecords(t *testing.T, b []byte) []tapRecord {
+	t.Helper()
+	var records []tapRecord
+	r := bytes.NewReader(b)
+	for {
+		var head [13]byte
+		if _, err := io.ReadFull(r, head[:]); err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatalf("reading a record: %v", err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head[9:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatalf("reading a record's frame: %v", err)
+		}
+		records = append(records, tapRecord{Dir: head[0], At: time.Unix(0, int64(binary.BigEndian.Uint64(head[1:]))), Data: data})
+	}
+}
+
+func TestTapAndReplay(t *testing.T) {
+	recorded := newLedger()
+	e := ledgerExchange(t, recorded)
+	c := relayrtest.NewTestClient(e)
+	var buf bytes.Buffer
+	stop, err := e.TapConnection(c.ConnectionID(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.TapConnection(c.ConnectionID(), io.Discard); err == nil {
+		t.Fatal("a connection was tapped twice")
+	}
+
+	start := time.Now()
+	for _, call := range []struct {
+		method  string
+		account string
+		amount  int
+	}{
+		{"Deposit", "alice", 10},
+		{"Withdraw", "alice", 3},
+		{"Deposit", "bob", 5},
+	} {
+		if _, err := c.CallServer("Ledger", call.method, call.account, call.amount); err != nil {
+			t.Fatalf("calling %s: %v", call.method, err)
+		}
+	}
+	stop()
+
+	records := readRecords(t, buf.Bytes())
+	if len(records) == 0 || records[0].Dir != 'h' {
+		t.Fatalf("the recording does not start with a header: %+v", records)
+	}
+	var header struct{ ConnectionID string }
+	json.Unmarshal(records[0].Data, &header)
+	if header.ConnectionID != c.ConnectionID() {
+		t.Fatalf("the header describes %q, want %q", header.ConnectionID, c.ConnectionID())
+	}
+	dirs := map[byte]int{}
+	for _, r := range records[1:] {
+		dirs[r.Dir]++
+		if r.At.Before(start.Add(-time.Second)) || r.At.After(time.Now()) {
+			t.Errorf("a record is timestamped %v", r.At)
+		}
+	}
+	if dirs['i'] != 3 || dirs['o'] != 3 {
+		t.Fatalf("recorded %d inbound and %d outbound frames, want 3 of each", dirs['i'], dirs['o'])
+	}
+
+	replayed := newLedger()
+	staging := ledgerExchange(t, replayed)
+	if err := relayr.Replay(staging, bytes.NewReader(buf.Bytes()), 0); err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+	if got, want := replayed.recorded(), recorded.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the replay made the calls %q, want %q", got, want)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	e := ledgerExchange(t, newLedger())
+	c := relayrtest.NewTestClient(e)
+	var buf bytes.Buffer
+	stop, _ := e.TapConnection(c.ConnectionID(), &buf)
+	c.CallServer("Ledger", "Deposit", "alice", 1)
+	time.Sleep(300 * time.Millisecond)
+	c.CallServer("Ledger", "Deposit", "alice", 2)
+	stop()
+
+	for _, tt := range []struct {
+		speed    float64
+		min, max time.Duration
+	}{
+		{1, 300 * time.Millisecond, time.Second},
+		{10, 30 * time.Millisecond, 200 * time.Millisecond},
+		{0, 0, 200 * time.Millisecond},
+	} {
+		replayed := newLedger()
+		start := time.Now()
+		if err := relayr.Replay(ledgerExchange(t, replayed), bytes.NewReader(buf.Bytes()), tt.speed); err != nil {
+			t.Fatalf("replaying at %v: %v", tt.speed, err)
+		}
+		if took := time.Since(start); took < tt.min || took > tt.max {
+			t.Errorf("replaying at %v took %v, want %v to %v", tt.speed, took, tt.min, tt.max)
+		}
+		if n := len(replayed.recorded()); n != 2 {
+			t.Errorf("replaying at %v made %d calls, want 2", tt.speed, n)
+		}
+	}
+}
+
+// blockingWriter blocks every write until unblock is closed.
+type blockingWriter struct{ unblock chan struct{} }
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func TestTapDropsForSlowWriter(t *testing.T) {
+	e := ledgerExchange(t, newLedger())
+	c := relayrtest.NewTestClient(e)
+	w := blockingWriter{unblock: make(chan struct{})}
+	stop, err := e.TapConnection(c.ConnectionID(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			c.CallServer("Ledger", "Deposit", "alice", i)
+			// so that the client's buffer does not fill
+			<-c.Received()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("calls were held up by a tap that cannot write")
+	}
+	if dropped := e.Stats().DroppedTapFrames; dropped == 0 {
+		t.Fatal("no frames were dropped for a tap that cannot write")
+	}
+	close(w.unblock)
+	stop()
+}
+
+func TestTapUnknownConnection(t *testing.T) {
+	e := ledgerExchange(t, newLedger())
+	if _, err := e.TapConnection("unknown", io.Discard); err != relayr.ErrConnectionNotFound {
+		t.Fatalf("tapping an unknown connection failed with %v, want ErrConnectionNotFound", err)
+	}
+}
@@ -0,0 +1,232 @@
+package relayr
+
+import (
+	"sync"
+	"time"
+)
+
+// ThrottleConnection throttles the frames sent to the client with the
+// given ConnectionID to bytesPerSec bytes per second, as the
+// BandwidthLimit does, overriding the limits of the Exchange and of its
+// tags. Zero removes its own throttle, so that those apply again, and a
+// negative bytesPerSec exempts it from them. The throttle lasts until the
+// client disconnects, surviving reconnections. It returns
+// ErrConnectionNotFound if there is no such client.
+func (e *Exchange) ThrottleConnection(connectionID string, bytesPerSec int) error {
+	c := e.getClientByConnectionID(connectionID)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+	c.bandwidth.setOverride(bytesPerSec)
+	return nil
+}
+
+// bandwidthLimit returns the bytes per second a client may be sent: its
+// own throttle, the lowest of the TagBandwidthLimits of its tags, or the
+// BandwidthLimit; 0 for no limit.
+func (e *Exchange) bandwidthLimit(cid string, b *bandwidth) int {
+	if o := b.getOverride(); o != 0 {
+		if o < 0 {
+			return 0
+		}
+		return o
+	}
+	tuned := e.runtime()
+	if len(tuned.TagBandwidthLimits) > 0 {
+		e.mapLock.RLock()
+		limit := tagBandwidthLimit(tuned.TagBandwidthLimits, e.tags[cid])
+		e.mapLock.RUnlock()
+		if limit > 0 {
+			return limit
+		}
+	}
+	if tuned.BandwidthLimit < 0 {
+		return 0
+	}
+	return tuned.BandwidthLimit
+}
+
+// tagBandwidthLimit returns the lowest of the limits, keyed "key=value",
+// that apply to a client with the given tags; 0 if none does.
+func tagBandwidthLimit(limits map[string]int, tags map[string]string) int {
+	limit := 0
+	for k, v := range tags {
+		if l := limits[k+"="+v]; l > 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// isUrgent reports whether a frame goes out ahead of the client's
+// throttle: pings and control frames, so that throttling a client does
+// not hold up the keep-alives and commands that keep it connected.
+func isUrgent(f frame) bool {
+	switch f.(type) {
+	case *pingFrame, *controlFrame, *appControl:
+		return true
+	}
+	return false
+}
+
+// urgentSend returns how to send an urgent frame over s.
+func urgentSend(s rawSender) func(cid string, frame []byte) error {
+	if u, ok := s.(urgentSender); ok {
+		return u.sendUrgent
+	}
+	return s.sendRaw
+}
+
+// addBandwidth fills in the throttle of a connection and what it has been
+// sent lately.
+func (e *Exchange) addBandwidth(info *ConnectionInfo) {
+	c := e.getClientByConnectionID(info.ConnectionID)
+	if c == nil {
+		return
+	}
+	info.Bandwidth = e.bandwidthLimit(info.ConnectionID, c.bandwidth)
+	info.Throughput = c.bandwidth.throughput(time.Now())
+}
+
+// bandwidth throttles the bytes sent to a client with a token bucket that
+// holds up to a second's worth of them. A frame may be written whenever
+// the bucket is not empty, and is paid for once written, so that frames
+// larger than the bucket are sent too, the bucket going into debt that
+// later frames wait out. It also counts the bytes written to the client,
+// throttled or not, a second at a time.
+type bandwidth struct {
+	lock     sync.Mutex
+	override int       // set by ThrottleConnection; 0 if it has not been
+	tokens   float64   // the bytes that may be written; negative in debt
+	last     time.Time // when tokens was brought up to date; zero while unthrottled
+	second   int64     // the unix second current counts the bytes written in
+	current  uint64    // the bytes written in that second
+	previous uint64    // the bytes written in the second before
+}
+
+func (b *bandwidth) setOverride(bytesPerSec int) {
+	b.lock.Lock()
+	b.override = bytesPerSec
+	b.lock.Unlock()
+}
+
+func (b *bandwidth) getOverride() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.override
+}
+
+// refillLocked brings tokens up to date for a limit of limit bytes per
+// second. The caller must hold b.lock.
+func (b *bandwidth) refillLocked(limit int, now time.Time) {
+	burst := float64(limit)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * burst
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// allowance returns how many bytes may be written by now under a limit of
+// limit bytes per second, or, when the bucket is in debt, how long until
+// some may be. A zero limit allows any number, returned as 0.
+func (b *bandwidth) allowance(limit int, now time.Time) (int, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if limit <= 0 {
+		b.last = time.Time{}
+		return 0, 0
+	}
+	b.refillLocked(limit, now)
+	if b.tokens < 0 {
+		return 0, time.Duration(-b.tokens / float64(limit) * float64(time.Second))
+	}
+	if b.tokens < 1 {
+		return 1, 0
+	}
+	return int(b.tokens), 0
+}
+
+// wrote counts n bytes written by now, paying for them under a limit of
+// limit bytes per second, unless limit is 0.
+func (b *bandwidth) wrote(n, limit int, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.countLocked(now)
+	b.current += uint64(n)
+	if limit > 0 {
+		b.refillLocked(limit, now)
+		b.tokens -= float64(n)
+	}
+}
+
+// throughput returns the bytes written in the last whole second.
+func (b *bandwidth) throughput(now time.Time) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.countLocked(now)
+	return b.previous
+}
+
+// countLocked moves the count on to the second now falls in. The caller
+// must hold b.lock.
+func (b *bandwidth) countLocked(now time.Time) {
+	sec := now.Unix()
+	if sec == b.second {
+		return
+	}
+	if sec == b.second+1 {
+		b.previous = b.current
+	} else {
+		b.previous = 0
+	}
+	b.current = 0
+	b.second = sec
+}
+
+// throttle waits until the connection's bandwidth allows another frame to
+// be written, or it goes.
+func (c *connection) throttle() {
+	if c.bandwidth == nil {
+		return
+	}
+	for {
+		_, wait := c.bandwidth.allowance(c.e.bandwidthLimit(c.id, c.bandwidth), time.Now())
+		if wait <= 0 {
+			return
+		}
+		// look at the limit again at least once a second, as it may change
+		if wait > time.Second {
+			wait = time.Second
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-c.gone:
+			t.Stop()
+			return
+		case <-c.e.done:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// wrote counts n bytes written to the connection, paying for them out of
+// its bandwidth unless they are urgent.
+func (c *connection) wrote(n int, urgent bool) {
+	if c.bandwidth == nil {
+		return
+	}
+	limit := 0
+	if !urgent {
+		limit = c.e.bandwidthLimit(c.id, c.bandwidth)
+	}
+	c.bandwidth.wrote(n, limit, time.Now())
+}
@@ -0,0 +1,210 @@
+package relayr
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// flood calls tick on the client with the given ConnectionID, with an
+// argument of size bytes, as fast as it can until stop is closed.
+func flood(e *Exchange, cid string, size int, stop chan struct{}) {
+	payload := strings.Repeat("x", size)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		e.Clients(Ticker{}).Client(cid).Call("tick", payload)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// checkRate fails the test unless n bytes sent over d to a client
+// throttled to limit bytes per second keep to the limit, allowing for the
+// second's worth it may be sent at once and a frame over.
+func checkRate(t *testing.T, n int, d time.Duration, limit, frame int) {
+	t.Helper()
+	most := limit + int(d.Seconds()*float64(limit)*1.2) + frame
+	least := int(d.Seconds() * float64(limit) * 0.7)
+	if n > most || n < least {
+		t.Fatalf("sent %d bytes in %v throttled to %d a second, want %d to %d", n, d, limit, least, most)
+	}
+}
+
+func TestThrottleWebSocket(t *testing.T) {
+	const limit, size = 20000, 1000
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	ws, cid := openWebSocket(t, srv)
+	if err := e.ThrottleConnection(cid, limit); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go flood(e, cid, size, stop)
+
+	const d = 2 * time.Second
+	n := 0
+	start := time.Now()
+	ws.SetReadDeadline(start.Add(d))
+	for {
+		_, m, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		n += len(m)
+	}
+	checkRate(t, n, time.Since(start), limit, size+100)
+
+	info, _ := e.ConnectionInfo(cid)
+	if info.Bandwidth != limit {
+		t.Errorf("ConnectionInfo reports a throttle of %d, want %d", info.Bandwidth, limit)
+	}
+	if info.Throughput == 0 || info.Throughput > limit*13/10 {
+		t.Errorf("ConnectionInfo reports a throughput of %d throttled to %d", info.Throughput, limit)
+	}
+}
+
+func TestThrottleLongPoll(t *testing.T) {
+	const limit, size = 5000, 500
+	e, srv := serve(t, ExchangeOptions{BandwidthLimit: limit, LongPollMaxWait: 100 * time.Millisecond}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	stop := make(chan struct{})
+	defer close(stop)
+	go flood(e, cid, size, stop)
+
+	const d = 2 * time.Second
+	n := 0
+	var seq uint64
+	start := time.Now()
+	for time.Since(start) < d {
+		res := poll(t, srv, cid, seq)
+		if res.Command != "" {
+			t.Fatalf("a throttled client was told to %s", res.Command)
+		}
+		for _, m := range res.Messages {
+			n += len(m)
+		}
+		if res.Seq > seq {
+			seq = res.Seq
+		}
+	}
+	checkRate(t, n, time.Since(start), limit, size+100)
+}
+
+func TestThrottleSparesUrgentFrames(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	ws, cid := openWebSocket(t, srv)
+	e.ThrottleConnection(cid, 1000)
+
+	// read reads the next frame but a keep-alive ping
+	read := func(within time.Duration) (string, bool) {
+		ws.SetReadDeadline(time.Now().Add(within))
+		for {
+			_, m, err := ws.ReadMessage()
+			if err != nil || string(m) != `{"T":"p"}` {
+				return string(m), err == nil
+			}
+		}
+	}
+	// a second's worth goes at once, leaving the client's bandwidth in
+	// debt for the next four
+	e.Clients(Ticker{}).Client(cid).Call("tick", strings.Repeat("x", 5000))
+	if _, ok := read(testTimeout); !ok {
+		t.Fatal("the first frame was held up")
+	}
+
+	if err := e.SendControl(cid, "logout", nil); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := read(time.Second); !ok || !strings.Contains(m, "logout") {
+		t.Fatalf("a control frame was held up by the throttle: %q", m)
+	}
+	e.Clients(Ticker{}).Client(cid).Call("tick", "late")
+	if m, ok := read(500 * time.Millisecond); ok {
+		t.Fatalf("a call was sent to a client in debt: %q", m)
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{
+		BandwidthLimit:     3000,
+		TagBandwidthLimits: map[string]int{"link=satellite": 1000, "plan=free": 2000},
+	})
+	cid := requestNegotiation(t, e)
+	limit := func() int {
+		t.Helper()
+		info, ok := e.ConnectionInfo(cid)
+		if !ok {
+			t.Fatal("no ConnectionInfo")
+		}
+		return info.Bandwidth
+	}
+
+	if l := limit(); l != 3000 {
+		t.Fatalf("throttled to %d, want the BandwidthLimit", l)
+	}
+	e.TagConnection(cid, "plan", "free")
+	if l := limit(); l != 2000 {
+		t.Fatalf("throttled to %d, want the tag's limit", l)
+	}
+	e.TagConnection(cid, "link", "satellite")
+	if l := limit(); l != 1000 {
+		t.Fatalf("throttled to %d, want the lowest of the tags' limits", l)
+	}
+	e.ThrottleConnection(cid, 5000)
+	if l := limit(); l != 5000 {
+		t.Fatalf("throttled to %d, want the connection's own limit", l)
+	}
+	e.ThrottleConnection(cid, -1)
+	if l := limit(); l != 0 {
+		t.Fatalf("throttled to %d, want no limit", l)
+	}
+	e.ThrottleConnection(cid, 0)
+	if l := limit(); l != 1000 {
+		t.Fatalf("throttled to %d once the connection's own limit was removed", l)
+	}
+
+	if err := e.ThrottleConnection("unknown", 1000); err != ErrConnectionNotFound {
+		t.Fatalf("throttling an unknown connection failed with %v", err)
+	}
+}
+
+func TestBandwidthBucket(t *testing.T) {
+	var b bandwidth
+	now := time.Unix(1000, 0)
+	if n, wait := b.allowance(1000, now); n != 1000 || wait != 0 {
+		t.Fatalf("a full bucket allows %d bytes after %v", n, wait)
+	}
+	// a frame larger than the bucket is paid for with debt
+	b.wrote(3000, 1000, now)
+	if n, wait := b.allowance(1000, now); n != 0 || wait != 2*time.Second {
+		t.Fatalf("a bucket 2000 bytes in debt allows %d bytes after %v", n, wait)
+	}
+	now = now.Add(2500 * time.Millisecond)
+	if n, wait := b.allowance(1000, now); n != 500 || wait != 0 {
+		t.Fatalf("after the debt is paid the bucket allows %d bytes after %v", n, wait)
+	}
+	// no limit allows anything, and forgets the bucket
+	if n, wait := b.allowance(0, now); n != 0 || wait != 0 {
+		t.Fatalf("no limit allows %d bytes after %v", n, wait)
+	}
+	b.wrote(1<<20, 0, now)
+	if n, _ := b.allowance(1000, now); n != 1000 {
+		t.Fatalf("a bucket throttled again allows %d bytes", n)
+	}
+
+	b = bandwidth{}
+	b.wrote(100, 0, now)
+	b.wrote(200, 0, now)
+	if tp := b.throughput(now); tp != 0 {
+		t.Fatalf("a second still counting reports %d bytes", tp)
+	}
+	if tp := b.throughput(now.Add(time.Second)); tp != 300 {
+		t.Fatalf("the last second reports %d bytes, want 300", tp)
+	}
+	if tp := b.throughput(now.Add(3 * time.Second)); tp != 0 {
+		t.Fatalf("a quiet second reports %d bytes", tp)
+	}
+}
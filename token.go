@@ -0,0 +1,136 @@
+package relayr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errMissingConnectionID = errors.New("relayr: missing connectionId")
+	errMissingToken        = errors.New("relayr: missing connection token")
+	errTokenInvalid        = errors.New("relayr: invalid connection token")
+	errTokenExpired        = errors.New("relayr: connection token expired")
+)
+
+// tokenClaims are what a connection token states about the client it was
+// issued to.
+type tokenClaims struct {
+	ConnectionID string `json:"c"`
+	UserID       string `json:"u,omitempty"`
+	IssuedAt     int64  `json:"i"` // Unix seconds
+	Expires      int64  `json:"x"` // Unix seconds
+}
+
+// tokensEnabled reports whether clients are identified by connection
+// tokens rather than bare ConnectionIDs.
+func (e *Exchange) tokensEnabled() bool {
+	return len(e.options.ConnectionTokenKeys) > 0
+}
+
+// issueToken returns a token for the client with the given ConnectionID
+// and user, signed with the first of the ConnectionTokenKeys, or an empty
+// string when tokens are not enabled.
+func (e *Exchange) issueToken(cid, userID string) string {
+	if !e.tokensEnabled() {
+		return ""
+	}
+	now := time.Now()
+	payload, err := json.Marshal(tokenClaims{
+		ConnectionID: cid,
+		UserID:       userID,
+		IssuedAt:     now.Unix(),
+		Expires:      now.Add(e.options.ConnectionTokenTTL).Unix(),
+	})
+	if err != nil {
+		// the claims are strings and integers
+		panic(err)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(signToken(e.options.ConnectionTokenKeys[0], payload))
+}
+
+// verifyToken returns the claims of a token signed with any of the
+// ConnectionTokenKeys, so that tokens issued before a key was rotated
+// remain good until they expire.
+func (e *Exchange) verifyToken(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	enc := base64.RawURLEncoding
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return claims, errTokenInvalid
+	}
+	payload, err := enc.DecodeString(token[:i])
+	if err != nil {
+		return claims, errTokenInvalid
+	}
+	sig, err := enc.DecodeString(token[i+1:])
+	if err != nil {
+		return claims, errTokenInvalid
+	}
+
+	signed := false
+	for _, key := range e.options.ConnectionTokenKeys {
+		if hmac.Equal(sig, signToken(key, payload)) {
+			signed = true
+			break
+		}
+	}
+	if !signed || json.Unmarshal(payload, &claims) != nil || claims.ConnectionID == "" {
+		return tokenClaims{}, errTokenInvalid
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return tokenClaims{}, errTokenExpired
+	}
+	return claims, nil
+}
+
+func signToken(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// requestConnectionID returns the ConnectionID a request was made for:
+// its connectionId query parameter or, with connection tokens, that of
+// the verified token in its token parameter. Any error but
+// errMissingConnectionID is the token's.
+func (e *Exchange) requestConnectionID(r *http.Request) (string, error) {
+	if !e.tokensEnabled() {
+		if cid := r.URL.Query().Get("connectionId"); cid != "" {
+			return cid, nil
+		}
+		return "", errMissingConnectionID
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return "", errMissingToken
+	}
+	claims, err := e.verifyToken(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.ConnectionID, nil
+}
+
+// previousConnectionID returns the ConnectionID a negotiating client had
+// before, given the P it negotiated with: the ConnectionID itself or, with
+// connection tokens, its token. A token that does not verify names no
+// connection, and the client is given a new one.
+func (e *Exchange) previousConnectionID(p string) string {
+	if p == "" || !e.tokensEnabled() {
+		return p
+	}
+	claims, err := e.verifyToken(p)
+	if err != nil {
+		e.logger.Debugf("ignoring the previous connection of a negotiating client: %v", err)
+		return ""
+	}
+	return claims.ConnectionID
+}
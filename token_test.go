@@ -0,0 +1,193 @@
+package relayr
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	rclient "github.com/simon-whitehead/relayr/client"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+var (
+	primaryKey   = []byte("primary key")
+	secondaryKey = []byte("secondary key")
+	retiredKey   = []byte("retired key")
+)
+
+// signedToken returns a token stating claims, signed with key.
+func signedToken(key []byte, claims tokenClaims) string {
+	payload, _ := json.Marshal(claims)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(signToken(key, payload))
+}
+
+// addCall is a call to Calculator.Add as a long-polling client posts it.
+const addCall = `{"T":"s","R":"Calculator","M":"Add","A":[1,2]}`
+
+// requestWithToken makes a request of the Exchange srv serves, a call
+// when body is set and a poll otherwise, presenting token, returning the
+// status it was answered with and the error it gave, if any.
+func requestWithToken(t *testing.T, srv *httptest.Server, token, body string) (int, string) {
+	t.Helper()
+	var resp *http.Response
+	var err error
+	if body != "" {
+		resp, err = http.Post(srv.URL+"/relayr/call?token="+url.QueryEscape(token), "application/json", strings.NewReader(body))
+	} else {
+		resp, err = http.Get(srv.URL + "/relayr/longpoll?seq=0&token=" + url.QueryEscape(token))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res errorResponse
+	json.NewDecoder(resp.Body).Decode(&res)
+	return resp.StatusCode, res.Error
+}
+
+func TestConnectionTokens(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{ConnectionTokenKeys: [][]byte{primaryKey, secondaryKey}}, Calculator{})
+	res := negotiate(t, srv, "longpoll")
+	if res.Token == "" {
+		t.Fatal("negotiating returned no token")
+	}
+	other := negotiate(t, srv, "longpoll").ConnectionID
+	now := time.Now()
+	claims := tokenClaims{ConnectionID: res.ConnectionID, IssuedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()}
+
+	// the issued token's payload, naming another connection under the
+	// issued token's signature
+	forged, _ := json.Marshal(tokenClaims{ConnectionID: other, IssuedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()})
+	dot := strings.IndexByte(res.Token, '.')
+	issuedSig := res.Token[dot:]
+	tamperedSig := []byte(res.Token)
+	if first := &tamperedSig[dot+1]; *first == 'A' {
+		*first = 'B'
+	} else {
+		*first = 'A'
+	}
+	expired := claims
+	expired.IssuedAt, expired.Expires = now.Add(-2*time.Hour).Unix(), now.Add(-time.Hour).Unix()
+
+	for _, tt := range []struct {
+		name   string
+		token  string
+		status int
+		err    error
+	}{
+		{"issued", res.Token, http.StatusOK, nil},
+		{"tampered payload", base64.RawURLEncoding.EncodeToString(forged) + issuedSig, http.StatusUnauthorized, errTokenInvalid},
+		{"tampered signature", string(tamperedSig), http.StatusUnauthorized, errTokenInvalid},
+		{"no signature", base64.RawURLEncoding.EncodeToString(forged), http.StatusUnauthorized, errTokenInvalid},
+		{"expired", signedToken(primaryKey, expired), http.StatusUnauthorized, errTokenExpired},
+		{"rotated out", signedToken(retiredKey, claims), http.StatusUnauthorized, errTokenInvalid},
+		{"still rotating", signedToken(secondaryKey, claims), http.StatusOK, nil},
+		{"missing", "", http.StatusUnauthorized, errMissingToken},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			status, msg := requestWithToken(t, srv, tt.token, addCall)
+			if status != tt.status || (tt.err != nil && msg != tt.err.Error()) {
+				t.Fatalf("a call was answered %d %q, want %d %v", status, msg, tt.status, tt.err)
+			}
+			// a poll with a good token waits for frames
+			if tt.err == nil {
+				return
+			}
+			if status, msg := requestWithToken(t, srv, tt.token, ""); status != tt.status || msg != tt.err.Error() {
+				t.Fatalf("a poll was answered %d %q, want %d %v", status, msg, tt.status, tt.err)
+			}
+		})
+	}
+
+	// a bare ConnectionID no longer identifies a client
+	received := e.Stats().MessagesReceived
+	resp, err := http.Post(srv.URL+"/relayr/call?connectionId="+res.ConnectionID, "application/json", strings.NewReader(addCall))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("a call naming a bare ConnectionID was answered %d", resp.StatusCode)
+	}
+	if n := e.Stats().MessagesReceived - received; n != 0 {
+		t.Fatalf("%d messages were received from a client without its token", n)
+	}
+}
+
+func TestConnectionTokenWebSocketRefused(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{ConnectionTokenKeys: [][]byte{primaryKey}}, Calculator{})
+	res := negotiate(t, srv, "websocket")
+	now := time.Now()
+	for _, tt := range []struct {
+		name  string
+		query string
+		err   error
+	}{
+		{"missing", "connectionId=" + res.ConnectionID, errMissingToken},
+		{"rotated out", "token=" + signedToken(retiredKey, tokenClaims{ConnectionID: res.ConnectionID, IssuedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()}), errTokenInvalid},
+		{"expired", "token=" + signedToken(primaryKey, tokenClaims{ConnectionID: res.ConnectionID, IssuedAt: now.Add(-time.Hour).Unix(), Expires: now.Unix()}), errTokenExpired},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u := "ws" + srv.URL[len("http"):] + "/relayr/ws?" + tt.query
+			ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			ws.SetReadDeadline(time.Now().Add(testTimeout))
+			_, _, err = ws.ReadMessage()
+			if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != closeInvalidToken || ce.Text != tt.err.Error() {
+				t.Fatalf("the websocket was closed with %v, want %d %v", err, closeInvalidToken, tt.err)
+			}
+		})
+	}
+}
+
+// TestConnectionTokenRenegotiate checks that a client negotiating with a
+// token that does not verify as its previous connection is given a new
+// one rather than the connection the token names.
+func TestConnectionTokenRenegotiate(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{ConnectionTokenKeys: [][]byte{primaryKey}}, Calculator{})
+	first := negotiate(t, srv, "longpoll")
+	now := time.Now()
+	for _, previous := range []string{
+		first.ConnectionID,
+		signedToken(retiredKey, tokenClaims{ConnectionID: first.ConnectionID, IssuedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()}),
+	} {
+		body, _ := json.Marshal(protocol.Negotiation{T: "longpoll", V: protocol.Version, P: previous})
+		resp, err := http.Post(srv.URL+"/relayr/negotiate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res protocol.NegotiationResponse
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil || res.ConnectionID == "" || res.ConnectionID == first.ConnectionID || res.Reconnected {
+			t.Fatalf("negotiating with %q as the previous connection returned %+v, %v", previous, res, err)
+		}
+	}
+}
+
+func TestConnectionTokenClients(t *testing.T) {
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			_, srv := serve(t, ExchangeOptions{ConnectionTokenKeys: [][]byte{primaryKey}}, Calculator{})
+			c := dialWith(t, srv, rclient.Options{Transport: transport})
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			v, err := c.Call(ctx, "Calculator", "Add", 2, 3)
+			if err != nil || string(v) != "5" {
+				t.Fatalf("a call with a connection token returned %s, %v", v, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package relayr
+
+import "context"
+
+// Tracer starts the spans the Exchange traces its work with, so that it
+// can report to a tracing system such as OpenTelemetry; the oteltracer
+// package adapts an OpenTelemetry tracer. Traces are propagated as W3C
+// traceparent headers.
+type Tracer interface {
+	// StartSpan starts a span with the given name, a child of the span
+	// identified by parent, or the root of a new trace when parent is
+	// empty or cannot be parsed.
+	StartSpan(name, parent string) Span
+}
+
+// Span is a unit of work started by a Tracer.
+type Span interface {
+	// SetAttribute records an attribute of the span.
+	SetAttribute(key, value string)
+	// TraceParent returns the traceparent identifying the span, or an
+	// empty string if it is not recorded.
+	TraceParent() string
+	// Context returns a context derived from parent that carries the
+	// span, so that spans started from it are the span's children.
+	Context(parent context.Context) context.Context
+	// End ends the span, err being the error the work failed with, if
+	// any.
+	End(err error)
+}
+
+// The names of the spans the Exchange starts.
+const (
+	SpanNegotiate = "relayr.negotiate" // a client negotiating a connection
+	SpanUpgrade   = "relayr.upgrade"   // a websocket being upgraded and added
+	SpanDispatch  = "relayr.dispatch"  // a call a client made to a relay method
+	SpanFanOut    = "relayr.fanout"    // a call to a client method made to a group
+)
+
+// noopTracer is the Tracer used when ExchangeOptions.Tracer is not set.
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(name, parent string) Span { return noopSpan{} }
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key, value string)                 {}
+func (noopSpan) TraceParent() string                            { return "" }
+func (noopSpan) Context(parent context.Context) context.Context { return parent }
+func (noopSpan) End(err error)                                  {}
+
+// spanParent returns the traceparent that calls made under span carry to
+// clients: the span's own, or the parent it was started with when it is
+// not recorded, so that traces pass through an Exchange without a Tracer.
+func spanParent(span Span, parent string) string {
+	if p := span.TraceParent(); p != "" {
+		return p
+	}
+	return parent
+}
+
+// TraceParentFromContext returns the traceparent the client sent with the
+// call being served by the relay method that received ctx, or that of the
+// span the Exchange's Tracer started for it.
+func TraceParentFromContext(ctx context.Context) (string, bool) {
+	p, ok := ctx.Value(traceParentKey).(string)
+	return p, ok && p != ""
+}
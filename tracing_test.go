@@ -0,0 +1,46 @@
+package relayr
+
+import (
+	"context"
+	"testing"
+)
+
+// BenchmarkNoopTracing measures what tracing costs an Exchange without a
+// Tracer: the spans a dispatch and a group fan-out start with the no-op
+// Tracer, which must allocate nothing, set against a whole dispatch.
+func BenchmarkNoopTracing(b *testing.B) {
+	e := newExchange(b, "http://localhost/relayr", ExchangeOptions{})
+	if err := e.RegisterRelay(Calculator{}); err != nil {
+		b.Fatal(err)
+	}
+	relay := e.getRelayByName("Calculator", "cid")
+	args := []interface{}{2, 3}
+
+	b.Run("dispatch-span", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			span := e.options.Tracer.StartSpan(SpanDispatch, "")
+			span.SetAttribute("relayr.relay", relay.Name)
+			span.SetAttribute("relayr.method", "Add")
+			span.SetAttribute("relayr.connection_id", "cid")
+			_ = spanParent(span, "")
+			_ = span.Context(context.Background())
+			span.End(nil)
+		}
+	})
+	b.Run("fanout-span", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, span := e.startFanOut(relay, "room", "tick")
+			span.End(nil)
+		}
+	})
+	b.Run("dispatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if v, err := e.invoke(relay, "cid", "websocket", "", "", "Add", args); err != nil || v != 5 {
+				b.Fatalf("Add returned %v, %v", v, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package relayr
+
+// CallWithTransform is Call for calls whose arguments differ from one
+// client to the next, such as messages in each user's language. transform
+// is called for each client in the target, just before the call is
+// encoded for it, with the client's ConnectionInfo, tags included, and a
+// copy of args, and returns the arguments to call the client with, or nil
+// to skip it. The call is encoded for each client rather than once for
+// every client speaking the same codec, so Call is better when transform
+// is not needed. Unlike Call, the call is neither relayed through a
+// Backplane nor retained for replay. It returns errors as Call does.
+func (t *ClientTarget) CallWithTransform(fn string, args []interface{}, transform func(info ConnectionInfo, args []interface{}) []interface{}) error {
+	e, relay := t.ops.e, t.ops.relay
+	switch {
+	case t.caller:
+		if relay.ConnectionID == "" || containsString(t.except, relay.ConnectionID) {
+			return nil
+		}
+		return e.callTransformed(relay, "", relay.ConnectionID, fn, args, transform)
+	case t.connectionID != "":
+		if containsString(t.except, t.connectionID) {
+			return nil
+		}
+		return e.callTransformed(relay, "", t.connectionID, fn, args, transform)
+	case t.all:
+		return e.callEachTransformed(relay, "Global", e.connectionIDs(), t.except, fn, args, transform)
+	case t.user != "":
+		return e.callEachTransformed(relay, "user:"+t.user, e.UserConnections(t.user), t.except, fn, args, transform)
+	case t.tagged || t.where != nil:
+		return e.callEachTransformed(relay, t.name(), t.ids(), t.except, fn, args, transform)
+	case t.callerGroups:
+		if relay.ConnectionID == "" {
+			return nil
+		}
+		members, _ := e.membersOfCallerGroups(relay.ConnectionID)
+		return e.callEachTransformed(relay, callerGroupsName, clientIDs(members), t.except, fn, args, transform)
+	case t.pattern != "":
+		members, err := e.membersOfGroupsMatching(t.pattern)
+		if err != nil {
+			return err
+		}
+		return e.callEachTransformed(relay, t.pattern, clientIDs(members), t.except, fn, args, transform)
+	}
+	return e.callEachTransformed(relay, t.group, e.GroupMembers(t.group), t.except, fn, args, transform)
+}
+
+// callEachTransformed makes a call with CallWithTransform to the clients
+// with the given ConnectionIDs, sent to the named group, skipping those
+// listed in except. It returns a *GroupCallError if the call could not be
+// delivered to some of them.
+func (e *Exchange) callEachTransformed(relay *Relay, group string, ids, except []string, fn string, args []interface{}, transform func(ConnectionInfo, []interface{}) []interface{}) error {
+	result := &GroupCallError{Group: group}
+	for _, id := range ids {
+		if containsString(except, id) {
+			continue
+		}
+		if err := e.callTransformed(relay, group, id, fn, args, transform); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[id] = err
+			continue
+		}
+		result.Delivered++
+	}
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// callTransformed makes a call with CallWithTransform to the client with
+// the given ConnectionID, with the arguments transform gives for it. It
+// returns ErrConnectionNotFound if there is no such client.
+func (e *Exchange) callTransformed(relay *Relay, group, cid, fn string, args []interface{}, transform func(ConnectionInfo, []interface{}) []interface{}) error {
+	c := e.getClientByConnectionID(cid)
+	if c == nil {
+		return ErrConnectionNotFound
+	}
+	info, ok := e.ConnectionInfo(cid)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	out := transform(info, append([]interface{}(nil), args...))
+	if out == nil {
+		return nil
+	}
+	return e.deliverToMember(c, nil, relay, group, fn, out)
+}
+
+// clientIDs returns the ConnectionIDs of clients.
+func clientIDs(cs []*client) []string {
+	ids := make([]string, len(cs))
+	for i, c := range cs {
+		ids[i] = c.ConnectionID
+	}
+	return ids
+}
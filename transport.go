@@ -1,7 +1,209 @@
 package relayr
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrConnectionNotFound is returned when a message is sent to a
+	// ConnectionID that is not connected to the Exchange.
+	ErrConnectionNotFound = errors.New("relayr: connection not found")
+
+	// ErrConnectionGone is returned when a call is made to a single client
+	// that is not connected, such as the caller of a Relay retained after
+	// the client went away. It wraps ErrConnectionNotFound, so errors.Is
+	// matches either.
+	ErrConnectionGone = fmt.Errorf("relayr: connection gone: %w", ErrConnectionNotFound)
+
+	// ErrBufferFull is returned when a message could not be queued, or
+	// displaced an older one, because the client is not keeping up.
+	ErrBufferFull = errors.New("relayr: connection buffer full")
+)
+
 // Transport represents a communication mechanism between
 // a Relay and a client.
+//
+// Transports other than the built-in "websocket" and "longpoll" ones are
+// added with Exchange.RegisterTransport. A client negotiates with the
+// Exchange over HTTP as usual, naming the transport, and then connects to
+// the transport with the ConnectionID it was given. The transport must
+// call Exchange.Connected once the client has connected, pass the calls
+// the client makes to Exchange.ServeCall, and call Exchange.Disconnected
+// when the client's connection closes so that the Exchange can remove the
+// client from its groups.
 type Transport interface {
-	CallClientFunction(relay *Relay, fn string, args ...interface{})
+	// AddConnection is called when a client negotiates a connection over
+	// the transport, before the client connects to it.
+	AddConnection(connectionID string)
+
+	// CallClientFunction queues a call to a client side method for the
+	// client with the Relay's ConnectionID. It returns an error if the
+	// call could not be queued. Calls made one after another, from any
+	// goroutines, must reach the client in the order they were made.
+	CallClientFunction(relay *Relay, fn string, args ...interface{}) error
+
+	// RemoveConnection closes a client's connection for good, passing on
+	// the reason if it can and telling the client not to reconnect. The
+	// Exchange has already forgotten the client, so the transport need
+	// not call Disconnected.
+	RemoveConnection(connectionID, reason string)
+
+	// Close is called when the Exchange closes.
+	Close() error
+}
+
+// rawSender is implemented by the built-in transports, which can deliver
+// a frame that has already been encoded to a single connection.
+type rawSender interface {
+	sendRaw(connectionID string, frame []byte) error
+
+	// sendCall queues an encoded call to a client method. When key is not
+	// empty it replaces a queued call with the same coalescing key. The
+	// policy applies if the connection's queue is full, or the Exchange's
+	// OverflowPolicy when it is unset. A call still queued once expires
+	// has passed is dropped; a zero expires never passes.
+	sendCall(connectionID string, frame []byte, key string, policy OverflowPolicy, expires time.Time) error
+}
+
+// progressSender is implemented by the built-in transports, which can
+// queue an encoded progress frame Low, replacing the one queued with the
+// same coalescing key.
+type progressSender interface {
+	sendProgress(connectionID string, frame []byte, key string) error
+}
+
+// urgentSender is implemented by the transports that throttle what they
+// send, which can send an encoded ping or control frame High, without
+// waiting for the connection's bandwidth.
+type urgentSender interface {
+	sendUrgent(connectionID string, frame []byte) error
+}
+
+// RegisterTransport adds a transport that clients may negotiate by name.
+// It must be called before the Exchange is frozen, which it is once it
+// serves a request.
+func (e *Exchange) RegisterTransport(name string, t Transport) error {
+	if e.frozen.Load() {
+		return errFrozen
+	}
+	if name == "" {
+		return errors.New("relayr: transport name is empty")
+	}
+	if _, ok := e.transports[name]; ok {
+		return fmt.Errorf("relayr: a transport named %s is already registered", name)
+	}
+
+	e.transports[name] = &registeredTransport{Transport: t, name: name, e: e}
+	return nil
+}
+
+// registeredTransport runs the outbound interceptors for a transport added
+// with RegisterTransport, as the built-in transports do for themselves.
+type registeredTransport struct {
+	Transport
+	name string
+	e    *Exchange
+}
+
+func (t *registeredTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) error {
+	fn, args, ok := t.e.interceptOutgoing(relay, relay.ConnectionID, t.name, fn, args)
+	if !ok {
+		return nil
+	}
+	if t.e.tapped(relay.ConnectionID) != nil {
+		t.e.tapEncoded(relay.ConnectionID, tapOutbound, &clientInvocation{Relay: relay.Name, Method: fn, Arguments: wireArgs(args)})
+	}
+	return t.Transport.CallClientFunction(relay, fn, args...)
+}
+
+// Connected is called by a Transport when a client that negotiated a
+// connection over it has connected. It returns ErrConnectionNotFound if
+// the Exchange does not know the client, in which case the transport
+// should refuse the connection.
+func (e *Exchange) Connected(connectionID string) error {
+	if e.getClientByConnectionID(connectionID) == nil {
+		return ErrConnectionNotFound
+	}
+	e.connectionEstablished(connectionID)
+	return nil
+}
+
+// Disconnected is called by a Transport when a client's connection has
+// closed. The client may reconnect within the ReconnectGracePeriod.
+func (e *Exchange) Disconnected(connectionID string) {
+	e.disconnectClient(connectionID, ReasonClosed)
+}
+
+// ServeCall is called by a Transport to invoke a relay method for a client
+// connected over it, returning the method's result. The call is subject
+// to the Exchange's rate limits, authorization rules, Limits and
+// interceptors. It blocks until the method returns, so transports should
+// not call it from the goroutine reading the client's messages.
+func (e *Exchange) ServeCall(connectionID, relayName, method string, args []interface{}) (interface{}, error) {
+	c := e.getClientByConnectionID(connectionID)
+	if c == nil {
+		return nil, ErrConnectionNotFound
+	}
+	e.counters.received.Add(1)
+	if e.tapped(connectionID) != nil {
+		e.tapEncoded(connectionID, tapInbound, &inboundFrame{
+			Type:      frameType(c.protocol, frameServerInvocation),
+			Server:    c.protocol < 1,
+			Relay:     relayName,
+			Method:    method,
+			Arguments: args,
+		})
+	}
+	transport := e.transportName(c.transport())
+	if err := e.allowCall(connectionID, relayName, method); err != nil {
+		return nil, err
+	}
+	if err := e.authorizeCall(connectionID, transport, relayName, method, args); err != nil {
+		return nil, err
+	}
+	e.emit(ExchangeEvent{Type: EventCallReceived, ConnectionID: connectionID, Transport: transport, Relay: relayName, Method: method})
+
+	relay := e.getRelayByName(relayName, connectionID)
+	if relay == nil {
+		return nil, &CallError{Relay: relayName, Reason: "does not exist"}
+	}
+
+	if limit := e.dispatcher.limitFor(relayName, method); limit != nil {
+		if err := e.dispatcher.acquire(limit); err != nil {
+			if err == ErrServerBusy {
+				e.counters.busy.Add(1)
+			}
+			return nil, err
+		}
+		defer e.dispatcher.release(limit)
+	}
+	return e.invoke(relay, connectionID, transport, "", "", method, args)
+}
+
+// GroupCallError is returned from a call to a group when it could not be
+// delivered to some of the group's members connected to this Exchange.
+type GroupCallError struct {
+	Group     string
+	Delivered int              // the number of members the call was queued for
+	Failed    map[string]error // the errors for the other members, by ConnectionID
+}
+
+func (e *GroupCallError) Error() string {
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = id + ": " + e.Failed[id].Error()
+	}
+
+	return fmt.Sprintf("relayr: call to group '%s' failed for %d of %d clients (%s)",
+		e.Group, len(e.Failed), len(e.Failed)+e.Delivered, strings.Join(parts, "; "))
 }
@@ -0,0 +1,138 @@
+package relayr_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr"
+	"github.com/simon-whitehead/relayr/protocol"
+	"github.com/simon-whitehead/relayr/relayrtest"
+)
+
+// webSocketConn is a client's websocket to the Exchange a server serves.
+type webSocketConn struct {
+	srv *httptest.Server
+	ws  *websocket.Conn
+}
+
+func connectWebSocket(e *relayr.Exchange, _ relayr.Transport, connectionID string) (relayrtest.Conn, error) {
+	srv := httptest.NewServer(e)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/relayr/ws?connectionId="+connectionID, nil)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return &webSocketConn{srv: srv, ws: ws}, nil
+}
+
+func (c *webSocketConn) Receive(timeout time.Duration) ([]byte, error) {
+	c.ws.SetReadDeadline(time.Now().Add(timeout))
+	_, m, err := c.ws.ReadMessage()
+	return m, err
+}
+
+func (c *webSocketConn) Close() error {
+	err := c.ws.Close()
+	c.srv.Close()
+	return err
+}
+
+// longPollConn is a client long-polling the Exchange a server serves.
+type longPollConn struct {
+	srv *httptest.Server
+	cid string
+
+	lock    sync.Mutex
+	seq     uint64
+	pending []json.RawMessage
+	closed  bool
+}
+
+func connectLongPoll(e *relayr.Exchange, _ relayr.Transport, connectionID string) (relayrtest.Conn, error) {
+	c := &longPollConn{srv: httptest.NewServer(e), cid: connectionID}
+	// the client is connected once it first polls
+	if err := c.poll(relayrtest.Timeout); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// poll makes a long poll, keeping the frames it returns.
+func (c *longPollConn) poll(timeout time.Duration) error {
+	url := fmt.Sprintf("%s/relayr/longpoll?connectionId=%s&seq=%d", c.srv.URL, c.cid, c.seq)
+	resp, err := (&http.Client{Timeout: timeout}).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("polling: %s", resp.Status)
+	}
+	var res struct {
+		protocol.Control
+		protocol.LongPollBatch
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if res.Type == protocol.TypeControl {
+		return fmt.Errorf("polling: %s %s", res.Command, res.Reason)
+	}
+	c.seq = res.Seq
+	c.pending = append(c.pending, res.Messages...)
+	return nil
+}
+
+func (c *longPollConn) Receive(timeout time.Duration) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for deadline := time.Now().Add(timeout); len(c.pending) == 0; {
+		if c.closed {
+			return nil, errors.New("closed")
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out")
+		}
+		if err := c.poll(time.Until(deadline)); err != nil {
+			return nil, err
+		}
+	}
+	m := c.pending[0]
+	c.pending = c.pending[1:]
+	return m, nil
+}
+
+// Close stops polling, which the Exchange notices once the client has
+// been idle for its LongPollIdleTimeout.
+func (c *longPollConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	c.srv.Close()
+	return nil
+}
+
+func TestBuiltInTransports(t *testing.T) {
+	t.Run("websocket", func(t *testing.T) {
+		relayrtest.TestTransport(t, relayrtest.Harness{Name: "websocket", Connect: connectWebSocket})
+	})
+	t.Run("longpoll", func(t *testing.T) {
+		relayrtest.TestTransport(t, relayrtest.Harness{
+			Name:    "longpoll",
+			Connect: connectLongPoll,
+			Options: relayr.ExchangeOptions{
+				LongPollMaxWait:     200 * time.Millisecond,
+				LongPollIdleTimeout: 500 * time.Millisecond,
+			},
+		})
+	})
+}
@@ -0,0 +1,55 @@
+package relayr
+
+import (
+	"errors"
+
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// closeUpgradeRefused is the websocket close code sent to long-polling
+// clients that open a websocket to upgrade to when they cannot, telling
+// them to carry on polling.
+const closeUpgradeRefused = 4006
+
+// commandUpgraded is the command of the control frame that tells a client
+// its connection has upgraded to a websocket: first over the websocket,
+// ahead of the frames it had yet to poll for, and in answer to a poll made
+// after.
+const commandUpgraded = protocol.CommandUpgraded
+
+var errUpgradeRefused = errors.New("relayr: connection cannot upgrade now, carry on polling")
+
+// upgradeIntervalFor returns the Upgrade of a negotiation response for a
+// client using the named transport.
+func (e *Exchange) upgradeIntervalFor(transport string) int64 {
+	if transport != "longpoll" || e.options.LongPollUpgradeInterval < 0 {
+		return 0
+	}
+	return e.options.LongPollUpgradeInterval.Milliseconds()
+}
+
+// upgradeLongPoll hands a long-polling client that has seen the frames up
+// to seq over to the websocket connection o, which has yet to be added:
+// the frames queued for it after seq are sent over o, after those on o
+// already, and the client is connected over the websocket transport from
+// then on. Nothing is queued for the client meanwhile, so no frame is lost
+// or sent twice. It returns errUpgradeRefused if the client cannot upgrade
+// now.
+func (e *Exchange) upgradeLongPoll(o *connection, seq uint64) error {
+	c := e.getClientByConnectionID(o.id)
+	if c == nil || e.options.LongPollUpgradeInterval < 0 {
+		return errUpgradeRefused
+	}
+	lp := e.transports["longpoll"].(*longPollTransport)
+	ok := lp.handOver(o.id, seq, cap(o.out)-len(o.out), func(pending []outFrame) {
+		o.c.expect(o.id, pending)
+		c.setTransport(o.c)
+		e.conns.setTransport(o.id, "websocket")
+	})
+	if !ok {
+		return errUpgradeRefused
+	}
+	e.counters.upgraded.Add(1)
+	e.logger.Infof("long-poll client %s upgraded to a websocket", o.id)
+	return nil
+}
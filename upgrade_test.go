@@ -0,0 +1,211 @@
+package relayr
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+// tickNumbers returns the numbers the ticks among frames carry, passing
+// over frames that are not client calls.
+func tickNumbers(t *testing.T, frames []json.RawMessage) []int {
+	t.Helper()
+	var r []int
+	for _, f := range frames {
+		var head struct{ T string }
+		if json.Unmarshal(f, &head) != nil || head.T != protocol.TypeClientInvocation {
+			continue
+		}
+		for _, inv := range clientCalls(t, []json.RawMessage{f}) {
+			if inv.Method == "tick" {
+				r = append(r, int(inv.Arguments[0].(float64)))
+			}
+		}
+	}
+	return r
+}
+
+// TestLongPollUpgradeHandover upgrades a long-polling client to a
+// websocket while it is called as fast as the calls can be made, and
+// checks that it receives every call once, in order.
+func TestLongPollUpgradeHandover(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	ops := e.Clients(Ticker{}).Client(cid)
+
+	// the client is called, paced to stay within its buffer, until it has
+	// received calls over its websocket, so before, during and after the
+	// upgrade
+	stop := make(chan struct{})
+	called := make(chan int, 1)
+	go func() {
+		i := 0
+		defer func() { called <- i }()
+		for ; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := ops.Call("tick", i); err != nil {
+				t.Errorf("calling the client: %v", err)
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	// the first calls arrive by polling, as the client script polls:
+	// frames it has seen already are skipped
+	var got []int
+	var seq uint64
+	for len(got) < 20 {
+		res := poll(t, srv, cid, seq)
+		first := res.Seq - uint64(len(res.Messages)) + 1
+		for i, m := range res.Messages {
+			if first+uint64(i) > seq {
+				got = append(got, tickNumbers(t, []json.RawMessage{m})...)
+			}
+		}
+		seq = res.Seq
+	}
+
+	// then the client opens a websocket naming the last frame it polled
+	// for, and is told of the upgrade ahead of the frames after it
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[len("http"):]+"/relayr/ws?connectionId="+cid+"&upgrade="+strconv.FormatUint(seq, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	upgraded := false
+	total := -1
+	for total < 0 || len(got) < total {
+		frames := readFrames(t, ws)
+		for _, f := range frames {
+			var z protocol.Control
+			if json.Unmarshal(f, &z) == nil && z.Type == protocol.TypeControl && z.Command == protocol.CommandUpgraded {
+				upgraded = true
+			}
+		}
+		ticks := tickNumbers(t, frames)
+		if len(ticks) > 0 && !upgraded {
+			t.Fatal("calls arrived over the websocket before it was told of the upgrade")
+		}
+		got = append(got, ticks...)
+		if total < 0 && len(got) >= 200 {
+			close(stop)
+			total = <-called
+		}
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("the calls arrived as %v, want each of 0 to %d once, in order", got, total-1)
+		}
+	}
+
+	// polls made after are told of the upgrade
+	if res := poll(t, srv, cid, seq); res.Type != protocol.TypeControl || res.Command != protocol.CommandUpgraded {
+		t.Fatalf("a poll after the upgrade was answered %+v", res)
+	}
+	if n := e.Stats().UpgradedClients; n != 1 {
+		t.Fatalf("Stats counts %d upgraded clients, want 1", n)
+	}
+}
+
+// TestLongPollUpgradeAnswersWaitingPoll checks that a poll waiting as its
+// client upgrades is answered, telling the client of the upgrade, and that
+// calls made after reach the client over its websocket alone.
+func TestLongPollUpgradeAnswersWaitingPoll(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{LongPollMaxWait: time.Minute}, Ticker{})
+	cid := negotiate(t, srv, "longpoll").ConnectionID
+	ops := e.Clients(Ticker{}).Client(cid)
+	if err := ops.Call("tick", 0); err != nil {
+		t.Fatal(err)
+	}
+	res := poll(t, srv, cid, 0)
+	if ticks := tickNumbers(t, res.Messages); len(ticks) != 1 {
+		t.Fatalf("polled for %v", ticks)
+	}
+
+	waiting := make(chan pollResult, 1)
+	go func() {
+		var r pollResult
+		resp, err := http.Get(srv.URL + "/relayr/longpoll?connectionId=" + cid + "&seq=" + strconv.FormatUint(res.Seq, 10))
+		if err == nil {
+			json.NewDecoder(resp.Body).Decode(&r)
+			resp.Body.Close()
+		}
+		waiting <- r
+	}()
+	waitWaiting(t, e, 1)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[len("http"):]+"/relayr/ws?connectionId="+cid+"&upgrade="+strconv.FormatUint(res.Seq, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	select {
+	case r := <-waiting:
+		if r.Type != protocol.TypeControl || r.Command != protocol.CommandUpgraded {
+			t.Fatalf("the waiting poll was answered %+v", r)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the waiting poll was not answered")
+	}
+	if err := ops.Call("tick", 1); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if ticks := tickNumbers(t, readFrames(t, ws)); len(ticks) > 0 {
+			if len(ticks) != 1 || ticks[0] != 1 {
+				t.Fatalf("the websocket was sent %v, want the call after the upgrade alone", ticks)
+			}
+			break
+		}
+	}
+}
+
+func TestLongPollUpgradeRefused(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		opts  ExchangeOptions
+		query func(cid string) string
+	}{
+		{"disabled", ExchangeOptions{LongPollUpgradeInterval: -1}, func(cid string) string { return "connectionId=" + cid + "&upgrade=0" }},
+		{"bad seq", ExchangeOptions{}, func(cid string) string { return "connectionId=" + cid + "&upgrade=x" }},
+		{"unseen seq", ExchangeOptions{}, func(cid string) string { return "connectionId=" + cid + "&upgrade=5" }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := serve(t, tt.opts, Ticker{})
+			cid := negotiate(t, srv, "longpoll").ConnectionID
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[len("http"):]+"/relayr/ws?"+tt.query(cid), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			ws.SetReadDeadline(time.Now().Add(testTimeout))
+			for {
+				_, _, err := ws.ReadMessage()
+				if ce, ok := err.(*websocket.CloseError); ok {
+					if ce.Code != closeUpgradeRefused {
+						t.Fatalf("the websocket was closed with %v, want %d", err, closeUpgradeRefused)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the client carries on polling
+			if status := callOverHTTP(t, srv, cid, "Ticker", "Subscribe", "room"); status != http.StatusOK {
+				t.Fatalf("a call after the refusal was answered %d", status)
+			}
+		})
+	}
+}
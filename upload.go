@@ -0,0 +1,309 @@
+package relayr
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The errors an IncomingStream fails with when its upload is cut short.
+// A client that disconnects mid-upload fails it with ErrDisconnected.
+var (
+	ErrUploadTooLarge = errors.New("relayr: upload over the MaxUploadBytes")
+	ErrUploadTimedOut = errors.New("relayr: upload took longer than the MaxUploadDuration")
+	ErrUploadAborted  = errors.New("relayr: upload aborted by the client")
+)
+
+var (
+	errUploadOverrun  = errors.New("relayr: upload sent more chunks than it was allowed")
+	errUploadNotBytes = errors.New("relayr: upload chunk is neither a string nor bytes")
+)
+
+var incomingStreamType = reflect.TypeOf((*IncomingStream)(nil)).Elem()
+
+// IncomingStream is the upload a client makes to a server method that
+// takes one after its *Relay and any context.Context, as
+//
+//	func (r Orders) ImportCsv(relay *relayr.Relay, stream relayr.IncomingStream) (int, error)
+//
+// which the client script calls as RelayR.Orders.server.importCsv.stream(),
+// writing the chunks it reads. The client may only send as many chunks
+// as the UploadBufferSize ahead of those the method has read, so a method
+// that reads slowly slows the client down rather than having the chunks
+// pile up in memory.
+//
+// A method called without an upload, as by callServer, reads an empty
+// stream. The stream is read from the method's goroutine alone, and not
+// once the method has returned.
+type IncomingStream interface {
+	// Next blocks until the next chunk arrives and returns it, decoded
+	// as the arguments of calls are. It returns io.EOF once the client
+	// has ended the upload and every chunk has been read, or the error
+	// that cut the upload short: ErrDisconnected, ErrUploadAborted,
+	// ErrUploadTooLarge or ErrUploadTimedOut.
+	Next() (interface{}, error)
+
+	// Read reads the upload as a stream of bytes, for uploads whose
+	// chunks are strings, or bytes with a binary codec. It fails as Next
+	// does.
+	Read(p []byte) (int, error)
+}
+
+// incomingStream is the IncomingStream of an upload, fed by the chunks
+// its client sends. The chunks are numbered, so that those that arrive
+// out of order over long polling are read in order.
+type incomingStream struct {
+	e      *Exchange
+	cid    string
+	id     string // the InvocationID of the call reading it
+	buffer uint64 // the UploadBufferSize
+	timer  *time.Timer
+	ready  chan struct{} // signalled when a chunk arrives or the upload ends
+	rest   []byte        // what Read has yet to return of the last chunk
+
+	lock    sync.Mutex
+	chunks  map[uint64]interface{} // arrived but not yet read, by number
+	next    uint64                 // the number of the next chunk to read
+	granted uint64                 // the chunks numbered below this may be sent
+	total   uint64                 // the number of chunks, once ended
+	ended   bool
+	bytes   int64 // received, as the size of the frames carrying the chunks
+	err     error // why the upload was cut short
+}
+
+// endedStream returns the IncomingStream read by a method called without
+// an upload.
+func endedStream() *incomingStream {
+	return &incomingStream{ended: true, ready: make(chan struct{}, 1)}
+}
+
+func (s *incomingStream) Next() (interface{}, error) {
+	for {
+		s.lock.Lock()
+		if s.ended && s.next == s.total {
+			s.lock.Unlock()
+			return nil, io.EOF
+		}
+		if s.err != nil {
+			err := s.err
+			s.lock.Unlock()
+			return nil, err
+		}
+		if v, ok := s.chunks[s.next]; ok {
+			delete(s.chunks, s.next)
+			s.next++
+			granted := s.creditLocked()
+			s.lock.Unlock()
+			if granted > 0 {
+				s.e.sendFrame(s.cid, "upload credit", &uploadCredit{InvocationID: s.id, Granted: granted})
+			}
+			return v, nil
+		}
+		s.lock.Unlock()
+		<-s.ready
+	}
+}
+
+func (s *incomingStream) Read(p []byte) (int, error) {
+	for len(s.rest) == 0 {
+		v, err := s.Next()
+		if err != nil {
+			return 0, err
+		}
+		switch chunk := v.(type) {
+		case string:
+			s.rest = []byte(chunk)
+		case []byte:
+			s.rest = chunk
+		default:
+			return 0, errUploadNotBytes
+		}
+	}
+	n := copy(p, s.rest)
+	s.rest = s.rest[n:]
+	return n, nil
+}
+
+// creditLocked grants the client more chunks once it has less than half
+// the buffer left to send, returning the new grant, or 0 if there is
+// none.
+func (s *incomingStream) creditLocked() uint64 {
+	if s.ended || s.granted-s.next > s.buffer/2 {
+		return 0
+	}
+	s.granted = s.next + s.buffer
+	return s.granted
+}
+
+// put adds a chunk of size bytes, numbered seq, or the end of the upload
+// when final is set, with seq then the number of chunks. It returns the
+// error the upload was cut short with if the chunk broke its limits.
+func (s *incomingStream) put(seq uint64, final bool, args []interface{}, size int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil || s.ended && (final || seq >= s.total) {
+		return nil
+	}
+	limit := s.granted
+	if final {
+		limit++
+	}
+	if seq >= limit {
+		return s.abortLocked(errUploadOverrun)
+	}
+	if final {
+		s.ended, s.total = true, seq
+		s.signal()
+		return nil
+	}
+	s.bytes += int64(size)
+	if max := s.e.options.MaxUploadBytes; max > 0 && s.bytes > max {
+		return s.abortLocked(ErrUploadTooLarge)
+	}
+	if seq < s.next {
+		return nil
+	}
+	var chunk interface{}
+	if len(args) > 0 {
+		chunk = args[0]
+	}
+	s.chunks[seq] = chunk
+	s.signal()
+	return nil
+}
+
+// abort cuts the upload short with err, unless it has been already.
+func (s *incomingStream) abort(err error) {
+	s.lock.Lock()
+	s.abortLocked(err)
+	s.lock.Unlock()
+}
+
+func (s *incomingStream) abortLocked(err error) error {
+	if s.err == nil {
+		s.err = err
+		s.signal()
+	}
+	return s.err
+}
+
+func (s *incomingStream) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// uploads tracks the uploads each connection is making, by the
+// InvocationID of the call reading them.
+type uploads struct {
+	lock   sync.Mutex
+	byConn map[string]map[string]*incomingStream
+}
+
+func newUploads() *uploads {
+	return &uploads{byConn: make(map[string]map[string]*incomingStream)}
+}
+
+// get returns a connection's upload to the call with the given
+// InvocationID, or nil if there is none.
+func (u *uploads) get(cid, id string) *incomingStream {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.byConn[cid][id]
+}
+
+// remove forgets an upload once the call reading it has returned.
+func (u *uploads) remove(cid, id string) {
+	u.lock.Lock()
+	s := u.byConn[cid][id]
+	delete(u.byConn[cid], id)
+	if len(u.byConn[cid]) == 0 {
+		delete(u.byConn, cid)
+	}
+	u.lock.Unlock()
+
+	if s != nil && s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// abort cuts short a connection's upload to the call with the given
+// InvocationID with err, or every upload it is making when id is empty.
+func (u *uploads) abort(cid, id string, err error) {
+	u.lock.Lock()
+	var streams []*incomingStream
+	for sid, s := range u.byConn[cid] {
+		if id == "" || sid == id {
+			streams = append(streams, s)
+		}
+	}
+	u.lock.Unlock()
+
+	for _, s := range streams {
+		s.abort(err)
+	}
+}
+
+// abortAll cuts short every upload with err.
+func (u *uploads) abortAll(err error) {
+	u.lock.Lock()
+	var streams []*incomingStream
+	for _, byID := range u.byConn {
+		for _, s := range byID {
+			streams = append(streams, s)
+		}
+	}
+	u.lock.Unlock()
+
+	for _, s := range streams {
+		s.abort(err)
+	}
+}
+
+// openUpload starts the upload a client is making to the call it sent
+// with the given InvocationID, granting it the UploadBufferSize of
+// chunks. Calls sent without an InvocationID cannot upload.
+func (e *Exchange) openUpload(cid, id string) {
+	if id == "" {
+		return
+	}
+	o := e.options
+	s := &incomingStream{
+		e:       e,
+		cid:     cid,
+		id:      id,
+		buffer:  uint64(o.UploadBufferSize),
+		granted: uint64(o.UploadBufferSize),
+		ready:   make(chan struct{}, 1),
+		chunks:  make(map[uint64]interface{}),
+	}
+	if o.MaxUploadDuration > 0 {
+		s.timer = time.AfterFunc(o.MaxUploadDuration, func() { s.abort(ErrUploadTimedOut) })
+	}
+
+	e.uploads.lock.Lock()
+	if e.uploads.byConn[cid] == nil {
+		e.uploads.byConn[cid] = make(map[string]*incomingStream)
+	}
+	e.uploads.byConn[cid][id] = s
+	e.uploads.lock.Unlock()
+
+	e.sendFrame(cid, "upload credit", &uploadCredit{InvocationID: id, Granted: s.granted})
+}
+
+// receiveUploadChunk adds a chunk, or the end, of an upload sent by a
+// client in a frame of size bytes. Chunks of uploads that have finished
+// are dropped.
+func (e *Exchange) receiveUploadChunk(cid string, m *inboundFrame, size int) {
+	s := e.uploads.get(cid, m.InvocationID)
+	if s == nil {
+		return
+	}
+	if err := s.put(m.Sequence, m.Final, m.Arguments, size); err != nil {
+		e.logger.Infof("upload %s from %s cut short: %v", m.InvocationID, cid, err)
+	}
+}
@@ -0,0 +1,88 @@
+package relayr
+
+// userIDFor derives the user ID for a principal.
+func (e *Exchange) userIDFor(principal interface{}) string {
+	if e.options.UserIDProvider != nil {
+		return e.options.UserIDProvider(principal)
+	}
+	id, _ := principal.(string)
+	return id
+}
+
+// addUserLocked indexes a client under its user ID. The caller must hold
+// mapLock.
+func (e *Exchange) addUserLocked(c *client) {
+	if c.userID == "" {
+		return
+	}
+	conns := e.users[c.userID]
+	if conns == nil {
+		conns = make(map[string]struct{})
+		e.users[c.userID] = conns
+	}
+	conns[c.ConnectionID] = struct{}{}
+}
+
+// removeUserLocked removes a client from the user index. The caller must
+// hold mapLock.
+func (e *Exchange) removeUserLocked(c *client) {
+	conns := e.users[c.userID]
+	delete(conns, c.ConnectionID)
+	if len(conns) == 0 {
+		delete(e.users, c.userID)
+	}
+}
+
+// callUserMethod calls a client method on every client connected as the
+// given user apart from those in except, or saves the call with the
+// OfflineStore if the user has none.
+func (e *Exchange) callUserMethod(relay *Relay, userID string, except []string, fn string, args ...interface{}) error {
+	if e.options.OfflineStore != nil {
+		l := e.offlineLock(userID)
+		l.Lock()
+		defer l.Unlock()
+		if saved, err := e.saveOfflineLocked(relay, userID, fn, args); saved {
+			return err
+		}
+	}
+
+	return e.callEach(relay, "user:"+userID, e.UserConnections(userID), except, fn, args...)
+}
+
+// callEach calls a client method on each of the clients with the given
+// ConnectionIDs apart from those in except, reporting those it could not
+// be delivered to in a *GroupCallError named name.
+func (e *Exchange) callEach(relay *Relay, name string, ids, except []string, fn string, args ...interface{}) error {
+	result := &GroupCallError{Group: name}
+	for _, id := range ids {
+		if containsString(except, id) {
+			continue
+		}
+		if err := e.callConnectionMethod(relay, id, fn, args...); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[id] = err
+			continue
+		}
+		result.Delivered++
+	}
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// UserConnections returns the ConnectionIDs of the clients connected as
+// the given user.
+func (e *Exchange) UserConnections(userID string) []string {
+	e.mapLock.RLock()
+	defer e.mapLock.RUnlock()
+
+	r := []string{}
+	for id := range e.users[userID] {
+		r = append(r, id)
+	}
+
+	return r
+}
@@ -1,9 +1,13 @@
 package relayr
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -12,11 +16,74 @@ func jsonResponse(w http.ResponseWriter) {
 	w.Header().Set("Content-type", "application/json")
 }
 
+// readBody reads the body of r, failing once it is longer than limit or
+// the client gives up on the request.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	return io.ReadAll(&contextReader{r.Context(), http.MaxBytesReader(w, r.Body, limit)})
+}
+
+// isMaxBytesError reports whether err is from reading more of a body than
+// its limit.
+func isMaxBytesError(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// generateConnectionID returns 256 random bits, encoded so that they can
+// be used in a URL without escaping.
 func generateConnectionID() string {
 	rb := make([]byte, 32)
-	rand.Read(rb)
-	rs := base64.URLEncoding.EncodeToString(rb)
-	return rs
+	if _, err := rand.Read(rb); err != nil {
+		panic("relayr: reading random bytes: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(rb)
+}
+
+// isURLSafe reports whether s is not empty and made only of characters
+// that need no escaping in a URL: letters, digits, '-', '.', '_' and '~'.
+func isURLSafe(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '.' || ch == '_' || ch == '~') {
+			return false
+		}
+	}
+	return true
+}
+
+// isJavascriptIdentifier reports whether s can be used as a Javascript
+// identifier in the generated client script.
+func isJavascriptIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || r == '$':
+		case r < utf8.RuneSelf && unicode.IsLetter(r):
+		case i > 0 && r < utf8.RuneSelf && unicode.IsDigit(r):
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 func lowerFirst(s string) string {
@@ -34,3 +101,51 @@ func upperFirst(s string) string {
 	r, n := utf8.DecodeRuneInString(s)
 	return string(unicode.ToUpper(r)) + s[n:]
 }
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString returns list without the first occurrence of s, reusing
+// its storage.
+func removeString(list []string, s string) []string {
+	for i, v := range list {
+		if v == s {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.IndexByte(enc, ';'); i >= 0 {
+			if q := strings.TrimSpace(enc[i+1:]); q == "q=0" || q == "q=0.0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package relayr
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// IssueSeverity grades a RelayValidationIssue.
+type IssueSeverity int
+
+const (
+	// SeverityWarning marks a relay or method that works, though likely
+	// not as meant.
+	SeverityWarning IssueSeverity = iota
+
+	// SeverityError marks a relay or method that cannot work. Clients
+	// cannot call a method with an error: the client script's stub for it
+	// throws, and calls to it are refused.
+	SeverityError
+)
+
+func (s IssueSeverity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// RelayValidationIssue is a problem with a registered relay, as Validate
+// reports it.
+type RelayValidationIssue struct {
+	Relay    string
+	Method   string // empty when the issue is with the relay itself
+	Severity IssueSeverity
+	Problem  string
+}
+
+func (i RelayValidationIssue) String() string {
+	return i.Severity.String() + ": " + i.describe()
+}
+
+// describe describes the issue, without its severity.
+func (i RelayValidationIssue) describe() string {
+	if i.Method == "" {
+		return fmt.Sprintf("relay %s %s", i.Relay, i.Problem)
+	}
+	return fmt.Sprintf("relay %s method %s %s", i.Relay, i.Method, i.Problem)
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// reservedRelayPrefix starts the relay names the protocol keeps for
+// itself, such as that presence is reported under.
+const reservedRelayPrefix = "__relayr"
+
+// objectPrototype lists the members every Javascript object inherits,
+// which the client script's relays and stubs must not shadow.
+var objectPrototype = map[string]bool{
+	"__proto__": true, "constructor": true, "hasOwnProperty": true, "isPrototypeOf": true,
+	"propertyIsEnumerable": true, "toLocaleString": true, "toString": true, "valueOf": true,
+}
+
+// Validate checks the registered relays for problems registration lets
+// through, which would otherwise only show as clients call them: relay
+// names reserved by the protocol or the client script, methods whose
+// results cannot be encoded, or whose parameters have map keys arguments
+// cannot be decoded into, methods returning several values, methods whose
+// stubs shadow members of Javascript objects, pointer methods of relays
+// registered by value, and names a MethodExposer lists that are not
+// methods. The issues are ordered by relay and method. Methods whose names
+// differ only in case, and parameters that cannot be decoded at all, are
+// refused by RegisterRelay, so are never reported.
+func (e *Exchange) Validate() []RelayValidationIssue {
+	issues := []RelayValidationIssue{}
+	for _, r := range e.relayList() {
+		issues = append(issues, r.issues...)
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Relay != issues[j].Relay {
+			return issues[i].Relay < issues[j].Relay
+		}
+		return issues[i].Method < issues[j].Method
+	})
+	return issues
+}
+
+// MustValidate panics, listing them, if Validate reports any issues of
+// SeverityError, for a program's main to refuse to start with relays that
+// cannot work.
+func (e *Exchange) MustValidate() {
+	var errs []string
+	for _, i := range e.Validate() {
+		if i.Severity == SeverityError {
+			errs = append(errs, i.String())
+		}
+	}
+	if len(errs) > 0 {
+		panic("relayr: invalid relays:\n" + strings.Join(errs, "\n"))
+	}
+}
+
+// validateRelay returns the issues with a relay being registered under
+// name, whose exposed methods are given, and the reasons clients cannot
+// call those with errors, by name. byValue is set for a relay registered
+// by value, whose pointer methods are called on the Exchange's copy.
+func (e *Exchange) validateRelay(name string, receiver reflect.Value, methods []string, byValue bool) ([]RelayValidationIssue, map[string]string) {
+	var issues []RelayValidationIssue
+	var refused map[string]string
+	report := func(method string, severity IssueSeverity, format string, args ...interface{}) {
+		issues = append(issues, RelayValidationIssue{Relay: name, Method: method, Severity: severity, Problem: fmt.Sprintf(format, args...)})
+		if severity == SeverityError && method != "" {
+			if refused == nil {
+				refused = make(map[string]string)
+			}
+			if _, ok := refused[method]; !ok {
+				refused[method] = issues[len(issues)-1].Problem
+			}
+		}
+	}
+
+	if strings.HasPrefix(name, reservedRelayPrefix) {
+		report("", SeverityError, "has a name starting %q, which the protocol reserves", reservedRelayPrefix)
+	}
+	if objectPrototype[name] {
+		report("", SeverityError, "shadows Object.prototype.%s in the client script's RelayR", name)
+	}
+	if exposer, ok := receiver.Interface().(MethodExposer); ok {
+		for _, m := range exposer.RelayMethods() {
+			if _, ok := receiver.Type().MethodByName(m); !ok {
+				report(m, SeverityWarning, "is listed by RelayMethods, but is not an exported method of %v", receiver.Type())
+			}
+		}
+	}
+
+	value := receiver.Type().Elem()
+	for _, m := range methods {
+		t := receiver.MethodByName(m).Type()
+		for i := firstArg(t); i < t.NumIn(); i++ {
+			if p := paramType(t, i); !jsonKeysDecodable(p, map[reflect.Type]bool{}) {
+				report(m, SeverityError, "takes a %v, whose map keys arguments cannot be decoded into", t.In(i))
+			}
+		}
+
+		results := 0
+		for i := 0; i < t.NumOut(); i++ {
+			out := t.Out(i)
+			if out == errorType {
+				continue
+			}
+			results++
+			if out.Kind() == reflect.Chan {
+				if out.ChanDir()&reflect.RecvDir == 0 {
+					report(m, SeverityError, "returns a %v, which cannot be streamed from", out)
+					continue
+				}
+				out = out.Elem()
+			}
+			if !jsonEncodable(out, map[reflect.Type]bool{}) {
+				report(m, SeverityError, "returns a %v, which cannot be encoded as JSON", t.Out(i))
+			}
+		}
+		if results > 1 {
+			report(m, SeverityWarning, "returns %d values, of which clients are sent only the last", results)
+		}
+
+		if script := lowerFirst(m); objectPrototype[script] {
+			report(m, SeverityWarning, "has the stub %s, which shadows Object.prototype.%s on the relay's server object", script, script)
+		}
+		if _, ok := value.MethodByName(m); !ok && byValue && value.NumField() > 0 {
+			report(m, SeverityWarning, "has a pointer receiver, so changes the Exchange's copy of the relay registered by value, not the value registered")
+		}
+	}
+	return issues, refused
+}
+
+// jsonEncodable reports whether encoding/json can encode values of type t:
+// all but channels, funcs, complex numbers, and values holding them, or
+// maps keyed by other than strings, integers or TextMarshalers. Types
+// with a converter registered, or that marshal themselves, can be. seen
+// holds the struct types being checked, so that recursive types end.
+func jsonEncodable(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if _, ok := converterFor(t); ok {
+		return true
+	}
+	if p := reflect.PtrTo(t); t.Implements(jsonMarshalerType) || p.Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || p.Implements(textMarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return jsonEncodable(t.Elem(), seen)
+	case reflect.Map:
+		return jsonMapKey(t.Key(), textMarshalerType) && jsonEncodable(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return true
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Tag.Get("json") == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			if !jsonEncodable(f.Type, seen) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// jsonKeysDecodable reports whether the maps values of type t hold, if
+// any, are keyed by types encoding/json can decode object keys into.
+func jsonKeysDecodable(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if _, ok := converterFor(t); ok || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return jsonKeysDecodable(t.Elem(), seen)
+	case reflect.Map:
+		return jsonMapKey(t.Key(), textUnmarshalerType) && jsonKeysDecodable(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return true
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Tag.Get("json") == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			if !jsonKeysDecodable(f.Type, seen) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// jsonMapKey reports whether encoding/json can use values of type t as
+// object keys: strings, integers, and types implementing text, either
+// encoding.TextMarshaler or encoding.TextUnmarshaler, can be.
+func jsonMapKey(t reflect.Type, text reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return t.Implements(text) || reflect.PtrTo(t).Implements(text)
+}
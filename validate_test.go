@@ -0,0 +1,172 @@
+package relayr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Broken is registered by value, with methods of each kind Validate
+// reports.
+type Broken struct{ calls int }
+
+func (Broken) Index(r *Relay, m map[point]int) int { return len(m) }
+
+func (Broken) Feed(r *Relay) chan<- int { return make(chan int) }
+
+func (Broken) Callback(r *Relay) func() { return func() {} }
+
+func (Broken) Pair(r *Relay) (int, string) { return 1, "one" }
+
+func (Broken) ToString(r *Relay) string { return "broken" }
+
+func (b *Broken) Bump(r *Relay) int {
+	b.calls++
+	return b.calls
+}
+
+// Listed lists a method it does not have.
+type Listed struct{}
+
+func (Listed) RelayMethods() []string { return []string{"Echo", "Missing"} }
+
+func (Listed) Echo(r *Relay, s string) string { return s }
+
+// Cased has methods whose names differ only in case.
+type Cased struct{}
+
+func (Cased) URL(r *Relay) string { return "/" }
+
+func (Cased) Url(r *Relay) string { return "/" }
+
+// Chute has a method taking an argument that cannot be decoded.
+type Chute struct{}
+
+func (Chute) Send(r *Relay, ch chan int) {}
+
+func TestRegisterRelayRefusesInvalid(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	for _, tt := range []struct {
+		name     string
+		register func() error
+		want     string
+	}{
+		{"name", func() error { return e.RegisterRelayWithName(Calculator{}, "bad-name") }, "not a valid Javascript identifier"},
+		{"case", func() error { return e.RegisterRelay(Cased{}) }, "differ only in case"},
+		{"param", func() error { return e.RegisterRelay(Chute{}) }, "method Send takes a chan int"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.register(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("registering failed with %v, want an error saying %q", err, tt.want)
+			}
+		})
+	}
+	if relays := e.relayList(); len(relays) != 0 {
+		t.Fatalf("relays refused were registered: %v", relays)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Broken{}, Calculator{})
+	if err := e.RegisterRelayWithName(Chat{}, "__relayrChat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterRelayWithName(Listed{}, "constructor"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		relay, method string
+		severity      IssueSeverity
+		problem       string
+	}{
+		{"Broken", "Bump", SeverityWarning, "has a pointer receiver"},
+		{"Broken", "Callback", SeverityError, "returns a func(), which cannot be encoded as JSON"},
+		{"Broken", "Feed", SeverityError, "returns a chan<- int, which cannot be streamed from"},
+		{"Broken", "Index", SeverityError, "takes a map[relayr.point]int, whose map keys"},
+		{"Broken", "Pair", SeverityWarning, "returns 2 values"},
+		{"Broken", "ToString", SeverityWarning, "has the stub toString"},
+		{"__relayrChat", "", SeverityError, `has a name starting "__relayr"`},
+		{"constructor", "", SeverityError, "shadows Object.prototype.constructor"},
+		{"constructor", "Missing", SeverityWarning, "is listed by RelayMethods"},
+	}
+	issues := e.Validate()
+	if len(issues) != len(want) {
+		t.Fatalf("Validate reported %v, want %d issues", issues, len(want))
+	}
+	for i, w := range want {
+		got := issues[i]
+		if got.Relay != w.relay || got.Method != w.method || got.Severity != w.severity || !strings.HasPrefix(got.Problem, w.problem) {
+			t.Errorf("issue %d is %v, want %s of relay %s method %s: %s", i, got, w.severity, w.relay, w.method, w.problem)
+		}
+	}
+
+	// the schema and the client script say why the methods with errors
+	// cannot be called
+	unavailable := map[string]string{}
+	for _, r := range e.Schema() {
+		if r.Name != "Broken" {
+			continue
+		}
+		for _, m := range r.Methods {
+			unavailable[m.Name] = m.Unavailable
+		}
+	}
+	for _, w := range want {
+		if w.relay != "Broken" {
+			continue
+		}
+		if got := unavailable[w.method]; (w.severity == SeverityError) != strings.HasPrefix(got, w.problem) || (w.severity == SeverityWarning && got != "") {
+			t.Errorf("the schema has %s unavailable as %q", w.method, got)
+		}
+	}
+	if script := getScript(e, "/relayr/client.js", nil).Body.String(); !strings.Contains(script, `"unavailable":"returns a func(), which cannot be encoded as JSON"`) {
+		t.Error("the client script does not mark Callback unavailable")
+	}
+
+	// and calls to them are refused, while the others are served
+	var cerr *CallError
+	if err := e.MustRelay(Broken{}).CallErr("Feed"); !errors.As(err, &cerr) || !strings.HasPrefix(cerr.Reason, "cannot be called: it returns a chan<- int") {
+		t.Fatalf("calling Feed failed with %v", err)
+	}
+	c := dial(t, srv, "websocket")
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if _, err := c.Call(ctx, "Broken", "callback"); err == nil || !strings.Contains(err.Error(), "cannot be called: it returns a func()") {
+		t.Fatalf("a client calling Callback failed with %v", err)
+	}
+	if v, err := c.Call(ctx, "Broken", "pair"); err != nil || string(v) != `"one"` {
+		t.Fatalf("a client calling Pair got %s, %v", v, err)
+	}
+}
+
+func TestMustValidate(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Calculator{})
+	e.RegisterRelay(Listed{})
+	if issues := e.Validate(); len(issues) != 1 || issues[0].Severity != SeverityWarning {
+		t.Fatalf("Validate reported %v, want a warning alone", issues)
+	}
+	e.MustValidate() // warnings alone pass
+
+	e.RegisterRelay(Broken{})
+	defer func() {
+		msg := fmt.Sprint(recover())
+		for _, want := range []string{
+			"relayr: invalid relays:",
+			"error: relay Broken method Callback returns a func()",
+			"error: relay Broken method Feed returns a chan<- int",
+			"error: relay Broken method Index takes a map[relayr.point]int",
+		} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("MustValidate panicked with %q, which lacks %q", msg, want)
+			}
+		}
+		if strings.Contains(msg, "warning") {
+			t.Errorf("MustValidate panicked listing warnings: %q", msg)
+		}
+	}()
+	e.MustValidate()
+}
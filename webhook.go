@@ -0,0 +1,395 @@
+package relayr
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The headers of the POSTs made by SubscribeWebhook. WebhookDeliveryHeader
+// carries the ID of the delivery, the same on every attempt, so that a
+// receiver can drop a delivery retried after it was received, and
+// WebhookSignatureHeader, with a Secret, "sha256=" and the hex HMAC-SHA256
+// of the body, which VerifyWebhookSignature checks.
+const (
+	WebhookDeliveryHeader  = "X-Relayr-Delivery"
+	WebhookSignatureHeader = "X-Relayr-Signature"
+)
+
+const (
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = time.Second
+	defaultWebhookTimeout  = 10 * time.Second
+	defaultWebhookQueue    = 256
+)
+
+// ErrSubscriptionNotFound is returned by UnsubscribeWebhook for a
+// subscription that is not held by the Exchange.
+var ErrSubscriptionNotFound = errors.New("relayr: webhook subscription not found")
+
+var errWebhookURL = errors.New("relayr: webhook URL must be absolute, over http or https")
+
+// SubscriptionID identifies a webhook added with SubscribeWebhook. It is
+// the ConnectionID of the client the webhook is subscribed as.
+type SubscriptionID string
+
+// WebhookOptions configure a webhook added with SubscribeWebhook.
+type WebhookOptions struct {
+	// Secret signs each POST, in the WebhookSignatureHeader. Nil sends
+	// them unsigned.
+	Secret []byte
+
+	// Header is added to each POST.
+	Header http.Header
+
+	// Client makes the POSTs. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Timeout is how long each attempt may take. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// MaxAttempts is how many times a delivery is attempted before it is
+	// given up on. Defaults to 5.
+	MaxAttempts int
+
+	// Backoff is how long to wait before attempting a delivery again,
+	// doubling after each attempt. Defaults to a second.
+	Backoff time.Duration
+
+	// QueueSize is how many deliveries may wait behind the one being
+	// made. Calls made while the queue is full are refused with
+	// ErrBufferFull. Defaults to 256.
+	QueueSize int
+
+	// OnDeadLetter, if not nil, is called with each delivery given up on
+	// and the error of its last attempt, from the goroutine delivering
+	// the webhook's calls, which waits for it to return.
+	OnDeadLetter func(d WebhookDelivery, err error)
+}
+
+func (o WebhookOptions) withDefaults() WebhookOptions {
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultWebhookTimeout
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = defaultWebhookAttempts
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = defaultWebhookBackoff
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaultWebhookQueue
+	}
+	return o
+}
+
+// WebhookDelivery is the body of a webhook's POST, in JSON: a call to a
+// client method made to the group it is subscribed to.
+type WebhookDelivery struct {
+	ID           string // the same on every attempt
+	Subscription SubscriptionID
+	Group        string
+	Relay        string
+	Method       string
+	Args         []interface{}
+	Sent         time.Time // when the call was made
+}
+
+// WebhookError is the error of an attempt whose POST was answered with
+// other than a 2xx status.
+type WebhookError struct {
+	StatusCode int
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("relayr: webhook answered %d", e.StatusCode)
+}
+
+// retry reports whether an attempt answered with the status is worth
+// making again: those the receiver could not handle now, rather than
+// those it refused.
+func (e *WebhookError) retry() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// VerifyWebhookSignature reports whether signature, the
+// WebhookSignatureHeader of a POST, signs body with secret.
+func VerifyWebhookSignature(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signWebhook(secret, body)), []byte(signature))
+}
+
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SubscribeWebhook subscribes a URL to the calls made to a group, as for a
+// service rather than a browser, by adding a client to the group whose
+// calls are POSTed to it as a WebhookDelivery. Deliveries are made in the
+// order the calls were, retried with a backoff when the receiver cannot
+// be reached or answers 5xx, 408 or 429, and given up on after the
+// MaxAttempts, or when it answers any other status but 2xx. A slow
+// receiver holds up nothing but its own deliveries, which are made at
+// most MaxWebhookWorkers at a time across every webhook.
+//
+// The webhook's client is listed by Connections, over the "webhook"
+// transport, and is neither evicted for being idle nor reaped as stale.
+// It stays subscribed until UnsubscribeWebhook, or Disconnect with its
+// SubscriptionID, is called, or the Exchange is closed.
+func (e *Exchange) SubscribeWebhook(group, rawURL string, opts WebhookOptions) (SubscriptionID, error) {
+	if u, err := url.Parse(rawURL); err != nil || !u.IsAbs() || u.Scheme != "http" && u.Scheme != "https" {
+		return "", errWebhookURL
+	}
+	if err := e.validateGroupName(group); err != nil {
+		return "", err
+	}
+	if !e.track() {
+		return "", errExchangeClosed
+	}
+	c, err := e.newClient("")
+	if err != nil {
+		e.wg.Done()
+		return "", err
+	}
+	t := e.webhookTransport()
+	c.setTransport(t)
+	opts = opts.withDefaults()
+	s := &webhookSubscription{
+		id:    SubscriptionID(c.ConnectionID),
+		url:   rawURL,
+		opts:  opts,
+		queue: make(chan webhookPost, opts.QueueSize),
+		stop:  make(chan struct{}),
+	}
+	t.lock.Lock()
+	t.subs[c.ConnectionID] = s
+	t.lock.Unlock()
+	go t.deliver(s)
+
+	e.mapLock.Lock()
+	e.registerLocked(c)
+	e.addToGroupLocked(group, c, false)
+	delete(e.negotiating, c.ConnectionID)
+	e.mapLock.Unlock()
+
+	e.logger.Infof("webhook %s subscribed to group '%s'", s.id, group)
+	return s.id, nil
+}
+
+// UnsubscribeWebhook removes a webhook added with SubscribeWebhook and its
+// client. Deliveries yet to be made are dropped.
+func (e *Exchange) UnsubscribeWebhook(id SubscriptionID) error {
+	c := e.getClientByConnectionID(string(id))
+	if c == nil || !c.isWebhook() {
+		return ErrSubscriptionNotFound
+	}
+	e.dropClient(string(id), ReasonUnsubscribed)
+	return nil
+}
+
+// isWebhook reports whether a client is a webhook's.
+func (c *client) isWebhook() bool {
+	_, ok := c.transport().(*webhookTransport)
+	return ok
+}
+
+// webhookTransport delivers the calls made to the clients added by
+// SubscribeWebhook. It is not registered with the Exchange, so that
+// clients cannot negotiate it.
+type webhookTransport struct {
+	e     *Exchange
+	slots chan struct{} // holds a value for each POST being made
+	lock  sync.Mutex
+	subs  map[string]*webhookSubscription // by ConnectionID
+}
+
+type webhookSubscription struct {
+	id    SubscriptionID
+	url   string
+	opts  WebhookOptions
+	queue chan webhookPost
+	stop  chan struct{} // closed when the webhook is unsubscribed
+	seq   atomic.Uint64
+}
+
+// webhookPost is a delivery, with its body encoded as the call was made.
+type webhookPost struct {
+	delivery WebhookDelivery
+	body     []byte
+}
+
+// webhookTransport returns the Exchange's webhookTransport, creating it
+// on first use.
+func (e *Exchange) webhookTransport() *webhookTransport {
+	if t := e.webhooks.Load(); t != nil {
+		return t
+	}
+	e.webhooks.CompareAndSwap(nil, &webhookTransport{
+		e:     e,
+		slots: make(chan struct{}, e.options.MaxWebhookWorkers),
+		subs:  make(map[string]*webhookSubscription),
+	})
+	return e.webhooks.Load()
+}
+
+func (t *webhookTransport) AddConnection(connectionID string) {}
+
+func (t *webhookTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) error {
+	t.lock.Lock()
+	s := t.subs[relay.ConnectionID]
+	t.lock.Unlock()
+	if s == nil {
+		return ErrConnectionNotFound
+	}
+
+	d := WebhookDelivery{
+		ID:           fmt.Sprintf("%s.%d", s.id, s.seq.Add(1)),
+		Subscription: s.id,
+		Group:        relay.group,
+		Relay:        relay.Name,
+		Method:       fn,
+		Args:         args,
+		Sent:         time.Now(),
+	}
+	body, err := t.e.json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- webhookPost{delivery: d, body: body}:
+		return nil
+	case <-s.stop:
+		return ErrConnectionNotFound
+	default:
+		return ErrBufferFull
+	}
+}
+
+func (t *webhookTransport) RemoveConnection(connectionID, reason string) {
+	t.lock.Lock()
+	s := t.subs[connectionID]
+	delete(t.subs, connectionID)
+	t.lock.Unlock()
+	if s != nil {
+		close(s.stop)
+		t.e.logger.Infof("webhook %s unsubscribed: %s", s.id, reason)
+	}
+}
+
+func (t *webhookTransport) Close() error { return nil }
+
+// count returns the number of webhooks subscribed.
+func (t *webhookTransport) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.subs)
+}
+
+// deliver makes a webhook's deliveries in turn until it is unsubscribed
+// or the Exchange is closed.
+func (t *webhookTransport) deliver(s *webhookSubscription) {
+	defer t.e.wg.Done()
+	for {
+		select {
+		case p := <-s.queue:
+			t.post(s, p)
+		case <-s.stop:
+			return
+		case <-t.e.done:
+			return
+		}
+	}
+}
+
+// post makes a delivery, attempting it again after the backoff as long as
+// it is worth it, and hands it to OnDeadLetter if it cannot be made.
+func (t *webhookTransport) post(s *webhookSubscription, p webhookPost) {
+	wait := s.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err := t.attempt(s, p)
+		if err == nil {
+			return
+		}
+		var werr *WebhookError
+		if (errors.As(err, &werr) && !werr.retry()) || attempt >= s.opts.MaxAttempts {
+			t.e.counters.deadLetters.Add(1)
+			t.e.logger.Infof("webhook %s gave up on delivery %s after %d attempts: %v", s.id, p.delivery.ID, attempt, err)
+			if s.opts.OnDeadLetter != nil {
+				s.opts.OnDeadLetter(p.delivery, err)
+			}
+			return
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-t.e.done:
+			timer.Stop()
+			return
+		}
+		wait *= 2
+	}
+}
+
+// attempt POSTs a delivery once a worker is free.
+func (t *webhookTransport) attempt(s *webhookSubscription, p webhookPost) error {
+	select {
+	case t.slots <- struct{}{}:
+	case <-s.stop:
+		return ErrSubscriptionNotFound
+	case <-t.e.done:
+		return errExchangeClosed
+	}
+	defer func() { <-t.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+		case <-t.e.done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(p.body))
+	if err != nil {
+		return err
+	}
+	for name, values := range s.opts.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookDeliveryHeader, p.delivery.ID)
+	if len(s.opts.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, signWebhook(s.opts.Secret, p.body))
+	}
+
+	res, err := s.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &WebhookError{StatusCode: res.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package relayr
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookPOST is a POST received by a webhookReceiver.
+type webhookPOST struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver records the POSTs made to it, answering each with the
+// status answer returns for the number of POSTs before it.
+type webhookReceiver struct {
+	lock     sync.Mutex
+	posts    []webhookPOST
+	answer   func(n int) int
+	received chan struct{}
+}
+
+// receiveWebhooks starts a webhookReceiver, closing it as the test ends.
+func receiveWebhooks(t *testing.T, answer func(n int) int) (*webhookReceiver, string) {
+	rec := &webhookReceiver{answer: answer, received: make(chan struct{}, 100)}
+	srv := httptest.NewServer(rec)
+	t.Cleanup(srv.Close)
+	return rec, srv.URL + "/hook"
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rec.lock.Lock()
+	n := len(rec.posts)
+	rec.posts = append(rec.posts, webhookPOST{header: r.Header.Clone(), body: body})
+	rec.lock.Unlock()
+	w.WriteHeader(rec.answer(n))
+	rec.received <- struct{}{}
+}
+
+// wait waits for n more POSTs.
+func (rec *webhookReceiver) wait(t *testing.T, n int) []webhookPOST {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-rec.received:
+		case <-time.After(testTimeout):
+			t.Fatalf("received %d of %d POSTs", i, n)
+		}
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return append([]webhookPOST(nil), rec.posts...)
+}
+
+func answerOK(n int) int { return http.StatusOK }
+
+func TestWebhookDelivery(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Ticker{})
+	rec, url := receiveWebhooks(t, answerOK)
+	for _, bad := range []string{"", "/hook", "ftp://localhost/hook", "://"} {
+		if _, err := e.SubscribeWebhook("ticks", bad, WebhookOptions{}); err == nil {
+			t.Errorf("subscribed %q", bad)
+		}
+	}
+	id, err := e.SubscribeWebhook("ticks", url, WebhookOptions{Header: http.Header{"Authorization": {"Bearer billing"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.IsInGroup("ticks", string(id)) {
+		t.Fatal("the webhook is not in its group")
+	}
+	if n := e.Stats().Connections["webhook"]; n != 1 {
+		t.Fatalf("Stats counts %d webhooks", n)
+	}
+
+	e.Clients(Ticker{}).Group("ticks").Call("tick", 1)
+	e.Clients(Ticker{}).Group("ticks").Call("tick", 2)
+	posts := rec.wait(t, 2)
+	for i, p := range posts {
+		var d WebhookDelivery
+		if err := json.Unmarshal(p.body, &d); err != nil {
+			t.Fatalf("delivery %d is not JSON: %s", i, p.body)
+		}
+		if d.Subscription != id || d.Group != "ticks" || d.Relay != "Ticker" || d.Method != "tick" || len(d.Args) != 1 || d.Args[0] != float64(i+1) {
+			t.Errorf("delivery %d is %+v", i, d)
+		}
+		if p.header.Get(WebhookDeliveryHeader) != d.ID || p.header.Get("Authorization") != "Bearer billing" {
+			t.Errorf("delivery %d was made with the headers %v", i, p.header)
+		}
+		if p.header.Get(WebhookSignatureHeader) != "" {
+			t.Errorf("a delivery without a Secret was signed")
+		}
+	}
+
+	if err := e.UnsubscribeWebhook(id); err != nil {
+		t.Fatal(err)
+	}
+	if e.IsInGroup("ticks", string(id)) || e.Stats().Connections["webhook"] != 0 {
+		t.Fatal("an unsubscribed webhook is still in its group")
+	}
+	if err := e.UnsubscribeWebhook(id); err != ErrSubscriptionNotFound {
+		t.Fatalf("unsubscribing twice failed with %v", err)
+	}
+	e.Clients(Ticker{}).Group("ticks").Call("tick", 3)
+	select {
+	case <-rec.received:
+		t.Fatal("a call was delivered to an unsubscribed webhook")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetryThenSuccess(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Ticker{})
+	rec, url := receiveWebhooks(t, func(n int) int {
+		if n < 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	dead := make(chan WebhookDelivery, 1)
+	_, err := e.SubscribeWebhook("ticks", url, WebhookOptions{
+		Backoff:      10 * time.Millisecond,
+		OnDeadLetter: func(d WebhookDelivery, err error) { dead <- d },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Clients(Ticker{}).Group("ticks").Call("tick", 1)
+	posts := rec.wait(t, 3)
+	for _, p := range posts[1:] {
+		if string(p.body) != string(posts[0].body) || p.header.Get(WebhookDeliveryHeader) != posts[0].header.Get(WebhookDeliveryHeader) {
+			t.Fatal("a delivery was attempted again with another body or ID")
+		}
+	}
+	select {
+	case <-rec.received:
+		t.Fatal("a delivery was attempted again once it was made")
+	case d := <-dead:
+		t.Fatalf("a delivery that was made was dead-lettered: %+v", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := e.Stats().DeadLetters; n != 0 {
+		t.Fatalf("Stats counts %d dead letters", n)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Ticker{})
+	rec, url := receiveWebhooks(t, answerOK)
+	secret := []byte("billing secret")
+	if _, err := e.SubscribeWebhook("ticks", url, WebhookOptions{Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Clients(Ticker{}).Group("ticks").Call("tick", 1)
+	p := rec.wait(t, 1)[0]
+	sig := p.header.Get(WebhookSignatureHeader)
+	if !VerifyWebhookSignature(secret, p.body, sig) {
+		t.Fatalf("the signature %q does not verify", sig)
+	}
+	tampered := append([]byte(nil), p.body...)
+	tampered[len(tampered)-2] ^= 1
+	for _, tt := range []struct {
+		name         string
+		secret, body []byte
+		signature    string
+	}{
+		{"another secret", []byte("guess"), p.body, sig},
+		{"a tampered body", secret, tampered, sig},
+		{"no signature", secret, p.body, ""},
+		{"a bare digest", secret, p.body, sig[len("sha256="):]},
+	} {
+		if VerifyWebhookSignature(tt.secret, tt.body, tt.signature) {
+			t.Errorf("the signature verifies with %s", tt.name)
+		}
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	e.RegisterRelay(Ticker{})
+	type deadLetter struct {
+		d   WebhookDelivery
+		err error
+	}
+
+	for _, tt := range []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{"failing", http.StatusInternalServerError, 3},
+		{"refusing", http.StatusBadRequest, 1},
+	} {
+		status := tt.status
+		rec, url := receiveWebhooks(t, func(n int) int { return status })
+		dead := make(chan deadLetter, 1)
+		group := tt.name + "-ticks"
+		id, err := e.SubscribeWebhook(group, url, WebhookOptions{
+			MaxAttempts:  3,
+			Backoff:      10 * time.Millisecond,
+			OnDeadLetter: func(d WebhookDelivery, err error) { dead <- deadLetter{d, err} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.Clients(Ticker{}).Group(group).Call("tick", 1)
+		rec.wait(t, tt.attempts)
+		select {
+		case l := <-dead:
+			var werr *WebhookError
+			if l.d.Subscription != id || l.d.Method != "tick" || !errors.As(l.err, &werr) || werr.StatusCode != tt.status {
+				t.Errorf("a %s receiver dead-lettered %+v with %v", tt.name, l.d, l.err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("a delivery to a %s receiver was not dead-lettered", tt.name)
+		}
+		select {
+		case <-rec.received:
+			t.Errorf("a delivery to a %s receiver was attempted more than %d times", tt.name, tt.attempts)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if n := e.Stats().DeadLetters; n != 2 {
+		t.Fatalf("Stats counts %d dead letters, want 2", n)
+	}
+}
+
+func TestSlowWebhookDoesNotStallBroadcasts(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{MaxWebhookWorkers: 1})
+	e.RegisterRelay(Ticker{})
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	t.Cleanup(slow.Close)
+	defer close(unblock)
+	if _, err := e.SubscribeWebhook("ticks", slow.URL, WebhookOptions{QueueSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			e.Clients(Ticker{}).Group("ticks").Call("tick", i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("broadcasts were held up by a webhook that does not answer")
+	}
+}
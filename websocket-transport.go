@@ -2,34 +2,101 @@ package relayr
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
-	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// outFrame is a message queued for a websocket's write loop.
+type outFrame struct {
+	binary   bool // always send as a binary message, whatever the codec
+	data     []byte
+	key      string         // the coalescing key, when queued with send
+	slot     *coalescedSlot // holds the data of a coalesced frame, once queued
+	welcome  bool           // sent by an OnClientConnected hook
+	policy   OverflowPolicy // what to drop if out is full; the Exchange's OverflowPolicy when unset
+	expires  time.Time      // when the frame is dropped if it has not been sent; never when zero
+	plain    bool           // written uncompressed, whatever its size
+	urgent   bool           // a ping or control frame, written High, without waiting for the connection's bandwidth
+	priority Priority       // the lane it waits in
+}
+
+// expired reports whether a frame that has not been sent by now should
+// be dropped.
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && now.After(expires)
+}
+
+// coalescedSlot holds the latest data sent with a coalescing key until the
+// write loop reaches the frame queued for it.
+type coalescedSlot struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
 type connection struct {
-	ws  *websocket.Conn
-	out chan []byte
-	c   *webSocketTransport
-	id  string
-	e   *Exchange
+	ws       *websocket.Conn
+	out      chan outFrame // the Normal lane; closed by retireLocked alone, so exactly once
+	high     chan outFrame // the High lane, never closed
+	low      chan outFrame // the Low lane, never closed
+	passed   [3]int        // by lane, High first, the frames taken off others since it was last taken off while it had frames; used by the write loop alone
+	c        *webSocketTransport
+	id       string
+	e        *Exchange
+	codec    Codec
+	protocol int          // the negotiated protocol version
+	caps     capabilities // the optional features the client supports
+
+	// wire counts the bytes written to the socket when the client
+	// negotiated permessage-deflate, and is nil otherwise.
+	wire *atomic.Uint64
+
+	// bandwidth throttles the frames written to the socket, those that
+	// are not urgent; nil for a client that had gone by the time it
+	// opened.
+	bandwidth *bandwidth
+	owner     *client // the client the socket opened for; nil if it had gone
+
+	dropped   uint64 // messages dropped because out was full
+	expired   uint64 // messages dropped because they expired on out
+	rtt       int64  // the round trip of the last ping, in nanoseconds; 0 until one is answered
+	lastPing  int64  // when the last ping was sent, in unix nanoseconds; 0 until one is
+	lastPong  int64  // when the last pong was received, in unix nanoseconds; 0 until one is
+	slow      slowness
+	fullSince int64 // when out was first found full, in unix nanoseconds; 0 if it isn't
+	queued    int64 // the size of the frames on out, in bytes
+
+	queueLock sync.Mutex                // serializes queueing frames on out; guards slots and watch
+	slots     map[string]*coalescedSlot // queued coalesced frames by key
+	watch     queueWatch
+
+	holdLock sync.Mutex
+	holding  bool       // OnClientConnected hooks are running
+	held     []outFrame // frames sent meanwhile, other than by the hooks
+
+	frames     [][]byte    // the frames of the batch being written, kept for the next; used by the write loop alone
+	batchTimer *time.Timer // times the WriteBatchDelay; used by the write loop alone
+
+	gone    chan struct{}          // closed once the read loop has ended
+	cause   atomic.Pointer[string] // why the websocket closed, the first reason given
+	retired bool                   // out has been closed; guarded by the transport's lock
 }
 
 type webSocketTransport struct {
 	connections  map[string]*connection
+	lock         sync.RWMutex // guards connections and closing out channels
 	connected    chan *connection
 	disconnected chan *connection
 	e            *Exchange
-}
 
-type webSocketClientMessage struct {
-	Server       bool          `json:"S"`
-	Relay        string        `json:"R"`
-	Method       string        `json:"M"`
-	Arguments    []interface{} `json:"A"`
-	ConnectionID string        `json:"C"`
+	earlyLock sync.Mutex            // acquired after lock
+	early     map[string][]outFrame // frames sent to negotiated clients before their websocket opened
 }
 
 func newWebSocketTransport(e *Exchange) *webSocketTransport {
@@ -37,91 +104,861 @@ func newWebSocketTransport(e *Exchange) *webSocketTransport {
 		connected:    make(chan *connection),
 		disconnected: make(chan *connection),
 		connections:  make(map[string]*connection),
+		early:        make(map[string][]outFrame),
 		e:            e,
 	}
 
+	e.wg.Add(1)
 	go c.listen()
 
 	return c
 }
 
 func (c *webSocketTransport) listen() {
+	defer c.e.wg.Done()
 	for {
 		select {
 		case conn := <-c.connected:
-			if c.e.verbosity > 0 {
-				log.Printf("connection added id: %s", conn.id)
+			c.e.logger.Debugf("connection added id: %s", conn.id)
+			c.lock.Lock()
+			if old, ok := c.connections[conn.id]; ok {
+				// the client reconnected before its old socket was noticed
+				// closing; retire the old one. Its disconnection is then
+				// ignored, as it is no longer the client's connection
+				c.retireLocked(old)
+				old.ws.Close()
 			}
 			c.connections[conn.id] = conn
-		case conn := <-c.disconnected:
-			if c.e.verbosity > 0 {
-				log.Printf("removing connection id: %s", conn.id)
+			c.earlyLock.Lock()
+			early := c.early[conn.id]
+			delete(c.early, conn.id)
+			c.earlyLock.Unlock()
+			for _, frame := range early {
+				c.deliver(conn, frame)
 			}
-			if _, ok := c.connections[conn.id]; ok {
-				c.e.removeFromAllGroups(conn.id)
-				delete(c.connections, conn.id)
-				close(conn.out)
+			if conn.owner != nil {
+				select {
+				case <-conn.owner.gone:
+					// the client was disconnected as its socket opened,
+					// before RemoveConnection could find it
+					c.disconnectLocked(conn, conn.owner.goneReason)
+				default:
+				}
 			}
+			c.lock.Unlock()
+		case conn := <-c.disconnected:
+			c.e.logger.Debugf("removing connection id: %s", conn.id)
+			c.lock.Lock()
+			ok := c.connections[conn.id] == conn && c.retireLocked(conn)
+			c.lock.Unlock()
+			if ok {
+				c.e.disconnectClient(conn.id, conn.reason())
+			}
+		case <-c.e.done:
+			c.closeAll()
+			return
 		}
 	}
 }
 
-func (c *webSocketTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) {
-	buff := &bytes.Buffer{}
-	encoder := json.NewEncoder(buff)
+// closeAll sends a close frame to every open connection and stops
+// their write loops. It is only called from listen.
+func (c *webSocketTransport) closeAll() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, conn := range c.connections {
+		conn.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.retireLocked(conn)
+	}
+}
+
+// retireLocked takes a connection out of service, removing it from
+// connections if it is there and closing out, which ends its write loop,
+// reporting false if it was retired already. Frames sent to it from then
+// on fail with ErrConnectionGone. The caller must hold c.lock.
+func (c *webSocketTransport) retireLocked(o *connection) bool {
+	if o.retired {
+		return false
+	}
+	o.retired = true
+	if c.connections[o.id] == o {
+		delete(c.connections, o.id)
+	}
+	close(o.out)
+	return true
+}
+
+func (c *webSocketTransport) CallClientFunction(relay *Relay, fn string, args ...interface{}) error {
+	fn, args, ok := c.e.interceptOutgoing(relay, relay.ConnectionID, "websocket", fn, args)
+	if !ok {
+		return nil
+	}
+
+	frame, err := c.e.encodeFrameFor(relay.ConnectionID, &clientInvocation{Relay: relay.Name, Method: fn, Arguments: wireArgs(args), Trace: relay.trace, Sender: relay.sender})
+	if err != nil {
+		c.e.logger.Errorf("encoding %s for %s: %v", fn, relay.ConnectionID, err)
+		return err
+	}
+
+	return c.send(relay.ConnectionID, outFrame{data: frame, key: relay.coalesce, welcome: relay.welcome, policy: relay.overflow, expires: relay.expires, plain: relay.plain, priority: relay.priority})
+}
+
+func (c *webSocketTransport) sendRaw(cid string, frame []byte) error {
+	return c.send(cid, outFrame{data: frame})
+}
+
+func (c *webSocketTransport) sendUrgent(cid string, frame []byte) error {
+	return c.send(cid, outFrame{data: frame, urgent: true})
+}
+
+func (c *webSocketTransport) sendProgress(cid string, frame []byte, key string) error {
+	return c.send(cid, outFrame{data: frame, key: key, priority: Low})
+}
+
+func (c *webSocketTransport) sendCall(cid string, frame []byte, key string, policy OverflowPolicy, expires time.Time) error {
+	return c.send(cid, outFrame{data: frame, key: key, policy: policy, expires: expires})
+}
+
+func (c *webSocketTransport) sendBinary(cid string, relay, fn string, data []byte) {
+	c.send(cid, outFrame{binary: true, data: encodeBinaryFrame(relay, fn, data)})
+}
+
+// send queues a frame for a connection without blocking. If the
+// connection's buffer is full the frame's OverflowPolicy applies, and
+// connections whose buffer stays full for longer than the
+// SlowClientGracePeriod are closed.
+func (c *webSocketTransport) send(cid string, frame outFrame) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	o := c.connections[cid]
+	if o == nil {
+		return c.sendEarly(cid, frame)
+	}
+	return c.deliver(o, frame)
+}
+
+// sendPing queues a ping frame for a connection, unless frames are
+// already waiting to be sent, which tell the client as much.
+func (c *webSocketTransport) sendPing(cid string, ping []byte) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-	encoder.Encode(struct {
-		R string
-		M string
-		A []interface{}
-	}{
-		relay.Name,
-		fn,
-		args,
-	})
+	o := c.connections[cid]
+	if o == nil {
+		return
+	}
+	o.queueLock.Lock()
+	defer o.queueLock.Unlock()
+	if o.pending() > 0 {
+		return
+	}
+	frame := outFrame{data: ping, urgent: true}
+	select {
+	case o.high <- frame:
+		c.queuedLocked(o, frame)
+	default:
+	}
+}
+
+// sendEarly keeps a frame sent to a client that has negotiated a websocket
+// but not yet opened it, up to OutChannelSize of them, to be queued once
+// it does.
+func (c *webSocketTransport) sendEarly(cid string, frame outFrame) error {
+	c.earlyLock.Lock()
+	defer c.earlyLock.Unlock()
+
+	early, ok := c.early[cid]
+	if !ok {
+		return ErrConnectionGone
+	}
+	if len(early) >= c.e.runtime().OutChannelSize {
+		c.e.counters.dropped.Add(1)
+		c.e.recordConnectionError(TransportError, cid, "", "", ErrBufferFull)
+		return ErrBufferFull
+	}
+	c.early[cid] = append(early, frame)
+	return nil
+}
+
+// deliver queues a frame on a connection, or holds it back while the
+// connection's OnClientConnected hooks run. The caller must hold c.lock.
+func (c *webSocketTransport) deliver(o *connection, frame outFrame) error {
+	if !frame.welcome {
+		o.holdLock.Lock()
+		if o.holding {
+			o.held = append(o.held, frame)
+			o.holdLock.Unlock()
+			return nil
+		}
+		o.holdLock.Unlock()
+	}
+
+	return c.enqueue(o, frame)
+}
 
-	o := c.connections[relay.ConnectionID]
+// enqueue queues a frame on a connection. The caller must hold c.lock for
+// reading.
+//
+// Frames are queued one at a time under the connection's queueLock, so
+// that a coalesced frame's slot is registered and queued in one step and
+// frames sent after one that overwrote it cannot overtake it. Frames sent
+// one after another therefore reach the client in that order, whichever
+// goroutines send them.
+func (c *webSocketTransport) enqueue(o *connection, frame outFrame) error {
+	o.queueLock.Lock()
+	defer o.queueLock.Unlock()
+
+	// a connection whose websocket is closing would never write the frame
+	if o.retired || o.cause.Load() != nil {
+		return ErrConnectionGone
+	}
+
+	if frame.key != "" {
+		if s := o.slots[frame.key]; s != nil {
+			// overwrite the queued frame in place, keeping its position
+			atomic.AddInt64(&o.queued, int64(len(frame.data)-len(s.data)))
+			s.data, s.expires = frame.data, frame.expires
+			c.e.counters.coalesced.Add(1)
+			return nil
+		}
+		if o.slots == nil {
+			o.slots = make(map[string]*coalescedSlot)
+		}
+		frame.slot = &coalescedSlot{key: frame.key, data: frame.data, expires: frame.expires}
+		o.slots[frame.key] = frame.slot
+	}
+
+	lane := o.lane(frame)
+	select {
+	case lane <- frame:
+		atomic.StoreInt64(&o.fullSince, 0)
+		c.queuedLocked(o, frame)
+		return nil
+	default:
+	}
+
+	switch frame.policy.resolve(c.e) {
+	case DropOldest:
+		select {
+		case old := <-lane:
+			c.discardLocked(o, old)
+		default:
+		}
+		select {
+		case lane <- frame:
+			c.queuedLocked(o, frame)
+			c.fullLocked(o)
+			return nil
+		default:
+		}
+	case Disconnect:
+		c.e.logger.Infof("disconnecting connection %s, whose buffer is full", o.id)
+		o.ws.Close()
+	}
+
+	if frame.slot != nil {
+		delete(o.slots, frame.key)
+	}
+	atomic.AddUint64(&o.dropped, 1)
+	c.e.counters.dropped.Add(1)
+	c.e.recordConnectionError(TransportError, o.id, "", "", ErrBufferFull)
+	c.fullLocked(o)
+	return ErrBufferFull
+}
+
+// queuedLocked accounts for a frame queued on a connection. The caller
+// must hold o.queueLock.
+func (c *webSocketTransport) queuedLocked(o *connection, frame outFrame) {
+	c.e.counters.sent.Add(1)
+	queued := atomic.AddInt64(&o.queued, int64(len(frame.data)))
+	slow, recovered := o.watch.observe(&c.e.options, o.pending(), cap(o.out))
+	if slow {
+		c.e.connectionSlow(o.id, int(queued))
+		o.slowChanged(false, true)
+	}
+	if recovered {
+		o.slowChanged(false, false)
+	}
+}
+
+// discardLocked drops a frame taken off a connection's queue to make room
+// for another. The caller must hold o.queueLock.
+func (c *webSocketTransport) discardLocked(o *connection, frame outFrame) {
+	if s := frame.slot; s != nil {
+		frame.data = s.data
+		delete(o.slots, s.key)
+	}
+	atomic.AddInt64(&o.queued, -int64(len(frame.data)))
+	atomic.AddUint64(&o.dropped, 1)
+	c.e.counters.dropped.Add(1)
+	c.e.recordConnectionError(TransportError, o.id, "", "", ErrBufferFull)
+}
+
+// fullLocked records that a connection's buffer was found full, closing
+// the connection once it has been full for the SlowClientGracePeriod. The
+// caller must hold o.queueLock.
+func (c *webSocketTransport) fullLocked(o *connection) {
+	now := time.Now().UnixNano()
+	if atomic.CompareAndSwapInt64(&o.fullSince, 0, now) {
+		return
+	}
+	grace := c.e.runtime().SlowClientGracePeriod
+	if grace > 0 && time.Duration(now-atomic.LoadInt64(&o.fullSince)) > grace {
+		c.e.logger.Infof("disconnecting slow connection %s", o.id)
+		o.ws.Close()
+	}
+}
+
+// queueStats describes a connection's send queue.
+func (c *webSocketTransport) queueStats(cid string) (queueStats, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	o := c.connections[cid]
+	if o == nil {
+		return queueStats{}, false
+	}
+
+	o.queueLock.Lock()
+	defer o.queueLock.Unlock()
+	return queueStats{
+		frames:   o.pending(),
+		bytes:    int(atomic.LoadInt64(&o.queued)),
+		peak:     o.watch.peak,
+		expired:  atomic.LoadUint64(&o.expired),
+		rtt:      time.Duration(atomic.LoadInt64(&o.rtt)),
+		lastPing: atomic.LoadInt64(&o.lastPing),
+		lastPong: atomic.LoadInt64(&o.lastPong),
+	}, true
+}
+
+// release sends the frames held back while a connection's OnClientConnected
+// hooks ran, and stops holding them.
+func (c *webSocketTransport) release(o *connection) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	o.holdLock.Lock()
+	defer o.holdLock.Unlock()
+
+	o.holding = false
+	held := o.held
+	o.held = nil
+	if c.connections[o.id] != o {
+		return
+	}
+	for _, frame := range held {
+		c.enqueue(o, frame)
+	}
+}
+
+// hasRoom reports whether a connection's send buffer has room for another
+// frame. Connections that have gone report true, so that sending to them
+// fails.
+func (c *webSocketTransport) hasRoom(cid string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	o := c.connections[cid]
+	return o == nil || len(o.out) < cap(o.out)
+}
+
+// move sends a client the control frame telling it to renegotiate, or
+// closes its websocket when forced.
+func (c *webSocketTransport) move(cid string, force bool) {
+	if force {
+		c.lock.RLock()
+		if o := c.connections[cid]; o != nil {
+			o.closed(ReasonClosed)
+			o.ws.Close()
+		}
+		c.lock.RUnlock()
+		return
+	}
+
+	frame, err := c.e.encodeFrameFor(cid, &controlFrame{Command: "RECONNECT", Reason: reasonDraining})
+	if err != nil {
+		c.e.logger.Errorf("encoding reconnect for %s: %v", cid, err)
+		c.e.reportError(TransportError, cid, "", "", err)
+		return
+	}
+	c.send(cid, outFrame{data: frame, urgent: true})
+}
+
+// AddConnection starts keeping the frames sent to a client that has
+// negotiated a websocket, until it opens it; the connection is added then.
+func (c *webSocketTransport) AddConnection(cid string) {
+	c.earlyLock.Lock()
+	defer c.earlyLock.Unlock()
+	if _, ok := c.early[cid]; !ok {
+		c.early[cid] = nil
+	}
+}
+
+// expect starts keeping the frames sent to a client that is upgrading to
+// a websocket from long-polling, as AddConnection does, with the frames
+// handed over from its queue first.
+func (c *webSocketTransport) expect(cid string, frames []outFrame) {
+	c.earlyLock.Lock()
+	defer c.earlyLock.Unlock()
+	c.early[cid] = frames
+}
+
+// forgetEarly discards the frames kept for a client that negotiated a
+// websocket but never opened it.
+func (c *webSocketTransport) forgetEarly(cid string) {
+	c.earlyLock.Lock()
+	defer c.earlyLock.Unlock()
+	delete(c.early, cid)
+}
+
+// Close does nothing; the websockets are closed by listen once the
+// Exchange is done.
+func (c *webSocketTransport) Close() error {
+	return nil
+}
+
+// RemoveConnection sends a close frame with the reason and closes a
+// client's websocket. Its read loop then notices and removes the
+// connection.
+func (c *webSocketTransport) RemoveConnection(cid, reason string) {
+	c.forgetEarly(cid)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if o := c.connections[cid]; o != nil {
+		c.disconnectLocked(o, reason)
+	}
+}
 
-	if o != nil {
-		o.out <- buff.Bytes()
+// disconnectLocked sends a close frame with the reason and closes a
+// connection's websocket. The caller must hold c.lock, for reading at
+// least.
+func (c *webSocketTransport) disconnectLocked(o *connection, reason string) {
+	// control frames are limited to 125 bytes, two of them the code
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	msg := websocket.FormatCloseMessage(closeDisconnected, reason)
+	o.closed(reason)
+	o.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	o.ws.Close()
+}
+
+// has reports whether a connection has a websocket.
+func (c *webSocketTransport) has(cid string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, ok := c.connections[cid]
+	return ok
+}
+
+func (c *webSocketTransport) count() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.connections)
+}
+
+// droppedMessages records the number of dropped messages for each connection
+// that has had any.
+func (c *webSocketTransport) droppedMessages(r map[string]uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for id, o := range c.connections {
+		if n := atomic.LoadUint64(&o.dropped); n > 0 {
+			r[id] = n
+		}
 	}
 }
 
 func (c *connection) read() {
+	var scratch *bytes.Buffer
+	if jc, ok := c.codec.(*jsonCodec); ok && jc.unmarshal == nil {
+		scratch = new(bytes.Buffer)
+	}
 	for {
-		_, message, err := c.ws.ReadMessage()
+		limit := c.e.runtime().MaxMessageSize
+		c.ws.SetReadLimit(limit)
+		message, err := c.readMessage(scratch)
+		if err == websocket.ErrReadLimit {
+			c.e.counters.oversized.Add(1)
+			c.e.recordConnectionError(DecodeError, c.id, "", "", errMessageTooLarge)
+			c.e.logger.Infof("connection %s sent a message over %d bytes", c.id, limit)
+		}
+		if websocket.IsCloseError(err, closeProbeFailed) {
+			// the client falls back on long-polling
+			c.e.counters.probeFailed.Add(1)
+			c.e.logger.Infof("connection %s gave up on its websocket, which did not deliver the handshake in time", c.id)
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// the read deadline is only pushed back by pongs
+			c.notResponding(ReasonPongTimeout, err)
+		}
 		if err != nil {
+			c.closed(ReasonClosed)
 			break
 		}
 
-		var m webSocketClientMessage
-		err = json.Unmarshal(message, &m)
-		if err != nil {
-			fmt.Println("ERR:", err)
-			continue
+		c.e.counters.read.Add(1)
+		c.handle(message)
+		if scratch != nil && scratch.Cap() > maxReadScratch {
+			scratch = new(bytes.Buffer)
 		}
+	}
+
+	c.ws.Close()
+	close(c.gone)
+}
+
+// maxReadScratch bounds the memory the read loop keeps between messages;
+// scratch grown past it by a large message is let go.
+const maxReadScratch = 64 << 10
+
+// readMessage reads the next message from the websocket. With scratch, it
+// is read into it, reusing its memory, for a codec that copies what it
+// keeps of a frame as encoding/json does; the message is only valid until
+// the next is read.
+func (c *connection) readMessage(scratch *bytes.Buffer) ([]byte, error) {
+	if scratch == nil {
+		_, message, err := c.ws.ReadMessage()
+		return message, err
+	}
+	_, r, err := c.ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	scratch.Reset()
+	_, err = scratch.ReadFrom(r)
+	return scratch.Bytes(), err
+}
 
-		relay := c.e.getRelayByName(m.Relay, m.ConnectionID)
+// closed records why the websocket closed, reporting false if that was
+// recorded already.
+func (c *connection) closed(reason string) bool {
+	return c.cause.CompareAndSwap(nil, &reason)
+}
+
+// reason returns why the websocket closed, ReasonClosed if it is not known.
+func (c *connection) reason() string {
+	if r := c.cause.Load(); r != nil {
+		return *r
+	}
+	return ReasonClosed
+}
 
-		if m.Server {
-			err := c.e.callRelayMethod(relay, m.Method, m.Arguments...)
-			if err != nil {
-				fmt.Println("ERR:", err)
+// notResponding closes the websocket of a client that stopped answering
+// pings or could not be written to, err saying which, sending it a close
+// frame with the reason if it can. It does nothing if the websocket was
+// closed already, as writing to it then fails too.
+func (c *connection) notResponding(reason string, err error) {
+	if !c.closed(reason) {
+		return
+	}
+	c.e.logger.Infof("closing the websocket of %s: %v", c.id, err)
+	msg := websocket.FormatCloseMessage(closeNotResponding, reason)
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.ws.Close()
+}
+
+// handle dispatches a message read from the websocket. A panic while doing
+// so is logged and the message dropped, keeping the connection open.
+func (c *connection) handle(message []byte) {
+	defer func() {
+		if p := recover(); p != nil {
+			c.e.logger.Errorf("panic handling message from %s: %v\n%s", c.id, p, debug.Stack())
+			c.e.reportError(DispatchError, c.id, "", "", fmt.Errorf("relayr: panic: %v", p))
+		}
+	}()
+
+	c.e.logger.Debugf("connection %s received %s", c.id, message)
+	c.e.counters.received.Add(1)
+	c.e.touchClient(c.id)
+	c.e.tapFrame(c.id, tapInbound, message)
+
+	m, err := decodeFrame(c.codec, c.protocol, message)
+	if err != nil {
+		c.e.logger.Errorf("connection %s sent an invalid message: %v", c.id, err)
+		c.e.reportError(DecodeError, c.id, "", "", err)
+		return
+	}
+
+	// the ConnectionID is implied by the connection; one naming another
+	// client is forged
+	if m.ConnectionID != "" && m.ConnectionID != c.id {
+		c.e.logger.Errorf("connection %s sent a message as %s", c.id, m.ConnectionID)
+		c.e.sendResult(c.id, m.InvocationID, nil, errForgedConnectionID)
+		return
+	}
+
+	if m.Type == framePing {
+		c.e.sendFrame(c.id, "ping", &pingFrame{})
+		return
+	}
+	if m.Hub != "" {
+		c.e.receiveHubFrame(c.id, &m)
+		return
+	}
+	if m.Type == frameUploadChunk {
+		c.e.receiveUploadChunk(c.id, &m, len(message))
+		return
+	}
+	if m.Type == frameServerInvocation && m.Method == ackMethod {
+		c.e.receiveAck(c.id, m.Arguments)
+		return
+	}
+	if m.Type == frameServerInvocation && m.Method == cancelMethod {
+		c.e.receiveCancel(c.id, m.Arguments)
+		return
+	}
+	if m.Type == frameServerInvocation && m.Method == stateMethod {
+		c.e.receiveStateRequest(c.id, m.Arguments)
+		return
+	}
+	if m.Type == frameJoinGroup || m.Type == frameLeaveGroup {
+		changed, err := c.e.receiveGroupRequest(c.id, &m)
+		c.e.sendResult(c.id, m.InvocationID, changed, err)
+		return
+	}
+	if m.Type == frameServerInvocation {
+		if c.e.duplicateCall(c.id, &m) {
+			return
+		}
+		if err := c.e.allowCall(c.id, m.Relay, m.Method); err != nil {
+			c.e.forgetCall(c.id, m.CallID)
+			c.e.sendResult(c.id, m.InvocationID, nil, err)
+			return
+		}
+		if err := c.e.authorizeCall(c.id, "websocket", m.Relay, m.Method, m.Arguments); err != nil {
+			c.e.forgetCall(c.id, m.CallID)
+			c.e.sendResult(c.id, m.InvocationID, nil, err)
+			return
+		}
+		if m.Upload {
+			c.e.openUpload(c.id, m.InvocationID)
+		}
+		// run the call off the read loop so that it keeps going and
+		// notices if the client disconnects mid-call
+		err := c.e.runCall(c.id, m.Relay, m.Method, func() {
+			c.e.serveCall(m.Relay, c.id, "websocket", m.InvocationID, m.TraceParent, m.Method, m.Arguments, nil)
+		})
+		if err != nil {
+			c.e.forgetCall(c.id, m.CallID)
+			c.e.uploads.remove(c.id, m.InvocationID)
+			c.e.logger.Infof("refusing a call from %s: %v", c.id, err)
+			if m.InvocationID == "" {
+				c.e.sendError(c.id, err)
+			} else {
+				c.e.sendResult(c.id, m.InvocationID, nil, err)
 			}
-		} else {
-			c.c.CallClientFunction(relay, m.Method, m.Arguments)
 		}
+		return
 	}
 
-	c.ws.Close()
+	if !c.e.options.AllowClientEcho {
+		c.e.logger.Errorf("connection %s sent a call to client method %s", c.id, m.Method)
+		c.e.sendError(c.id, errClientEcho)
+		return
+	}
+	relay := c.e.getRelayByName(m.Relay, c.id)
+	if relay == nil {
+		err := &CallError{Relay: m.Relay, Reason: "does not exist"}
+		c.e.logger.Errorf("connection %s: %v", c.id, err)
+		c.e.reportError(DispatchError, c.id, m.Relay, m.Method, err)
+		c.e.sendError(c.id, err)
+		return
+	}
+	c.c.CallClientFunction(relay, m.Method, m.Arguments)
 }
 
 func (c *connection) write() {
-	for message := range c.out {
-		err := c.ws.WriteMessage(websocket.TextMessage, message)
+	o := c.e.options
+	batching := o.WriteBatchSize > 1 && c.caps.has(canBatch) && !c.codec.Binary()
+	for {
+		message, _, closed := c.next(true, nil)
+		if closed {
+			break
+		}
+		if !message.urgent {
+			c.throttle()
+		}
+		if !c.take(&message) {
+			continue
+		}
+		if !batching || message.binary || message.plain || message.urgent {
+			if err := c.writeFrame(message); err != nil {
+				c.writeFailed(err)
+				break
+			}
+			continue
+		}
+
+		frames, next, closed := c.batch(message.data)
+		err := c.writeBatch(frames)
+		for i := range frames {
+			frames[i] = nil
+		}
+		c.frames = frames[:0]
+		if err == nil && next != nil {
+			err = c.writeFrame(*next)
+		}
 		if err != nil {
+			c.writeFailed(err)
+			break
+		}
+		if closed {
 			break
 		}
 	}
 	c.ws.Close()
 }
+
+// writeFailed reports a write that failed, as it does once the client has
+// gone or has not read for the WriteTimeout. Closing the socket then ends
+// the read loop, which disconnects the client.
+func (c *connection) writeFailed(err error) {
+	c.e.logger.Debugf("writing to %s: %v", c.id, err)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.e.reportError(TransportError, c.id, "", "", err)
+	}
+	c.notResponding(ReasonWriteError, err)
+}
+
+// take readies a frame taken off out to be written, reporting false if it
+// has expired and is to be dropped instead.
+func (c *connection) take(message *outFrame) bool {
+	if s := message.slot; s != nil {
+		c.queueLock.Lock()
+		message.data, message.expires = s.data, s.expires
+		delete(c.slots, s.key)
+		c.queueLock.Unlock()
+	}
+	atomic.AddInt64(&c.queued, -int64(len(message.data)))
+	if expired(message.expires, time.Now()) {
+		atomic.AddUint64(&c.expired, 1)
+		c.e.counters.expired.Add(1)
+		return false
+	}
+	c.e.tapFrame(c.id, tapOutbound, message.data)
+	return true
+}
+
+// writeFrame writes a single frame as a message of its own.
+func (c *connection) writeFrame(message outFrame) error {
+	t := websocket.TextMessage
+	if message.binary || c.codec.Binary() {
+		t = websocket.BinaryMessage
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(c.e.options.WriteTimeout))
+	deflate, before := c.compress(len(message.data), message.plain)
+	err := c.ws.WriteMessage(t, message.data)
+	if err == nil {
+		c.wrote(len(message.data), message.urgent)
+	}
+	if err == nil && deflate {
+		c.deflated(len(message.data), before)
+	}
+	return err
+}
+
+// batch collects the frames waiting on out after first, up to the
+// WriteBatchSize and WriteBatchBytes, waiting up to the WriteBatchDelay
+// for more. A binary frame, an urgent one, or one written uncompressed,
+// cannot join the batch, so it ends it and is returned to be written
+// after it. closed reports that out was closed.
+func (c *connection) batch(first []byte) (frames [][]byte, next *outFrame, closed bool) {
+	o := c.e.options
+	frames = append(c.frames[:0], first)
+	size := len(first)
+
+	var wait <-chan time.Time
+	if o.WriteBatchDelay > 0 {
+		t := c.batchTimer
+		if t == nil {
+			t = time.NewTimer(o.WriteBatchDelay)
+			c.batchTimer = t
+		} else {
+			t.Reset(o.WriteBatchDelay)
+		}
+		defer stopTimer(t)
+		wait = t.C
+	}
+
+	for len(frames) < o.WriteBatchSize && (o.WriteBatchBytes <= 0 || size < o.WriteBatchBytes) {
+		message, got, closed := c.next(wait != nil, wait)
+		if closed {
+			return frames, nil, true
+		}
+		if !got {
+			return frames, nil, false
+		}
+		if !c.take(&message) {
+			continue
+		}
+		if message.binary || message.plain || message.urgent {
+			next := message
+			return frames, &next, false
+		}
+		frames = append(frames, message.data)
+		size += len(message.data)
+	}
+	return frames, nil, false
+}
+
+// stopTimer stops a timer, draining its channel if it fired and was not
+// received from, so that it can be Reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// the delimiters of the array a batch is written as
+var (
+	openBatch  = []byte{'['}
+	batchComma = []byte{','}
+	closeBatch = []byte{']'}
+)
+
+// writeBatch writes frames as a single message holding an array of them,
+// or on its own when there is just one.
+func (c *connection) writeBatch(frames [][]byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(c.e.options.WriteTimeout))
+	if len(frames) == 1 {
+		deflate, before := c.compress(len(frames[0]), false)
+		err := c.ws.WriteMessage(websocket.TextMessage, frames[0])
+		if err == nil {
+			c.wrote(len(frames[0]), false)
+		}
+		if err == nil && deflate {
+			c.deflated(len(frames[0]), before)
+		}
+		return err
+	}
+
+	size := len(frames) + 1 // the brackets and commas
+	for _, f := range frames {
+		size += len(f)
+	}
+	deflate, before := c.compress(size, false)
+	w, err := c.ws.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	w.Write(openBatch)
+	for i, f := range frames {
+		if i > 0 {
+			w.Write(batchComma)
+		}
+		w.Write(f)
+	}
+	w.Write(closeBatch)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.wrote(size, false)
+	if deflate {
+		c.deflated(size, before)
+	}
+	return nil
+}
@@ -0,0 +1,874 @@
+package relayr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	rclient "github.com/simon-whitehead/relayr/client"
+	"github.com/simon-whitehead/relayr/protocol"
+)
+
+func TestStalledClientDoesNotBlockBroadcasts(t *testing.T) {
+	const broadcasts = 200
+	e, srv := serve(t, ExchangeOptions{OutChannelSize: 8}, Ticker{})
+
+	// the stalled client never reads, so its socket and then its buffer
+	// fill up
+	_, stalled := openWebSocket(t, srv)
+	if err := e.AddToGroup("ticks", stalled); err != nil {
+		t.Fatal(err)
+	}
+	healthy := dial(t, srv, "websocket")
+	ticks := calls(healthy, "Ticker", "tick")
+	if err := healthy.Invoke(context.Background(), "Ticker", "Subscribe", "ticks"); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	for i := 0; i < broadcasts; i++ {
+		e.Clients(Ticker{}).Group("ticks").Call("tick", payload)
+		receive(t, ticks)
+	}
+	if elapsed := time.Since(start); elapsed > testTimeout {
+		t.Errorf("the broadcasts took %v to reach the healthy client", elapsed)
+	}
+
+	if dropped := e.DroppedMessages()[stalled]; dropped == 0 {
+		t.Error("no messages were dropped for the stalled client")
+	}
+	if _, ok := e.DroppedMessages()[healthy.ConnectionID()]; ok {
+		t.Error("messages were dropped for the healthy client")
+	}
+	if e.Stats().DroppedMessages == 0 {
+		t.Error("Stats reports no dropped messages")
+	}
+}
+
+func TestSlowClientGracePeriod(t *testing.T) {
+	gone := make(chan string, 1)
+	e, srv := serve(t, ExchangeOptions{
+		OutChannelSize:        8,
+		SlowClientGracePeriod: 100 * time.Millisecond,
+		ReconnectGracePeriod:  -1,
+		OnDisconnect: func(id string) {
+			gone <- id
+		},
+	}, Ticker{})
+	_, stalled := openWebSocket(t, srv)
+
+	payload := strings.Repeat("x", 64*1024)
+	deadline := time.After(testTimeout)
+	for {
+		e.Clients(Ticker{}).Client(stalled).Call("tick", payload)
+		select {
+		case id := <-gone:
+			if id != stalled {
+				t.Fatalf("disconnected %s", id)
+			}
+			return
+		case <-deadline:
+			t.Fatal("a client whose buffer stayed full past the grace period was not disconnected")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// malformedFrames are frames a client might send that name no relay or
+// method that exists, lack fields, or have fields of the wrong types.
+var malformedFrames = []string{
+	``,
+	`{`,
+	`null`,
+	`42`,
+	`"s"`,
+	`[]`,
+	`[1, "two"]`,
+	`{}`,
+	`{"T":"s"}`,
+	`{"T":"s","R":"Nope","M":"Add","A":[]}`,
+	`{"T":"s","R":"Calculator","M":"Nope","A":[]}`,
+	`{"T":"s","R":"Calculator","M":"Add"}`,
+	`{"T":"s","R":"Calculator","M":"Add","A":"2,3"}`,
+	`{"T":"s","R":"Calculator","M":"Add","A":["two","three"]}`,
+	`{"T":"s","R":"Calculator","M":"Add","A":[2]}`,
+	`{"T":"s","R":"Calculator","M":"Add","A":[2,3,4]}`,
+	`{"T":"s","R":7,"M":["Add"],"A":{}}`,
+	`{"T":"s","R":null,"M":null,"A":null,"I":null}`,
+	`{"T":"c","R":"Nope","M":"tick","A":[]}`,
+	`{"T":"j"}`,
+	`{"T":"l","G":""}`,
+	`{"T":"u","N":18446744073709551615}`,
+	`{"T":"?","R":"Calculator","M":"Add","A":[2,3]}`,
+	`{"T":"s","S":true,"R":"Calculator","M":"Add","A":[2,3],"I":{"nested":[]}}`,
+}
+
+// checks numbers the calls checkAlive makes.
+var checks atomic.Int64
+
+// checkAlive fails the test unless ws still answers calls, having been
+// sent frame.
+func checkAlive(t *testing.T, ws *websocket.Conn, frame string) {
+	t.Helper()
+	id := "alive-" + strconv.FormatInt(checks.Add(1), 10)
+	ws.WriteJSON(protocol.Inbound{Type: protocol.TypeServerInvocation, Relay: "Calculator", Method: "Add", Arguments: []interface{}{2, 3}, InvocationID: id})
+	if c := readCompletion(t, ws, id); c.Value != 5.0 {
+		t.Fatalf("after %q a call completed with %+v", frame, c)
+	}
+}
+
+func TestMalformedFramesKeepConnection(t *testing.T) {
+	_, srv := serve(t, ExchangeOptions{}, Calculator{})
+
+	t.Run("websocket", func(t *testing.T) {
+		ws, _ := openWebSocket(t, srv)
+		for _, frame := range malformedFrames {
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+				t.Fatalf("writing %q: %v", frame, err)
+			}
+			checkAlive(t, ws, frame)
+		}
+	})
+
+	t.Run("unknown relay", func(t *testing.T) {
+		ws, _ := openWebSocket(t, srv)
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"T":"s","R":"Nope","M":"Add","A":[]}`))
+		for {
+			var f protocol.ErrorFrame
+			frames := readFrames(t, ws)
+			if json.Unmarshal(frames[0], &f) == nil && f.Type == protocol.TypeError {
+				if f.Code != CodeUnknownRelay || !strings.Contains(f.Error, "Nope") {
+					t.Fatalf("an unknown relay was reported with %+v", f)
+				}
+				return
+			}
+		}
+	})
+
+	t.Run("longpoll", func(t *testing.T) {
+		cid := negotiate(t, srv, "longpoll").ConnectionID
+		for _, frame := range malformedFrames {
+			resp, err := http.Post(srv.URL+"/relayr/call?connectionId="+cid, "application/json", strings.NewReader(frame))
+			if err != nil {
+				t.Fatalf("posting %q: %v", frame, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				t.Fatalf("%q was answered with %d", frame, resp.StatusCode)
+			}
+			if status := callOverHTTP(t, srv, cid, "Calculator", "Add", 2, 3); status != http.StatusOK && status != http.StatusAccepted {
+				t.Fatalf("after %q a call was answered with %d", frame, status)
+			}
+		}
+	})
+}
+
+func FuzzWebSocketFrame(f *testing.F) {
+	for _, frame := range malformedFrames {
+		f.Add([]byte(frame))
+	}
+	_, srv := serve(f, ExchangeOptions{}, Calculator{})
+	ws, _ := openWebSocket(f, srv)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		if err := ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+			t.Fatalf("writing %q: %v", frame, err)
+		}
+		checkAlive(t, ws, string(frame))
+	})
+}
+
+func TestDuplicateWebSocketRefused(t *testing.T) {
+	gone := make(chan string, 1)
+	e, srv := serve(t, ExchangeOptions{OnDisconnect: func(id string) { gone <- id }}, Ticker{})
+	res := negotiate(t, srv, "websocket")
+	first, _, err := websocket.DefaultDialer.Dial(wsURL(srv, res), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	readFrames(t, first) // the handshake
+
+	// the second sockets race each other, and are all refused
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv, res), nil)
+			if err != nil {
+				t.Errorf("opening a second socket: %v", err)
+				return
+			}
+			defer ws.Close()
+			ws.SetReadDeadline(time.Now().Add(testTimeout))
+			for {
+				_, _, err := ws.ReadMessage()
+				if websocket.IsCloseError(err, closeDuplicateConnection) {
+					return
+				}
+				if err != nil {
+					t.Errorf("a second socket was closed with %v, want %d", err, closeDuplicateConnection)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the first socket is still the client's
+	if err := e.AddToGroup("ticks", res.ConnectionID); err != nil {
+		t.Fatal(err)
+	}
+	e.Clients(Ticker{}).Group("ticks").Call("tick", "after")
+	for ticked := false; !ticked; {
+		for _, inv := range clientCalls(t, readFrames(t, first)) {
+			ticked = ticked || inv.Method == "tick"
+		}
+	}
+	select {
+	case id := <-gone:
+		t.Fatalf("the client %s was disconnected as its second sockets closed", id)
+	default:
+	}
+}
+
+// waitDetached waits for the client cid to be detached, within its grace
+// period to reconnect.
+func waitDetached(t *testing.T, e *Exchange, cid string) {
+	t.Helper()
+	for deadline := time.Now().Add(testTimeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		e.mapLock.RLock()
+		_, ok := e.detached[cid]
+		e.mapLock.RUnlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("%s was not detached", cid)
+}
+
+func TestRapidReconnectKeepsNewSocket(t *testing.T) {
+	e, srv := serve(t, ExchangeOptions{}, Ticker{})
+	res := negotiate(t, srv, "websocket")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv, res), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFrames(t, ws) // the handshake
+	if err := e.AddToGroup("ticks", res.ConnectionID); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		// the client reconnects as soon as the server has noticed its old
+		// socket close, with the old connection's retirement racing the
+		// new socket
+		ws.Close()
+		waitDetached(t, e, res.ConnectionID)
+		body, _ := json.Marshal(protocol.Negotiation{T: "websocket", P: res.ConnectionID, V: protocol.Version})
+		resp, err := http.Post(srv.URL+"/relayr/negotiate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again protocol.NegotiationResponse
+		json.NewDecoder(resp.Body).Decode(&again)
+		resp.Body.Close()
+		if again.ConnectionID != res.ConnectionID {
+			t.Fatalf("reconnect %d was given %q, want %q", i, again.ConnectionID, res.ConnectionID)
+		}
+		if ws, _, err = websocket.DefaultDialer.Dial(wsURL(srv, again), nil); err != nil {
+			t.Fatalf("reconnect %d: %v", i, err)
+		}
+		readFrames(t, ws)
+	}
+	defer ws.Close()
+
+	// once the old sockets' disconnections have been handled, the new one
+	// is still the client's
+	time.Sleep(100 * time.Millisecond)
+	e.Clients(Ticker{}).Group("ticks").Call("tick", "after")
+	for ticked := false; !ticked; {
+		for _, inv := range clientCalls(t, readFrames(t, ws)) {
+			ticked = ticked || inv.Method == "tick"
+		}
+	}
+}
+
+func TestWriteTimeoutDropsNonReadingClient(t *testing.T) {
+	gone := make(chan string, 1)
+	e, srv := serve(t, ExchangeOptions{
+		WriteTimeout:         200 * time.Millisecond,
+		OutChannelSize:       1024,
+		ReconnectGracePeriod: -1,
+		OnDisconnectWithReason: func(id, reason string) {
+			gone <- reason
+		},
+	}, Ticker{})
+
+	// the socket is never read, so its writes block once the buffers
+	// between it and the server are full
+	_, cid := openWebSocket(t, srv)
+	payload := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	for i := 0; i < 512; i++ {
+		if e.Clients(Ticker{}).Client(cid).Call("tick", payload) != nil {
+			break
+		}
+	}
+
+	select {
+	case reason := <-gone:
+		if reason != ReasonWriteError {
+			t.Fatalf("the client was disconnected for %q, want %q", reason, ReasonWriteError)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("the blocked writer took %v to give up", elapsed)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("a client that never read was not disconnected")
+	}
+}
+
+func TestWebSocketBufferSizes(t *testing.T) {
+	e := newExchange(t, "http://localhost/relayr", ExchangeOptions{ReadBufferSize: 8192, WriteBufferSize: 16384})
+	other := newExchange(t, "http://localhost/relayr", ExchangeOptions{})
+	if e.upgrader.ReadBufferSize != 8192 || e.upgrader.WriteBufferSize != 16384 {
+		t.Errorf("the upgrader's buffers are %d and %d bytes", e.upgrader.ReadBufferSize, e.upgrader.WriteBufferSize)
+	}
+	if other.upgrader == e.upgrader || other.upgrader.ReadBufferSize != 1024 || other.upgrader.WriteBufferSize != 1024 {
+		t.Errorf("another Exchange's buffers are %d and %d bytes", other.upgrader.ReadBufferSize, other.upgrader.WriteBufferSize)
+	}
+}
+
+// tickPayload is what broadcaster sends as its nth tick: a string whose
+// length and letters vary, past maxPooledBuffer every so often, with
+// characters HTML escaping would change.
+func tickPayload(broadcaster, n int) string {
+	size := 10 + n*37%2000
+	if n%25 == 0 {
+		size = maxPooledBuffer + 1000
+	}
+	return strconv.Itoa(broadcaster) + "<&>" + strings.Repeat(string(rune('a'+(broadcaster+n)%26)), size)
+}
+
+// TestBatchedBroadcastsIntact broadcasts from several goroutines to
+// websocket clients sent batches, while they call the Exchange with
+// arguments of varying size, and checks every frame arrives whole, in
+// order, and unaltered, although the encode buffers, the frames of the
+// batches and the read scratch are reused.
+func TestBatchedBroadcastsIntact(t *testing.T) {
+	const clients, broadcasters, ticks = 4, 4, 100
+	e, srv := serve(t, ExchangeOptions{
+		WriteBatchSize:    16,
+		WriteBatchDelay:   time.Millisecond,
+		DisableHTMLEscape: true,
+		OutChannelSize:    broadcasters * ticks,
+		MaxMessageSize:    1 << 20, // for the calls past maxReadScratch
+	}, Ticker{}, Greeter{greeting: "hello"})
+
+	type tick struct {
+		broadcaster, n int
+		payload        string
+	}
+	received := make([][]tick, clients)
+	var lock sync.Mutex
+	var all sync.WaitGroup
+	all.Add(clients * broadcasters * ticks)
+	cs := make([]*rclient.Client, clients)
+	for i := range cs {
+		i := i
+		cs[i] = dial(t, srv, "websocket")
+		cs[i].On("Ticker", "tick", func(args []json.RawMessage) {
+			var tk tick
+			json.Unmarshal(args[0], &tk.broadcaster)
+			json.Unmarshal(args[1], &tk.n)
+			json.Unmarshal(args[2], &tk.payload)
+			lock.Lock()
+			received[i] = append(received[i], tk)
+			lock.Unlock()
+			all.Done()
+		})
+	}
+
+	var wg sync.WaitGroup
+	for b := 0; b < broadcasters; b++ {
+		wg.Add(1)
+		go func(b int) {
+			defer wg.Done()
+			for n := 0; n < ticks; n++ {
+				if err := e.Clients(Ticker{}).All("tick", b, n, tickPayload(b, n)); err != nil {
+					t.Errorf("broadcasting: %v", err)
+				}
+			}
+		}(b)
+	}
+	for _, c := range cs {
+		wg.Add(1)
+		go func(c *rclient.Client) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				name := tickPayload(n, n)
+				ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+				res, err := c.Call(ctx, "Greeter", "Greet", name)
+				cancel()
+				var greeting string
+				json.Unmarshal(res, &greeting)
+				if err != nil || greeting != "hello, "+name {
+					t.Errorf("Greet returned %.40q, %v", greeting, err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	arrived := make(chan struct{})
+	go func() {
+		all.Wait()
+		close(arrived)
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(testTimeout):
+		t.Fatal("not every tick arrived")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i, ticks := range received {
+		next := make([]int, broadcasters)
+		for _, tk := range ticks {
+			if tk.n != next[tk.broadcaster] {
+				t.Fatalf("client %d received tick %d of broadcaster %d, want %d", i, tk.n, tk.broadcaster, next[tk.broadcaster])
+			}
+			if tk.payload != tickPayload(tk.broadcaster, tk.n) {
+				t.Fatalf("client %d received tick %d of broadcaster %d altered: %.40q", i, tk.n, tk.broadcaster, tk.payload)
+			}
+			next[tk.broadcaster]++
+		}
+	}
+	if dropped := e.Stats().DroppedMessages; dropped != 0 {
+		t.Fatalf("%d messages were dropped", dropped)
+	}
+}
+
+// Teller is a relay whose method tells the tests which client it was
+// called as.
+type Teller struct{ callers chan string }
+
+func (k Teller) Withdraw(r *Relay) { k.callers <- r.ConnectionID }
+
+// checkCaller checks that Withdraw was called as want, or, if want is
+// empty, that it was not called.
+func (k Teller) checkCaller(t *testing.T, want string) {
+	t.Helper()
+	if want == "" {
+		select {
+		case got := <-k.callers:
+			t.Fatalf("Withdraw was called as %s", got)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return
+	}
+	select {
+	case got := <-k.callers:
+		if got != want {
+			t.Fatalf("Withdraw was called as %s, want %s", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Withdraw was not called")
+	}
+}
+
+func TestWebSocketForgedConnectionID(t *testing.T) {
+	teller := Teller{callers: make(chan string, 1)}
+	_, srv := serve(t, ExchangeOptions{}, teller)
+	victim := negotiate(t, srv, "longpoll").ConnectionID
+	ws, cid := openWebSocket(t, srv)
+
+	for i, tt := range []struct {
+		as, err, caller string
+	}{
+		{victim, errForgedConnectionID.Error(), ""},
+		{cid, "", cid},
+		{"", "", cid},
+	} {
+		id := strconv.Itoa(i)
+		frame, _ := json.Marshal(protocol.Inbound{
+			Type:         protocol.TypeServerInvocation,
+			Relay:        "Teller",
+			Method:       "Withdraw",
+			Arguments:    []interface{}{},
+			ConnectionID: tt.as,
+			InvocationID: id,
+		})
+		if err := ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+		if c := readCompletion(t, ws, id); c.Error != tt.err {
+			t.Fatalf("a call sent as %q completed with the error %q, want %q", tt.as, c.Error, tt.err)
+		}
+		teller.checkCaller(t, tt.caller)
+	}
+}
+
+func TestClientEcho(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		t.Run(strconv.FormatBool(allow), func(t *testing.T) {
+			_, srv := serve(t, ExchangeOptions{AllowClientEcho: allow}, Chat{})
+			other := calls(dial(t, srv, "websocket"), "Chat", "said")
+			ws, cid := openWebSocket(t, srv)
+
+			// echoed, if at all, to the sender alone
+			frame, _ := json.Marshal(protocol.Inbound{
+				Type:      protocol.TypeClientInvocation,
+				Relay:     "Chat",
+				Method:    "said",
+				Arguments: []interface{}{"hi"},
+			})
+			if err := ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Type   string `json:"T"`
+				Method string `json:"M"`
+				Error  string `json:"E"`
+			}
+			for got.Type == "" || got.Type == protocol.TypePing {
+				for _, f := range readFrames(t, ws) {
+					if json.Unmarshal(f, &got); got.Type != protocol.TypePing {
+						break
+					}
+				}
+			}
+			if allow && (got.Type != protocol.TypeClientInvocation || got.Method != "said") {
+				t.Fatalf("%s was answered %+v, want the call echoed", cid, got)
+			}
+			if !allow && (got.Type != protocol.TypeError || got.Error != errClientEcho.Error()) {
+				t.Fatalf("%s was answered %+v, want the call refused", cid, got)
+			}
+			select {
+			case args := <-other:
+				t.Fatalf("another client was sent %s", args)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+// listenTicks reads the messages of ws, into a buffer it reuses, until
+// it closes, marking one done on received for each carrying a tick.
+func listenTicks(ws *websocket.Conn, received *sync.WaitGroup) {
+	var buf bytes.Buffer
+	for {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		buf.Reset()
+		if _, err := buf.ReadFrom(r); err != nil {
+			return
+		}
+		if bytes.Contains(buf.Bytes(), []byte(`"tick"`)) {
+			received.Done()
+		}
+	}
+}
+
+// BenchmarkBroadcast1kClients broadcasts a call to 1000 websocket clients
+// at a time, each iteration ending once they have all received it.
+func BenchmarkBroadcast1kClients(b *testing.B) {
+	const clients = 1000
+	e, srv := serve(b, ExchangeOptions{OutChannelSize: 256}, Ticker{})
+	var received sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		ws, _ := openWebSocket(b, srv)
+		go listenTicks(ws, &received)
+	}
+	ops := e.Clients(Ticker{})
+	payload := strings.Repeat("x", 256)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		received.Add(clients)
+		if err := ops.All("tick", i, payload); err != nil {
+			b.Fatal(err)
+		}
+		received.Wait()
+	}
+}
+
+// listenBatches reads the messages of ws as listenTicks does, counting
+// them in frames and marking one done on received for each tick they
+// carry, batched or not.
+func listenBatches(ws *websocket.Conn, received *sync.WaitGroup, frames *atomic.Int64) {
+	var buf bytes.Buffer
+	for {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		buf.Reset()
+		if _, err := buf.ReadFrom(r); err != nil {
+			return
+		}
+		frames.Add(1)
+		if n := bytes.Count(buf.Bytes(), []byte(`"tick"`)); n > 0 {
+			received.Add(-n)
+		}
+	}
+}
+
+// BenchmarkWriteBatching sends 1000 websocket clients a second's worth of
+// calls at 50 a second, each iteration ending once they have all received
+// them, with write batching off and on, reporting the websocket messages
+// each iteration takes, the messages and calls delivered a second, and,
+// in ns/op, the time it takes all told.
+func BenchmarkWriteBatching(b *testing.B) {
+	const clients, perClient = 1000, 50
+	for _, batch := range []int{0, perClient} {
+		name := "off"
+		if batch > 0 {
+			name = "batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			e, srv := serve(b, ExchangeOptions{OutChannelSize: 256, WriteBatchSize: batch}, Ticker{})
+			var received sync.WaitGroup
+			var frames atomic.Int64
+			for i := 0; i < clients; i++ {
+				ws, _ := openWebSocket(b, srv)
+				go listenBatches(ws, &received, &frames)
+			}
+			ops := e.Clients(Ticker{})
+			payload := strings.Repeat("x", 64)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := frames.Load()
+			for i := 0; i < b.N; i++ {
+				received.Add(clients * perClient)
+				for j := 0; j < perClient; j++ {
+					if err := ops.All("tick", j, payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+				received.Wait()
+			}
+			sent := float64(frames.Load() - start)
+			b.ReportMetric(sent/float64(b.N), "frames/op")
+			b.ReportMetric(sent/b.Elapsed().Seconds(), "frames/s")
+			b.ReportMetric(float64(clients*perClient*b.N)/b.Elapsed().Seconds(), "calls/s")
+		})
+	}
+}
+
+// pipeListener serves HTTP over in-memory pipes, so that a benchmark can
+// open more websockets than the process may have file descriptors.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+// dial connects to the listener, whatever the address.
+func (l *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+
+func (pipeAddr) String() string { return "pipe" }
+
+// servePiped starts an Exchange made with opts, with the relays
+// registered, and members websocket clients in the group "room", all
+// connected over pipes, each listening for ticks as listenTicks does.
+func servePiped(b *testing.B, opts ExchangeOptions, members int, relays ...interface{}) (*Exchange, *sync.WaitGroup) {
+	b.Helper()
+	l := &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	mux := http.NewServeMux()
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	b.Cleanup(srv.Close)
+	e := newExchange(b, srv.URL+"/relayr", opts)
+	mux.Handle("/relayr/", e)
+	for _, r := range relays {
+		if err := e.RegisterRelay(r); err != nil {
+			b.Fatalf("registering %T: %v", r, err)
+		}
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: l.dial}}
+	dialer := &websocket.Dialer{NetDialContext: l.dial}
+	body, _ := json.Marshal(protocol.Negotiation{T: "websocket", V: protocol.Version})
+	received := new(sync.WaitGroup)
+	for i := 0; i < members; i++ {
+		resp, err := client.Post(srv.URL+"/relayr/negotiate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			b.Fatalf("negotiating: %v", err)
+		}
+		var res protocol.NegotiationResponse
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			b.Fatalf("negotiating: %v", err)
+		}
+		ws, _, err := dialer.Dial(wsURL(srv, res), nil)
+		if err != nil {
+			b.Fatalf("opening a websocket: %v", err)
+		}
+		b.Cleanup(func() { ws.Close() })
+		if _, _, err := ws.ReadMessage(); err != nil {
+			b.Fatalf("reading the handshake: %v", err)
+		}
+		if err := e.AddToGroup("room", res.ConnectionID); err != nil {
+			b.Fatal(err)
+		}
+		go listenTicks(ws, received)
+	}
+	return e, received
+}
+
+// BenchmarkBroadcastRaw queues a frame encoded ahead of time for each
+// member of a group of 10,000 websocket clients, each iteration ending
+// once they have all received it.
+func BenchmarkBroadcastRaw(b *testing.B) {
+	const members = 10000
+	e, received := servePiped(b, ExchangeOptions{OutChannelSize: 256}, members, Ticker{})
+	frame, _ := json.Marshal(protocol.ClientInvocation{
+		Type:      protocol.TypeClientInvocation,
+		Relay:     "Ticker",
+		Method:    "tick",
+		Arguments: []interface{}{strings.Repeat("x", 256)},
+	})
+
+	b.Run("10k", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			received.Add(members)
+			if err := e.BroadcastRaw("room", frame); err != nil {
+				b.Fatal(err)
+			}
+			received.Wait()
+		}
+	})
+}
+
+// BenchmarkBroadcastGroup calls a client method on a group of 10,000
+// websocket clients, each iteration ending once they have all received
+// it: encoded once for them all, and, with an outbound interceptor that
+// may change the call for each of them, encoded for each.
+func BenchmarkBroadcastGroup(b *testing.B) {
+	const members = 10000
+	e, received := servePiped(b, ExchangeOptions{OutChannelSize: 256}, members, Ticker{})
+	room := e.Clients(Ticker{}).Group("room")
+	payload := strings.Repeat("x", 256)
+
+	for _, each := range []bool{false, true} {
+		name := "once"
+		if each {
+			name = "each"
+			e.UseOutboundInterceptor(func(msg *OutgoingMessage, next func()) { next() })
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				received.Add(members)
+				if err := room.Call("tick", payload); err != nil {
+					b.Fatal(err)
+				}
+				received.Wait()
+			}
+		})
+	}
+}
+
+// BenchmarkReadLoop sends calls over a websocket as fast as the Exchange
+// reads them, up to a frame's worth at a time in flight, reading their
+// completions alongside.
+func BenchmarkReadLoop(b *testing.B) {
+	_, srv := serve(b, ExchangeOptions{}, Calculator{})
+	ws, _ := openWebSocket(b, srv)
+	defer ws.Close()
+	frames := make([][]byte, 64)
+	for i := range frames {
+		frames[i], _ = json.Marshal(protocol.Inbound{
+			Type:         protocol.TypeServerInvocation,
+			Relay:        "Calculator",
+			Method:       "Add",
+			Arguments:    []interface{}{i, i},
+			InvocationID: strconv.Itoa(i),
+		})
+	}
+
+	// sending waits for a slot, which a completion frees, so that the
+	// completions never overflow the connection's buffer
+	slots := make(chan struct{}, len(frames))
+	completed := make(chan struct{})
+	go func() {
+		defer close(completed)
+		for n := 0; n < b.N; {
+			_, m, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if !bytes.Contains(m, []byte(`"T":"p"`)) {
+				n++
+				<-slots
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		slots <- struct{}{}
+		if err := ws.WriteMessage(websocket.TextMessage, frames[i%len(frames)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	select {
+	case <-completed:
+	case <-time.After(testTimeout):
+		b.Fatal("not every call completed")
+	}
+}
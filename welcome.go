@@ -0,0 +1,66 @@
+package relayr
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// ClientConnectedHandler can be implemented by a relay to send clients
+// their initial state, such as the current contents of a room, as soon as
+// they connect.
+type ClientConnectedHandler interface {
+	// OnClientConnected is called on its own goroutine once a client has
+	// connected, and again whenever it reconnects, with r's ConnectionID
+	// set to the client's. Calls it makes to the client through
+	// r.Clients.Caller are delivered before any other messages sent to the
+	// client in the meantime, which are held back until it returns. It
+	// must not wait for the client, e.g. with CallWithAck.
+	OnClientConnected(r *Relay)
+}
+
+// hasConnectHooks reports whether any registered relay implements
+// ClientConnectedHandler.
+func (e *Exchange) hasConnectHooks() bool {
+	for _, r := range e.relayList() {
+		if _, ok := r.receiver.Interface().(ClientConnectedHandler); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// welcome runs the OnClientConnected hooks of every relay for a client
+// that has just connected, and then calls release to send the messages
+// held back meanwhile.
+func (e *Exchange) welcome(cid string, release func()) {
+	defer release()
+
+	for _, r := range e.relayList() {
+		receiver := r.receiver
+		if r.factory != nil {
+			receiver = relayReceiver(r.factory())
+		}
+		h, ok := receiver.Interface().(ClientConnectedHandler)
+		if !ok {
+			continue
+		}
+
+		relay := e.getRelayByName(r.Name, cid)
+		relay.UnderlyingStruct = receiver.Interface()
+		relay.welcome = true
+		e.runConnectHook(relay, h)
+	}
+}
+
+// runConnectHook calls a relay's OnClientConnected hook, logging rather
+// than propagating a panic.
+func (e *Exchange) runConnectHook(relay *Relay, h ClientConnectedHandler) {
+	defer func() {
+		if p := recover(); p != nil {
+			e.logger.Errorf("panic in %s.OnClientConnected for %s: %v\n%s", relay.Name, relay.ConnectionID, p, debug.Stack())
+			e.reportError(DispatchError, relay.ConnectionID, relay.Name, "OnClientConnected", fmt.Errorf("relayr: panic: %v", p))
+		}
+	}()
+
+	h.OnClientConnected(relay)
+}
@@ -0,0 +1,67 @@
+package relayr
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Lobby welcomes clients with the lobby's state, taking its time, and
+// adds them to the lobby as they connect.
+type Lobby struct {
+	connected chan string
+}
+
+func (l Lobby) OnClientConnected(r *Relay) {
+	r.Groups("lobby").Add(r.ConnectionID)
+	l.connected <- r.ConnectionID
+	// broadcasts to the lobby are made meanwhile
+	time.Sleep(100 * time.Millisecond)
+	r.Clients.Caller().Call("welcome", "state")
+}
+
+// Doorman is a relay whose OnClientConnected hook panics.
+type Doorman struct{}
+
+func (Doorman) OnClientConnected(r *Relay) {
+	panic("no entry")
+}
+
+func TestWelcomeBeforeBroadcasts(t *testing.T) {
+	for _, transport := range []string{"websocket", "longpoll"} {
+		t.Run(transport, func(t *testing.T) {
+			lobby := Lobby{connected: make(chan string, 1)}
+			// Doorman's hook panicking keeps neither Lobby's from running
+			// nor the connection from being served
+			e, srv := serve(t, ExchangeOptions{}, lobby, Doorman{})
+			c := dial(t, srv, transport)
+			received := make(chan string, 2)
+			for _, method := range []string{"welcome", "news"} {
+				method := method
+				c.On("Lobby", method, func(args []json.RawMessage) {
+					received <- method
+				})
+			}
+
+			select {
+			case <-lobby.connected:
+			case <-time.After(testTimeout):
+				t.Fatal("OnClientConnected was not called")
+			}
+			if err := e.Clients(Lobby{}).Group("lobby").Call("news", "headline"); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []string{"welcome", "news"} {
+				select {
+				case got := <-received:
+					if got != want {
+						t.Fatalf("received %s, want %s: the welcome comes first", got, want)
+					}
+				case <-time.After(testTimeout):
+					t.Fatalf("%s did not arrive", want)
+				}
+			}
+		})
+	}
+}